@@ -21,6 +21,18 @@ const (
 	// Required fields: Entity
 	OpPromulgate   Operation = "promulgate"
 	OpUnpromulgate Operation = "unpromulgate"
+
+	// OpUpload represents the upload of an entity archive.
+	// Required fields: User, Entity, BlobHash, Size
+	OpUpload Operation = "upload"
+
+	// OpDelete represents the deletion of an entity.
+	// Required fields: User, Entity, BlobHash, Size
+	OpDelete Operation = "delete"
+
+	// OpYank represents the withdrawal of an entity from a channel.
+	// Required fields: User, Entity, Channel
+	OpYank Operation = "yank"
 )
 
 // ACL represents an access control list.
@@ -31,9 +43,12 @@ type ACL struct {
 
 // Entry represents an audit log entry.
 type Entry struct {
-	Time   time.Time  `json:"time"`
-	User   string     `json:"user"`
-	Op     Operation  `json:"op"`
-	Entity *charm.URL `json:"entity,omitempty"`
-	ACL    *ACL       `json:"acl,omitempty"`
+	Time     time.Time  `json:"time"`
+	User     string     `json:"user"`
+	Op       Operation  `json:"op"`
+	Entity   *charm.URL `json:"entity,omitempty"`
+	ACL      *ACL       `json:"acl,omitempty"`
+	BlobHash string     `json:"blob-hash,omitempty"`
+	Size     int64      `json:"size,omitempty"`
+	Channel  string     `json:"channel,omitempty"`
 }
@@ -0,0 +1,142 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// The channelcheck command verifies that the Published field of each
+// entity agrees with the ChannelEntities field of its base entity and,
+// when the -fix flag is given, reconciles them, treating the base
+// entity as authoritative.
+package main // import "gopkg.in/juju/charmstore.v5/cmd/channelcheck"
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/juju/loggo"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v5/config"
+	"gopkg.in/juju/charmstore.v5/internal/charm"
+	"gopkg.in/juju/charmstore.v5/internal/charmstore"
+	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
+)
+
+var logger = loggo.GetLogger("channelcheck")
+
+var (
+	fix           = flag.Bool("fix", false, "repair inconsistencies as well as reporting them")
+	filter        = flag.String("filter", "", "JSON MongoDB query restricting the base entities checked, e.g. {\"name\": \"wordpress\"}")
+	loggingConfig = flag.String("logging-config", "INFO", "specify log levels for modules e.g. <root>=TRACE")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [options] <config path>\n", filepath.Base(os.Args[0]))
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+	}
+	if *loggingConfig != "" {
+		if err := loggo.ConfigureLoggers(*loggingConfig); err != nil {
+			fmt.Fprintf(os.Stderr, "cannot configure loggers: %v", err)
+			os.Exit(1)
+		}
+	}
+	if err := run(flag.Arg(0)); err != nil {
+		logger.Errorf("cannot run: %v", err)
+		os.Exit(1)
+	}
+}
+
+func run(confPath string) error {
+	var query bson.M
+	if *filter != "" {
+		if err := bson.UnmarshalJSON([]byte(*filter), &query); err != nil {
+			return errgo.Notef(err, "invalid filter %q", *filter)
+		}
+	}
+	logger.Debugf("reading config file %q", confPath)
+	conf, err := config.Read(confPath)
+	if err != nil {
+		return errgo.Notef(err, "cannot read config file %q", confPath)
+	}
+	session, err := mgo.Dial(conf.MongoURL)
+	if err != nil {
+		return errgo.Notef(err, "cannot dial mongo at %q", conf.MongoURL)
+	}
+	defer session.Close()
+	dbName := "juju"
+	if conf.Database != "" {
+		dbName = conf.Database
+	}
+	db := session.DB(dbName)
+
+	pool, err := charmstore.NewPool(db, nil, nil, charmstore.ServerParams{
+		CollectionPrefix:    conf.CollectionPrefix,
+		BlobStorePrefix:     conf.BlobStorePrefix,
+		BlobStoreShardDepth: conf.BlobStoreShardDepth,
+	})
+	if err != nil {
+		return errgo.Notef(err, "cannot create a new store")
+	}
+	defer pool.Close()
+	store := pool.Store()
+	defer store.Close()
+
+	var checked, invalid, failed int
+	iter := store.DB.BaseEntities().Find(query).Select(charmstore.FieldSelector("_id")).Iter()
+	var baseEntity mongodoc.BaseEntity
+	for iter.Next(&baseEntity) {
+		baseURL := baseEntity.URL
+		checked++
+		problems, err := store.VerifyChannelConsistency(baseURL)
+		if err != nil {
+			logger.Errorf("cannot check channels of %v: %v", baseURL, err)
+			failed++
+			continue
+		}
+		if len(problems) == 0 {
+			continue
+		}
+		invalid++
+		for _, p := range problems {
+			logProblem(baseURL, p)
+		}
+		if !*fix {
+			continue
+		}
+		if err := store.FixChannelConsistency(baseURL, problems); err != nil {
+			logger.Errorf("cannot fix channels of %v: %v", baseURL, err)
+			failed++
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return errgo.Notef(err, "cannot iterate base entities")
+	}
+	logger.Infof("checked %d base entities, %d with inconsistent channels, %d failed", checked, invalid, failed)
+	if failed > 0 {
+		return errgo.Newf("cannot check %d base entities", failed)
+	}
+	return nil
+}
+
+func logProblem(baseURL *charm.URL, p charmstore.Inconsistency) {
+	action := "found"
+	if *fix {
+		action = "fixing"
+	}
+	switch p.Kind {
+	case charmstore.HeadNotFound:
+		logger.Infof("%s %s: %s head for series %q in %v refers to missing entity %v", action, p.Kind, p.Channel, p.Series, baseURL, p.Entity)
+	case charmstore.HeadNotPublished:
+		logger.Infof("%s %s: %s head for series %q in %v is not published to %s: %v", action, p.Kind, p.Channel, p.Series, baseURL, p.Channel, p.Entity)
+	default:
+		logger.Infof("%s %s: %v is published to %s but has no head there", action, p.Kind, p.Entity, p.Channel)
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"path/filepath"
 
 	"github.com/gorilla/handlers"
+	"github.com/juju/charmrepo/v6/csclient/params"
 	"github.com/juju/loggo"
 	"gopkg.in/errgo.v1"
 	"gopkg.in/goose.v2/identity"
@@ -108,20 +109,46 @@ func serve(conf *config.Config) error {
 		AgentUsername:                  conf.AgentUsername,
 		AgentKey:                       conf.AgentKey,
 		StatsCacheMaxAge:               conf.StatsCacheMaxAge.Duration,
+		CharmMetricsLimit:              conf.CharmMetricsLimit,
+		MaxMetaResponseEntities:        conf.MaxMetaResponseEntities,
+		MaxMetaIncludes:                conf.MaxMetaIncludes,
+		NewRevisionMaxAttempts:         conf.NewRevisionMaxAttempts,
+		MongoRetryAttempts:             conf.MongoRetryAttempts,
+		CollectionPrefix:               conf.CollectionPrefix,
+		BlobStorePrefix:                conf.BlobStorePrefix,
+		BlobStoreShardDepth:            conf.BlobStoreShardDepth,
 		MaxMgoSessions:                 conf.MaxMgoSessions,
 		HTTPRequestWaitDuration:        conf.RequestTimeout.Duration,
 		SearchCacheMaxAge:              conf.SearchCacheMaxAge.Duration,
+		GroupCacheMaxAge:               conf.GroupCacheMaxAge.Duration,
 		PublicKeyLocator:               keyring,
 		MinUploadPartSize:              conf.MinUploadPartSize,
 		MaxUploadPartSize:              conf.MaxUploadPartSize,
 		MaxUploadParts:                 conf.MaxUploadParts,
+		MaxBundleWithCharmsSize:        conf.MaxBundleWithCharmsSize,
+		MaxBundleWithCharmsCount:       conf.MaxBundleWithCharmsCount,
+		ArchiveCacheMaxAge:             conf.ArchiveCacheMaxAge.Duration,
+		MaxBundleSize:                  conf.MaxBundleSize,
+		MaxArchiveSize:                 conf.MaxArchiveSize,
+		MaxBundleApplications:          conf.MaxBundleApplications,
 		RunBlobStoreGC:                 true,
+		CompressBlobs:                  conf.CompressBlobs,
+		LintOnUpload:                   conf.LintOnUpload,
+		DedupExtraInfoWrites:           conf.DedupExtraInfoWrites,
+		UploadContentTypes:             conf.UploadContentTypes,
+		IngestionErrorWebhook:          conf.IngestionErrorWebhook,
 		DockerRegistryAddress:          conf.DockerRegistryAddress,
 		DockerRegistryAuthCertificates: conf.DockerRegistryAuthCertificates.Certificates,
 		DockerRegistryAuthKey:          conf.DockerRegistryAuthKey.Key,
 		DockerRegistryTokenDuration:    conf.DockerRegistryTokenDuration.Duration,
 		DisableSlowMetadata:            conf.DisableSlowMetadata,
 		ReadOnly:                       conf.ReadOnly,
+		UploadBlocklist:                conf.UploadBlocklist,
+		AutoPromulgateUsers:            conf.AutoPromulgateUsers,
+		ApprovalRequiredChannels:       conf.ApprovalRequiredChannels,
+		RequirePublishedForDownload:    conf.RequirePublishedForDownload,
+		BlobCacheDir:                   conf.BlobCacheDir,
+		BlobCacheMaxSize:               conf.BlobCacheMaxSize,
 	}
 	switch conf.BlobStore {
 	case config.MongoDBBlobStore:
@@ -140,6 +167,41 @@ func serve(conf *config.Config) error {
 	default:
 		return errgo.Newf("unknown blob store type")
 	}
+	switch conf.SecondaryBlobStore {
+	case "":
+		// No secondary blob store.
+	case config.SwiftBlobStore:
+		cred := &identity.Credentials{
+			URL:        conf.SecondarySwiftAuthURL,
+			User:       conf.SecondarySwiftUsername,
+			Secrets:    conf.SecondarySwiftSecret,
+			Region:     conf.SecondarySwiftRegion,
+			TenantName: conf.SecondarySwiftTenant,
+		}
+		cfg.NewSecondaryBlobBackend = func(db *mgo.Database) blobstore.Backend {
+			return blobstore.NewSwiftBackend(cred, conf.SecondarySwiftAuthMode.Mode, conf.SecondarySwiftBucket, conf.TempDir)
+		}
+	default:
+		return errgo.Newf("unknown secondary blob store type")
+	}
+
+	if len(conf.BlobEncryptionKeys) > 0 {
+		cfg.BlobEncryptionKeys = make(map[string][]byte)
+		for id, key := range conf.BlobEncryptionKeys {
+			cfg.BlobEncryptionKeys[id] = key.Key
+		}
+		cfg.BlobEncryptionKeyID = conf.BlobEncryptionKeyID
+	}
+
+	if conf.GroupMembers != nil {
+		cfg.GroupMembers = func(group string) ([]string, error) {
+			members, ok := conf.GroupMembers[group]
+			if !ok {
+				return nil, errgo.WithCausef(nil, params.ErrNotFound, "group %q not found", group)
+			}
+			return members, nil
+		}
+	}
 
 	if conf.AuditLogFile != "" {
 		cfg.AuditLogger = &lumberjack.Logger{
@@ -174,8 +236,21 @@ func serve(conf *config.Config) error {
 		}
 		handler = handlers.CombinedLoggingHandler(accesslog, handler)
 	}
-	logger.Infof("starting the API server")
-	return http.ListenAndServe(conf.APIAddr, handler)
+	if conf.TLSCertFile == "" {
+		logger.Infof("starting the API server")
+		return http.ListenAndServe(conf.APIAddr, handler)
+	}
+	tlsConfig, err := conf.TLSConfig()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	httpServer := &http.Server{
+		Addr:      conf.APIAddr,
+		Handler:   handler,
+		TLSConfig: tlsConfig,
+	}
+	logger.Infof("starting the API server with TLS")
+	return httpServer.ListenAndServeTLS(conf.TLSCertFile, conf.TLSKeyFile)
 }
 
 func addPublicKey(ring *bakery.PublicKeyRing, loc string, key *bakery.PublicKey) error {
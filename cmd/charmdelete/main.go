@@ -30,6 +30,7 @@ var (
 	dryrun            = flag.Bool("dry-run", false, "Don't actually delete; just print them.")
 	verbose           = flag.Bool("verbose", false, "")
 	deletePromulgated = flag.Bool("delete-promulgated", false, "Delete a charm even if it is promulgated.")
+	idsOnly           = flag.Bool("ids-only", false, "Fetch only entity ids while scanning, to reduce load on large stores.")
 )
 
 func main() {
@@ -74,15 +75,22 @@ func run(confPath string) error {
 		return errgo.Notef(err, "cannot dial mongo at %q", conf.MongoURL)
 	}
 	defer session.Close()
-	db := session.DB("juju")
+	dbName := "juju"
+	if conf.Database != "" {
+		dbName = conf.Database
+	}
+	db := session.DB(dbName)
 
-	pool, err := charmstore.NewPool(db, si, nil, charmstore.ServerParams{})
+	pool, err := charmstore.NewPool(db, si, nil, charmstore.ServerParams{
+		CollectionPrefix:    conf.CollectionPrefix,
+		BlobStorePrefix:     conf.BlobStorePrefix,
+		BlobStoreShardDepth: conf.BlobStoreShardDepth,
+	})
 	if err != nil {
 		return errgo.Notef(err, "cannot create a new store")
 	}
 	store := pool.Store()
 	defer store.Close()
-	entities := store.DB.Entities()
 
 	query := bson.D{{"user", *user}}
 	if *user == "" {
@@ -93,48 +101,66 @@ func run(confPath string) error {
 			query = nil
 		}
 	}
-	if query != nil {
-		var entity mongodoc.Entity
-		iter := entities.Find(query).Iter()
+	if query == nil {
+		return nil
+	}
+	counter := 0
+	handle := func(entity *mongodoc.Entity) {
+		if entity.PromulgatedURL != nil && !*deletePromulgated {
+			fmt.Printf("not deleting promulgated charm %s\n", entity.URL)
+			return
+		}
+		if *verbose {
+			fmt.Printf("deleting %s\n", entity.URL)
+		}
+		if !*dryrun {
+			deleteEntity(entity, store)
+		}
+		counter++
+		if counter%100 == 0 {
+			logger.Infof("%d entities deleted", counter)
+		}
+	}
+	if *idsOnly {
+		// Only the entity ids are needed to delete entities, so
+		// avoid fetching the full documents.
+		iter, err := store.IterEntityURLs(query)
+		if err != nil {
+			return errgo.Mask(err)
+		}
 		defer iter.Close()
-
-		counter := 0
-		for iter.Next(&entity) {
-			if entity.PromulgatedURL != nil && !*deletePromulgated {
-				fmt.Printf("not deleting promulgated charm %s\n", entity.URL)
-				continue
-			}
-			if *verbose {
-				fmt.Printf("deleting %s\n", entity.URL)
-			}
-			if !*dryrun {
-				deleteEntity(&entity, store)
-			}
-			counter++
-			if counter%100 == 0 {
-				logger.Infof("%d entities deleted", counter)
-			}
+		for iter.Next() {
+			handle(iter.Entity())
+		}
+		if err := iter.Err(); err != nil {
+			return errgo.Notef(err, "cannot iterate entities")
 		}
+		return nil
+	}
+	var entity mongodoc.Entity
+	iter := store.DB.Entities().Find(query).Iter()
+	defer iter.Close()
+	for iter.Next(&entity) {
+		handle(&entity)
+	}
+	if err := iter.Err(); err != nil {
+		return errgo.Notef(err, "cannot iterate entities")
 	}
-
 	return nil
 }
 
 func deleteEntity(entity *mongodoc.Entity, store *charmstore.Store) {
+	baseURL := mongodoc.BaseURL(entity.URL)
 	err := store.DB.Entities().Remove(bson.D{{"_id", entity.URL}})
 	if err != nil {
 		logger.Errorf("could not remove entity for charm %s %s", entity.URL, err)
 	} else if *verbose {
 		fmt.Printf("deleted entity %s\n", entity.URL)
 	}
-	c, err := store.DB.Entities().Find(bson.D{{"baseurl", entity.BaseURL}}).Count()
-
-	if c == 0 {
-		err = store.DB.BaseEntities().Remove(bson.D{{"_id", entity.BaseURL}})
-		if err != nil {
-			logger.Errorf("could not remove base_entity for charm %s %s", entity.BaseURL, err)
-		} else if *verbose {
-			fmt.Printf("deleted base entity %s\n", entity.BaseURL)
-		}
+	removed, err := store.RemoveBaseEntityIfOrphaned(baseURL)
+	if err != nil {
+		logger.Errorf("could not remove base_entity for charm %s %s", baseURL, err)
+	} else if removed && *verbose {
+		fmt.Printf("deleted base entity %s\n", baseURL)
 	}
 }
@@ -0,0 +1,203 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// The contentscheck command verifies that the archive file locations
+// cached in the Contents field of entities refer to the correct files
+// in their archives, and repairs any that do not. With the -rebuild
+// flag, it instead recomputes the cached locations of the README and
+// icon files of every entity.
+package main // import "gopkg.in/juju/charmstore.v5/cmd/contentscheck"
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/juju/loggo"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/goose.v2/identity"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v5/config"
+	"gopkg.in/juju/charmstore.v5/internal/blobstore"
+	"gopkg.in/juju/charmstore.v5/internal/charmstore"
+	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5/internal/router"
+)
+
+var logger = loggo.GetLogger("contentscheck")
+
+var (
+	dryRun        = flag.Bool("dry-run", false, "report invalid entries without changing them")
+	filter        = flag.String("filter", "", "JSON MongoDB query restricting the entities checked, e.g. {\"name\": \"wordpress\"}")
+	rebuild       = flag.Bool("rebuild", false, "recompute the cached README and icon locations of all entities")
+	loggingConfig = flag.String("logging-config", "INFO", "specify log levels for modules e.g. <root>=TRACE")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [options] <config path>\n", filepath.Base(os.Args[0]))
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+	}
+	if *loggingConfig != "" {
+		if err := loggo.ConfigureLoggers(*loggingConfig); err != nil {
+			fmt.Fprintf(os.Stderr, "cannot configure loggers: %v", err)
+			os.Exit(1)
+		}
+	}
+	if err := run(flag.Arg(0)); err != nil {
+		logger.Errorf("cannot run: %v", err)
+		os.Exit(1)
+	}
+}
+
+func run(confPath string) error {
+	query := bson.D{{"contents", bson.D{{"$exists", true}}}}
+	if *rebuild {
+		query = bson.D{}
+	}
+	if *filter != "" {
+		var f bson.M
+		if err := bson.UnmarshalJSON([]byte(*filter), &f); err != nil {
+			return errgo.Notef(err, "invalid filter %q", *filter)
+		}
+		query = bson.D{{"$and", []interface{}{query, f}}}
+	}
+	logger.Debugf("reading config file %q", confPath)
+	conf, err := config.Read(confPath)
+	if err != nil {
+		return errgo.Notef(err, "cannot read config file %q", confPath)
+	}
+	session, err := mgo.Dial(conf.MongoURL)
+	if err != nil {
+		return errgo.Notef(err, "cannot dial mongo at %q", conf.MongoURL)
+	}
+	defer session.Close()
+	dbName := "juju"
+	if conf.Database != "" {
+		dbName = conf.Database
+	}
+	db := session.DB(dbName)
+
+	params := charmstore.ServerParams{
+		CollectionPrefix:    conf.CollectionPrefix,
+		BlobStorePrefix:     conf.BlobStorePrefix,
+		CompressBlobs:       conf.CompressBlobs,
+		BlobStoreShardDepth: conf.BlobStoreShardDepth,
+	}
+	switch conf.BlobStore {
+	case config.MongoDBBlobStore:
+	case config.SwiftBlobStore:
+		cred := &identity.Credentials{
+			URL:        conf.SwiftAuthURL,
+			User:       conf.SwiftUsername,
+			Secrets:    conf.SwiftSecret,
+			Region:     conf.SwiftRegion,
+			TenantName: conf.SwiftTenant,
+		}
+		params.NewBlobBackend = func(db *mgo.Database) blobstore.Backend {
+			return blobstore.NewSwiftBackend(cred, conf.SwiftAuthMode.Mode, conf.SwiftBucket, conf.TempDir)
+		}
+	default:
+		return errgo.Newf("unknown blob store type")
+	}
+	if len(conf.BlobEncryptionKeys) > 0 {
+		params.BlobEncryptionKeys = make(map[string][]byte)
+		for id, key := range conf.BlobEncryptionKeys {
+			params.BlobEncryptionKeys[id] = key.Key
+		}
+		params.BlobEncryptionKeyID = conf.BlobEncryptionKeyID
+	}
+	pool, err := charmstore.NewPool(db, nil, nil, params)
+	if err != nil {
+		return errgo.Notef(err, "cannot create a new store")
+	}
+	defer pool.Close()
+	store := pool.Store()
+	defer store.Close()
+
+	if *rebuild {
+		return rebuildContents(store, query)
+	}
+
+	var checked, invalid, failed int
+	iter, err := store.IterEntityURLs(query)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	for iter.Next() {
+		id := charmstore.EntityResolvedURL(iter.Entity())
+		checked++
+		problems, err := store.CheckContents(id, !*dryRun)
+		if err != nil {
+			logger.Errorf("cannot check contents of %v: %v", id, err)
+			failed++
+			continue
+		}
+		for _, p := range problems {
+			logProblem(id, p)
+		}
+		if len(problems) > 0 {
+			invalid++
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return errgo.Notef(err, "cannot iterate entities")
+	}
+	logger.Infof("checked %d entities, %d with invalid contents, %d failed", checked, invalid, failed)
+	if failed > 0 {
+		return errgo.Newf("cannot check %d entities", failed)
+	}
+	return nil
+}
+
+// rebuildContents rebuilds the cached README and icon locations of all
+// the entities matching the given query.
+func rebuildContents(store *charmstore.Store, query bson.D) error {
+	var rebuilt, failed int
+	iter, err := store.IterEntityURLs(query)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	for iter.Next() {
+		id := charmstore.EntityResolvedURL(iter.Entity())
+		if *dryRun {
+			logger.Infof("would rebuild contents of %v", id)
+			rebuilt++
+			continue
+		}
+		if err := store.RebuildContents(id, mongodoc.FileReadMe, mongodoc.FileIcon); err != nil {
+			logger.Errorf("cannot rebuild contents of %v: %v", id, err)
+			failed++
+			continue
+		}
+		rebuilt++
+	}
+	if err := iter.Err(); err != nil {
+		return errgo.Notef(err, "cannot iterate entities")
+	}
+	logger.Infof("rebuilt contents of %d entities, %d failed", rebuilt, failed)
+	if failed > 0 {
+		return errgo.Newf("cannot rebuild contents of %d entities", failed)
+	}
+	return nil
+}
+
+func logProblem(id *router.ResolvedURL, p charmstore.ContentsProblem) {
+	action := "fixed"
+	if *dryRun {
+		action = "found"
+	}
+	if p.Unknown {
+		logger.Infof("%s unknown contents entry %q in %v", action, p.FileId, id)
+		return
+	}
+	logger.Infof("%s invalid contents entry %q in %v: cached %+v, actual %+v", action, p.FileId, id, p.Cached, p.Actual)
+}
@@ -69,9 +69,17 @@ func populate(confPath string) error {
 		return errgo.Notef(err, "cannot dial mongo at %q", conf.MongoURL)
 	}
 	defer session.Close()
-	db := session.DB("juju")
+	dbName := "juju"
+	if conf.Database != "" {
+		dbName = conf.Database
+	}
+	db := session.DB(dbName)
 
-	pool, err := charmstore.NewPool(db, si, nil, charmstore.ServerParams{})
+	pool, err := charmstore.NewPool(db, si, nil, charmstore.ServerParams{
+		CollectionPrefix:    conf.CollectionPrefix,
+		BlobStorePrefix:     conf.BlobStorePrefix,
+		BlobStoreShardDepth: conf.BlobStoreShardDepth,
+	})
 	if err != nil {
 		return errgo.Notef(err, "cannot create a new store")
 	}
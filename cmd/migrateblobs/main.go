@@ -71,7 +71,11 @@ func run(confPath string) error {
 		return errgo.Notef(err, "cannot dial mongo at %q", config.MongoURL)
 	}
 	defer session.Close()
-	db := session.DB("juju")
+	dbName := "juju"
+	if config.Database != "" {
+		dbName = config.Database
+	}
+	db := session.DB(dbName)
 
 	cred := &identity.Credentials{
 		URL:        config.SwiftAuthURL,
@@ -88,7 +92,11 @@ func run(confPath string) error {
 	dst := swift.New(client)
 
 	logger.Infof("migrating entity blobs")
-	counter, alreadyExistsCounter, err := migrate(db.GridFS("entitystore"), dst, config.SwiftBucket)
+	blobPrefix := config.BlobStorePrefix
+	if blobPrefix == "" {
+		blobPrefix = "entitystore"
+	}
+	counter, alreadyExistsCounter, err := migrate(db.GridFS(config.CollectionPrefix+blobPrefix), dst, config.SwiftBucket)
 	logger.Infof("Total entities migrated %d, already existing %d", counter, alreadyExistsCounter)
 	if err != nil {
 		return errgo.Notef(err, "cannot migrate entity blobs")
@@ -0,0 +1,102 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// The orphancleanup command removes base entities that no longer have
+// any entities, for example because all their revisions have been
+// deleted. Names reserved before anything was uploaded are kept.
+package main // import "gopkg.in/juju/charmstore.v5/cmd/orphancleanup"
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/juju/loggo"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2"
+
+	"gopkg.in/juju/charmstore.v5/config"
+	"gopkg.in/juju/charmstore.v5/internal/charmstore"
+)
+
+var logger = loggo.GetLogger("orphancleanup")
+
+var (
+	loggingConfig = flag.String("logging-config", "", "specify log levels for modules e.g. <root>=TRACE")
+	dryrun        = flag.Bool("dry-run", false, "Don't actually remove; just print the orphaned base entities.")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [options] <config path>\n", filepath.Base(os.Args[0]))
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+	}
+	if *loggingConfig != "" {
+		if err := loggo.ConfigureLoggers(*loggingConfig); err != nil {
+			fmt.Fprintf(os.Stderr, "cannot configure loggers: %v", err)
+			os.Exit(1)
+		}
+	}
+	if err := run(flag.Arg(0)); err != nil {
+		logger.Errorf("cannot run: %v", err)
+		os.Exit(1)
+	}
+}
+
+func run(confPath string) error {
+	logger.Debugf("reading config file %q", confPath)
+	conf, err := config.Read(confPath)
+	if err != nil {
+		return errgo.Notef(err, "cannot read config file %q", confPath)
+	}
+	session, err := mgo.Dial(conf.MongoURL)
+	if err != nil {
+		return errgo.Notef(err, "cannot dial mongo at %q", conf.MongoURL)
+	}
+	defer session.Close()
+	dbName := "juju"
+	if conf.Database != "" {
+		dbName = conf.Database
+	}
+	db := session.DB(dbName)
+
+	pool, err := charmstore.NewPool(db, nil, nil, charmstore.ServerParams{
+		CollectionPrefix:    conf.CollectionPrefix,
+		BlobStorePrefix:     conf.BlobStorePrefix,
+		BlobStoreShardDepth: conf.BlobStoreShardDepth,
+	})
+	if err != nil {
+		return errgo.Notef(err, "cannot create a new store")
+	}
+	defer pool.Close()
+	store := pool.Store()
+	defer store.Close()
+
+	urls, err := store.OrphanedBaseEntities()
+	if err != nil {
+		return errgo.Notef(err, "cannot find orphaned base entities")
+	}
+	removed := 0
+	for _, url := range urls {
+		if *dryrun {
+			fmt.Printf("%s\n", url)
+			continue
+		}
+		ok, err := store.RemoveBaseEntityIfOrphaned(url)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if ok {
+			fmt.Printf("removed %s\n", url)
+			removed++
+		}
+	}
+	logger.Infof("%d of %d orphaned base entities removed", removed, len(urls))
+	return nil
+}
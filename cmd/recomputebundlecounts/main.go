@@ -0,0 +1,110 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// The recomputebundlecounts command recalculates the unit and machine
+// counts of every bundle in the charm store from its stored bundle
+// data. It is intended for refreshing the counts after the counting
+// logic has changed.
+package main // import "gopkg.in/juju/charmstore.v5/cmd/recomputebundlecounts"
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/juju/loggo"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v5/config"
+	"gopkg.in/juju/charmstore.v5/elasticsearch"
+	"gopkg.in/juju/charmstore.v5/internal/charmstore"
+	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
+)
+
+var logger = loggo.GetLogger("recomputebundlecounts")
+
+var (
+	index         = flag.String("index", "cs", "Name of the search index to update.")
+	loggingConfig = flag.String("logging-config", "", "specify log levels for modules e.g. <root>=TRACE")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [options] <config path>\n", filepath.Base(os.Args[0]))
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+	}
+	if *loggingConfig != "" {
+		if err := loggo.ConfigureLoggers(*loggingConfig); err != nil {
+			fmt.Fprintf(os.Stderr, "cannot configure loggers: %v", err)
+			os.Exit(1)
+		}
+	}
+	if err := run(flag.Arg(0)); err != nil {
+		logger.Errorf("cannot run: %v", err)
+		os.Exit(1)
+	}
+}
+
+func run(confPath string) error {
+	logger.Debugf("reading config file %q", confPath)
+	conf, err := config.Read(confPath)
+	if err != nil {
+		return errgo.Notef(err, "cannot read config file %q", confPath)
+	}
+	var si *charmstore.SearchIndex
+	if conf.ESAddr != "" {
+		si = &charmstore.SearchIndex{
+			Database: &elasticsearch.Database{
+				Addr: conf.ESAddr,
+			},
+			Index: *index,
+		}
+	}
+	session, err := mgo.Dial(conf.MongoURL)
+	if err != nil {
+		return errgo.Notef(err, "cannot dial mongo at %q", conf.MongoURL)
+	}
+	defer session.Close()
+	dbName := "juju"
+	if conf.Database != "" {
+		dbName = conf.Database
+	}
+	db := session.DB(dbName)
+
+	pool, err := charmstore.NewPool(db, si, nil, charmstore.ServerParams{
+		CollectionPrefix:    conf.CollectionPrefix,
+		BlobStorePrefix:     conf.BlobStorePrefix,
+		BlobStoreShardDepth: conf.BlobStoreShardDepth,
+	})
+	if err != nil {
+		return errgo.Notef(err, "cannot create a new store")
+	}
+	defer pool.Close()
+	store := pool.Store()
+	defer store.Close()
+
+	iter := store.DB.Entities().Find(bson.D{{"series", "bundle"}}).Select(charmstore.FieldSelector("promulgated-url")).Iter()
+	defer iter.Close()
+	var entity mongodoc.Entity
+	count := 0
+	for iter.Next(&entity) {
+		rurl := charmstore.EntityResolvedURL(&entity)
+		if err := store.RecomputeBundleCounts(rurl); err != nil {
+			return errgo.Notef(err, "cannot recompute counts of %v", &rurl.URL)
+		}
+		count++
+	}
+	if err := iter.Close(); err != nil {
+		return errgo.Notef(err, "cannot iterate bundles")
+	}
+	logger.Infof("recomputed the counts of %d bundles", count)
+	return nil
+}
@@ -7,7 +7,9 @@ package config // import "gopkg.in/juju/charmstore.v5/config"
 
 import (
 	"crypto"
+	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/pem"
 	"fmt"
 	"io/ioutil"
@@ -15,6 +17,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/juju/charmrepo/v6/csclient/params"
 	"gopkg.in/errgo.v1"
 	"gopkg.in/goose.v2/identity"
 	"gopkg.in/macaroon-bakery.v2-unstable/bakery"
@@ -23,46 +26,87 @@ import (
 
 type Config struct {
 	// TODO(rog) rename this to MongoAddr - it's not a URL.
-	MongoURL                       string            `yaml:"mongo-url,omitempty"`
-	AuditLogFile                   string            `yaml:"audit-log-file,omitempty"`
-	AuditLogMaxSize                int               `yaml:"audit-log-max-size,omitempty"`
-	AuditLogMaxAge                 int               `yaml:"audit-log-max-age,omitempty"`
-	APIAddr                        string            `yaml:"api-addr,omitempty"`
-	AuthUsername                   string            `yaml:"auth-username,omitempty"`
-	AuthPassword                   string            `yaml:"auth-password,omitempty"`
-	ESAddr                         string            `yaml:"elasticsearch-addr,omitempty"` // elasticsearch is optional
-	IdentityPublicKey              *bakery.PublicKey `yaml:"identity-public-key,omitempty"`
-	IdentityLocation               string            `yaml:"identity-location"`
-	TermsPublicKey                 *bakery.PublicKey `yaml:"terms-public-key,omitempty"`
-	TermsLocation                  string            `yaml:"terms-location,omitempty"`
-	AgentUsername                  string            `yaml:"agent-username,omitempty"`
-	AgentKey                       *bakery.KeyPair   `yaml:"agent-key,omitempty"`
-	MaxMgoSessions                 int               `yaml:"max-mgo-sessions,omitempty"`
-	RequestTimeout                 DurationString    `yaml:"request-timeout,omitempty"`
-	StatsCacheMaxAge               DurationString    `yaml:"stats-cache-max-age,omitempty"`
-	SearchCacheMaxAge              DurationString    `yaml:"search-cache-max-age,omitempty"`
-	Database                       string            `yaml:"database,omitempty"`
-	AccessLog                      string            `yaml:"access-log"`
-	MinUploadPartSize              int64             `yaml:"min-upload-part-size"`
-	MaxUploadPartSize              int64             `yaml:"max-upload-part-size"`
-	MaxUploadParts                 int               `yaml:"max-upload-parts"`
-	BlobStore                      BlobStoreType     `yaml:"blobstore"`
-	SwiftAuthURL                   string            `yaml:"swift-auth-url"`
-	SwiftEndpointURL               string            `yaml:"swift-endpoint-url"`
-	SwiftUsername                  string            `yaml:"swift-username"`
-	SwiftSecret                    string            `yaml:"swift-secret"`
-	SwiftBucket                    string            `yaml:"swift-bucket"`
-	SwiftRegion                    string            `yaml:"swift-region"`
-	SwiftTenant                    string            `yaml:"swift-tenant"`
-	SwiftAuthMode                  *SwiftAuthMode    `yaml:"swift-authmode"`
-	LoggingConfig                  string            `yaml:"logging-config"`
-	DockerRegistryAddress          string            `yaml:"docker-registry-address"`
-	DockerRegistryAuthCertificates X509Certificates  `yaml:"docker-registry-auth-certs"`
-	DockerRegistryAuthKey          X509PrivateKey    `yaml:"docker-registry-auth-key"`
-	DockerRegistryTokenDuration    DurationString    `yaml:"docker-registry-token-duration"`
-	DisableSlowMetadata            bool              `yaml:"disable-slow-metadata"`
-	TempDir                        string            `yaml:"tempdir"`
-	ReadOnly                       bool              `yaml:"read-only"`
+	MongoURL                       string              `yaml:"mongo-url,omitempty"`
+	AuditLogFile                   string              `yaml:"audit-log-file,omitempty"`
+	AuditLogMaxSize                int                 `yaml:"audit-log-max-size,omitempty"`
+	AuditLogMaxAge                 int                 `yaml:"audit-log-max-age,omitempty"`
+	APIAddr                        string              `yaml:"api-addr,omitempty"`
+	AuthUsername                   string              `yaml:"auth-username,omitempty"`
+	AuthPassword                   string              `yaml:"auth-password,omitempty"`
+	ESAddr                         string              `yaml:"elasticsearch-addr,omitempty"` // elasticsearch is optional
+	IdentityPublicKey              *bakery.PublicKey   `yaml:"identity-public-key,omitempty"`
+	IdentityLocation               string              `yaml:"identity-location"`
+	TermsPublicKey                 *bakery.PublicKey   `yaml:"terms-public-key,omitempty"`
+	TermsLocation                  string              `yaml:"terms-location,omitempty"`
+	AgentUsername                  string              `yaml:"agent-username,omitempty"`
+	AgentKey                       *bakery.KeyPair     `yaml:"agent-key,omitempty"`
+	MaxMgoSessions                 int                 `yaml:"max-mgo-sessions,omitempty"`
+	RequestTimeout                 DurationString      `yaml:"request-timeout,omitempty"`
+	StatsCacheMaxAge               DurationString      `yaml:"stats-cache-max-age,omitempty"`
+	CharmMetricsLimit              int                 `yaml:"charm-metrics-limit"`
+	MaxMetaResponseEntities        int                 `yaml:"max-meta-response-entities"`
+	MaxMetaIncludes                int                 `yaml:"max-meta-includes"`
+	NewRevisionMaxAttempts         int                 `yaml:"new-revision-max-attempts"`
+	MongoRetryAttempts             int                 `yaml:"mongo-retry-attempts"`
+	SearchCacheMaxAge              DurationString      `yaml:"search-cache-max-age,omitempty"`
+	GroupCacheMaxAge               DurationString      `yaml:"group-cache-max-age,omitempty"`
+	GroupMembers                   map[string][]string `yaml:"group-members"`
+	Database                       string              `yaml:"database,omitempty"`
+	CollectionPrefix               string              `yaml:"collection-prefix,omitempty"`
+	BlobStorePrefix                string              `yaml:"blobstore-prefix,omitempty"`
+	BlobStoreShardDepth            int                 `yaml:"blobstore-shard-depth"`
+	AccessLog                      string              `yaml:"access-log"`
+	MinUploadPartSize              int64               `yaml:"min-upload-part-size"`
+	MaxUploadPartSize              int64               `yaml:"max-upload-part-size"`
+	MaxUploadParts                 int                 `yaml:"max-upload-parts"`
+	MaxBundleWithCharmsSize        int64               `yaml:"max-bundle-with-charms-size"`
+	MaxBundleWithCharmsCount       int                 `yaml:"max-bundle-with-charms-count"`
+	ArchiveCacheMaxAge             DurationString      `yaml:"archive-cache-max-age,omitempty"`
+	MaxBundleSize                  int64               `yaml:"max-bundle-size"`
+	MaxArchiveSize                 int64               `yaml:"max-archive-size"`
+	MaxBundleApplications          int                 `yaml:"max-bundle-applications"`
+	BlobStore                      BlobStoreType       `yaml:"blobstore"`
+	CompressBlobs                  bool                `yaml:"compress-blobs"`
+	LintOnUpload                   bool                `yaml:"lint-on-upload"`
+	DedupExtraInfoWrites           bool                `yaml:"dedup-extra-info-writes"`
+	UploadContentTypes             []string            `yaml:"upload-content-types"`
+	IngestionErrorWebhook          string              `yaml:"ingestion-error-webhook"`
+	SwiftAuthURL                   string              `yaml:"swift-auth-url"`
+	SwiftEndpointURL               string              `yaml:"swift-endpoint-url"`
+	SwiftUsername                  string              `yaml:"swift-username"`
+	SwiftSecret                    string              `yaml:"swift-secret"`
+	SwiftBucket                    string              `yaml:"swift-bucket"`
+	SwiftRegion                    string              `yaml:"swift-region"`
+	SwiftTenant                    string              `yaml:"swift-tenant"`
+	SwiftAuthMode                  *SwiftAuthMode      `yaml:"swift-authmode"`
+	SecondaryBlobStore             BlobStoreType       `yaml:"secondary-blobstore"`
+	SecondarySwiftAuthURL          string              `yaml:"secondary-blobstore-swift-auth-url"`
+	SecondarySwiftUsername         string              `yaml:"secondary-blobstore-swift-username"`
+	SecondarySwiftSecret           string              `yaml:"secondary-blobstore-swift-secret"`
+	SecondarySwiftBucket           string              `yaml:"secondary-blobstore-swift-bucket"`
+	SecondarySwiftRegion           string              `yaml:"secondary-blobstore-swift-region"`
+	SecondarySwiftTenant           string              `yaml:"secondary-blobstore-swift-tenant"`
+	SecondarySwiftAuthMode         *SwiftAuthMode      `yaml:"secondary-blobstore-swift-authmode"`
+	BlobEncryptionKeys             EncryptionKeys      `yaml:"blob-encryption-keys"`
+	BlobEncryptionKeyID            string              `yaml:"blob-encryption-key-id"`
+	BlobCacheDir                   string              `yaml:"blob-cache-dir"`
+	BlobCacheMaxSize               int64               `yaml:"blob-cache-max-size"`
+	LoggingConfig                  string              `yaml:"logging-config"`
+	DockerRegistryAddress          string              `yaml:"docker-registry-address"`
+	DockerRegistryAuthCertificates X509Certificates    `yaml:"docker-registry-auth-certs"`
+	DockerRegistryAuthKey          X509PrivateKey      `yaml:"docker-registry-auth-key"`
+	DockerRegistryTokenDuration    DurationString      `yaml:"docker-registry-token-duration"`
+	DisableSlowMetadata            bool                `yaml:"disable-slow-metadata"`
+	TempDir                        string              `yaml:"tempdir"`
+	ReadOnly                       bool                `yaml:"read-only"`
+	UploadBlocklist                []string            `yaml:"upload-blocklist"`
+	AutoPromulgateUsers            []string            `yaml:"auto-promulgate-users"`
+	ApprovalRequiredChannels       []params.Channel    `yaml:"approval-required-channels"`
+	RequirePublishedForDownload    bool                `yaml:"require-published-for-download"`
+	TLSCertFile                    string              `yaml:"tls-cert-file"`
+	TLSKeyFile                     string              `yaml:"tls-key-file"`
+	TLSMinVersion                  string              `yaml:"tls-min-version"`
+	TLSCipherSuites                []string            `yaml:"tls-cipher-suites"`
 }
 
 type BlobStoreType string
@@ -126,12 +170,129 @@ func (c *Config) validate() error {
 	default:
 		return errgo.Newf("invalid blob store type %q", c.BlobStore)
 	}
+	switch c.SecondaryBlobStore {
+	case "":
+	case SwiftBlobStore:
+		needString("secondary-blobstore-swift-auth-url", c.SecondarySwiftAuthURL)
+		needString("secondary-blobstore-swift-username", c.SecondarySwiftUsername)
+		needString("secondary-blobstore-swift-secret", c.SecondarySwiftSecret)
+		needString("secondary-blobstore-swift-bucket", c.SecondarySwiftBucket)
+		needString("secondary-blobstore-swift-region", c.SecondarySwiftRegion)
+		needString("secondary-blobstore-swift-tenant", c.SecondarySwiftTenant)
+		if c.SecondarySwiftAuthMode == nil {
+			missing = append(missing, "secondary-blobstore-swift-authmode")
+		}
+	default:
+		return errgo.Newf("invalid secondary blob store type %q", c.SecondaryBlobStore)
+	}
+	if c.BlobEncryptionKeyID != "" {
+		if _, ok := c.BlobEncryptionKeys[c.BlobEncryptionKeyID]; !ok {
+			return errgo.Newf("blob encryption key %q not found in blob-encryption-keys", c.BlobEncryptionKeyID)
+		}
+	}
+	if c.CompressBlobs && (len(c.BlobEncryptionKeys) > 0 || c.BlobEncryptionKeyID != "") {
+		return errgo.New("compress-blobs cannot be used with blob encryption")
+	}
+	if c.BlobCacheDir != "" && (len(c.BlobEncryptionKeys) > 0 || c.BlobEncryptionKeyID != "") {
+		return errgo.New("blob-cache-dir cannot be used with blob encryption")
+	}
+	if c.CharmMetricsLimit < 0 {
+		return errgo.Newf("invalid charm-metrics-limit %d", c.CharmMetricsLimit)
+	}
+	if c.MaxMetaResponseEntities < 0 {
+		return errgo.Newf("invalid max-meta-response-entities %d", c.MaxMetaResponseEntities)
+	}
+	if c.MaxMetaIncludes < 0 {
+		return errgo.Newf("invalid max-meta-includes %d", c.MaxMetaIncludes)
+	}
+	if c.NewRevisionMaxAttempts < 0 {
+		return errgo.Newf("invalid new-revision-max-attempts %d", c.NewRevisionMaxAttempts)
+	}
+	// The maximum matches the one accepted by charmstore.NewPool.
+	if c.MongoRetryAttempts < 0 || c.MongoRetryAttempts > 10 {
+		return errgo.Newf("invalid mongo-retry-attempts %d", c.MongoRetryAttempts)
+	}
+	for _, ch := range c.ApprovalRequiredChannels {
+		if !params.ValidChannels[ch] || ch == params.UnpublishedChannel {
+			return errgo.Newf("invalid channel %q in approval-required-channels", ch)
+		}
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return errgo.Newf("tls-cert-file and tls-key-file must be specified together")
+	}
+	if _, err := c.TLSConfig(); err != nil {
+		return errgo.Mask(err)
+	}
+	// The maximum depth matches blobstore.MaxShardDepth.
+	if c.BlobStoreShardDepth < 0 || c.BlobStoreShardDepth > 8 {
+		return errgo.Newf("invalid blobstore-shard-depth %d", c.BlobStoreShardDepth)
+	}
+	if c.BlobCacheMaxSize < 0 {
+		return errgo.Newf("invalid blob-cache-max-size %d", c.BlobCacheMaxSize)
+	}
 	if len(missing) != 0 {
 		return errgo.Newf("missing fields %s in config file", strings.Join(missing, ", "))
 	}
 	return nil
 }
 
+// DefaultTLSMinVersion holds the minimum TLS version used when
+// tls-min-version is not specified.
+const DefaultTLSMinVersion = tls.VersionTLS12
+
+// DefaultTLSCipherSuites holds the cipher suites used when
+// tls-cipher-suites is not specified. All of them provide forward
+// secrecy and authenticated encryption.
+var DefaultTLSCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSConfig returns the TLS configuration to be used by the API server
+// when tls-cert-file and tls-key-file are specified. Only cipher suites
+// without known security problems may be named in tls-cipher-suites.
+// Note that the cipher suites do not apply to TLS 1.3 connections,
+// whose cipher suites are not configurable.
+func (c *Config) TLSConfig() (*tls.Config, error) {
+	conf := &tls.Config{
+		MinVersion:   DefaultTLSMinVersion,
+		CipherSuites: DefaultTLSCipherSuites,
+	}
+	if c.TLSMinVersion != "" {
+		v, ok := tlsVersions[c.TLSMinVersion]
+		if !ok {
+			return nil, errgo.Newf("invalid tls-min-version %q", c.TLSMinVersion)
+		}
+		conf.MinVersion = v
+	}
+	if len(c.TLSCipherSuites) > 0 {
+		suites := make(map[string]uint16)
+		for _, suite := range tls.CipherSuites() {
+			suites[suite.Name] = suite.ID
+		}
+		conf.CipherSuites = make([]uint16, len(c.TLSCipherSuites))
+		for i, name := range c.TLSCipherSuites {
+			id, ok := suites[name]
+			if !ok {
+				return nil, errgo.Newf("unknown cipher suite %q in tls-cipher-suites", name)
+			}
+			conf.CipherSuites[i] = id
+		}
+	}
+	return conf, nil
+}
+
 // Read reads a charm store configuration file from the
 // given path.
 func Read(path string) (*Config, error) {
@@ -170,6 +331,25 @@ func (dp *DurationString) UnmarshalText(data []byte) error {
 	return nil
 }
 
+// EncryptionKeys holds a set of symmetric encryption
+// keys indexed by key id.
+type EncryptionKeys map[string]EncryptionKey
+
+// EncryptionKey holds a symmetric encryption key that
+// unmarshals from a base64-encoded string.
+type EncryptionKey struct {
+	Key []byte
+}
+
+func (k *EncryptionKey) UnmarshalText(data []byte) error {
+	key, err := base64.StdEncoding.DecodeString(string(data))
+	if err != nil {
+		return errgo.Notef(err, "cannot decode encryption key")
+	}
+	k.Key = key
+	return nil
+}
+
 type X509Certificates struct {
 	Certificates []*x509.Certificate
 }
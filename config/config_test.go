@@ -5,6 +5,7 @@ package config_test
 
 import (
 	"crypto/ecdsa"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
 	"io/ioutil"
@@ -12,6 +13,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/juju/charmrepo/v6/csclient/params"
 	jujutesting "github.com/juju/testing"
 	jc "github.com/juju/testing/checkers"
 	gc "gopkg.in/check.v1"
@@ -51,7 +53,16 @@ agent-key:
   private: lsvcDkapKoFxIyjX9/eQgb3s41KVwPMISFwAJdVCZ70=
   public: +qNbDWly3kRTDVv2UN03hrv/CBt4W6nxY5dHdw+KJFA=
 stats-cache-max-age: 1h
+charm-metrics-limit: 50
+max-meta-response-entities: 200
+max-meta-includes: 30
+new-revision-max-attempts: 5
+mongo-retry-attempts: 3
 search-cache-max-age: 15m
+group-cache-max-age: 5m
+collection-prefix: staging_
+blobstore-prefix: blobs
+blobstore-shard-depth: 2
 request-timeout: 500ms
 max-mgo-sessions: 10
 blobstore: swift
@@ -62,6 +73,18 @@ swift-bucket: bucket
 swift-region: somewhere
 swift-tenant: a-tenant
 swift-authmode: userpass
+secondary-blobstore: swift
+secondary-blobstore-swift-auth-url: 'https://bar.com'
+secondary-blobstore-swift-username: alice
+secondary-blobstore-swift-secret: secret2
+secondary-blobstore-swift-bucket: bucket2
+secondary-blobstore-swift-region: elsewhere
+secondary-blobstore-swift-tenant: b-tenant
+secondary-blobstore-swift-authmode: userpassv3
+blob-encryption-keys:
+  key1: MDEyMzQ1Njc4OWFiY2RlZg==
+  key2: ZmVkY2JhOTg3NjU0MzIxMA==
+blob-encryption-key-id: key2
 logging-config: INFO
 docker-registry-address: 0.1.3.5:1000
 docker-registry-auth-certs: |
@@ -93,6 +116,34 @@ docker-registry-token-duration: 1h10m
 tempdir: /var/tmp/charmstore
 disable-slow-metadata: true
 read-only: true
+max-bundle-with-charms-size: 2147483648
+max-bundle-with-charms-count: 50
+archive-cache-max-age: 24h
+max-bundle-size: 1048576
+max-archive-size: 104857600
+max-bundle-applications: 20
+lint-on-upload: true
+dedup-extra-info-writes: true
+upload-content-types:
+  - application/zip
+  - application/x-zip-compressed
+ingestion-error-webhook: https://example.com/hooks/ingestion
+upload-blocklist:
+  - "*/microsoft-*"
+  - "bob/*"
+auto-promulgate-users:
+  - charmers
+approval-required-channels:
+  - stable
+require-published-for-download: true
+group-members:
+  charmers: [bob, alice]
+tls-cert-file: /etc/charmstore/cert.pem
+tls-key-file: /etc/charmstore/key.pem
+tls-min-version: "1.3"
+tls-cipher-suites:
+  - TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384
+  - TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384
 `
 
 func (s *ConfigSuite) readConfig(c *gc.C, content string) (*config.Config, error) {
@@ -133,18 +184,40 @@ func (s *ConfigSuite) TestRead(c *gc.C) {
 				mustParseKey("lsvcDkapKoFxIyjX9/eQgb3s41KVwPMISFwAJdVCZ70="),
 			},
 		},
-		StatsCacheMaxAge:      config.DurationString{time.Hour},
-		RequestTimeout:        config.DurationString{500 * time.Millisecond},
-		MaxMgoSessions:        10,
-		SearchCacheMaxAge:     config.DurationString{15 * time.Minute},
-		BlobStore:             config.SwiftBlobStore,
-		SwiftAuthURL:          "https://foo.com",
-		SwiftUsername:         "bob",
-		SwiftSecret:           "secret",
-		SwiftBucket:           "bucket",
-		SwiftRegion:           "somewhere",
-		SwiftTenant:           "a-tenant",
-		SwiftAuthMode:         &config.SwiftAuthMode{identity.AuthUserPass},
+		StatsCacheMaxAge:        config.DurationString{time.Hour},
+		CharmMetricsLimit:       50,
+		MaxMetaResponseEntities: 200,
+		MaxMetaIncludes:         30,
+		NewRevisionMaxAttempts:  5,
+		MongoRetryAttempts:      3,
+		RequestTimeout:          config.DurationString{500 * time.Millisecond},
+		MaxMgoSessions:          10,
+		SearchCacheMaxAge:       config.DurationString{15 * time.Minute},
+		GroupCacheMaxAge:        config.DurationString{5 * time.Minute},
+		CollectionPrefix:        "staging_",
+		BlobStorePrefix:         "blobs",
+		BlobStoreShardDepth:     2,
+		BlobStore:               config.SwiftBlobStore,
+		SwiftAuthURL:            "https://foo.com",
+		SwiftUsername:           "bob",
+		SwiftSecret:             "secret",
+		SwiftBucket:             "bucket",
+		SwiftRegion:             "somewhere",
+		SwiftTenant:             "a-tenant",
+		SwiftAuthMode:           &config.SwiftAuthMode{identity.AuthUserPass},
+		SecondaryBlobStore:      config.SwiftBlobStore,
+		SecondarySwiftAuthURL:   "https://bar.com",
+		SecondarySwiftUsername:  "alice",
+		SecondarySwiftSecret:    "secret2",
+		SecondarySwiftBucket:    "bucket2",
+		SecondarySwiftRegion:    "elsewhere",
+		SecondarySwiftTenant:    "b-tenant",
+		SecondarySwiftAuthMode:  &config.SwiftAuthMode{identity.AuthUserPassV3},
+		BlobEncryptionKeys: config.EncryptionKeys{
+			"key1": {[]byte("0123456789abcdef")},
+			"key2": {[]byte("fedcba9876543210")},
+		},
+		BlobEncryptionKeyID:   "key2",
 		LoggingConfig:         "INFO",
 		DockerRegistryAddress: "0.1.3.5:1000",
 		DockerRegistryAuthCertificates: config.X509Certificates{
@@ -160,9 +233,80 @@ func (s *ConfigSuite) TestRead(c *gc.C) {
 		TempDir:                     "/var/tmp/charmstore",
 		DisableSlowMetadata:         true,
 		ReadOnly:                    true,
+		MaxBundleWithCharmsSize:     2147483648,
+		MaxBundleWithCharmsCount:    50,
+		ArchiveCacheMaxAge:          config.DurationString{24 * time.Hour},
+		MaxBundleSize:               1048576,
+		MaxArchiveSize:              104857600,
+		MaxBundleApplications:       20,
+		LintOnUpload:                true,
+		DedupExtraInfoWrites:        true,
+		UploadContentTypes:          []string{"application/zip", "application/x-zip-compressed"},
+		IngestionErrorWebhook:       "https://example.com/hooks/ingestion",
+		UploadBlocklist:             []string{"*/microsoft-*", "bob/*"},
+		AutoPromulgateUsers:         []string{"charmers"},
+		ApprovalRequiredChannels:    []params.Channel{params.StableChannel},
+		RequirePublishedForDownload: true,
+		GroupMembers: map[string][]string{
+			"charmers": {"bob", "alice"},
+		},
+		TLSCertFile:     "/etc/charmstore/cert.pem",
+		TLSKeyFile:      "/etc/charmstore/key.pem",
+		TLSMinVersion:   "1.3",
+		TLSCipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384", "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"},
+	})
+}
+
+func (s *ConfigSuite) TestTLSConfig(c *gc.C) {
+	conf, err := s.readConfig(c, testConfig)
+	c.Assert(err, gc.Equals, nil)
+	tlsConfig, err := conf.TLSConfig()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(tlsConfig.MinVersion, gc.Equals, uint16(tls.VersionTLS13))
+	c.Assert(tlsConfig.CipherSuites, jc.DeepEquals, []uint16{
+		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
 	})
 }
 
+func (s *ConfigSuite) TestTLSConfigDefaults(c *gc.C) {
+	tlsConfig, err := (&config.Config{}).TLSConfig()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(tlsConfig.MinVersion, gc.Equals, uint16(tls.VersionTLS12))
+	c.Assert(tlsConfig.CipherSuites, jc.DeepEquals, config.DefaultTLSCipherSuites)
+}
+
+var tlsConfigErrorTests = []struct {
+	about       string
+	config      string
+	expectError string
+}{{
+	about:       "unknown cipher suite",
+	config:      "tls-cipher-suites: [TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384, TLS_BOGUS]",
+	expectError: `unknown cipher suite "TLS_BOGUS" in tls-cipher-suites`,
+}, {
+	about:       "insecure cipher suite",
+	config:      "tls-cipher-suites: [TLS_RSA_WITH_RC4_128_SHA]",
+	expectError: `unknown cipher suite "TLS_RSA_WITH_RC4_128_SHA" in tls-cipher-suites`,
+}, {
+	about:       "invalid minimum version",
+	config:      "tls-min-version: \"1.4\"",
+	expectError: `invalid tls-min-version "1.4"`,
+}, {
+	about:       "certificate without key",
+	config:      "tls-cert-file: /etc/charmstore/cert.pem",
+	expectError: `tls-cert-file and tls-key-file must be specified together`,
+}}
+
+func (s *ConfigSuite) TestTLSConfigErrors(c *gc.C) {
+	for i, test := range tlsConfigErrorTests {
+		c.Logf("test %d: %s", i, test.about)
+		cfg, err := s.readConfig(c, "mongo-url: localhost:23456\napi-addr: blah:2324\nauth-username: myuser\nauth-password: mypasswd\n"+test.config+"\n")
+		c.Assert(err, gc.ErrorMatches, test.expectError)
+		c.Assert(cfg, gc.IsNil)
+	}
+}
+
 func (s *ConfigSuite) TestReadConfigError(c *gc.C) {
 	cfg, err := config.Read(path.Join(c.MkDir(), "charmd.conf"))
 	c.Assert(err, gc.ErrorMatches, ".* no such file or directory")
@@ -284,6 +428,38 @@ func (s *ConfigSuite) TestValidateConfigError(c *gc.C) {
 	cfg, err = s.readConfig(c, "blobstore: swift\n")
 	c.Assert(err, gc.ErrorMatches, "missing fields mongo-url, api-addr, auth-username, auth-password, swift-auth-url, swift-username, swift-secret, swift-bucket, swift-region, swift-tenant, swift-auth-mode in config file")
 	c.Assert(cfg, gc.IsNil)
+
+	cfg, err = s.readConfig(c, "secondary-blobstore: swift\n")
+	c.Assert(err, gc.ErrorMatches, "missing fields mongo-url, api-addr, auth-username, auth-password, secondary-blobstore-swift-auth-url, secondary-blobstore-swift-username, secondary-blobstore-swift-secret, secondary-blobstore-swift-bucket, secondary-blobstore-swift-region, secondary-blobstore-swift-tenant, secondary-blobstore-swift-authmode in config file")
+	c.Assert(cfg, gc.IsNil)
+
+	cfg, err = s.readConfig(c, "secondary-blobstore: mongodb\n")
+	c.Assert(err, gc.ErrorMatches, `invalid secondary blob store type "mongodb"`)
+	c.Assert(cfg, gc.IsNil)
+
+	cfg, err = s.readConfig(c, "blob-encryption-key-id: key1\n")
+	c.Assert(err, gc.ErrorMatches, `blob encryption key "key1" not found in blob-encryption-keys`)
+	c.Assert(cfg, gc.IsNil)
+
+	cfg, err = s.readConfig(c, "blob-encryption-keys:\n  key1: MDEyMzQ1Njc4OWFiY2RlZg==\nblob-encryption-key-id: key1\ncompress-blobs: true\n")
+	c.Assert(err, gc.ErrorMatches, `compress-blobs cannot be used with blob encryption`)
+	c.Assert(cfg, gc.IsNil)
+
+	cfg, err = s.readConfig(c, "blob-encryption-keys:\n  key1: MDEyMzQ1Njc4OWFiY2RlZg==\ncompress-blobs: true\n")
+	c.Assert(err, gc.ErrorMatches, `compress-blobs cannot be used with blob encryption`)
+	c.Assert(cfg, gc.IsNil)
+
+	cfg, err = s.readConfig(c, "blob-encryption-keys:\n  key1: MDEyMzQ1Njc4OWFiY2RlZg==\nblob-cache-dir: /var/cache/charmstore\n")
+	c.Assert(err, gc.ErrorMatches, `blob-cache-dir cannot be used with blob encryption`)
+	c.Assert(cfg, gc.IsNil)
+
+	cfg, err = s.readConfig(c, "blobstore-shard-depth: 9\n")
+	c.Assert(err, gc.ErrorMatches, `invalid blobstore-shard-depth 9`)
+	c.Assert(cfg, gc.IsNil)
+
+	cfg, err = s.readConfig(c, "mongo-retry-attempts: 11\n")
+	c.Assert(err, gc.ErrorMatches, `invalid mongo-retry-attempts 11`)
+	c.Assert(cfg, gc.IsNil)
 }
 
 func mustParseKey(s string) bakery.Key {
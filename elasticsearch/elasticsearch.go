@@ -382,6 +382,25 @@ func (db *Database) Search(index, type_ string, q QueryDSL) (SearchResult, error
 	return sr, nil
 }
 
+// Suggest performs the completion suggestion specified in s on the
+// documents in index and returns the suggested options, best first.
+func (db *Database) Suggest(index string, s CompletionSuggest) ([]SuggestOption, error) {
+	var resp struct {
+		Suggest []struct {
+			Options []SuggestOption `json:"options"`
+		} `json:"suggest"`
+	}
+	body := map[string]CompletionSuggest{"suggest": s}
+	if err := db.post(db.url(index, "_suggest"), body, &resp); err != nil {
+		return nil, errgo.NoteMask(err, "suggest failed", IsElasticsearchError)
+	}
+	var options []SuggestOption
+	for _, entry := range resp.Suggest {
+		options = append(options, entry.Options...)
+	}
+	return options, nil
+}
+
 // do performs a request on the elasticsearch server. If body is not nil it will be
 // marshaled as a json object and sent with the request. If v is non nil the response
 // body will be unmarshalled into the value it points to.
@@ -486,6 +505,13 @@ type SearchResult struct {
 	TimedOut bool `json:"timed_out"`
 }
 
+// SuggestOption represents an individual suggestion returned from
+// elasticsearch.
+type SuggestOption struct {
+	Text  string  `json:"text"`
+	Score float64 `json:"score"`
+}
+
 // Hit represents an individual search hit returned from elasticsearch
 type Hit struct {
 	Index  string          `json:"_index"`
@@ -217,6 +217,25 @@ func (t TermFilter) MarshalJSON() ([]byte, error) {
 	return marshalNamedObject("term", map[string]string{t.Field: t.Value})
 }
 
+// RangeFilter provides a filter that requires a field to lie within a
+// range. Bounds that are nil are not included in the filter.
+type RangeFilter struct {
+	Field string
+	GTE   interface{}
+	LTE   interface{}
+}
+
+func (r RangeFilter) MarshalJSON() ([]byte, error) {
+	bounds := make(map[string]interface{})
+	if r.GTE != nil {
+		bounds["gte"] = r.GTE
+	}
+	if r.LTE != nil {
+		bounds["lte"] = r.LTE
+	}
+	return marshalNamedObject("range", map[string]interface{}{r.Field: bounds})
+}
+
 // ExistsFilter provides a filter that requres a field to be present.
 type ExistsFilter string
 
@@ -256,9 +275,44 @@ var Ascending = Order{"asc"}
 // Descending is an Order that orders a sort by descending throuth the values.
 var Descending = Order{"desc"}
 
+// CompletionSuggest is a request for suggestions from a completion
+// suggester field. See
+// https://www.elastic.co/guide/en/elasticsearch/reference/1.7/search-suggesters-completion.html
+// for details.
+type CompletionSuggest struct {
+	// Text holds the prefix to complete.
+	Text string
+
+	// Field holds the name of the completion field.
+	Field string
+
+	// Size holds the maximum number of suggestions to return.
+	// If it is zero, the elasticsearch default is used.
+	Size int
+
+	// Context holds, for each category context of the field,
+	// the values that the suggestions must match any of.
+	Context map[string][]string
+}
+
+func (s CompletionSuggest) MarshalJSON() ([]byte, error) {
+	completion := map[string]interface{}{"field": s.Field}
+	if s.Size > 0 {
+		completion["size"] = s.Size
+	}
+	if len(s.Context) > 0 {
+		completion["context"] = s.Context
+	}
+	return json.Marshal(map[string]interface{}{
+		"text":       s.Text,
+		"completion": completion,
+	})
+}
+
 // marshalNamedObject provides a helper that creates json objects in a form
 // often required by the elasticsearch query DSL. The objects created
 // take the following form:
+//
 //	{
 //		name: obj
 //	}
@@ -88,6 +88,25 @@ func (s *QuerySuite) TestJSONEncodings(c *gc.C) {
 		about: "regexp filter",
 		query: RegexpFilter{Field: "foo", Regexp: ".*"},
 		json:  `{"regexp": {"foo": ".*"}}`,
+	}, {
+		about: "range filter",
+		query: RangeFilter{Field: "foo", GTE: 1, LTE: 10},
+		json:  `{"range": {"foo": {"gte": 1, "lte": 10}}}`,
+	}, {
+		about: "range filter with lower bound only",
+		query: RangeFilter{Field: "foo", GTE: 1},
+		json:  `{"range": {"foo": {"gte": 1}}}`,
+	}, {
+		about: "completion suggest",
+		query: CompletionSuggest{
+			Text:  "wor",
+			Field: "Suggest",
+			Size:  5,
+			Context: map[string][]string{
+				"acl": {"everyone", "bob"},
+			},
+		},
+		json: `{"text": "wor", "completion": {"field": "Suggest", "size": 5, "context": {"acl": ["everyone", "bob"]}}}`,
 	}, {
 		about: "query dsl",
 		query: QueryDSL{
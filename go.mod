@@ -15,6 +15,7 @@ require (
 	github.com/juju/mgomonitor v0.0.0-20181029151116-52206bb0cd31
 	github.com/juju/testing v0.0.0-20200923013621-75df6121fbb0
 	github.com/juju/utils v0.0.0-20200424103611-54ececcc5fc7
+	github.com/juju/version v0.0.0-20191219164919-81c1be00b9a6
 	github.com/juju/xml v0.0.0-20160224194805-b5bf18ebd8b8
 	github.com/juju/zip v0.0.0-20160205105221-f6b1e93fa2e2
 	github.com/julienschmidt/httprouter v1.3.0
@@ -96,6 +96,17 @@ type Store struct {
 	// MaxParts holds the maximum number of parts that there
 	// can be in a multipart upload.
 	MaxParts int
+
+	// OnRemove, if non-nil, is called with the hash of each
+	// blob removed by GC.
+	OnRemove func(hash string)
+
+	// Cache, if non-nil, holds a local cache of blobs that is
+	// checked by Open before fetching blobs from the backend.
+	// Blobs fetched from the backend are added to it as they are
+	// read. Because the cache holds the blobs as returned by the
+	// backend, it must not be used with an encrypted backend.
+	Cache *DiskCache
 }
 
 // New returns a new blob store that writes to the given database,
@@ -204,11 +215,38 @@ func (s *Store) Open(hash string, index *mongodoc.MultipartIndex) (ReadSeekClose
 	if err != nil {
 		return nil, 0, errgo.Mask(err, errgo.Is(ErrNotFound))
 	}
+	if s.Cache != nil {
+		if r, size, ok := s.Cache.Open(hash); ok {
+			return r, size, nil
+		}
+	}
 	r, size, err := s.backend.Get(ref.Name)
 	if err != nil {
 		return nil, 0, errgo.NoteMask(err, "cannot get blob from backend", errgo.Is(ErrNotFound))
 	}
-	return r, size, nil
+	if s.Cache == nil {
+		return r, size, nil
+	}
+	// Populate the cache as the blob is read.
+	return s.Cache.Tee(hash, r, size), size, nil
+}
+
+// pingBlobName holds the name of the blob that Ping looks for in the
+// backend. No blob with this name is ever stored.
+const pingBlobName = "blobstore-ping"
+
+// Ping checks that the backend can be reached by looking up a blob
+// that does not exist.
+func (s *Store) Ping() error {
+	r, _, err := s.backend.Get(pingBlobName)
+	if err == nil {
+		r.Close()
+		return nil
+	}
+	if errgo.Cause(err) == ErrNotFound {
+		return nil
+	}
+	return errgo.Notef(err, "cannot get blob from backend")
 }
 
 // GC runs the garbage collector, deleting all blobs not present in refs
@@ -259,6 +297,9 @@ func (s *Store) GC(refs *Refs, before time.Time) (monitoring.BlobStats, error) {
 			logger.Errorf("cannot remove garbage blob %q from backend (hash %q)", doc.Name, doc.Hash)
 		}
 		logger.Infof("removed garbage blob %q; hash %s", doc.Name, doc.Hash)
+		if s.OnRemove != nil {
+			s.OnRemove(doc.Hash)
+		}
 	}
 	if stats.Count > 0 {
 		stats.MeanSize = totalSize / int64(stats.Count)
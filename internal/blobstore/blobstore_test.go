@@ -51,6 +51,78 @@ func (s *MongoStoreSuite) TestPutConcurrent(c *gc.C) {
 	c.Assert(n, gc.Equals, 1)
 }
 
+var _ = gc.Suite(&CompressedMongoStoreSuite{})
+
+type CompressedMongoStoreSuite struct {
+	blobStoreSuite
+}
+
+func (s *CompressedMongoStoreSuite) SetUpTest(c *gc.C) {
+	s.blobStoreSuite.SetUpTest(c, func(db *mgo.Database) blobstore.Backend {
+		return blobstore.NewCompressedMongoBackend(db, "blobstore")
+	})
+}
+
+func (s *CompressedMongoStoreSuite) TestPutCompressesData(c *gc.C) {
+	content := strings.Repeat("compressible data ", 1000)
+	hash := hashOf(content)
+	err := s.store.Put(strings.NewReader(content), hash, int64(len(content)))
+	c.Assert(err, gc.Equals, nil)
+
+	// The logical size and hash are those of the original data.
+	r, size, err := s.store.Open(hash, nil)
+	c.Assert(err, gc.Equals, nil)
+	defer r.Close()
+	c.Assert(size, gc.Equals, int64(len(content)))
+	c.Assert(hashOfReader(c, r), gc.Equals, hash)
+
+	// The data actually stored is smaller.
+	fs := blobstore.BackendGridFS(s.store)
+	var doc struct {
+		Length int64
+	}
+	err = fs.Files.Find(nil).One(&doc)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(doc.Length < int64(len(content))/10, gc.Equals, true, gc.Commentf("stored size %d", doc.Length))
+}
+
+func (s *CompressedMongoStoreSuite) TestSeek(c *gc.C) {
+	content := strings.Repeat("0123456789", 1000)
+	hash := hashOf(content)
+	err := s.store.Put(strings.NewReader(content), hash, int64(len(content)))
+	c.Assert(err, gc.Equals, nil)
+
+	r, _, err := s.store.Open(hash, nil)
+	c.Assert(err, gc.Equals, nil)
+	defer r.Close()
+	buf := make([]byte, 5)
+	for i, offset := range []int64{5003, 12, 9990, 0} {
+		c.Logf("test %d: offset %d", i, offset)
+		p, err := r.Seek(offset, io.SeekStart)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(p, gc.Equals, offset)
+		n, err := io.ReadFull(r, buf)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(string(buf[:n]), gc.Equals, content[offset:offset+5])
+	}
+	p, err := r.Seek(0, io.SeekEnd)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(p, gc.Equals, int64(len(content)))
+	n, err := r.Read(buf)
+	c.Assert(n, gc.Equals, 0)
+	c.Assert(err, gc.Equals, io.EOF)
+}
+
+func (s *CompressedMongoStoreSuite) TestOpenUncompressedBlob(c *gc.C) {
+	// Blobs stored before compression was enabled can still be read.
+	content := "some data"
+	uncompressed := blobstore.New(s.Session.DB("db"), "blobstore", blobstore.NewMongoBackend(s.Session.DB("db"), "blobstore"))
+	err := uncompressed.Put(strings.NewReader(content), hashOf(content), int64(len(content)))
+	c.Assert(err, gc.Equals, nil)
+
+	s.assertBlobContent(c, nil, content)
+}
+
 type SwiftStoreSuite struct {
 	openstack *openstackservice.Openstack
 	blobStoreSuite
@@ -899,6 +971,21 @@ func (s *blobStoreSuite) TestMultipartCloseWithoutReading(c *gc.C) {
 	c.Assert(err, gc.Equals, nil)
 }
 
+func (s *blobStoreSuite) TestNewSizedUpload(c *gc.C) {
+	expires := time.Now().Add(time.Minute)
+	id, err := s.store.NewSizedUpload(expires, 1234, map[string]string{"hash": "foo"})
+	c.Assert(err, gc.Equals, nil)
+	info, err := s.store.UploadInfo(id)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(info.Length, gc.Equals, int64(1234))
+	c.Assert(info.Metadata, jc.DeepEquals, map[string]string{"hash": "foo"})
+	c.Assert(info.Parts, gc.HasLen, 0)
+
+	_, err = s.store.NewSizedUpload(expires, 0, nil)
+	c.Assert(err, gc.ErrorMatches, "non-positive upload length 0")
+	c.Assert(errgo.Cause(err), gc.Equals, blobstore.ErrBadParams)
+}
+
 func (s *blobStoreSuite) TestUploadInfo(c *gc.C) {
 	s.store.MinPartSize = 10
 	part0 := "123456789 12345"
@@ -0,0 +1,403 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package blobstore // import "gopkg.in/juju/charmstore.v5/internal/blobstore"
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/adler32"
+	"io"
+	"io/ioutil"
+
+	"gopkg.in/errgo.v1"
+)
+
+// ErrInvalidDelta is used as the cause of errors returned by
+// ApplyDelta when the delta cannot be applied.
+var ErrInvalidDelta = errgo.New("invalid delta")
+
+// maxDeltaWindowSize holds the maximum size of the source segment,
+// target window and delta encoding of any window in a delta. It
+// limits the amount of memory that a malicious delta can make us
+// allocate.
+const maxDeltaWindowSize = 1 << 26
+
+// VCDIFF header and window indicator bits, as defined in RFC 3284.
+const (
+	vcdDecompress = 0x01
+	vcdCodeTable  = 0x02
+	vcdAppHeader  = 0x04
+
+	vcdSource = 0x01
+	vcdTarget = 0x02
+	// vcdAdler32 is the xdelta3 extension that adds an Adler-32
+	// checksum of the target window to each window.
+	vcdAdler32 = 0x04
+)
+
+// Sizes of the address caches used by the default code table.
+const (
+	vcdNearSize = 4
+	vcdSameSize = 3
+)
+
+var vcdiffMagic = []byte{0xd6, 0xc3, 0xc4, 0x00}
+
+// Instruction types.
+const (
+	vcdNoop = iota
+	vcdAdd
+	vcdRun
+	vcdCopy
+)
+
+// vcdInst holds a single instruction from a code table. A zero size
+// means that the size is read from the instructions section.
+type vcdInst struct {
+	typ  byte
+	size int
+	mode byte
+}
+
+// vcdDefaultCodeTable holds the default VCDIFF code table, mapping
+// each opcode to a pair of instructions.
+var vcdDefaultCodeTable = makeVCDDefaultCodeTable()
+
+// makeVCDDefaultCodeTable returns the code table defined in section 5.6
+// of RFC 3284.
+func makeVCDDefaultCodeTable() [256][2]vcdInst {
+	var t [256][2]vcdInst
+	i := 0
+	t[i][0] = vcdInst{typ: vcdRun}
+	i++
+	for size := 0; size <= 17; size++ {
+		t[i][0] = vcdInst{typ: vcdAdd, size: size}
+		i++
+	}
+	for mode := byte(0); mode <= 8; mode++ {
+		t[i][0] = vcdInst{typ: vcdCopy, mode: mode}
+		i++
+		for size := 4; size <= 18; size++ {
+			t[i][0] = vcdInst{typ: vcdCopy, size: size, mode: mode}
+			i++
+		}
+	}
+	for mode := byte(0); mode <= 5; mode++ {
+		for addSize := 1; addSize <= 4; addSize++ {
+			for copySize := 4; copySize <= 6; copySize++ {
+				t[i][0] = vcdInst{typ: vcdAdd, size: addSize}
+				t[i][1] = vcdInst{typ: vcdCopy, size: copySize, mode: mode}
+				i++
+			}
+		}
+	}
+	for mode := byte(6); mode <= 8; mode++ {
+		for addSize := 1; addSize <= 4; addSize++ {
+			t[i][0] = vcdInst{typ: vcdAdd, size: addSize}
+			t[i][1] = vcdInst{typ: vcdCopy, size: 4, mode: mode}
+			i++
+		}
+	}
+	for mode := byte(0); mode <= 8; mode++ {
+		t[i][0] = vcdInst{typ: vcdCopy, size: 4, mode: mode}
+		t[i][1] = vcdInst{typ: vcdAdd, size: 1}
+		i++
+	}
+	return t
+}
+
+// ApplyDelta reconstructs a blob by applying delta to the source blob
+// and writes the result to w. The delta must be encoded in the VCDIFF
+// format defined by RFC 3284, as produced, for example, by
+// "xdelta3 -S none".
+//
+// Secondary compression, application-defined code tables and windows
+// that take their source segment from the target are not supported.
+// The Adler-32 window checksums added by xdelta3 are verified.
+//
+// If the delta is malformed, or cannot be applied to the source, an
+// error with an ErrInvalidDelta cause is returned.
+func ApplyDelta(w io.Writer, source io.ReadSeeker, delta io.Reader) error {
+	r := bufio.NewReader(delta)
+	if err := readDeltaHeader(r); err != nil {
+		return errgo.Mask(err, errgo.Is(ErrInvalidDelta))
+	}
+	for {
+		target, err := readDeltaWindow(r, source)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errgo.Mask(err, errgo.Is(ErrInvalidDelta))
+		}
+		if _, err := w.Write(target); err != nil {
+			return errgo.Notef(err, "cannot write reconstructed blob")
+		}
+	}
+}
+
+// readDeltaHeader reads the VCDIFF header from r, checking that it
+// does not require any unsupported features.
+func readDeltaHeader(r *bufio.Reader) error {
+	magic := make([]byte, len(vcdiffMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return deltaReadError(err, "cannot read header")
+	}
+	if !bytes.Equal(magic, vcdiffMagic) {
+		return errgo.WithCausef(nil, ErrInvalidDelta, "not a VCDIFF delta")
+	}
+	ind, err := r.ReadByte()
+	if err != nil {
+		return deltaReadError(err, "cannot read header")
+	}
+	if ind&vcdDecompress != 0 {
+		return errgo.WithCausef(nil, ErrInvalidDelta, "secondary compression not supported")
+	}
+	if ind&vcdCodeTable != 0 {
+		return errgo.WithCausef(nil, ErrInvalidDelta, "application-defined code tables not supported")
+	}
+	if ind&vcdAppHeader != 0 {
+		n, err := readDeltaInt(r, "application header length")
+		if err != nil {
+			return errgo.Mask(err, errgo.Is(ErrInvalidDelta))
+		}
+		if _, err := io.CopyN(ioutil.Discard, r, int64(n)); err != nil {
+			return deltaReadError(err, "cannot read application header")
+		}
+	}
+	return nil
+}
+
+// readDeltaWindow reads a single window from r and returns the target
+// window that it encodes. It returns io.EOF if there are no more
+// windows.
+func readDeltaWindow(r *bufio.Reader, source io.ReadSeeker) ([]byte, error) {
+	ind, err := r.ReadByte()
+	if err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, errgo.Notef(err, "cannot read window")
+	}
+	if ind&vcdTarget != 0 {
+		return nil, errgo.WithCausef(nil, ErrInvalidDelta, "target source segments not supported")
+	}
+	if ind&^(vcdSource|vcdAdler32) != 0 {
+		return nil, errgo.WithCausef(nil, ErrInvalidDelta, "invalid window indicator %#x", ind)
+	}
+	var src []byte
+	if ind&vcdSource != 0 {
+		size, err := readDeltaInt(r, "source segment size")
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Is(ErrInvalidDelta))
+		}
+		pos, err := readDeltaInt(r, "source segment position")
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Is(ErrInvalidDelta))
+		}
+		src, err = readSourceSegment(source, int64(pos), size)
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Is(ErrInvalidDelta))
+		}
+	}
+	if _, err := readDeltaInt(r, "delta encoding length"); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(ErrInvalidDelta))
+	}
+	targetLen, err := readDeltaInt(r, "target window length")
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(ErrInvalidDelta))
+	}
+	deltaInd, err := r.ReadByte()
+	if err != nil {
+		return nil, deltaReadError(err, "cannot read delta indicator")
+	}
+	if deltaInd != 0 {
+		return nil, errgo.WithCausef(nil, ErrInvalidDelta, "secondary compression not supported")
+	}
+	var sections [3][]byte
+	for i, what := range []string{"data section length", "instructions section length", "addresses section length"} {
+		n, err := readDeltaInt(r, what)
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Is(ErrInvalidDelta))
+		}
+		sections[i] = make([]byte, n)
+	}
+	var checksum uint32
+	if ind&vcdAdler32 != 0 {
+		if err := binary.Read(r, binary.BigEndian, &checksum); err != nil {
+			return nil, deltaReadError(err, "cannot read window checksum")
+		}
+	}
+	for _, section := range sections {
+		if _, err := io.ReadFull(r, section); err != nil {
+			return nil, deltaReadError(err, "cannot read window")
+		}
+	}
+	target, err := decodeDeltaWindow(src, targetLen, sections[0], sections[1], sections[2])
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(ErrInvalidDelta))
+	}
+	if ind&vcdAdler32 != 0 && adler32.Checksum(target) != checksum {
+		return nil, errgo.WithCausef(nil, ErrInvalidDelta, "window checksum mismatch")
+	}
+	return target, nil
+}
+
+// readSourceSegment reads size bytes starting at pos from source.
+func readSourceSegment(source io.ReadSeeker, pos int64, size int) ([]byte, error) {
+	if source == nil {
+		return nil, errgo.WithCausef(nil, ErrInvalidDelta, "delta requires a source")
+	}
+	if _, err := source.Seek(pos, seekStart); err != nil {
+		return nil, errgo.Notef(err, "cannot seek in source")
+	}
+	src := make([]byte, size)
+	if _, err := io.ReadFull(source, src); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, errgo.WithCausef(nil, ErrInvalidDelta, "source segment out of range")
+		}
+		return nil, errgo.Notef(err, "cannot read source")
+	}
+	return src, nil
+}
+
+// decodeDeltaWindow decodes the target window of length targetLen
+// from the given source segment and data, instructions and addresses
+// sections of a window.
+func decodeDeltaWindow(src []byte, targetLen int, data, inst, addr []byte) ([]byte, error) {
+	target := make([]byte, 0, targetLen)
+	dataR := bytes.NewReader(data)
+	instR := bytes.NewReader(inst)
+	addrR := bytes.NewReader(addr)
+	var cache vcdAddrCache
+	for instR.Len() > 0 {
+		op, _ := instR.ReadByte()
+		for _, in := range vcdDefaultCodeTable[op] {
+			if in.typ == vcdNoop {
+				continue
+			}
+			size := in.size
+			if size == 0 {
+				var err error
+				size, err = readDeltaInt(instR, "instruction size")
+				if err != nil {
+					return nil, errgo.Mask(err, errgo.Is(ErrInvalidDelta))
+				}
+			}
+			if size > targetLen-len(target) {
+				return nil, errgo.WithCausef(nil, ErrInvalidDelta, "instruction overflows target window")
+			}
+			switch in.typ {
+			case vcdAdd:
+				if dataR.Len() < size {
+					return nil, errgo.WithCausef(nil, ErrInvalidDelta, "data section too short")
+				}
+				start := len(target)
+				target = target[:start+size]
+				dataR.Read(target[start:])
+			case vcdRun:
+				b, err := dataR.ReadByte()
+				if err != nil {
+					return nil, errgo.WithCausef(nil, ErrInvalidDelta, "data section too short")
+				}
+				for i := 0; i < size; i++ {
+					target = append(target, b)
+				}
+			case vcdCopy:
+				here := len(src) + len(target)
+				a, err := cache.decode(addrR, here, in.mode)
+				if err != nil {
+					return nil, errgo.Mask(err, errgo.Is(ErrInvalidDelta))
+				}
+				if a < 0 || a >= here {
+					return nil, errgo.WithCausef(nil, ErrInvalidDelta, "invalid copy address %d", a)
+				}
+				// Copy byte by byte because the copied region
+				// may overlap the region being written.
+				for i := a; i < a+size; i++ {
+					if i < len(src) {
+						target = append(target, src[i])
+					} else {
+						target = append(target, target[i-len(src)])
+					}
+				}
+			}
+		}
+	}
+	if len(target) != targetLen {
+		return nil, errgo.WithCausef(nil, ErrInvalidDelta, "target window has length %d, expected %d", len(target), targetLen)
+	}
+	return target, nil
+}
+
+// vcdAddrCache implements the address caches used to decode COPY
+// instruction addresses, as described in section 5.1 of RFC 3284.
+type vcdAddrCache struct {
+	near     [vcdNearSize]int
+	nextSlot int
+	same     [vcdSameSize * 256]int
+}
+
+// decode reads the address of a COPY instruction with the given mode
+// from r, where here is the current location in the target window.
+func (c *vcdAddrCache) decode(r *bytes.Reader, here int, mode byte) (int, error) {
+	var addr int
+	if mode < 2+vcdNearSize {
+		v, err := readDeltaInt(r, "copy address")
+		if err != nil {
+			return 0, errgo.Mask(err, errgo.Is(ErrInvalidDelta))
+		}
+		switch mode {
+		case 0:
+			addr = v
+		case 1:
+			addr = here - v
+		default:
+			addr = c.near[mode-2] + v
+		}
+	} else {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, errgo.WithCausef(nil, ErrInvalidDelta, "addresses section too short")
+		}
+		addr = c.same[int(mode-2-vcdNearSize)*256+int(b)]
+	}
+	c.near[c.nextSlot] = addr
+	c.nextSlot = (c.nextSlot + 1) % vcdNearSize
+	if addr >= 0 {
+		c.same[addr%(vcdSameSize*256)] = addr
+	}
+	return addr, nil
+}
+
+// readDeltaInt reads a VCDIFF variable length integer from r. The
+// integer must not be greater than maxDeltaWindowSize. The what
+// argument describes the integer for error messages.
+func readDeltaInt(r io.ByteReader, what string) (int, error) {
+	n := 0
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, deltaReadError(err, "cannot read "+what)
+		}
+		n = n<<7 | int(b&0x7f)
+		if n > maxDeltaWindowSize {
+			return 0, errgo.WithCausef(nil, ErrInvalidDelta, "%s too large", what)
+		}
+		if b&0x80 == 0 {
+			return n, nil
+		}
+	}
+}
+
+// deltaReadError returns an error for a failure reading from a
+// delta. Unexpected end of file errors are given an ErrInvalidDelta
+// cause.
+func deltaReadError(err error, msg string) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errgo.WithCausef(nil, ErrInvalidDelta, "%s: unexpected end of delta", msg)
+	}
+	return errgo.Notef(err, "%s", msg)
+}
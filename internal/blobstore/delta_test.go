@@ -0,0 +1,178 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/adler32"
+	"strings"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/juju/charmstore.v5/internal/blobstore"
+	"gopkg.in/juju/charmstore.v5/internal/storetesting"
+)
+
+type deltaSuite struct{}
+
+var _ = gc.Suite(&deltaSuite{})
+
+var applyDeltaTests = []struct {
+	about  string
+	source string
+	target string
+}{{
+	about:  "identical",
+	source: "hello world",
+	target: "hello world",
+}, {
+	about:  "change in the middle",
+	source: "hello world",
+	target: "hello there world",
+}, {
+	about:  "change at the start",
+	source: "hello world",
+	target: "goodbye world",
+}, {
+	about:  "change at the end",
+	source: "hello world",
+	target: "hello everyone",
+}, {
+	about:  "empty source",
+	source: "",
+	target: "hello world",
+}, {
+	about:  "empty target",
+	source: "hello world",
+	target: "",
+}, {
+	about:  "large",
+	source: strings.Repeat("abcdefghij", 10000),
+	target: strings.Repeat("abcdefghij", 5000) + "klmnop" + strings.Repeat("abcdefghij", 5000),
+}}
+
+func (s *deltaSuite) TestApplyDelta(c *gc.C) {
+	for i, test := range applyDeltaTests {
+		c.Logf("test %d: %s", i, test.about)
+		delta := storetesting.Delta([]byte(test.source), []byte(test.target))
+		var buf bytes.Buffer
+		err := blobstore.ApplyDelta(&buf, strings.NewReader(test.source), bytes.NewReader(delta))
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(buf.String(), gc.Equals, test.target)
+	}
+}
+
+func (s *deltaSuite) TestApplyDeltaInstructions(c *gc.C) {
+	// This delta exercises RUN instructions, all the address modes
+	// and a double instruction, and has an xdelta3 window
+	// checksum.
+	source := "abcdefgh"
+	target := "xxxcdefxxxcdefgdefgyabcd"
+	data := []byte{'x', 'y'}
+	inst := []byte{
+		0, 3, // RUN size 3
+		20,  // COPY size 4, VCD_SELF mode
+		36,  // COPY size 4, VCD_HERE mode
+		52,  // COPY size 4, first near mode
+		116, // COPY size 4, first same mode
+		163, // ADD size 1 then COPY size 4, VCD_SELF mode
+	}
+	addr := []byte{2, 7, 1, 3, 0}
+	var checksum [4]byte
+	binary.BigEndian.PutUint32(checksum[:], adler32.Checksum([]byte(target)))
+	enc := []byte{byte(len(target)), 0, byte(len(data)), byte(len(inst)), byte(len(addr))}
+	enc = append(enc, checksum[:]...)
+	enc = append(enc, data...)
+	enc = append(enc, inst...)
+	enc = append(enc, addr...)
+	delta := []byte{0xd6, 0xc3, 0xc4, 0x00, 0x00, 0x05, byte(len(source)), 0, byte(len(enc))}
+	delta = append(delta, enc...)
+
+	var buf bytes.Buffer
+	err := blobstore.ApplyDelta(&buf, strings.NewReader(source), bytes.NewReader(delta))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(buf.String(), gc.Equals, target)
+
+	// Check that the checksum is verified.
+	delta[len(delta)-len(enc)+5] ^= 0xff
+	err = blobstore.ApplyDelta(&buf, strings.NewReader(source), bytes.NewReader(delta))
+	c.Assert(err, gc.ErrorMatches, `window checksum mismatch`)
+	c.Assert(errgo.Cause(err), gc.Equals, blobstore.ErrInvalidDelta)
+}
+
+var applyDeltaErrorTests = []struct {
+	about       string
+	delta       []byte
+	expectError string
+}{{
+	about:       "empty delta",
+	delta:       []byte{},
+	expectError: `cannot read header: unexpected end of delta`,
+}, {
+	about:       "bad magic",
+	delta:       []byte("BSDIFF40"),
+	expectError: `not a VCDIFF delta`,
+}, {
+	about:       "secondary compression",
+	delta:       []byte{0xd6, 0xc3, 0xc4, 0x00, 0x01},
+	expectError: `secondary compression not supported`,
+}, {
+	about:       "code table",
+	delta:       []byte{0xd6, 0xc3, 0xc4, 0x00, 0x02},
+	expectError: `application-defined code tables not supported`,
+}, {
+	about:       "target source segment",
+	delta:       []byte{0xd6, 0xc3, 0xc4, 0x00, 0x00, 0x02},
+	expectError: `target source segments not supported`,
+}, {
+	about:       "source segment out of range",
+	delta:       []byte{0xd6, 0xc3, 0xc4, 0x00, 0x00, 0x01, 100, 0},
+	expectError: `source segment out of range`,
+}, {
+	about:       "truncated window",
+	delta:       []byte{0xd6, 0xc3, 0xc4, 0x00, 0x00, 0x01, 4, 0, 10, 4, 0, 1, 1},
+	expectError: `cannot read addresses section length: unexpected end of delta`,
+}, {
+	about: "copy address out of range",
+	delta: []byte{
+		0xd6, 0xc3, 0xc4, 0x00, 0x00,
+		0x01, 4, 0, // window with source segment
+		7, 4, 0, 0, 1, 1, // lengths
+		20, // COPY size 4, VCD_SELF mode
+		4,  // address
+	},
+	expectError: `invalid copy address 4`,
+}, {
+	about: "target too short",
+	delta: []byte{
+		0xd6, 0xc3, 0xc4, 0x00, 0x00,
+		0x01, 4, 0, // window with source segment
+		7, 5, 0, 0, 1, 1, // lengths
+		20, // COPY size 4, VCD_SELF mode
+		0,  // address
+	},
+	expectError: `target window has length 4, expected 5`,
+}, {
+	about: "target too long",
+	delta: []byte{
+		0xd6, 0xc3, 0xc4, 0x00, 0x00,
+		0x01, 4, 0, // window with source segment
+		7, 3, 0, 0, 1, 1, // lengths
+		20, // COPY size 4, VCD_SELF mode
+		0,  // address
+	},
+	expectError: `instruction overflows target window`,
+}}
+
+func (s *deltaSuite) TestApplyDeltaError(c *gc.C) {
+	for i, test := range applyDeltaErrorTests {
+		c.Logf("test %d: %s", i, test.about)
+		var buf bytes.Buffer
+		err := blobstore.ApplyDelta(&buf, strings.NewReader("abcd"), bytes.NewReader(test.delta))
+		c.Assert(err, gc.ErrorMatches, test.expectError)
+		c.Assert(errgo.Cause(err), gc.Equals, blobstore.ErrInvalidDelta)
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package blobstore // import "gopkg.in/juju/charmstore.v5/internal/blobstore"
+
+import (
+	"fmt"
+)
+
+// BackendInfo holds information about a Backend, for reporting to
+// operators.
+type BackendInfo struct {
+	// Type holds the kind of the backend, for example "mongodb"
+	// or "swift".
+	Type string
+
+	// Config holds the configuration settings of the backend
+	// that affect how blobs are stored, such as whether they are
+	// compressed. Credentials and the names and locations of the
+	// backend's storage are not included.
+	Config map[string]string `json:",omitempty"`
+
+	// Reachable holds whether the backend's storage could be
+	// reached. For a backend that wraps others, it holds whether
+	// all of them could be reached.
+	Reachable bool
+
+	// Error holds the reason that the backend could not be reached.
+	Error string `json:",omitempty"`
+
+	// Backends holds information on any backends wrapped by
+	// this one.
+	Backends []BackendInfo `json:",omitempty"`
+}
+
+// Describer may be implemented by a Backend to report information
+// about itself.
+type Describer interface {
+	// Describe returns information about the backend, checking
+	// whether its storage can be reached.
+	Describe() BackendInfo
+}
+
+// Describe returns information about the given backend. If the backend
+// does not implement Describer, only its Go type is reported.
+func Describe(b Backend) BackendInfo {
+	if d, ok := b.(Describer); ok {
+		return d.Describe()
+	}
+	return BackendInfo{
+		Type:  fmt.Sprintf("%T", b),
+		Error: "backend cannot be checked",
+	}
+}
+
+// Describe returns information about the backend used by the store.
+func (s *Store) Describe() BackendInfo {
+	return Describe(s.backend)
+}
+
+// wrapperInfo returns information about a backend of the given type
+// that wraps the given backends.
+func wrapperInfo(typ string, config map[string]string, backends ...Backend) BackendInfo {
+	info := BackendInfo{
+		Type:      typ,
+		Config:    config,
+		Reachable: true,
+		Backends:  make([]BackendInfo, len(backends)),
+	}
+	for i, b := range backends {
+		info.Backends[i] = Describe(b)
+		info.Reachable = info.Reachable && info.Backends[i].Reachable
+	}
+	return info
+}
+
+// reachability sets the Reachable and Error fields of info
+// according to the result of checking the backend.
+func (info BackendInfo) reachability(err error) BackendInfo {
+	info.Reachable = err == nil
+	if err != nil {
+		info.Error = err.Error()
+	}
+	return info
+}
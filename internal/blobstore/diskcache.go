@@ -0,0 +1,338 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package blobstore // import "gopkg.in/juju/charmstore.v5/internal/blobstore"
+
+import (
+	"container/list"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/errgo.v1"
+)
+
+// diskCacheTempPrefix is the prefix of the temporary files used while
+// adding blobs to a DiskCache.
+const diskCacheTempPrefix = "tmp-"
+
+// DiskCache holds a size-bounded cache of blobs on local disk, keyed by
+// blob hash. Because the content of a blob never changes for a given
+// hash, cached blobs never need to be invalidated. When the total size
+// of the cached blobs would exceed the maximum size, the least recently
+// used blobs are removed.
+//
+// A DiskCache may be used concurrently and shared between stores.
+type DiskCache struct {
+	dir     string
+	maxSize int64
+
+	// mu guards the fields following it.
+	mu sync.Mutex
+
+	// size holds the total size of the cached blobs.
+	size int64
+
+	// lru holds a *diskCacheEntry for each cached blob, most
+	// recently used first.
+	lru *list.List
+
+	// entries holds the element of lru for each cached blob,
+	// keyed by hash.
+	entries map[string]*list.Element
+}
+
+// diskCacheEntry holds a blob in a DiskCache.
+type diskCacheEntry struct {
+	hash string
+	size int64
+}
+
+// NewDiskCache returns a cache that stores blobs in the given
+// directory, which is created if necessary, holding at most maxSize
+// bytes. Any blobs already in the directory, for example from a
+// previous run of the server, are retained, in least recently modified
+// order.
+func NewDiskCache(dir string, maxSize int64) (*DiskCache, error) {
+	if maxSize <= 0 {
+		return nil, errgo.Newf("invalid disk cache size %d", maxSize)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errgo.Notef(err, "cannot create disk cache directory")
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot read disk cache directory")
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().Before(infos[j].ModTime())
+	})
+	c := &DiskCache{
+		dir:     dir,
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+	for _, info := range infos {
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		if _, err := decodeHash(info.Name()); err != nil {
+			// Remove any temporary files left behind when
+			// the server stopped while adding a blob.
+			if strings.HasPrefix(info.Name(), diskCacheTempPrefix) {
+				os.Remove(filepath.Join(dir, info.Name()))
+			}
+			continue
+		}
+		c.entries[info.Name()] = c.lru.PushFront(&diskCacheEntry{
+			hash: info.Name(),
+			size: info.Size(),
+		})
+		c.size += info.Size()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.evict()
+	return c, nil
+}
+
+// MaxSize returns the maximum total size of the blobs held in the
+// cache. Blobs larger than this are never cached.
+func (c *DiskCache) MaxSize() int64 {
+	return c.maxSize
+}
+
+// Open opens the cached blob with the given hash, returning its
+// contents and size. It reports whether the blob was found in the
+// cache.
+func (c *DiskCache) Open(hash string) (ReadSeekCloser, int64, bool) {
+	c.mu.Lock()
+	elem := c.entries[hash]
+	if elem == nil {
+		c.mu.Unlock()
+		return nil, 0, false
+	}
+	c.lru.MoveToFront(elem)
+	size := elem.Value.(*diskCacheEntry).size
+	c.mu.Unlock()
+
+	f, err := os.Open(c.path(hash))
+	if err != nil {
+		// The blob has been evicted since it was looked up,
+		// or has been removed from the disk behind our back.
+		if !os.IsNotExist(err) {
+			logger.Errorf("cannot open cached blob %s: %v", hash, err)
+		}
+		c.mu.Lock()
+		if c.entries[hash] == elem {
+			c.remove(elem)
+		}
+		c.mu.Unlock()
+		return nil, 0, false
+	}
+	return f, size, true
+}
+
+// Add adds the blob with the given hash and size to the cache, reading
+// its contents from r. An error is returned if the contents read do not
+// match the hash and size, or if the blob is larger than the maximum
+// size of the cache.
+func (c *DiskCache) Add(hash string, r io.Reader, size int64) error {
+	if _, err := decodeHash(hash); err != nil {
+		return errgo.Mask(err)
+	}
+	if size > c.maxSize {
+		return errgo.Newf("blob too large to cache (%d bytes)", size)
+	}
+	name, err := c.writeTemp(hash, r, size)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return errgo.Mask(c.commit(name, hash, size))
+}
+
+// commit adds the temporary file with the given name, which holds the
+// blob with the given hash and size, to the cache.
+func (c *DiskCache) commit(name, hash string, size int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem := c.entries[hash]; elem != nil {
+		// The blob has been added concurrently.
+		os.Remove(name)
+		c.lru.MoveToFront(elem)
+		return nil
+	}
+	if err := os.Rename(name, c.path(hash)); err != nil {
+		os.Remove(name)
+		return errgo.Notef(err, "cannot add cache file")
+	}
+	c.entries[hash] = c.lru.PushFront(&diskCacheEntry{
+		hash: hash,
+		size: size,
+	})
+	c.size += size
+	c.evict()
+	return nil
+}
+
+// writeTemp writes the blob with the given hash and size, read from r,
+// to a temporary file in the cache directory and returns the file's
+// name.
+func (c *DiskCache) writeTemp(hash string, r io.Reader, size int64) (_ string, err error) {
+	f, err := ioutil.TempFile(c.dir, diskCacheTempPrefix)
+	if err != nil {
+		return "", errgo.Notef(err, "cannot create cache file")
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}()
+	hasher := NewHash()
+	n, err := io.Copy(io.MultiWriter(f, hasher), r)
+	if err != nil {
+		f.Close()
+		return "", errgo.Notef(err, "cannot write cache file")
+	}
+	if err := f.Close(); err != nil {
+		return "", errgo.Notef(err, "cannot write cache file")
+	}
+	if n != size {
+		return "", errgo.Newf("unexpected blob size %d (expected %d)", n, size)
+	}
+	if fmt.Sprintf("%x", hasher.Sum(nil)) != hash {
+		return "", errgo.Newf("blob hash mismatch")
+	}
+	return f.Name(), nil
+}
+
+// Tee returns a reader that reads the blob with the given hash and
+// size from r, adding it to the cache as it is read, so that the blob
+// can be served without waiting for it to be written to the cache. The
+// blob is only added when the reader is closed, if the whole blob has
+// been read in order and matches its hash. If the blob is too large to
+// cache or the cache file cannot be created, r is returned unchanged.
+func (c *DiskCache) Tee(hash string, r ReadSeekCloser, size int64) ReadSeekCloser {
+	if size > c.maxSize {
+		return r
+	}
+	if _, err := decodeHash(hash); err != nil {
+		return r
+	}
+	f, err := ioutil.TempFile(c.dir, diskCacheTempPrefix)
+	if err != nil {
+		logger.Warningf("cannot create cache file for blob %s: %v", hash, err)
+		return r
+	}
+	return &teeReader{
+		ReadSeekCloser: r,
+		cache:          c,
+		hash:           hash,
+		size:           size,
+		f:              f,
+		hasher:         NewHash(),
+	}
+}
+
+// teeReader is the reader returned by DiskCache.Tee.
+type teeReader struct {
+	ReadSeekCloser
+	cache  *DiskCache
+	hash   string
+	size   int64
+	f      *os.File
+	hasher hash.Hash
+
+	// pos holds the current read position.
+	pos int64
+
+	// written holds the number of bytes written to f.
+	written int64
+
+	// failed holds whether the blob can no longer be
+	// added to the cache.
+	failed bool
+}
+
+// Read implements io.Reader.Read.
+func (r *teeReader) Read(buf []byte) (int, error) {
+	n, err := r.ReadSeekCloser.Read(buf)
+	if n > 0 && !r.failed {
+		if r.pos != r.written {
+			r.failed = true
+		} else if _, werr := r.f.Write(buf[:n]); werr != nil {
+			logger.Warningf("cannot write cache file for blob %s: %v", r.hash, werr)
+			r.failed = true
+		} else {
+			r.hasher.Write(buf[:n])
+			r.written += int64(n)
+		}
+	}
+	r.pos += int64(n)
+	return n, err
+}
+
+// Seek implements io.Seeker.Seek.
+func (r *teeReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := r.ReadSeekCloser.Seek(offset, whence)
+	if err != nil {
+		r.failed = true
+		return pos, err
+	}
+	r.pos = pos
+	return pos, nil
+}
+
+// Close implements io.Closer.Close. It adds the blob to the cache if
+// it has been read in full.
+func (r *teeReader) Close() error {
+	err := r.ReadSeekCloser.Close()
+	name := r.f.Name()
+	if cerr := r.f.Close(); cerr != nil {
+		r.failed = true
+	}
+	if r.failed || r.written != r.size || fmt.Sprintf("%x", r.hasher.Sum(nil)) != r.hash {
+		os.Remove(name)
+		return err
+	}
+	if cerr := r.cache.commit(name, r.hash, r.size); cerr != nil {
+		logger.Warningf("cannot add blob %s to cache: %v", r.hash, cerr)
+	}
+	return err
+}
+
+// evict removes the least recently used blobs until the total size of
+// the cache is no more than its maximum size. It must be called with
+// c.mu held.
+func (c *DiskCache) evict() {
+	for c.size > c.maxSize && c.lru.Len() > 0 {
+		elem := c.lru.Back()
+		hash := elem.Value.(*diskCacheEntry).hash
+		if err := os.Remove(c.path(hash)); err != nil && !os.IsNotExist(err) {
+			logger.Errorf("cannot remove cached blob %s: %v", hash, err)
+		}
+		c.remove(elem)
+	}
+}
+
+// remove removes the given element from the cache's index. It must be
+// called with c.mu held.
+func (c *DiskCache) remove(elem *list.Element) {
+	e := elem.Value.(*diskCacheEntry)
+	c.lru.Remove(elem)
+	delete(c.entries, e.hash)
+	c.size -= e.size
+}
+
+// path returns the path of the file holding the blob with the given
+// hash.
+func (c *DiskCache) path(hash string) string {
+	return filepath.Join(c.dir, hash)
+}
@@ -0,0 +1,253 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	jujutesting "github.com/juju/testing"
+	gc "gopkg.in/check.v1"
+
+	"gopkg.in/juju/charmstore.v5/internal/blobstore"
+)
+
+type diskCacheSuite struct{}
+
+var _ = gc.Suite(&diskCacheSuite{})
+
+func (s *diskCacheSuite) TestAddAndOpen(c *gc.C) {
+	cache, err := blobstore.NewDiskCache(c.MkDir(), 100)
+	c.Assert(err, gc.Equals, nil)
+
+	_, _, ok := cache.Open(hashOf("some data"))
+	c.Assert(ok, gc.Equals, false)
+
+	err = cache.Add(hashOf("some data"), strings.NewReader("some data"), 9)
+	c.Assert(err, gc.Equals, nil)
+	assertCachedBlob(c, cache, "some data")
+}
+
+func (s *diskCacheSuite) TestAddHashMismatch(c *gc.C) {
+	dir := c.MkDir()
+	cache, err := blobstore.NewDiskCache(dir, 100)
+	c.Assert(err, gc.Equals, nil)
+
+	err = cache.Add(hashOf("some data"), strings.NewReader("other data"), 10)
+	c.Assert(err, gc.ErrorMatches, "blob hash mismatch")
+	_, _, ok := cache.Open(hashOf("some data"))
+	c.Assert(ok, gc.Equals, false)
+
+	// The temporary file has been removed.
+	infos, err := ioutil.ReadDir(dir)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(infos, gc.HasLen, 0)
+}
+
+func (s *diskCacheSuite) TestAddWrongSize(c *gc.C) {
+	cache, err := blobstore.NewDiskCache(c.MkDir(), 100)
+	c.Assert(err, gc.Equals, nil)
+
+	err = cache.Add(hashOf("some data"), strings.NewReader("some data"), 20)
+	c.Assert(err, gc.ErrorMatches, `unexpected blob size 9 \(expected 20\)`)
+}
+
+func (s *diskCacheSuite) TestAddTooLarge(c *gc.C) {
+	cache, err := blobstore.NewDiskCache(c.MkDir(), 5)
+	c.Assert(err, gc.Equals, nil)
+
+	err = cache.Add(hashOf("some data"), strings.NewReader("some data"), 9)
+	c.Assert(err, gc.ErrorMatches, `blob too large to cache \(9 bytes\)`)
+}
+
+func (s *diskCacheSuite) TestEvictsLeastRecentlyUsed(c *gc.C) {
+	dir := c.MkDir()
+	cache, err := blobstore.NewDiskCache(dir, 20)
+	c.Assert(err, gc.Equals, nil)
+
+	for _, content := range []string{"blob one", "blob two"} {
+		err := cache.Add(hashOf(content), strings.NewReader(content), int64(len(content)))
+		c.Assert(err, gc.Equals, nil)
+	}
+	// Use the first blob so that the second is the least
+	// recently used.
+	assertCachedBlob(c, cache, "blob one")
+
+	err = cache.Add(hashOf("blob three"), strings.NewReader("blob three"), 10)
+	c.Assert(err, gc.Equals, nil)
+
+	assertCachedBlob(c, cache, "blob one")
+	assertCachedBlob(c, cache, "blob three")
+	_, _, ok := cache.Open(hashOf("blob two"))
+	c.Assert(ok, gc.Equals, false)
+	_, err = os.Stat(filepath.Join(dir, hashOf("blob two")))
+	c.Assert(os.IsNotExist(err), gc.Equals, true)
+}
+
+func (s *diskCacheSuite) TestNewDiskCacheUsesExistingBlobs(c *gc.C) {
+	dir := c.MkDir()
+	cache, err := blobstore.NewDiskCache(dir, 100)
+	c.Assert(err, gc.Equals, nil)
+	err = cache.Add(hashOf("some data"), strings.NewReader("some data"), 9)
+	c.Assert(err, gc.Equals, nil)
+	err = ioutil.WriteFile(filepath.Join(dir, "tmp-1234"), []byte("partial"), 0600)
+	c.Assert(err, gc.Equals, nil)
+
+	cache, err = blobstore.NewDiskCache(dir, 100)
+	c.Assert(err, gc.Equals, nil)
+	assertCachedBlob(c, cache, "some data")
+
+	// The left over temporary file has been removed.
+	_, err = os.Stat(filepath.Join(dir, "tmp-1234"))
+	c.Assert(os.IsNotExist(err), gc.Equals, true)
+}
+
+func (s *diskCacheSuite) TestNewDiskCacheInvalidSize(c *gc.C) {
+	_, err := blobstore.NewDiskCache(c.MkDir(), 0)
+	c.Assert(err, gc.ErrorMatches, "invalid disk cache size 0")
+}
+
+func (s *diskCacheSuite) TestTee(c *gc.C) {
+	cache, err := blobstore.NewDiskCache(c.MkDir(), 100)
+	c.Assert(err, gc.Equals, nil)
+
+	r := cache.Tee(hashOf("some data"), nopCloser{strings.NewReader("some data")}, 9)
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(string(data), gc.Equals, "some data")
+
+	// The blob is not added until the reader is closed.
+	_, _, ok := cache.Open(hashOf("some data"))
+	c.Assert(ok, gc.Equals, false)
+	err = r.Close()
+	c.Assert(err, gc.Equals, nil)
+	assertCachedBlob(c, cache, "some data")
+}
+
+func (s *diskCacheSuite) TestTeePartialRead(c *gc.C) {
+	dir := c.MkDir()
+	cache, err := blobstore.NewDiskCache(dir, 100)
+	c.Assert(err, gc.Equals, nil)
+
+	r := cache.Tee(hashOf("some data"), nopCloser{strings.NewReader("some data")}, 9)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(r, buf)
+	c.Assert(err, gc.Equals, nil)
+	err = r.Close()
+	c.Assert(err, gc.Equals, nil)
+	_, _, ok := cache.Open(hashOf("some data"))
+	c.Assert(ok, gc.Equals, false)
+
+	// The temporary file has been removed.
+	infos, err := ioutil.ReadDir(dir)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(infos, gc.HasLen, 0)
+}
+
+func (s *diskCacheSuite) TestTeeSeek(c *gc.C) {
+	cache, err := blobstore.NewDiskCache(c.MkDir(), 100)
+	c.Assert(err, gc.Equals, nil)
+
+	// Seeking that does not skip any data, as done by
+	// http.ServeContent to find the size, does not stop the blob
+	// being cached.
+	r := cache.Tee(hashOf("some data"), nopCloser{strings.NewReader("some data")}, 9)
+	_, err = r.Seek(0, io.SeekEnd)
+	c.Assert(err, gc.Equals, nil)
+	_, err = r.Seek(0, io.SeekStart)
+	c.Assert(err, gc.Equals, nil)
+	_, err = ioutil.ReadAll(r)
+	c.Assert(err, gc.Equals, nil)
+	err = r.Close()
+	c.Assert(err, gc.Equals, nil)
+	assertCachedBlob(c, cache, "some data")
+
+	// Reading out of order does.
+	r = cache.Tee(hashOf("other data"), nopCloser{strings.NewReader("other data")}, 10)
+	_, err = r.Seek(6, io.SeekStart)
+	c.Assert(err, gc.Equals, nil)
+	_, err = ioutil.ReadAll(r)
+	c.Assert(err, gc.Equals, nil)
+	err = r.Close()
+	c.Assert(err, gc.Equals, nil)
+	_, _, ok := cache.Open(hashOf("other data"))
+	c.Assert(ok, gc.Equals, false)
+}
+
+type diskCacheStoreSuite struct {
+	jujutesting.IsolatedMgoSuite
+}
+
+var _ = gc.Suite(&diskCacheStoreSuite{})
+
+func (s *diskCacheStoreSuite) TestOpenPopulatesCache(c *gc.C) {
+	backend := &countingBackend{Backend: newMemBackend()}
+	store := blobstore.New(s.Session.DB("db"), "blobstore", backend)
+	cache, err := blobstore.NewDiskCache(c.MkDir(), 100)
+	c.Assert(err, gc.Equals, nil)
+	store.Cache = cache
+
+	err = store.Put(strings.NewReader("some data"), hashOf("some data"), 9)
+	c.Assert(err, gc.Equals, nil)
+
+	// The first read misses the cache, so the blob is fetched from
+	// the backend and added to the cache.
+	assertBlobContent(c, store, "some data")
+	c.Assert(backend.gets, gc.Equals, 1)
+	assertCachedBlob(c, cache, "some data")
+
+	// Subsequent reads are served from the cache.
+	assertBlobContent(c, store, "some data")
+	assertBlobContent(c, store, "some data")
+	c.Assert(backend.gets, gc.Equals, 1)
+}
+
+func (s *diskCacheStoreSuite) TestOpenBlobTooLargeToCache(c *gc.C) {
+	backend := &countingBackend{Backend: newMemBackend()}
+	store := blobstore.New(s.Session.DB("db"), "blobstore", backend)
+	cache, err := blobstore.NewDiskCache(c.MkDir(), 5)
+	c.Assert(err, gc.Equals, nil)
+	store.Cache = cache
+
+	err = store.Put(strings.NewReader("some data"), hashOf("some data"), 9)
+	c.Assert(err, gc.Equals, nil)
+
+	assertBlobContent(c, store, "some data")
+	assertBlobContent(c, store, "some data")
+	c.Assert(backend.gets, gc.Equals, 2)
+}
+
+func assertBlobContent(c *gc.C, store *blobstore.Store, content string) {
+	r, size, err := store.Open(hashOf(content), nil)
+	c.Assert(err, gc.Equals, nil)
+	defer r.Close()
+	c.Assert(size, gc.Equals, int64(len(content)))
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(string(data), gc.Equals, content)
+}
+
+func assertCachedBlob(c *gc.C, cache *blobstore.DiskCache, content string) {
+	r, size, ok := cache.Open(hashOf(content))
+	c.Assert(ok, gc.Equals, true)
+	defer r.Close()
+	c.Assert(size, gc.Equals, int64(len(content)))
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(string(data), gc.Equals, content)
+}
+
+// countingBackend is a Backend that counts the calls to Get.
+type countingBackend struct {
+	blobstore.Backend
+	gets int
+}
+
+func (b *countingBackend) Get(name string) (blobstore.ReadSeekCloser, int64, error) {
+	b.gets++
+	return b.Backend.Get(name)
+}
@@ -0,0 +1,398 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package blobstore // import "gopkg.in/juju/charmstore.v5/internal/blobstore"
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"gopkg.in/errgo.v1"
+)
+
+// encryptionMagic is written at the start of every encrypted blob.
+const encryptionMagic = "csenc01\n"
+
+// encryptionSegmentSize holds the amount of plaintext that is sealed
+// in each segment of an encrypted blob. Splitting the blob into
+// independently sealed segments allows it to be read and seeked
+// without decrypting the whole blob.
+const encryptionSegmentSize = 64 * 1024
+
+// EncryptionKeys holds a set of AES keys, indexed by key id, used by
+// an encrypted backend.
+type EncryptionKeys struct {
+	keyID string
+	aeads map[string]cipher.AEAD
+}
+
+// NewEncryptionKeys returns an EncryptionKeys value holding the given
+// AES keys, each of which must be 16, 24 or 32 bytes long. New blobs
+// are encrypted with the key with the given id; blobs encrypted with
+// any of the keys can be decrypted, so old keys should be retained
+// until no blobs encrypted with them remain. If keyID is empty, new
+// blobs are stored unencrypted.
+func NewEncryptionKeys(keys map[string][]byte, keyID string) (*EncryptionKeys, error) {
+	ek := &EncryptionKeys{
+		keyID: keyID,
+		aeads: make(map[string]cipher.AEAD),
+	}
+	for id, key := range keys {
+		if id == "" || len(id) > 255 {
+			return nil, errgo.Newf("invalid encryption key id %q", id)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, errgo.Notef(err, "invalid encryption key %q", id)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, errgo.Notef(err, "invalid encryption key %q", id)
+		}
+		ek.aeads[id] = aead
+	}
+	if keyID != "" && ek.aeads[keyID] == nil {
+		return nil, errgo.Newf("encryption key %q not found", keyID)
+	}
+	return ek, nil
+}
+
+// NewEncryptedBackend returns a Backend that encrypts the data
+// written to the given backend with AES-GCM, using the current key
+// in keys, and decrypts it again when read. The sizes and hashes
+// given to Put and returned from Get are those of the plaintext, so
+// blob hashes are unaffected by encryption. The id of the key used is
+// stored with each blob, along with the nonce. Blobs that were stored
+// without encryption can still be read.
+//
+// Encrypted data is staged in memory or, for large blobs, in a
+// temporary file in tmpdir (or the default temporary directory if
+// tmpdir is empty) so that its hash is known before it is written.
+func NewEncryptedBackend(backend Backend, keys *EncryptionKeys, tmpdir string) Backend {
+	return &encryptedBackend{
+		backend: backend,
+		keys:    keys,
+		tmpdir:  tmpdir,
+	}
+}
+
+type encryptedBackend struct {
+	backend Backend
+	keys    *EncryptionKeys
+	tmpdir  string
+}
+
+// encryptionHeader holds the information stored at the start of an
+// encrypted blob. The encoded header is also used as additional
+// authenticated data for every segment.
+type encryptionHeader struct {
+	keyID string
+	nonce []byte
+	size  int64
+}
+
+func (h *encryptionHeader) marshal() []byte {
+	buf := make([]byte, 0, len(encryptionMagic)+1+len(h.keyID)+len(h.nonce)+8)
+	buf = append(buf, encryptionMagic...)
+	buf = append(buf, byte(len(h.keyID)))
+	buf = append(buf, h.keyID...)
+	buf = append(buf, h.nonce...)
+	var size [8]byte
+	binary.BigEndian.PutUint64(size[:], uint64(h.size))
+	return append(buf, size[:]...)
+}
+
+// encryptedSize returns the size of the encrypted form of
+// a blob with the given header.
+func encryptedSize(header []byte, aead cipher.AEAD, size int64) int64 {
+	segments := (size + encryptionSegmentSize - 1) / encryptionSegmentSize
+	return int64(len(header)) + size + segments*int64(aead.Overhead())
+}
+
+// segmentNonce returns the nonce used to seal the segment with
+// the given index.
+func segmentNonce(nonce []byte, index int64) []byte {
+	n := make([]byte, len(nonce))
+	copy(n, nonce)
+	var seq [8]byte
+	binary.BigEndian.PutUint64(seq[:], uint64(index))
+	for i := range seq {
+		n[len(n)-len(seq)+i] ^= seq[i]
+	}
+	return n
+}
+
+// Get implements Backend.Get.
+func (b *encryptedBackend) Get(name string) (ReadSeekCloser, int64, error) {
+	r, size, err := b.backend.Get(name)
+	if err != nil {
+		return nil, 0, errgo.Mask(err, errgo.Is(ErrNotFound))
+	}
+	rs, size, err := b.decrypt(name, r, size)
+	if err != nil {
+		r.Close()
+		return nil, 0, errgo.Mask(err, errgo.Is(ErrNotFound))
+	}
+	return rs, size, nil
+}
+
+func (b *encryptedBackend) decrypt(name string, r ReadSeekCloser, size int64) (ReadSeekCloser, int64, error) {
+	magic := make([]byte, len(encryptionMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != encryptionMagic {
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, 0, errgo.Mask(err, errgo.Is(ErrNotFound))
+		}
+		// The blob was stored without encryption.
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return nil, 0, errgo.Mask(err, errgo.Is(ErrNotFound))
+		}
+		return r, size, nil
+	}
+	var idLen [1]byte
+	if _, err := io.ReadFull(r, idLen[:]); err != nil {
+		return nil, 0, errgo.Notef(err, "cannot read encryption header of blob %q", name)
+	}
+	keyID := make([]byte, idLen[0])
+	if _, err := io.ReadFull(r, keyID); err != nil {
+		return nil, 0, errgo.Notef(err, "cannot read encryption header of blob %q", name)
+	}
+	aead := b.keys.aeads[string(keyID)]
+	if aead == nil {
+		return nil, 0, errgo.Newf("blob %q is encrypted with unknown key %q", name, keyID)
+	}
+	rest := make([]byte, aead.NonceSize()+8)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, 0, errgo.Notef(err, "cannot read encryption header of blob %q", name)
+	}
+	h := encryptionHeader{
+		keyID: string(keyID),
+		nonce: rest[:aead.NonceSize()],
+		size:  int64(binary.BigEndian.Uint64(rest[aead.NonceSize():])),
+	}
+	header := h.marshal()
+	if encryptedSize(header, aead, h.size) != size {
+		return nil, 0, errgo.Newf("encrypted blob %q has unexpected size %d", name, size)
+	}
+	return &decryptingReader{
+		r:      r,
+		aead:   aead,
+		header: header,
+		nonce:  h.nonce,
+		size:   h.size,
+		index:  -1,
+	}, h.size, nil
+}
+
+// Put implements Backend.Put.
+func (b *encryptedBackend) Put(name string, r io.Reader, size int64, hash string) error {
+	if b.keys.keyID == "" {
+		return errgo.Mask(b.backend.Put(name, r, size, hash), errgo.Is(io.ErrUnexpectedEOF))
+	}
+	aead := b.keys.aeads[b.keys.keyID]
+	h := encryptionHeader{
+		keyID: b.keys.keyID,
+		nonce: make([]byte, aead.NonceSize()),
+		size:  size,
+	}
+	if _, err := io.ReadFull(rand.Reader, h.nonce); err != nil {
+		return errgo.Notef(err, "cannot generate nonce")
+	}
+	header := h.marshal()
+	esize := encryptedSize(header, aead, size)
+
+	var buf io.ReadWriter
+	if esize > maxBufferSize {
+		f, err := ioutil.TempFile(b.tmpdir, "blob")
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		defer func() {
+			f.Close()
+			if err := os.Remove(f.Name()); err != nil {
+				logger.Warningf("error removing temporary file: %s", err)
+			}
+		}()
+		buf = f
+	} else {
+		buf = bytes.NewBuffer(make([]byte, 0, esize))
+	}
+	hasher := NewHash()
+	w := io.MultiWriter(buf, hasher)
+	if _, err := w.Write(header); err != nil {
+		return errgo.Mask(err)
+	}
+	ew := &encryptingWriter{
+		w:      w,
+		aead:   aead,
+		header: header,
+		nonce:  h.nonce,
+		buf:    make([]byte, 0, encryptionSegmentSize),
+	}
+	// Note that the hash is always checked against the plaintext.
+	if err := copyAndCheckHash(ew, r, size, hash); err != nil {
+		return errgo.Mask(err, errgo.Is(io.ErrUnexpectedEOF))
+	}
+	if err := ew.flush(); err != nil {
+		return errgo.Mask(err)
+	}
+	if f, ok := buf.(*os.File); ok {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	ehash := fmt.Sprintf("%x", hasher.Sum(nil))
+	if err := b.backend.Put(name, buf, esize, ehash); err != nil {
+		return errgo.Mask(err, errgo.Is(io.ErrUnexpectedEOF))
+	}
+	return nil
+}
+
+// Describe implements Describer.Describe.
+func (b *encryptedBackend) Describe() BackendInfo {
+	return wrapperInfo("encrypted", nil, b.backend)
+}
+
+// Remove implements Backend.Remove.
+func (b *encryptedBackend) Remove(name string) error {
+	return errgo.Mask(b.backend.Remove(name), errgo.Any)
+}
+
+// encryptingWriter seals the data written to it in segments of
+// encryptionSegmentSize bytes, writing the sealed segments to w.
+type encryptingWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	header []byte
+	nonce  []byte
+	buf    []byte
+	index  int64
+	sealed []byte
+}
+
+func (w *encryptingWriter) Write(data []byte) (int, error) {
+	n := 0
+	for len(data) > 0 {
+		m := copy(w.buf[len(w.buf):cap(w.buf)], data)
+		w.buf = w.buf[:len(w.buf)+m]
+		data = data[m:]
+		n += m
+		if len(w.buf) == cap(w.buf) {
+			if err := w.flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// flush seals and writes any buffered data.
+func (w *encryptingWriter) flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	w.sealed = w.aead.Seal(w.sealed[:0], segmentNonce(w.nonce, w.index), w.buf, w.header)
+	if _, err := w.w.Write(w.sealed); err != nil {
+		return err
+	}
+	w.index++
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// decryptingReader provides a seekable view of the plaintext
+// of an encrypted blob.
+type decryptingReader struct {
+	r      ReadSeekCloser
+	aead   cipher.AEAD
+	header []byte
+	nonce  []byte
+
+	// size holds the size of the plaintext.
+	size int64
+
+	// offset holds the current position in the plaintext.
+	offset int64
+
+	// index holds the index of the segment held in plain,
+	// or -1 if there is none.
+	index int64
+	plain []byte
+	ebuf  []byte
+}
+
+// Read implements io.Reader.
+func (r *decryptingReader) Read(buf []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	index := r.offset / encryptionSegmentSize
+	if index != r.index {
+		if err := r.readSegment(index); err != nil {
+			return 0, errgo.Mask(err, errgo.Is(ErrNotFound))
+		}
+	}
+	n := copy(buf, r.plain[r.offset-index*encryptionSegmentSize:])
+	r.offset += int64(n)
+	return n, nil
+}
+
+// readSegment reads and decrypts the segment with the given index.
+func (r *decryptingReader) readSegment(index int64) error {
+	r.index = -1
+	overhead := int64(r.aead.Overhead())
+	pos := int64(len(r.header)) + index*(encryptionSegmentSize+overhead)
+	if _, err := r.r.Seek(pos, io.SeekStart); err != nil {
+		return errgo.Mask(err, errgo.Is(ErrNotFound))
+	}
+	plainSize := r.size - index*encryptionSegmentSize
+	if plainSize > encryptionSegmentSize {
+		plainSize = encryptionSegmentSize
+	}
+	if cap(r.ebuf) < int(plainSize+overhead) {
+		r.ebuf = make([]byte, plainSize+overhead)
+	}
+	r.ebuf = r.ebuf[:plainSize+overhead]
+	if _, err := io.ReadFull(r.r, r.ebuf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return errgo.Mask(err, errgo.Is(ErrNotFound))
+	}
+	plain, err := r.aead.Open(r.plain[:0], segmentNonce(r.nonce, index), r.ebuf, r.header)
+	if err != nil {
+		return errgo.Notef(err, "cannot decrypt blob")
+	}
+	r.plain = plain
+	r.index = index
+	return nil
+}
+
+// Seek implements io.Seeker.
+func (r *decryptingReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errgo.Newf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, errgo.Newf("negative offset")
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+// Close implements io.Closer.
+func (r *decryptingReader) Close() error {
+	return r.r.Close()
+}
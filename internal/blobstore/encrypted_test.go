@@ -0,0 +1,265 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"strings"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/juju/charmstore.v5/internal/blobstore"
+)
+
+type encryptedSuite struct{}
+
+var _ = gc.Suite(&encryptedSuite{})
+
+var (
+	key1 = []byte("0123456789abcdef0123456789abcdef")
+	key2 = []byte("fedcba9876543210")
+)
+
+func (s *encryptedSuite) TestRoundTrip(c *gc.C) {
+	for _, size := range []int{0, 1, 1000, 64 * 1024, 64*1024 + 1, 200000} {
+		c.Logf("size %d", size)
+		mem := newMemBackend()
+		b := newEncryptedBackend(c, mem, map[string][]byte{"k1": key1}, "k1")
+		data := randomData(size)
+		putData(c, b, "foo", data)
+
+		// The stored data does not hold the plaintext.
+		c.Assert(len(mem.blobs["foo"]) > size, gc.Equals, true)
+		if size > 0 {
+			c.Assert(strings.Contains(mem.blobs["foo"], string(data)), gc.Equals, false)
+		}
+
+		r, gotSize, err := b.Get("foo")
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(gotSize, gc.Equals, int64(size))
+		got, err := ioutil.ReadAll(r)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(r.Close(), gc.Equals, nil)
+		c.Assert(bytes.Equal(got, data), gc.Equals, true)
+		c.Assert(hashOf(string(got)), gc.Equals, hashOf(string(data)))
+	}
+}
+
+func (s *encryptedSuite) TestRoundTripLarge(c *gc.C) {
+	// Large blobs are staged in a temporary file
+	// which is removed afterwards.
+	tmpdir := c.MkDir()
+	ek, err := blobstore.NewEncryptionKeys(map[string][]byte{"k1": key1}, "k1")
+	c.Assert(err, gc.Equals, nil)
+	b := blobstore.NewEncryptedBackend(newMemBackend(), ek, tmpdir)
+	data := randomData(11 * 1024 * 1024)
+	putData(c, b, "foo", data)
+	files, err := ioutil.ReadDir(tmpdir)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(files, gc.HasLen, 0)
+
+	r, _, err := b.Get("foo")
+	c.Assert(err, gc.Equals, nil)
+	defer r.Close()
+	got, err := ioutil.ReadAll(r)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(bytes.Equal(got, data), gc.Equals, true)
+}
+
+func (s *encryptedSuite) TestSeek(c *gc.C) {
+	b := newEncryptedBackend(c, newMemBackend(), map[string][]byte{"k1": key1}, "k1")
+	data := randomData(200000)
+	putData(c, b, "foo", data)
+
+	r, _, err := b.Get("foo")
+	c.Assert(err, gc.Equals, nil)
+	defer r.Close()
+	for _, offset := range []int64{150000, 10, 65535, 0, 199999} {
+		pos, err := r.Seek(offset, io.SeekStart)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(pos, gc.Equals, offset)
+		got, err := ioutil.ReadAll(io.LimitReader(r, 100))
+		c.Assert(err, gc.Equals, nil)
+		end := offset + 100
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+		c.Assert(bytes.Equal(got, data[offset:end]), gc.Equals, true, gc.Commentf("offset %d", offset))
+	}
+	pos, err := r.Seek(-5, io.SeekEnd)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(pos, gc.Equals, int64(len(data)-5))
+}
+
+func (s *encryptedSuite) TestPutHashMismatch(c *gc.C) {
+	mem := newMemBackend()
+	b := newEncryptedBackend(c, mem, map[string][]byte{"k1": key1}, "k1")
+	err := b.Put("foo", strings.NewReader("some data"), 9, hashOf("other data"))
+	c.Assert(err, gc.ErrorMatches, "hash mismatch")
+	c.Assert(mem.blobs, gc.HasLen, 0)
+}
+
+func (s *encryptedSuite) TestPutAbortRemovesTempFile(c *gc.C) {
+	tmpdir := c.MkDir()
+	mem := newMemBackend()
+	ek, err := blobstore.NewEncryptionKeys(map[string][]byte{"k1": key1}, "k1")
+	c.Assert(err, gc.Equals, nil)
+	b := blobstore.NewEncryptedBackend(mem, ek, tmpdir)
+	data := randomData(11 * 1024 * 1024)
+	r := io.MultiReader(bytes.NewReader(data[:5*1024*1024]), errorReader{errgo.New("upload aborted")})
+	err = b.Put("foo", r, int64(len(data)), hashOf(string(data)))
+	c.Assert(err, gc.ErrorMatches, "upload aborted")
+	c.Assert(mem.blobs, gc.HasLen, 0)
+	files, err := ioutil.ReadDir(tmpdir)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(files, gc.HasLen, 0)
+}
+
+func (s *encryptedSuite) TestWrongKey(c *gc.C) {
+	mem := newMemBackend()
+	b := newEncryptedBackend(c, mem, map[string][]byte{"k1": key1}, "k1")
+	putData(c, b, "foo", []byte("some data"))
+
+	b = newEncryptedBackend(c, mem, map[string][]byte{"k1": key2}, "k1")
+	r, _, err := b.Get("foo")
+	c.Assert(err, gc.Equals, nil)
+	defer r.Close()
+	_, err = ioutil.ReadAll(r)
+	c.Assert(err, gc.ErrorMatches, "cannot decrypt blob: cipher: message authentication failed")
+}
+
+func (s *encryptedSuite) TestUnknownKey(c *gc.C) {
+	mem := newMemBackend()
+	b := newEncryptedBackend(c, mem, map[string][]byte{"k1": key1}, "k1")
+	putData(c, b, "foo", []byte("some data"))
+
+	b = newEncryptedBackend(c, mem, map[string][]byte{"k2": key2}, "k2")
+	_, _, err := b.Get("foo")
+	c.Assert(err, gc.ErrorMatches, `blob "foo" is encrypted with unknown key "k1"`)
+}
+
+func (s *encryptedSuite) TestTamperedData(c *gc.C) {
+	mem := newMemBackend()
+	b := newEncryptedBackend(c, mem, map[string][]byte{"k1": key1}, "k1")
+	putData(c, b, "foo", []byte("some data"))
+	stored := []byte(mem.blobs["foo"])
+	stored[len(stored)-1] ^= 1
+	mem.blobs["foo"] = string(stored)
+
+	r, _, err := b.Get("foo")
+	c.Assert(err, gc.Equals, nil)
+	defer r.Close()
+	_, err = ioutil.ReadAll(r)
+	c.Assert(err, gc.ErrorMatches, "cannot decrypt blob: cipher: message authentication failed")
+
+	// Truncated data is detected before reading.
+	mem.blobs["foo"] = string(stored[:len(stored)-1])
+	_, _, err = b.Get("foo")
+	c.Assert(err, gc.ErrorMatches, `encrypted blob "foo" has unexpected size .*`)
+}
+
+func (s *encryptedSuite) TestKeyRotation(c *gc.C) {
+	mem := newMemBackend()
+	b := newEncryptedBackend(c, mem, map[string][]byte{"k1": key1}, "k1")
+	putData(c, b, "old", []byte("old data"))
+
+	b = newEncryptedBackend(c, mem, map[string][]byte{"k1": key1, "k2": key2}, "k2")
+	putData(c, b, "new", []byte("new data"))
+	c.Assert(strings.Contains(mem.blobs["new"], "k2"), gc.Equals, true)
+	assertGet(c, b, "old", "old data")
+	assertGet(c, b, "new", "new data")
+
+	// With no current key, blobs are stored unencrypted
+	// but existing encrypted blobs can still be read.
+	b = newEncryptedBackend(c, mem, map[string][]byte{"k1": key1, "k2": key2}, "")
+	putData(c, b, "plain", []byte("plain data"))
+	c.Assert(mem.blobs["plain"], gc.Equals, "plain data")
+	assertGet(c, b, "old", "old data")
+	assertGet(c, b, "new", "new data")
+	assertGet(c, b, "plain", "plain data")
+}
+
+func (s *encryptedSuite) TestUnencryptedBlob(c *gc.C) {
+	mem := newMemBackend()
+	mem.blobs["foo"] = "unencrypted data"
+	mem.blobs["short"] = "x"
+	b := newEncryptedBackend(c, mem, map[string][]byte{"k1": key1}, "k1")
+	assertGet(c, b, "foo", "unencrypted data")
+	assertGet(c, b, "short", "x")
+}
+
+func (s *encryptedSuite) TestGetNotFound(c *gc.C) {
+	b := newEncryptedBackend(c, newMemBackend(), map[string][]byte{"k1": key1}, "k1")
+	_, _, err := b.Get("foo")
+	c.Assert(errgo.Cause(err), gc.Equals, blobstore.ErrNotFound)
+}
+
+var newEncryptionKeysErrorTests = []struct {
+	about       string
+	keys        map[string][]byte
+	keyID       string
+	expectError string
+}{{
+	about:       "invalid key size",
+	keys:        map[string][]byte{"k1": []byte("short")},
+	keyID:       "k1",
+	expectError: `invalid encryption key "k1": crypto/aes: invalid key size 5`,
+}, {
+	about:       "current key not found",
+	keys:        map[string][]byte{"k1": key1},
+	keyID:       "k2",
+	expectError: `encryption key "k2" not found`,
+}, {
+	about:       "empty key id",
+	keys:        map[string][]byte{"": key1},
+	expectError: `invalid encryption key id ""`,
+}}
+
+func (s *encryptedSuite) TestNewEncryptionKeysErrors(c *gc.C) {
+	for i, test := range newEncryptionKeysErrorTests {
+		c.Logf("test %d: %s", i, test.about)
+		_, err := blobstore.NewEncryptionKeys(test.keys, test.keyID)
+		c.Assert(err, gc.ErrorMatches, test.expectError)
+	}
+}
+
+func newEncryptedBackend(c *gc.C, backend blobstore.Backend, keys map[string][]byte, keyID string) blobstore.Backend {
+	ek, err := blobstore.NewEncryptionKeys(keys, keyID)
+	c.Assert(err, gc.Equals, nil)
+	return blobstore.NewEncryptedBackend(backend, ek, c.MkDir())
+}
+
+func putData(c *gc.C, b blobstore.Backend, name string, data []byte) {
+	err := b.Put(name, bytes.NewReader(data), int64(len(data)), hashOf(string(data)))
+	c.Assert(err, gc.Equals, nil)
+}
+
+func assertGet(c *gc.C, b blobstore.Backend, name, expect string) {
+	r, size, err := b.Get(name)
+	c.Assert(err, gc.Equals, nil)
+	defer r.Close()
+	c.Assert(size, gc.Equals, int64(len(expect)))
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(string(data), gc.Equals, expect)
+}
+
+func randomData(n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(data)
+	return data
+}
+
+// errorReader is an io.Reader that always returns an error.
+type errorReader struct {
+	err error
+}
+
+func (r errorReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
@@ -9,3 +9,5 @@ type UploadDoc uploadDoc
 func BackendGridFS(s *Store) *mgo.GridFS {
 	return s.backend.(*mongoBackend).fs
 }
+
+var ShardedName = shardedName
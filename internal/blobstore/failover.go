@@ -0,0 +1,65 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package blobstore // import "gopkg.in/juju/charmstore.v5/internal/blobstore"
+
+import (
+	"io"
+
+	"gopkg.in/errgo.v1"
+)
+
+// NewFailoverBackend returns a Backend that reads from primary and
+// falls back to reading from secondary when primary returns an error
+// other than one with an ErrNotFound cause. The secondary backend is
+// expected to hold a replica of the primary's objects under the same
+// names. If the secondary read also fails, the primary's error is
+// returned, even when the secondary does not hold the object.
+//
+// All writes and removals go to the primary backend only.
+func NewFailoverBackend(primary, secondary Backend) Backend {
+	return &failoverBackend{
+		primary:   primary,
+		secondary: secondary,
+	}
+}
+
+type failoverBackend struct {
+	primary   Backend
+	secondary Backend
+}
+
+// Get implements Backend.Get.
+func (b *failoverBackend) Get(name string) (ReadSeekCloser, int64, error) {
+	r, size, err := b.primary.Get(name)
+	if err == nil {
+		return r, size, nil
+	}
+	if errgo.Cause(err) == ErrNotFound {
+		return nil, 0, errgo.Mask(err, errgo.Is(ErrNotFound))
+	}
+	logger.Warningf("cannot get blob %q from primary backend, trying secondary: %v", name, err)
+	r, size, err2 := b.secondary.Get(name)
+	if err2 != nil {
+		// The secondary may not yet hold a replica of the blob,
+		// so the primary's error is returned even if the
+		// secondary reports that the blob is not found.
+		return nil, 0, errgo.Notef(err, "cannot get blob from primary backend (secondary also failed: %v)", err2)
+	}
+	return r, size, nil
+}
+
+// Put implements Backend.Put.
+func (b *failoverBackend) Put(name string, r io.Reader, size int64, hash string) error {
+	return errgo.Mask(b.primary.Put(name, r, size, hash), errgo.Any)
+}
+
+// Remove implements Backend.Remove.
+func (b *failoverBackend) Remove(name string) error {
+	return errgo.Mask(b.primary.Remove(name), errgo.Any)
+}
+
+// Describe implements Describer.Describe.
+func (b *failoverBackend) Describe() BackendInfo {
+	return wrapperInfo("failover", nil, b.primary, b.secondary)
+}
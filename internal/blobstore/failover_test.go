@@ -0,0 +1,152 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/juju/charmstore.v5/internal/blobstore"
+)
+
+type failoverSuite struct{}
+
+var _ = gc.Suite(&failoverSuite{})
+
+func (s *failoverSuite) TestGetFromPrimary(c *gc.C) {
+	primary := newMemBackend()
+	primary.blobs["foo"] = "primary data"
+	secondary := newMemBackend()
+	secondary.blobs["foo"] = "secondary data"
+	b := blobstore.NewFailoverBackend(primary, secondary)
+
+	r, size, err := b.Get("foo")
+	c.Assert(err, gc.Equals, nil)
+	defer r.Close()
+	c.Assert(size, gc.Equals, int64(len("primary data")))
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(string(data), gc.Equals, "primary data")
+}
+
+func (s *failoverSuite) TestGetFallsBackOnTransientError(c *gc.C) {
+	primary := newMemBackend()
+	primary.blobs["foo"] = "primary data"
+	primary.getErr = errgo.New("connection refused")
+	secondary := newMemBackend()
+	secondary.blobs["foo"] = "secondary data"
+	b := blobstore.NewFailoverBackend(primary, secondary)
+
+	r, size, err := b.Get("foo")
+	c.Assert(err, gc.Equals, nil)
+	defer r.Close()
+	c.Assert(size, gc.Equals, int64(len("secondary data")))
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(string(data), gc.Equals, "secondary data")
+}
+
+func (s *failoverSuite) TestGetDoesNotFallBackOnNotFound(c *gc.C) {
+	primary := newMemBackend()
+	secondary := newMemBackend()
+	secondary.blobs["foo"] = "secondary data"
+	b := blobstore.NewFailoverBackend(primary, secondary)
+
+	_, _, err := b.Get("foo")
+	c.Assert(errgo.Cause(err), gc.Equals, blobstore.ErrNotFound)
+}
+
+func (s *failoverSuite) TestGetPrimaryFailsNotFoundInSecondary(c *gc.C) {
+	primary := newMemBackend()
+	primary.getErr = errgo.New("connection refused")
+	secondary := newMemBackend()
+	b := blobstore.NewFailoverBackend(primary, secondary)
+
+	// The secondary may not have a replica of the blob yet,
+	// so the primary's error is returned, not a not-found error.
+	_, _, err := b.Get("foo")
+	c.Assert(err, gc.ErrorMatches, `cannot get blob from primary backend \(secondary also failed: blob "foo" not found\): connection refused`)
+	c.Assert(errgo.Cause(err), gc.Not(gc.Equals), blobstore.ErrNotFound)
+}
+
+func (s *failoverSuite) TestGetBothFail(c *gc.C) {
+	primary := newMemBackend()
+	primary.getErr = errgo.New("connection refused")
+	secondary := newMemBackend()
+	secondary.getErr = errgo.New("timed out")
+	b := blobstore.NewFailoverBackend(primary, secondary)
+
+	_, _, err := b.Get("foo")
+	c.Assert(err, gc.ErrorMatches, `cannot get blob from primary backend \(secondary also failed: timed out\): connection refused`)
+}
+
+func (s *failoverSuite) TestPutAndRemoveUsePrimaryOnly(c *gc.C) {
+	primary := newMemBackend()
+	secondary := newMemBackend()
+	b := blobstore.NewFailoverBackend(primary, secondary)
+
+	err := b.Put("foo", bytes.NewReader([]byte("data")), 4, "")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(primary.blobs, gc.DeepEquals, map[string]string{"foo": "data"})
+	c.Assert(secondary.blobs, gc.HasLen, 0)
+
+	secondary.blobs["foo"] = "data"
+	err = b.Remove("foo")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(primary.blobs, gc.HasLen, 0)
+	c.Assert(secondary.blobs, gc.DeepEquals, map[string]string{"foo": "data"})
+}
+
+// memBackend is a simple in-memory blobstore.Backend
+// that can be made to fail reads.
+type memBackend struct {
+	blobs  map[string]string
+	getErr error
+}
+
+func newMemBackend() *memBackend {
+	return &memBackend{
+		blobs: make(map[string]string),
+	}
+}
+
+func (b *memBackend) Get(name string) (blobstore.ReadSeekCloser, int64, error) {
+	if b.getErr != nil {
+		return nil, 0, b.getErr
+	}
+	data, ok := b.blobs[name]
+	if !ok {
+		return nil, 0, errgo.WithCausef(nil, blobstore.ErrNotFound, "blob %q not found", name)
+	}
+	return nopCloser{bytes.NewReader([]byte(data))}, int64(len(data)), nil
+}
+
+func (b *memBackend) Put(name string, r io.Reader, size int64, hash string) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	b.blobs[name] = string(data)
+	return nil
+}
+
+func (b *memBackend) Remove(name string) error {
+	if _, ok := b.blobs[name]; !ok {
+		return errgo.WithCausef(nil, blobstore.ErrNotFound, "blob %q not found", name)
+	}
+	delete(b.blobs, name)
+	return nil
+}
+
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
@@ -4,15 +4,29 @@
 package blobstore // import "gopkg.in/juju/charmstore.v5/internal/blobstore"
 
 import (
+	"compress/gzip"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"strconv"
 
 	"gopkg.in/errgo.v1"
 	"gopkg.in/mgo.v2"
 )
 
 type mongoBackend struct {
-	fs *mgo.GridFS
+	fs       *mgo.GridFS
+	compress bool
+}
+
+// mongoBlobMeta holds the metadata stored with each GridFS file.
+type mongoBlobMeta struct {
+	// Compressed holds whether the file holds gzip-compressed data.
+	Compressed bool `bson:"compressed,omitempty"`
+
+	// Size holds the size of the data before compression. The
+	// size of the file itself is the size of the stored data.
+	Size int64 `bson:"size,omitempty"`
 }
 
 // NewMongoBackend returns a backend implementation which stores
@@ -24,6 +38,17 @@ func NewMongoBackend(db *mgo.Database, prefix string) Backend {
 	}
 }
 
+// NewCompressedMongoBackend is like NewMongoBackend except that the
+// data for each blob is gzip-compressed before it is stored. The sizes
+// and hashes of the blobs are those of the uncompressed data. Blobs
+// stored without compression may still be read.
+func NewCompressedMongoBackend(db *mgo.Database, prefix string) Backend {
+	return &mongoBackend{
+		fs:       db.GridFS(prefix),
+		compress: true,
+	}
+}
+
 func (m *mongoBackend) Get(name string) (ReadSeekCloser, int64, error) {
 	f, err := m.fs.Open(name)
 	if err != nil {
@@ -32,7 +57,20 @@ func (m *mongoBackend) Get(name string) (ReadSeekCloser, int64, error) {
 		}
 		return nil, 0, errgo.Mask(err)
 	}
-	return mongoBackendReader{f}, f.Size(), nil
+	var meta mongoBlobMeta
+	if err := f.GetMeta(&meta); err != nil {
+		f.Close()
+		return nil, 0, errgo.Notef(err, "cannot read blob metadata")
+	}
+	if !meta.Compressed {
+		return mongoBackendReader{f}, f.Size(), nil
+	}
+	r, err := newGzipReadSeeker(mongoBackendReader{f}, meta.Size)
+	if err != nil {
+		f.Close()
+		return nil, 0, errgo.Mask(err, errgo.Is(ErrNotFound))
+	}
+	return r, meta.Size, nil
 }
 
 func (m *mongoBackend) Put(name string, r io.Reader, size int64, hash string) error {
@@ -40,17 +78,47 @@ func (m *mongoBackend) Put(name string, r io.Reader, size int64, hash string) er
 	if err != nil {
 		return errgo.Mask(err)
 	}
-	if err := copyAndCheckHash(f, r, size, hash); err != nil {
+	var w io.Writer = f
+	var zw *gzip.Writer
+	if m.compress {
+		f.SetMeta(mongoBlobMeta{
+			Compressed: true,
+			Size:       size,
+		})
+		zw = gzip.NewWriter(f)
+		w = zw
+	}
+	// Note that the hash is always calculated over the
+	// uncompressed data.
+	if err := copyAndCheckHash(w, r, size, hash); err != nil {
 		f.Abort()
 		f.Close()
 		return errgo.Mask(err, errgo.Is(io.ErrUnexpectedEOF))
 	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			f.Abort()
+			f.Close()
+			return errgo.Mask(err)
+		}
+	}
 	if err := f.Close(); err != nil {
 		return errgo.Mask(err)
 	}
 	return nil
 }
 
+// Describe implements Describer.Describe.
+func (m *mongoBackend) Describe() BackendInfo {
+	info := BackendInfo{
+		Type: "mongodb",
+		Config: map[string]string{
+			"compressed": strconv.FormatBool(m.compress),
+		},
+	}
+	return info.reachability(m.fs.Files.Database.Session.Ping())
+}
+
 func (m *mongoBackend) Remove(name string) error {
 	if err := m.fs.Remove(name); err != nil && err != mgo.ErrNotFound {
 		return errgo.Notef(err, "cannot delete %q", name)
@@ -90,3 +158,84 @@ func (r mongoBackendReader) Read(buf []byte) (int, error) {
 	}
 	return n, errgo.Mask(err)
 }
+
+// gzipReadSeeker provides a seekable view of the uncompressed contents
+// of a gzip-compressed ReadSeekCloser. Seeking forward discards
+// uncompressed data; seeking backward restarts decompression from the
+// beginning of the stream, so random access is expensive.
+type gzipReadSeeker struct {
+	r  ReadSeekCloser
+	zr *gzip.Reader
+
+	// size holds the size of the uncompressed data.
+	size int64
+
+	// pos holds the current position in the uncompressed stream.
+	pos int64
+
+	// offset holds the position that the next read should start
+	// from, as set by Seek.
+	offset int64
+}
+
+func newGzipReadSeeker(r ReadSeekCloser, size int64) (*gzipReadSeeker, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(ErrNotFound))
+	}
+	return &gzipReadSeeker{
+		r:    r,
+		zr:   zr,
+		size: size,
+	}, nil
+}
+
+// Read implements io.Reader.
+func (r *gzipReadSeeker) Read(buf []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.offset < r.pos {
+		if _, err := r.r.Seek(0, io.SeekStart); err != nil {
+			return 0, errgo.Mask(err, errgo.Is(ErrNotFound))
+		}
+		if err := r.zr.Reset(r.r); err != nil {
+			return 0, errgo.Mask(err, errgo.Is(ErrNotFound))
+		}
+		r.pos = 0
+	}
+	if r.offset > r.pos {
+		n, err := io.CopyN(ioutil.Discard, r.zr, r.offset-r.pos)
+		r.pos += n
+		if err != nil {
+			return 0, errgo.Mask(err, errgo.Is(ErrNotFound))
+		}
+	}
+	n, err := r.zr.Read(buf)
+	r.pos += int64(n)
+	r.offset = r.pos
+	return n, err
+}
+
+// Seek implements io.Seeker.
+func (r *gzipReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errgo.Newf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, errgo.Newf("negative offset")
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+// Close implements io.Closer.
+func (r *gzipReadSeeker) Close() error {
+	return r.r.Close()
+}
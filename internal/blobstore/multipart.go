@@ -54,6 +54,14 @@ type uploadDoc struct {
 	// accidentally removing an upload because the
 	// update process failed half-way through.
 	Owner string `bson:",omitempty"`
+
+	// Length holds the total size of the upload if it
+	// was declared when the upload was created.
+	Length int64 `bson:",omitempty"`
+
+	// Metadata holds any metadata associated with
+	// the upload when it was created.
+	Metadata map[string]string `bson:",omitempty"`
 }
 
 // Note that the PartInfo type is also used as a document
@@ -88,6 +96,15 @@ type UploadInfo struct {
 	// This will be empty until the upload has
 	// been completed with FinishUpload.
 	Hash string `bson:"hash,omitempty"`
+
+	// Length holds the total size of the upload as
+	// declared to NewSizedUpload, or zero if the
+	// upload was created with NewUpload.
+	Length int64
+
+	// Metadata holds the metadata passed to
+	// NewSizedUpload.
+	Metadata map[string]string
 }
 
 // Index returns a multipart index suitable for opening
@@ -114,14 +131,33 @@ func (info *UploadInfo) Index() (*mongodoc.MultipartIndex, bool) {
 // creating the upload, each part must be uploaded individually, and
 // then the whole completed by calling FinishUpload and RemoveUpload.
 func (s *Store) NewUpload(expires time.Time) (uploadId string, err error) {
-	uploadId = base64.RawURLEncoding.EncodeToString([]byte(bson.NewObjectId()))
-	if err := s.uploadc.Insert(uploadDoc{
-		Id:      uploadId,
+	return s.newUpload(uploadDoc{
 		Expires: expires,
-	}); err != nil {
+	})
+}
+
+// NewSizedUpload is like NewUpload except that it also records the
+// total size that the upload will have when complete and some
+// arbitrary metadata. Both are returned by UploadInfo.
+func (s *Store) NewSizedUpload(expires time.Time, length int64, metadata map[string]string) (uploadId string, err error) {
+	if length <= 0 {
+		return "", errgo.WithCausef(nil, ErrBadParams, "non-positive upload length %d", length)
+	}
+	return s.newUpload(uploadDoc{
+		Expires:  expires,
+		Length:   length,
+		Metadata: metadata,
+	})
+}
+
+// newUpload inserts the given upload document
+// with a newly allocated upload id.
+func (s *Store) newUpload(udoc uploadDoc) (uploadId string, err error) {
+	udoc.Id = base64.RawURLEncoding.EncodeToString([]byte(bson.NewObjectId()))
+	if err := s.uploadc.Insert(udoc); err != nil {
 		return "", errgo.Notef(err, "cannot create new upload")
 	}
-	return uploadId, nil
+	return udoc.Id, nil
 }
 
 // PutPart uploads a part to the given upload id. The part number
@@ -298,9 +334,11 @@ func (s *Store) UploadInfo(uploadId string) (UploadInfo, error) {
 		return UploadInfo{}, errgo.Mask(err, errgo.Is(ErrNotFound))
 	}
 	return UploadInfo{
-		Parts:   udoc.Parts,
-		Expires: udoc.Expires,
-		Hash:    udoc.Hash,
+		Parts:    udoc.Parts,
+		Expires:  udoc.Expires,
+		Hash:     udoc.Hash,
+		Length:   udoc.Length,
+		Metadata: udoc.Metadata,
 	}, nil
 }
 
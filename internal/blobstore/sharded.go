@@ -0,0 +1,94 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package blobstore // import "gopkg.in/juju/charmstore.v5/internal/blobstore"
+
+import (
+	"io"
+	"strconv"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+)
+
+// MaxShardDepth holds the maximum depth supported by
+// NewShardedBackend. Blob names start with the first 16 hex digits of
+// the blob hash, and each level of sharding uses two of them.
+const MaxShardDepth = 8
+
+// NewShardedBackend returns a Backend that stores each object in the
+// given backend under a key prefixed with depth pseudo-directories,
+// each named by two hex digits taken from the start of the object
+// name (and so from the blob hash), so that the objects are spread
+// across the key space of large Swift or S3 containers. For example,
+// with a depth of 2, the object "0123456789abcdef-xxx" is stored as
+// "01/23/0123456789abcdef-xxx". Names that do not start with enough
+// hex digits are stored unchanged.
+//
+// To allow sharding to be enabled on an existing store, objects that
+// are not found under their sharded key are read and removed under
+// their unsharded name. New objects are always written under their
+// sharded key.
+func NewShardedBackend(backend Backend, depth int) Backend {
+	return &shardedBackend{
+		backend: backend,
+		depth:   depth,
+	}
+}
+
+type shardedBackend struct {
+	backend Backend
+	depth   int
+}
+
+// Get implements Backend.Get.
+func (b *shardedBackend) Get(name string) (ReadSeekCloser, int64, error) {
+	key := shardedName(name, b.depth)
+	r, size, err := b.backend.Get(key)
+	if key == name || errgo.Cause(err) != ErrNotFound {
+		return r, size, errgo.Mask(err, errgo.Is(ErrNotFound))
+	}
+	r, size, err = b.backend.Get(name)
+	return r, size, errgo.Mask(err, errgo.Is(ErrNotFound))
+}
+
+// Put implements Backend.Put.
+func (b *shardedBackend) Put(name string, r io.Reader, size int64, hash string) error {
+	return errgo.Mask(b.backend.Put(shardedName(name, b.depth), r, size, hash), errgo.Is(io.ErrUnexpectedEOF))
+}
+
+// Remove implements Backend.Remove.
+func (b *shardedBackend) Remove(name string) error {
+	key := shardedName(name, b.depth)
+	err := b.backend.Remove(key)
+	if key == name || errgo.Cause(err) != ErrNotFound {
+		return errgo.Mask(err, errgo.Is(ErrNotFound))
+	}
+	return errgo.Mask(b.backend.Remove(name), errgo.Is(ErrNotFound))
+}
+
+// Describe implements Describer.Describe.
+func (b *shardedBackend) Describe() BackendInfo {
+	return wrapperInfo("sharded", map[string]string{
+		"depth": strconv.Itoa(b.depth),
+	}, b.backend)
+}
+
+// shardedName returns the key used to store the object with the given
+// name when sharding to the given depth.
+func shardedName(name string, depth int) string {
+	if depth <= 0 || len(name) < depth*2 {
+		return name
+	}
+	for i := 0; i < depth*2; i++ {
+		if !strings.ContainsRune("0123456789abcdef", rune(name[i])) {
+			return name
+		}
+	}
+	key := make([]byte, 0, len(name)+depth*3)
+	for i := 0; i < depth; i++ {
+		key = append(key, name[i*2:i*2+2]...)
+		key = append(key, '/')
+	}
+	return string(append(key, name...))
+}
@@ -0,0 +1,163 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"io/ioutil"
+	"strings"
+	"time"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2"
+
+	"gopkg.in/juju/charmstore.v5/internal/blobstore"
+)
+
+type shardedSuite struct{}
+
+var _ = gc.Suite(&shardedSuite{})
+
+var shardedNameTests = []struct {
+	name   string
+	depth  int
+	expect string
+}{{
+	name:   "0123456789abcdef-0011223344556677",
+	depth:  0,
+	expect: "0123456789abcdef-0011223344556677",
+}, {
+	name:   "0123456789abcdef-0011223344556677",
+	depth:  1,
+	expect: "01/0123456789abcdef-0011223344556677",
+}, {
+	name:   "0123456789abcdef-0011223344556677",
+	depth:  2,
+	expect: "01/23/0123456789abcdef-0011223344556677",
+}, {
+	name:   "0123456789abcdef-0011223344556677",
+	depth:  8,
+	expect: "01/23/45/67/89/ab/cd/ef/0123456789abcdef-0011223344556677",
+}, {
+	name:   "blobstore-ping",
+	depth:  2,
+	expect: "blobstore-ping",
+}, {
+	name:   "0a",
+	depth:  2,
+	expect: "0a",
+}}
+
+func (s *shardedSuite) TestShardedName(c *gc.C) {
+	for i, test := range shardedNameTests {
+		c.Logf("test %d: %q at depth %d", i, test.name, test.depth)
+		c.Assert(blobstore.ShardedName(test.name, test.depth), gc.Equals, test.expect)
+	}
+}
+
+func (s *shardedSuite) TestRoundTrip(c *gc.C) {
+	mem := newMemBackend()
+	b := blobstore.NewShardedBackend(mem, 2)
+	const name = "0123456789abcdef-0011223344556677"
+
+	err := b.Put(name, strings.NewReader("some data"), 9, hashOf("some data"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(mem.blobs, jc.DeepEquals, map[string]string{
+		"01/23/" + name: "some data",
+	})
+
+	r, size, err := b.Get(name)
+	c.Assert(err, gc.Equals, nil)
+	defer r.Close()
+	c.Assert(size, gc.Equals, int64(9))
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(string(data), gc.Equals, "some data")
+
+	err = b.Remove(name)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(mem.blobs, gc.HasLen, 0)
+
+	_, _, err = b.Get(name)
+	c.Assert(errgo.Cause(err), gc.Equals, blobstore.ErrNotFound)
+	err = b.Remove(name)
+	c.Assert(errgo.Cause(err), gc.Equals, blobstore.ErrNotFound)
+}
+
+func (s *shardedSuite) TestReadsUnshardedName(c *gc.C) {
+	mem := newMemBackend()
+	const name = "0123456789abcdef-0011223344556677"
+	mem.blobs[name] = "old data"
+	b := blobstore.NewShardedBackend(mem, 2)
+
+	r, size, err := b.Get(name)
+	c.Assert(err, gc.Equals, nil)
+	defer r.Close()
+	c.Assert(size, gc.Equals, int64(len("old data")))
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(string(data), gc.Equals, "old data")
+
+	err = b.Remove(name)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(mem.blobs, gc.HasLen, 0)
+}
+
+func (s *shardedSuite) TestGetDoesNotFallBackOnError(c *gc.C) {
+	mem := newMemBackend()
+	mem.getErr = errgo.New("connection refused")
+	b := blobstore.NewShardedBackend(mem, 2)
+
+	_, _, err := b.Get("0123456789abcdef-0011223344556677")
+	c.Assert(err, gc.ErrorMatches, "connection refused")
+}
+
+var _ = gc.Suite(&ShardedMongoStoreSuite{})
+
+type ShardedMongoStoreSuite struct {
+	blobStoreSuite
+}
+
+func (s *ShardedMongoStoreSuite) SetUpTest(c *gc.C) {
+	s.blobStoreSuite.SetUpTest(c, func(db *mgo.Database) blobstore.Backend {
+		return blobstore.NewShardedBackend(blobstore.NewMongoBackend(db, "blobstore"), 2)
+	})
+}
+
+func (s *ShardedMongoStoreSuite) TestPutUsesShardedName(c *gc.C) {
+	content := "some data"
+	hash := hashOf(content)
+	err := s.store.Put(strings.NewReader(content), hash, int64(len(content)))
+	c.Assert(err, gc.Equals, nil)
+	s.assertBlobContent(c, nil, content)
+
+	var files []struct {
+		Filename string
+	}
+	err = s.Session.DB("db").GridFS("blobstore").Find(nil).All(&files)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(files, gc.HasLen, 1)
+	c.Assert(files[0].Filename, jc.HasPrefix, hash[0:2]+"/"+hash[2:4]+"/"+hash[0:16]+"-")
+}
+
+func (s *ShardedMongoStoreSuite) TestOpenUnshardedBlob(c *gc.C) {
+	// Store a blob without sharding, as it would have been
+	// before sharding was enabled.
+	content := "some data"
+	hash := hashOf(content)
+	db := s.Session.DB("db")
+	err := blobstore.New(db, "blobstore", blobstore.NewMongoBackend(db, "blobstore")).Put(strings.NewReader(content), hash, int64(len(content)))
+	c.Assert(err, gc.Equals, nil)
+
+	s.assertBlobContent(c, nil, content)
+
+	// The unsharded blob is removed by GC.
+	_, err = s.store.GC(blobstore.NewRefs(0), time.Now())
+	c.Assert(err, gc.Equals, nil)
+	s.assertBlobDoesNotExist(c, content)
+	n, err := db.GridFS("blobstore").Find(nil).Count()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 0)
+}
@@ -8,6 +8,7 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
 	"strconv"
 
@@ -23,6 +24,8 @@ const maxBufferSize = 10 * 1024 * 1024
 
 type swiftBackend struct {
 	client    *swift.Client
+	cred      *identity.Credentials
+	authmode  identity.AuthMode
 	container string
 	tmpdir    string
 }
@@ -38,6 +41,8 @@ func NewSwiftBackend(cred *identity.Credentials, authmode identity.AuthMode, con
 	c.SetRequiredServiceTypes([]string{"object-store"})
 	return &swiftBackend{
 		client:    swift.New(c),
+		cred:      cred,
+		authmode:  authmode,
 		container: container,
 		tmpdir:    tmpdir,
 	}
@@ -86,7 +91,9 @@ func (s *swiftBackend) putReadSeeker(name string, rs io.ReadSeeker, size int64,
 }
 
 func (s *swiftBackend) putFileBuffer(name string, r io.Reader, size int64, hash string) error {
-	fn := filepath.Join(s.tmpdir, name)
+	// Sharded names contain pseudo-directories, which don't exist
+	// in tmpdir, but the final element is unique on its own.
+	fn := filepath.Join(s.tmpdir, path.Base(name))
 	f, err := os.OpenFile(fn, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
 	if err != nil {
 		return errgo.Mask(err)
@@ -124,6 +131,18 @@ func (s *swiftBackend) putBuffer(name string, r io.Reader, size int64, hash stri
 	return nil
 }
 
+// Describe implements Describer.Describe.
+func (s *swiftBackend) Describe() BackendInfo {
+	info := BackendInfo{
+		Type: "swift",
+		Config: map[string]string{
+			"auth-mode": s.authmode.String(),
+		},
+	}
+	_, err := s.client.List(s.container, "", "", "", 1)
+	return info.reachability(err)
+}
+
 func (s *swiftBackend) Remove(name string) error {
 	err := s.client.DeleteObject(s.container, name)
 	if err != nil && errors.IsNotFound(err) {
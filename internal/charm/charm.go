@@ -21,6 +21,7 @@ const (
 // Alias all necessary types
 type Actions = charm.Actions
 type ApplicationSpec = charm.ApplicationSpec
+type Architecture = charm.Architecture
 type Bundle = charm.Bundle
 type BundleArchive = charm.BundleArchive
 type BundleData = charm.BundleData
@@ -28,11 +29,16 @@ type Charm = charm.Charm
 type CharmArchive = charm.CharmArchive
 type CharmDir = charm.CharmDir
 type Config = charm.Config
+type Container = charm.Container
+type Device = charm.Device
+type ExtraBinding = charm.ExtraBinding
+type LXDProfile = charm.LXDProfile
 type MachineSpec = charm.MachineSpec
 type Meta = charm.Meta
 type Metric = charm.Metric
 type Metrics = charm.Metrics
 type Relation = charm.Relation
+type Storage = charm.Storage
 type URL = charm.URL
 type UnitPlacement = charm.UnitPlacement
 type VerificationError = charm.VerificationError
@@ -71,6 +77,14 @@ func ReadMeta(r io.Reader) (*Meta, error) {
 	return charm.ReadMeta(r)
 }
 
+func ReadConfig(r io.Reader) (*Config, error) {
+	return charm.ReadConfig(r)
+}
+
+func ReadLXDProfile(r io.Reader) (*LXDProfile, error) {
+	return charm.ReadLXDProfile(r)
+}
+
 func ParsePlacement(p string) (*UnitPlacement, error) {
 	return charm.ParsePlacement(p)
 }
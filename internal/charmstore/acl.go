@@ -0,0 +1,101 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5/internal/charmstore"
+
+import (
+	"sort"
+	"time"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/juju/charmstore.v5/internal/charm"
+)
+
+// groupMembersCacheMaxAge holds the maximum length of time
+// that the members of an identity-service group are cached.
+const groupMembersCacheMaxAge = time.Minute
+
+// EffectiveReaders returns the users that are able to read the entity
+// with the given id in the given channel. If ch is params.NoChannel,
+// the most stable channel the entity is published to is used, as when
+// authorizing requests. Groups in the read ACL are expanded to their
+// members; see ExpandReaders for details.
+func (s *Store) EffectiveReaders(url *charm.URL, ch params.Channel) ([]string, error) {
+	entity, err := s.FindBestEntity(url, params.NoChannel, FieldSelector("published"))
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	baseEntity, err := s.FindBaseEntity(entity.URL, FieldSelector("channelacls"))
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	if ch == params.NoChannel {
+		ch = params.UnpublishedChannel
+		for _, c := range params.OrderedChannels {
+			if entity.Published[c] {
+				ch = c
+				break
+			}
+		}
+	}
+	return s.ExpandReaders(baseEntity.ChannelACLs[ch].Read)
+}
+
+// ExpandReaders returns the sorted set of users named by the given
+// ACL, replacing each group with its members as reported by the
+// GroupMembers server parameter. If the ACL allows everyone, the
+// result holds only params.Everyone. If GroupMembers is not set,
+// the names in the ACL are returned unexpanded.
+func (s *Store) ExpandReaders(acl []string) ([]string, error) {
+	users := make(map[string]bool)
+	for _, name := range acl {
+		if name == params.Everyone {
+			return []string{params.Everyone}, nil
+		}
+		members, err := s.pool.groupMembers(name)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot expand %q", name)
+		}
+		if members == nil {
+			users[name] = true
+			continue
+		}
+		for _, m := range members {
+			users[m] = true
+		}
+	}
+	readers := make([]string, 0, len(users))
+	for u := range users {
+		readers = append(readers, u)
+	}
+	sort.Strings(readers)
+	return readers, nil
+}
+
+// groupMembers returns the members of the group with the given name,
+// or nil if the name does not refer to a group. Results are cached
+// for groupMembersCacheMaxAge.
+func (p *Pool) groupMembers(name string) ([]string, error) {
+	if p.config.GroupMembers == nil {
+		return nil, nil
+	}
+	members, err := p.groupMembersCache.Get(name, func() (interface{}, error) {
+		members, err := p.config.GroupMembers(name)
+		if errgo.Cause(err) == params.ErrNotFound {
+			return []string(nil), nil
+		}
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if members == nil {
+			members = []string{}
+		}
+		return members, nil
+	})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return members.([]string), nil
+}
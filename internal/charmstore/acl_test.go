@@ -0,0 +1,139 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"github.com/juju/charmrepo/v6/csclient/params"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/juju/charmstore.v5/internal/charm"
+	"gopkg.in/juju/charmstore.v5/internal/router"
+	"gopkg.in/juju/charmstore.v5/internal/storetesting"
+)
+
+type aclSuite struct {
+	commonSuite
+}
+
+var _ = gc.Suite(&aclSuite{})
+
+// testGroupMembers holds the group memberships reported by the
+// GroupMembers function used in these tests.
+var testGroupMembers = map[string][]string{
+	"charmers": {"bob", "alice"},
+	"admins":   {"alice", "carol"},
+	"nobody":   {},
+}
+
+var effectiveReadersTests = []struct {
+	about         string
+	acl           []string
+	expectReaders []string
+}{{
+	about:         "users only",
+	acl:           []string{"dave", "bob"},
+	expectReaders: []string{"bob", "dave"},
+}, {
+	about:         "group expanded",
+	acl:           []string{"charmers", "dave"},
+	expectReaders: []string{"alice", "bob", "dave"},
+}, {
+	about:         "overlapping groups",
+	acl:           []string{"charmers", "admins", "bob"},
+	expectReaders: []string{"alice", "bob", "carol"},
+}, {
+	about:         "empty group",
+	acl:           []string{"nobody"},
+	expectReaders: []string{},
+}, {
+	about:         "everyone",
+	acl:           []string{"charmers", "everyone"},
+	expectReaders: []string{params.Everyone},
+}}
+
+func (s *aclSuite) TestEffectiveReaders(c *gc.C) {
+	store := s.newStoreWithGroups(c, func(group string) ([]string, error) {
+		members, ok := testGroupMembers[group]
+		if !ok {
+			return nil, errgo.WithCausef(nil, params.ErrNotFound, "group %q not found", group)
+		}
+		return members, nil
+	})
+	defer store.Close()
+	url := router.MustNewResolvedURL("cs:~charmers/"+storetesting.SearchSeries[0]+"/wordpress-1", 1)
+	err := store.AddCharmWithArchive(url, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	for i, test := range effectiveReadersTests {
+		c.Logf("test %d: %s", i, test.about)
+		err := store.SetPerms(&url.URL, "unpublished.read", test.acl...)
+		c.Assert(err, gc.Equals, nil)
+		readers, err := store.EffectiveReaders(&url.URL, params.NoChannel)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(readers, gc.DeepEquals, test.expectReaders)
+	}
+
+	// Once published, the ACL for the published channel is used.
+	err = store.Publish(url, nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	err = store.SetPerms(&url.URL, "stable.read", "admins")
+	c.Assert(err, gc.Equals, nil)
+	readers, err := store.EffectiveReaders(&url.URL, params.NoChannel)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(readers, gc.DeepEquals, []string{"alice", "carol"})
+
+	// An explicit channel selects the ACL for that channel.
+	readers, err = store.EffectiveReaders(&url.URL, params.UnpublishedChannel)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(readers, gc.DeepEquals, []string{params.Everyone})
+}
+
+func (s *aclSuite) TestEffectiveReadersCachesGroups(c *gc.C) {
+	var calls []string
+	store := s.newStoreWithGroups(c, func(group string) ([]string, error) {
+		calls = append(calls, group)
+		return testGroupMembers[group], nil
+	})
+	defer store.Close()
+	for i := 0; i < 3; i++ {
+		readers, err := store.ExpandReaders([]string{"charmers"})
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(readers, gc.DeepEquals, []string{"alice", "bob"})
+	}
+	c.Assert(calls, gc.DeepEquals, []string{"charmers"})
+}
+
+func (s *aclSuite) TestEffectiveReadersGroupError(c *gc.C) {
+	store := s.newStoreWithGroups(c, func(group string) ([]string, error) {
+		return nil, errgo.New("identity service unavailable")
+	})
+	defer store.Close()
+	_, err := store.ExpandReaders([]string{"charmers"})
+	c.Assert(err, gc.ErrorMatches, `cannot expand "charmers": identity service unavailable`)
+}
+
+func (s *aclSuite) TestEffectiveReadersWithoutGroupMembers(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	readers, err := store.ExpandReaders([]string{"charmers", "bob"})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(readers, gc.DeepEquals, []string{"bob", "charmers"})
+}
+
+func (s *aclSuite) TestEffectiveReadersNotFound(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	_, err := store.EffectiveReaders(charm.MustParseURL("~charmers/precise/wordpress-1"), params.NoChannel)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *aclSuite) newStoreWithGroups(c *gc.C, groupMembers func(string) ([]string, error)) *Store {
+	p, err := NewPool(s.Session.DB("juju_test"), nil, nil, ServerParams{
+		GroupMembers: groupMembers,
+	})
+	c.Assert(err, gc.Equals, nil)
+	store := p.Store()
+	defer p.Close()
+	return store
+}
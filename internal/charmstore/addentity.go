@@ -12,6 +12,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"regexp"
 	"sort"
 	"time"
 
@@ -22,6 +23,7 @@ import (
 	"gopkg.in/mgo.v2/bson"
 	"gopkg.in/yaml.v2"
 
+	"gopkg.in/juju/charmstore.v5/audit"
 	"gopkg.in/juju/charmstore.v5/internal/blobstore"
 	"gopkg.in/juju/charmstore.v5/internal/charm"
 	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
@@ -65,8 +67,40 @@ type addParams struct {
 
 	// chans holds the channels to associate with the entity.
 	chans []params.Channel
+
+	// assumes holds the assumes block from a charm's metadata.
+	assumes []mongodoc.AssumesExpression
+
+	// source and sourceURL hold the provenance of the entity.
+	source    string
+	sourceURL string
+}
+
+// AddParams holds the parameters for an upload with
+// UploadEntityWithParams.
+type AddParams struct {
+	// Channels holds the channels to associate with the entity
+	// (without actually making it current in any of them).
+	Channels []params.Channel
+
+	// Source holds the name of the upstream source that the
+	// entity is being ingested from, such as "launchpad" or
+	// "github". It must match SourcePattern if set.
+	Source string
+
+	// SourceURL holds the location of the entity in the upstream
+	// source. It may only be set if Source is set.
+	SourceURL string
+
+	// User holds the name of the user performing the upload, as
+	// recorded in the audit log. If it is empty, the owner of the
+	// entity is recorded.
+	User string
 }
 
+// SourcePattern matches valid upstream source names.
+var SourcePattern = regexp.MustCompile(`^[a-z][a-z0-9-]*$`)
+
 // AddCharmWithArchive adds the given charm, which must
 // be either a *charm.CharmDir or implement ArchiverTo,
 // to the charmstore under the given URL.
@@ -113,12 +147,31 @@ func (s *Store) AddEntityWithArchive(url *router.ResolvedURL, archive interface{
 // UploadEntity reads the given blob, which should have the given hash
 // and size, and uploads it to the charm store, associating it with
 // the given channels (without actually making it current in any of them).
+// On success, an OpUpload audit entry is recorded for the owner of the
+// entity; use UploadEntityWithParams to record a different user.
 //
 // The following error causes may be returned:
 //	params.ErrDuplicateUpload if the URL duplicates an existing entity.
 //	params.ErrEntityIdNotAllowed if the id may not be created.
 //	params.ErrInvalidEntity if the provided blob is invalid.
+//	router.ErrEntityTooLarge if the entity exceeds a configured limit.
 func (s *Store) UploadEntity(url *router.ResolvedURL, blob io.Reader, blobHash string, size int64, chans []params.Channel) error {
+	return s.UploadEntityWithParams(url, blob, blobHash, size, AddParams{
+		Channels: chans,
+	})
+}
+
+// UploadEntityWithParams is like UploadEntity except that it takes
+// additional parameters, including the provenance of an ingested
+// entity. If the provenance is invalid, an error with a
+// params.ErrBadRequest cause is returned.
+func (s *Store) UploadEntityWithParams(url *router.ResolvedURL, blob io.Reader, blobHash string, size int64, p AddParams) error {
+	if p.Source != "" && !SourcePattern.MatchString(p.Source) {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "invalid source %q", p.Source)
+	}
+	if p.Source == "" && p.SourceURL != "" {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "source URL specified without source")
+	}
 	// Strictly speaking these tests are redundant, because a ResolvedURL should
 	// always be canonical, but check just in case anyway, as this is
 	// final gateway before a potentially invalid url might be stored
@@ -129,8 +182,41 @@ func (s *Store) UploadEntity(url *router.ResolvedURL, blob io.Reader, blobHash s
 	if url.URL.Revision == -1 {
 		return errgo.WithCausef(nil, params.ErrEntityIdNotAllowed, "entity id does not specify revision")
 	}
+	if url.URL.Series == "bundle" && size > s.maxBundleSize() {
+		return errgo.WithCausef(nil, router.ErrEntityTooLarge, "bundle archive too large (maximum %d bytes)", s.maxBundleSize())
+	}
+	var limitReader *archiveLimitReader
+	if max := s.pool.config.MaxArchiveSize; max > 0 {
+		if size > max {
+			return errgo.WithCausef(nil, router.ErrEntityTooLarge, "archive too large (maximum %d bytes)", max)
+		}
+		limitReader = &archiveLimitReader{
+			r: blob,
+			n: max,
+		}
+		blob = limitReader
+	}
+	var scanner *archiveScanner
+	if scan := s.pool.config.ArchiveScanner; scan != nil {
+		scanner = newArchiveScanner(scan, blobHash, blob)
+		blob = scanner
+	}
 	blobHash256, err := s.putArchive(blob, size, blobHash)
+	if scanner != nil {
+		// If the scanner rejects the archive, the blob has already
+		// been stored, but it will be removed by the blob store
+		// garbage collector because no entity refers to it.
+		if scanErr := scanner.finish(err); err == nil && scanErr != nil {
+			return errgo.WithCausef(nil, params.ErrForbidden, "archive rejected by scanner: %s", scanErr.Error())
+		}
+	}
 	if err != nil {
+		if limitReader != nil && limitReader.exceeded {
+			// The blob store may not preserve the cause of
+			// errors returned by the reader, so check for
+			// this case explicitly.
+			return errgo.WithCausef(nil, router.ErrEntityTooLarge, "archive too large (maximum %d bytes)", s.pool.config.MaxArchiveSize)
+		}
 		return errgo.Mask(err, errgo.Is(params.ErrInvalidEntity))
 	}
 	uploadDuration := monitoring.NewUploadProcessingDuration()
@@ -143,13 +229,25 @@ func (s *Store) UploadEntity(url *router.ResolvedURL, blob io.Reader, blobHash s
 	if err := s.AddRevision(url); err != nil {
 		return errgo.Mask(err)
 	}
-	if err := s.addEntityFromReader(url, r, blobHash, blobHash256, size, chans); err != nil {
+	if err := s.addEntityFromReader(url, r, blobHash, blobHash256, size, p); err != nil {
 		return errgo.Mask(err,
 			errgo.Is(params.ErrDuplicateUpload),
 			errgo.Is(params.ErrEntityIdNotAllowed),
 			errgo.Is(params.ErrInvalidEntity),
+			errgo.Is(router.ErrEntityTooLarge),
 		)
 	}
+	user := p.User
+	if user == "" {
+		user = url.URL.User
+	}
+	s.AddAudit(audit.Entry{
+		User:     user,
+		Op:       audit.OpUpload,
+		Entity:   &url.URL,
+		BlobHash: blobHash,
+		Size:     size,
+	})
 	return nil
 }
 
@@ -177,7 +275,7 @@ func (s *Store) putArchive(blob io.Reader, blobSize int64, hash string) (blobHas
 
 // addEntityFromReader adds the entity represented by the contents
 // of the given reader, associating it with the given id.
-func (s *Store) addEntityFromReader(id *router.ResolvedURL, r io.ReadSeeker, hash, hash256 string, blobSize int64, chans []params.Channel) error {
+func (s *Store) addEntityFromReader(id *router.ResolvedURL, r io.ReadSeeker, hash, hash256 string, blobSize int64, ap AddParams) error {
 	p := addParams{
 		url:              id,
 		blobHash:         hash,
@@ -186,12 +284,14 @@ func (s *Store) addEntityFromReader(id *router.ResolvedURL, r io.ReadSeeker, has
 		preV5BlobHash:    hash,
 		preV5BlobHash256: hash256,
 		preV5BlobSize:    blobSize,
-		chans:            chans,
+		chans:            ap.Channels,
+		source:           ap.Source,
+		sourceURL:        ap.SourceURL,
 	}
 	if id.URL.Series == "bundle" {
 		b, err := s.newBundle(id, r, blobSize)
 		if err != nil {
-			return errgo.Mask(err, errgo.Is(params.ErrInvalidEntity), errgo.Is(params.ErrDuplicateUpload), errgo.Is(params.ErrEntityIdNotAllowed))
+			return errgo.Mask(err, errgo.Is(params.ErrInvalidEntity), errgo.Is(params.ErrDuplicateUpload), errgo.Is(params.ErrEntityIdNotAllowed), errgo.Is(router.ErrEntityTooLarge))
 		}
 		info, err := addPreV5BundleCompatibilityHackBlob(s.BlobStore, r, p.blobSize)
 		if err != nil && errgo.Cause(err) != errNoCompat {
@@ -210,6 +310,10 @@ func (s *Store) addEntityFromReader(id *router.ResolvedURL, r io.ReadSeeker, has
 	if err != nil {
 		return errgo.Mask(err, errgo.Is(params.ErrInvalidEntity), errgo.Is(params.ErrDuplicateUpload), errgo.Is(params.ErrEntityIdNotAllowed))
 	}
+	p.assumes, err = readAssumes(r, blobSize)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrInvalidEntity))
+	}
 	if len(ch.Meta().Series) > 0 {
 		if _, err := r.Seek(0, 0); err != nil {
 			return errgo.Notef(err, "cannot seek to start of archive")
@@ -405,9 +509,15 @@ func updateZipFile(r io.ReadSeeker, size int64, filename string, updatef func(io
 // read from r, that should have the given size and will
 // be named with the given id.
 //
-// The charm is checked for validity before returning.
+// The charm is checked for validity before returning. If the store
+// has been configured with LintOnUpload, the archive is also linted.
 func (s *Store) newCharm(id *router.ResolvedURL, r io.ReadSeeker, blobSize int64) (charm.Charm, error) {
 	readerAt := ReaderAtSeeker(r)
+	if s.pool.config.LintOnUpload {
+		if err := lintCharm(readerAt, blobSize); err != nil {
+			return nil, errgo.Mask(err, errgo.Is(params.ErrInvalidEntity))
+		}
+	}
 	ch, err := charm.ReadCharmArchiveFromReader(readerAt, blobSize)
 	if err != nil {
 		return nil, zipReadError(err, "cannot read charm archive")
@@ -512,6 +622,11 @@ func (s *Store) addCharm(c charm.Charm, p addParams) (err error) {
 		CharmProvidedInterfaces: interfacesForRelations(c.Meta().Provides),
 		CharmRequiredInterfaces: interfacesForRelations(c.Meta().Requires),
 		SupportedSeries:         c.Meta().Series,
+		Assumes:                 p.assumes,
+		AssumesFeatures:         assumesFeatures(p.assumes),
+		Architectures:           charmArchitectures(c.Meta()),
+		Source:                  p.source,
+		SourceURL:               p.sourceURL,
 	}
 	metrics := c.Metrics()
 	if metrics != nil && len(metrics.Metrics) > 0 {
@@ -580,6 +695,8 @@ func (s *Store) addBundle(b charm.Bundle, p addParams) error {
 		BundleReadMe:       b.ReadMe(),
 		BundleCharms:       urls,
 		PromulgatedURL:     p.url.PromulgatedURL(),
+		Source:             p.source,
+		SourceURL:          p.sourceURL,
 	}
 	denormalizeEntity(entity)
 	setEntityChannels(entity, p.chans)
@@ -605,24 +722,28 @@ func (s *Store) addBundle(b charm.Bundle, p addParams) error {
 // the database. It assumes that the blob associated with the
 // entity has already been validated and stored.
 func (s *Store) addEntity(entity *mongodoc.Entity) (err error) {
-	// Add the base entity to the database.
-	perms := []string{entity.User}
-	channelACLs := make(map[params.Channel]mongodoc.ACL, len(params.OrderedChannels))
-	for _, ch := range params.OrderedChannels {
-		channelACLs[ch] = mongodoc.ACL{
-			Read:  perms,
-			Write: perms,
-		}
-	}
+	// Add the base entity to the database. If it already exists,
+	// for example because its name has been reserved (see
+	// ReserveName), its ACLs are left unchanged.
 	baseEntity := &mongodoc.BaseEntity{
 		URL:         entity.BaseURL,
 		User:        entity.User,
 		Name:        entity.Name,
-		ChannelACLs: channelACLs,
+		ChannelACLs: newChannelACLs(entity.User),
 		Promulgated: entity.PromulgatedURL != nil,
 	}
 	err = s.DB.BaseEntities().Insert(baseEntity)
-	if err != nil && !mgo.IsDup(err) {
+	if mgo.IsDup(err) {
+		// The base entity is in use now, so it is no longer
+		// only a reservation.
+		err = s.DB.BaseEntities().Update(bson.D{
+			{"_id", entity.BaseURL},
+			{"reserved", true},
+		}, bson.D{{"$unset", bson.D{{"reserved", ""}}}})
+		if err != nil && err != mgo.ErrNotFound {
+			return errgo.Notef(err, "cannot update base entity")
+		}
+	} else if err != nil {
 		return errgo.Notef(err, "cannot insert base entity")
 	}
 
@@ -637,6 +758,56 @@ func (s *Store) addEntity(entity *mongodoc.Entity) (err error) {
 	return nil
 }
 
+// ReserveName reserves the name of the charm or bundle with the given
+// base URL, for example cs:~charmers/wordpress, for the given user
+// before anything has been uploaded under it. It creates a base entity
+// with no revisions that only the user can read or write, so only that
+// user (or an admin) can later upload to it.
+//
+// If the base URL is invalid, an error with a params.ErrBadRequest
+// cause is returned. If the base entity already exists, because the
+// name has already been reserved or used, an error with a
+// params.ErrForbidden cause is returned.
+func (s *Store) ReserveName(url *charm.URL, user string) error {
+	if url.Series != "" || url.Revision != -1 {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "%q is not a base URL", url)
+	}
+	if url.User == "" {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "%q has no user", url)
+	}
+	if user == "" {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "no user specified")
+	}
+	err := s.DB.BaseEntities().Insert(&mongodoc.BaseEntity{
+		URL:         url,
+		User:        url.User,
+		Name:        url.Name,
+		ChannelACLs: newChannelACLs(user),
+		Reserved:    true,
+	})
+	if mgo.IsDup(err) {
+		return errgo.WithCausef(nil, params.ErrForbidden, "name %s is already in use", url)
+	}
+	if err != nil {
+		return errgo.Notef(err, "cannot insert base entity")
+	}
+	return nil
+}
+
+// newChannelACLs returns the ACLs of a new base entity, which allow
+// only the given user to read and write every channel.
+func newChannelACLs(user string) map[params.Channel]mongodoc.ACL {
+	perms := []string{user}
+	channelACLs := make(map[params.Channel]mongodoc.ACL, len(params.OrderedChannels))
+	for _, ch := range params.OrderedChannels {
+		channelACLs[ch] = mongodoc.ACL{
+			Read:  perms,
+			Write: perms,
+		}
+	}
+	return channelACLs
+}
+
 // denormalizeEntity sets all denormalized fields in e
 // from their associated canonical fields.
 //
@@ -681,6 +852,12 @@ func (s *Store) newBundle(id *router.ResolvedURL, r io.ReadSeeker, blobSize int6
 	}
 
 	bundleData := b.Data()
+	// Check the number of applications before doing anything that
+	// iterates over them, such as verification or counting the
+	// bundle's units and machines.
+	if n, max := len(bundleData.Applications), s.maxBundleApplications(); n > max {
+		return nil, errgo.WithCausef(nil, router.ErrEntityTooLarge, "bundle has too many applications (%d, maximum %d)", n, max)
+	}
 	charms, err := s.bundleCharms(requiredCharms(bundleData))
 	if err != nil {
 		return nil, errgo.Notef(err, "cannot retrieve bundle charms")
@@ -692,6 +869,104 @@ func (s *Store) newBundle(id *router.ResolvedURL, r io.ReadSeeker, blobSize int6
 	return b, nil
 }
 
+const (
+	// defaultMaxBundleSize holds the maximum size of an uploaded
+	// bundle archive when ServerParams.MaxBundleSize is zero.
+	defaultMaxBundleSize = 10 << 20
+
+	// defaultMaxBundleApplications holds the maximum number of
+	// applications in an uploaded bundle when
+	// ServerParams.MaxBundleApplications is zero.
+	defaultMaxBundleApplications = 500
+)
+
+// maxBundleSize returns the maximum size of an uploaded bundle archive.
+func (s *Store) maxBundleSize() int64 {
+	if s.pool.config.MaxBundleSize > 0 {
+		return s.pool.config.MaxBundleSize
+	}
+	return defaultMaxBundleSize
+}
+
+// archiveLimitReader reads from r, returning an error with a
+// router.ErrEntityTooLarge cause as soon as more than n bytes have been
+// read, so that an over-long upload is aborted before it has been
+// completely read and hashed.
+type archiveLimitReader struct {
+	r        io.Reader
+	n        int64
+	exceeded bool
+}
+
+// Read implements io.Reader.Read.
+func (r *archiveLimitReader) Read(buf []byte) (int, error) {
+	if r.n < 0 {
+		r.exceeded = true
+		return 0, errgo.WithCausef(nil, router.ErrEntityTooLarge, "archive too large")
+	}
+	// Allow one byte more than the limit so that
+	// we can tell when it has been exceeded.
+	if int64(len(buf)) > r.n+1 {
+		buf = buf[:r.n+1]
+	}
+	n, err := r.r.Read(buf)
+	r.n -= int64(n)
+	if r.n < 0 {
+		r.exceeded = true
+		return 0, errgo.WithCausef(nil, router.ErrEntityTooLarge, "archive too large")
+	}
+	return n, err
+}
+
+// archiveScanner passes the data read through it to a
+// ServerParams.ArchiveScanner running in its own goroutine, so that
+// an archive can be scanned while it is being stored.
+type archiveScanner struct {
+	r    io.Reader
+	pw   *io.PipeWriter
+	done chan error
+}
+
+// newArchiveScanner returns an archiveScanner that reads from r and
+// starts scan on the archive with the given hash.
+func newArchiveScanner(scan func(hash string, r io.Reader) error, hash string, r io.Reader) *archiveScanner {
+	pr, pw := io.Pipe()
+	s := &archiveScanner{
+		r:    io.TeeReader(r, pw),
+		pw:   pw,
+		done: make(chan error, 1),
+	}
+	go func() {
+		err := scan(hash, pr)
+		// Discard any data that the scanner did not read so
+		// that reading the archive does not block.
+		io.Copy(ioutil.Discard, pr)
+		s.done <- err
+	}()
+	return s
+}
+
+// Read implements io.Reader.Read.
+func (s *archiveScanner) Read(buf []byte) (int, error) {
+	return s.r.Read(buf)
+}
+
+// finish tells the scanner that there is no more data, returning err
+// from its reads if it is non-nil, and waits for the scanner's result.
+func (s *archiveScanner) finish(err error) error {
+	s.pw.CloseWithError(err)
+	return <-s.done
+}
+
+// maxBundleApplications returns the maximum number of applications in
+// an uploaded bundle.
+func (s *Store) maxBundleApplications() int {
+	if s.pool.config.MaxBundleApplications > 0 {
+		return s.pool.config.MaxBundleApplications
+	}
+	return defaultMaxBundleApplications
+}
+
 func (s *Store) bundleCharms(reqs []requiredCharm) (map[string]charm.Charm, error) {
 	numReqs := len(reqs)
 	urls := make([]*charm.URL, 0, numReqs)
@@ -821,6 +1096,19 @@ func interfacesForRelations(rels map[string]charm.Relation) []string {
 	return result
 }
 
+// charmArchitectures returns the architectures declared in the given
+// charm metadata.
+func charmArchitectures(meta *charm.Meta) []string {
+	if len(meta.Architectures) == 0 {
+		return nil
+	}
+	archs := make([]string, len(meta.Architectures))
+	for i, a := range meta.Architectures {
+		archs[i] = string(a)
+	}
+	return archs
+}
+
 // zipReadError creates an appropriate error for errors in reading an
 // uploaded archive. If the archive could not be read because the data
 // uploaded is invalid then an error with a cause of
@@ -147,6 +147,133 @@ func (s *AddEntitySuite) TestAddCharmWithMultiSeriesToES(c *gc.C) {
 	s.checkAddCharm(c, ch, router.MustNewResolvedURL("~charmers/juju-gui-1", 1))
 }
 
+func (s *AddEntitySuite) TestAddCharmWithAssumes(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	ch := storetesting.NewCharm(nil).WithAssumes(
+		"juju >= 2.9",
+		map[string]interface{}{
+			"any-of": []interface{}{
+				"k8s-api",
+				map[string]interface{}{
+					"all-of": []interface{}{"lxd", "juju < 3.0"},
+				},
+			},
+		},
+	)
+	url := router.MustNewResolvedURL("~charmers/focal/assumer-0", -1)
+	err := store.AddCharmWithArchive(url, ch)
+	c.Assert(err, gc.Equals, nil)
+	entity, err := store.FindEntity(url, FieldSelector("assumes", "assumesfeatures"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entity.Assumes, jc.DeepEquals, []mongodoc.AssumesExpression{{
+		Feature: "juju",
+		Op:      ">=",
+		Version: "2.9",
+	}, {
+		AnyOf: []mongodoc.AssumesExpression{{
+			Feature: "k8s-api",
+		}, {
+			AllOf: []mongodoc.AssumesExpression{{
+				Feature: "lxd",
+			}, {
+				Feature: "juju",
+				Op:      "<",
+				Version: "3.0",
+			}},
+		}},
+	}})
+	c.Assert(entity.AssumesFeatures, jc.DeepEquals, []string{"juju<3.0", "juju>=2.9", "k8s-api", "lxd"})
+}
+
+var addCharmWithInvalidAssumesTests = []struct {
+	about       string
+	assumes     []interface{}
+	expectError string
+}{{
+	about:       "invalid feature",
+	assumes:     []interface{}{"juju >= two"},
+	expectError: `invalid assumes block: invalid feature expression "juju >= two"`,
+}, {
+	about: "unknown composite expression",
+	assumes: []interface{}{
+		map[string]interface{}{"none-of": []interface{}{"lxd"}},
+	},
+	expectError: `invalid assumes block: unknown composite expression "none-of"`,
+}, {
+	about: "composite expression without a list",
+	assumes: []interface{}{
+		map[string]interface{}{"any-of": "lxd"},
+	},
+	expectError: `invalid assumes block: any-of expression does not hold a list`,
+}}
+
+func (s *AddEntitySuite) TestAddCharmWithInvalidAssumes(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	for i, test := range addCharmWithInvalidAssumesTests {
+		c.Logf("test %d: %s", i, test.about)
+		ch := storetesting.NewCharm(nil).WithAssumes(test.assumes...)
+		url := router.MustNewResolvedURL(fmt.Sprintf("~charmers/focal/assumer-%d", i), -1)
+		err := store.AddCharmWithArchive(url, ch)
+		c.Assert(err, gc.ErrorMatches, test.expectError)
+		c.Assert(errgo.Cause(err), gc.Equals, params.ErrInvalidEntity)
+	}
+}
+
+func (s *AddEntitySuite) TestUploadEntityWithSource(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	ch := storetesting.NewCharm(nil)
+	url := router.MustNewResolvedURL("~charmers/focal/ingested-0", -1)
+	err := store.UploadEntityWithParams(url, bytes.NewReader(ch.Bytes()), hashOfString(string(ch.Bytes())), int64(len(ch.Bytes())), AddParams{
+		Channels:  []params.Channel{params.EdgeChannel},
+		Source:    "github",
+		SourceURL: "https://github.com/charmers/ingested",
+	})
+	c.Assert(err, gc.Equals, nil)
+	entity, err := store.FindEntity(url, FieldSelector("source", "sourceurl", "published"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entity.Source, gc.Equals, "github")
+	c.Assert(entity.SourceURL, gc.Equals, "https://github.com/charmers/ingested")
+	c.Assert(entity.Published, jc.DeepEquals, map[params.Channel]bool{
+		params.EdgeChannel: true,
+	})
+}
+
+var uploadEntityWithInvalidSourceTests = []struct {
+	about       string
+	source      string
+	sourceURL   string
+	expectError string
+}{{
+	about:       "invalid source",
+	source:      "Git Hub",
+	expectError: `invalid source "Git Hub"`,
+}, {
+	about:       "source URL without source",
+	sourceURL:   "https://github.com/charmers/ingested",
+	expectError: `source URL specified without source`,
+}}
+
+func (s *AddEntitySuite) TestUploadEntityWithInvalidSource(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	ch := storetesting.NewCharm(nil)
+	url := router.MustNewResolvedURL("~charmers/focal/ingested-0", -1)
+	for i, test := range uploadEntityWithInvalidSourceTests {
+		c.Logf("test %d: %s", i, test.about)
+		err := store.UploadEntityWithParams(url, bytes.NewReader(ch.Bytes()), hashOfString(string(ch.Bytes())), int64(len(ch.Bytes())), AddParams{
+			Source:    test.source,
+			SourceURL: test.sourceURL,
+		})
+		c.Assert(err, gc.ErrorMatches, test.expectError)
+		c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+	}
+	_, err := store.FindEntity(url, nil)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
 func (s *AddEntitySuite) TestAddBundleDuplicatingCharm(c *gc.C) {
 	store := s.newStore(c, false)
 	defer store.Close()
@@ -332,6 +459,118 @@ func (s *AddEntitySuite) TestUploadEntityErrors(c *gc.C) {
 	}
 }
 
+const lintTestMetadata = `
+name: foo
+summary: foo
+description: foo
+series: [xenial]
+provides:
+  website:
+    interface: http
+`
+
+var lintOnUploadTests = []struct {
+	about       string
+	files       []storetesting.File
+	expectError string
+}{{
+	about: "valid charm",
+	files: []storetesting.File{{
+		Name: "metadata.yaml",
+		Data: []byte(lintTestMetadata),
+	}, {
+		Name: "config.yaml",
+		Data: []byte("options:\n  port:\n    type: int\n    default: 80\n"),
+	}, {
+		Name: "hooks/website-relation-joined",
+		Data: []byte("#!/bin/sh\n"),
+	}},
+}, {
+	about: "missing metadata.yaml",
+	files: []storetesting.File{{
+		Name: "config.yaml",
+		Data: []byte("options: {}\n"),
+	}},
+	expectError: `charm failed lint checks: metadata.yaml not found`,
+}, {
+	about: "invalid config option type",
+	files: []storetesting.File{{
+		Name: "metadata.yaml",
+		Data: []byte(lintTestMetadata),
+	}, {
+		Name: "config.yaml",
+		Data: []byte("options:\n  port:\n    type: integer\n  name:\n    type: text\n"),
+	}, {
+		Name: "hooks/website-relation-joined",
+		Data: []byte("#!/bin/sh\n"),
+	}},
+	expectError: `charm failed lint checks: config option "name" has invalid type "text"; config option "port" has invalid type "integer"`,
+}, {
+	about: "missing relation hooks",
+	files: []storetesting.File{{
+		Name: "metadata.yaml",
+		Data: []byte(lintTestMetadata),
+	}, {
+		Name: "hooks/install",
+		Data: []byte("#!/bin/sh\n"),
+	}},
+	expectError: `charm failed lint checks: no hooks found for relation "website"`,
+}, {
+	about: "relation hooks handled by dispatch",
+	files: []storetesting.File{{
+		Name: "metadata.yaml",
+		Data: []byte(lintTestMetadata),
+	}, {
+		Name: "dispatch",
+		Data: []byte("#!/bin/sh\n"),
+	}},
+}, {
+	about: "multiple issues",
+	files: []storetesting.File{{
+		Name: "metadata.yaml",
+		Data: []byte(lintTestMetadata),
+	}, {
+		Name: "config.yaml",
+		Data: []byte("options:\n  port:\n    type: integer\n"),
+	}},
+	expectError: `charm failed lint checks: no hooks found for relation "website"; config option "port" has invalid type "integer"`,
+}}
+
+func (s *AddEntitySuite) TestLintOnUpload(c *gc.C) {
+	p, err := NewPool(s.Session.DB("juju_test"), nil, nil, ServerParams{
+		LintOnUpload: true,
+	})
+	c.Assert(err, gc.Equals, nil)
+	defer p.Close()
+	store := p.Store()
+	defer store.Close()
+	for i, test := range lintOnUploadTests {
+		c.Logf("test %d: %s", i, test.about)
+		url := router.MustNewResolvedURL(fmt.Sprintf("~charmers/xenial/foo-%d", i), -1)
+		err := store.AddEntityWithArchive(url, storetesting.NewBlob(test.files))
+		if test.expectError == "" {
+			c.Assert(err, gc.Equals, nil)
+			continue
+		}
+		c.Assert(err, gc.ErrorMatches, regexp.QuoteMeta(test.expectError))
+		c.Assert(errgo.Cause(err), gc.Equals, params.ErrInvalidEntity)
+	}
+}
+
+func (s *AddEntitySuite) TestLintOnUploadDisabled(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	// A charm with no relation hooks is accepted when linting
+	// is not enabled.
+	url := router.MustNewResolvedURL("~charmers/xenial/foo-0", -1)
+	err := store.AddEntityWithArchive(url, storetesting.NewBlob([]storetesting.File{{
+		Name: "metadata.yaml",
+		Data: []byte(lintTestMetadata),
+	}}))
+	c.Assert(err, gc.Equals, nil)
+}
+
 func (s *AddEntitySuite) TestUploadBundleWithServices(c *gc.C) {
 	store := s.newStore(c, true)
 	defer store.Close()
@@ -365,6 +604,142 @@ services:
 	c.Assert(entity.BundleData.Applications, gc.DeepEquals, bundle.Data().Applications)
 }
 
+func (s *AddEntitySuite) TestAddBundleTooManyApplications(c *gc.C) {
+	p, err := NewPool(s.Session.DB("juju_test"), nil, nil, ServerParams{
+		MaxBundleApplications: 1,
+	})
+	c.Assert(err, gc.Equals, nil)
+	defer p.Close()
+	store := p.Store()
+	defer store.Close()
+
+	bundle := storetesting.Charms.BundleDir("wordpress-simple")
+	c.Assert(bundle.Data().Applications, gc.HasLen, 2)
+	s.addRequiredCharms(c, bundle)
+	url := router.MustNewResolvedURL("cs:~charmers/bundle/wordpress-simple-0", -1)
+	err = store.AddBundleWithArchive(url, bundle)
+	c.Assert(err, gc.ErrorMatches, `bundle has too many applications \(2, maximum 1\)`)
+	c.Assert(errgo.Cause(err), gc.Equals, router.ErrEntityTooLarge)
+	_, err = store.FindEntity(url, nil)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *AddEntitySuite) TestAddBundleTooLarge(c *gc.C) {
+	p, err := NewPool(s.Session.DB("juju_test"), nil, nil, ServerParams{
+		MaxBundleSize: 100,
+	})
+	c.Assert(err, gc.Equals, nil)
+	defer p.Close()
+	store := p.Store()
+	defer store.Close()
+
+	bundle := storetesting.Charms.BundleDir("wordpress-simple")
+	s.addRequiredCharms(c, bundle)
+	url := router.MustNewResolvedURL("cs:~charmers/bundle/wordpress-simple-0", -1)
+	err = store.AddBundleWithArchive(url, bundle)
+	c.Assert(err, gc.ErrorMatches, `bundle archive too large \(maximum 100 bytes\)`)
+	c.Assert(errgo.Cause(err), gc.Equals, router.ErrEntityTooLarge)
+	_, err = store.FindEntity(url, nil)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+
+	// Charms are not subject to the bundle size limit.
+	err = store.AddCharmWithArchive(router.MustNewResolvedURL("cs:~charmers/trusty/wordpress-1", -1), storetesting.Charms.CharmDir("wordpress"))
+	c.Assert(err, gc.Equals, nil)
+}
+
+func (s *AddEntitySuite) TestUploadEntityArchiveTooLarge(c *gc.C) {
+	p, err := NewPool(s.Session.DB("juju_test"), nil, nil, ServerParams{
+		MaxArchiveSize: 100,
+	})
+	c.Assert(err, gc.Equals, nil)
+	defer p.Close()
+	store := p.Store()
+	defer store.Close()
+
+	ch := storetesting.NewCharm(nil)
+	url := router.MustNewResolvedURL("cs:~charmers/trusty/wordpress-0", -1)
+	err = store.UploadEntity(url, bytes.NewReader(ch.Bytes()), hashOfString(string(ch.Bytes())), int64(len(ch.Bytes())), nil)
+	c.Assert(err, gc.ErrorMatches, `archive too large \(maximum 100 bytes\)`)
+	c.Assert(errgo.Cause(err), gc.Equals, router.ErrEntityTooLarge)
+	_, err = store.FindEntity(url, nil)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *AddEntitySuite) TestUploadEntityArchiveScannerRejects(c *gc.C) {
+	ch := storetesting.NewCharm(nil)
+	var scanned []byte
+	var scannedHash string
+	p, err := NewPool(s.Session.DB("juju_test"), nil, nil, ServerParams{
+		ArchiveScanner: func(hash string, r io.Reader) error {
+			scannedHash = hash
+			data, err := ioutil.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			scanned = data
+			return errgo.New("found a secret")
+		},
+	})
+	c.Assert(err, gc.Equals, nil)
+	defer p.Close()
+	store := p.Store()
+	defer store.Close()
+
+	url := router.MustNewResolvedURL("cs:~charmers/trusty/wordpress-0", -1)
+	hash := hashOfString(string(ch.Bytes()))
+	err = store.UploadEntity(url, bytes.NewReader(ch.Bytes()), hash, int64(len(ch.Bytes())), nil)
+	c.Assert(err, gc.ErrorMatches, `archive rejected by scanner: found a secret`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrForbidden)
+	c.Assert(scannedHash, gc.Equals, hash)
+	c.Assert(scanned, gc.DeepEquals, ch.Bytes())
+	_, err = store.FindEntity(url, nil)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *AddEntitySuite) TestAddCharmWithArchiveScannerAccepts(c *gc.C) {
+	scanned := 0
+	p, err := NewPool(s.Session.DB("juju_test"), nil, nil, ServerParams{
+		ArchiveScanner: func(hash string, r io.Reader) error {
+			// Read only part of the archive to check that
+			// the upload does not depend on the scanner
+			// reading everything.
+			_, err := r.Read(make([]byte, 10))
+			scanned++
+			return err
+		},
+	})
+	c.Assert(err, gc.Equals, nil)
+	defer p.Close()
+	store := p.Store()
+	defer store.Close()
+
+	url := router.MustNewResolvedURL("cs:~charmers/trusty/wordpress-0", -1)
+	err = store.AddCharmWithArchive(url, storetesting.Charms.CharmDir("wordpress"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(scanned, gc.Equals, 1)
+	_, err = store.FindEntity(url, nil)
+	c.Assert(err, gc.Equals, nil)
+}
+
+func (s *AddEntitySuite) TestArchiveLimitReader(c *gc.C) {
+	data := bytes.Repeat([]byte("x"), 200)
+
+	// Reading up to the limit succeeds.
+	r := &archiveLimitReader{r: bytes.NewReader(data[:100]), n: 100}
+	got, err := ioutil.ReadAll(r)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(got, gc.HasLen, 100)
+	c.Assert(r.exceeded, gc.Equals, false)
+
+	// Reading beyond the limit fails without returning
+	// the extra data.
+	r = &archiveLimitReader{r: bytes.NewReader(data), n: 100}
+	got, err = ioutil.ReadAll(r)
+	c.Assert(errgo.Cause(err), gc.Equals, router.ErrEntityTooLarge)
+	c.Assert(len(got) <= 100, gc.Equals, true)
+	c.Assert(r.exceeded, gc.Equals, true)
+}
+
 func (s *AddEntitySuite) TestUploadBundleWithCharmsFromDifferentChannels(c *gc.C) {
 	store := s.newStore(c, true)
 	defer store.Close()
@@ -0,0 +1,92 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5/internal/charmstore"
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
+)
+
+// apiTokenSize holds the number of random bytes in an API token.
+const apiTokenSize = 24
+
+// CreateAPIToken creates a new API token that authenticates requests
+// as the given user until the given expiry time. Only a hash of the
+// token is stored, so the returned token cannot be retrieved again
+// later.
+func (s *Store) CreateAPIToken(user string, expiry time.Time) (string, error) {
+	if user == "" {
+		return "", errgo.WithCausef(nil, params.ErrBadRequest, "no user specified for API token")
+	}
+	buf := make([]byte, apiTokenSize)
+	if _, err := rand.Read(buf); err != nil {
+		return "", errgo.Notef(err, "cannot generate API token")
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+	if err := s.DB.APITokens().Insert(&mongodoc.APIToken{
+		Hash:    apiTokenHash(token),
+		User:    user,
+		Created: timeNow().UTC(),
+		Expires: expiry.UTC(),
+	}); err != nil {
+		return "", errgo.Notef(err, "cannot insert API token")
+	}
+	return token, nil
+}
+
+// AuthenticateToken returns the name of the user authenticated by the
+// given API token. If the token is unknown, has been revoked or has
+// expired, an error with a params.ErrUnauthorized cause is returned.
+func (s *Store) AuthenticateToken(token string) (string, error) {
+	var doc mongodoc.APIToken
+	if err := s.DB.APITokens().FindId(apiTokenHash(token)).One(&doc); err != nil {
+		if err == mgo.ErrNotFound {
+			return "", errgo.WithCausef(nil, params.ErrUnauthorized, "invalid API token")
+		}
+		return "", errgo.Notef(err, "cannot get API token")
+	}
+	// Expired tokens are removed by a TTL index, but
+	// that may happen some time after they expire.
+	if !timeNow().Before(doc.Expires) {
+		return "", errgo.WithCausef(nil, params.ErrUnauthorized, "API token has expired")
+	}
+	return doc.User, nil
+}
+
+// RevokeAPIToken revokes the given API token so that it can no
+// longer be used for authentication. If the token does not exist,
+// an error with a params.ErrNotFound cause is returned.
+func (s *Store) RevokeAPIToken(token string) error {
+	if err := s.DB.APITokens().RemoveId(apiTokenHash(token)); err != nil {
+		if err == mgo.ErrNotFound {
+			return errgo.WithCausef(nil, params.ErrNotFound, "API token not found")
+		}
+		return errgo.Notef(err, "cannot remove API token")
+	}
+	return nil
+}
+
+// RevokeAPITokens revokes all the API tokens of the given user.
+func (s *Store) RevokeAPITokens(user string) error {
+	if _, err := s.DB.APITokens().RemoveAll(bson.D{{"user", user}}); err != nil {
+		return errgo.Notef(err, "cannot remove API tokens")
+	}
+	return nil
+}
+
+// apiTokenHash returns the hash of the given token as it
+// is stored in the database.
+func apiTokenHash(token string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(token)))
+}
@@ -0,0 +1,128 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"time"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
+)
+
+type apiTokenSuite struct {
+	commonSuite
+}
+
+var _ = gc.Suite(&apiTokenSuite{})
+
+func (s *apiTokenSuite) TestCreateAndAuthenticateToken(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	token, err := store.CreateAPIToken("bob", time.Now().Add(time.Hour))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(token, gc.Not(gc.Equals), "")
+
+	user, err := store.AuthenticateToken(token)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(user, gc.Equals, "bob")
+
+	// Only the hash of the token is stored.
+	var docs []mongodoc.APIToken
+	err = store.DB.APITokens().Find(nil).All(&docs)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(docs, gc.HasLen, 1)
+	c.Assert(docs[0].Hash, gc.Not(gc.Equals), token)
+	c.Assert(docs[0].User, gc.Equals, "bob")
+
+	// Each token is different.
+	token1, err := store.CreateAPIToken("bob", time.Now().Add(time.Hour))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(token1, gc.Not(gc.Equals), token)
+}
+
+func (s *apiTokenSuite) TestCreateAPITokenNoUser(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	_, err := store.CreateAPIToken("", time.Now().Add(time.Hour))
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+}
+
+func (s *apiTokenSuite) TestAuthenticateUnknownToken(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	_, err := store.AuthenticateToken("no-such-token")
+	c.Assert(err, gc.ErrorMatches, "invalid API token")
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrUnauthorized)
+}
+
+func (s *apiTokenSuite) TestAuthenticateExpiredToken(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	now := time.Now()
+	s.PatchValue(&timeNow, func() time.Time {
+		return now
+	})
+	token, err := store.CreateAPIToken("bob", now.Add(time.Minute))
+	c.Assert(err, gc.Equals, nil)
+	_, err = store.AuthenticateToken(token)
+	c.Assert(err, gc.Equals, nil)
+
+	now = now.Add(time.Minute)
+	_, err = store.AuthenticateToken(token)
+	c.Assert(err, gc.ErrorMatches, "API token has expired")
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrUnauthorized)
+}
+
+func (s *apiTokenSuite) TestRevokeAPIToken(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	token1, err := store.CreateAPIToken("bob", time.Now().Add(time.Hour))
+	c.Assert(err, gc.Equals, nil)
+	token2, err := store.CreateAPIToken("bob", time.Now().Add(time.Hour))
+	c.Assert(err, gc.Equals, nil)
+
+	err = store.RevokeAPIToken(token1)
+	c.Assert(err, gc.Equals, nil)
+	_, err = store.AuthenticateToken(token1)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrUnauthorized)
+
+	// Other tokens are not affected.
+	user, err := store.AuthenticateToken(token2)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(user, gc.Equals, "bob")
+
+	err = store.RevokeAPIToken(token1)
+	c.Assert(err, gc.ErrorMatches, "API token not found")
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *apiTokenSuite) TestRevokeAPITokens(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	bob1, err := store.CreateAPIToken("bob", time.Now().Add(time.Hour))
+	c.Assert(err, gc.Equals, nil)
+	bob2, err := store.CreateAPIToken("bob", time.Now().Add(time.Hour))
+	c.Assert(err, gc.Equals, nil)
+	alice, err := store.CreateAPIToken("alice", time.Now().Add(time.Hour))
+	c.Assert(err, gc.Equals, nil)
+
+	err = store.RevokeAPITokens("bob")
+	c.Assert(err, gc.Equals, nil)
+	_, err = store.AuthenticateToken(bob1)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrUnauthorized)
+	_, err = store.AuthenticateToken(bob2)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrUnauthorized)
+	user, err := store.AuthenticateToken(alice)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(user, gc.Equals, "alice")
+}
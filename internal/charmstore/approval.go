@@ -0,0 +1,104 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5/internal/charmstore"
+
+import (
+	"github.com/juju/charmrepo/v6/csclient/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2"
+
+	"gopkg.in/juju/charmstore.v5/internal/charm"
+	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5/internal/router"
+)
+
+// ApprovalRequired reports whether publishing to the given channel
+// requires approval, as configured by
+// ServerParams.ApprovalRequiredChannels.
+func (s *Store) ApprovalRequired(channel params.Channel) bool {
+	for _, ch := range s.pool.config.ApprovalRequiredChannels {
+		if ch == channel {
+			return true
+		}
+	}
+	return false
+}
+
+// RequestPublish records a request by the given user to publish the
+// entity with the given id to the given channel, which must require
+// approval. The entity is not published until the request is approved
+// with ApprovePublish. The resources and requireResources arguments
+// are used when publishing as for Publish and
+// PublishRequiringResources. Any earlier request to publish the same
+// entity to the same channel is replaced.
+func (s *Store) RequestPublish(url *router.ResolvedURL, channel params.Channel, resources map[string]int, requireResources bool, user string) error {
+	if !s.ApprovalRequired(channel) {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "publishing to the %s channel does not require approval", channel)
+	}
+	if user == "" {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "no user specified for publish request")
+	}
+	if _, err := s.FindEntity(url, FieldSelector("_id")); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	doc := mongodoc.PendingPublish{
+		Id:               pendingPublishId(&url.URL, channel),
+		URL:              &url.URL,
+		Channel:          channel,
+		Resources:        resources,
+		RequireResources: requireResources,
+		User:             user,
+		Time:             timeNow().UTC(),
+	}
+	if _, err := s.DB.PendingPublishes().UpsertId(doc.Id, &doc); err != nil {
+		return errgo.Notef(err, "cannot record publish request")
+	}
+	return nil
+}
+
+// ApprovePublish approves the pending request to publish the entity
+// with the given id to the given channel on behalf of the given user,
+// and publishes the entity. Users cannot approve their own requests.
+// The approving user is recorded in the publish history as having
+// published the entity.
+//
+// If there is no such request, an error with a params.ErrNotFound
+// cause is returned. If the user made the request, an error with a
+// params.ErrForbidden cause is returned. If the publish fails, the
+// request is left pending.
+func (s *Store) ApprovePublish(url *router.ResolvedURL, channel params.Channel, user string) error {
+	var doc mongodoc.PendingPublish
+	if err := s.DB.PendingPublishes().FindId(pendingPublishId(&url.URL, channel)).One(&doc); err != nil {
+		if err == mgo.ErrNotFound {
+			return errgo.WithCausef(nil, params.ErrNotFound, "no pending publish of %s to the %s channel", &url.URL, channel)
+		}
+		return errgo.Notef(err, "cannot get publish request")
+	}
+	if doc.User == user {
+		return errgo.WithCausef(nil, params.ErrForbidden, "cannot approve own publish request")
+	}
+	if err := s.publish(url, doc.Resources, doc.RequireResources, user, []params.Channel{channel}); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound), errgo.Is(ErrPublishResourceMismatch))
+	}
+	if err := s.DB.PendingPublishes().RemoveId(doc.Id); err != nil && err != mgo.ErrNotFound {
+		return errgo.Notef(err, "cannot remove publish request")
+	}
+	return nil
+}
+
+// ListPendingPublishes returns all the publish requests awaiting
+// approval, oldest first.
+func (s *Store) ListPendingPublishes() ([]mongodoc.PendingPublish, error) {
+	var docs []mongodoc.PendingPublish
+	if err := s.DB.PendingPublishes().Find(nil).Sort("time", "_id").All(&docs); err != nil {
+		return nil, errgo.Notef(err, "cannot list publish requests")
+	}
+	return docs, nil
+}
+
+// pendingPublishId returns the id of the pending publish document for
+// the given entity and channel.
+func pendingPublishId(url *charm.URL, channel params.Channel) string {
+	return string(channel) + " " + url.String()
+}
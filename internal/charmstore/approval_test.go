@@ -0,0 +1,129 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"time"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/juju/charmstore.v5/internal/charm"
+	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5/internal/storetesting"
+)
+
+type approvalSuite struct {
+	commonSuite
+}
+
+var _ = gc.Suite(&approvalSuite{})
+
+func (s *approvalSuite) newStore(c *gc.C) *Store {
+	p, err := NewPool(s.Session.DB("juju_test"), nil, nil, ServerParams{
+		ApprovalRequiredChannels: []params.Channel{params.StableChannel},
+	})
+	c.Assert(err, gc.Equals, nil)
+	defer p.Close()
+	return p.Store()
+}
+
+func (s *approvalSuite) TestApprovalRequired(c *gc.C) {
+	store := s.newStore(c)
+	defer store.Close()
+	c.Assert(store.ApprovalRequired(params.StableChannel), gc.Equals, true)
+	c.Assert(store.ApprovalRequired(params.EdgeChannel), gc.Equals, false)
+}
+
+func (s *approvalSuite) TestRequestAndApprovePublish(c *gc.C) {
+	store := s.newStore(c)
+	defer store.Close()
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	s.PatchValue(&timeNow, func() time.Time {
+		return now
+	})
+
+	id := MustParseResolvedURL("~charmers/xenial/wordpress-0")
+	err := store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+
+	err = store.RequestPublish(id, params.StableChannel, nil, false, "bob")
+	c.Assert(err, gc.Equals, nil)
+
+	// The entity is not published until the request is approved.
+	entity, err := store.FindEntity(id, FieldSelector("published"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entity.Published[params.StableChannel], gc.Equals, false)
+
+	pending, err := store.ListPendingPublishes()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(pending, jc.DeepEquals, []mongodoc.PendingPublish{{
+		Id:      "stable cs:~charmers/xenial/wordpress-0",
+		URL:     charm.MustParseURL("~charmers/xenial/wordpress-0"),
+		Channel: params.StableChannel,
+		User:    "bob",
+		Time:    now,
+	}})
+
+	// The requester cannot approve their own request.
+	err = store.ApprovePublish(id, params.StableChannel, "bob")
+	c.Assert(err, gc.ErrorMatches, "cannot approve own publish request")
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrForbidden)
+	pending, err = store.ListPendingPublishes()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(pending, gc.HasLen, 1)
+
+	err = store.ApprovePublish(id, params.StableChannel, "alice")
+	c.Assert(err, gc.Equals, nil)
+	entity, err = store.FindEntity(id, FieldSelector("published"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entity.Published[params.StableChannel], gc.Equals, true)
+
+	// The request has gone.
+	pending, err = store.ListPendingPublishes()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(pending, gc.HasLen, 0)
+	err = store.ApprovePublish(id, params.StableChannel, "alice")
+	c.Assert(err, gc.ErrorMatches, `no pending publish of cs:~charmers/xenial/wordpress-0 to the stable channel`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *approvalSuite) TestRequestPublishReplacesEarlierRequest(c *gc.C) {
+	store := s.newStore(c)
+	defer store.Close()
+
+	id := MustParseResolvedURL("~charmers/xenial/wordpress-0")
+	err := store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	err = store.RequestPublish(id, params.StableChannel, nil, false, "bob")
+	c.Assert(err, gc.Equals, nil)
+	err = store.RequestPublish(id, params.StableChannel, nil, false, "alice")
+	c.Assert(err, gc.Equals, nil)
+
+	pending, err := store.ListPendingPublishes()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(pending, gc.HasLen, 1)
+	c.Assert(pending[0].User, gc.Equals, "alice")
+}
+
+func (s *approvalSuite) TestRequestPublishErrors(c *gc.C) {
+	store := s.newStore(c)
+	defer store.Close()
+
+	id := MustParseResolvedURL("~charmers/xenial/wordpress-0")
+	err := store.RequestPublish(id, params.StableChannel, nil, false, "bob")
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+
+	err = store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	err = store.RequestPublish(id, params.EdgeChannel, nil, false, "bob")
+	c.Assert(err, gc.ErrorMatches, "publishing to the edge channel does not require approval")
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+
+	err = store.RequestPublish(id, params.StableChannel, nil, false, "")
+	c.Assert(err, gc.ErrorMatches, "no user specified for publish request")
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+}
@@ -6,6 +6,8 @@ package charmstore // import "gopkg.in/juju/charmstore.v5/internal/charmstore"
 import (
 	"archive/zip"
 	"bytes"
+	"fmt"
+	"hash"
 	"io"
 	"os"
 	"path"
@@ -53,7 +55,11 @@ func (s *Store) OpenBlobPreV5(id *router.ResolvedURL) (*Blob, error) {
 	return s.openBlob(id, true)
 }
 
-func (s *Store) openBlob(id *router.ResolvedURL, preV5 bool) (*Blob, error) {
+func (s *Store) openBlob(id *router.ResolvedURL, preV5 bool) (_ *Blob, err error) {
+	sp := s.startSpan("OpenBlob", "blobstore")
+	defer func() {
+		sp.done(err)
+	}()
 	entity, err := s.FindEntity(id, FieldSelector(preV5ArchiveFields...))
 	if err != nil {
 		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
@@ -83,6 +89,54 @@ func (s *Store) openBlob(id *router.ResolvedURL, preV5 bool) (*Blob, error) {
 	}, nil
 }
 
+// OpenVerifiedBlob is like OpenBlob except that the returned reader
+// checks the content against the entity's BlobHash as it is read. If
+// the hash does not match when the end of the blob is reached, the
+// final Read and the subsequent Close return an error.
+func (s *Store) OpenVerifiedBlob(id *router.ResolvedURL) (io.ReadCloser, error) {
+	blob, err := s.OpenBlob(id)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	return &verifiedBlobReader{
+		id:     id,
+		blob:   blob,
+		hasher: blobstore.NewHash(),
+	}, nil
+}
+
+// verifiedBlobReader is the reader returned by OpenVerifiedBlob.
+type verifiedBlobReader struct {
+	id     *router.ResolvedURL
+	blob   *Blob
+	hasher hash.Hash
+	err    error
+}
+
+// Read implements io.Reader.Read.
+func (r *verifiedBlobReader) Read(buf []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	n, err := r.blob.Read(buf)
+	r.hasher.Write(buf[:n])
+	if err != io.EOF {
+		return n, err
+	}
+	if got := fmt.Sprintf("%x", r.hasher.Sum(nil)); got != r.blob.Hash {
+		logger.Errorf("hash mismatch reading archive of %v: got %s, expected %s", r.id, got, r.blob.Hash)
+		r.err = errgo.Newf("archive of %v does not match its hash", r.id)
+		return n, r.err
+	}
+	return n, io.EOF
+}
+
+// Close implements io.Closer.Close.
+func (r *verifiedBlobReader) Close() error {
+	r.blob.Close()
+	return r.err
+}
+
 type multiReadSeekCloser struct {
 	readers []blobstore.ReadSeekCloser
 	io.ReadSeeker
@@ -0,0 +1,208 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5/internal/charmstore"
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	jujuversion "github.com/juju/version"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/yaml.v2"
+
+	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
+)
+
+// assumesFeaturePattern matches a feature expression in an assumes
+// block, such as "k8s-api" or "juju >= 2.9".
+var assumesFeaturePattern = regexp.MustCompile(`^([a-z][a-z0-9-]*)(?:\s*(>=|<)\s*(\d+(?:\.\d+)*))?$`)
+
+// readAssumes reads the assumes block from the metadata.yaml file in
+// the charm archive held in r, which has the given size. The charm
+// package ignores assumes blocks, so the metadata is read again here.
+// If the block is invalid, an error with a params.ErrInvalidEntity
+// cause is returned.
+func readAssumes(r io.ReadSeeker, size int64) ([]mongodoc.AssumesExpression, error) {
+	z, err := zip.NewReader(ReaderAtSeeker(r), size)
+	if err != nil {
+		return nil, zipReadError(err, "cannot read charm archive")
+	}
+	for _, f := range z.File {
+		if f.Name != "metadata.yaml" {
+			continue
+		}
+		fr, err := f.Open()
+		if err != nil {
+			return nil, zipReadError(err, "cannot read metadata.yaml")
+		}
+		defer fr.Close()
+		data, err := ioutil.ReadAll(fr)
+		if err != nil {
+			return nil, zipReadError(err, "cannot read metadata.yaml")
+		}
+		var meta struct {
+			Assumes []interface{} `yaml:"assumes"`
+		}
+		if err := yaml.Unmarshal(data, &meta); err != nil {
+			return nil, errgo.WithCausef(err, params.ErrInvalidEntity, "cannot unmarshal metadata.yaml")
+		}
+		exprs, err := parseAssumesExprs(meta.Assumes)
+		if err != nil {
+			return nil, errgo.WithCausef(err, params.ErrInvalidEntity, "invalid assumes block")
+		}
+		return exprs, nil
+	}
+	return nil, errgo.WithCausef(nil, params.ErrInvalidEntity, "metadata.yaml not found")
+}
+
+// parseAssumesExprs parses the given list of expressions from an
+// assumes block.
+func parseAssumesExprs(vals []interface{}) ([]mongodoc.AssumesExpression, error) {
+	if len(vals) == 0 {
+		return nil, nil
+	}
+	exprs := make([]mongodoc.AssumesExpression, len(vals))
+	for i, v := range vals {
+		expr, err := parseAssumesExpr(v)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		exprs[i] = expr
+	}
+	return exprs, nil
+}
+
+// parseAssumesExpr parses a single expression from an assumes block,
+// which is either a feature expression or a map holding a single
+// "any-of" or "all-of" key.
+func parseAssumesExpr(v interface{}) (mongodoc.AssumesExpression, error) {
+	switch v := v.(type) {
+	case string:
+		m := assumesFeaturePattern.FindStringSubmatch(v)
+		if m == nil {
+			return mongodoc.AssumesExpression{}, errgo.Newf("invalid feature expression %q", v)
+		}
+		return mongodoc.AssumesExpression{
+			Feature: m[1],
+			Op:      m[2],
+			Version: m[3],
+		}, nil
+	case map[interface{}]interface{}:
+		if len(v) != 1 {
+			return mongodoc.AssumesExpression{}, errgo.Newf("composite expression must have exactly one key")
+		}
+		for key, val := range v {
+			list, ok := val.([]interface{})
+			if !ok {
+				return mongodoc.AssumesExpression{}, errgo.Newf("%v expression does not hold a list", key)
+			}
+			exprs, err := parseAssumesExprs(list)
+			if err != nil {
+				return mongodoc.AssumesExpression{}, errgo.Mask(err)
+			}
+			switch key {
+			case "any-of":
+				return mongodoc.AssumesExpression{AnyOf: exprs}, nil
+			case "all-of":
+				return mongodoc.AssumesExpression{AllOf: exprs}, nil
+			}
+			return mongodoc.AssumesExpression{}, errgo.Newf("unknown composite expression %q", key)
+		}
+	}
+	return mongodoc.AssumesExpression{}, errgo.Newf("unexpected expression %#v", v)
+}
+
+// assumesFeatures returns the sorted set of feature expressions found
+// anywhere in the given expressions, formatted as by assumesFeature.
+func assumesFeatures(exprs []mongodoc.AssumesExpression) []string {
+	found := make(map[string]bool)
+	var add func([]mongodoc.AssumesExpression)
+	add = func(exprs []mongodoc.AssumesExpression) {
+		for _, e := range exprs {
+			if e.Feature != "" {
+				found[assumesFeature(e)] = true
+			}
+			add(e.AnyOf)
+			add(e.AllOf)
+		}
+	}
+	add(exprs)
+	return sortedKeys(found)
+}
+
+// assumesFeature returns the canonical form of the given feature
+// expression, without any spaces, for example "juju>=2.9".
+func assumesFeature(e mongodoc.AssumesExpression) string {
+	return e.Feature + e.Op + e.Version
+}
+
+// assumesSearchTerms returns the sorted names of the features found
+// anywhere in the given expressions, and the sorted keys, as returned
+// by assumesVersionKey, of their version constraints.
+func assumesSearchTerms(exprs []mongodoc.AssumesExpression) (names, versions []string) {
+	foundNames := make(map[string]bool)
+	foundVersions := make(map[string]bool)
+	var add func([]mongodoc.AssumesExpression)
+	add = func(exprs []mongodoc.AssumesExpression) {
+		for _, e := range exprs {
+			if e.Feature != "" {
+				foundNames[e.Feature] = true
+			}
+			if e.Op != "" {
+				foundVersions[assumesVersionKey(e.Feature, e.Op, assumesVersionOrdinal(e.Version))] = true
+			}
+			add(e.AnyOf)
+			add(e.AllOf)
+		}
+	}
+	add(exprs)
+	return sortedKeys(foundNames), sortedKeys(foundVersions)
+}
+
+// sortedKeys returns the keys of m in sorted order, or nil if m is
+// empty.
+func sortedKeys(m map[string]bool) []string {
+	if len(m) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// assumesVersionOrdinal returns the ordinal of the given version from
+// a feature expression, such as "2.9", as encoded by
+// jujuVersionOrdinal. Components after the fourth are ignored.
+func assumesVersionOrdinal(version string) int64 {
+	var v jujuversion.Number
+	fields := []*int{&v.Major, &v.Minor, &v.Patch, &v.Build}
+	for i, part := range strings.Split(version, ".") {
+		if i >= len(fields) {
+			break
+		}
+		// The version has been checked by assumesFeaturePattern,
+		// so each part holds only digits.
+		*fields[i], _ = strconv.Atoi(part)
+	}
+	return jujuVersionOrdinal(v)
+}
+
+// assumesVersionKey returns the term held in the search index for a
+// constraint with the given operator on the version of the given
+// feature, where the version is encoded as the given ordinal. The
+// ordinal is zero padded so that the keys for the same feature and
+// operator sort in the same order as their versions.
+func assumesVersionKey(feature, op string, ordinal int64) string {
+	return fmt.Sprintf("%s%s%019d", feature, op, ordinal)
+}
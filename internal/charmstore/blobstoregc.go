@@ -14,6 +14,12 @@ import (
 
 var gcInterval = time.Hour
 
+// blobGCGracePeriod holds the length of time for which a newly stored
+// blob is protected from garbage collection, so that blobs are not
+// removed between being stored and being referenced by an entity or
+// resource.
+var blobGCGracePeriod = 30 * time.Minute
+
 // blobstoreGC implements the worker that runs the blobstore
 // garbage collector.
 type blobstoreGC struct {
@@ -67,7 +73,7 @@ func (gc *blobstoreGC) doGC() error {
 	if err != nil {
 		return errgo.Notef(err, "expired-upload garbage collection failed")
 	}
-	err = store.BlobStoreGC(time.Now().Add(-30 * time.Minute))
+	err = store.BlobStoreGC(time.Now().Add(-blobGCGracePeriod))
 	if err != nil {
 		return errgo.Notef(err, "blob garbage collection failed")
 	}
@@ -0,0 +1,85 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5/internal/charmstore"
+
+import (
+	"path"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2"
+
+	"gopkg.in/juju/charmstore.v5/internal/charm"
+	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
+)
+
+// uploadBlocklistId holds the id of the document in the
+// upload_blocklist collection that holds the blocklist.
+const uploadBlocklistId = "upload-blocklist"
+
+// checkUploadBlocklist checks that all the given patterns
+// are valid.
+func checkUploadBlocklist(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errgo.WithCausef(nil, params.ErrBadRequest, "invalid upload blocklist pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+// SetUploadBlocklist replaces the patterns matching the entities that
+// may not be uploaded. Each pattern uses the syntax of path.Match and
+// is matched against the "user/name" of the uploaded entity. The
+// blocklist is stored in the database, so it is shared by all servers
+// and replaces the one in ServerParams.UploadBlocklist.
+func (s *Store) SetUploadBlocklist(patterns []string) error {
+	if err := checkUploadBlocklist(patterns); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	if patterns == nil {
+		patterns = []string{}
+	}
+	if _, err := s.DB.UploadBlocklist().UpsertId(uploadBlocklistId, &mongodoc.UploadBlocklist{
+		Id:       uploadBlocklistId,
+		Patterns: patterns,
+	}); err != nil {
+		return errgo.Notef(err, "cannot update upload blocklist")
+	}
+	return nil
+}
+
+// UploadBlocklist returns the patterns matching the entities that may
+// not be uploaded. If no blocklist has been stored with
+// SetUploadBlocklist, the patterns from ServerParams.UploadBlocklist
+// are returned.
+func (s *Store) UploadBlocklist() ([]string, error) {
+	var doc mongodoc.UploadBlocklist
+	if err := s.DB.UploadBlocklist().FindId(uploadBlocklistId).One(&doc); err != nil {
+		if err == mgo.ErrNotFound {
+			return append([]string(nil), s.pool.config.UploadBlocklist...), nil
+		}
+		return nil, errgo.Notef(err, "cannot get upload blocklist")
+	}
+	return doc.Patterns, nil
+}
+
+// CheckUploadAllowed checks that the entity with the given id does not
+// match any of the upload blocklist patterns. If it does, an error
+// with a params.ErrForbidden cause is returned.
+func (s *Store) CheckUploadAllowed(id *charm.URL) error {
+	patterns, err := s.UploadBlocklist()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	name := id.User + "/" + id.Name
+	for _, pattern := range patterns {
+		// The patterns have been checked when they were set,
+		// so Match cannot fail.
+		if ok, _ := path.Match(pattern, name); ok {
+			return errgo.WithCausef(nil, params.ErrForbidden, "cannot upload %q: %q is blocked by pattern %q", id, name, pattern)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"github.com/juju/charmrepo/v6/csclient/params"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/macaroon-bakery.v2-unstable/bakery"
+
+	"gopkg.in/juju/charmstore.v5/internal/charm"
+)
+
+type blocklistSuite struct {
+	commonSuite
+}
+
+var _ = gc.Suite(&blocklistSuite{})
+
+var checkUploadAllowedTests = []struct {
+	about       string
+	blocklist   []string
+	id          string
+	expectError string
+}{{
+	about: "empty blocklist",
+	id:    "~bob/wordpress",
+}, {
+	about:       "exact match",
+	blocklist:   []string{"bob/wordpress"},
+	id:          "~bob/precise/wordpress",
+	expectError: `cannot upload "cs:~bob/precise/wordpress": "bob/wordpress" is blocked by pattern "bob/wordpress"`,
+}, {
+	about:       "any user",
+	blocklist:   []string{"alice/*", "*/microsoft-*"},
+	id:          "~bob/microsoft-sql",
+	expectError: `cannot upload "cs:~bob/microsoft-sql": "bob/microsoft-sql" is blocked by pattern "\*/microsoft-\*"`,
+}, {
+	about:     "no match",
+	blocklist: []string{"alice/*", "*/microsoft-*"},
+	id:        "~bob/wordpress",
+}, {
+	about:     "pattern does not match across the separator",
+	blocklist: []string{"bob*"},
+	id:        "~bob/wordpress",
+}}
+
+func (s *blocklistSuite) TestCheckUploadAllowed(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	for i, test := range checkUploadAllowedTests {
+		c.Logf("test %d: %s", i, test.about)
+		err := store.SetUploadBlocklist(test.blocklist)
+		c.Assert(err, gc.Equals, nil)
+		err = store.CheckUploadAllowed(charm.MustParseURL(test.id))
+		if test.expectError == "" {
+			c.Assert(err, gc.Equals, nil)
+			continue
+		}
+		c.Assert(err, gc.ErrorMatches, test.expectError)
+		c.Assert(errgo.Cause(err), gc.Equals, params.ErrForbidden)
+	}
+}
+
+func (s *blocklistSuite) TestSetUploadBlocklistInvalidPattern(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	err := store.SetUploadBlocklist([]string{"bob/*"})
+	c.Assert(err, gc.Equals, nil)
+	err = store.SetUploadBlocklist([]string{"alice/*", "bob/[*"})
+	c.Assert(err, gc.ErrorMatches, `invalid upload blocklist pattern "bob/\[\*"`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+	patterns, err := store.UploadBlocklist()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(patterns, gc.DeepEquals, []string{"bob/*"})
+}
+
+func (s *blocklistSuite) TestUploadBlocklistShared(c *gc.C) {
+	config := ServerParams{
+		UploadBlocklist: []string{"alice/*"},
+	}
+	p1, err := NewPool(s.Session.DB("juju_test"), nil, &bakery.NewServiceParams{}, config)
+	c.Assert(err, gc.Equals, nil)
+	defer p1.Close()
+	p2, err := NewPool(s.Session.DB("juju_test"), nil, &bakery.NewServiceParams{}, config)
+	c.Assert(err, gc.Equals, nil)
+	defer p2.Close()
+	store1 := p1.Store()
+	defer store1.Close()
+	store2 := p2.Store()
+	defer store2.Close()
+
+	// The configured blocklist is used until one is stored.
+	patterns, err := store2.UploadBlocklist()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(patterns, gc.DeepEquals, []string{"alice/*"})
+
+	// A blocklist set through one pool applies to the other.
+	err = store1.SetUploadBlocklist([]string{"bob/*"})
+	c.Assert(err, gc.Equals, nil)
+	patterns, err = store2.UploadBlocklist()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(patterns, gc.DeepEquals, []string{"bob/*"})
+	err = store2.CheckUploadAllowed(charm.MustParseURL("~bob/wordpress"))
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrForbidden)
+	err = store2.CheckUploadAllowed(charm.MustParseURL("~alice/wordpress"))
+	c.Assert(err, gc.Equals, nil)
+
+	// An empty stored blocklist still overrides the configuration.
+	err = store1.SetUploadBlocklist(nil)
+	c.Assert(err, gc.Equals, nil)
+	patterns, err = store2.UploadBlocklist()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(patterns, gc.HasLen, 0)
+}
+
+func (s *blocklistSuite) TestNewPoolWithInvalidUploadBlocklist(c *gc.C) {
+	_, err := NewPool(s.Session.DB("juju_test"), nil, &bakery.NewServiceParams{}, ServerParams{
+		UploadBlocklist: []string{"bob/[*"},
+	})
+	c.Assert(err, gc.ErrorMatches, `invalid upload blocklist pattern "bob/\[\*"`)
+}
@@ -0,0 +1,304 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5/internal/charmstore"
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v5/internal/charm"
+	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5/internal/router"
+)
+
+// PublishRequest holds a single entry in a call to BulkPublish.
+type PublishRequest struct {
+	// Id holds the id of the entity to publish.
+	Id *router.ResolvedURL
+
+	// Resources holds the resource revisions to publish with the
+	// entity, as for Publish.
+	Resources map[string]int
+
+	// Channels holds the channels to publish the entity to.
+	Channels []params.Channel
+}
+
+// BulkPublish publishes each of the given entities as Publish does, for
+// example to release a set of related charms together. Every entry is
+// checked before anything is changed, so an invalid entry causes an
+// error without publishing any of them.
+//
+// The channels of each base entity are only updated if they have not
+// changed since the entries were checked. If an update fails part way
+// through the batch, the changes already made are undone before the
+// error is returned. Each change is only undone if it has not since
+// been overwritten, so a concurrent publish is never lost. If undoing
+// the changes fails, the returned error says so.
+//
+// The updates to each base entity are applied together, so when more
+// than one entry updates the same channel of the same base entity, the
+// last entry wins.
+func (s *Store) BulkPublish(entries []PublishRequest) error {
+	ops := make([]*publishOp, len(entries))
+	for i, e := range entries {
+		op, err := s.preparePublish(e.Id, e.Resources, false, e.Channels)
+		if err != nil {
+			return errgo.NoteMask(err, "cannot publish "+e.Id.String(), errgo.Is(params.ErrNotFound), errgo.Is(ErrPublishResourceMismatch))
+		}
+		ops[i] = op
+	}
+
+	// Record the changes that will be made so that they can be
+	// undone if any update fails.
+	var st bulkPublishState
+	if err := st.save(s, ops); err != nil {
+		return errgo.Mask(err)
+	}
+	if err := s.applyBulkPublish(ops, &st); err != nil {
+		if rerr := st.restore(s); rerr != nil {
+			return errgo.Notef(rerr, "cannot roll back bulk publish after error %q", err)
+		}
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	for _, op := range ops {
+		if err := s.publishToSearch(op); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	return nil
+}
+
+// applyBulkPublish applies all the given publish operations, whose
+// changes have been recorded in st. The base entity updates are merged
+// so that each base entity is only updated once, and only if its
+// channel heads are unchanged since st was saved.
+func (s *Store) applyBulkPublish(ops []*publishOp, st *bulkPublishState) error {
+	type baseUpdate struct {
+		set     bson.D
+		history []mongodoc.PublishHistoryEntry
+	}
+	var baseURLs []*charm.URL
+	baseUpdates := make(map[charm.URL]*baseUpdate)
+	for _, op := range ops {
+		if err := s.UpdateEntity(op.url, op.entityUpdate()); err != nil {
+			return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+		}
+		set, history := op.baseEntityUpdate(st.now)
+		u := baseUpdates[*op.entity.BaseURL]
+		if u == nil {
+			u = new(baseUpdate)
+			baseUpdates[*op.entity.BaseURL] = u
+			baseURLs = append(baseURLs, op.entity.BaseURL)
+		}
+		u.set = mergeSet(u.set, set)
+		u.history = append(u.history, history...)
+	}
+	for _, baseURL := range baseURLs {
+		u := baseUpdates[*baseURL]
+		err := s.DB.BaseEntities().Update(st.baseQuery(baseURL), bson.D{
+			{"$set", u.set},
+			pushPublishHistory(u.history),
+		})
+		if err == mgo.ErrNotFound {
+			return errgo.Newf("cannot update base entity for %q: channels changed concurrently", baseURL)
+		}
+		if err != nil {
+			return errgo.Notef(err, "cannot update base entity for %q", baseURL)
+		}
+	}
+	// The publish events are only recorded once all the updates have
+	// succeeded so that they never need to be rolled back.
+	for _, baseURL := range baseURLs {
+		if err := s.addPublishEvents(baseUpdates[*baseURL].history); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	return nil
+}
+
+// mergeSet returns the result of adding the fields in set2 to set1,
+// replacing the values of any fields that are in both.
+func mergeSet(set1, set2 bson.D) bson.D {
+	index := make(map[string]int, len(set1))
+	for i, elem := range set1 {
+		index[elem.Name] = i
+	}
+	for _, elem := range set2 {
+		if i, ok := index[elem.Name]; ok {
+			set1[i].Value = elem.Value
+			continue
+		}
+		index[elem.Name] = len(set1)
+		set1 = append(set1, elem)
+	}
+	return set1
+}
+
+// bulkPublishState records the changes made by a bulk publish.
+type bulkPublishState struct {
+	// now holds the time recorded in the publish history.
+	now time.Time
+
+	// changes holds the fields changed by the bulk publish,
+	// in the order that they were first changed.
+	changes []*fieldChange
+
+	// baseURLs holds the base entities changed by the bulk
+	// publish.
+	baseURLs []*charm.URL
+
+	// urls holds the entities published by the bulk publish.
+	urls []*charm.URL
+}
+
+// fieldChange records a change made to a single field of an entity or
+// base entity.
+type fieldChange struct {
+	// base holds whether the field belongs to a base entity.
+	base bool
+
+	// id holds the id of the changed document.
+	id *charm.URL
+
+	// field holds the name of the changed field.
+	field string
+
+	// old and new hold the value of the field before and after
+	// the change. A nil value means that the field is not set.
+	old, new interface{}
+}
+
+// save records the changes that will be made by the given publish
+// operations.
+func (st *bulkPublishState) save(s *Store, ops []*publishOp) error {
+	st.now = timeNow()
+	index := make(map[string]*fieldChange)
+	record := func(base bool, id *charm.URL, field string, old, new interface{}) {
+		key := fmt.Sprintf("%v %s %s", base, id, field)
+		if c := index[key]; c != nil {
+			c.new = new
+			return
+		}
+		c := &fieldChange{
+			base:  base,
+			id:    id,
+			field: field,
+			old:   old,
+			new:   new,
+		}
+		index[key] = c
+		st.changes = append(st.changes, c)
+	}
+	baseEntities := make(map[charm.URL]*mongodoc.BaseEntity)
+	for _, op := range ops {
+		entity, err := s.FindEntity(op.url, FieldSelector("published", "yanked"))
+		if err != nil {
+			return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+		}
+		st.urls = append(st.urls, entity.URL)
+		baseEntity := baseEntities[*op.entity.BaseURL]
+		if baseEntity == nil {
+			baseEntity, err = s.FindBaseEntity(op.entity.BaseURL, FieldSelector("channelentities", "channelresources"))
+			if err != nil {
+				return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+			}
+			baseEntities[*op.entity.BaseURL] = baseEntity
+			st.baseURLs = append(st.baseURLs, baseEntity.URL)
+		}
+		for _, ch := range op.channels {
+			record(false, entity.URL, "published."+string(ch), boolField(entity.Published[ch]), true)
+			record(false, entity.URL, "yanked."+string(ch), boolField(entity.Yanked[ch]), nil)
+			for _, series := range op.series {
+				var old interface{}
+				if head := baseEntity.ChannelEntities[ch][series]; head != nil {
+					old = head
+				}
+				record(true, baseEntity.URL, fmt.Sprintf("channelentities.%s.%s", ch, series), old, op.entity.URL)
+			}
+			var old interface{}
+			if resources, ok := baseEntity.ChannelResources[ch]; ok {
+				old = resources
+			}
+			record(true, baseEntity.URL, "channelresources."+string(ch), old, op.resourceDocs[ch])
+		}
+	}
+	return nil
+}
+
+// boolField returns the value recorded in a fieldChange for a boolean
+// field that holds b; false fields are not set.
+func boolField(b bool) interface{} {
+	if b {
+		return true
+	}
+	return nil
+}
+
+// baseQuery returns a query that matches the base entity with the
+// given URL only if none of its channel heads that will be changed
+// have changed since st was saved.
+func (st *bulkPublishState) baseQuery(baseURL *charm.URL) bson.D {
+	query := bson.D{{"_id", baseURL}}
+	for _, c := range st.changes {
+		if !c.base || *c.id != *baseURL || !strings.HasPrefix(c.field, "channelentities.") {
+			continue
+		}
+		query = append(query, fieldQuery(c.field, c.old))
+	}
+	return query
+}
+
+// restore undoes the changes recorded by save. A change is not undone
+// if the field has been changed again since. Publish history entries
+// discarded to make room for the new ones are not restored.
+func (st *bulkPublishState) restore(s *Store) error {
+	for i := len(st.changes) - 1; i >= 0; i-- {
+		c := st.changes[i]
+		if reflect.DeepEqual(c.old, c.new) {
+			continue
+		}
+		coll := s.DB.Entities()
+		if c.base {
+			coll = s.DB.BaseEntities()
+		}
+		var update bson.D
+		if c.old == nil {
+			update = bson.D{{"$unset", bson.D{{c.field, true}}}}
+		} else {
+			update = bson.D{{"$set", bson.D{{c.field, c.old}}}}
+		}
+		err := coll.Update(bson.D{{"_id", c.id}, fieldQuery(c.field, c.new)}, update)
+		if err != nil && err != mgo.ErrNotFound {
+			return errgo.Notef(err, "cannot restore %s of %s", c.field, c.id)
+		}
+	}
+	for _, baseURL := range st.baseURLs {
+		if err := s.DB.BaseEntities().UpdateId(baseURL, bson.D{{
+			"$pull", bson.D{{"publishhistory", bson.D{
+				{"time", st.now},
+				{"url", bson.D{{"$in", st.urls}}},
+			}}},
+		}}); err != nil {
+			return errgo.Notef(err, "cannot restore publish history of %s", baseURL)
+		}
+	}
+	return nil
+}
+
+// fieldQuery returns a query element that matches the given field
+// only if it holds the given value, or is not set if value is nil.
+func fieldQuery(field string, value interface{}) bson.DocElem {
+	if value == nil {
+		return bson.DocElem{field, bson.D{{"$exists", false}}}
+	}
+	return bson.DocElem{field, value}
+}
@@ -0,0 +1,178 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5/internal/charmstore"
+
+import (
+	"sort"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v5/internal/charm"
+	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
+)
+
+// InconsistencyKind describes the kind of an Inconsistency.
+type InconsistencyKind string
+
+const (
+	// HeadNotPublished is reported when an entity is listed in
+	// the base entity's ChannelEntities for a channel but is not
+	// marked as published in that channel.
+	HeadNotPublished InconsistencyKind = "head-not-published"
+
+	// HeadNotFound is reported when the base entity's
+	// ChannelEntities refers to an entity that does not exist.
+	HeadNotFound InconsistencyKind = "head-not-found"
+
+	// PublishedWithoutHead is reported when an entity is marked as
+	// published in a channel but the base entity's ChannelEntities
+	// holds no entity in that channel for any of its series.
+	PublishedWithoutHead InconsistencyKind = "published-without-head"
+)
+
+// Inconsistency describes a mismatch between the Published field of an
+// entity and the ChannelEntities field of its base entity.
+type Inconsistency struct {
+	// Kind holds the kind of the inconsistency.
+	Kind InconsistencyKind
+
+	// Channel holds the channel that is inconsistent.
+	Channel params.Channel
+
+	// Series holds the series of the channel head. It is empty
+	// for PublishedWithoutHead inconsistencies.
+	Series string
+
+	// Entity holds the id of the entity concerned.
+	Entity *charm.URL
+}
+
+// VerifyChannelConsistency checks that the Published fields of the
+// entities with the given base URL agree with the ChannelEntities field
+// of the base entity. It returns a description of each mismatch,
+// ordered by channel, series and entity id.
+//
+// Note that an entity that is marked as published in a channel but has
+// been superseded there by a newer revision is not inconsistent: it
+// remains available in that channel.
+func (s *Store) VerifyChannelConsistency(baseURL *charm.URL) ([]Inconsistency, error) {
+	baseEntity, err := s.FindBaseEntity(baseURL, FieldSelector("channelentities"))
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	var entities []*mongodoc.Entity
+	if err := s.DB.Entities().
+		Find(bson.D{{"baseurl", baseEntity.URL}}).
+		Select(FieldSelector("published", "series", "supportedseries")).
+		All(&entities); err != nil {
+		return nil, errgo.Notef(err, "cannot find entities for %s", baseEntity.URL)
+	}
+	byId := make(map[string]*mongodoc.Entity, len(entities))
+	for _, e := range entities {
+		byId[e.URL.String()] = e
+	}
+	var problems []Inconsistency
+	for ch, heads := range baseEntity.ChannelEntities {
+		for series, id := range heads {
+			e := byId[id.String()]
+			switch {
+			case e == nil:
+				problems = append(problems, Inconsistency{
+					Kind:    HeadNotFound,
+					Channel: ch,
+					Series:  series,
+					Entity:  id,
+				})
+			case !e.Published[ch]:
+				problems = append(problems, Inconsistency{
+					Kind:    HeadNotPublished,
+					Channel: ch,
+					Series:  series,
+					Entity:  id,
+				})
+			}
+		}
+	}
+	for _, e := range entities {
+		series := e.SupportedSeries
+		if len(series) == 0 {
+			series = []string{e.URL.Series}
+		}
+		for ch, published := range e.Published {
+			if !published {
+				continue
+			}
+			hasHead := false
+			for _, s := range series {
+				if baseEntity.ChannelEntities[ch][s] != nil {
+					hasHead = true
+					break
+				}
+			}
+			if !hasHead {
+				problems = append(problems, Inconsistency{
+					Kind:    PublishedWithoutHead,
+					Channel: ch,
+					Entity:  e.URL,
+				})
+			}
+		}
+	}
+	sort.Slice(problems, func(i, j int) bool {
+		p0, p1 := problems[i], problems[j]
+		if p0.Channel != p1.Channel {
+			return p0.Channel < p1.Channel
+		}
+		if p0.Series != p1.Series {
+			return p0.Series < p1.Series
+		}
+		return p0.Entity.String() < p1.Entity.String()
+	})
+	return problems, nil
+}
+
+// FixChannelConsistency repairs the given inconsistencies, as returned
+// by VerifyChannelConsistency for the given base URL, treating the base
+// entity's ChannelEntities as authoritative: channel heads are marked
+// as published, heads that refer to missing entities are removed and
+// entities published in a channel with no head for their series are
+// marked as unpublished in that channel.
+func (s *Store) FixChannelConsistency(baseURL *charm.URL, problems []Inconsistency) error {
+	base := mongodoc.BaseURL(baseURL)
+	updateSearch := false
+	for _, p := range problems {
+		var err error
+		switch p.Kind {
+		case HeadNotPublished:
+			err = s.DB.Entities().UpdateId(p.Entity, bson.D{{
+				"$set", bson.D{{"published." + string(p.Channel), true}},
+			}})
+		case HeadNotFound:
+			err = s.DB.BaseEntities().UpdateId(base, bson.D{{
+				"$unset", bson.D{{"channelentities." + string(p.Channel) + "." + p.Series, true}},
+			}})
+		case PublishedWithoutHead:
+			err = s.DB.Entities().UpdateId(p.Entity, bson.D{{
+				"$unset", bson.D{{"published." + string(p.Channel), true}},
+			}})
+		default:
+			return errgo.Newf("unknown inconsistency kind %q", p.Kind)
+		}
+		if err != nil {
+			return errgo.Notef(err, "cannot fix %s inconsistency for %s in %s channel", p.Kind, p.Entity, p.Channel)
+		}
+		if p.Channel == params.StableChannel {
+			updateSearch = true
+		}
+	}
+	if !updateSearch {
+		return nil
+	}
+	if err := s.UpdateSearchBaseURL(base); err != nil {
+		return errgo.Notef(err, "cannot update search entities for %q", base)
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5/internal/charmstore"
+
+import (
+	"github.com/juju/charmrepo/v6/csclient/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v5/internal/charm"
+	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
+)
+
+// CopyChannelState copies the channel heads of the base entity with
+// the URL fromBase to the base entity with the URL toBase, for example
+// when a charm has been forked to a new owner. Each revision of
+// fromBase that is current in a channel is mapped to the revision of
+// toBase with the same archive blob hash, which is then published in
+// that channel. The channel heads previously held by toBase are
+// replaced, and a replaced head is no longer marked as published in
+// its channel unless it is also one of the new heads there; note that
+// the resources published to the channels of toBase are left
+// unchanged.
+//
+// If any channel head of fromBase has no corresponding revision in
+// toBase, an error is returned and nothing is changed.
+func (s *Store) CopyChannelState(fromBase, toBase *charm.URL) error {
+	from, err := s.FindBaseEntity(fromBase, FieldSelector("channelentities"))
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	to, err := s.FindBaseEntity(toBase, FieldSelector("channelentities"))
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	var heads []*charm.URL
+	for _, chHeads := range from.ChannelEntities {
+		for _, id := range chHeads {
+			heads = append(heads, id)
+		}
+	}
+	var fromEntities []*mongodoc.Entity
+	if err := s.DB.Entities().
+		Find(bson.D{{"_id", bson.D{{"$in", heads}}}}).
+		Select(FieldSelector("blobhash")).
+		All(&fromEntities); err != nil {
+		return errgo.Notef(err, "cannot find entities for %s", from.URL)
+	}
+	hashes := make(map[charm.URL]string, len(fromEntities))
+	for _, e := range fromEntities {
+		hashes[*e.URL] = e.BlobHash
+	}
+	var toEntities []*mongodoc.Entity
+	if err := s.DB.Entities().
+		Find(bson.D{{"baseurl", to.URL}}).
+		Select(FieldSelector("blobhash", "revision")).
+		All(&toEntities); err != nil {
+		return errgo.Notef(err, "cannot find entities for %s", to.URL)
+	}
+	byHash := make(map[string][]*mongodoc.Entity)
+	for _, e := range toEntities {
+		byHash[e.BlobHash] = append(byHash[e.BlobHash], e)
+	}
+
+	channelEntities := make(map[params.Channel]map[string]*charm.URL)
+	published := make(map[charm.URL][]params.Channel)
+	var history []mongodoc.PublishHistoryEntry
+	now := timeNow()
+	for _, ch := range params.OrderedChannels {
+		for series, id := range from.ChannelEntities[ch] {
+			hash, ok := hashes[*id]
+			if !ok {
+				return errgo.Newf("cannot copy channel state from %s to %s: %s not found", from.URL, to.URL, id)
+			}
+			target := matchingEntity(byHash[hash], id)
+			if target == nil {
+				return errgo.Newf("cannot copy channel state from %s to %s: no revision matches %s", from.URL, to.URL, id)
+			}
+			if channelEntities[ch] == nil {
+				channelEntities[ch] = make(map[string]*charm.URL)
+			}
+			channelEntities[ch][series] = target.URL
+			published[*target.URL] = append(published[*target.URL], ch)
+			history = append(history, mongodoc.PublishHistoryEntry{
+				Channel: ch,
+				Series:  series,
+				URL:     target.URL,
+				Time:    now,
+			})
+		}
+	}
+
+	// Previous heads of toBase that have been replaced are no longer
+	// published in their channel.
+	unpublished := make(map[charm.URL][]params.Channel)
+	for ch, chHeads := range to.ChannelEntities {
+		for _, id := range chHeads {
+			if isChannelHead(channelEntities[ch], id) || containsChannel(unpublished[*id], ch) {
+				continue
+			}
+			unpublished[*id] = append(unpublished[*id], ch)
+		}
+	}
+
+	updateSearch := false
+	for id, channels := range unpublished {
+		var unset bson.D
+		for _, ch := range channels {
+			unset = append(unset, bson.DocElem{"published." + string(ch), true})
+			if ch == params.StableChannel {
+				updateSearch = true
+			}
+		}
+		if err := s.DB.Entities().UpdateId(id, bson.D{{"$unset", unset}}); err != nil {
+			return errgo.Notef(err, "cannot unpublish %s", &id)
+		}
+	}
+	for id, channels := range published {
+		var set, unset bson.D
+		for _, ch := range channels {
+			set = append(set, bson.DocElem{"published." + string(ch), true})
+			unset = append(unset, bson.DocElem{"yanked." + string(ch), true})
+			if ch == params.StableChannel {
+				updateSearch = true
+			}
+		}
+		if err := s.DB.Entities().UpdateId(id, bson.D{
+			{"$set", set},
+			{"$unset", unset},
+		}); err != nil {
+			return errgo.Notef(err, "cannot publish %s", &id)
+		}
+	}
+	update := bson.D{{"$set", bson.D{{"channelentities", channelEntities}}}}
+	if len(history) > 0 {
+		update = append(update, pushPublishHistory(history))
+	}
+	if err := s.DB.BaseEntities().UpdateId(to.URL, update); err != nil {
+		return errgo.Notef(err, "cannot update base entity %s", to.URL)
+	}
+	if err := s.addPublishEvents(history); err != nil {
+		return errgo.Mask(err)
+	}
+	if !updateSearch {
+		return nil
+	}
+	if err := s.UpdateSearchBaseURL(to.URL); err != nil {
+		return errgo.Notef(err, "cannot update search entities for %q", to.URL)
+	}
+	return nil
+}
+
+// isChannelHead reports whether id is one of the given channel heads.
+func isChannelHead(heads map[string]*charm.URL, id *charm.URL) bool {
+	for _, head := range heads {
+		if *head == *id {
+			return true
+		}
+	}
+	return false
+}
+
+// containsChannel reports whether ch is one of the given channels.
+func containsChannel(channels []params.Channel, ch params.Channel) bool {
+	for _, c := range channels {
+		if c == ch {
+			return true
+		}
+	}
+	return false
+}
+
+// matchingEntity returns the entity from the given entities, which all
+// have the same blob hash as the entity with the given id, that
+// corresponds to that entity. Entities with the same series as id are
+// preferred, then the entity with the highest revision. It returns nil
+// if there are no entities.
+func matchingEntity(entities []*mongodoc.Entity, id *charm.URL) *mongodoc.Entity {
+	var best *mongodoc.Entity
+	for _, e := range entities {
+		switch {
+		case best == nil:
+			best = e
+		case (e.URL.Series == id.Series) != (best.URL.Series == id.Series):
+			if e.URL.Series == id.Series {
+				best = e
+			}
+		case e.Revision > best.Revision:
+			best = e
+		}
+	}
+	return best
+}
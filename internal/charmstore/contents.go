@@ -0,0 +1,215 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5/internal/charmstore"
+
+import (
+	"archive/zip"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5/internal/router"
+)
+
+// These are all forms of README files
+// actually observed in charms in the wild.
+var allowedReadMe = map[string]bool{
+	"readme":          true,
+	"readme.md":       true,
+	"readme.rst":      true,
+	"readme.ex":       true,
+	"readme.markdown": true,
+	"readme.txt":      true,
+}
+
+// IsReadMeFile reports whether f is the README file of an archive.
+// It is suitable for use with OpenCachedBlobFile and mongodoc.FileReadMe.
+func IsReadMeFile(f *zip.File) bool {
+	name := strings.ToLower(path.Clean(f.Name))
+	// This is the same condition currently used by the GUI.
+	// TODO propagate likely content type from file extension.
+	return allowedReadMe[name]
+}
+
+// IsIconFile reports whether f is the icon of an archive.
+// It is suitable for use with OpenCachedBlobFile and mongodoc.FileIcon.
+func IsIconFile(f *zip.File) bool {
+	return path.Clean(f.Name) == "icon.svg"
+}
+
+// IsLXDProfileFile reports whether f is the LXD profile of an archive.
+// It is suitable for use with OpenCachedBlobFile and
+// mongodoc.FileLXDProfile.
+func IsLXDProfileFile(f *zip.File) bool {
+	return path.Clean(f.Name) == "lxd-profile.yaml"
+}
+
+// contentsFiles maps each file id that may be cached in
+// Entity.Contents to the function used to find the file
+// in an archive.
+var contentsFiles = map[mongodoc.FileId]func(f *zip.File) bool{
+	mongodoc.FileReadMe:     IsReadMeFile,
+	mongodoc.FileIcon:       IsIconFile,
+	mongodoc.FileLXDProfile: IsLXDProfileFile,
+}
+
+// ContentsProblem describes an entry in Entity.Contents
+// that does not match the entity's archive.
+type ContentsProblem struct {
+	// FileId holds the id of the invalid entry.
+	FileId mongodoc.FileId
+
+	// Cached holds the value found in Entity.Contents.
+	Cached mongodoc.ZipFile
+
+	// Actual holds the value that should be cached. It is the
+	// zero value if the file is not present in the archive.
+	Actual mongodoc.ZipFile
+
+	// Unknown holds whether the file id is not one that the
+	// store knows how to find. Such entries are removed
+	// rather than corrected.
+	Unknown bool
+}
+
+// CheckContents verifies that each entry in the Contents field of the
+// entity with the given id refers to the correct file in its archive.
+// It returns a description of each invalid entry, ordered by file id.
+// If fix is true, the invalid entries are corrected in the database.
+func (s *Store) CheckContents(id *router.ResolvedURL, fix bool) ([]ContentsProblem, error) {
+	entity, err := s.FindEntity(id, FieldSelector("blobhash", "contents"))
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	if len(entity.Contents) == 0 {
+		return nil, nil
+	}
+	blob, size, err := s.BlobStore.Open(entity.BlobHash, nil)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot open archive blob")
+	}
+	defer blob.Close()
+	zipReader, err := zip.NewReader(&readerAtSeeker{r: blob}, size)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot read archive data")
+	}
+	var problems []ContentsProblem
+	for fileId, cached := range entity.Contents {
+		isFile, ok := contentsFiles[fileId]
+		if !ok {
+			problems = append(problems, ContentsProblem{
+				FileId:  fileId,
+				Cached:  cached,
+				Unknown: true,
+			})
+			continue
+		}
+		actual, err := findContentsFile(zipReader, isFile)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if cached != actual {
+			problems = append(problems, ContentsProblem{
+				FileId: fileId,
+				Cached: cached,
+				Actual: actual,
+			})
+		}
+	}
+	sort.Slice(problems, func(i, j int) bool {
+		return problems[i].FileId < problems[j].FileId
+	})
+	if !fix || len(problems) == 0 {
+		return problems, nil
+	}
+	var set, unset bson.D
+	for _, p := range problems {
+		field := "contents." + string(p.FileId)
+		if p.Unknown {
+			unset = append(unset, bson.DocElem{field, true})
+		} else {
+			set = append(set, bson.DocElem{field, p.Actual})
+		}
+	}
+	var update bson.D
+	if len(set) > 0 {
+		update = append(update, bson.DocElem{"$set", set})
+	}
+	if len(unset) > 0 {
+		update = append(update, bson.DocElem{"$unset", unset})
+	}
+	if err := s.UpdateEntity(id, update); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return problems, nil
+}
+
+// RebuildContents recomputes the Contents entries for the given files
+// of the entity with the given id from its archive, replacing any
+// existing entries. A file that is not present in the archive is
+// recorded as such, as OpenCachedBlobFile does. If no files are
+// given, the entries for all the files that the store knows how to
+// find are rebuilt. An unknown file id results in an error with a
+// params.ErrBadRequest cause.
+func (s *Store) RebuildContents(url *router.ResolvedURL, files ...mongodoc.FileId) error {
+	if len(files) == 0 {
+		for fileId := range contentsFiles {
+			files = append(files, fileId)
+		}
+		sort.Slice(files, func(i, j int) bool {
+			return files[i] < files[j]
+		})
+	}
+	for _, fileId := range files {
+		if contentsFiles[fileId] == nil {
+			return errgo.WithCausef(nil, params.ErrBadRequest, "unknown contents file %q", fileId)
+		}
+	}
+	entity, err := s.FindEntity(url, FieldSelector("blobhash"))
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	blob, size, err := s.BlobStore.Open(entity.BlobHash, nil)
+	if err != nil {
+		return errgo.Notef(err, "cannot open archive blob")
+	}
+	defer blob.Close()
+	zipReader, err := zip.NewReader(&readerAtSeeker{r: blob}, size)
+	if err != nil {
+		return errgo.Notef(err, "cannot read archive data")
+	}
+	set := make(bson.D, 0, len(files))
+	for _, fileId := range files {
+		zipf, err := findContentsFile(zipReader, contentsFiles[fileId])
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		set = append(set, bson.DocElem{"contents." + string(fileId), zipf})
+	}
+	if err := s.UpdateEntity(url, bson.D{{"$set", set}}); err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+// findContentsFile returns the location of the first file in the
+// given archive for which isFile returns true. It returns the zero
+// ZipFile if there is no such file.
+func findContentsFile(zipReader *zip.Reader, isFile func(f *zip.File) bool) (mongodoc.ZipFile, error) {
+	for _, f := range zipReader.File {
+		if isFile(f) {
+			zipf, err := NewZipFile(f)
+			if err != nil {
+				return mongodoc.ZipFile{}, errgo.Mask(err)
+			}
+			return zipf, nil
+		}
+	}
+	return mongodoc.ZipFile{}, nil
+}
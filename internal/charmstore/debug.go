@@ -12,21 +12,66 @@ import (
 	"net/http/httptest"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/juju/charmrepo/v6/csclient/params"
 	"github.com/juju/utils"
+	"golang.org/x/net/context"
 	"gopkg.in/errgo.v1"
 	"gopkg.in/mgo.v2"
 
+	"gopkg.in/juju/charmstore.v5/internal/blobstore"
 	"gopkg.in/juju/charmstore.v5/internal/monitoring"
 	"gopkg.in/juju/charmstore.v5/internal/router"
 	appver "gopkg.in/juju/charmstore.v5/version"
 )
 
+// debugInfoResponse holds the response to a GET /debug/info request.
+type debugInfoResponse struct {
+	appver.Version
+
+	// BlobStore holds information about the blob store backend.
+	BlobStore blobstore.BackendInfo
+}
+
 // GET /debug/info .
-func serveDebugInfo(http.Header, *http.Request) (interface{}, error) {
-	return appver.VersionInfo, nil
+func serveDebugInfo(describeBlobStore func() blobstore.BackendInfo) router.JSONHandler {
+	return func(http.Header, *http.Request) (interface{}, error) {
+		return debugInfoResponse{
+			Version:   appver.VersionInfo,
+			BlobStore: describeBlobStore(),
+		}, nil
+	}
+}
+
+// debugInfoCacheDuration holds how long the blob store information
+// reported by /debug/info is reused before the backend is checked
+// again.
+const debugInfoCacheDuration = time.Minute
+
+// describeBlobStore returns information about the blob store
+// backend used by stores from the given pool. Because describing the
+// backend checks whether its storage can be reached, the information
+// is cached for debugInfoCacheDuration.
+func describeBlobStore(p *Pool) func() blobstore.BackendInfo {
+	var (
+		mu      sync.Mutex
+		info    blobstore.BackendInfo
+		expires time.Time
+	)
+	return func() blobstore.BackendInfo {
+		mu.Lock()
+		defer mu.Unlock()
+		if time.Now().Before(expires) {
+			return info
+		}
+		store := p.Store()
+		defer store.Close()
+		info = store.BlobStore.Describe()
+		expires = time.Now().Add(debugInfoCacheDuration)
+		return info
+	}
 }
 
 // GET /debug/check.
@@ -92,6 +137,25 @@ func checkES(si *SearchIndex) func() error {
 	}
 }
 
+// probeTimeout holds the maximum time that a request to /debug/probe
+// will wait for the probe to complete.
+const probeTimeout = 5 * time.Second
+
+// GET /debug/probe
+func debugProbe(p *Pool) router.JSONHandler {
+	return func(_ http.Header, req *http.Request) (interface{}, error) {
+		ctx, cancel := context.WithTimeout(req.Context(), probeTimeout)
+		defer cancel()
+		store := p.Store()
+		defer store.Close()
+		result, err := store.Probe(ctx)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		return result, nil
+	}
+}
+
 // GET /debug/fullcheck
 func debugFullCheck(hnd http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
@@ -211,11 +275,12 @@ func debugFullCheck(hnd http.Handler) http.Handler {
 
 func newServiceDebugHandler(p *Pool, c ServerParams, hnd http.Handler) http.Handler {
 	mux := router.NewServeMux()
-	mux.Handle("/info", router.HandleJSON(serveDebugInfo))
+	mux.Handle("/info", authorized(c, router.HandleJSON(serveDebugInfo(describeBlobStore(p)))))
 	mux.Handle("/check", debugCheck(map[string]func() error{
 		"mongodb":       checkDB(p.db.Database),
 		"elasticsearch": checkES(p.es),
 	}))
+	mux.Handle("/probe", router.HandleJSON(debugProbe(p)))
 	mux.Handle("/fullcheck", authorized(c, debugFullCheck(hnd)))
 	return handler{mux}
 }
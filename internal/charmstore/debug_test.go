@@ -4,13 +4,17 @@
 package charmstore
 
 import (
+	"encoding/json"
 	"errors"
 	"net/http"
 
 	"github.com/juju/charmrepo/v6/csclient/params"
+	jc "github.com/juju/testing/checkers"
 	"github.com/juju/testing/httptesting"
 	gc "gopkg.in/check.v1"
+	"gopkg.in/goose.v2/identity"
 
+	"gopkg.in/juju/charmstore.v5/internal/blobstore"
 	"gopkg.in/juju/charmstore.v5/internal/router"
 	appver "gopkg.in/juju/charmstore.v5/version"
 )
@@ -92,9 +96,65 @@ func (s *debugSuite) TestDebugCheck(c *gc.C) {
 }
 
 func (s *debugSuite) TestDebugInfo(c *gc.C) {
+	info := blobstore.BackendInfo{
+		Type:      "mongodb",
+		Reachable: true,
+	}
 	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
-		Handler:      router.HandleJSON(serveDebugInfo),
+		Handler: router.HandleJSON(serveDebugInfo(func() blobstore.BackendInfo {
+			return info
+		})),
 		ExpectStatus: http.StatusOK,
-		ExpectBody:   appver.VersionInfo,
+		ExpectBody: map[string]interface{}{
+			"GitCommit": appver.VersionInfo.GitCommit,
+			"Version":   appver.VersionInfo.Version,
+			"BlobStore": map[string]interface{}{
+				"Type":      "mongodb",
+				"Reachable": true,
+			},
+		},
+	})
+}
+
+func (s *debugSuite) TestDebugInfoOmitsCredentials(c *gc.C) {
+	cred := &identity.Credentials{
+		URL:        "http://127.0.0.1:1/",
+		User:       "fred",
+		Secrets:    "swift-secret",
+		Region:     "some region",
+		TenantName: "tenant",
+	}
+	backend := blobstore.NewSwiftBackend(cred, identity.AuthUserPass, "charms", "")
+	keys, err := blobstore.NewEncryptionKeys(map[string][]byte{
+		"k1": []byte("0123456789abcdef"),
+	}, "k1")
+	c.Assert(err, gc.Equals, nil)
+	backend = blobstore.NewEncryptedBackend(backend, keys, "")
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: router.HandleJSON(serveDebugInfo(func() blobstore.BackendInfo {
+			return blobstore.Describe(backend)
+		})),
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	for _, secret := range []string{"swift-secret", "0123456789abcdef", "127.0.0.1", "fred", "some region", "tenant", "charms", "k1"} {
+		c.Assert(rec.Body.String(), gc.Not(jc.Contains), secret)
+	}
+
+	var resp struct {
+		BlobStore blobstore.BackendInfo
+	}
+	err = json.Unmarshal(rec.Body.Bytes(), &resp)
+	c.Assert(err, gc.Equals, nil)
+	info := resp.BlobStore
+	c.Assert(info.Type, gc.Equals, "encrypted")
+	c.Assert(info.Reachable, gc.Equals, false)
+	c.Assert(info.Config, gc.HasLen, 0)
+	c.Assert(info.Backends, gc.HasLen, 1)
+	swiftInfo := info.Backends[0]
+	c.Assert(swiftInfo.Type, gc.Equals, "swift")
+	c.Assert(swiftInfo.Reachable, gc.Equals, false)
+	c.Assert(swiftInfo.Error, gc.Not(gc.Equals), "")
+	c.Assert(swiftInfo.Config, jc.DeepEquals, map[string]string{
+		"auth-mode": identity.AuthUserPass.String(),
 	})
 }
@@ -0,0 +1,140 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5/internal/charmstore"
+
+import (
+	"sort"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v5/internal/charm"
+)
+
+// DuplicateBlobGroup holds a set of entities and resources that all
+// refer to blobs with the same hash. The blob store holds a single
+// object for each hash, so the group records shared references rather
+// than duplicated storage.
+type DuplicateBlobGroup struct {
+	// BlobHash holds the hash of the shared blob.
+	BlobHash string
+
+	// Size holds the size of the shared blob.
+	Size int64
+
+	// Entities holds the ids of the entities whose archive is the
+	// shared blob.
+	Entities []*charm.URL `json:",omitempty"`
+
+	// Resources holds the resource revisions whose content is the
+	// shared blob.
+	Resources []DuplicateBlobResource `json:",omitempty"`
+}
+
+// DuplicateBlobResource identifies a resource revision in a
+// DuplicateBlobGroup.
+type DuplicateBlobResource struct {
+	// BaseURL holds the base URL of the charm the resource
+	// belongs to.
+	BaseURL *charm.URL
+
+	// Name holds the name of the resource.
+	Name string
+
+	// Revision holds the revision of the resource.
+	Revision int
+}
+
+// DuplicateBlobReport returns a group for each blob hash that is
+// referred to by more than one entity or resource revision, largest
+// blob first. It only reads the store; removing the
+// duplicates is left to the caller. Docker resources have no blob, so
+// they are never included.
+func (s *Store) DuplicateBlobReport() ([]DuplicateBlobGroup, error) {
+	var entityGroups []struct {
+		BlobHash string       `bson:"_id"`
+		Size     int64        `bson:"size"`
+		URLs     []*charm.URL `bson:"urls"`
+	}
+	if err := s.DB.Entities().Pipe([]bson.D{{
+		{"$group", bson.D{
+			{"_id", "$blobhash"},
+			{"size", bson.D{{"$first", "$size"}}},
+			{"urls", bson.D{{"$push", "$_id"}}},
+		}},
+	}}).AllowDiskUse().All(&entityGroups); err != nil {
+		return nil, errgo.Notef(err, "cannot group entities by blob")
+	}
+	var resourceGroups []struct {
+		BlobHash  string                  `bson:"_id"`
+		Size      int64                   `bson:"size"`
+		Resources []DuplicateBlobResource `bson:"resources"`
+	}
+	if err := s.DB.Resources().Pipe([]bson.D{{
+		{"$match", bson.D{{"blobhash", bson.D{{"$nin", []interface{}{"", nil}}}}}},
+	}, {
+		{"$group", bson.D{
+			{"_id", "$blobhash"},
+			{"size", bson.D{{"$first", "$size"}}},
+			{"resources", bson.D{{"$push", bson.D{
+				{"baseurl", "$baseurl"},
+				{"name", "$name"},
+				{"revision", "$revision"},
+			}}}},
+		}},
+	}}).AllowDiskUse().All(&resourceGroups); err != nil {
+		return nil, errgo.Notef(err, "cannot group resources by blob")
+	}
+
+	// Entities and resources may share blobs too, so merge the
+	// groups by hash before looking for duplicates.
+	groups := make(map[string]*DuplicateBlobGroup)
+	group := func(hash string, size int64) *DuplicateBlobGroup {
+		g := groups[hash]
+		if g == nil {
+			g = &DuplicateBlobGroup{
+				BlobHash: hash,
+				Size:     size,
+			}
+			groups[hash] = g
+		}
+		return g
+	}
+	for _, eg := range entityGroups {
+		g := group(eg.BlobHash, eg.Size)
+		g.Entities = append(g.Entities, eg.URLs...)
+	}
+	for _, rg := range resourceGroups {
+		g := group(rg.BlobHash, rg.Size)
+		g.Resources = append(g.Resources, rg.Resources...)
+	}
+	result := []DuplicateBlobGroup{}
+	for _, g := range groups {
+		n := len(g.Entities) + len(g.Resources)
+		if n < 2 {
+			continue
+		}
+		sort.Slice(g.Entities, func(i, j int) bool {
+			return g.Entities[i].String() < g.Entities[j].String()
+		})
+		sort.Slice(g.Resources, func(i, j int) bool {
+			r0, r1 := g.Resources[i], g.Resources[j]
+			if *r0.BaseURL != *r1.BaseURL {
+				return r0.BaseURL.String() < r1.BaseURL.String()
+			}
+			if r0.Name != r1.Name {
+				return r0.Name < r1.Name
+			}
+			return r0.Revision < r1.Revision
+		})
+		result = append(result, *g)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Size != result[j].Size {
+			return result[i].Size > result[j].Size
+		}
+		return result[i].BlobHash < result[j].BlobHash
+	})
+	return result, nil
+}
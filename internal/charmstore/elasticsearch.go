@@ -10,7 +10,7 @@ var (
 	esMapping = mustParseJSON(esMappingJSON)
 )
 
-const esSettingsVersion = 12
+const esSettingsVersion = 20
 
 func mustParseJSON(s string) interface{} {
 	var j json.RawMessage
@@ -126,6 +126,21 @@ const esMappingJSON = `
       "TotalDownloads": {
         "type": "long"
       },
+      "MinJujuVersion": {
+        "type": "long"
+      },
+      "AssumesFeatureNames": {
+        "type": "string",
+        "index": "not_analyzed",
+        "omit_norms": true,
+        "index_options": "docs"
+      },
+      "AssumesFeatureVersions": {
+        "type": "string",
+        "index": "not_analyzed",
+        "omit_norms": true,
+        "index_options": "docs"
+      },
       "BlobHash": {
         "type": "string",
         "index": "not_analyzed",
@@ -251,6 +266,12 @@ const esMappingJSON = `
 	      }
 	    }
           },
+          "Terms": {
+            "type": "string",
+            "index": "not_analyzed",
+            "omit_norms": true,
+            "index_options": "docs"
+          },
           "Tags": {
 	    "type": "multi_field",
 	    "fields": {
@@ -295,6 +316,18 @@ const esMappingJSON = `
         "omit_norms": true,
         "index_options": "docs"
       },
+      "AssumesFeatures": {
+        "type": "string",
+        "index": "not_analyzed",
+        "omit_norms": true,
+        "index_options": "docs"
+      },
+      "Source": {
+        "type": "string",
+        "index": "not_analyzed",
+        "omit_norms": true,
+        "index_options": "docs"
+      },
       "BundleData": {
         "type": "object",
         "dynamic": "false",
@@ -397,6 +430,24 @@ const esMappingJSON = `
         "index": "not_analyzed",
         "omit_norms": true,
         "index_options": "docs"
+      },
+      "Promulgated": {
+        "type": "boolean",
+        "index": "not_analyzed",
+        "omit_norms": true,
+        "index_options": "docs"
+      },
+      "Suggest": {
+        "type": "completion",
+        "analyzer": "simple",
+        "search_analyzer": "simple",
+        "payloads": false,
+        "context": {
+          "acl": {
+            "type": "category",
+            "path": "ReadACLs"
+          }
+        }
       }
     }
   }
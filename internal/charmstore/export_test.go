@@ -2,3 +2,10 @@
 // Licensed under the AGPLv3, see LICENCE file for details.
 
 package charmstore
+
+var (
+	TestNewRevisionCollision = &testNewRevisionCollision
+	TestExtraInfoWritten     = &testExtraInfoWritten
+	TestMongoReadError       = &testMongoReadError
+	TestRenameWritten        = &testRenameWritten
+)
@@ -0,0 +1,187 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5/internal/charmstore"
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/yaml.v2"
+
+	"gopkg.in/juju/charmstore.v5/internal/charm"
+)
+
+// relationHookKinds holds the suffixes of the hooks that may be
+// run for a relation.
+var relationHookKinds = []string{
+	"-relation-joined",
+	"-relation-changed",
+	"-relation-departed",
+	"-relation-broken",
+}
+
+// lintCharm checks the charm archive of the given size held in r for
+// common problems. If any are found, an error with a *params.Error
+// cause with the code params.ErrInvalidEntity is returned, enumerating
+// all the issues found.
+func lintCharm(r io.ReaderAt, size int64) error {
+	issues, err := lintCharmArchive(r, size)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrInvalidEntity))
+	}
+	if len(issues) == 0 {
+		return nil
+	}
+	return &params.Error{
+		Code:    params.ErrInvalidEntity,
+		Message: fmt.Sprintf("charm failed lint checks: %s", strings.Join(issues, "; ")),
+	}
+}
+
+// lintCharmArchive returns a description of each problem found in the
+// charm archive of the given size held in r. It checks that
+// metadata.yaml is present and valid, that every declared relation has
+// at least one hook (unless the charm dispatches all its hooks through
+// a dispatch script) and that config.yaml, if present, declares valid
+// option types and defaults.
+func lintCharmArchive(r io.ReaderAt, size int64) ([]string, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, zipReadError(err, "cannot read charm archive")
+	}
+	files := make(map[string]*zip.File)
+	for _, f := range zr.File {
+		files[path.Clean(f.Name)] = f
+	}
+	var issues []string
+	meta, issue, err := lintMeta(files)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if issue != "" {
+		issues = append(issues, issue)
+	}
+	if meta != nil {
+		issues = append(issues, lintRelationHooks(meta, files)...)
+	}
+	configIssues, err := lintConfig(files)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	issues = append(issues, configIssues...)
+	return issues, nil
+}
+
+// lintMeta reads and parses the charm metadata from the given archive
+// files. If the metadata is missing or invalid, it returns a
+// description of the problem.
+func lintMeta(files map[string]*zip.File) (*charm.Meta, string, error) {
+	data, err := readArchiveFile(files, "metadata.yaml")
+	if err != nil {
+		return nil, "", errgo.Mask(err)
+	}
+	if data == nil {
+		return nil, "metadata.yaml not found", nil
+	}
+	meta, err := charm.ReadMeta(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Sprintf("cannot parse metadata.yaml: %v", err), nil
+	}
+	return meta, "", nil
+}
+
+// lintRelationHooks returns a description of each relation
+// in meta that has no associated hook in the given archive files.
+func lintRelationHooks(meta *charm.Meta, files map[string]*zip.File) []string {
+	if files["dispatch"] != nil {
+		// All hooks are handled by the dispatch script.
+		return nil
+	}
+	var names []string
+	for _, rels := range []map[string]charm.Relation{meta.Provides, meta.Requires, meta.Peers} {
+		for name := range rels {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var issues []string
+	for _, name := range names {
+		found := false
+		for _, kind := range relationHookKinds {
+			if files[path.Join("hooks", name+kind)] != nil {
+				found = true
+				break
+			}
+		}
+		if !found {
+			issues = append(issues, fmt.Sprintf("no hooks found for relation %q", name))
+		}
+	}
+	return issues
+}
+
+// lintConfig returns a description of each problem found in the
+// config.yaml file in the given archive files, if there is one.
+func lintConfig(files map[string]*zip.File) ([]string, error) {
+	data, err := readArchiveFile(files, "config.yaml")
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if data == nil {
+		return nil, nil
+	}
+	var config struct {
+		Options map[string]struct {
+			Type string
+		}
+	}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return []string{fmt.Sprintf("cannot parse config.yaml: %v", err)}, nil
+	}
+	var issues []string
+	for name, option := range config.Options {
+		switch option.Type {
+		case "", "string", "int", "float", "boolean":
+		default:
+			issues = append(issues, fmt.Sprintf("config option %q has invalid type %q", name, option.Type))
+		}
+	}
+	if len(issues) > 0 {
+		sort.Strings(issues)
+		return issues, nil
+	}
+	// The option types are fine, so check the rest of the
+	// configuration (for example the option defaults).
+	if _, err := charm.ReadConfig(bytes.NewReader(data)); err != nil {
+		return []string{fmt.Sprintf("invalid config.yaml: %v", err)}, nil
+	}
+	return nil, nil
+}
+
+// readArchiveFile returns the contents of the named file from the given
+// archive files, or nil if there is no such file.
+func readArchiveFile(files map[string]*zip.File, name string) ([]byte, error) {
+	f := files[name]
+	if f == nil {
+		return nil, nil
+	}
+	r, err := f.Open()
+	if err != nil {
+		return nil, zipReadError(err, fmt.Sprintf("cannot open %s", name))
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, zipReadError(err, fmt.Sprintf("cannot read %s", name))
+	}
+	return data, nil
+}
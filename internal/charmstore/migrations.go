@@ -90,13 +90,17 @@ var migrations = []migration{{
 }}
 
 // migration holds a migration function with its corresponding name.
+// The function is called with the database and the prefix of the
+// collections used by the blob store, including any collection prefix.
 type migration struct {
 	name    mongodoc.MigrationName
-	migrate func(StoreDatabase) error
+	migrate func(db StoreDatabase, blobPrefix string) error
 }
 
-// Migrate starts the migration process using the given database.
-func migrate(db StoreDatabase) error {
+// Migrate starts the migration process using the given database. The
+// blobPrefix parameter holds the prefix of the collections used by the
+// blob store, including any collection prefix.
+func migrate(db StoreDatabase, blobPrefix string) error {
 	db = db.copy()
 	defer db.Close()
 	db.Session.SetSocketTimeout(10 * time.Minute)
@@ -122,7 +126,7 @@ func migrate(db StoreDatabase) error {
 			continue
 		}
 		logger.Infof("starting migration: %s", m.name)
-		if err := m.migrate(db); err != nil {
+		if err := m.migrate(db, blobPrefix); err != nil {
 			return errgo.Notef(err, "error executing migration: %s", m.name)
 		}
 		if err := setExecuted(db, m.name); err != nil {
@@ -171,7 +175,7 @@ func setExecuted(db StoreDatabase, name mongodoc.MigrationName) error {
 
 // migrateRevisionsCollection populates the revisions collection
 // from the entities in the database.
-func migrateRevisionsCollection(db StoreDatabase) error {
+func migrateRevisionsCollection(db StoreDatabase, _ string) error {
 	revs := make(map[string]int)
 	set := func(url *charm.URL) {
 		rev := url.Revision
@@ -252,8 +256,8 @@ type legacyManagedResourceDoc struct {
 	ResourceId string
 }
 
-func migrateBlobRefs(db StoreDatabase) error {
-	if err := createBlobRefsCollection(db); err != nil {
+func migrateBlobRefs(db StoreDatabase, blobPrefix string) error {
+	if err := createBlobRefsCollection(db, blobPrefix); err != nil {
 		return errgo.Mask(err)
 	}
 	if err := updatePreV5BlobExtraHashes(db); err != nil {
@@ -262,6 +266,14 @@ func migrateBlobRefs(db StoreDatabase) error {
 	return nil
 }
 
+// The legacy juju blobstore collections read by migrateBlobRefs. Like
+// all the charm store collections, their names are given any
+// configured collection prefix.
+const (
+	legacyManagedResourcesCollection = "managedStoredResources"
+	legacyStoredResourcesCollection  = "storedResources"
+)
+
 type legacyEntity struct {
 	mongodoc.Entity `bson:",inline"`
 
@@ -274,7 +286,7 @@ type legacyEntity struct {
 
 // updatePreV5BlobExtraHashes updates the entity
 func updatePreV5BlobExtraHashes(db StoreDatabase) error {
-	managedResources := db.C("managedStoredResources")
+	managedResources := db.C(legacyManagedResourcesCollection)
 	iter := managedResources.Find(bson.D{{
 		"path", bson.D{{
 			"$regex", `.pre-v5-suffix$`,
@@ -342,14 +354,15 @@ func preV5CompatibilityBlobName(blobName string) string {
 }
 
 // createBlobRefsCollection populates the blobrefs collection
-// used by the blob store by getting all the blob names and
-// hashes from the legacy juju blobstore storedResources collection.
-// Note: this leaves the storedResources collection around, even
-// though it's no longer in use.
-func createBlobRefsCollection(db StoreDatabase) error {
-	storedResources := db.C("storedResources")
+// used by the blob store with the given prefix by getting all the blob
+// names and hashes from the legacy juju blobstore storedResources
+// collection. Note: this leaves the storedResources collection around,
+// even though it's no longer in use.
+func createBlobRefsCollection(db StoreDatabase, blobPrefix string) error {
+	storedResources := db.C(legacyStoredResourcesCollection)
 	iter := storedResources.Find(nil).Iter()
-	blobRefCollection := db.C("entitystore.blobref")
+	// The blob prefix already includes any collection prefix.
+	blobRefCollection := db.Database.C(blobPrefix + ".blobref")
 	var doc legacyBlobstoreResourceDoc
 	logger.Infof("start adding blobrefs")
 	for iter.Next(&doc) {
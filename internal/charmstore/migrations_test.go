@@ -25,7 +25,7 @@ var _ = gc.Suite(&migrationsSuite{})
 
 func (s *migrationsSuite) SetUpTest(c *gc.C) {
 	s.IsolatedMgoSuite.SetUpTest(c)
-	s.db = StoreDatabase{s.Session.DB("migration-testing")}
+	s.db = StoreDatabase{Database: s.Session.DB("migration-testing")}
 	s.executed = nil
 }
 
@@ -55,7 +55,7 @@ func (s *migrationsSuite) makeMigrations(c *gc.C, names ...mongodoc.MigrationNam
 		name := name
 		ms[i] = migration{
 			name: name,
-			migrate: func(StoreDatabase) error {
+			migrate: func(StoreDatabase, string) error {
 				s.executed = append(s.executed, name)
 				return nil
 			},
@@ -140,17 +140,17 @@ func (s *migrationsSuite) TestMigrateErrorUnknownMigration(c *gc.C) {
 func (s *migrationsSuite) TestMigrateErrorExecutingMigration(c *gc.C) {
 	ms := []migration{{
 		name: "migr-1",
-		migrate: func(StoreDatabase) error {
+		migrate: func(StoreDatabase, string) error {
 			return nil
 		},
 	}, {
 		name: "migr-2",
-		migrate: func(StoreDatabase) error {
+		migrate: func(StoreDatabase, string) error {
 			return errgo.New("bad wolf")
 		},
 	}, {
 		name: "migr-3",
-		migrate: func(StoreDatabase) error {
+		migrate: func(StoreDatabase, string) error {
 			return nil
 		},
 	}}
@@ -164,6 +164,31 @@ func (s *migrationsSuite) TestMigrateErrorExecutingMigration(c *gc.C) {
 	s.checkExecuted(c, "migr-1")
 }
 
+func (s *migrationsSuite) TestCreateBlobRefsCollectionWithPrefixes(c *gc.C) {
+	db := StoreDatabase{
+		Database: s.db.Database,
+		prefix:   "test-",
+	}
+	err := db.C(legacyStoredResourcesCollection).Insert(&legacyBlobstoreResourceDoc{
+		Id:         "res-0",
+		Path:       "blob-0",
+		SHA384Hash: "hash-0",
+		Length:     42,
+	})
+	c.Assert(err, gc.Equals, nil)
+
+	err = createBlobRefsCollection(db, "test-blobs")
+	c.Assert(err, gc.Equals, nil)
+	var doc blobRefDoc
+	err = s.db.Database.C("test-blobs.blobref").FindId("hash-0").One(&doc)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(doc.Name, gc.Equals, "blob-0")
+	c.Assert(doc.Size, gc.Equals, int64(42))
+	n, err := s.db.Database.C("entitystore.blobref").Count()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 0)
+}
+
 func (s *migrationsSuite) TestMigrateMigrationNames(c *gc.C) {
 	names := make(map[mongodoc.MigrationName]bool, len(migrations))
 	for _, m := range migrations {
@@ -0,0 +1,71 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5/internal/charmstore"
+
+import (
+	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v5/internal/charm"
+	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
+)
+
+// OrphanedBaseEntities returns the URLs of all the base entities that
+// have no entities, for example because all their revisions have been
+// deleted. Base entities created by ReserveName that have not yet had
+// anything uploaded to them are not included.
+func (s *Store) OrphanedBaseEntities() ([]*charm.URL, error) {
+	iter := s.DB.BaseEntities().Find(bson.D{{"reserved", bson.D{{"$ne", true}}}}).Select(bson.D{{"_id", 1}}).Iter()
+	var urls []*charm.URL
+	var baseEntity mongodoc.BaseEntity
+	for iter.Next(&baseEntity) {
+		orphaned, err := s.isOrphaned(baseEntity.URL)
+		if err != nil {
+			iter.Close()
+			return nil, errgo.Mask(err)
+		}
+		if orphaned {
+			urls = append(urls, baseEntity.URL)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, errgo.Notef(err, "cannot iterate base entities")
+	}
+	return urls, nil
+}
+
+// RemoveBaseEntityIfOrphaned removes the base entity with the given
+// URL if it has no entities and is not a reservation made by
+// ReserveName. It reports whether the base entity was removed.
+func (s *Store) RemoveBaseEntityIfOrphaned(url *charm.URL) (bool, error) {
+	orphaned, err := s.isOrphaned(url)
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	if !orphaned {
+		return false, nil
+	}
+	err = s.DB.BaseEntities().Remove(bson.D{
+		{"_id", url},
+		{"reserved", bson.D{{"$ne", true}}},
+	})
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, errgo.Notef(err, "cannot remove base entity %s", url)
+	}
+	return true, nil
+}
+
+// isOrphaned reports whether there are no entities with the given
+// base URL.
+func (s *Store) isOrphaned(baseURL *charm.URL) (bool, error) {
+	n, err := s.DB.Entities().Find(bson.D{{"baseurl", baseURL}}).Limit(1).Count()
+	if err != nil {
+		return false, errgo.Notef(err, "cannot count entities of %s", baseURL)
+	}
+	return n == 0, nil
+}
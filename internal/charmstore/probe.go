@@ -0,0 +1,110 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5/internal/charmstore"
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ProbeResult holds the results of probing the services that the
+// store depends on.
+type ProbeResult struct {
+	// MongoLatency holds the time taken to run a ping command on
+	// MongoDB.
+	MongoLatency time.Duration
+
+	// BlobStoreLatency holds the time taken to look up a blob
+	// in the blob store backend.
+	BlobStoreLatency time.Duration
+
+	// SessionsInUse holds the number of MongoDB sessions that
+	// are currently in use by the pool.
+	SessionsInUse int
+
+	// MaxSessions holds the maximum number of MongoDB sessions
+	// that the pool will use to serve requests, as configured with
+	// ServerParams.MaxMgoSessions. Zero means no limit.
+	MaxSessions int
+
+	// SessionUtilization holds SessionsInUse as a fraction of
+	// MaxSessions. It is zero if there is no limit.
+	SessionUtilization float64
+}
+
+// Probe measures the round trip latency of MongoDB and of the blob
+// store, and reports the pool's MongoDB session utilization.
+//
+// If ctx is done before the probe completes, Probe returns an error
+// with the context's error as its cause.
+func (s *Store) Probe(ctx context.Context) (ProbeResult, error) {
+	if err := ctx.Err(); err != nil {
+		return ProbeResult{}, errgo.WithCausef(err, err, "cannot probe store")
+	}
+	var result ProbeResult
+	result.SessionsInUse, result.MaxSessions = s.pool.sessionsInUse()
+	if result.MaxSessions > 0 {
+		result.SessionUtilization = float64(result.SessionsInUse) / float64(result.MaxSessions)
+	}
+
+	// Run the probe on a store with its own session, so that it
+	// is safe to return while it is still running. The session is
+	// closed rather than returned to the pool afterwards, so that
+	// the timeouts set below do not apply to other requests.
+	store := *s
+	store.DB = s.DB.copy()
+	store.BlobStore = s.pool.newBlobStore(store.DB)
+	if deadline, ok := ctx.Deadline(); ok {
+		// Make sure the probe does not hold on to its
+		// session for long after we have stopped waiting.
+		store.DB.Session.SetSocketTimeout(time.Until(deadline))
+		store.DB.Session.SetSyncTimeout(time.Until(deadline))
+	}
+	type probeResult struct {
+		mongo, blobStore time.Duration
+		err              error
+	}
+	c := make(chan probeResult, 1)
+	go func() {
+		var r probeResult
+		r.mongo, r.blobStore, r.err = store.probe()
+		store.DB.Close()
+		c <- r
+	}()
+	select {
+	case r := <-c:
+		if r.err != nil {
+			return ProbeResult{}, errgo.Mask(r.err)
+		}
+		result.MongoLatency = r.mongo
+		result.BlobStoreLatency = r.blobStore
+		return result, nil
+	case <-ctx.Done():
+		return ProbeResult{}, errgo.WithCausef(ctx.Err(), ctx.Err(), "cannot probe store")
+	}
+}
+
+// probe returns the time taken to ping MongoDB and the blob store.
+func (s *Store) probe() (mongo, blobStore time.Duration, err error) {
+	t0 := time.Now()
+	if err := s.DB.Run(bson.D{{"ping", 1}}, nil); err != nil {
+		return 0, 0, errgo.Notef(err, "cannot ping MongoDB")
+	}
+	t1 := time.Now()
+	if err := s.BlobStore.Ping(); err != nil {
+		return 0, 0, errgo.Notef(err, "cannot ping blob store")
+	}
+	return t1.Sub(t0), time.Since(t1), nil
+}
+
+// sessionsInUse returns the number of MongoDB sessions currently in use
+// by the pool and the configured maximum number of sessions.
+func (p *Pool) sessionsInUse() (inUse, max int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.storeCount - len(p.reqStoreC), p.config.MaxMgoSessions
+}
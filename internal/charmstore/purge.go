@@ -0,0 +1,214 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5/internal/charmstore"
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v5/internal/charm"
+	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
+)
+
+// PurgeReport holds the number of documents of each kind removed by
+// PurgeUser.
+type PurgeReport struct {
+	// Entities holds the number of charm and bundle revisions
+	// removed.
+	Entities int
+
+	// BaseEntities holds the number of base entities removed,
+	// not including reservations.
+	BaseEntities int
+
+	// Reservations holds the number of names reserved with
+	// ReserveName that were removed.
+	Reservations int
+
+	// Resources holds the number of resource revisions removed.
+	Resources int
+
+	// AuditEntries holds the number of audit entries removed.
+	AuditEntries int
+}
+
+// PurgeUser removes everything owned by the given user: all the
+// entities and base entities under ~user, including reserved names,
+// their resources, revision counters, download counts and pending
+// publish requests, the user's API tokens and the audit entries that
+// refer to the user or their entities. References to the user on other
+// users' entities are also removed: the user is taken out of their
+// channel ACLs, publish requests made by the user are discarded and
+// the user's name is removed from their publish history. The blob garbage collector is then run so that the
+// archives and resources that are no longer referenced are removed
+// (blobs stored less than blobGCGracePeriod ago are left for the
+// periodic garbage collector). It returns the number of documents
+// removed.
+//
+// If the user owns a promulgated charm or bundle, an error with a
+// params.ErrForbidden cause is returned unless force is true.
+func (s *Store) PurgeUser(user string, force bool) (PurgeReport, error) {
+	var report PurgeReport
+	if user == "" {
+		return report, errgo.WithCausef(nil, params.ErrBadRequest, "no user specified")
+	}
+	var baseEntities []*mongodoc.BaseEntity
+	if err := s.DB.BaseEntities().
+		Find(bson.D{{"user", user}}).
+		Select(FieldSelector("promulgated", "reserved", "channelentities")).
+		All(&baseEntities); err != nil {
+		return report, errgo.Notef(err, "cannot find base entities of %q", user)
+	}
+	if !force {
+		var promulgated []string
+		for _, b := range baseEntities {
+			if b.Promulgated {
+				promulgated = append(promulgated, b.URL.String())
+			}
+		}
+		if len(promulgated) > 0 {
+			sort.Strings(promulgated)
+			return report, errgo.WithCausef(nil, params.ErrForbidden, "cannot purge user %q: user owns promulgated entities %s", user, strings.Join(promulgated, ", "))
+		}
+	}
+	baseURLs := make([]*charm.URL, len(baseEntities))
+	for i, b := range baseEntities {
+		baseURLs[i] = b.URL
+	}
+
+	var entities []*mongodoc.Entity
+	if err := s.DB.Entities().
+		Find(bson.D{{"user", user}}).
+		Select(FieldSelector("blobhash", "prev5blobhash")).
+		All(&entities); err != nil {
+		return report, errgo.Notef(err, "cannot find entities of %q", user)
+	}
+	entityURLs := make([]*charm.URL, len(entities))
+	for i, e := range entities {
+		entityURLs[i] = e.URL
+	}
+	info, err := s.DB.Entities().RemoveAll(bson.D{{"user", user}})
+	if err != nil {
+		return report, errgo.Notef(err, "cannot remove entities of %q", user)
+	}
+	report.Entities = info.Removed
+	for _, e := range entities {
+		s.pool.invalidateBlob(e.BlobHash)
+		if e.PreV5BlobHash != "" && e.PreV5BlobHash != e.BlobHash {
+			s.pool.invalidateBlob(e.PreV5BlobHash)
+		}
+	}
+	if _, err := s.DB.PendingPublishes().RemoveAll(bson.D{{"$or", []bson.D{
+		{{"url", bson.D{{"$in", entityURLs}}}},
+		{{"user", user}},
+	}}}); err != nil {
+		return report, errgo.Notef(err, "cannot remove pending publishes of %q", user)
+	}
+
+	info, err = s.DB.Resources().RemoveAll(bson.D{{"baseurl", bson.D{{"$in", baseURLs}}}})
+	if err != nil {
+		return report, errgo.Notef(err, "cannot remove resources of %q", user)
+	}
+	report.Resources = info.Removed
+	if _, err := s.DB.Revisions().RemoveAll(bson.D{{"baseurl", bson.D{{"$in", baseURLs}}}}); err != nil {
+		return report, errgo.Notef(err, "cannot remove revisions of %q", user)
+	}
+	if _, err := s.DB.RevisionBases().RemoveAll(bson.D{{"_id", bson.D{{"$in", baseURLs}}}}); err != nil {
+		return report, errgo.Notef(err, "cannot remove revision bases of %q", user)
+	}
+
+	for _, b := range baseEntities {
+		if err := s.ES.deleteBaseEntity(b); err != nil {
+			return report, errgo.Notef(err, "cannot remove search records for %s", b.URL)
+		}
+	}
+	info, err = s.DB.BaseEntities().RemoveAll(bson.D{{"user", user}})
+	if err != nil {
+		return report, errgo.Notef(err, "cannot remove base entities of %q", user)
+	}
+	for _, b := range baseEntities {
+		if b.Reserved {
+			report.Reservations++
+		}
+	}
+	report.BaseEntities = info.Removed - report.Reservations
+	if _, err := s.DB.DownloadCounts().RemoveAll(bson.D{{"id", bson.RegEx{
+		Pattern: "^" + regexp.QuoteMeta("cs:~"+user+"/"),
+	}}}); err != nil {
+		return report, errgo.Notef(err, "cannot remove download counts of %q", user)
+	}
+	if err := s.purgeUserReferences(user); err != nil {
+		return report, errgo.Mask(err)
+	}
+
+	if err := s.RevokeAPITokens(user); err != nil {
+		return report, errgo.Mask(err)
+	}
+	info, err = s.DB.Audit().RemoveAll(bson.D{{"$or", []bson.D{
+		{{"user", user}},
+		{{"baseurl", bson.D{{"$in", baseURLs}}}},
+	}}})
+	if err != nil {
+		return report, errgo.Notef(err, "cannot remove audit entries of %q", user)
+	}
+	report.AuditEntries = info.Removed
+
+	if err := s.BlobStoreGC(time.Now().Add(-blobGCGracePeriod)); err != nil {
+		return report, errgo.Mask(err)
+	}
+	return report, nil
+}
+
+// purgeUserReferences removes the given user from the channel ACLs and
+// publish history of the base entities owned by other users.
+func (s *Store) purgeUserReferences(user string) error {
+	var query []bson.D
+	var pull bson.D
+	for _, ch := range params.OrderedChannels {
+		for _, op := range []string{"read", "write"} {
+			field := fmt.Sprintf("channelacls.%s.%s", ch, op)
+			query = append(query, bson.D{{field, user}})
+			pull = append(pull, bson.DocElem{field, user})
+		}
+	}
+	var baseEntities []*mongodoc.BaseEntity
+	if err := s.DB.BaseEntities().
+		Find(bson.D{{"$or", query}}).
+		Select(FieldSelector("_id")).
+		All(&baseEntities); err != nil {
+		return errgo.Notef(err, "cannot find base entities shared with %q", user)
+	}
+	if len(baseEntities) > 0 {
+		if _, err := s.DB.BaseEntities().UpdateAll(bson.D{{"$or", query}}, bson.D{{"$pull", pull}}); err != nil {
+			return errgo.Notef(err, "cannot remove %q from ACLs", user)
+		}
+		for _, b := range baseEntities {
+			if err := s.UpdateSearchBaseURL(b.URL); err != nil {
+				return errgo.Notef(err, "cannot update search entities for %q", b.URL)
+			}
+		}
+	}
+	// The positional operator only updates the first matching
+	// publish history entry in each base entity, so keep going
+	// until no entries refer to the user.
+	for {
+		info, err := s.DB.BaseEntities().UpdateAll(
+			bson.D{{"publishhistory.user", user}},
+			bson.D{{"$unset", bson.D{{"publishhistory.$.user", true}}}},
+		)
+		if err != nil {
+			return errgo.Notef(err, "cannot remove %q from publish history", user)
+		}
+		if info.Matched == 0 {
+			return nil
+		}
+	}
+}
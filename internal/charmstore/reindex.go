@@ -0,0 +1,311 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5/internal/charmstore"
+
+import (
+	"time"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	"github.com/juju/utils"
+	"golang.org/x/net/context"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5/internal/router"
+)
+
+// ReindexAll updates the search record of every entity in the store.
+// If progress is non-nil, it is called with the number of entities
+// processed so far and the total number of entities, once before any
+// entity is indexed and then after each entity. The reindex stops with
+// an error with the context's error as its cause if ctx is cancelled.
+// If the search index is not configured then ReindexAll does nothing
+// and returns a nil error.
+func (s *Store) ReindexAll(ctx context.Context, progress func(done, total int)) error {
+	if s.ES == nil || s.ES.Database == nil {
+		return nil
+	}
+	if progress == nil {
+		progress = func(int, int) {}
+	}
+	total, err := s.DB.Entities().Count()
+	if err != nil {
+		return errgo.Notef(err, "cannot count entities")
+	}
+	progress(0, total)
+	var result mongodoc.Entity
+	// Only get the IDs here, UpdateSearch will get the full document
+	// if it is in a series that is indexed.
+	iter := s.DB.Entities().Find(nil).Select(bson.M{"_id": 1, "promulgated-url": 1}).Iter()
+	defer iter.Close() // Make sure we always close on error.
+	done := 0
+	for iter.Next(&result) {
+		if err := ctx.Err(); err != nil {
+			return errgo.NoteMask(err, "reindex stopped", errgo.Any)
+		}
+		rurl := EntityResolvedURL(&result)
+		if err := s.UpdateSearch(rurl); err != nil {
+			return errgo.Notef(err, "cannot index %s", rurl)
+		}
+		done++
+		if done > total {
+			// Entities have been added since we counted them.
+			total = done
+		}
+		progress(done, total)
+	}
+	if err := iter.Close(); err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+// reindexJobMaxAge holds the length of time that finished reindex
+// jobs are kept before they are removed by MongoDB.
+const reindexJobMaxAge = 24 * time.Hour
+
+// reindexProgressInterval holds the minimum time between the updates
+// of a running job's progress in the database. The job notices that it
+// has been cancelled from another server when its progress is updated.
+var reindexProgressInterval = time.Second
+
+// reindexJobStaleTime holds the length of time after which a running
+// job whose progress has not been updated is assumed to have been
+// abandoned, for example because the server running it stopped.
+var reindexJobStaleTime = 10 * time.Minute
+
+// ReindexStatus holds the progress of a reindex job started by
+// Pool.StartReindex.
+type ReindexStatus struct {
+	// JobId holds the id of the job.
+	JobId string
+
+	// Done holds the number of entities processed so far.
+	Done int
+
+	// Total holds the total number of entities to process.
+	Total int
+
+	// Finished holds whether the job has completed, either
+	// successfully or not.
+	Finished bool
+
+	// Error holds the reason the job failed, if it did.
+	Error string `json:",omitempty"`
+}
+
+// StartReindex starts reindexing all the entities in the store in the
+// background and returns the id of the job, which can be used with
+// ReindexStatus and CancelReindex from any server sharing the
+// database. Only one job may run at a time; if another job is running,
+// an error with a router.ErrConflict cause is returned. Any jobs
+// running in the pool are cancelled when the pool is closed.
+func (p *Pool) StartReindex() (string, error) {
+	uuid, err := utils.NewUUID()
+	if err != nil {
+		return "", errgo.Notef(err, "cannot create job id")
+	}
+	id := uuid.String()
+	store, err := p.RequestStore()
+	if err != nil {
+		return "", errgo.Mask(err, errgo.Is(ErrTooManySessions))
+	}
+	defer store.Close()
+	if err := store.finishStaleReindexJobs(); err != nil {
+		return "", errgo.Mask(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		cancel()
+		return "", errgo.Newf("pool closed")
+	}
+	if p.reindexJobs == nil {
+		p.reindexJobs = make(map[string]context.CancelFunc)
+	}
+	p.reindexJobs[id] = cancel
+	p.mu.Unlock()
+	removeJob := func() {
+		cancel()
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		delete(p.reindexJobs, id)
+	}
+	err = store.DB.ReindexJobs().Insert(&mongodoc.ReindexJob{
+		Id:         id,
+		Running:    true,
+		UpdateTime: timeNow().UTC(),
+	})
+	if mgo.IsDup(err) {
+		removeJob()
+		var running mongodoc.ReindexJob
+		if err := store.DB.ReindexJobs().Find(bson.D{{"running", true}}).One(&running); err == nil {
+			return "", errgo.WithCausef(nil, router.ErrConflict, "reindex job %s is already running", running.Id)
+		}
+		return "", errgo.WithCausef(nil, router.ErrConflict, "another reindex job is already running")
+	}
+	if err != nil {
+		removeJob()
+		return "", errgo.Notef(err, "cannot record reindex job")
+	}
+	store.Go(func(s *Store) {
+		defer removeJob()
+		var lastUpdate time.Time
+		var done, total int
+		err := s.ReindexAll(ctx, func(done1, total1 int) {
+			done, total = done1, total1
+			if time.Since(lastUpdate) < reindexProgressInterval {
+				return
+			}
+			lastUpdate = time.Now()
+			if !s.updateReindexJob(id, done, total) {
+				cancel()
+			}
+		})
+		if err := s.finishReindexJob(id, done, total, err); err != nil {
+			logger.Errorf("cannot record end of reindex job %s: %v", id, err)
+		}
+		if err != nil {
+			logger.Errorf("reindex job %s failed: %v", id, err)
+			return
+		}
+		logger.Infof("reindex job %s finished", id)
+	})
+	return id, nil
+}
+
+// updateReindexJob records the progress of the running reindex job with
+// the given id. It reports false if the job should stop because it has
+// been cancelled or is no longer running.
+func (s *Store) updateReindexJob(id string, done, total int) bool {
+	err := s.DB.ReindexJobs().Update(bson.D{
+		{"_id", id},
+		{"running", true},
+		{"cancelrequested", bson.D{{"$ne", true}}},
+	}, bson.D{{"$set", bson.D{
+		{"done", done},
+		{"total", total},
+		{"updatetime", timeNow().UTC()},
+	}}})
+	if err == mgo.ErrNotFound {
+		return false
+	}
+	if err != nil {
+		// Keep going; the progress will be recorded next time.
+		logger.Errorf("cannot record progress of reindex job %s: %v", id, err)
+	}
+	return true
+}
+
+// finishReindexJob records that the reindex job with the given id has
+// finished after processing done of total entities, with the given
+// error, which is nil if it succeeded.
+func (s *Store) finishReindexJob(id string, done, total int, jobErr error) error {
+	now := timeNow().UTC()
+	set := bson.D{
+		{"done", done},
+		{"total", total},
+		{"updatetime", now},
+		{"finishtime", now},
+	}
+	if jobErr != nil {
+		set = append(set, bson.DocElem{"error", jobErr.Error()})
+	}
+	err := s.DB.ReindexJobs().Update(bson.D{
+		{"_id", id},
+		{"running", true},
+	}, bson.D{
+		{"$set", set},
+		{"$unset", bson.D{{"running", true}}},
+	})
+	if err != nil && err != mgo.ErrNotFound {
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+// finishStaleReindexJobs marks as finished any running reindex jobs
+// whose progress has not been updated for reindexJobStaleTime, so that
+// a job abandoned by a server that stopped does not prevent new jobs
+// from starting.
+func (s *Store) finishStaleReindexJobs() error {
+	now := timeNow().UTC()
+	_, err := s.DB.ReindexJobs().UpdateAll(bson.D{
+		{"running", true},
+		{"updatetime", bson.D{{"$lt", now.Add(-reindexJobStaleTime)}}},
+	}, bson.D{
+		{"$set", bson.D{
+			{"error", "reindex job abandoned"},
+			{"updatetime", now},
+			{"finishtime", now},
+		}},
+		{"$unset", bson.D{{"running", true}}},
+	})
+	if err != nil {
+		return errgo.Notef(err, "cannot finish stale reindex jobs")
+	}
+	return nil
+}
+
+// ReindexStatus returns the progress of the reindex job with the given
+// id. If there is no such job, it returns an error with a
+// params.ErrNotFound cause. Jobs are forgotten some time after they
+// finish.
+func (p *Pool) ReindexStatus(id string) (ReindexStatus, error) {
+	store, err := p.RequestStore()
+	if err != nil {
+		return ReindexStatus{}, errgo.Mask(err, errgo.Is(ErrTooManySessions))
+	}
+	defer store.Close()
+	var job mongodoc.ReindexJob
+	if err := store.DB.ReindexJobs().FindId(id).One(&job); err != nil {
+		if err == mgo.ErrNotFound {
+			return ReindexStatus{}, errgo.WithCausef(nil, params.ErrNotFound, "reindex job %q not found", id)
+		}
+		return ReindexStatus{}, errgo.Notef(err, "cannot get reindex job")
+	}
+	return ReindexStatus{
+		JobId:    job.Id,
+		Done:     job.Done,
+		Total:    job.Total,
+		Finished: !job.Running,
+		Error:    job.Error,
+	}, nil
+}
+
+// CancelReindex stops the reindex job with the given id. A job running
+// on another server stops when it next records its progress.
+// Cancelling a job that has already finished has no effect. If there
+// is no such job, it returns an error with a params.ErrNotFound cause.
+func (p *Pool) CancelReindex(id string) error {
+	store, err := p.RequestStore()
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(ErrTooManySessions))
+	}
+	defer store.Close()
+	n, err := store.DB.ReindexJobs().FindId(id).Count()
+	if err != nil {
+		return errgo.Notef(err, "cannot get reindex job")
+	}
+	if n == 0 {
+		return errgo.WithCausef(nil, params.ErrNotFound, "reindex job %q not found", id)
+	}
+	err = store.DB.ReindexJobs().Update(bson.D{
+		{"_id", id},
+		{"running", true},
+	}, bson.D{{"$set", bson.D{{"cancelrequested", true}}}})
+	if err != nil && err != mgo.ErrNotFound {
+		return errgo.Notef(err, "cannot cancel reindex job")
+	}
+	p.mu.Lock()
+	cancel := p.reindexJobs[id]
+	p.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+	return nil
+}
@@ -0,0 +1,305 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5/internal/charmstore"
+
+import (
+	"github.com/juju/charmrepo/v6/csclient/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v5/internal/charm"
+	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
+)
+
+var testRenameWritten func() error
+
+// RenameCharm renames the charm or bundle with the base URL oldBase,
+// for example cs:~bob/wordpres, to newBase, for example
+// cs:~bob/wordpress, which must have the same user. Every revision is
+// renamed, along with its promulgated URL if it has one, and the
+// channel heads, resources and revision counters of the base entity
+// are carried over. Download statistics are not carried over.
+//
+// If oldBase does not exist, an error with a params.ErrNotFound cause
+// is returned. If newBase or any of the promulgated URLs it would
+// use already exist, or oldBase is promulgated and another base entity
+// with the new name is promulgated, an error with a
+// params.ErrForbidden cause is returned.
+//
+// All the renamed documents are written before any of the old ones
+// are removed, so if the rename fails part way through, calling
+// RenameCharm again with the same arguments completes it.
+//
+// Note that bundles that refer to the old name are not changed.
+func (s *Store) RenameCharm(oldBase, newBase *charm.URL) error {
+	if err := checkRenameURLs(oldBase, newBase); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	resuming, err := s.renameInProgress(oldBase, newBase)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrForbidden))
+	}
+	var baseDoc bson.M
+	if err := s.DB.BaseEntities().FindId(oldBase).One(&baseDoc); err != nil {
+		if err != mgo.ErrNotFound {
+			return errgo.Notef(err, "cannot find %s", oldBase)
+		}
+		if !resuming {
+			return errgo.WithCausef(nil, params.ErrNotFound, "%s not found", oldBase)
+		}
+		// Only the final steps of a previous rename remain.
+		return errgo.Mask(s.finishRename(oldBase, newBase))
+	}
+	baseEntity, err := s.FindBaseEntity(oldBase, FieldSelector("promulgated", "channelentities", "publishhistory"))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	var entityDocs []bson.M
+	if err := s.DB.Entities().Find(bson.D{{"baseurl", oldBase}}).All(&entityDocs); err != nil {
+		return errgo.Notef(err, "cannot find entities for %s", oldBase)
+	}
+	var newPromulgatedURLs []*charm.URL
+	for _, doc := range entityDocs {
+		if _, err := renameDocURL(doc, "_id", newBase.Name); err != nil {
+			return errgo.Mask(err)
+		}
+		purl, err := renameDocURL(doc, "promulgated-url", newBase.Name)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if purl != nil {
+			newPromulgatedURLs = append(newPromulgatedURLs, doc["promulgated-url"].(*charm.URL))
+		}
+		doc["baseurl"] = newBase
+		doc["name"] = newBase.Name
+	}
+	if err := s.checkRenamePromulgation(oldBase, newBase, bool(baseEntity.Promulgated), newPromulgatedURLs); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrForbidden))
+	}
+
+	if !resuming {
+		// Write the renamed base entity first so that a concurrent
+		// rename or upload to the new name fails. It records the
+		// old name until the rename is complete.
+		baseDoc["_id"] = newBase
+		baseDoc["name"] = newBase.Name
+		baseDoc["renamedfrom"] = oldBase
+		baseDoc["channelentities"] = renameChannelEntities(baseEntity.ChannelEntities, newBase.Name)
+		history := baseEntity.PublishHistory
+		for i := range history {
+			history[i].URL = renameURL(history[i].URL, newBase.Name)
+		}
+		if len(history) > 0 {
+			baseDoc["publishhistory"] = history
+		}
+		if err := s.DB.BaseEntities().Insert(baseDoc); err != nil {
+			if mgo.IsDup(err) {
+				return errgo.WithCausef(nil, params.ErrForbidden, "cannot rename %s: %s already exists", oldBase, newBase)
+			}
+			return errgo.Notef(err, "cannot insert base entity %s", newBase)
+		}
+	}
+	for _, doc := range entityDocs {
+		if _, err := s.DB.Entities().UpsertId(doc["_id"], doc); err != nil {
+			return errgo.Notef(err, "cannot insert %s", doc["_id"])
+		}
+		if purl, ok := doc["promulgated-url"].(*charm.URL); ok {
+			if err := s.addRevision(purl); err != nil {
+				return errgo.Mask(err)
+			}
+		}
+	}
+	if _, err := s.DB.Resources().UpdateAll(
+		bson.D{{"baseurl", oldBase}},
+		bson.D{{"$set", bson.D{{"baseurl", newBase}}}},
+	); err != nil {
+		return errgo.Notef(err, "cannot update resources for %s", oldBase)
+	}
+	if err := s.copyRenamedRevisions(oldBase, newBase); err != nil {
+		return errgo.Mask(err)
+	}
+
+	if testRenameWritten != nil {
+		if err := testRenameWritten(); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	// Everything has been written under the new name, so the old
+	// documents can now be removed. The old base entity is removed
+	// last so that an interrupted rename can still find them.
+	if _, err := s.DB.Entities().RemoveAll(bson.D{{"baseurl", oldBase}}); err != nil {
+		return errgo.Notef(err, "cannot remove entities for %s", oldBase)
+	}
+	if _, err := s.DB.Revisions().RemoveAll(bson.D{{"baseurl", oldBase}}); err != nil {
+		return errgo.Notef(err, "cannot remove revisions for %s", oldBase)
+	}
+	if err := s.DB.RevisionBases().RemoveId(oldBase); err != nil && err != mgo.ErrNotFound {
+		return errgo.Notef(err, "cannot remove revision base for %s", oldBase)
+	}
+	if err := s.DB.BaseEntities().RemoveId(oldBase); err != nil {
+		return errgo.Notef(err, "cannot remove base entity %s", oldBase)
+	}
+	return errgo.Mask(s.finishRename(oldBase, newBase))
+}
+
+// renameInProgress reports whether a rename of oldBase to newBase has
+// been started but not completed. If newBase exists for any other
+// reason, it returns an error with a params.ErrForbidden cause.
+func (s *Store) renameInProgress(oldBase, newBase *charm.URL) (bool, error) {
+	var baseEntity mongodoc.BaseEntity
+	err := s.DB.BaseEntities().FindId(newBase).Select(FieldSelector("renamedfrom")).One(&baseEntity)
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, errgo.Notef(err, "cannot find %s", newBase)
+	}
+	if baseEntity.RenamedFrom == nil || *baseEntity.RenamedFrom != *oldBase {
+		return false, errgo.WithCausef(nil, params.ErrForbidden, "cannot rename %s: %s already exists", oldBase, newBase)
+	}
+	return true, nil
+}
+
+// checkRenamePromulgation checks that renaming oldBase to newBase
+// would not reuse any of the given promulgated URLs or leave two
+// promulgated base entities with the same name. Documents that
+// already belong to newBase are ignored, as they can only have been
+// written by an earlier attempt at the same rename.
+func (s *Store) checkRenamePromulgation(oldBase, newBase *charm.URL, promulgated bool, promulgatedURLs []*charm.URL) error {
+	if len(promulgatedURLs) > 0 {
+		n, err := s.DB.Entities().Find(bson.D{
+			{"promulgated-url", bson.D{{"$in", promulgatedURLs}}},
+			{"baseurl", bson.D{{"$ne", newBase}}},
+		}).Count()
+		if err != nil {
+			return errgo.Notef(err, "cannot check promulgated URLs")
+		}
+		if n > 0 {
+			return errgo.WithCausef(nil, params.ErrForbidden, "cannot rename %s: promulgated name %q is already in use", oldBase, newBase.Name)
+		}
+	}
+	if !promulgated {
+		return nil
+	}
+	n, err := s.DB.BaseEntities().Find(bson.D{
+		{"_id", bson.D{{"$ne", newBase}}},
+		{"name", newBase.Name},
+		{"promulgated", mongodoc.IntBool(true)},
+	}).Count()
+	if err != nil {
+		return errgo.Notef(err, "cannot check promulgated base entities")
+	}
+	if n > 0 {
+		return errgo.WithCausef(nil, params.ErrForbidden, "cannot rename %s: another charm named %q is already promulgated", oldBase, newBase.Name)
+	}
+	return nil
+}
+
+// finishRename completes a rename of oldBase to newBase once all the
+// old documents have been removed, by updating the search index and
+// clearing the record of the rename.
+func (s *Store) finishRename(oldBase, newBase *charm.URL) error {
+	baseEntity, err := s.FindBaseEntity(newBase, FieldSelector("channelentities"))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	// Search records are keyed by the entity URLs, so the records to
+	// remove are those of the current heads under the old name.
+	if err := s.ES.deleteBaseEntity(&mongodoc.BaseEntity{
+		URL:             oldBase,
+		ChannelEntities: renameChannelEntities(baseEntity.ChannelEntities, oldBase.Name),
+	}); err != nil {
+		return errgo.Notef(err, "cannot remove search records for %s", oldBase)
+	}
+	if err := s.UpdateSearchBaseURL(newBase); err != nil {
+		return errgo.Notef(err, "cannot update search records for %s", newBase)
+	}
+	if err := s.DB.BaseEntities().UpdateId(newBase, bson.D{{"$unset", bson.D{{"renamedfrom", ""}}}}); err != nil {
+		return errgo.Notef(err, "cannot complete rename of %s", oldBase)
+	}
+	return nil
+}
+
+// checkRenameURLs checks that a charm can be renamed from oldBase to
+// newBase.
+func checkRenameURLs(oldBase, newBase *charm.URL) error {
+	for _, u := range []*charm.URL{oldBase, newBase} {
+		if u.Series != "" || u.Revision != -1 {
+			return errgo.WithCausef(nil, params.ErrBadRequest, "%q is not a base URL", u)
+		}
+		if u.User == "" {
+			return errgo.WithCausef(nil, params.ErrBadRequest, "%q has no user", u)
+		}
+	}
+	if oldBase.User != newBase.User {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "cannot rename %s to %s: user differs", oldBase, newBase)
+	}
+	if oldBase.Name == newBase.Name {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "cannot rename %s to the same name", oldBase)
+	}
+	return nil
+}
+
+// renameDocURL replaces the URL held in the given field of the entity
+// document doc with one with the given name, returning the old URL.
+// If the field is not set, it returns nil.
+func renameDocURL(doc bson.M, field, name string) (*charm.URL, error) {
+	s, ok := doc[field].(string)
+	if !ok {
+		return nil, nil
+	}
+	u, err := charm.ParseURL(s)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot parse %s", field)
+	}
+	doc[field] = renameURL(u, name)
+	return u, nil
+}
+
+// renameURL returns a copy of u with the given name.
+func renameURL(u *charm.URL, name string) *charm.URL {
+	u1 := *u
+	u1.Name = name
+	return &u1
+}
+
+// renameChannelEntities returns a copy of the given channel entities
+// with each URL given the given name.
+func renameChannelEntities(channelEntities map[params.Channel]map[string]*charm.URL, name string) map[params.Channel]map[string]*charm.URL {
+	result := make(map[params.Channel]map[string]*charm.URL, len(channelEntities))
+	for ch, heads := range channelEntities {
+		result[ch] = make(map[string]*charm.URL, len(heads))
+		for series, id := range heads {
+			result[ch][series] = renameURL(id, name)
+		}
+	}
+	return result
+}
+
+// copyRenamedRevisions copies the revision counters and revision
+// base of oldBase to newBase. It never lowers a counter, so it can be
+// called more than once.
+func (s *Store) copyRenamedRevisions(oldBase, newBase *charm.URL) error {
+	var base mongodoc.RevisionBase
+	err := s.DB.RevisionBases().FindId(oldBase).One(&base)
+	if err != nil && err != mgo.ErrNotFound {
+		return errgo.Notef(err, "cannot get revision base")
+	}
+	if err == nil {
+		if _, err := s.DB.RevisionBases().UpsertId(newBase, bson.D{{"$max", bson.D{{"base", base.Base}}}}); err != nil {
+			return errgo.Notef(err, "cannot insert revision base for %s", newBase)
+		}
+	}
+	var docs []mongodoc.LatestRevision
+	if err := s.DB.Revisions().Find(bson.D{{"baseurl", oldBase}}).All(&docs); err != nil {
+		return errgo.Notef(err, "cannot find revisions for %s", oldBase)
+	}
+	for _, doc := range docs {
+		if err := s.addRevision(renameURL(doc.URL, newBase.Name).WithRevision(doc.Revision)); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	return nil
+}
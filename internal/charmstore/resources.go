@@ -105,6 +105,143 @@ func (s *Store) ListResources(id *router.ResolvedURL, channel params.Channel) ([
 	return docs, nil
 }
 
+// ListResourcesPage returns a page of the resources that ListResources
+// would return for the entity with the given id in the given channel,
+// ordered by name, including placeholders for declared resources that
+// have no revision in the channel.
+//
+// Only resources with names after the given one are returned. If limit
+// is positive, at most limit resources are returned and, if there are
+// more, the returned token is non-empty and can be passed as after to
+// retrieve the next page.
+func (s *Store) ListResourcesPage(id *router.ResolvedURL, channel params.Channel, after string, limit int) ([]*mongodoc.Resource, string, error) {
+	if channel == params.NoChannel {
+		return nil, "", errgo.Newf("no channel specified")
+	}
+	if id.URL.Series == "bundle" {
+		return nil, "", nil
+	}
+	entity, err := s.FindEntity(id, FieldSelector("charmmeta", "baseurl"))
+	if err != nil {
+		return nil, "", errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	if entity.CharmMeta == nil {
+		return nil, "", errgo.Newf("entity missing charm metadata")
+	}
+	names := make([]string, 0, len(entity.CharmMeta.Resources))
+	for name := range entity.CharmMeta.Resources {
+		if name > after {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	next := ""
+	if limit > 0 && len(names) > limit {
+		names = names[:limit]
+		next = names[limit-1]
+	}
+	if len(names) == 0 {
+		return nil, "", nil
+	}
+	var revisions map[string]int
+	if channel == params.UnpublishedChannel {
+		revisions, err = s.latestResourceRevisions(entity.BaseURL, names)
+		if err != nil {
+			return nil, "", errgo.Mask(err)
+		}
+	} else {
+		baseEntity, err := s.FindBaseEntity(entity.BaseURL, FieldSelector("channelresources"))
+		if err != nil {
+			return nil, "", errgo.Mask(err)
+		}
+		revisions = mapRevisions(baseEntity.ChannelResources[channel])
+	}
+	found := make(map[string]*mongodoc.Resource)
+	var or []bson.D
+	for _, name := range names {
+		if rev, ok := revisions[name]; ok {
+			or = append(or, bson.D{{"name", name}, {"revision", rev}})
+		}
+	}
+	if len(or) > 0 {
+		var docs []*mongodoc.Resource
+		if err := s.DB.Resources().Find(bson.D{
+			{"baseurl", entity.BaseURL},
+			{"$or", or},
+		}).All(&docs); err != nil {
+			return nil, "", errgo.Notef(err, "cannot list resources for %s", entity.BaseURL)
+		}
+		for _, doc := range docs {
+			found[doc.Name] = doc
+		}
+	}
+	docs := make([]*mongodoc.Resource, len(names))
+	for i, name := range names {
+		revision, ok := revisions[name]
+		if !ok {
+			// Create a placeholder for the missing resource.
+			docs[i] = &mongodoc.Resource{
+				BaseURL:  entity.BaseURL,
+				Name:     name,
+				Revision: -1,
+			}
+			continue
+		}
+		if docs[i] = found[name]; docs[i] == nil {
+			return nil, "", errgo.Newf("published resource %q not found", fmt.Sprintf("%s/%d", name, revision))
+		}
+	}
+	return docs, next, nil
+}
+
+// latestResourceRevisions returns the latest revision of each of the
+// named resources uploaded for the charm with the given base URL.
+// Resources with no revisions are omitted.
+func (s *Store) latestResourceRevisions(baseURL *charm.URL, names []string) (map[string]int, error) {
+	var results []struct {
+		Name     string `bson:"_id"`
+		Revision int
+	}
+	if err := s.DB.Resources().Pipe([]bson.D{{
+		{"$match", bson.D{
+			{"baseurl", baseURL},
+			{"name", bson.D{{"$in", names}}},
+		}},
+	}, {
+		{"$group", bson.D{
+			{"_id", "$name"},
+			{"revision", bson.D{{"$max", "$revision"}}},
+		}},
+	}}).All(&results); err != nil {
+		return nil, errgo.Notef(err, "cannot list resources for %s", baseURL)
+	}
+	revisions := make(map[string]int, len(results))
+	for _, r := range results {
+		revisions[r.Name] = r.Revision
+	}
+	return revisions, nil
+}
+
+// MissingResourcesForChannel returns the names of the resources
+// declared by the charm with the given id that have no revision
+// assigned in the given channel, in alphabetical order. For the
+// unpublished channel, a resource is missing if no revision of it has
+// been uploaded.
+func (s *Store) MissingResourcesForChannel(id *router.ResolvedURL, channel params.Channel) ([]string, error) {
+	docs, err := s.ListResources(id, channel)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	missing := []string{}
+	for _, doc := range docs {
+		if doc.Revision == -1 {
+			missing = append(missing, doc.Name)
+		}
+	}
+	// ListResources returns the resources sorted by name.
+	return missing, nil
+}
+
 // charmResources returns all of the currently stored resources for a charm.
 func (s *Store) charmResources(baseURL *charm.URL) (map[string]map[int]*mongodoc.Resource, map[string]int, error) {
 	resources := make(map[string]map[int]*mongodoc.Resource)
@@ -205,6 +342,43 @@ func (s *Store) DeleteResource(id *router.ResolvedURL, rev mongodoc.ResourceRevi
 	return nil
 }
 
+// CanAddResource checks whether a resource with the given name may be
+// added to the entity with the given id, without uploading anything. It
+// returns an error with a params.ErrNotFound cause if the entity does
+// not exist and one with a params.ErrForbidden cause if the entity is a
+// bundle or its metadata does not declare a suitable resource of that
+// name.
+//
+// Note that the store has no knowledge of the caller, so checking that
+// the caller has write access to the entity is the responsibility of
+// the API layer.
+func (s *Store) CanAddResource(url *router.ResolvedURL, name string) error {
+	if url.URL.Series == "bundle" {
+		return errgo.WithCausef(nil, params.ErrForbidden, "cannot upload a resource to a bundle")
+	}
+	entity, err := s.FindEntity(url, FieldSelector("charmmeta"))
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	if entity.CharmMeta == nil {
+		return errgo.WithCausef(nil, params.ErrForbidden, "cannot upload a resource to a bundle")
+	}
+	r, ok := entity.CharmMeta.Resources[name]
+	if !ok {
+		return errgo.WithCausef(nil, params.ErrForbidden, "resource %q not found in charm metadata", name)
+	}
+	if IsKubernetesCharm(entity.CharmMeta) {
+		if r.Type != resource.TypeContainerImage {
+			return errgo.WithCausef(nil, params.ErrForbidden, "resource %q is not a docker resource", name)
+		}
+		return nil
+	}
+	if r.Type != resource.TypeFile {
+		return errgo.WithCausef(nil, params.ErrForbidden, "non-file resource types not supported")
+	}
+	return nil
+}
+
 // UploadResource add blob to the blob store and adds a new resource with
 // the given name to the entity with the given id. If revision is -1, the revision of the new resource
 // will be calculated to be one higher than any existing resources.
@@ -395,6 +569,43 @@ func (s *Store) ResolveResource(url *router.ResolvedURL, name string, revision i
 	return &r, nil
 }
 
+// ResourceRef identifies a single revision of a charm resource.
+type ResourceRef struct {
+	// BaseURL holds the base URL of the charm that owns the resource.
+	BaseURL *charm.URL
+
+	// Name holds the name of the resource.
+	Name string
+
+	// Revision holds the revision of the resource.
+	Revision int
+}
+
+// FindResourcesByHash returns references to all the resource
+// revisions whose blob has the given hash, as created by
+// blobstore.NewHash. The returned references are sorted by base URL,
+// then by name and finally by revision.
+func (s *Store) FindResourcesByHash(hash string) ([]ResourceRef, error) {
+	var docs []*mongodoc.Resource
+	if err := s.DB.Resources().Find(bson.D{{"blobhash", hash}}).Select(bson.D{
+		{"baseurl", 1},
+		{"name", 1},
+		{"revision", 1},
+	}).All(&docs); err != nil {
+		return nil, errgo.Notef(err, "cannot find resources")
+	}
+	sortResources(docs)
+	refs := make([]ResourceRef, len(docs))
+	for i, doc := range docs {
+		refs[i] = ResourceRef{
+			BaseURL:  doc.BaseURL,
+			Name:     doc.Name,
+			Revision: doc.Revision,
+		}
+	}
+	return refs, nil
+}
+
 func IsKubernetesCharm(meta *charm.Meta) bool {
 	return meta != nil && len(meta.Series) == 1 && meta.Series[0] == "kubernetes"
 }
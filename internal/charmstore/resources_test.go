@@ -16,6 +16,7 @@ import (
 	gc "gopkg.in/check.v1"
 	"gopkg.in/errgo.v1"
 	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 
 	"gopkg.in/juju/charmstore.v5/internal/blobstore"
 	"gopkg.in/juju/charmstore.v5/internal/charm"
@@ -249,6 +250,168 @@ func (s *resourceSuite) TestListResourcesCharmWithDockerResourcesUnpublished(c *
 	checkResourceDocs(c, store, id, []string{"resource1/0", "resource2/0"}, docs)
 }
 
+func (s *resourceSuite) TestListResourcesPage(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	id := MustParseResolvedURL("cs:~charmers/precise/wordpress-3")
+	names := []string{"resource5", "resource3", "resource1", "resource4", "resource2"}
+	meta := storetesting.MetaWithResources(nil, names...)
+	err := store.AddCharmWithArchive(id, storetesting.NewCharm(meta))
+	c.Assert(err, gc.Equals, nil)
+	for i := 0; i < 3; i++ {
+		uploadResources(c, store, id, fmt.Sprint(i))
+	}
+	err = store.Publish(id, map[string]int{
+		"resource1": 0,
+		"resource2": 1,
+		"resource3": 2,
+		"resource4": 0,
+		"resource5": 1,
+	}, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+
+	// Page through the unpublished channel, which holds the
+	// latest revision of each resource.
+	var all []*mongodoc.Resource
+	after := ""
+	for {
+		docs, next, err := store.ListResourcesPage(id, params.UnpublishedChannel, after, 2)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(len(docs) <= 2, gc.Equals, true)
+		all = append(all, docs...)
+		if next == "" {
+			break
+		}
+		c.Assert(next, gc.Equals, docs[len(docs)-1].Name)
+		after = next
+	}
+	checkResourceDocs(c, store, id, []string{"resource1/2", "resource2/2", "resource3/2", "resource4/2", "resource5/2"}, all)
+
+	// Page through the stable channel, which holds the
+	// published revisions.
+	docs, next, err := store.ListResourcesPage(id, params.StableChannel, "", 3)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(next, gc.Equals, "resource3")
+	checkResourceDocs(c, store, id, []string{"resource1/0", "resource2/1", "resource3/2"}, docs)
+	docs, next, err = store.ListResourcesPage(id, params.StableChannel, next, 3)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(next, gc.Equals, "")
+	checkResourceDocs(c, store, id, []string{"resource4/0", "resource5/1"}, docs)
+
+	// With no limit, all the resources are returned.
+	docs, next, err = store.ListResourcesPage(id, params.StableChannel, "resource2", 0)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(next, gc.Equals, "")
+	checkResourceDocs(c, store, id, []string{"resource3/2", "resource4/0", "resource5/1"}, docs)
+
+	// Placeholders are returned for the resources in a channel
+	// that the charm has not been published to, as with
+	// ListResources.
+	docs, next, err = store.ListResourcesPage(id, params.EdgeChannel, "", 2)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(next, gc.Equals, "resource2")
+	checkResourceDocs(c, store, id, []string{"resource1/-1", "resource2/-1"}, docs)
+
+	// A single page holding all the resources is the same as the
+	// unpaged listing.
+	for _, ch := range []params.Channel{params.UnpublishedChannel, params.StableChannel, params.EdgeChannel} {
+		docs, next, err := store.ListResourcesPage(id, ch, "", 0)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(next, gc.Equals, "")
+		expect, err := store.ListResources(id, ch)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(docs, jc.DeepEquals, expect)
+	}
+}
+
+func (s *resourceSuite) TestListResourcesPageNotFound(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	_, _, err := store.ListResourcesPage(MustParseResolvedURL("cs:~charmers/precise/wordpress-1"), params.StableChannel, "", 2)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *resourceSuite) TestMissingResourcesForChannel(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	id := MustParseResolvedURL("cs:~charmers/precise/wordpress-3")
+	meta := storetesting.MetaWithResources(nil, "resource1", "resource2", "resource3")
+	err := store.AddCharmWithArchive(id, storetesting.NewCharm(meta))
+	c.Assert(err, gc.Equals, nil)
+
+	// No resources have been uploaded.
+	missing, err := store.MissingResourcesForChannel(id, params.UnpublishedChannel)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(missing, jc.DeepEquals, []string{"resource1", "resource2", "resource3"})
+
+	uploadResources(c, store, id, "")
+	missing, err = store.MissingResourcesForChannel(id, params.UnpublishedChannel)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(missing, jc.DeepEquals, []string{})
+
+	err = store.Publish(id, map[string]int{
+		"resource1": 0,
+		"resource2": 0,
+		"resource3": 0,
+	}, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	missing, err = store.MissingResourcesForChannel(id, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(missing, jc.DeepEquals, []string{})
+
+	// Nothing is assigned in a channel that the charm
+	// has not been published to.
+	missing, err = store.MissingResourcesForChannel(id, params.EdgeChannel)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(missing, jc.DeepEquals, []string{"resource1", "resource2", "resource3"})
+
+	// Simulate a charm that was published before all its
+	// resources were required.
+	err = store.DB.BaseEntities().UpdateId(mongodoc.BaseURL(&id.URL), bson.D{{
+		"$set", bson.D{{
+			"channelresources.stable", []mongodoc.ResourceRevision{{
+				Name:     "resource2",
+				Revision: 0,
+			}},
+		}},
+	}})
+	c.Assert(err, gc.Equals, nil)
+	missing, err = store.MissingResourcesForChannel(id, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(missing, jc.DeepEquals, []string{"resource1", "resource3"})
+}
+
+func (s *resourceSuite) TestMissingResourcesForChannelNotFound(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	_, err := store.MissingResourcesForChannel(MustParseResolvedURL("cs:~charmers/precise/wordpress-3"), params.StableChannel)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *resourceSuite) TestCanAddResource(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	id := MustParseResolvedURL("cs:~charmers/precise/wordpress-3")
+	meta := storetesting.MetaWithResources(nil, "someResource")
+	err := store.AddCharmWithArchive(id, storetesting.NewCharm(meta))
+	c.Assert(err, gc.Equals, nil)
+
+	err = store.CanAddResource(id, "someResource")
+	c.Assert(err, gc.Equals, nil)
+
+	err = store.CanAddResource(id, "otherResource")
+	c.Assert(err, gc.ErrorMatches, `resource "otherResource" not found in charm metadata`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrForbidden)
+
+	err = store.CanAddResource(MustParseResolvedURL("cs:~charmers/precise/wordpress-4"), "someResource")
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
 func (s *resourceSuite) TestUploadResource(c *gc.C) {
 	store := s.newStore(c, false)
 	defer store.Close()
@@ -597,6 +760,89 @@ func (s *resourceSuite) TestPublishWithoutAllRequiredResources(c *gc.C) {
 	c.Assert(errgo.Cause(err), gc.Equals, ErrPublishResourceMismatch)
 }
 
+func (s *resourceSuite) TestPublishInheritsChannelResources(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	id0 := MustParseResolvedURL("cs:~charmers/precise/wordpress-0")
+	meta := storetesting.MetaWithResources(nil, "resource1", "resource2")
+	err := store.AddCharmWithArchive(id0, storetesting.NewCharm(meta))
+	c.Assert(err, gc.Equals, nil)
+	uploadResource(c, store, id0, "resource1", "content1")
+	uploadResource(c, store, id0, "resource2", "content2")
+	err = store.Publish(id0, map[string]int{
+		"resource1": 0,
+		"resource2": 0,
+	}, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+
+	id1 := MustParseResolvedURL("cs:~charmers/precise/wordpress-1")
+	err = store.AddCharmWithArchive(id1, storetesting.NewCharm(meta))
+	c.Assert(err, gc.Equals, nil)
+	uploadResource(c, store, id1, "resource1", "content1.1")
+
+	// Only resource1 is pinned; resource2 keeps the revision
+	// already published in the stable channel.
+	err = store.Publish(id1, map[string]int{
+		"resource1": 1,
+	}, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	docs, err := store.ListResources(id1, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(resourceRevisions(docs), jc.DeepEquals, map[string]int{
+		"resource1": 1,
+		"resource2": 0,
+	})
+
+	// There is nothing to inherit from the edge channel.
+	err = store.Publish(id1, map[string]int{
+		"resource1": 1,
+	}, params.EdgeChannel)
+	c.Assert(err, gc.ErrorMatches, `resources are missing from publish request: resource2`)
+	c.Assert(errgo.Cause(err), gc.Equals, ErrPublishResourceMismatch)
+}
+
+func (s *resourceSuite) TestPublishRequiringResources(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	id0 := MustParseResolvedURL("cs:~charmers/precise/wordpress-0")
+	meta := storetesting.MetaWithResources(nil, "resource1", "resource2")
+	err := store.AddCharmWithArchive(id0, storetesting.NewCharm(meta))
+	c.Assert(err, gc.Equals, nil)
+	uploadResource(c, store, id0, "resource1", "content1")
+	uploadResource(c, store, id0, "resource2", "content2")
+	err = store.Publish(id0, map[string]int{
+		"resource1": 0,
+		"resource2": 0,
+	}, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+
+	id1 := MustParseResolvedURL("cs:~charmers/precise/wordpress-1")
+	err = store.AddCharmWithArchive(id1, storetesting.NewCharm(meta))
+	c.Assert(err, gc.Equals, nil)
+
+	// Without pinning resource2 the publish fails even though
+	// the stable channel already has a revision for it.
+	err = store.PublishRequiringResources(id1, map[string]int{
+		"resource1": 0,
+	}, params.StableChannel)
+	c.Assert(err, gc.ErrorMatches, `resources are missing from publish request: resource2`)
+	c.Assert(errgo.Cause(err), gc.Equals, ErrPublishResourceMismatch)
+
+	err = store.PublishRequiringResources(id1, map[string]int{
+		"resource1": 0,
+		"resource2": 0,
+	}, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	docs, err := store.ListResources(id1, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(resourceRevisions(docs), jc.DeepEquals, map[string]int{
+		"resource1": 0,
+		"resource2": 0,
+	})
+}
+
 func (s *resourceSuite) TestOpenResourceBlob(c *gc.C) {
 	store := s.newStore(c, false)
 	defer store.Close()
@@ -628,6 +874,41 @@ func (s *resourceSuite) TestOpenResourceBlob(c *gc.C) {
 	c.Assert(err, gc.ErrorMatches, `cannot open archive data for cs:~charmers/wordpress resource "someResource/0": blob not found`)
 }
 
+func (s *resourceSuite) TestFindResourcesByHash(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	meta := storetesting.MetaWithResources(nil, "someResource", "otherResource")
+	id1 := MustParseResolvedURL("cs:~charmers/precise/wordpress-3")
+	err := store.AddCharmWithArchive(id1, storetesting.NewCharm(meta))
+	c.Assert(err, gc.Equals, nil)
+	id2 := MustParseResolvedURL("cs:~bob/trusty/mysql-0")
+	err = store.AddCharmWithArchive(id2, storetesting.NewCharm(meta))
+	c.Assert(err, gc.Equals, nil)
+
+	shared := "shared content"
+	uploadResource(c, store, id1, "someResource", "other content")
+	uploadResource(c, store, id1, "someResource", shared)
+	uploadResource(c, store, id2, "otherResource", shared)
+	uploadResource(c, store, id2, "someResource", "more content")
+
+	refs, err := store.FindResourcesByHash(hashOfString(shared))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(refs, jc.DeepEquals, []ResourceRef{{
+		BaseURL:  charm.MustParseURL("cs:~bob/mysql"),
+		Name:     "otherResource",
+		Revision: 0,
+	}, {
+		BaseURL:  charm.MustParseURL("cs:~charmers/wordpress"),
+		Name:     "someResource",
+		Revision: 1,
+	}})
+
+	refs, err = store.FindResourcesByHash(hashOfString("no such content"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(refs, gc.HasLen, 0)
+}
+
 func (s *resourceSuite) TestAddDockerResource(c *gc.C) {
 	store := s.newStore(c, false)
 	defer store.Close()
@@ -0,0 +1,105 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5/internal/charmstore"
+
+import (
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2"
+)
+
+// maxMongoRetryAttempts holds the maximum allowed value of
+// ServerParams.MongoRetryAttempts.
+const maxMongoRetryAttempts = 10
+
+// mongoRetryDelay holds the time that a read waits before its first
+// retry after a transient mongo error. The delay doubles after each
+// further failure, up to maxMongoRetryDelay.
+var mongoRetryDelay = 50 * time.Millisecond
+
+// maxMongoRetryDelay holds the maximum time that a read waits between
+// retries.
+const maxMongoRetryDelay = 2 * time.Second
+
+var testMongoReadError func(op string) error
+
+// transientMongoCodes holds the mongo error codes that indicate that
+// a failed operation may succeed if tried again, typically because
+// the replica set is electing a new primary.
+var transientMongoCodes = map[int]bool{
+	6:     true, // HostUnreachable
+	7:     true, // HostNotFound
+	89:    true, // NetworkTimeout
+	91:    true, // ShutdownInProgress
+	189:   true, // PrimarySteppedDown
+	10107: true, // NotMaster
+	11600: true, // InterruptedAtShutdown
+	11602: true, // InterruptedDueToReplStateChange
+	13435: true, // NotMasterNoSlaveOk
+	13436: true, // NotMasterOrSecondary
+}
+
+// isTransientMongoError reports whether err, or any error it wraps,
+// is a mongo error that a retry may avoid.
+func isTransientMongoError(err error) bool {
+	for err != nil {
+		switch err1 := err.(type) {
+		case *mgo.QueryError:
+			return transientMongoCodes[err1.Code]
+		case *mgo.LastError:
+			return transientMongoCodes[err1.Code]
+		case net.Error:
+			return true
+		}
+		if err == io.EOF {
+			return true
+		}
+		if msg := err.Error(); msg == "no reachable servers" || strings.HasPrefix(msg, "not master") {
+			return true
+		}
+		u, ok := err.(interface {
+			Underlying() error
+		})
+		if !ok {
+			return false
+		}
+		err = u.Underlying()
+	}
+	return false
+}
+
+// retryRead calls f, which should perform the read operation with the
+// given name, retrying up to ServerParams.MongoRetryAttempts times if
+// it fails with a transient mongo error. The session is refreshed
+// before each retry so that a new connection, possibly to a new
+// primary, is used. The error from the last attempt is returned
+// unchanged.
+//
+// Only idempotent reads should be retried in this way, as a write may
+// have been applied even though an error was returned.
+func (s *Store) retryRead(op string, f func() error) error {
+	delay := mongoRetryDelay
+	for i := 0; ; i++ {
+		var err error
+		if testMongoReadError != nil {
+			err = testMongoReadError(op)
+		}
+		if err == nil {
+			err = f()
+		}
+		if err == nil || i >= s.pool.config.MongoRetryAttempts || !isTransientMongoError(err) {
+			return err
+		}
+		logger.Infof("retrying %s after transient mongo error: %v", op, err)
+		time.Sleep(delay)
+		delay *= 2
+		if delay > maxMongoRetryDelay {
+			delay = maxMongoRetryDelay
+		}
+		s.DB.Session.Refresh()
+	}
+}
@@ -8,12 +8,15 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"math"
 	"reflect"
 	"strings"
 	"time"
 
 	"github.com/juju/charmrepo/v6/csclient/params"
 	"github.com/juju/utils"
+	jujuversion "github.com/juju/version"
+	"golang.org/x/net/context"
 	"gopkg.in/errgo.v1"
 	"gopkg.in/mgo.v2/bson"
 
@@ -66,6 +69,67 @@ type SearchDoc struct {
 	// be a bundle, a single-series charm or the canonical record for
 	// a multi-series charm.
 	AllSeries bool
+
+	// MinJujuVersion holds the minimum Juju version declared by a
+	// charm, encoded with jujuVersionOrdinal so that it can be
+	// compared in range filters. It is zero when the charm does not
+	// declare a minimum version.
+	MinJujuVersion int64
+
+	// AssumesFeatureNames holds the name of each feature referred
+	// to by the assumes block of a charm.
+	AssumesFeatureNames []string
+
+	// AssumesFeatureVersions holds a term for each version
+	// constraint in the assumes block of a charm, encoded with
+	// assumesVersionKey so that it can be compared in range
+	// filters.
+	AssumesFeatureVersions []string
+
+	// Promulgated is true if the document refers to a promulgated
+	// entity.
+	Promulgated bool
+
+	// Suggest holds the input to the completion suggester used by
+	// SearchSuggest.
+	Suggest *SearchSuggestion `json:",omitempty"`
+}
+
+// SearchSuggestion holds the completion suggester input for a search
+// document.
+type SearchSuggestion struct {
+	// Input holds the words that will suggest the entity: its name
+	// and the words of its summary.
+	Input []string `json:"input"`
+
+	// Output holds the name that is suggested.
+	Output string `json:"output"`
+
+	// Weight holds the rank of the suggestion; entities with more
+	// downloads are suggested first.
+	Weight int64 `json:"weight"`
+}
+
+// maxSuggestWeight holds the largest weight allowed by the
+// elasticsearch completion suggester.
+const maxSuggestWeight = 1<<31 - 1
+
+// entitySuggestion returns the completion suggester input for the
+// given entity, which has been downloaded the given number of times.
+func entitySuggestion(e *mongodoc.Entity, downloads int64) *SearchSuggestion {
+	name := e.URL.Name
+	input := []string{name}
+	if e.CharmMeta != nil {
+		input = append(input, strings.Fields(e.CharmMeta.Summary)...)
+	}
+	if downloads > maxSuggestWeight {
+		downloads = maxSuggestWeight
+	}
+	return &SearchSuggestion{
+		Input:  input,
+		Output: name,
+		Weight: downloads,
+	}
 }
 
 // UpdateSearchAsync will update the search record for the entity
@@ -146,6 +210,48 @@ func (s *Store) UpdateSearchBaseURL(baseURL *charm.URL) error {
 	return nil
 }
 
+// DumpSearch calls f with the search document for every entity that is
+// the latest revision in the given channel of an indexed series. The
+// documents are built in the same way as those sent to elasticsearch by
+// UpdateSearch, except that the read ACLs are taken from the given
+// channel; elasticsearch does not need to be configured. The base
+// entities are streamed from the database, so the whole store is never
+// held in memory. If f returns an error, DumpSearch stops and returns
+// that error.
+func (s *Store) DumpSearch(channel params.Channel, f func(*SearchDoc) error) error {
+	iter := s.DB.BaseEntities().Find(bson.D{{
+		"channelentities." + string(channel), bson.D{{"$exists", true}},
+	}}).Sort("_id").Iter()
+	defer iter.Close()
+	var baseEntity mongodoc.BaseEntity
+	for iter.Next(&baseEntity) {
+		dumped := make(map[string]bool)
+		for urlSeries, url := range baseEntity.ChannelEntities[channel] {
+			if !series.Series[urlSeries].SearchIndex || dumped[url.String()] {
+				continue
+			}
+			dumped[url.String()] = true
+			entity, err := s.FindEntity(&router.ResolvedURL{URL: *url}, nil)
+			if err != nil {
+				return errgo.Notef(err, "cannot get search record for %q", url)
+			}
+			doc, err := s.searchDocFromEntity(entity, &baseEntity)
+			if err != nil {
+				return errgo.Notef(err, "cannot get search record for %q", url)
+			}
+			doc.ReadACLs = baseEntity.ChannelACLs[channel].Read
+			if err := f(doc); err != nil {
+				return errgo.Mask(err, errgo.Any)
+			}
+		}
+		baseEntity = mongodoc.BaseEntity{}
+	}
+	if err := iter.Close(); err != nil {
+		return errgo.Notef(err, "cannot iterate base entities")
+	}
+	return nil
+}
+
 func (s *Store) updateSearchEntity(entity *mongodoc.Entity, baseEntity *mongodoc.BaseEntity) error {
 	doc, err := s.searchDocFromEntity(entity, baseEntity)
 	if err != nil {
@@ -181,6 +287,12 @@ func (s *Store) searchDocFromEntity(e *mongodoc.Entity, be *mongodoc.BaseEntity)
 		return nil, errgo.Mask(err)
 	}
 	doc.TotalDownloads = allRevisions.Total
+	doc.Promulgated = doc.Entity.PromulgatedURL != nil
+	doc.Suggest = entitySuggestion(e, doc.TotalDownloads)
+	if e.CharmMeta != nil {
+		doc.MinJujuVersion = jujuVersionOrdinal(e.CharmMeta.MinJujuVersion)
+	}
+	doc.AssumesFeatureNames, doc.AssumesFeatureVersions = assumesSearchTerms(e.Assumes)
 	if doc.Entity.Series == "bundle" {
 		doc.Series = []string{"bundle"}
 	} else {
@@ -232,6 +344,34 @@ func (si *SearchIndex) update(doc *SearchDoc) error {
 	return nil
 }
 
+// deleteBaseEntity removes the search records for the entities
+// published to the stable channel of the given base entity, which must
+// hold its channel entities.
+func (si *SearchIndex) deleteBaseEntity(baseEntity *mongodoc.BaseEntity) error {
+	if si == nil || si.Database == nil {
+		return nil
+	}
+	deleted := make(map[string]bool)
+	for series, id := range baseEntity.ChannelEntities[params.StableChannel] {
+		// Multi-series charms have a record for the charm
+		// itself as well as one for each supported series.
+		seriesId := *id
+		seriesId.Series = series
+		for _, u := range []*charm.URL{id, &seriesId} {
+			docId := si.getID(u)
+			if deleted[docId] {
+				continue
+			}
+			deleted[docId] = true
+			err := si.DeleteDocument(si.Index, typeName, docId)
+			if err != nil && !elasticsearch.IsNotFoundError(errgo.Cause(err)) {
+				return errgo.Notef(err, "cannot delete search record for %s", u)
+			}
+		}
+	}
+	return nil
+}
+
 // getID returns an ID for the elasticsearch document based on the contents of the
 // mongoDB document. This is to allow elasticsearch documents to be replaced with
 // updated versions when charm data is changed.
@@ -370,27 +510,40 @@ func (si *SearchIndex) updateVersion(v version, dv int64) (bool, error) {
 // syncSearch populates the SearchIndex with all the data currently stored in
 // mongodb. If the SearchIndex is not configured then this method returns a nil error.
 func (s *Store) syncSearch() error {
-	if s.ES == nil || s.ES.Database == nil {
-		return nil
-	}
-	var result mongodoc.Entity
-	// Only get the IDs here, UpdateSearch will get the full document
-	// if it is in a series that is indexed.
-	iter := s.DB.Entities().Find(nil).Select(bson.M{"_id": 1, "promulgated-url": 1}).Iter()
-	defer iter.Close() // Make sure we always close on error.
-	for iter.Next(&result) {
-		rurl := EntityResolvedURL(&result)
-		if err := s.UpdateSearch(rurl); err != nil {
-			return errgo.Notef(err, "cannot index %s", rurl)
-		}
+	if err := s.ReindexAll(context.Background(), nil); err != nil {
+		return errgo.Mask(err)
 	}
 	logger.Infof("finished sync search")
-	if err := iter.Close(); err != nil {
-		return err
-	}
 	return nil
 }
 
+// SearchSuggest returns up to limit names of entities published to
+// the stable channel that have a name or summary word starting with
+// prefix, most downloaded first. Only entities readable by everyone or
+// by one of the given groups are considered. If the search index is not
+// configured then SearchSuggest returns no names.
+func (s *Store) SearchSuggest(prefix string, groups []string, limit int) ([]string, error) {
+	if s.ES == nil || s.ES.Database == nil {
+		return nil, nil
+	}
+	options, err := s.ES.Suggest(s.ES.Index, elasticsearch.CompletionSuggest{
+		Text:  prefix,
+		Field: "Suggest",
+		Size:  limit,
+		Context: map[string][]string{
+			"acl": append([]string{params.Everyone}, groups...),
+		},
+	})
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot get suggestions")
+	}
+	names := make([]string, len(options))
+	for i, o := range options {
+		names[i] = o.Text
+	}
+	return names, nil
+}
+
 // SearchParams represents the search parameters used to search the store.
 type SearchParams struct {
 	// The text to use in the full text search query.
@@ -673,16 +826,60 @@ func createFilters(sp SearchParams) elasticsearch.Filter {
 // function that will generate an elasticsearch query DSL filter for the
 // given value.
 var filters = map[string]func(string) elasticsearch.Filter{
-	"description": descriptionFilter,
-	"name":        nameFilter,
-	"owner":       ownerFilter,
-	"promulgated": promulgatedFilter,
-	"provides":    termFilter("CharmProvidedInterfaces"),
-	"requires":    termFilter("CharmRequiredInterfaces"),
-	"series":      seriesFilter,
-	"summary":     summaryFilter,
-	"tags":        tagsFilter,
-	"type":        typeFilter,
+	"assumes-feature":  assumesFeatureFilter,
+	"description":      descriptionFilter,
+	"max-juju-version": maxJujuVersionFilter,
+	"min-juju-version": minJujuVersionFilter,
+	"name":             nameFilter,
+	"owner":            ownerFilter,
+	"promulgated":      promulgatedFilter,
+	"provides":         termFilter("CharmProvidedInterfaces"),
+	"requires":         termFilter("CharmRequiredInterfaces"),
+	"series":           seriesFilter,
+	"source":           termFilter("Source"),
+	"summary":          summaryFilter,
+	"tags":             tagsFilter,
+	"terms":            termFilter("CharmMeta.Terms"),
+	"type":             typeFilter,
+}
+
+// assumesFeatureFilter generates a filter that will match charms
+// whose assumes block refers to the given feature expression. A
+// feature without a version, for example "k8s-api", matches any
+// reference to the feature. A feature with a version matches
+// constraints that are at least as strict: "juju>=2.9" matches charms
+// that assume Juju 2.9 or later, such as "juju>=3.0", and "juju<3.0"
+// matches charms that assume a Juju version before 3.0 or earlier.
+// Entities without an assumes block always match.
+func assumesFeatureFilter(value string) elasticsearch.Filter {
+	f := elasticsearch.OrFilter{
+		elasticsearch.NotFilter{elasticsearch.ExistsFilter("AssumesFeatureNames")},
+	}
+	e, err := parseAssumesExpr(value)
+	switch {
+	case err != nil:
+		return append(f, elasticsearch.TermFilter{
+			Field: "AssumesFeatureNames",
+			Value: value,
+		})
+	case e.Op == "":
+		return append(f, elasticsearch.TermFilter{
+			Field: "AssumesFeatureNames",
+			Value: e.Feature,
+		})
+	case e.Op == ">=":
+		return append(f, elasticsearch.RangeFilter{
+			Field: "AssumesFeatureVersions",
+			GTE:   assumesVersionKey(e.Feature, e.Op, assumesVersionOrdinal(e.Version)),
+			LTE:   assumesVersionKey(e.Feature, e.Op, math.MaxInt64),
+		})
+	default:
+		return append(f, elasticsearch.RangeFilter{
+			Field: "AssumesFeatureVersions",
+			GTE:   assumesVersionKey(e.Feature, e.Op, 0),
+			LTE:   assumesVersionKey(e.Feature, e.Op, assumesVersionOrdinal(e.Version)),
+		})
+	}
 }
 
 // descriptionFilter generates a filter that will match against the
@@ -697,6 +894,55 @@ func descriptionFilter(value string) elasticsearch.Filter {
 	}
 }
 
+// maxJujuVersionFilter generates a filter that will match charms that
+// can be deployed by the given version of Juju. Entities that do not
+// declare a minimum Juju version are indexed with a MinJujuVersion of
+// zero, so they always match.
+func maxJujuVersionFilter(value string) elasticsearch.Filter {
+	v, _ := jujuversion.Parse(value)
+	return elasticsearch.RangeFilter{
+		Field: "MinJujuVersion",
+		LTE:   jujuVersionOrdinal(v),
+	}
+}
+
+// minJujuVersionFilter generates a filter that will match charms that
+// declare a minimum Juju version of at least the given version.
+func minJujuVersionFilter(value string) elasticsearch.Filter {
+	v, _ := jujuversion.Parse(value)
+	return elasticsearch.RangeFilter{
+		Field: "MinJujuVersion",
+		GTE:   jujuVersionOrdinal(v),
+	}
+}
+
+// jujuPreReleaseTags holds the rank of the well-known pre-release
+// tags. Other tags sort before all of them.
+var jujuPreReleaseTags = map[string]int64{
+	"alpha": 1,
+	"beta":  2,
+	"rc":    3,
+}
+
+// jujuVersionOrdinal encodes v as a single number that sorts in the
+// same order as the versions themselves. Pre-release versions (those
+// with a tag, such as 2.0-beta1) sort before the corresponding release,
+// ordered by tag (alpha, beta, then rc) and then by tag number, which
+// the version holds in its Patch field. The zero version is encoded
+// as zero.
+func jujuVersionOrdinal(v jujuversion.Number) int64 {
+	if v == jujuversion.Zero {
+		return 0
+	}
+	release := int64(1)
+	patch := int64(v.Patch)
+	if v.Tag != "" {
+		release = 0
+		patch = jujuPreReleaseTags[v.Tag]*10000 + int64(v.Patch)
+	}
+	return (((int64(v.Major)*1000+int64(v.Minor))*2+release)*100000+patch)*1000 + int64(v.Build)
+}
+
 // nameFilter generates a filter that will match against the
 // name of the charm or bundle.
 func nameFilter(value string) elasticsearch.Filter {
@@ -725,13 +971,16 @@ func ownerFilter(value string) elasticsearch.Filter {
 }
 
 // promulgatedFilter generates a filter that will match against the
-// existence of a promulgated URL.
+// promulgated status of the entity.
 func promulgatedFilter(value string) elasticsearch.Filter {
-	f := elasticsearch.ExistsFilter("PromulgatedURL")
+	promulgated := "false"
 	if value == "1" {
-		return f
+		promulgated = "true"
+	}
+	return elasticsearch.TermFilter{
+		Field: "Promulgated",
+		Value: promulgated,
 	}
-	return elasticsearch.NotFilter{f}
 }
 
 // seriesFilter generates a filter that will match against the
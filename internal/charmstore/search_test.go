@@ -4,14 +4,20 @@
 package charmstore
 
 import (
+	"bytes"
 	"encoding/json"
 	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/juju/charmrepo/v6/csclient/params"
 	jc "github.com/juju/testing/checkers"
+	jujuversion "github.com/juju/version"
+	"golang.org/x/net/context"
 	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2/bson"
 
 	"gopkg.in/juju/charmstore.v5/internal/charm"
 	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
@@ -94,11 +100,116 @@ func (s *StoreSearchSuite) TestSuccessfulExport(c *gc.C) {
 			AllSeries:      true,
 			SingleSeries:   ent.URL.Series != "",
 			TotalDownloads: int64(ent.Downloads),
+			Promulgated:    entity.PromulgatedURL != nil,
+			Suggest:        entitySuggestion(entity, int64(ent.Downloads)),
 		}
 		c.Assert(string(actual), jc.JSONEquals, doc)
 	}
 }
 
+func (s *StoreSearchSuite) TestReindexAllProgress(c *gc.C) {
+	total, err := s.store.DB.Entities().Count()
+	c.Assert(err, gc.Equals, nil)
+	var calls [][2]int
+	err = s.store.ReindexAll(context.Background(), func(done, total int) {
+		calls = append(calls, [2]int{done, total})
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(calls, gc.HasLen, total+1)
+	for i, call := range calls {
+		c.Assert(call, gc.Equals, [2]int{i, total})
+	}
+}
+
+func (s *StoreSearchSuite) TestReindexAllCancelled(c *gc.C) {
+	total, err := s.store.DB.Entities().Count()
+	c.Assert(err, gc.Equals, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	var calls [][2]int
+	err = s.store.ReindexAll(ctx, func(done, total int) {
+		calls = append(calls, [2]int{done, total})
+		if done == 1 {
+			cancel()
+		}
+	})
+	c.Assert(err, gc.ErrorMatches, "reindex stopped: context canceled")
+	c.Assert(errgo.Cause(err), gc.Equals, context.Canceled)
+	c.Assert(calls, jc.DeepEquals, [][2]int{{0, total}, {1, total}})
+}
+
+func (s *StoreSearchSuite) TestStartReindex(c *gc.C) {
+	total, err := s.store.DB.Entities().Count()
+	c.Assert(err, gc.Equals, nil)
+	id, err := s.pool.StartReindex()
+	c.Assert(err, gc.Equals, nil)
+	var status ReindexStatus
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status, err = s.pool.ReindexStatus(id)
+		c.Assert(err, gc.Equals, nil)
+		if status.Finished || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(status, jc.DeepEquals, ReindexStatus{
+		JobId:    id,
+		Done:     total,
+		Total:    total,
+		Finished: true,
+	})
+	// Cancelling a finished job has no effect.
+	err = s.pool.CancelReindex(id)
+	c.Assert(err, gc.Equals, nil)
+}
+
+func (s *StoreSearchSuite) TestReindexJobNotFound(c *gc.C) {
+	_, err := s.pool.ReindexStatus("no-such-job")
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	err = s.pool.CancelReindex("no-such-job")
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *StoreSearchSuite) TestStartReindexWhileRunning(c *gc.C) {
+	// A job running on another server prevents a new one from
+	// starting.
+	err := s.store.DB.ReindexJobs().Insert(&mongodoc.ReindexJob{
+		Id:         "other-job",
+		Running:    true,
+		UpdateTime: time.Now().UTC(),
+	})
+	c.Assert(err, gc.Equals, nil)
+	_, err = s.pool.StartReindex()
+	c.Assert(err, gc.ErrorMatches, "reindex job other-job is already running")
+	c.Assert(errgo.Cause(err), gc.Equals, router.ErrConflict)
+
+	// Cancelling the job records the request for the other server.
+	err = s.pool.CancelReindex("other-job")
+	c.Assert(err, gc.Equals, nil)
+	var job mongodoc.ReindexJob
+	err = s.store.DB.ReindexJobs().FindId("other-job").One(&job)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(job.CancelRequested, gc.Equals, true)
+
+	// Once the job has not made progress for a long time, it is
+	// assumed to have been abandoned.
+	err = s.store.DB.ReindexJobs().UpdateId("other-job", bson.D{{"$set", bson.D{
+		{"updatetime", time.Now().Add(-reindexJobStaleTime - time.Minute).UTC()},
+	}}})
+	c.Assert(err, gc.Equals, nil)
+	id, err := s.pool.StartReindex()
+	c.Assert(err, gc.Equals, nil)
+	status, err := s.pool.ReindexStatus("other-job")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(status, jc.DeepEquals, ReindexStatus{
+		JobId:    "other-job",
+		Finished: true,
+		Error:    "reindex job abandoned",
+	})
+	err = s.pool.CancelReindex(id)
+	c.Assert(err, gc.Equals, nil)
+}
+
 func (s *StoreSearchSuite) TestNoExportDeprecated(c *gc.C) {
 	charmArchive := storetesting.NewCharm(nil)
 	url := router.MustNewResolvedURL("cs:~charmers/saucy/mysql-4", -1)
@@ -149,6 +260,7 @@ func (s *StoreSearchSuite) TestExportOnlyLatest(c *gc.C) {
 		Series:       expected.SupportedSeries,
 		SingleSeries: true,
 		AllSeries:    true,
+		Suggest:      entitySuggestion(expected, 0),
 	}
 	c.Assert(string(actual), jc.JSONEquals, doc)
 }
@@ -188,6 +300,7 @@ func (s *StoreSearchSuite) TestExportMultiSeriesCharmsCreateExpandedVersions(c *
 		Series:       expected.SupportedSeries,
 		SingleSeries: false,
 		AllSeries:    true,
+		Suggest:      entitySuggestion(expected, 0),
 	}
 	c.Assert(string(actual), jc.JSONEquals, doc)
 	err = s.store.ES.GetDocument(s.TestIndex, typeName, s.store.ES.getID(old.URL), &actual)
@@ -199,6 +312,7 @@ func (s *StoreSearchSuite) TestExportMultiSeriesCharmsCreateExpandedVersions(c *
 		Series:       []string{old.URL.Series},
 		SingleSeries: true,
 		AllSeries:    false,
+		Suggest:      entitySuggestion(expected, 0),
 	}
 	c.Assert(string(actual), jc.JSONEquals, doc)
 }
@@ -682,6 +796,56 @@ func (s *StoreSearchSuite) TestLimitTestSearch(c *gc.C) {
 	c.Assert(res, gc.HasLen, 1)
 }
 
+var searchSuggestTests = []struct {
+	about       string
+	prefix      string
+	groups      []string
+	limit       int
+	expectNames []string
+}{{
+	about:       "name prefix",
+	prefix:      "word",
+	limit:       10,
+	expectNames: []string{"wordpress-simple", "wordpress"},
+}, {
+	about:       "summary word prefix",
+	prefix:      "data",
+	limit:       10,
+	expectNames: []string{"varnish", "mysql"},
+}, {
+	about:       "limited results",
+	prefix:      "data",
+	limit:       1,
+	expectNames: []string{"varnish"},
+}, {
+	about:       "entity not readable",
+	prefix:      "ria",
+	limit:       10,
+	expectNames: []string{},
+}, {
+	about:       "entity readable by group",
+	prefix:      "ria",
+	groups:      []string{"charmers"},
+	limit:       10,
+	expectNames: []string{"riak"},
+}, {
+	about:       "no match",
+	prefix:      "xyz",
+	limit:       10,
+	expectNames: []string{},
+}}
+
+func (s *StoreSearchSuite) TestSearchSuggest(c *gc.C) {
+	err := s.store.ES.Database.RefreshIndex(s.TestIndex)
+	c.Assert(err, gc.Equals, nil)
+	for i, test := range searchSuggestTests {
+		c.Logf("test %d: %s", i, test.about)
+		names, err := s.store.SearchSuggest(test.prefix, test.groups, test.limit)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(names, jc.DeepEquals, test.expectNames)
+	}
+}
+
 func (s *StoreSearchSuite) TestPromulgatedRank(c *gc.C) {
 	ent := storetesting.SearchEntity{
 		URL:                 charm.MustParseURL("cs:~charmers/" + storetesting.SearchSeries[2] + "/varnish-1"),
@@ -703,6 +867,81 @@ func (s *StoreSearchSuite) TestPromulgatedRank(c *gc.C) {
 	})
 }
 
+func (s *StoreSearchSuite) TestPromulgatedFilterWithInterfaces(c *gc.C) {
+	ent := storetesting.SearchEntity{
+		URL:                 charm.MustParseURL("cs:~bob/" + storetesting.SearchSeries[0] + "/wordpress-1"),
+		PromulgatedRevision: -1,
+		Charm: storetesting.NewCharm(&charm.Meta{
+			Requires: map[string]charm.Relation{
+				"mysql": {
+					Name:      "mysql",
+					Interface: "mysql",
+					Scope:     charm.ScopeGlobal,
+				},
+			},
+		}),
+		ACL: []string{params.Everyone},
+	}
+	addCharmForSearch(c, s.store, ent.ResolvedURL(), ent.Charm, ent.ACL, ent.Downloads)
+	s.store.ES.Database.RefreshIndex(s.TestIndex)
+	tests := []struct {
+		about   string
+		filters map[string][]string
+		results []storetesting.SearchEntity
+	}{{
+		about: "requires only",
+		filters: map[string][]string{
+			"requires": {"mysql"},
+		},
+		results: []storetesting.SearchEntity{
+			storetesting.SearchEntities["multi-series"],
+			storetesting.SearchEntities["wordpress"],
+			ent,
+		},
+	}, {
+		about: "requires and promulgated",
+		filters: map[string][]string{
+			"requires":    {"mysql"},
+			"promulgated": {"1"},
+		},
+		results: []storetesting.SearchEntity{
+			storetesting.SearchEntities["multi-series"],
+			storetesting.SearchEntities["wordpress"],
+		},
+	}, {
+		about: "requires and not promulgated",
+		filters: map[string][]string{
+			"requires":    {"mysql"},
+			"promulgated": {"0"},
+		},
+		results: []storetesting.SearchEntity{
+			ent,
+		},
+	}, {
+		about: "provides and promulgated",
+		filters: map[string][]string{
+			"provides":    {"mysql"},
+			"promulgated": {"1"},
+		},
+		results: []storetesting.SearchEntity{
+			storetesting.SearchEntities["mysql"],
+		},
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: %s", i, test.about)
+		_, res := search(c, s.store, SearchParams{
+			Filters: test.filters,
+		})
+		sort.Sort(resolvedURLsByString(res))
+		expected := make(Entities, len(test.results))
+		for i, r := range test.results {
+			expected[i] = s.entity(c, r.ResolvedURL())
+		}
+		sort.Sort(resolvedURLsByString(expected))
+		c.Check(Entities(res), jc.DeepEquals, expected)
+	}
+}
+
 func (s *StoreSearchSuite) TestSorting(c *gc.C) {
 	s.store.ES.Database.RefreshIndex(s.TestIndex)
 	tests := []struct {
@@ -1016,6 +1255,235 @@ func (s *StoreSearchSuite) TestMultiSeriesCharmFiltersSeriesCorrectly(c *gc.C) {
 	}
 }
 
+func (s *StoreSearchSuite) TestJujuVersionFilters(c *gc.C) {
+	url := router.MustNewResolvedURL("cs:~charmers/"+storetesting.SearchSeries[1]+"/modern-1", -1)
+	addCharmForSearch(
+		c,
+		s.store,
+		url,
+		storetesting.NewCharm(&charm.Meta{
+			Name:           "modern",
+			MinJujuVersion: jujuversion.MustParse("2.5.0"),
+		}),
+		[]string{url.URL.User, params.Everyone},
+		0,
+	)
+	s.store.ES.Database.RefreshIndex(s.TestIndex)
+	filterTests := []struct {
+		filter   string
+		value    string
+		notFound bool
+	}{{
+		filter:   "max-juju-version",
+		value:    "2.0.0",
+		notFound: true,
+	}, {
+		filter:   "max-juju-version",
+		value:    "2.5-beta1",
+		notFound: true,
+	}, {
+		filter: "max-juju-version",
+		value:  "2.5.0",
+	}, {
+		filter: "max-juju-version",
+		value:  "2.6.1",
+	}, {
+		filter: "min-juju-version",
+		value:  "2.4.0",
+	}, {
+		filter:   "min-juju-version",
+		value:    "2.5.1",
+		notFound: true,
+	}}
+	for i, test := range filterTests {
+		c.Logf("%d. %s=%s", i, test.filter, test.value)
+		_, res := search(c, s.store, SearchParams{
+			Filters: map[string][]string{
+				"name":      {"modern"},
+				test.filter: {test.value},
+			},
+		})
+		if test.notFound {
+			c.Assert(res, gc.HasLen, 0)
+			continue
+		}
+		c.Assert(res, gc.HasLen, 1)
+		c.Assert(res[0].URL.String(), gc.Equals, url.String())
+	}
+
+	// Charms that do not declare a minimum version are
+	// compatible with any version of Juju.
+	_, res := search(c, s.store, SearchParams{
+		Filters: map[string][]string{
+			"name":             {"wordpress"},
+			"max-juju-version": {"1.25.0"},
+		},
+	})
+	c.Assert(res, gc.Not(gc.HasLen), 0)
+}
+
+var jujuVersionOrdinalTests = []string{
+	"0.0.0",
+	"0.0.1",
+	"1.25.6",
+	"2.0-alpha1",
+	"2.0-alpha2",
+	"2.0-beta1",
+	"2.0-beta2",
+	"2.0-beta10",
+	"2.0-rc1",
+	"2.0.0",
+	"2.0.1",
+	"2.0.1.1",
+	"2.1-beta1",
+	"2.1.0",
+	"3.0.0",
+}
+
+func (s *StoreSearchSuite) TestJujuVersionOrdinal(c *gc.C) {
+	for i := 1; i < len(jujuVersionOrdinalTests); i++ {
+		v0 := jujuversion.MustParse(jujuVersionOrdinalTests[i-1])
+		v1 := jujuversion.MustParse(jujuVersionOrdinalTests[i])
+		c.Logf("%d. %v < %v", i, v0, v1)
+		c.Assert(jujuVersionOrdinal(v0) < jujuVersionOrdinal(v1), gc.Equals, true)
+	}
+}
+
+func (s *StoreSearchSuite) TestAssumesFeatureFilter(c *gc.C) {
+	url := router.MustNewResolvedURL("cs:~charmers/"+storetesting.SearchSeries[1]+"/assumer-1", -1)
+	addCharmForSearch(
+		c,
+		s.store,
+		url,
+		storetesting.NewCharm(&charm.Meta{
+			Name: "assumer",
+		}).WithAssumes("juju >= 3.0", "k8s-api", "lxd < 5.10"),
+		[]string{url.URL.User, params.Everyone},
+		0,
+	)
+	s.store.ES.Database.RefreshIndex(s.TestIndex)
+	filterTests := []struct {
+		value    string
+		notFound bool
+	}{{
+		value: "juju>=3.0",
+	}, {
+		value: "juju >= 3.0",
+	}, {
+		value: "juju>=2.9",
+	}, {
+		value: "juju",
+	}, {
+		value: "k8s-api",
+	}, {
+		value:    "juju>=3.1",
+		notFound: true,
+	}, {
+		value:    "juju>=10.0",
+		notFound: true,
+	}, {
+		value:    "juju<4.0",
+		notFound: true,
+	}, {
+		value: "lxd<5.10",
+	}, {
+		value: "lxd<6",
+	}, {
+		value:    "lxd<5.9",
+		notFound: true,
+	}, {
+		value:    "microk8s",
+		notFound: true,
+	}}
+	for i, test := range filterTests {
+		c.Logf("%d. %s", i, test.value)
+		_, res := search(c, s.store, SearchParams{
+			Filters: map[string][]string{
+				"name":            {"assumer"},
+				"assumes-feature": {test.value},
+			},
+		})
+		if test.notFound {
+			c.Assert(res, gc.HasLen, 0)
+			continue
+		}
+		c.Assert(res, gc.HasLen, 1)
+		c.Assert(res[0].URL.String(), gc.Equals, url.String())
+	}
+
+	// Charms without an assumes block are compatible with
+	// any environment.
+	_, res := search(c, s.store, SearchParams{
+		Filters: map[string][]string{
+			"name":            {"wordpress"},
+			"assumes-feature": {"microk8s"},
+		},
+	})
+	c.Assert(res, gc.Not(gc.HasLen), 0)
+}
+
+func (s *StoreSearchSuite) TestSourceFilter(c *gc.C) {
+	ch := storetesting.NewCharm(&charm.Meta{
+		Name: "ingested",
+	})
+	url := router.MustNewResolvedURL("cs:~charmers/"+storetesting.SearchSeries[1]+"/ingested-1", -1)
+	err := s.store.UploadEntityWithParams(url, bytes.NewReader(ch.Bytes()), hashOfString(string(ch.Bytes())), int64(len(ch.Bytes())), AddParams{
+		Source:    "launchpad",
+		SourceURL: "lp:~charmers/ingested",
+	})
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.SetPerms(&url.URL, "stable.read", url.URL.User, params.Everyone)
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.Publish(url, nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	s.store.ES.Database.RefreshIndex(s.TestIndex)
+
+	_, res := search(c, s.store, SearchParams{
+		Filters: map[string][]string{
+			"source": {"launchpad"},
+		},
+	})
+	c.Assert(res, gc.HasLen, 1)
+	c.Assert(res[0].URL.String(), gc.Equals, url.String())
+
+	_, res = search(c, s.store, SearchParams{
+		Filters: map[string][]string{
+			"source": {"github"},
+		},
+	})
+	c.Assert(res, gc.HasLen, 0)
+}
+
+func (s *StoreSearchSuite) TestTermsFilter(c *gc.C) {
+	ch := storetesting.NewCharm(&charm.Meta{
+		Name:  "terms-charm",
+		Terms: []string{"enterprise-terms/1", "special-terms/17"},
+	})
+	url := router.MustNewResolvedURL("cs:~charmers/"+storetesting.SearchSeries[1]+"/terms-charm-1", -1)
+	err := s.store.AddCharmWithArchive(url, ch)
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.SetPerms(&url.URL, "stable.read", url.URL.User, params.Everyone)
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.Publish(url, nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	s.store.ES.Database.RefreshIndex(s.TestIndex)
+
+	_, res := search(c, s.store, SearchParams{
+		Filters: map[string][]string{
+			"terms": {"special-terms/17"},
+		},
+	})
+	c.Assert(res, gc.HasLen, 1)
+	c.Assert(res[0].URL.String(), gc.Equals, url.String())
+
+	_, res = search(c, s.store, SearchParams{
+		Filters: map[string][]string{
+			"terms": {"other-terms/1"},
+		},
+	})
+	c.Assert(res, gc.HasLen, 0)
+}
+
 func (s *StoreSearchSuite) TestOnlyIndexStableCharms(c *gc.C) {
 	ch := storetesting.NewCharm(&charm.Meta{
 		Name: "test",
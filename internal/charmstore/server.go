@@ -9,10 +9,12 @@ package charmstore // import "gopkg.in/juju/charmstore.v5/internal/charmstore"
 import (
 	"crypto"
 	"crypto/x509"
+	"io"
 	"net/http"
 	"strings"
 	"time"
 
+	"github.com/juju/charmrepo/v6/csclient/params"
 	"github.com/juju/idmclient"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"gopkg.in/errgo.v1"
@@ -82,14 +84,57 @@ type ServerParams struct {
 	AgentUsername string
 	AgentKey      *bakery.KeyPair
 
+	// GroupMembers returns the names of the users that are members
+	// of the identity-service group with the given name. It should
+	// return an error with a params.ErrNotFound cause if the name
+	// does not refer to a group. It is used to report the effective
+	// readers of an entity. If it is nil, group names are not
+	// expanded.
+	GroupMembers func(group string) ([]string, error)
+
 	// StatsCacheMaxAge is the maximum length of time between
 	// refreshes of entities in the stats cache.
 	StatsCacheMaxAge time.Duration
 
+	// CharmMetricsLimit holds the maximum number of charms included
+	// in the output of the admin/charm-metrics endpoint, which
+	// includes the most downloaded charms first. If it is zero, a
+	// default of 100 is used.
+	CharmMetricsLimit int
+
+	// MaxMetaResponseEntities holds the maximum number of ids that
+	// may be given in a single bulk meta request. If it is zero,
+	// there is no limit.
+	MaxMetaResponseEntities int
+
+	// MaxMetaIncludes holds the maximum number of include
+	// parameters that may be given in a single meta request. If it
+	// is zero, there is no limit.
+	MaxMetaIncludes int
+
+	// NewRevisionMaxAttempts holds the maximum number of times
+	// that allocating a new revision number is attempted when it
+	// collides with concurrent allocations for the same id. If it
+	// is zero, a default of 10 is used.
+	NewRevisionMaxAttempts int
+
+	// MongoRetryAttempts holds the maximum number of times that
+	// reading an entity or base entity is retried after a
+	// transient mongo error, such as a primary stepdown. If it is
+	// zero, reads are not retried. It must not be more than 10.
+	MongoRetryAttempts int
+
 	// SearchCacheMaxAge is the maximum length of time between
 	// refreshes of entities in the search cache.
 	SearchCacheMaxAge time.Duration
 
+	// GroupCacheMaxAge is the maximum length of time that the
+	// group memberships of a user fetched from the identity
+	// service are cached for when checking ACLs. If it is zero,
+	// group memberships are not cached. The cache can be flushed
+	// with the admin/flush-group-cache endpoint.
+	GroupCacheMaxAge time.Duration
+
 	// MaxMgoSessions specifies a soft limit on the maximum
 	// number of mongo sessions used. Each concurrent
 	// HTTP request will use one session.
@@ -125,6 +170,38 @@ type ServerParams struct {
 	// If it's zero, a default value will be used.
 	MaxUploadParts int
 
+	// MaxBundleWithCharmsSize holds the maximum total size of the
+	// archives included in a bundle-with-charms archive.
+	// If it's zero, a default value will be used.
+	MaxBundleWithCharmsSize int64
+
+	// MaxBundleWithCharmsCount holds the maximum number of charms
+	// included in a bundle-with-charms archive.
+	// If it's zero, a default value will be used.
+	MaxBundleWithCharmsCount int
+
+	// MaxBundleSize holds the maximum size of an uploaded
+	// bundle archive. If it's zero, a default value will be used.
+	MaxBundleSize int64
+
+	// MaxArchiveSize holds the maximum size of an uploaded charm or
+	// bundle archive. Uploads are aborted as soon as more data than
+	// this has been read. If it's zero, there is no limit other
+	// than those implied by MaxUploadParts and MaxUploadPartSize
+	// for multipart uploads.
+	MaxArchiveSize int64
+
+	// MaxBundleApplications holds the maximum number of
+	// applications in an uploaded bundle. If it's zero, a default
+	// value will be used.
+	MaxBundleApplications int
+
+	// ArchiveCacheMaxAge holds the max-age used in the Cache-Control
+	// header of archive downloads for public entities that are
+	// published to the stable channel. Archives of other entities
+	// are never cached. If it's zero, a default value will be used.
+	ArchiveCacheMaxAge time.Duration
+
 	// RunBlobStoreGC holds whether the server will run
 	// the blobstore garbage collector worker.
 	RunBlobStoreGC bool
@@ -134,11 +211,115 @@ type ServerParams struct {
 	// never be set in production.
 	NoIndexes bool
 
+	// CollectionPrefix holds a prefix added to the names of all
+	// the MongoDB collections used by the store, including those
+	// used by the MongoDB blob store, so that several charm stores
+	// can share a database.
+	CollectionPrefix string
+
+	// BlobStorePrefix holds the prefix of the MongoDB collections
+	// used by the blob store, before CollectionPrefix is added.
+	// If it is empty, "entitystore" is used.
+	BlobStorePrefix string
+
 	// NewBlobBackend returns a new blobstore backend
 	// that may use the given MongoDB database.
 	// If this is nil, a MongoDB backend will be used.
 	NewBlobBackend func(db *mgo.Database) blobstore.Backend
 
+	// NewSecondaryBlobBackend optionally returns a read-only
+	// blobstore backend holding a replica of the primary
+	// backend's blobs. When set, blob reads that fail on the
+	// primary backend for any reason other than the blob not
+	// existing are retried on the secondary backend. Writes
+	// always go to the primary backend.
+	NewSecondaryBlobBackend func(db *mgo.Database) blobstore.Backend
+
+	// BlobStoreShardDepth holds the number of pseudo-directories,
+	// named by successive pairs of blob hash hex digits, under
+	// which objects are stored in the blob store backend, to
+	// spread the load on large Swift or S3 containers. Objects
+	// stored before sharding was enabled can still be read and
+	// removed. If it is zero, objects are not sharded. It must not
+	// be greater than blobstore.MaxShardDepth.
+	BlobStoreShardDepth int
+
+	// BlobInvalidator, if non-nil, is called with the hash of
+	// each blob that is removed from the blob store, or that
+	// belonged to a deleted entity, so that external caches
+	// can be purged. It is called in its own goroutine and
+	// errors are not reported back to the charm store.
+	BlobInvalidator func(hash string)
+
+	// BlobEncryptionKeys holds AES keys, indexed by key id,
+	// that can be used to decrypt blobs stored in the blob
+	// store. Each key must be 16, 24 or 32 bytes long.
+	BlobEncryptionKeys map[string][]byte
+
+	// BlobEncryptionKeyID holds the id of the key in
+	// BlobEncryptionKeys used to encrypt newly stored blobs.
+	// If this is empty, new blobs are stored unencrypted.
+	// Blob hashes are always those of the unencrypted data,
+	// so keys may be rotated by adding a new key and
+	// changing BlobEncryptionKeyID while retaining the old
+	// key for reading existing blobs. Encrypted data does not
+	// compress, so it is an error to set CompressBlobs when this
+	// or BlobEncryptionKeys is set.
+	BlobEncryptionKeyID string
+
+	// BlobCacheDir holds the directory of a local disk cache of
+	// blobs that is checked before fetching blobs from the blob
+	// store backend, to reduce the load on remote backends such as
+	// Swift. If it is empty, no cache is used. Because cached blobs
+	// would be held unencrypted, it is an error to set this when
+	// BlobEncryptionKeys or BlobEncryptionKeyID is set.
+	BlobCacheDir string
+
+	// BlobCacheMaxSize holds the maximum total size in bytes of the
+	// blobs held in BlobCacheDir. If it is zero, a default of 1GiB
+	// is used.
+	BlobCacheMaxSize int64
+
+	// LintOnUpload specifies that uploaded charms should be checked
+	// for common problems, such as missing relation hooks or invalid
+	// configuration option types, and rejected if any are found.
+	LintOnUpload bool
+
+	// DedupExtraInfoWrites specifies that a PUT of extra-info
+	// that would not change the stored values succeeds without
+	// writing to the database.
+	DedupExtraInfoWrites bool
+
+	// UploadContentTypes holds the content types accepted for
+	// uploaded archives. An upload whose declared content type, or
+	// sniffed content type if none is declared, is not in the list
+	// is rejected before its body is stored. If it is empty, only
+	// application/zip is accepted.
+	UploadContentTypes []string
+
+	// ArchiveScanner, if non-nil, is called with the hash of each
+	// uploaded charm or bundle archive and a reader of its contents,
+	// for example to check for leaked secrets or malware. The
+	// contents are read as the archive is being stored, so the
+	// scanner sees the data exactly once. If it returns an error,
+	// the upload is rejected with a params.ErrForbidden error
+	// holding the scanner's message.
+	ArchiveScanner func(hash string, r io.Reader) error
+
+	// IngestionErrorWebhook, if non-empty, holds a URL to which
+	// error-level ingestion log entries are POSTed as JSON when
+	// they are added to the store. Notifications are delivered
+	// one at a time in the background and retried a few times on
+	// failure; when too many are waiting, new ones are dropped.
+	IngestionErrorWebhook string
+
+	// CompressBlobs specifies that blobs stored in the default
+	// MongoDB backend should be gzip-compressed. Blob sizes and
+	// hashes are still those of the uncompressed data. It has no
+	// effect when NewBlobBackend is set, and may not be used
+	// together with BlobEncryptionKeys or BlobEncryptionKeyID.
+	CompressBlobs bool
+
 	// DockerRegistryAddress contains the address of the docker
 	// registry associated with the charmstore.
 	DockerRegistryAddress string
@@ -160,6 +341,35 @@ type ServerParams struct {
 	// This is temporary.
 	DisableSlowMetadata bool
 
+	// UploadBlocklist holds glob patterns, in the syntax used by
+	// path.Match, that are matched against the "user/name" of
+	// uploaded charms and bundles. Uploads that match any pattern
+	// are rejected. It is used until a blocklist is stored in the
+	// database through the admin/upload-blocklist endpoint.
+	UploadBlocklist []string
+
+	// AutoPromulgateUsers holds the names of users whose charms
+	// are promulgated automatically when they are published to
+	// the stable channel. A charm is not promulgated if a charm
+	// with the same name is already promulgated, whether owned by
+	// the same user or another.
+	AutoPromulgateUsers []string
+
+	// ApprovalRequiredChannels holds the channels that charms and
+	// bundles may only be published to once a second user has
+	// approved the publication. Publishing to one of these channels
+	// records a pending publish instead, which is completed when
+	// another user with write access approves it. Requests made
+	// with admin credentials are not subject to approval.
+	ApprovalRequiredChannels []params.Channel
+
+	// RequirePublishedForDownload specifies that the archives of
+	// entities that are not published to any channel, and the files
+	// within them, may only be downloaded by users with write access
+	// to them. This applies to all API versions and to the charms
+	// included in bundle-with-charms archives.
+	RequirePublishedForDownload bool
+
 	// If ReadOnly is true, the charmstore will run in "read-only" mode,
 	// returning errors on any attempts to change the charmstore
 	// data.
@@ -217,7 +427,7 @@ func NewServer(db *mgo.Database, si *SearchIndex, config ServerParams, versions
 	}
 	store := pool.Store()
 	defer store.Close()
-	if err := migrate(store.DB); err != nil {
+	if err := migrate(store.DB, pool.blobPrefix); err != nil {
 		pool.Close()
 		return nil, errgo.Notef(err, "database migration failed")
 	}
@@ -243,6 +453,7 @@ func NewServer(db *mgo.Database, si *SearchIndex, config ServerParams, versions
 			Client:        bclient,
 			BaseURL:       config.IdentityLocation,
 			AgentUsername: config.AgentUsername,
+			CacheTime:     config.GroupCacheMaxAge,
 		})
 		if err != nil {
 			return nil, errgo.Notef(err, "cannot initialize identity client")
@@ -4,6 +4,7 @@
 package charmstore
 
 import (
+	"encoding/json"
 	"net/http"
 	"strings"
 	"time"
@@ -260,6 +261,47 @@ func (s *ServerSuite) TestServerStartsBlobstoreGC(c *gc.C) {
 	r.Close()
 }
 
+func (s *ServerSuite) TestDebugProbe(c *gc.C) {
+	params := serverParams
+	params.MaxMgoSessions = 5
+	h, err := NewServer(s.Session.DB("juju_test"), nil, params, nopAPI)
+	c.Assert(err, gc.Equals, nil)
+	defer h.Close()
+
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: h,
+		URL:     "/debug/probe",
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.Bytes()))
+	var result ProbeResult
+	err = json.Unmarshal(rec.Body.Bytes(), &result)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(result.MongoLatency > 0, gc.Equals, true)
+	c.Assert(result.BlobStoreLatency > 0, gc.Equals, true)
+	c.Assert(result.MaxSessions, gc.Equals, 5)
+	c.Assert(result.SessionUtilization, gc.Equals, float64(result.SessionsInUse)/5)
+}
+
+func (s *ServerSuite) TestDebugInfoRequiresAuthorization(c *gc.C) {
+	h, err := NewServer(s.Session.DB("juju_test"), nil, serverParams, nopAPI)
+	c.Assert(err, gc.Equals, nil)
+	defer h.Close()
+
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: h,
+		URL:     "/debug/info",
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusUnauthorized, gc.Commentf("body: %s", rec.Body.Bytes()))
+
+	rec = httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler:  h,
+		URL:      "/debug/info",
+		Username: serverParams.AuthUsername,
+		Password: serverParams.AuthPassword,
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.Bytes()))
+}
+
 func assertServesVersion(c *gc.C, h http.Handler, vers string) {
 	path := vers
 	if path != "" {
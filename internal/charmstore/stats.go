@@ -5,10 +5,14 @@ package charmstore // import "gopkg.in/juju/charmstore.v5/internal/charmstore"
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 
+	"github.com/juju/charmrepo/v6/csclient/params"
 	"gopkg.in/errgo.v1"
 	"gopkg.in/juju/charmstore.v5/internal/charm"
+	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 
 	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
@@ -33,7 +37,7 @@ func (s *Store) ArchiveDownloadCountsAtTime(id *charm.URL, t time.Time) (thisRev
 	id1.Revision = -1
 	withoutRevision := id1.String()
 
-	day, _ := currentDay(t)
+	day := currentDay(t)
 	week, _ := currentWeek(t)
 	month, _ := currentMonth(t)
 
@@ -66,12 +70,405 @@ func (s *Store) ArchiveDownloadCountsAtTime(id *charm.URL, t time.Time) (thisRev
 	return
 }
 
+// Client types recorded with archive downloads. See
+// IncrementDownloadCountsAsync.
+const (
+	ClientJuju    = "juju"
+	ClientBrowser = "browser"
+	ClientCI      = "ci"
+	ClientOther   = "other"
+)
+
+// ValidClients holds the valid client types.
+var ValidClients = map[string]bool{
+	ClientJuju:    true,
+	ClientBrowser: true,
+	ClientCI:      true,
+	ClientOther:   true,
+}
+
+// clientPeriodPrefix prefixes the period of the all-time download
+// counts held for each client type, so that they are never matched by
+// the queries for the other periods.
+const clientPeriodPrefix = "client:"
+
+// clientPeriod returns the period of the download count that holds
+// the all-time downloads made by the given client type.
+func clientPeriod(client string) string {
+	return clientPeriodPrefix + client
+}
+
+// ArchiveDownloadCountsByClient returns the all-time download counts
+// of the given charm or bundle revision, keyed by the type of client
+// that made the downloads. Downloads that were recorded without a
+// client type are not included.
+func (s *Store) ArchiveDownloadCountsByClient(id *charm.URL) (map[string]int64, error) {
+	iter := s.DB.DownloadCounts().Find(bson.D{
+		{"id", id.String()},
+		{"period", bson.D{{"$regex", "^" + clientPeriodPrefix}}},
+	}).Select(bson.D{{"period", 1}, {"count", 1}}).Iter()
+	counts := make(map[string]int64)
+	var dc mongodoc.DownloadCount
+	for iter.Next(&dc) {
+		counts[strings.TrimPrefix(dc.Period, clientPeriodPrefix)] = dc.Count
+	}
+	if err := iter.Close(); err != nil {
+		return nil, errgo.Notef(err, "cannot read download counts")
+	}
+	return counts, nil
+}
+
+// DownloadCountInRange returns the number of times that the archive of
+// the entity with the given id was downloaded between start and end,
+// counted against the entity's preferred URL. Download counts are
+// held for each day (UTC), so the range includes all of the days
+// containing start and end. Days that have been compacted (see
+// CompactStats) are counted a month at a time, so the range includes
+// the whole of any compacted month that it overlaps.
+func (s *Store) DownloadCountInRange(url *router.ResolvedURL, start, end time.Time) (int64, error) {
+	startDay, endDay := currentDay(start), currentDay(end)
+	if startDay > endDay {
+		return 0, nil
+	}
+	it := s.DB.DownloadCounts().Find(bson.D{
+		{"id", url.PreferredURL().String()},
+		{"$or", []bson.D{{
+			{"period", bson.D{
+				{"$gte", startDay},
+				{"$lte", endDay},
+				// Exclude the weekly and monthly counts, which
+				// can sort within the range.
+				{"$regex", dayPeriodPattern},
+			}},
+		}, {
+			{"period", bson.D{
+				{"$gte", compactedMonth(start)},
+				{"$lte", compactedMonth(end)},
+				{"$regex", compactedPeriodPattern},
+			}},
+		}}},
+	}).Select(bson.D{{"count", 1}}).Iter()
+	var total int64
+	var dc mongodoc.DownloadCount
+	for it.Next(&dc) {
+		total += dc.Count
+	}
+	if err := it.Close(); err != nil {
+		return 0, errgo.Notef(err, "cannot count downloads")
+	}
+	return total, nil
+}
+
+// DownloadCountsSince returns the number of archive downloads of each
+// entity recorded since the given time, keyed by the entity's
+// non-promulgated id, for example "cs:~charmers/trusty/wordpress-3".
+// Entities that have not been downloaded since t are omitted.
+//
+// Download counts are held for each day (UTC), so the window includes
+// the whole of the day containing t, or the whole of its month if that
+// has been compacted (see CompactStats). Callers polling for increments
+// should therefore use times on a day boundary.
+func (s *Store) DownloadCountsSince(t time.Time) (map[string]int64, error) {
+	// Only count the ids that include a user, as downloads
+	// of promulgated entities are counted under both ids.
+	iter := s.DB.DownloadCounts().Pipe([]bson.D{{
+		{"$match", bson.D{
+			{"id", bson.D{{"$regex", "^cs:~"}}},
+			{"$or", []bson.D{{
+				{"period", bson.D{
+					{"$gte", currentDay(t)},
+					{"$regex", dayPeriodPattern},
+				}},
+			}, {
+				{"period", bson.D{
+					{"$gte", compactedMonth(t)},
+					{"$regex", compactedPeriodPattern},
+				}},
+			}}},
+		}},
+	}, {
+		{"$group", bson.D{
+			{"_id", "$id"},
+			{"count", bson.D{{"$sum", "$count"}}},
+		}},
+	}}).AllowDiskUse().Iter()
+
+	counts := make(map[string]int64)
+	var result struct {
+		Id    string `bson:"_id"`
+		Count int64
+	}
+	for iter.Next(&result) {
+		url, err := charm.ParseURL(result.Id)
+		if err != nil {
+			logger.Errorf("invalid id %q in download counts: %v", result.Id, err)
+			continue
+		}
+		if url.Revision == -1 {
+			// The count for all revisions of an entity.
+			continue
+		}
+		counts[result.Id] = result.Count
+	}
+	if err := iter.Close(); err != nil {
+		return nil, errgo.Notef(err, "cannot read download counts")
+	}
+	return counts, nil
+}
+
+// TopCharms returns the charms published in the given channel whose
+// archives were downloaded the most since the given time, most
+// downloaded first. Downloads are counted for all revisions of each
+// charm, and the returned ids refer to the latest revision published
+// in the channel. If allow is not nil, charms for which it returns
+// false are omitted before the limit is applied. At most limit ids are
+// returned; if limit is not positive there is no limit.
+//
+// Download counts are held for each day (UTC), so the window includes
+// the whole of the day containing since, or the whole of its month if
+// that has been compacted. The ranking is cached for
+// ServerParams.StatsCacheMaxAge, so it may not reflect recent
+// downloads.
+func (s *Store) TopCharms(channel params.Channel, since time.Time, limit int, allow func(*router.ResolvedURL) bool) ([]*router.ResolvedURL, error) {
+	ranked, err := s.rankedCharms(since)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var ids []*router.ResolvedURL
+	seen := make(map[charm.URL]bool)
+	for _, url := range ranked {
+		entity, err := s.FindBestEntity(url, channel, FieldSelector("_id", "promulgated-url"))
+		if errgo.Cause(err) == params.ErrNotFound {
+			// The charm is not published in the channel.
+			continue
+		}
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if entity.URL.Series == "bundle" || seen[*entity.URL] {
+			continue
+		}
+		seen[*entity.URL] = true
+		id := EntityResolvedURL(entity)
+		if allow != nil && !allow(id) {
+			continue
+		}
+		ids = append(ids, id)
+		if limit > 0 && len(ids) >= limit {
+			break
+		}
+	}
+	return ids, nil
+}
+
+// topCharmsCacheKeyPrefix holds the prefix of the keys used to cache
+// the results of rankCharms in the stats cache. It cannot be confused
+// with an entity id.
+const topCharmsCacheKeyPrefix = "top-charms "
+
+// rankedCharms returns the result of rankCharms for the given time,
+// caching it in the stats cache. As download counts are held for each
+// day, the result depends only on the day containing since.
+func (s *Store) rankedCharms(since time.Time) ([]*charm.URL, error) {
+	v, err := s.pool.statsCache.Get(topCharmsCacheKeyPrefix+currentDay(since), func() (interface{}, error) {
+		return s.rankCharms(since)
+	})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return v.([]*charm.URL), nil
+}
+
+// rankCharms returns the base URLs of the charms and bundles whose
+// archives were downloaded the most since the given time, most
+// downloaded first.
+func (s *Store) rankCharms(since time.Time) ([]*charm.URL, error) {
+	// Only count the ids that include a user, as downloads
+	// of promulgated entities are counted under both ids.
+	iter := s.DB.DownloadCounts().Pipe([]bson.D{{
+		{"$match", bson.D{
+			{"id", bson.D{{"$regex", "^cs:~"}}},
+			{"$or", []bson.D{{
+				{"period", bson.D{
+					{"$gte", currentDay(since)},
+					{"$regex", dayPeriodPattern},
+				}},
+			}, {
+				{"period", bson.D{
+					{"$gte", compactedMonth(since)},
+					{"$regex", compactedPeriodPattern},
+				}},
+			}}},
+		}},
+	}, {
+		{"$group", bson.D{
+			{"_id", "$id"},
+			{"count", bson.D{{"$sum", "$count"}}},
+		}},
+	}, {
+		{"$sort", bson.D{{"count", -1}, {"_id", 1}}},
+	}}).AllowDiskUse().Iter()
+	defer iter.Close()
+
+	var urls []*charm.URL
+	var result struct {
+		Id    string `bson:"_id"`
+		Count int64
+	}
+	for iter.Next(&result) {
+		url, err := charm.ParseURL(result.Id)
+		if err != nil {
+			logger.Errorf("invalid id %q in download counts: %v", result.Id, err)
+			continue
+		}
+		if url.Revision != -1 || url.Series == "bundle" {
+			// The count for a single revision or for a bundle.
+			continue
+		}
+		urls = append(urls, url)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, errgo.Notef(err, "cannot rank download counts")
+	}
+	return urls, nil
+}
+
+// CharmDownloads holds the total number of archive downloads of a
+// charm.
+type CharmDownloads struct {
+	// URL holds the base URL of the charm, for example
+	// cs:~charmers/wordpress.
+	URL *charm.URL
+
+	// Count holds the number of downloads of all revisions and
+	// series of the charm.
+	Count int64
+}
+
+// topCharmDownloadsCacheKeyPrefix holds the prefix of the keys used to
+// cache the results of TopCharmDownloads in the stats cache. It cannot
+// be confused with an entity id.
+const topCharmDownloadsCacheKeyPrefix = "top-charm-downloads "
+
+// TopCharmDownloads returns the all-time download totals of the charms
+// currently published in the given channel, most downloaded first.
+// Downloads are counted for all revisions and series of each charm,
+// whichever channel they were downloaded from, as download counts are
+// not held per channel. At most limit charms are returned; if limit is
+// not positive there is no limit. The result is cached for
+// ServerParams.StatsCacheMaxAge, so it may not reflect recent
+// downloads. Note that TopCharmDownloads does not check ACLs.
+func (s *Store) TopCharmDownloads(channel params.Channel, limit int) ([]CharmDownloads, error) {
+	if channel == params.NoChannel {
+		channel = params.StableChannel
+	}
+	key := fmt.Sprintf("%s%s %d", topCharmDownloadsCacheKeyPrefix, channel, limit)
+	v, err := s.pool.statsCache.Get(key, func() (interface{}, error) {
+		return s.topCharmDownloads(channel, limit)
+	})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return v.([]CharmDownloads), nil
+}
+
+// topCharmDownloadsBatchSize holds the number of charms whose channels
+// are checked at once by topCharmDownloads.
+const topCharmDownloadsBatchSize = 100
+
+// topCharmDownloads calculates the result of TopCharmDownloads.
+func (s *Store) topCharmDownloads(channel params.Channel, limit int) ([]CharmDownloads, error) {
+	// Only count the ids that include a user, as downloads
+	// of promulgated entities are counted under both ids.
+	iter := s.DB.DownloadCounts().Find(bson.D{
+		{"id", bson.D{{"$regex", "^cs:~"}}},
+		{"period", ""},
+	}).Select(bson.D{{"id", 1}, {"count", 1}}).Iter()
+	totals := make(map[charm.URL]int64)
+	var dc mongodoc.DownloadCount
+	for iter.Next(&dc) {
+		url, err := charm.ParseURL(dc.ID)
+		if err != nil {
+			logger.Errorf("invalid id %q in download counts: %v", dc.ID, err)
+			continue
+		}
+		if url.Revision != -1 || url.Series == "bundle" {
+			// The count for a single revision or for a bundle.
+			continue
+		}
+		totals[*mongodoc.BaseURL(url)] += dc.Count
+	}
+	if err := iter.Close(); err != nil {
+		return nil, errgo.Notef(err, "cannot read download counts")
+	}
+	downloads := make([]CharmDownloads, 0, len(totals))
+	for url, count := range totals {
+		url := url
+		downloads = append(downloads, CharmDownloads{
+			URL:   &url,
+			Count: count,
+		})
+	}
+	sort.Slice(downloads, func(i, j int) bool {
+		if downloads[i].Count != downloads[j].Count {
+			return downloads[i].Count > downloads[j].Count
+		}
+		return downloads[i].URL.String() < downloads[j].URL.String()
+	})
+	var result []CharmDownloads
+	for len(downloads) > 0 {
+		batch := downloads
+		if len(batch) > topCharmDownloadsBatchSize {
+			batch = batch[:topCharmDownloadsBatchSize]
+		}
+		downloads = downloads[len(batch):]
+		published, err := s.publishedBaseURLs(batch, channel)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		for _, d := range batch {
+			// Charms that have been deleted or are not
+			// published in the channel are omitted.
+			if !published[*d.URL] {
+				continue
+			}
+			result = append(result, d)
+			if limit > 0 && len(result) >= limit {
+				return result, nil
+			}
+		}
+	}
+	return result, nil
+}
+
+// publishedBaseURLs returns the set of the base URLs of the given
+// charms that have a current revision in the given channel.
+func (s *Store) publishedBaseURLs(downloads []CharmDownloads, channel params.Channel) (map[charm.URL]bool, error) {
+	urls := make([]*charm.URL, len(downloads))
+	for i, d := range downloads {
+		urls[i] = d.URL
+	}
+	var baseEntities []*mongodoc.BaseEntity
+	if err := s.DB.BaseEntities().Find(bson.D{
+		{"_id", bson.D{{"$in", urls}}},
+		{"channelentities." + string(channel), bson.D{{"$exists", true}, {"$ne", bson.D{}}}},
+	}).Select(FieldSelector("_id")).All(&baseEntities); err != nil {
+		return nil, errgo.Notef(err, "cannot find base entities")
+	}
+	published := make(map[charm.URL]bool, len(baseEntities))
+	for _, e := range baseEntities {
+		published[*e.URL] = true
+	}
+	return published, nil
+}
+
 // IncrementDownloadCountsAsync updates the download statistics for entity id in both
-// the statistics database and the search database. The action is done in the
-// background using a separate goroutine.
-func (s *Store) IncrementDownloadCountsAsync(id *router.ResolvedURL) {
+// the statistics database and the search database, as
+// IncrementClientDownloadCounts does. The action is done in the background
+// using a separate goroutine.
+func (s *Store) IncrementDownloadCountsAsync(id *router.ResolvedURL, client string) {
 	s.Go(func(s *Store) {
-		if err := s.IncrementDownloadCounts(id); err != nil {
+		if err := s.IncrementClientDownloadCounts(id, client); err != nil {
 			logger.Errorf("cannot increase download counter for %v: %s", id, err)
 		}
 	})
@@ -83,10 +480,21 @@ func (s *Store) IncrementDownloadCounts(id *router.ResolvedURL) error {
 	return s.IncrementDownloadCountsAtTime(id, time.Now())
 }
 
+// IncrementClientDownloadCounts is like IncrementDownloadCounts except
+// that, if client is not empty, the download is also counted against
+// that client type.
+func (s *Store) IncrementClientDownloadCounts(id *router.ResolvedURL, client string) error {
+	return s.incrementDownloadCounts(id, time.Now(), client)
+}
+
 // IncrementDownloadCountsAtTime updates the download statistics for entity id in both
 // the statistics database and the search database, associating it with the given time.
 func (s *Store) IncrementDownloadCountsAtTime(id *router.ResolvedURL, t time.Time) error {
-	if err := s.incrementDownloadCountsAtTime(&id.URL, t); err != nil {
+	return s.incrementDownloadCounts(id, t, "")
+}
+
+func (s *Store) incrementDownloadCounts(id *router.ResolvedURL, t time.Time, client string) error {
+	if err := s.incrementDownloadCountsAtTime(&id.URL, t, client); err != nil {
 		return errgo.Mask(err)
 	}
 	if id.PromulgatedRevision == -1 {
@@ -102,7 +510,7 @@ func (s *Store) IncrementDownloadCountsAtTime(id *router.ResolvedURL, t time.Tim
 	}
 
 	if id.PromulgatedRevision != -1 {
-		if err := s.incrementDownloadCountsAtTime(id.PromulgatedURL(), t); err != nil {
+		if err := s.incrementDownloadCountsAtTime(id.PromulgatedURL(), t, client); err != nil {
 			return errgo.Mask(err)
 		}
 	}
@@ -115,8 +523,8 @@ func (s *Store) IncrementDownloadCountsAtTime(id *router.ResolvedURL, t time.Tim
 	return nil
 }
 
-func (s *Store) incrementDownloadCountsAtTime(url *charm.URL, t time.Time) error {
-	day, dayExpires := currentDay(t)
+func (s *Store) incrementDownloadCountsAtTime(url *charm.URL, t time.Time, client string) error {
+	day := currentDay(t)
 	week, weekExpires := currentWeek(t)
 	month, monthExpires := currentMonth(t)
 
@@ -129,10 +537,9 @@ func (s *Store) incrementDownloadCountsAtTime(url *charm.URL, t time.Time) error
 		ID:    withRevision,
 		Count: 1,
 	}, {
-		ID:      withRevision,
-		Period:  day,
-		Count:   1,
-		Expires: &dayExpires,
+		ID:     withRevision,
+		Period: day,
+		Count:  1,
 	}, {
 		ID:      withRevision,
 		Period:  week,
@@ -147,10 +554,9 @@ func (s *Store) incrementDownloadCountsAtTime(url *charm.URL, t time.Time) error
 		ID:    withoutRevision,
 		Count: 1,
 	}, {
-		ID:      withoutRevision,
-		Period:  day,
-		Count:   1,
-		Expires: &dayExpires,
+		ID:     withoutRevision,
+		Period: day,
+		Count:  1,
 	}, {
 		ID:      withoutRevision,
 		Period:  week,
@@ -162,6 +568,13 @@ func (s *Store) incrementDownloadCountsAtTime(url *charm.URL, t time.Time) error
 		Count:   1,
 		Expires: &monthExpires,
 	}}
+	if client != "" {
+		dcs = append(dcs, mongodoc.DownloadCount{
+			ID:     withRevision,
+			Period: clientPeriod(client),
+			Count:  1,
+		})
+	}
 
 	for _, dc := range dcs {
 		if err := s.incrementDownloadCount(dc); err != nil {
@@ -171,11 +584,93 @@ func (s *Store) incrementDownloadCountsAtTime(url *charm.URL, t time.Time) error
 	return nil
 }
 
-// currentDay returns the day that the given time occurs in along with
-// the time at which that count should expire.
-func currentDay(t time.Time) (period string, expires time.Time) {
+// currentDay returns the day that the given time occurs in. Unlike
+// the weekly and monthly counts, daily counts never expire so that
+// they can be used to find the number of downloads in an arbitrary
+// range of days (see DownloadCountInRange).
+func currentDay(t time.Time) (period string) {
 	y, m, d := t.UTC().Date()
-	return fmt.Sprintf("%04d-%02d-%02d", y, m, d), time.Date(y, m, d, 0, 0, 0, 0, time.UTC).AddDate(0, 0, 1)
+	return fmt.Sprintf("%04d-%02d-%02d", y, m, d)
+}
+
+// dayPeriodPattern matches the periods of the daily download counts,
+// as returned by currentDay.
+const dayPeriodPattern = `^[0-9]{4}-[0-9]{2}-[0-9]{2}$`
+
+// compactedMonth returns the period of the download count that holds
+// the compacted daily counts for the month that the given time occurs
+// in (see CompactStats).
+func compactedMonth(t time.Time) (period string) {
+	y, m, _ := t.UTC().Date()
+	return fmt.Sprintf("%04d-%02d-compacted", y, m)
+}
+
+// compactedPeriodPattern matches the periods of compacted download
+// counts, as returned by compactedMonth.
+const compactedPeriodPattern = `^[0-9]{4}-[0-9]{2}-compacted$`
+
+// CompactStats bounds the growth of the download counts by rolling the
+// daily counts for each month that ended before the given time up into
+// a single count for the month. Total counts are preserved, but
+// DownloadCountInRange and TopCharms can only count the downloads in
+// compacted months a month at a time.
+//
+// Each daily count is recorded in the monthly count before it is
+// removed, so CompactStats may safely be run again if it is
+// interrupted.
+func (s *Store) CompactStats(before time.Time) error {
+	y, m, _ := before.UTC().Date()
+	cutoff := currentDay(time.Date(y, m, 1, 0, 0, 0, 0, time.UTC))
+	counts := s.DB.DownloadCounts()
+	iter := counts.Find(bson.D{
+		{"period", bson.D{
+			{"$lt", cutoff},
+			{"$regex", dayPeriodPattern},
+		}},
+	}).Iter()
+	var dc struct {
+		Id                     bson.ObjectId `bson:"_id"`
+		mongodoc.DownloadCount `bson:",inline"`
+	}
+	n := 0
+	for iter.Next(&dc) {
+		t, err := time.Parse("2006-01-02", dc.Period)
+		if err != nil {
+			logger.Errorf("invalid period %q in download count for %s", dc.Period, dc.ID)
+			continue
+		}
+		month := compactedMonth(t)
+		if _, err := counts.Upsert(bson.D{
+			{"id", dc.ID},
+			{"period", month},
+		}, bson.D{
+			{"$setOnInsert", bson.D{{"count", 0}}},
+		}); err != nil {
+			return errgo.Notef(err, "cannot create %s download count for %s", month, dc.ID)
+		}
+		// Only add the daily count if it has not already been
+		// added by an earlier, interrupted, compaction.
+		err = counts.Update(bson.D{
+			{"id", dc.ID},
+			{"period", month},
+			{"compacteddays", bson.D{{"$ne", dc.Period}}},
+		}, bson.D{
+			{"$inc", bson.D{{"count", dc.Count}}},
+			{"$push", bson.D{{"compacteddays", dc.Period}}},
+		})
+		if err != nil && err != mgo.ErrNotFound {
+			return errgo.Notef(err, "cannot update %s download count for %s", month, dc.ID)
+		}
+		if err := counts.RemoveId(dc.Id); err != nil {
+			return errgo.Notef(err, "cannot remove %s download count for %s", dc.Period, dc.ID)
+		}
+		n++
+	}
+	if err := iter.Close(); err != nil {
+		return errgo.Notef(err, "cannot iterate download counts")
+	}
+	logger.Infof("compacted %d daily download counts before %s", n, cutoff)
+	return nil
 }
 
 // currentWeek returns the ISO 8601 week that the given time occurs in
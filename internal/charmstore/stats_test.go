@@ -6,12 +6,15 @@ package charmstore_test
 import (
 	"time"
 
+	"github.com/juju/charmrepo/v6/csclient/params"
 	jujutesting "github.com/juju/testing"
 	jc "github.com/juju/testing/checkers"
 	gc "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
 
 	"gopkg.in/juju/charmstore.v5/internal/charm"
 	"gopkg.in/juju/charmstore.v5/internal/charmstore"
+	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
 	"gopkg.in/juju/charmstore.v5/internal/router"
 	"gopkg.in/juju/charmstore.v5/internal/storetesting"
 )
@@ -219,6 +222,271 @@ func (s *StatsSuite) TestIncrementDownloadCounts(c *gc.C) {
 	c.Assert(allRevisions, jc.DeepEquals, expect)
 }
 
+func (s *StatsSuite) TestArchiveDownloadCountsByClient(c *gc.C) {
+	ch := storetesting.Charms.CharmDir("wordpress")
+	id := charmstore.MustParseResolvedURL("0 ~charmers/trusty/wordpress-1")
+	err := s.store.AddCharmWithArchive(id, ch)
+	c.Assert(err, gc.Equals, nil)
+	for _, client := range []string{charmstore.ClientJuju, charmstore.ClientBrowser, charmstore.ClientJuju, ""} {
+		err := s.store.IncrementClientDownloadCounts(id, client)
+		c.Assert(err, gc.Equals, nil)
+	}
+	expect := map[string]int64{
+		charmstore.ClientJuju:    2,
+		charmstore.ClientBrowser: 1,
+	}
+	for _, url := range []string{"~charmers/trusty/wordpress-1", "trusty/wordpress-0"} {
+		counts, err := s.store.ArchiveDownloadCountsByClient(charm.MustParseURL(url))
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(counts, jc.DeepEquals, expect)
+	}
+
+	// The downloads by client are not counted again in the other
+	// download counts.
+	thisRevision, allRevisions, err := s.store.ArchiveDownloadCounts(charm.MustParseURL("~charmers/trusty/wordpress-1"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(thisRevision.Total, gc.Equals, int64(4))
+	c.Assert(thisRevision.LastDay, gc.Equals, int64(4))
+	c.Assert(allRevisions.Total, gc.Equals, int64(4))
+	count, err := s.store.DownloadCountInRange(id, time.Now(), time.Now())
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(count, gc.Equals, int64(4))
+}
+
+var downloadCountInRangeTests = []struct {
+	about       string
+	start, end  string
+	expectCount int64
+}{{
+	about:       "all days",
+	start:       "2016-01-01",
+	end:         "2016-03-31",
+	expectCount: 15,
+}, {
+	about:       "single day",
+	start:       "2016-01-31",
+	end:         "2016-01-31",
+	expectCount: 2,
+}, {
+	about:       "sub-range",
+	start:       "2016-01-31",
+	end:         "2016-02-01",
+	expectCount: 6,
+}, {
+	about:       "range across month boundary excludes monthly counts",
+	start:       "2016-01-15",
+	end:         "2016-02-15",
+	expectCount: 6,
+}, {
+	about:       "no downloads in range",
+	start:       "2016-02-02",
+	end:         "2016-02-28",
+	expectCount: 0,
+}, {
+	about:       "end before start",
+	start:       "2016-03-01",
+	end:         "2016-01-01",
+	expectCount: 0,
+}}
+
+func (s *StatsSuite) TestDownloadCountInRange(c *gc.C) {
+	ch := storetesting.Charms.CharmDir("wordpress")
+	id := charmstore.MustParseResolvedURL("0 ~charmers/trusty/wordpress-1")
+	err := s.store.AddCharmWithArchive(id, ch)
+	c.Assert(err, gc.Equals, nil)
+	for day, n := range map[string]int{
+		"2016-01-01": 1,
+		"2016-01-31": 2,
+		"2016-02-01": 4,
+		"2016-03-01": 8,
+	} {
+		t, err := time.Parse("2006-01-02", day)
+		c.Assert(err, gc.Equals, nil)
+		// Record the downloads part way through the day.
+		setDownloadCounts(c, s.store, id, t.Add(13*time.Hour), n)
+	}
+	// Downloads of another revision are not counted.
+	id2 := charmstore.MustParseResolvedURL("1 ~charmers/trusty/wordpress-2")
+	err = s.store.AddCharmWithArchive(id2, ch)
+	c.Assert(err, gc.Equals, nil)
+	setDownloadCounts(c, s.store, id2, time.Date(2016, 1, 31, 0, 0, 0, 0, time.UTC), 16)
+
+	for i, test := range downloadCountInRangeTests {
+		c.Logf("test %d: %s", i, test.about)
+		start, err := time.Parse("2006-01-02", test.start)
+		c.Assert(err, gc.Equals, nil)
+		end, err := time.Parse("2006-01-02", test.end)
+		c.Assert(err, gc.Equals, nil)
+		count, err := s.store.DownloadCountInRange(id, start, end)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(count, gc.Equals, test.expectCount)
+	}
+}
+
+func (s *StatsSuite) TestDownloadCountsSince(c *gc.C) {
+	ch := storetesting.Charms.CharmDir("wordpress")
+	id1 := charmstore.MustParseResolvedURL("0 ~charmers/trusty/wordpress-1")
+	err := s.store.AddCharmWithArchive(id1, ch)
+	c.Assert(err, gc.Equals, nil)
+	id2 := charmstore.MustParseResolvedURL("~bob/trusty/wordpress-0")
+	err = s.store.AddCharmWithArchive(id2, ch)
+	c.Assert(err, gc.Equals, nil)
+
+	t1 := time.Date(2016, 1, 1, 13, 0, 0, 0, time.UTC)
+	t2 := time.Date(2016, 1, 5, 13, 0, 0, 0, time.UTC)
+	setDownloadCounts(c, s.store, id1, t1, 3)
+	setDownloadCounts(c, s.store, id2, t1, 1)
+	setDownloadCounts(c, s.store, id1, t2, 2)
+
+	tests := []struct {
+		about        string
+		since        time.Time
+		expectCounts map[string]int64
+	}{{
+		about: "all downloads",
+		since: time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC),
+		expectCounts: map[string]int64{
+			"cs:~charmers/trusty/wordpress-1": 5,
+			"cs:~bob/trusty/wordpress-0":      1,
+		},
+	}, {
+		about: "earlier downloads excluded",
+		since: time.Date(2016, 1, 3, 0, 0, 0, 0, time.UTC),
+		expectCounts: map[string]int64{
+			"cs:~charmers/trusty/wordpress-1": 2,
+		},
+	}, {
+		about: "whole of the day containing since",
+		since: time.Date(2016, 1, 5, 20, 0, 0, 0, time.UTC),
+		expectCounts: map[string]int64{
+			"cs:~charmers/trusty/wordpress-1": 2,
+		},
+	}, {
+		about:        "no downloads",
+		since:        time.Date(2016, 1, 6, 0, 0, 0, 0, time.UTC),
+		expectCounts: map[string]int64{},
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: %s", i, test.about)
+		counts, err := s.store.DownloadCountsSince(test.since)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(counts, jc.DeepEquals, test.expectCounts)
+	}
+
+	// Once the month has been compacted, its downloads are
+	// counted a month at a time.
+	err = s.store.CompactStats(time.Date(2016, 2, 1, 0, 0, 0, 0, time.UTC))
+	c.Assert(err, gc.Equals, nil)
+	counts, err := s.store.DownloadCountsSince(time.Date(2016, 1, 3, 0, 0, 0, 0, time.UTC))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(counts, jc.DeepEquals, map[string]int64{
+		"cs:~charmers/trusty/wordpress-1": 5,
+		"cs:~bob/trusty/wordpress-0":      1,
+	})
+}
+
+func (s *StatsSuite) TestCompactStats(c *gc.C) {
+	ch := storetesting.Charms.CharmDir("wordpress")
+	id := charmstore.MustParseResolvedURL("0 ~charmers/trusty/wordpress-1")
+	err := s.store.AddCharmWithArchive(id, ch)
+	c.Assert(err, gc.Equals, nil)
+	for day, n := range map[string]int{
+		"2016-01-01": 1,
+		"2016-01-31": 2,
+		"2016-02-01": 4,
+		"2016-03-01": 8,
+	} {
+		t, err := time.Parse("2006-01-02", day)
+		c.Assert(err, gc.Equals, nil)
+		setDownloadCounts(c, s.store, id, t.Add(13*time.Hour), n)
+	}
+	tests := []struct {
+		start, end  string
+		expectCount int64
+	}{{
+		start:       "2016-01-01",
+		end:         "2016-03-31",
+		expectCount: 15,
+	}, {
+		start:       "2016-01-01",
+		end:         "2016-01-31",
+		expectCount: 3,
+	}, {
+		start:       "2016-01-31",
+		end:         "2016-02-01",
+		expectCount: 6,
+	}, {
+		start:       "2016-02-01",
+		end:         "2016-02-29",
+		expectCount: 4,
+	}}
+	assertCounts := func() {
+		for i, test := range tests {
+			c.Logf("test %d: %s to %s", i, test.start, test.end)
+			start, err := time.Parse("2006-01-02", test.start)
+			c.Assert(err, gc.Equals, nil)
+			end, err := time.Parse("2006-01-02", test.end)
+			c.Assert(err, gc.Equals, nil)
+			count, err := s.store.DownloadCountInRange(id, start, end)
+			c.Assert(err, gc.Equals, nil)
+			c.Assert(count, gc.Equals, test.expectCount)
+		}
+		thisRevision, _, err := s.store.ArchiveDownloadCounts(&id.URL)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(thisRevision.Total, gc.Equals, int64(15))
+	}
+	assertCounts()
+
+	// February has not ended by the cutoff, so only
+	// January is compacted.
+	before := time.Date(2016, 2, 15, 0, 0, 0, 0, time.UTC)
+	err = s.store.CompactStats(before)
+	c.Assert(err, gc.Equals, nil)
+	assertCounts()
+	n, err := s.store.DB.DownloadCounts().Find(bson.D{{"period", bson.D{{"$regex", "^2016-01-[0-9]{2}$"}}}}).Count()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 0)
+	n, err = s.store.DB.DownloadCounts().Find(bson.D{{"period", "2016-02-01"}}).Count()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Not(gc.Equals), 0)
+
+	// A range that overlaps a compacted month includes the
+	// whole of that month.
+	count, err := s.store.DownloadCountInRange(id, time.Date(2016, 1, 15, 0, 0, 0, 0, time.UTC), time.Date(2016, 2, 1, 0, 0, 0, 0, time.UTC))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(count, gc.Equals, int64(7))
+
+	// Compacting again changes nothing.
+	err = s.store.CompactStats(before)
+	c.Assert(err, gc.Equals, nil)
+	assertCounts()
+}
+
+func (s *StatsSuite) TestCompactStatsInterrupted(c *gc.C) {
+	ch := storetesting.Charms.CharmDir("wordpress")
+	id := charmstore.MustParseResolvedURL("0 ~charmers/trusty/wordpress-1")
+	err := s.store.AddCharmWithArchive(id, ch)
+	c.Assert(err, gc.Equals, nil)
+	setDownloadCounts(c, s.store, id, time.Date(2016, 1, 1, 13, 0, 0, 0, time.UTC), 3)
+	before := time.Date(2016, 2, 1, 0, 0, 0, 0, time.UTC)
+	err = s.store.CompactStats(before)
+	c.Assert(err, gc.Equals, nil)
+
+	// Simulate a compaction that was interrupted after adding a
+	// daily count to the monthly count but before removing it.
+	err = s.store.DB.DownloadCounts().Insert(mongodoc.DownloadCount{
+		ID:     id.URL.String(),
+		Period: "2016-01-01",
+		Count:  3,
+	})
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.CompactStats(before)
+	c.Assert(err, gc.Equals, nil)
+	count, err := s.store.DownloadCountInRange(id, before.AddDate(0, -1, 0), before)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(count, gc.Equals, int64(3))
+}
+
 func (s *StatsSuite) TestIncrementDownloadCountsOnPromulgatedMultiSeriesCharm(c *gc.C) {
 	ch := storetesting.Charms.CharmDir("multi-series")
 	id := charmstore.MustParseResolvedURL("0 ~charmers/wordpress-1")
@@ -292,3 +560,136 @@ func monthCount(day, week, month int) int64 {
 		return int64(day + week + month)
 	}
 }
+
+func (s *StatsSuite) TestTopCharmDownloads(c *gc.C) {
+	now := time.Now()
+	addCharm := func(id, name string, downloads int, channels ...params.Channel) {
+		rid := charmstore.MustParseResolvedURL(id)
+		err := s.store.AddCharmWithArchive(rid, storetesting.Charms.CharmDir(name))
+		c.Assert(err, gc.Equals, nil)
+		if len(channels) > 0 {
+			err = s.store.Publish(rid, nil, channels...)
+			c.Assert(err, gc.Equals, nil)
+		}
+		setDownloadCounts(c, s.store, rid, now, downloads)
+	}
+	// Downloads of all revisions and series are counted together.
+	addCharm("0 ~charmers/trusty/wordpress-0", "wordpress", 2, params.StableChannel)
+	addCharm("1 ~charmers/xenial/wordpress-1", "wordpress", 4, params.EdgeChannel)
+	addCharm("0 ~charmers/trusty/mysql-0", "mysql", 5, params.StableChannel)
+	addCharm("~bob/trusty/varnish-0", "varnish", 1, params.StableChannel)
+	addCharm("~bob/trusty/logging-0", "logging", 20, params.EdgeChannel)
+	addCharm("~bob/trusty/riak-0", "riak", 30)
+
+	// A bundle is never included.
+	bundleId := charmstore.MustParseResolvedURL("~charmers/bundle/wordpress-simple-0")
+	err := s.store.AddBundleWithArchive(bundleId, storetesting.Charms.BundleDir("wordpress-simple"))
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.Publish(bundleId, nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	setDownloadCounts(c, s.store, bundleId, now, 50)
+
+	downloads, err := s.store.TopCharmDownloads(params.StableChannel, 0)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(downloads, jc.DeepEquals, []charmstore.CharmDownloads{{
+		URL:   charm.MustParseURL("cs:~charmers/wordpress"),
+		Count: 6,
+	}, {
+		URL:   charm.MustParseURL("cs:~charmers/mysql"),
+		Count: 5,
+	}, {
+		URL:   charm.MustParseURL("cs:~bob/varnish"),
+		Count: 1,
+	}})
+
+	// NoChannel is treated as the stable channel.
+	downloads, err = s.store.TopCharmDownloads(params.NoChannel, 2)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(downloads, jc.DeepEquals, []charmstore.CharmDownloads{{
+		URL:   charm.MustParseURL("cs:~charmers/wordpress"),
+		Count: 6,
+	}, {
+		URL:   charm.MustParseURL("cs:~charmers/mysql"),
+		Count: 5,
+	}})
+
+	downloads, err = s.store.TopCharmDownloads(params.EdgeChannel, 0)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(downloads, jc.DeepEquals, []charmstore.CharmDownloads{{
+		URL:   charm.MustParseURL("cs:~bob/logging"),
+		Count: 20,
+	}, {
+		URL:   charm.MustParseURL("cs:~charmers/wordpress"),
+		Count: 6,
+	}})
+}
+
+func (s *StatsSuite) TestTopCharms(c *gc.C) {
+	now := time.Now()
+	since := now.AddDate(0, 0, -7)
+	addCharm := func(id, name string, downloads, oldDownloads int, channels ...params.Channel) *router.ResolvedURL {
+		rid := charmstore.MustParseResolvedURL(id)
+		err := s.store.AddCharmWithArchive(rid, storetesting.Charms.CharmDir(name))
+		c.Assert(err, gc.Equals, nil)
+		if len(channels) > 0 {
+			err = s.store.Publish(rid, nil, channels...)
+			c.Assert(err, gc.Equals, nil)
+		}
+		setDownloadCounts(c, s.store, rid, now, downloads)
+		// Downloads before the window are not counted.
+		setDownloadCounts(c, s.store, rid, since.AddDate(0, 0, -1), oldDownloads)
+		return rid
+	}
+	addCharm("0 ~charmers/trusty/wordpress-0", "wordpress", 2, 10, params.StableChannel)
+	wordpress := addCharm("1 ~charmers/trusty/wordpress-1", "wordpress", 2, 0, params.StableChannel)
+	mysql := addCharm("0 ~charmers/trusty/mysql-0", "mysql", 5, 0, params.StableChannel)
+	varnish := addCharm("~bob/trusty/varnish-0", "varnish", 1, 0, params.StableChannel)
+	logging := addCharm("~bob/trusty/logging-0", "logging", 20, 0, params.EdgeChannel)
+	addCharm("~bob/trusty/riak-0", "riak", 30, 0)
+
+	// A bundle is never included.
+	bundleId := charmstore.MustParseResolvedURL("~charmers/bundle/wordpress-simple-0")
+	err := s.store.AddBundleWithArchive(bundleId, storetesting.Charms.BundleDir("wordpress-simple"))
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.Publish(bundleId, nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	setDownloadCounts(c, s.store, bundleId, now, 50)
+
+	ids, err := s.store.TopCharms(params.StableChannel, since, 0, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(ids, jc.DeepEquals, []*router.ResolvedURL{mysql, wordpress, varnish})
+
+	ids, err = s.store.TopCharms(params.StableChannel, since, 2, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(ids, jc.DeepEquals, []*router.ResolvedURL{mysql, wordpress})
+
+	// NoChannel is treated as the stable channel.
+	ids, err = s.store.TopCharms(params.NoChannel, since, 1, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(ids, jc.DeepEquals, []*router.ResolvedURL{mysql})
+
+	ids, err = s.store.TopCharms(params.EdgeChannel, since, 0, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(ids, jc.DeepEquals, []*router.ResolvedURL{logging})
+
+	// Downloads before the window change the ranking when they
+	// are included.
+	ids, err = s.store.TopCharms(params.StableChannel, since.AddDate(0, 0, -1), 0, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(ids, jc.DeepEquals, []*router.ResolvedURL{wordpress, mysql, varnish})
+
+	// Charms that are not allowed are omitted before the
+	// limit is applied.
+	ids, err = s.store.TopCharms(params.StableChannel, since, 2, func(id *router.ResolvedURL) bool {
+		return id.URL != mysql.URL
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(ids, jc.DeepEquals, []*router.ResolvedURL{wordpress, varnish})
+
+	// The ranking is cached, so new downloads are not
+	// taken into account until the cache expires.
+	setDownloadCounts(c, s.store, varnish, now, 100)
+	ids, err = s.store.TopCharms(params.StableChannel, since, 0, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(ids, jc.DeepEquals, []*router.ResolvedURL{mysql, wordpress, varnish})
+}
@@ -15,6 +15,7 @@ import (
 	"github.com/juju/charmrepo/v6/csclient/params"
 	"github.com/juju/loggo"
 	"github.com/juju/utils/parallel"
+	"golang.org/x/net/context"
 	"gopkg.in/errgo.v1"
 	"gopkg.in/macaroon-bakery.v2-unstable/bakery"
 	"gopkg.in/macaroon-bakery.v2-unstable/bakery/mgostorage"
@@ -51,11 +52,29 @@ type Pool struct {
 	// statsCache holds a cache of AggregatedCounts
 	// values, keyed by entity id. When the id has no
 	// revision, the counts apply to all revisions of the
-	// entity.
+	// entity. It also holds the StoreSummary, keyed
+	// by storeSummaryCacheKey, and the download rankings
+	// used by TopCharms.
 	statsCache *cache.Cache
 
+	// groupMembersCache holds a cache of the members of
+	// identity-service groups, keyed by group name.
+	groupMembersCache *cache.Cache
+
 	config ServerParams
 
+	// blobPrefix holds the prefix of the collections used
+	// by the blob store, including any collection prefix.
+	blobPrefix string
+
+	// blobKeys holds the keys used to encrypt and decrypt
+	// blobs. It is nil when blob encryption is not configured.
+	blobKeys *blobstore.EncryptionKeys
+
+	// blobCache holds the local disk cache of blobs shared by
+	// all the pool's stores. It is nil when no cache is configured.
+	blobCache *blobstore.DiskCache
+
 	// auditEncoder encodes messages to auditLogger.
 	auditEncoder *json.Encoder
 	auditLogger  *lumberjack.Logger
@@ -75,13 +94,39 @@ type Pool struct {
 
 	// rootKeys holds the cache of macaroon root keys.
 	rootKeys *mgostorage.RootKeys
+
+	// reindexJobs holds the functions that cancel the reindex
+	// jobs running in this pool, keyed by job id.
+	reindexJobs map[string]context.CancelFunc
+
+	// webhookC holds the queue of ingestion error notifications
+	// waiting to be delivered. It is nil when no
+	// IngestionErrorWebhook is configured.
+	webhookC chan *IngestionErrorNotification
+
+	// webhookCancel stops the webhook delivery goroutine, which
+	// closes webhookDone when it has finished.
+	webhookCancel func()
+	webhookDone   chan struct{}
 }
 
+// defaultBlobCacheMaxSize holds the maximum size of the local blob
+// cache when ServerParams.BlobCacheMaxSize is zero.
+const defaultBlobCacheMaxSize = 1 << 30
+
 // reqStoreCacheSize holds the maximum number of store
 // instances to keep around cached when there is no
 // limit specified by config.MaxMgoSessions.
 const reqStoreCacheSize = 50
 
+// defaultBlobStorePrefix holds the prefix of the collections used by
+// the blob store when ServerParams.BlobStorePrefix is empty.
+const defaultBlobStorePrefix = "entitystore"
+
+// auditEntryMaxAge holds the length of time that entries are kept
+// in the audit collection before they are removed by MongoDB.
+const auditEntryMaxAge = 365 * 24 * time.Hour
+
 // maxAsyncGoroutines holds the maximum number
 // of goroutines that will be started by Store.Go.
 const maxAsyncGoroutines = 50
@@ -97,20 +142,68 @@ func NewPool(db *mgo.Database, si *SearchIndex, bakeryParams *bakery.NewServiceP
 	if config.StatsCacheMaxAge == 0 {
 		config.StatsCacheMaxAge = time.Hour
 	}
+	blobPrefix := config.BlobStorePrefix
+	if blobPrefix == "" {
+		blobPrefix = defaultBlobStorePrefix
+	}
+	blobPrefix = config.CollectionPrefix + blobPrefix
 	if config.NewBlobBackend == nil {
 		config.NewBlobBackend = func(db *mgo.Database) blobstore.Backend {
-			return blobstore.NewMongoBackend(db, "entitystore")
+			return blobstore.NewMongoBackend(db, blobPrefix)
+		}
+		if config.CompressBlobs {
+			config.NewBlobBackend = func(db *mgo.Database) blobstore.Backend {
+				return blobstore.NewCompressedMongoBackend(db, blobPrefix)
+			}
 		}
 	}
 
 	p := &Pool{
-		db:          StoreDatabase{db}.copy(),
-		es:          si,
-		statsCache:  cache.New(config.StatsCacheMaxAge),
-		config:      config,
-		run:         parallel.NewRun(maxAsyncGoroutines),
-		auditLogger: config.AuditLogger,
-		rootKeys:    mgostorage.NewRootKeys(100),
+		db: StoreDatabase{
+			Database: db,
+			prefix:   config.CollectionPrefix,
+		}.copy(),
+		blobPrefix:        blobPrefix,
+		es:                si,
+		statsCache:        cache.New(config.StatsCacheMaxAge),
+		groupMembersCache: cache.New(groupMembersCacheMaxAge),
+		config:            config,
+		run:               parallel.NewRun(maxAsyncGoroutines),
+		auditLogger:       config.AuditLogger,
+		rootKeys:          mgostorage.NewRootKeys(100),
+	}
+	if err := checkUploadBlocklist(config.UploadBlocklist); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if config.BlobStoreShardDepth < 0 || config.BlobStoreShardDepth > blobstore.MaxShardDepth {
+		return nil, errgo.Newf("invalid blob store shard depth %d", config.BlobStoreShardDepth)
+	}
+	if config.MongoRetryAttempts < 0 || config.MongoRetryAttempts > maxMongoRetryAttempts {
+		return nil, errgo.Newf("invalid mongo retry attempts %d", config.MongoRetryAttempts)
+	}
+	if config.CompressBlobs && (len(config.BlobEncryptionKeys) > 0 || config.BlobEncryptionKeyID != "") {
+		return nil, errgo.New("cannot compress encrypted blobs")
+	}
+	if config.BlobCacheDir != "" && (len(config.BlobEncryptionKeys) > 0 || config.BlobEncryptionKeyID != "") {
+		return nil, errgo.New("cannot cache encrypted blobs on disk")
+	}
+	if len(config.BlobEncryptionKeys) > 0 || config.BlobEncryptionKeyID != "" {
+		keys, err := blobstore.NewEncryptionKeys(config.BlobEncryptionKeys, config.BlobEncryptionKeyID)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot set up blob encryption")
+		}
+		p.blobKeys = keys
+	}
+	if config.BlobCacheDir != "" {
+		maxSize := config.BlobCacheMaxSize
+		if maxSize == 0 {
+			maxSize = defaultBlobCacheMaxSize
+		}
+		blobCache, err := blobstore.NewDiskCache(config.BlobCacheDir, maxSize)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot set up blob cache")
+		}
+		p.blobCache = blobCache
 	}
 	if config.MaxMgoSessions > 0 {
 		p.reqStoreC = make(chan *Store, config.MaxMgoSessions)
@@ -140,6 +233,7 @@ func NewPool(db *mgo.Database, si *SearchIndex, bakeryParams *bakery.NewServiceP
 			return nil, errgo.Notef(err, "cannot ensure elasticsearch indexes")
 		}
 	}
+	p.startWebhookWorker()
 	return p, nil
 }
 
@@ -152,8 +246,12 @@ func (p *Pool) Close() {
 		return
 	}
 	p.closed = true
+	for _, cancel := range p.reindexJobs {
+		cancel()
+	}
 	p.mu.Unlock()
 	p.run.Wait()
+	p.stopWebhookWorker()
 	p.db.Close()
 	// Close all cached stores. Any used by
 	// outstanding requests will be closed when the
@@ -195,7 +293,17 @@ func (p *Pool) RequestStore() (*Store, error) {
 
 func (p *Pool) newBlobStore(db StoreDatabase) *blobstore.Store {
 	backend := p.config.NewBlobBackend(db.Database)
-	bs := blobstore.New(db.Database, "entitystore", backend)
+	if p.config.NewSecondaryBlobBackend != nil {
+		backend = blobstore.NewFailoverBackend(backend, p.config.NewSecondaryBlobBackend(db.Database))
+	}
+	if p.config.BlobStoreShardDepth > 0 {
+		backend = blobstore.NewShardedBackend(backend, p.config.BlobStoreShardDepth)
+	}
+	if p.blobKeys != nil {
+		backend = blobstore.NewEncryptedBackend(backend, p.blobKeys, "")
+	}
+	bs := blobstore.New(db.Database, p.blobPrefix, backend)
+	bs.Cache = p.blobCache
 	if p.config.MinUploadPartSize != 0 {
 		bs.MinPartSize = p.config.MinUploadPartSize
 	}
@@ -205,9 +313,20 @@ func (p *Pool) newBlobStore(db StoreDatabase) *blobstore.Store {
 	if p.config.MaxUploadParts != 0 {
 		bs.MaxParts = p.config.MaxUploadParts
 	}
+	bs.OnRemove = p.invalidateBlob
 	return bs
 }
 
+// invalidateBlob notifies the configured BlobInvalidator, if any,
+// that the blob with the given hash should no longer be cached.
+// It does not wait for the notification to be delivered.
+func (p *Pool) invalidateBlob(hash string) {
+	if p.config.BlobInvalidator == nil {
+		return
+	}
+	go p.config.BlobInvalidator(hash)
+}
+
 // Store returns a Store that can be used to access the database.
 //
 // It must be closed (with the Close method) after use.
@@ -269,6 +388,9 @@ type Store struct {
 	Bakery         *bakery.Service
 	LongTermBakery *bakery.Service
 	pool           *Pool
+
+	// tracer holds the tracer set by SetTracer, if any.
+	tracer *Tracer
 }
 
 // Copy returns a new store with a lifetime
@@ -297,6 +419,7 @@ func (s *Store) Close() {
 	// a new connection from the pool as if the
 	// session had been copied.
 	s.DB.Session.Refresh()
+	s.tracer = nil
 
 	s.pool.mu.Lock()
 	defer s.pool.mu.Unlock()
@@ -355,6 +478,9 @@ func (s *Store) ensureIndexes() error {
 	}, {
 		s.DB.Entities(),
 		mgo.Index{Key: []string{"uploadtime"}},
+	}, {
+		s.DB.Entities(),
+		mgo.Index{Key: []string{"source"}, Sparse: true},
 	}, {
 		s.DB.Entities(),
 		mgo.Index{Key: []string{"promulgated-url"}, Unique: true, Sparse: true},
@@ -403,9 +529,12 @@ func (s *Store) ensureIndexes() error {
 	}, {
 		s.DB.Resources(),
 		mgo.Index{Key: []string{"baseurl", "name", "revision"}, Unique: true},
+	}, {
+		s.DB.Resources(),
+		mgo.Index{Key: []string{"blobhash"}},
 	}, {
 		// TODO this index should be created by the mgo gridfs code.
-		s.DB.C("entitystore.files"),
+		s.DB.Database.C(s.pool.blobPrefix + ".files"),
 		mgo.Index{Key: []string{"filename"}},
 	}, {
 		s.DB.Revisions(),
@@ -419,7 +548,38 @@ func (s *Store) ensureIndexes() error {
 	}, {
 		s.DB.DownloadCounts(),
 		mgo.Index{Key: []string{"expires"}, Sparse: true, ExpireAfter: time.Hour},
+	}, {
+		s.DB.APITokens(),
+		mgo.Index{Key: []string{"user"}},
+	}, {
+		s.DB.APITokens(),
+		mgo.Index{Key: []string{"expires"}, ExpireAfter: time.Hour},
+	}, {
+		s.DB.Audit(),
+		mgo.Index{Key: []string{"baseurl", "-time", "-_id"}},
+	}, {
+		s.DB.Audit(),
+		mgo.Index{Key: []string{"time"}, ExpireAfter: auditEntryMaxAge},
+	}, {
+		s.DB.PendingPublishes(),
+		mgo.Index{Key: []string{"time"}},
+	}, {
+		s.DB.PublishEvents(),
+		mgo.Index{Key: []string{"channel", "-time"}},
+	}, {
+		s.DB.ReindexJobs(),
+		mgo.Index{Key: []string{"running"}, Unique: true, Sparse: true},
+	}, {
+		s.DB.ReindexJobs(),
+		mgo.Index{Key: []string{"finishtime"}, ExpireAfter: reindexJobMaxAge},
 	}}
+	// The publish events collection must be created as capped before
+	// its index creates it implicitly. We ignore the error because
+	// we'll get one if the collection already exists.
+	s.DB.PublishEvents().Create(&mgo.CollectionInfo{
+		Capped:   true,
+		MaxBytes: publishEventsMaxBytes,
+	})
 	for _, idx := range indexes {
 		err := idx.c.EnsureIndex(idx.i)
 		if err != nil {
@@ -494,26 +654,120 @@ func (s *Store) BlobStoreGC(before time.Time) error {
 	return nil
 }
 
-// AddAudit adds the given entry to the audit log.
+// AddAudit adds the given entry to the audit log. The entry is
+// recorded in the audit collection, where it can be retrieved
+// with EntityAuditHistory, and written to the audit logger if
+// one has been configured.
 func (s *Store) AddAudit(entry audit.Entry) {
 	s.addAuditAtTime(entry, time.Now())
 }
 
 func (s *Store) addAuditAtTime(entry audit.Entry, t time.Time) {
+	entry.Time = t
+	doc := mongodoc.AuditEntry{
+		Id:    bson.NewObjectId(),
+		Entry: entry,
+	}
+	if entry.Entity != nil {
+		doc.BaseURL = mongodoc.BaseURL(entry.Entity)
+	}
+	if err := s.DB.Audit().Insert(&doc); err != nil {
+		logger.Errorf("Cannot store audit log entry: %v", err)
+	}
 	if s.pool.auditEncoder == nil {
 		return
 	}
-	entry.Time = t
 	err := s.pool.auditEncoder.Encode(entry)
 	if err != nil {
 		logger.Errorf("Cannot write audit log entry: %v", err)
 	}
 }
 
+// entityAuditOps holds the operations that apply to all
+// revisions of an entity, and so are included in the audit
+// history of each revision.
+var entityAuditOps = []audit.Operation{
+	audit.OpSetPerm,
+	audit.OpPromulgate,
+	audit.OpUnpromulgate,
+}
+
+// EntityAuditHistory returns at most limit entries from the audit log
+// that refer to the entity with the given URL, which must include a
+// user, most recent first. If the URL has no revision, entries for
+// all revisions are returned; otherwise only entries for the given
+// revision and entries that apply to all revisions, such as
+// permission changes, are returned. If limit is zero, all entries
+// are returned.
+func (s *Store) EntityAuditHistory(url *charm.URL, limit int) ([]audit.Entry, error) {
+	if url.User == "" {
+		return nil, errgo.Newf("no user specified in %q", url)
+	}
+	query := bson.D{{"baseurl", mongodoc.BaseURL(url)}}
+	if url.Revision != -1 {
+		query = append(query, bson.DocElem{"$or", []bson.D{
+			{{"entity", url}},
+			{{"op", bson.D{{"$in", entityAuditOps}}}},
+		}})
+	}
+	var docs []mongodoc.AuditEntry
+	if err := s.DB.Audit().Find(query).Sort("-time", "-_id").Limit(limit).All(&docs); err != nil {
+		return nil, errgo.Notef(err, "cannot retrieve audit history of %q", url)
+	}
+	entries := make([]audit.Entry, len(docs))
+	for i, doc := range docs {
+		entries[i] = doc.Entry
+	}
+	return entries, nil
+}
+
+// defaultNewRevisionMaxAttempts holds the maximum number of attempts
+// made by NewRevision when ServerParams.NewRevisionMaxAttempts is zero.
+const defaultNewRevisionMaxAttempts = 10
+
+// newRevisionRetryDelay holds the time that NewRevision waits before
+// its first retry. The delay doubles after each further collision.
+var newRevisionRetryDelay = 10 * time.Millisecond
+
+var testNewRevisionCollision func(id *charm.URL) bool
+
 // NewRevision returns a new revision number for the
 // given entity URL.
+//
+// If the allocation repeatedly collides with concurrent allocations
+// for the same id, it gives up after ServerParams.NewRevisionMaxAttempts
+// attempts and returns an error with a params.ErrServiceUnavailable
+// cause.
 func (s *Store) NewRevision(id *charm.URL) (int, error) {
 	id = id.WithRevision(-1)
+	maxAttempts := s.pool.config.NewRevisionMaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultNewRevisionMaxAttempts
+	}
+	delay := newRevisionRetryDelay
+	for i := 0; i < maxAttempts; i++ {
+		if i > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+		if testNewRevisionCollision != nil && testNewRevisionCollision(id) {
+			continue
+		}
+		rev, ok, err := s.newRevision(id)
+		if err != nil {
+			return 0, errgo.Mask(err)
+		}
+		if ok {
+			return rev, nil
+		}
+	}
+	return 0, errgo.WithCausef(nil, params.ErrServiceUnavailable, "cannot obtain new revision for %s: too many concurrent allocations after %d attempts", id, maxAttempts)
+}
+
+// newRevision makes a single attempt to allocate a new revision number
+// for the given unrevisioned id. It returns false if the attempt
+// collided with a concurrent allocation and should be retried.
+func (s *Store) newRevision(id *charm.URL) (int, bool, error) {
 	col := s.DB.Revisions()
 	change := mgo.Change{
 		Update:    bson.D{{"$inc", bson.D{{"revision", 1}}}},
@@ -522,21 +776,26 @@ func (s *Store) NewRevision(id *charm.URL) (int, error) {
 	var doc mongodoc.LatestRevision
 	_, err := col.FindId(id).Apply(change, &doc)
 	if err == nil {
-		return doc.Revision, nil
+		return doc.Revision, true, nil
 	}
 	if err != mgo.ErrNotFound {
-		return 0, errgo.Notef(err, "cannot obtain new revision")
+		return 0, false, errgo.Notef(err, "cannot obtain new revision")
 	}
 	// This is the first revision of a given name.
-	firstRev := 0
+	firstRev, err := s.revisionBase(id)
+	if err != nil {
+		return 0, false, errgo.Mask(err)
+	}
 	if id.Series == "" {
 		// It's multi-series. Choose a revision that's greater
 		// than any existing single-series variant.
 		err := col.Find(bson.D{{"baseurl", mongodoc.BaseURL(id)}}).Sort("-revision").One(&doc)
 		if err == nil {
-			firstRev = doc.Revision + 1
+			if doc.Revision >= firstRev {
+				firstRev = doc.Revision + 1
+			}
 		} else if err != mgo.ErrNotFound {
-			return 0, errgo.Notef(err, "cannot find latest single-series revision")
+			return 0, false, errgo.Notef(err, "cannot find latest single-series revision")
 		}
 	}
 	err = col.Insert(mongodoc.LatestRevision{
@@ -545,11 +804,14 @@ func (s *Store) NewRevision(id *charm.URL) (int, error) {
 		Revision: firstRev,
 	})
 	if mgo.IsDup(err) {
-		// We were in a race and they won. Recur to
+		// We were in a race and they won. Retry to
 		// use the usual increment method to find the id.
-		return s.NewRevision(id)
+		return 0, false, nil
 	}
-	return firstRev, nil
+	if err != nil {
+		return 0, false, errgo.Notef(err, "cannot insert first revision")
+	}
+	return firstRev, true, nil
 }
 
 // AddRevision records a new revision of the given id,
@@ -572,7 +834,16 @@ func (s *Store) AddRevision(id *router.ResolvedURL) error {
 func (s *Store) addRevision(id *charm.URL) error {
 	rev := id.Revision
 	id = id.WithRevision(-1)
-	_, err := s.DB.Revisions().Upsert(bson.D{
+	base, err := s.revisionBase(id)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if rev < base-1 {
+		// Make sure that subsequent new revisions
+		// start from the revision base.
+		rev = base - 1
+	}
+	_, err = s.DB.Revisions().Upsert(bson.D{
 		{"_id", id},
 		{"revision", bson.D{{"$lt", rev}}},
 	}, mongodoc.LatestRevision{
@@ -593,18 +864,88 @@ func (s *Store) addRevision(id *charm.URL) error {
 	return errgo.Notef(err, "cannot add revision")
 }
 
+// SetRevisionBase sets the lowest revision number that will be
+// allocated by NewRevision for any id with the given base URL (for
+// example cs:~bob/wordpress). Revisions of existing entities are
+// unaffected, but subsequently allocated revisions will be no lower
+// than base. The base must be greater than any revision already
+// allocated for the base URL.
+func (s *Store) SetRevisionBase(baseURL *charm.URL, base int) error {
+	if baseURL.Series != "" || baseURL.Revision != -1 {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "%q is not a base URL", baseURL)
+	}
+	if base < 0 {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "invalid revision base %d", base)
+	}
+	var doc mongodoc.LatestRevision
+	err := s.DB.Revisions().Find(bson.D{{"baseurl", baseURL}}).Sort("-revision").One(&doc)
+	if err == nil {
+		if doc.Revision >= base {
+			return errgo.WithCausef(nil, params.ErrBadRequest, "revision base %d is not greater than existing revision %d of %s", base, doc.Revision, doc.URL)
+		}
+	} else if err != mgo.ErrNotFound {
+		return errgo.Notef(err, "cannot find latest revision")
+	}
+	if _, err := s.DB.RevisionBases().UpsertId(baseURL, mongodoc.RevisionBase{
+		BaseURL: baseURL,
+		Base:    base,
+	}); err != nil {
+		return errgo.Notef(err, "cannot set revision base")
+	}
+	// Bring any existing revision counters up to the base so
+	// that the next revision allocated for them is base.
+	if _, err := s.DB.Revisions().UpdateAll(bson.D{
+		{"baseurl", baseURL},
+		{"revision", bson.D{{"$lt", base - 1}}},
+	}, bson.D{{"$set", bson.D{{"revision", base - 1}}}}); err != nil {
+		return errgo.Notef(err, "cannot update revisions")
+	}
+	return nil
+}
+
+// revisionBase returns the revision base set for the base URL
+// of the given id, or zero if none has been set.
+func (s *Store) revisionBase(id *charm.URL) (int, error) {
+	var doc mongodoc.RevisionBase
+	err := s.DB.RevisionBases().FindId(mongodoc.BaseURL(id)).One(&doc)
+	if err == mgo.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, errgo.Notef(err, "cannot get revision base")
+	}
+	return doc.Base, nil
+}
+
 // FindEntity finds the entity in the store with the given URL, which
 // must be fully qualified. If the given URL has no user then it is
 // assumed to be a promulgated entity. If fields is not nil, only its
 // fields will be populated in the returned entities.
-func (s *Store) FindEntity(url *router.ResolvedURL, fields map[string]int) (*mongodoc.Entity, error) {
+//
+// The read is retried after transient mongo errors as configured by
+// ServerParams.MongoRetryAttempts.
+func (s *Store) FindEntity(url *router.ResolvedURL, fields map[string]int) (_ *mongodoc.Entity, err error) {
+	sp := s.startSpan("FindEntity", "entities")
+	defer func() {
+		sp.done(err)
+	}()
+	var entity *mongodoc.Entity
+	err = s.retryRead("FindEntity", func() error {
+		var err error
+		entity, err = s.findEntity(url, fields)
+		return err
+	})
+	return entity, err
+}
+
+// findEntity implements FindEntity without retries.
+func (s *Store) findEntity(url *router.ResolvedURL, fields map[string]int) (*mongodoc.Entity, error) {
 	q := s.DB.Entities().Find(bson.D{{"_id", &url.URL}})
 	if fields != nil {
 		q = q.Select(fields)
 	}
 	var entity mongodoc.Entity
-	err := q.One(&entity)
-	if err != nil {
+	if err := q.One(&entity); err != nil {
 		if err == mgo.ErrNotFound {
 			return nil, errgo.WithCausef(nil, params.ErrNotFound, "entity not found")
 		}
@@ -613,6 +954,121 @@ func (s *Store) FindEntity(url *router.ResolvedURL, fields map[string]int) (*mon
 	return &entity, nil
 }
 
+// PreferredURLs returns the preferred URL for each of the given ids,
+// keyed by the string form of the id's canonical URL. The preferred
+// URL is the promulgated URL when the entity is promulgated, and the
+// canonical URL otherwise (see mongodoc.Entity.PreferredURL). Ids
+// that do not refer to an existing entity are omitted from the
+// result. All the entities are found with a single query.
+func (s *Store) PreferredURLs(urls []*router.ResolvedURL) (map[string]*charm.URL, error) {
+	if len(urls) == 0 {
+		return map[string]*charm.URL{}, nil
+	}
+	ids := make([]*charm.URL, len(urls))
+	for i, url := range urls {
+		ids[i] = &url.URL
+	}
+	var entities []*mongodoc.Entity
+	if err := s.DB.Entities().
+		Find(bson.D{{"_id", bson.D{{"$in", ids}}}}).
+		Select(FieldSelector("promulgated-url")).
+		All(&entities); err != nil {
+		return nil, errgo.Notef(err, "cannot find entities")
+	}
+	preferred := make(map[string]*charm.URL, len(entities))
+	for _, entity := range entities {
+		preferred[entity.URL.String()] = entity.PreferredURL(true)
+	}
+	return preferred, nil
+}
+
+// BundlesContaining returns the ids of the bundles that reference any
+// revision or series of the given charm and are published to the
+// given channel, ordered by id. NoChannel is treated as
+// params.StableChannel; params.UnpublishedChannel matches bundles
+// regardless of where they are published. Bundles may refer to a
+// promulgated charm either by its promulgated URL or by its owner's
+// URL, so both forms are matched.
+func (s *Store) BundlesContaining(charmURL *charm.URL, channel params.Channel) ([]*router.ResolvedURL, error) {
+	ids := []*charm.URL{mongodoc.BaseURL(charmURL)}
+	baseEntity, err := s.FindBaseEntity(charmURL, FieldSelector("promulgated"))
+	switch {
+	case err == nil:
+		ids = append(ids, baseEntity.URL)
+		if baseEntity.Promulgated {
+			promulgatedURL := *baseEntity.URL
+			promulgatedURL.User = ""
+			ids = append(ids, &promulgatedURL)
+		}
+	case errgo.Cause(err) != params.ErrNotFound:
+		return nil, errgo.Mask(err)
+	}
+	query := bson.D{{"bundlecharms", bson.D{{"$in", ids}}}}
+	switch channel {
+	case params.UnpublishedChannel:
+	case params.NoChannel:
+		channel = params.StableChannel
+		fallthrough
+	default:
+		query = append(query, bson.DocElem{"published." + string(channel), true})
+	}
+	var entities []*mongodoc.Entity
+	if err := s.DB.Entities().
+		Find(query).
+		Select(FieldSelector("promulgated-url")).
+		Sort("_id").
+		All(&entities); err != nil {
+		return nil, errgo.Notef(err, "cannot find bundles containing %s", charmURL)
+	}
+	urls := make([]*router.ResolvedURL, len(entities))
+	for i, entity := range entities {
+		urls[i] = EntityResolvedURL(entity)
+	}
+	return urls, nil
+}
+
+// FilterPublished returns the members of urls that are published to
+// the given channel, in their original order. NoChannel is treated as
+// params.StableChannel; params.UnpublishedChannel matches all the
+// entities that exist. All the entities are checked with a single
+// query, so this is cheaper than resolving each id in turn.
+func (s *Store) FilterPublished(urls []*router.ResolvedURL, channel params.Channel) ([]*router.ResolvedURL, error) {
+	if len(urls) == 0 {
+		return nil, nil
+	}
+	ids := make([]*charm.URL, len(urls))
+	for i, url := range urls {
+		ids[i] = &url.URL
+	}
+	query := bson.D{{"_id", bson.D{{"$in", ids}}}}
+	switch channel {
+	case params.UnpublishedChannel:
+	case params.NoChannel:
+		channel = params.StableChannel
+		fallthrough
+	default:
+		query = append(query, bson.DocElem{"published." + string(channel), true})
+	}
+	var entities []*mongodoc.Entity
+	if err := s.DB.Entities().
+		Find(query).
+		Select(bson.D{{"_id", 1}}).
+		All(&entities); err != nil {
+		return nil, errgo.Notef(err, "cannot find entities published to %s", channel)
+	}
+	published := make(map[string]bool, len(entities))
+	for _, entity := range entities {
+		published[entity.URL.String()] = true
+	}
+	var filtered []*router.ResolvedURL
+	for _, url := range urls {
+		if published[url.URL.String()] {
+			filtered = append(filtered, url)
+		}
+	}
+	return filtered, nil
+}
+
 // FindEntities finds all entities in the store matching the given URL.
 // If the given URL has no user then only promulgated entities will be
 // queried. If the given URL channel does not represent an entity under
@@ -632,6 +1088,114 @@ func (s *Store) FindEntities(url *charm.URL, fields map[string]int) ([]*mongodoc
 	return docs, nil
 }
 
+// IterEntityURLs returns an iterator over the ids of all entities
+// matching the given filter. Only the _id and promulgated-url fields
+// are fetched from the database, which makes it suitable for scanning
+// large numbers of entities.
+func (s *Store) IterEntityURLs(filter bson.D) (*EntityURLIter, error) {
+	iter := s.DB.Entities().Find(filter).Select(FieldSelector("_id", "promulgated-url")).Iter()
+	return &EntityURLIter{
+		iter: iter,
+	}, nil
+}
+
+// EntityURLIter iterates over the ids of a set of entities.
+// See Store.IterEntityURLs.
+type EntityURLIter struct {
+	iter   *mgo.Iter
+	entity mongodoc.Entity
+	err    error
+}
+
+// Next reports whether there are any more entities available from the
+// iterator. The iterator is automatically closed when Next returns
+// false.
+func (i *EntityURLIter) Next() bool {
+	i.entity = mongodoc.Entity{}
+	if i.iter.Next(&i.entity) {
+		return true
+	}
+	i.Close()
+	return false
+}
+
+// Entity returns the current entity. Only the URL and PromulgatedURL
+// fields are populated. The returned entity is only valid until the
+// next call to Next.
+func (i *EntityURLIter) Entity() *mongodoc.Entity {
+	return &i.entity
+}
+
+// Close closes the iterator. This must be called if the iterator is
+// abandoned without reaching its end.
+func (i *EntityURLIter) Close() {
+	if err := i.iter.Close(); err != nil && i.err == nil {
+		i.err = errgo.Mask(err)
+	}
+}
+
+// Err returns any error encountered by the iterator.
+func (i *EntityURLIter) Err() error {
+	return i.err
+}
+
+// EntitiesByUploadTime returns an iterator over all entities uploaded
+// at or after start and before end, in order of upload time. If any
+// fields are specified, only those fields will be populated in the
+// returned entities. Backfill jobs can process large numbers of
+// entities in time order by splitting the time into windows, which
+// may be processed in parallel.
+func (s *Store) EntitiesByUploadTime(start, end time.Time, fields ...string) *EntityIter {
+	iter := s.DB.Entities().Find(bson.D{
+		{"uploadtime", bson.D{
+			{"$gte", start},
+			{"$lt", end},
+		}},
+	}).Sort("uploadtime").Select(FieldSelector(fields...)).Iter()
+	return &EntityIter{
+		iter: iter,
+	}
+}
+
+// EntityIter iterates over a set of entities.
+// See Store.EntitiesByUploadTime.
+type EntityIter struct {
+	iter   *mgo.Iter
+	entity mongodoc.Entity
+	err    error
+}
+
+// Next reports whether there are any more entities available from the
+// iterator. The iterator is automatically closed when Next returns
+// false.
+func (i *EntityIter) Next() bool {
+	i.entity = mongodoc.Entity{}
+	if i.iter.Next(&i.entity) {
+		return true
+	}
+	i.Close()
+	return false
+}
+
+// Entity returns the current entity. The returned entity is only valid
+// until the next call to Next.
+func (i *EntityIter) Entity() *mongodoc.Entity {
+	return &i.entity
+}
+
+// Close closes the iterator. This must be called if the iterator is
+// abandoned without reaching its end.
+func (i *EntityIter) Close() {
+	if err := i.iter.Close(); err != nil && i.err == nil {
+		i.err = errgo.Mask(err)
+	}
+}
+
+// Err returns any error encountered by the iterator.
+func (i *EntityIter) Err() error {
+	return i.err
+}
+
 // FindBestEntity finds the entity that provides the preferred match to
 // the given URL, on the given channel. If the given URL has no user
 // then only promulgated entities will be queried. If fields is not nil,
@@ -644,6 +1208,44 @@ func (s *Store) FindEntities(url *charm.URL, fields map[string]int) ([]*mongodoc
 // for the best match, here NoChannel will be treated as
 // params.StableChannel.
 func (s *Store) FindBestEntity(url *charm.URL, channel params.Channel, fields map[string]int) (*mongodoc.Entity, error) {
+	return s.FindBestEntityAt(url, channel, time.Time{}, fields)
+}
+
+// FindBestEntityAt is like FindBestEntity except that, when the URL
+// does not contain a revision and the channel is not
+// params.UnpublishedChannel, the best match is chosen from the entities
+// that were current in the channel at the given time, as recorded in
+// the base entity's publish history. If t is zero, the entities
+// currently published are used.
+func (s *Store) FindBestEntityAt(url *charm.URL, channel params.Channel, t time.Time, fields map[string]int) (*mongodoc.Entity, error) {
+	return s.FindBestEntityForArch(url, channel, t, "", fields)
+}
+
+// FindBestEntityForArch is like FindBestEntityAt except that, when the
+// URL does not contain a revision and arch is not empty, only entities
+// that can be deployed to the given architecture are considered.
+// Entities that declare no architectures are assumed to support all of
+// them. If no matching entity supports the architecture, an error with
+// a params.ErrNotFound cause is returned.
+//
+// The read is retried after transient mongo errors as configured by
+// ServerParams.MongoRetryAttempts.
+func (s *Store) FindBestEntityForArch(url *charm.URL, channel params.Channel, t time.Time, arch string, fields map[string]int) (_ *mongodoc.Entity, err error) {
+	sp := s.startSpan("FindBestEntity", "entities")
+	defer func() {
+		sp.done(err)
+	}()
+	var entity *mongodoc.Entity
+	err = s.retryRead("FindBestEntity", func() error {
+		var err error
+		entity, err = s.findBestEntity(url, channel, t, arch, fields)
+		return err
+	})
+	return entity, err
+}
+
+// findBestEntity implements FindBestEntityForArch without retries.
+func (s *Store) findBestEntity(url *charm.URL, channel params.Channel, t time.Time, arch string, fields map[string]int) (*mongodoc.Entity, error) {
 	if fields != nil {
 		// Make sure we have all the fields we need to make a decision.
 		// TODO this would be more efficient if we used bitmasks for field selection.
@@ -655,6 +1257,9 @@ func (s *Store) FindBestEntity(url *charm.URL, channel params.Channel, fields ma
 			"revision":             1,
 			"published":            1,
 		}
+		if arch != "" && url.Revision == -1 {
+			nfields["architectures"] = 1
+		}
 		for f := range fields {
 			nfields[f] = 1
 		}
@@ -679,13 +1284,70 @@ func (s *Store) FindBestEntity(url *charm.URL, channel params.Channel, fields ma
 
 	switch channel {
 	case params.UnpublishedChannel:
-		return s.findUnpublishedEntity(url, fields)
+		return s.findUnpublishedEntity(url, arch, fields)
 	case params.NoChannel:
 		channel = params.StableChannel
 		fallthrough
 	default:
-		return s.findEntityInChannel(url, channel, fields)
+		if !t.IsZero() {
+			return s.findEntityInChannelAt(url, channel, t, arch, fields)
+		}
+		return s.findEntityInChannel(url, channel, arch, fields)
+	}
+}
+
+// supportsArch reports whether the given entity can be deployed to the
+// given architecture. An empty arch is supported by all entities.
+func supportsArch(e *mongodoc.Entity, arch string) bool {
+	if arch == "" || len(e.Architectures) == 0 {
+		return true
+	}
+	for _, a := range e.Architectures {
+		if a == arch {
+			return true
+		}
+	}
+	return false
+}
+
+// filterEntityURLsByArch returns the entries in the given map of series
+// to entity ids that refer to entities supporting the given
+// architecture. If arch is empty, entities is returned unchanged.
+func (s *Store) filterEntityURLsByArch(entities map[string]*charm.URL, arch string) (map[string]*charm.URL, error) {
+	if arch == "" || len(entities) == 0 {
+		return entities, nil
+	}
+	urls := make([]*charm.URL, 0, len(entities))
+	for _, u := range entities {
+		urls = append(urls, u)
+	}
+	var docs []mongodoc.Entity
+	if err := s.DB.Entities().Find(bson.D{
+		{"_id", bson.D{{"$in", urls}}},
+		{"architectures", bson.D{{"$in", []interface{}{arch, nil}}}},
+	}).Select(bson.D{{"_id", 1}}).All(&docs); err != nil {
+		return nil, errgo.Notef(err, "cannot find entities supporting %q", arch)
+	}
+	supported := make(map[charm.URL]bool)
+	for _, d := range docs {
+		supported[*d.URL] = true
+	}
+	filtered := make(map[string]*charm.URL)
+	for series, u := range entities {
+		if supported[*u] {
+			filtered[series] = u
+		}
+	}
+	return filtered, nil
+}
+
+// archNotFoundSuffix returns a suffix for a not-found error message
+// mentioning the given architecture, if any.
+func archNotFoundSuffix(arch string) string {
+	if arch == "" {
+		return ""
 	}
+	return fmt.Sprintf(" with architecture %q", arch)
 }
 
 // findSingleEntity returns the entity referred to by URL. It is expected
@@ -710,8 +1372,8 @@ func (s *Store) findSingleEntity(url *charm.URL, fields map[string]int) (*mongod
 // findEntityInChannel attempts to find an entity on the given channel. The
 // base entity for URL is retrieved and the series with the best match to
 // URL.Series is used as the resolved entity.
-func (s *Store) findEntityInChannel(url *charm.URL, ch params.Channel, fields map[string]int) (*mongodoc.Entity, error) {
-	baseEntity, err := s.FindBaseEntity(url, map[string]int{
+func (s *Store) findEntityInChannel(url *charm.URL, ch params.Channel, arch string, fields map[string]int) (*mongodoc.Entity, error) {
+	baseEntity, err := s.findBaseEntity(url, map[string]int{
 		"_id":             1,
 		"channelentities": 1,
 	})
@@ -720,49 +1382,99 @@ func (s *Store) findEntityInChannel(url *charm.URL, ch params.Channel, fields ma
 	} else if err != nil {
 		return nil, errgo.Mask(err)
 	}
-	var entityURL *charm.URL
-	if url.Series == "" {
-		var entitySeries string
-		for s, u := range baseEntity.ChannelEntities[ch] {
-			// Determine the preferred URL from the available series.
-			//
-			// Note that because each of the series has a different
-			// score the only situation where the score in the URL is
-			// where there is more than one series supported by a
-			// multi-series charm. In this case the tie is broken by
-			// looking for the preferred series from the ones
-			// supported by the charm. To save fetching every charm
-			// to look at the supported series the key is used,
-			// because when a charm is listed as the published
-			// version for a series it must support that series.
-			if entityURL == nil ||
-				seriesScore[u.Series] > seriesScore[entityURL.Series] ||
-				// Note that if the two series are the same, they must both be
-				// multi-series URLs.
-				seriesScore[u.Series] == seriesScore[entityURL.Series] && seriesScore[s] > seriesScore[entitySeries] {
-				entityURL = u
-				entitySeries = s
-			}
-		}
-	} else {
-		entityURL = baseEntity.ChannelEntities[ch][url.Series]
+	entities, err := s.filterEntityURLsByArch(baseEntity.ChannelEntities[ch], arch)
+	if err != nil {
+		return nil, errgo.Mask(err)
 	}
+	entityURL := bestChannelEntityURL(url, entities)
 	if entityURL == nil {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "no matching charm or bundle for %s%s", url, archNotFoundSuffix(arch))
+	}
+	return s.findSingleEntity(entityURL, fields)
+}
+
+// findEntityInChannelAt is like findEntityInChannel except that the
+// entity is chosen from those that were current in the channel at the
+// given time.
+func (s *Store) findEntityInChannelAt(url *charm.URL, ch params.Channel, t time.Time, arch string, fields map[string]int) (*mongodoc.Entity, error) {
+	baseEntity, err := s.findBaseEntity(url, map[string]int{
+		"_id":            1,
+		"publishhistory": 1,
+	})
+	if errgo.Cause(err) == params.ErrNotFound {
 		return nil, errgo.WithCausef(nil, params.ErrNotFound, "no matching charm or bundle for %s", url)
+	} else if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	entities := make(map[string]*charm.URL)
+	published := make(map[string]time.Time)
+	for _, h := range baseEntity.PublishHistory {
+		if h.Channel != ch || h.Time.After(t) || h.Time.Before(published[h.Series]) {
+			continue
+		}
+		entities[h.Series] = h.URL
+		published[h.Series] = h.Time
+	}
+	entities, err = s.filterEntityURLsByArch(entities, arch)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	entityURL := bestChannelEntityURL(url, entities)
+	if entityURL == nil {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "no matching charm or bundle for %s%s in %s channel at %s", url, archNotFoundSuffix(arch), ch, t.Format(time.RFC3339))
 	}
 	return s.findSingleEntity(entityURL, fields)
 }
 
+// bestChannelEntityURL returns the entity from the given map of series
+// to entity ids published in a channel that is the best match for the
+// given URL, or nil if there is none.
+func bestChannelEntityURL(url *charm.URL, entities map[string]*charm.URL) *charm.URL {
+	if url.Series != "" {
+		return entities[url.Series]
+	}
+	var entityURL *charm.URL
+	var entitySeries string
+	for s, u := range entities {
+		// Determine the preferred URL from the available series.
+		//
+		// Note that because each of the series has a different
+		// score the only situation where the score in the URL is
+		// where there is more than one series supported by a
+		// multi-series charm. In this case the tie is broken by
+		// looking for the preferred series from the ones
+		// supported by the charm. To save fetching every charm
+		// to look at the supported series the key is used,
+		// because when a charm is listed as the published
+		// version for a series it must support that series.
+		if entityURL == nil ||
+			seriesScore[u.Series] > seriesScore[entityURL.Series] ||
+			// Note that if the two series are the same, they must both be
+			// multi-series URLs.
+			seriesScore[u.Series] == seriesScore[entityURL.Series] && seriesScore[s] > seriesScore[entitySeries] {
+			entityURL = u
+			entitySeries = s
+		}
+	}
+	return entityURL
+}
+
 // findUnpublishedEntity attempts to find an entity on the unpublished
 // channel. This searches all entities in the store for the best match to
 // the URL.
-func (s *Store) findUnpublishedEntity(url *charm.URL, fields map[string]int) (*mongodoc.Entity, error) {
-	entities, err := s.FindEntities(url, fields)
+func (s *Store) findUnpublishedEntity(url *charm.URL, arch string, fields map[string]int) (*mongodoc.Entity, error) {
+	allEntities, err := s.FindEntities(url, fields)
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
+	entities := allEntities[:0]
+	for _, e := range allEntities {
+		if supportsArch(e, arch) {
+			entities = append(entities, e)
+		}
+	}
 	if len(entities) == 0 {
-		return nil, errgo.WithCausef(nil, params.ErrNotFound, "no matching charm or bundle for %s", url)
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "no matching charm or bundle for %s%s", url, archNotFoundSuffix(arch))
 	}
 	best := entities[0]
 	for _, e := range entities {
@@ -855,11 +1567,42 @@ func (s *Store) EntitiesQuery(url *charm.URL) *mgo.Query {
 	return entities.Find(query)
 }
 
+// CandidateBaseEntities returns all the base entities with the given
+// name, owned by any user, ordered by user name. It can be used to
+// present the choices for a name that cannot otherwise be resolved.
+// If fields is not nil, only those fields will be populated in the
+// returned base entities.
+func (s *Store) CandidateBaseEntities(name string, fields map[string]int) ([]*mongodoc.BaseEntity, error) {
+	query := s.DB.BaseEntities().Find(bson.D{{"name", name}}).Sort("user")
+	if fields != nil {
+		query = query.Select(fields)
+	}
+	var entities []*mongodoc.BaseEntity
+	if err := query.All(&entities); err != nil {
+		return nil, errgo.Notef(err, "cannot find base entities")
+	}
+	return entities, nil
+}
+
 // FindBaseEntity finds the base entity in the store using the given URL,
 // which can either represent a fully qualified entity or a base id.
 // If fields is not nil, only those fields will be populated in the
 // returned base entity.
+//
+// The read is retried after transient mongo errors as configured by
+// ServerParams.MongoRetryAttempts.
 func (s *Store) FindBaseEntity(url *charm.URL, fields map[string]int) (*mongodoc.BaseEntity, error) {
+	var baseEntity *mongodoc.BaseEntity
+	err := s.retryRead("FindBaseEntity", func() error {
+		var err error
+		baseEntity, err = s.findBaseEntity(url, fields)
+		return err
+	})
+	return baseEntity, err
+}
+
+// findBaseEntity implements FindBaseEntity without retries.
+func (s *Store) findBaseEntity(url *charm.URL, fields map[string]int) (*mongodoc.BaseEntity, error) {
 	var query *mgo.Query
 	if url.User == "" {
 		query = s.DB.BaseEntities().Find(bson.D{{"name", url.Name}, {"promulgated", 1}})
@@ -879,25 +1622,362 @@ func (s *Store) FindBaseEntity(url *charm.URL, fields map[string]int) (*mongodoc
 	return &baseEntity, nil
 }
 
-// FieldSelector returns a field selector that will select
-// the given fields, or all fields if none are specified.
-func FieldSelector(fields ...string) map[string]int {
-	if len(fields) == 0 {
-		return nil
+// LatestPublishedRevision returns the id of the entity currently
+// published for the given series in the given channel of the base
+// entity with the given URL. If there is no such entity, an error with
+// a params.ErrNotFound cause is returned.
+func (s *Store) LatestPublishedRevision(baseURL *charm.URL, series string, channel params.Channel) (*router.ResolvedURL, error) {
+	baseEntity, err := s.FindBaseEntity(baseURL, FieldSelector("channelentities"))
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
 	}
-	sel := make(map[string]int, len(fields))
-	for _, field := range fields {
-		sel[field] = 1
+	entityURL := baseEntity.ChannelEntities[channel][series]
+	if entityURL == nil {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "no %s entity published for series %q in %s channel", baseURL, series, channel)
 	}
-	return sel
+	entity, err := s.FindEntity(&router.ResolvedURL{URL: *entityURL}, FieldSelector("promulgated-url"))
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	return EntityResolvedURL(entity), nil
 }
 
-// UpdateEntity applies the provided update to the entity described by
-// url. If there are no entries in update then no update is performed,
-// and no error is returned.
-func (s *Store) UpdateEntity(url *router.ResolvedURL, update bson.D) error {
-	if len(update) == 0 {
-		return nil
+// ChannelHeads returns the ids of the entities currently published in
+// each channel of the base entity with the given URL, keyed by channel
+// and then by series. Unlike BaseEntity.ChannelEntities, the returned
+// ids include promulgated revisions where relevant. If the base entity
+// does not exist, an error with a params.ErrNotFound cause is returned.
+// Note that ACLs are not checked.
+func (s *Store) ChannelHeads(baseURL *charm.URL) (map[params.Channel]map[string]*router.ResolvedURL, error) {
+	baseEntity, err := s.FindBaseEntity(baseURL, FieldSelector("channelentities"))
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	return s.channelHeads(baseEntity)
+}
+
+// channelHeads implements ChannelHeads for the given base entity,
+// which must hold its channel entities.
+func (s *Store) channelHeads(baseEntity *mongodoc.BaseEntity) (map[params.Channel]map[string]*router.ResolvedURL, error) {
+	var urls []*charm.URL
+	for _, entities := range baseEntity.ChannelEntities {
+		for _, url := range entities {
+			urls = append(urls, url)
+		}
+	}
+	if len(urls) == 0 {
+		return map[params.Channel]map[string]*router.ResolvedURL{}, nil
+	}
+	var entities []*mongodoc.Entity
+	if err := s.DB.Entities().
+		Find(bson.D{{"_id", bson.D{{"$in", urls}}}}).
+		Select(FieldSelector("promulgated-url")).
+		All(&entities); err != nil {
+		return nil, errgo.Notef(err, "cannot find channel entities of %v", baseEntity.URL)
+	}
+	resolved := make(map[charm.URL]*router.ResolvedURL, len(entities))
+	for _, entity := range entities {
+		resolved[*entity.URL] = EntityResolvedURL(entity)
+	}
+	heads := make(map[params.Channel]map[string]*router.ResolvedURL, len(baseEntity.ChannelEntities))
+	for ch, entities := range baseEntity.ChannelEntities {
+		for series, url := range entities {
+			rurl := resolved[*url]
+			if rurl == nil {
+				// The entity has been removed since it was
+				// published; there is nothing sensible to return.
+				continue
+			}
+			if heads[ch] == nil {
+				heads[ch] = make(map[string]*router.ResolvedURL)
+			}
+			heads[ch][series] = rurl
+		}
+	}
+	return heads, nil
+}
+
+// ChannelStatus holds the status of a channel of a base entity, as
+// returned by Store.ChannelStatus.
+type ChannelStatus struct {
+	// Heads holds the entities currently published in the channel,
+	// keyed by series.
+	Heads map[string]*router.ResolvedURL
+
+	// PublishTime holds the time that the most recent of the
+	// current heads was published. It is zero if the publication
+	// was made before publications were recorded.
+	PublishTime time.Time
+}
+
+// ChannelStatus returns the status of every channel, other than
+// params.UnpublishedChannel, of the given base entity, which must hold
+// its channel entities and publish history. Unlike ChannelHeads, the
+// returned map holds an entry for every such channel; the entry for a
+// channel with nothing published in it is nil. Note that ACLs are not
+// checked.
+func (s *Store) ChannelStatus(baseEntity *mongodoc.BaseEntity) (map[params.Channel]*ChannelStatus, error) {
+	heads, err := s.channelHeads(baseEntity)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	status := make(map[params.Channel]*ChannelStatus)
+	for _, ch := range params.OrderedChannels {
+		if ch == params.UnpublishedChannel {
+			continue
+		}
+		if len(heads[ch]) == 0 {
+			status[ch] = nil
+			continue
+		}
+		st := &ChannelStatus{
+			Heads: heads[ch],
+		}
+		for _, h := range baseEntity.PublishHistory {
+			if h.Channel != ch || h.Time.Before(st.PublishTime) {
+				continue
+			}
+			if head := heads[ch][h.Series]; head != nil && *h.URL == head.URL {
+				st.PublishTime = h.Time.UTC()
+			}
+		}
+		status[ch] = st
+	}
+	return status, nil
+}
+
+// BundleClosure returns the ids of the charms that would be deployed
+// by the bundle with the given id, with each charm reference that does
+// not specify a revision resolved to the current head of the given
+// channel. It also returns the charm references that cannot be found
+// in the channel. Both returned slices are sorted and contain no
+// duplicates. Note that ACLs are not checked.
+//
+// Bundles with embedded overlays are rejected when they are uploaded,
+// so the charms recorded in the bundle document are the full closure.
+func (s *Store) BundleClosure(url *router.ResolvedURL, channel params.Channel) (ids []*router.ResolvedURL, unresolved []*charm.URL, err error) {
+	entity, err := s.FindEntity(url, FieldSelector("bundlecharms", "series"))
+	if err != nil {
+		return nil, nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	if entity.URL.Series != "bundle" {
+		return nil, nil, errgo.Newf("%v is not a bundle", url)
+	}
+	// BundleCharms also holds the base URL of every referenced charm.
+	// Those are only resolved when the bundle refers to the charm by
+	// its base URL, otherwise they would add an arbitrary series of
+	// the charm to the closure.
+	specific := make(map[string]bool)
+	for _, u := range entity.BundleCharms {
+		if u.Series != "" || u.Revision != -1 {
+			specific[mongodoc.BaseURL(u).String()] = true
+		}
+	}
+	seen := make(map[string]bool)
+	for _, u := range entity.BundleCharms {
+		if u.Series == "" && u.Revision == -1 && specific[u.String()] {
+			continue
+		}
+		e, err := s.FindBestEntity(u, channel, FieldSelector("promulgated-url"))
+		if errgo.Cause(err) == params.ErrNotFound {
+			if !seen[u.String()] {
+				seen[u.String()] = true
+				unresolved = append(unresolved, u)
+			}
+			continue
+		}
+		if err != nil {
+			return nil, nil, errgo.Notef(err, "cannot resolve %q", u)
+		}
+		id := EntityResolvedURL(e)
+		if seen[id.URL.String()] {
+			continue
+		}
+		seen[id.URL.String()] = true
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i].URL.String() < ids[j].URL.String()
+	})
+	sort.Slice(unresolved, func(i, j int) bool {
+		return unresolved[i].String() < unresolved[j].String()
+	})
+	return ids, unresolved, nil
+}
+
+// HighestRevision returns the highest revision number of any entity
+// with the given base URL, regardless of series, channel or whether it
+// has been published. If there are no such entities, an error with a
+// params.ErrNotFound cause is returned. Note that ACLs are not checked.
+func (s *Store) HighestRevision(baseURL *charm.URL) (int, error) {
+	var entity mongodoc.Entity
+	err := s.DB.Entities().
+		Find(bson.D{{"baseurl", baseURL}}).
+		Sort("-revision").
+		Select(FieldSelector("revision")).
+		One(&entity)
+	if err == mgo.ErrNotFound {
+		return 0, errgo.WithCausef(nil, params.ErrNotFound, "no entities found for %s", baseURL)
+	}
+	if err != nil {
+		return 0, errgo.Notef(err, "cannot find highest revision of %s", baseURL)
+	}
+	return entity.Revision, nil
+}
+
+// PublishTime returns the time that the entity with the given id most
+// recently became the current revision in the given channel, as
+// recorded in the publish history of its base entity. If the entity
+// has never been published to the channel, an error with a
+// params.ErrNotFound cause is returned.
+func (s *Store) PublishTime(id *router.ResolvedURL, channel params.Channel) (time.Time, error) {
+	baseEntity, err := s.FindBaseEntity(&id.URL, FieldSelector("publishhistory"))
+	if err != nil {
+		return time.Time{}, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	var t time.Time
+	for _, h := range baseEntity.PublishHistory {
+		if h.Channel == channel && *h.URL == id.URL && h.Time.After(t) {
+			t = h.Time
+		}
+	}
+	if t.IsZero() {
+		return time.Time{}, errgo.WithCausef(nil, params.ErrNotFound, "%s has not been published to the %s channel", &id.URL, channel)
+	}
+	return t, nil
+}
+
+// ChannelHistoryEntry holds a single entry in the history of a
+// channel, as returned by ChannelHistory.
+type ChannelHistoryEntry struct {
+	// Revision holds the revision that became current in the
+	// channel.
+	Revision int
+
+	// PublishedAt holds the time the revision became current.
+	PublishedAt time.Time
+
+	// PublishedBy holds the name of the user that published the
+	// revision, if known.
+	PublishedBy string `json:",omitempty"`
+}
+
+// ChannelHistory returns the revisions of the charm or bundle with the
+// given base URL (for example cs:~bob/wordpress) that have been
+// current in the given channel for the given series, as recorded in
+// the publish history of the base entity, newest first. If the base
+// entity does not exist, an error with a params.ErrNotFound cause is
+// returned.
+func (s *Store) ChannelHistory(baseURL *charm.URL, series string, channel params.Channel) ([]ChannelHistoryEntry, error) {
+	if baseURL.Series != "" || baseURL.Revision != -1 {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "%q is not a base URL", baseURL)
+	}
+	baseEntity, err := s.FindBaseEntity(baseURL, FieldSelector("publishhistory"))
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	entries := []ChannelHistoryEntry{}
+	for i := len(baseEntity.PublishHistory) - 1; i >= 0; i-- {
+		h := baseEntity.PublishHistory[i]
+		if h.Channel != channel || h.Series != series {
+			continue
+		}
+		entries = append(entries, ChannelHistoryEntry{
+			Revision:    h.URL.Revision,
+			PublishedAt: h.Time.UTC(),
+			PublishedBy: h.User,
+		})
+	}
+	// The history is recorded in publish order, but make sure
+	// that entries copied from elsewhere are ordered too.
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].PublishedAt.After(entries[j].PublishedAt)
+	})
+	return entries, nil
+}
+
+// PublishedEntity holds an entity published to a channel.
+type PublishedEntity struct {
+	// Id holds the id of the entity.
+	Id *router.ResolvedURL
+
+	// Time holds the time the entity most recently became the
+	// current revision in the channel.
+	Time time.Time
+}
+
+// RecentlyPublished returns the charms and bundles most recently
+// published to the given channel, as recorded in the publishevents
+// collection, most recent first. Each entity is returned once, at the
+// time it was most recently published, and entities that are no longer
+// published in the channel are omitted. If filter is not nil, only
+// entities for which it returns true are included. At most limit
+// entities are returned; if limit is not positive there is no limit.
+// If channel is params.NoChannel, the stable channel is used.
+func (s *Store) RecentlyPublished(channel params.Channel, limit int, filter func(*router.ResolvedURL) bool) ([]PublishedEntity, error) {
+	if channel == params.NoChannel {
+		channel = params.StableChannel
+	}
+	iter := s.DB.PublishEvents().Find(bson.D{{"channel", channel}}).Sort("-time").Iter()
+	defer iter.Close()
+
+	var published []PublishedEntity
+	seen := make(map[charm.URL]bool)
+	var event mongodoc.PublishEvent
+	for iter.Next(&event) {
+		if seen[*event.URL] {
+			// Only the most recent publication is reported.
+			continue
+		}
+		seen[*event.URL] = true
+		entity, err := s.FindEntity(&router.ResolvedURL{URL: *event.URL}, FieldSelector("promulgated-url", "published"))
+		if errgo.Cause(err) == params.ErrNotFound {
+			// The entity has been removed.
+			continue
+		}
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if !entity.Published[channel] {
+			continue
+		}
+		id := EntityResolvedURL(entity)
+		if filter != nil && !filter(id) {
+			continue
+		}
+		published = append(published, PublishedEntity{
+			Id:   id,
+			Time: event.Time,
+		})
+		if limit > 0 && len(published) >= limit {
+			break
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, errgo.Notef(err, "cannot read publish events")
+	}
+	return published, nil
+}
+
+// FieldSelector returns a field selector that will select
+// the given fields, or all fields if none are specified.
+func FieldSelector(fields ...string) map[string]int {
+	if len(fields) == 0 {
+		return nil
+	}
+	sel := make(map[string]int, len(fields))
+	for _, field := range fields {
+		sel[field] = 1
+	}
+	return sel
+}
+
+// UpdateEntity applies the provided update to the entity described by
+// url. If there are no entries in update then no update is performed,
+// and no error is returned.
+func (s *Store) UpdateEntity(url *router.ResolvedURL, update bson.D) error {
+	if len(update) == 0 {
+		return nil
 	}
 	if err := s.DB.Entities().Update(bson.D{{"_id", &url.URL}}, update); err != nil {
 		if err == mgo.ErrNotFound {
@@ -908,6 +1988,60 @@ func (s *Store) UpdateEntity(url *router.ResolvedURL, update bson.D) error {
 	return nil
 }
 
+var testExtraInfoWritten func(url *router.ResolvedURL)
+
+// UpdateEntityExtraInfo sets the given extra-info values of the entity
+// with the given id, keyed by extra-info key. A nil value removes the
+// key. If the update would not change any of the stored values, the
+// database is not written to and false is returned.
+func (s *Store) UpdateEntityExtraInfo(url *router.ResolvedURL, values map[string][]byte) (changed bool, err error) {
+	if len(values) == 0 {
+		return false, nil
+	}
+	var setFields, unsetFields bson.D
+	var changes []bson.D
+	for key, val := range values {
+		field := "extrainfo." + key
+		if val == nil {
+			unsetFields = append(unsetFields, bson.DocElem{field, nil})
+			changes = append(changes, bson.D{{field, bson.D{{"$exists", true}}}})
+		} else {
+			setFields = append(setFields, bson.DocElem{field, val})
+			changes = append(changes, bson.D{{field, bson.D{{"$ne", val}}}})
+		}
+	}
+	var update bson.D
+	if len(setFields) > 0 {
+		update = append(update, bson.DocElem{"$set", setFields})
+	}
+	if len(unsetFields) > 0 {
+		update = append(update, bson.DocElem{"$unset", unsetFields})
+	}
+	// Only match the entity if at least one of the values differs,
+	// so that an unchanged update does not write anything.
+	err = s.DB.Entities().Update(bson.D{
+		{"_id", &url.URL},
+		{"$or", changes},
+	}, update)
+	if err == nil {
+		if testExtraInfoWritten != nil {
+			testExtraInfoWritten(url)
+		}
+		return true, nil
+	}
+	if err != mgo.ErrNotFound {
+		return false, errgo.Notef(err, "cannot update %q", url)
+	}
+	n, err := s.DB.Entities().FindId(&url.URL).Count()
+	if err != nil {
+		return false, errgo.Notef(err, "cannot update %q", url)
+	}
+	if n == 0 {
+		return false, errgo.WithCausef(nil, params.ErrNotFound, "cannot update %q", url)
+	}
+	return false, nil
+}
+
 // UpdateBaseEntity applies the provided update to the base entity of
 // url. If there are no entries in update then no update is performed,
 // and no error is returned.
@@ -931,10 +2065,132 @@ var ErrPublishResourceMismatch = errgo.Newf("charm published with incorrect reso
 // for the list of supported channels. The unpublished channel cannot
 // be provided.
 //
-// If the given resources do not match those expected or they're not
-// found, an error with a ErrPublichResourceMismatch cause will be returned.
+// Any resource declared by the charm that is not given a revision in
+// resources keeps the revision currently published in each target
+// channel. If the given resources do not match those expected or
+// they're not found, or a declared resource has no revision assigned
+// for a target channel, an error with a ErrPublishResourceMismatch
+// cause will be returned.
 func (s *Store) Publish(url *router.ResolvedURL, resources map[string]int, channels ...params.Channel) error {
-	var updateSearch bool
+	return s.publish(url, resources, false, "", channels)
+}
+
+// PublishRequiringResources is like Publish except that every resource
+// declared by the charm must be explicitly pinned to a revision in
+// resources; no revisions are carried over from the target channels.
+func (s *Store) PublishRequiringResources(url *router.ResolvedURL, resources map[string]int, channels ...params.Channel) error {
+	return s.publish(url, resources, true, "", channels)
+}
+
+// PublishAs is like Publish, or PublishRequiringResources if
+// requireResources is true, except that the given user is recorded in
+// the publish history as having published the entity.
+func (s *Store) PublishAs(user string, url *router.ResolvedURL, resources map[string]int, requireResources bool, channels ...params.Channel) error {
+	return s.publish(url, resources, requireResources, user, channels)
+}
+
+// timeNow is defined as a variable so that it can be overridden in tests.
+var timeNow = time.Now
+
+// maxPublishHistory holds the maximum number of entries kept in the
+// publish history of a base entity; older entries are discarded. It is
+// defined as a variable so that it can be overridden in tests.
+var maxPublishHistory = 1000
+
+// pushPublishHistory returns an update operation that appends the
+// given entries to the publish history of a base entity, keeping only
+// the most recent maxPublishHistory entries.
+func pushPublishHistory(history []mongodoc.PublishHistoryEntry) bson.DocElem {
+	return bson.DocElem{"$push", bson.D{{"publishhistory", bson.D{
+		{"$each", history},
+		{"$slice", -maxPublishHistory},
+	}}}}
+}
+
+// publishEventsMaxBytes holds the maximum size of the capped
+// publishevents collection; the oldest events are discarded when it
+// is full.
+const publishEventsMaxBytes = 64 * 1024 * 1024
+
+// addPublishEvents records the given publish history entries in the
+// publishevents collection so that they can be found by
+// RecentlyPublished. Entries for the same entity and channel are
+// recorded once.
+func (s *Store) addPublishEvents(history []mongodoc.PublishHistoryEntry) error {
+	type key struct {
+		channel params.Channel
+		url     charm.URL
+	}
+	seen := make(map[key]bool)
+	var docs []interface{}
+	for _, h := range history {
+		k := key{h.Channel, *h.URL}
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		docs = append(docs, &mongodoc.PublishEvent{
+			Channel: h.Channel,
+			URL:     h.URL,
+			Time:    h.Time,
+		})
+	}
+	if len(docs) == 0 {
+		return nil
+	}
+	if err := s.DB.PublishEvents().Insert(docs...); err != nil {
+		return errgo.Notef(err, "cannot record publish events")
+	}
+	return nil
+}
+
+func (s *Store) publish(url *router.ResolvedURL, resources map[string]int, requireResources bool, user string, channels []params.Channel) error {
+	op, err := s.preparePublish(url, resources, requireResources, channels)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound), errgo.Is(ErrPublishResourceMismatch))
+	}
+	op.user = user
+	if err := s.UpdateEntity(url, op.entityUpdate()); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	set, history := op.baseEntityUpdate(timeNow())
+	if err := s.UpdateBaseEntity(url, bson.D{
+		{"$set", set},
+		pushPublishHistory(history),
+	}); err != nil {
+		return errgo.Mask(err)
+	}
+	if err := s.addPublishEvents(history); err != nil {
+		return errgo.Mask(err)
+	}
+	if err := s.publishToSearch(op); err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+// publishOp holds a publish operation on a single entity that has been
+// checked by preparePublish but not yet applied.
+type publishOp struct {
+	url          *router.ResolvedURL
+	entity       *mongodoc.Entity
+	channels     []params.Channel
+	series       []string
+	resourceDocs map[params.Channel][]mongodoc.ResourceRevision
+	updateSearch bool
+
+	// user holds the user recorded in the publish history as
+	// having published the entity, if known.
+	user string
+}
+
+// preparePublish checks that the entity with the given URL can be
+// published to the given channels with the given resources and returns
+// the operation that will do so, without changing anything.
+func (s *Store) preparePublish(url *router.ResolvedURL, resources map[string]int, requireResources bool, channels []params.Channel) (*publishOp, error) {
+	op := &publishOp{
+		url: url,
+	}
 	// Throw away any channels that we don't like.
 	actualChannels := make([]params.Channel, 0, len(channels))
 	for _, c := range channels {
@@ -943,64 +2199,195 @@ func (s *Store) Publish(url *router.ResolvedURL, resources map[string]int, chann
 		}
 		actualChannels = append(actualChannels, c)
 		if c == params.StableChannel {
-			updateSearch = true
+			op.updateSearch = true
 		}
 	}
-	channels = actualChannels
-	if len(channels) == 0 {
-		return errgo.Newf("cannot update %q: no valid channels provided", url)
+	op.channels = actualChannels
+	if len(op.channels) == 0 {
+		return nil, errgo.Newf("cannot update %q: no valid channels provided", url)
 	}
 	entity, err := s.FindEntity(url, FieldSelector("series", "supportedseries", "charmmeta", "baseurl"))
 	if err != nil {
-		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
 	}
-	resourceDocs := make([]mongodoc.ResourceRevision, 0, len(resources))
-	if err = s.checkPublishedResources(entity, resources); err != nil {
-		return errgo.WithCausef(err, ErrPublishResourceMismatch, "")
+	op.entity = entity
+	var channelResources map[params.Channel][]mongodoc.ResourceRevision
+	if !requireResources && entity.CharmMeta != nil && len(entity.CharmMeta.Resources) > len(resources) {
+		baseEntity, err := s.FindBaseEntity(entity.URL, FieldSelector("channelresources"))
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		channelResources = baseEntity.ChannelResources
 	}
-	for name, rev := range resources {
-		resourceDocs = append(resourceDocs, mongodoc.ResourceRevision{
-			Name:     name,
-			Revision: rev,
-		})
+	op.resourceDocs = make(map[params.Channel][]mongodoc.ResourceRevision, len(op.channels))
+	for _, c := range op.channels {
+		chResources := channelPublishResources(entity, resources, channelResources[c])
+		if err = s.checkPublishedResources(entity, chResources); err != nil {
+			return nil, errgo.WithCausef(err, ErrPublishResourceMismatch, "")
+		}
+		docs := make([]mongodoc.ResourceRevision, 0, len(chResources))
+		for name, rev := range chResources {
+			docs = append(docs, mongodoc.ResourceRevision{
+				Name:     name,
+				Revision: rev,
+			})
+		}
+		op.resourceDocs[c] = docs
+	}
+	op.series = entity.SupportedSeries
+	if len(op.series) == 0 {
+		op.series = []string{entity.Series}
+	}
+	return op, nil
+}
+
+// entityUpdate returns the update that marks the entity as published
+// in each of the operation's channels. Publishing an entity to a
+// channel it has been yanked from reinstates it there.
+func (op *publishOp) entityUpdate() bson.D {
+	set := make(bson.D, 0, len(op.channels))
+	unsetYanked := make(bson.D, 0, len(op.channels))
+	for _, c := range op.channels {
+		set = append(set, bson.DocElem{"published." + string(c), true})
+		unsetYanked = append(unsetYanked, bson.DocElem{"yanked." + string(c), true})
+	}
+	return bson.D{
+		{"$set", set},
+		{"$unset", unsetYanked},
+	}
+}
+
+// baseEntityUpdate returns the fields to set on the base entity to make
+// the entity current in each of the operation's channels, along with
+// the publish history entries recording that, timestamped with now.
+func (op *publishOp) baseEntityUpdate(now time.Time) (bson.D, []mongodoc.PublishHistoryEntry) {
+	set := make(bson.D, 0, len(op.channels)*(len(op.series)+1))
+	history := make([]mongodoc.PublishHistoryEntry, 0, len(op.channels)*len(op.series))
+	for _, c := range op.channels {
+		for _, s := range op.series {
+			set = append(set, bson.DocElem{fmt.Sprintf("channelentities.%s.%s", c, s), op.entity.URL})
+			history = append(history, mongodoc.PublishHistoryEntry{
+				Channel: c,
+				Series:  s,
+				URL:     op.entity.URL,
+				Time:    now,
+				User:    op.user,
+			})
+		}
+		set = append(set, bson.DocElem{fmt.Sprintf("channelresources.%s", c), op.resourceDocs[c]})
 	}
+	return set, history
+}
 
-	series := entity.SupportedSeries
-	if len(series) == 0 {
-		series = []string{entity.Series}
+// publishToSearch updates the search index and any automatic
+// promulgation after the given publish operation has been applied.
+func (s *Store) publishToSearch(op *publishOp) error {
+	if !op.updateSearch {
+		return nil
 	}
-	// Update the entity's published channels.
-	update := make(bson.D, 0, len(channels)*(len(series)+1)) // ...ish.
-	for _, c := range channels {
-		update = append(update, bson.DocElem{"published." + string(c), true})
+	if op.entity.URL.Series != "bundle" {
+		if err := s.autoPromulgate(op.url, op.user); err != nil {
+			return errgo.Mask(err)
+		}
 	}
-	if err := s.UpdateEntity(url, bson.D{{"$set", update}}); err != nil {
-		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+
+	// Add entity to ElasticSearch.
+	if err := s.UpdateSearch(op.url); err != nil {
+		return errgo.Notef(err, "cannot index %s to ElasticSearch", op.url)
 	}
+	return nil
+}
 
-	// Update the base entity.
-	update = update[:0]
-	for _, c := range channels {
-		for _, s := range series {
-			update = append(update, bson.DocElem{fmt.Sprintf("channelentities.%s.%s", c, s), entity.URL})
+// autoPromulgate promulgates the base entity of url if it is owned by
+// one of the users in ServerParams.AutoPromulgateUsers and no base
+// entity with the same name is already promulgated. The given user,
+// or the owner of the entity if it is empty, is recorded in the audit
+// log as having promulgated it.
+//
+// The base entity is claimed by atomically setting its promulgated
+// flag only if it is not already set. If another base entity with the
+// same name turns out to be promulgated after that, perhaps by a
+// concurrent publish, the claim is released again so that at most one
+// of them remains promulgated.
+func (s *Store) autoPromulgate(url *router.ResolvedURL, user string) error {
+	found := false
+	for _, u := range s.pool.config.AutoPromulgateUsers {
+		if u == url.URL.User {
+			found = true
+			break
 		}
-		update = append(update, bson.DocElem{fmt.Sprintf("channelresources.%s", c), resourceDocs})
 	}
-	if err := s.UpdateBaseEntity(url, bson.D{{"$set", update}}); err != nil {
-		return errgo.Mask(err)
+	if !found {
+		return nil
 	}
-
-	if !updateSearch {
+	base := mongodoc.BaseURL(&url.URL)
+	err := s.DB.BaseEntities().Update(bson.D{
+		{"_id", base},
+		{"promulgated", mongodoc.IntBool(false)},
+	}, bson.D{{"$set", bson.D{{"promulgated", mongodoc.IntBool(true)}}}})
+	if err == mgo.ErrNotFound {
+		// The base entity is already promulgated.
 		return nil
 	}
-
-	// Add entity to ElasticSearch.
-	if err := s.UpdateSearch(url); err != nil {
-		return errgo.Notef(err, "cannot index %s to ElasticSearch", url)
+	if err != nil {
+		return errgo.Notef(err, "cannot promulgate base entity %q", base)
+	}
+	n, err := s.DB.BaseEntities().Find(bson.D{
+		{"_id", bson.D{{"$ne", base}}},
+		{"name", base.Name},
+		{"promulgated", mongodoc.IntBool(true)},
+	}).Count()
+	if err != nil {
+		return errgo.Notef(err, "cannot count promulgated base entities")
 	}
+	if n > 0 {
+		err := s.DB.BaseEntities().Update(bson.D{
+			{"_id", base},
+			{"promulgated", mongodoc.IntBool(true)},
+		}, bson.D{{"$set", bson.D{{"promulgated", mongodoc.IntBool(false)}}}})
+		if err != nil && err != mgo.ErrNotFound {
+			return errgo.Notef(err, "cannot unpromulgate base entity %q", base)
+		}
+		return nil
+	}
+	logger.Infof("automatically promulgating %v", url)
+	if err := s.SetPromulgated(url, true); err != nil {
+		return errgo.Notef(err, "cannot promulgate %v", url)
+	}
+	if user == "" {
+		user = url.URL.User
+	}
+	s.AddAudit(audit.Entry{
+		User:   user,
+		Op:     audit.OpPromulgate,
+		Entity: &url.URL,
+	})
 	return nil
 }
 
+// channelPublishResources returns the resource revisions to publish
+// for a single channel. Any resource declared by the entity that is not
+// in resources is taken from current, which holds the revisions
+// currently published in the channel.
+func channelPublishResources(entity *mongodoc.Entity, resources map[string]int, current []mongodoc.ResourceRevision) map[string]int {
+	if len(current) == 0 || entity.CharmMeta == nil {
+		return resources
+	}
+	chResources := make(map[string]int, len(entity.CharmMeta.Resources))
+	for name, rev := range resources {
+		chResources[name] = rev
+	}
+	for _, rr := range current {
+		if _, ok := chResources[rr.Name]; ok {
+			continue
+		}
+		if charmHasResource(entity.CharmMeta, rr.Name) {
+			chResources[rr.Name] = rr.Revision
+		}
+	}
+	return chResources
+}
+
 func (s *Store) checkPublishedResources(entity *mongodoc.Entity, resources map[string]int) error {
 	knownResources, _, err := s.charmResources(entity.BaseURL)
 	if err != nil {
@@ -1227,6 +2614,115 @@ func (s *Store) SetPromulgated(url *router.ResolvedURL, promulgate bool) error {
 	return nil
 }
 
+// RecomputePromulgatedRevisions renumbers the promulgated revisions of
+// all the promulgated entities with the given name so that they are
+// contiguous, starting at zero, in order of upload time. The promulgated
+// URL of each entity is rewritten to match its new promulgated revision.
+//
+// This is intended to repair the promulgated revisions after they have
+// been damaged by manual changes to the database. It is safe to call
+// RecomputePromulgatedRevisions more than once, including after a
+// previous call has failed part way through.
+func (s *Store) RecomputePromulgatedRevisions(name string) error {
+	var entities []*mongodoc.Entity
+	err := s.DB.Entities().Find(bson.D{
+		{"name", name},
+		{"promulgated-revision", bson.D{{"$gt", -1}}},
+	}).Sort("uploadtime", "promulgated-revision", "_id").Select(FieldSelector(
+		"baseurl",
+		"uploadtime",
+		"promulgated-url",
+		"promulgated-revision",
+	)).All(&entities)
+	if err != nil {
+		return errgo.Notef(err, "cannot find promulgated entities for %q", name)
+	}
+
+	// Remove the promulgated URL from every entity that needs
+	// renumbering before setting any of the new ones, so that the
+	// new URLs cannot clash with the old ones in the unique
+	// promulgated-url index. The promulgated revision is left in
+	// place so that the entity is still found if we need to run
+	// again.
+	var changed []*mongodoc.Entity
+	for i, e := range entities {
+		if e.PromulgatedRevision == i && e.PromulgatedURL != nil && e.PromulgatedURL.Revision == i {
+			continue
+		}
+		err := s.DB.Entities().UpdateId(e.URL, bson.D{{"$unset", bson.D{{"promulgated-url", nil}}}})
+		if err != nil {
+			return errgo.Notef(err, "cannot remove promulgated URL from %v", e.URL)
+		}
+		e.PromulgatedRevision = i
+		changed = append(changed, e)
+	}
+	baseURLs := make(map[string]*charm.URL)
+	for _, e := range changed {
+		pID := *e.URL
+		pID.User = ""
+		pID.Revision = e.PromulgatedRevision
+		logger.Infof("updating promulgation URL of %v to %v", e.URL, &pID)
+		err := s.DB.Entities().UpdateId(e.URL, bson.D{{
+			"$set", bson.D{
+				{"promulgated-url", &pID},
+				{"promulgated-revision", pID.Revision},
+			},
+		}})
+		if err != nil {
+			return errgo.Notef(err, "cannot update promulgated URL of %v", e.URL)
+		}
+		// Make sure that new promulgated revisions are
+		// allocated after the renumbered ones.
+		if err := s.addRevision(&pID); err != nil {
+			return errgo.Mask(err)
+		}
+		baseURLs[e.BaseURL.String()] = e.BaseURL
+	}
+	for _, baseURL := range baseURLs {
+		if err := s.UpdateSearchBaseURL(baseURL); err != nil {
+			return errgo.Notef(err, "cannot update search entities for %q", baseURL)
+		}
+	}
+	return nil
+}
+
+// RecomputeBundleCounts recalculates the unit and machine counts of the
+// bundle with the given id from its stored bundle data, using the
+// current counting rules, and updates the entity and its search record
+// if they have changed. It is intended for refreshing the counts of
+// bundles that were uploaded before a change to those rules.
+func (s *Store) RecomputeBundleCounts(url *router.ResolvedURL) error {
+	if url.URL.Series != "bundle" {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "%v is not a bundle", &url.URL)
+	}
+	entity, err := s.FindEntity(url, FieldSelector("bundledata", "bundleunitcount", "bundlemachinecount"))
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	if entity.BundleData == nil {
+		return errgo.Newf("no bundle data found for %v", &url.URL)
+	}
+	units := bundleUnitCount(entity.BundleData)
+	machines := bundleMachineCount(entity.BundleData)
+	if entity.BundleUnitCount != nil && *entity.BundleUnitCount == units &&
+		entity.BundleMachineCount != nil && *entity.BundleMachineCount == machines {
+		return nil
+	}
+	err = s.DB.Entities().UpdateId(&url.URL, bson.D{{
+		"$set", bson.D{
+			{"bundleunitcount", units},
+			{"bundlemachinecount", machines},
+		},
+	}})
+	if err != nil {
+		return errgo.Notef(err, "cannot update bundle counts of %v", &url.URL)
+	}
+	if err := s.UpdateSearch(url); err != nil {
+		return errgo.Notef(err, "cannot update search record for %v", &url.URL)
+	}
+	return nil
+}
+
 // SetPerms sets the ACL specified by which for the base entity with the
 // given id. The which parameter is in the form "channel.operation",
 // where channel is the string corresponding to one of the ValidChannels
@@ -1239,6 +2735,93 @@ func (s *Store) SetPerms(id *charm.URL, which string, acl ...string) error {
 	}})
 }
 
+// SetPermsBatch sets the ACL specified by op for all the base entities
+// with the given ids. The op parameter is in the form
+// "channel.operation", as for the which parameter to SetPerms; if it
+// does not specify a channel, the unpublished ACL is updated. The given
+// user is recorded as the actor in the audit entry added for each base
+// entity.
+//
+// The operation is all-or-nothing: if op is invalid, any of the base
+// entities does not exist, or authorize returns an error for any of
+// them, no changes are made. If authorize is not nil, it is called with
+// the channel being changed and each base entity, including its
+// channelacls field, before anything is written; its error is returned
+// unchanged.
+func (s *Store) SetPermsBatch(urls []*charm.URL, op string, acl []string, user string, authorize func(ch params.Channel, be *mongodoc.BaseEntity) error) error {
+	channel, operation := params.UnpublishedChannel, op
+	if i := strings.LastIndex(op, "."); i >= 0 {
+		channel, operation = params.Channel(op[:i]), op[i+1:]
+	}
+	if !params.ValidChannels[channel] {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "invalid channel %q", channel)
+	}
+	if operation != "read" && operation != "write" {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "invalid operation %q", operation)
+	}
+	baseURLs := make([]*charm.URL, 0, len(urls))
+	seen := make(map[string]bool)
+	for _, url := range urls {
+		baseURL := mongodoc.BaseURL(url)
+		if seen[baseURL.String()] {
+			continue
+		}
+		seen[baseURL.String()] = true
+		baseURLs = append(baseURLs, baseURL)
+	}
+	if len(baseURLs) == 0 {
+		return nil
+	}
+	query := bson.D{{"_id", bson.D{{"$in", baseURLs}}}}
+	var found []*mongodoc.BaseEntity
+	if err := s.DB.BaseEntities().Find(query).Select(FieldSelector("channelacls")).All(&found); err != nil {
+		return errgo.Notef(err, "cannot get base entities")
+	}
+	if len(found) != len(baseURLs) {
+		for _, e := range found {
+			delete(seen, e.URL.String())
+		}
+		for _, baseURL := range baseURLs {
+			if seen[baseURL.String()] {
+				return errgo.WithCausef(nil, params.ErrNotFound, "base entity %q not found", baseURL)
+			}
+		}
+	}
+	if authorize != nil {
+		for _, e := range found {
+			if err := authorize(channel, e); err != nil {
+				return errgo.Mask(err, errgo.Any)
+			}
+		}
+	}
+	if _, err := s.DB.BaseEntities().UpdateAll(query, bson.D{{"$set",
+		bson.D{{"channelacls." + string(channel) + "." + operation, acl}},
+	}}); err != nil {
+		return errgo.Notef(err, "cannot update base entities")
+	}
+	for _, baseURL := range baseURLs {
+		var auditACL audit.ACL
+		if operation == "read" {
+			auditACL.Read = acl
+		} else {
+			auditACL.Write = acl
+		}
+		s.AddAudit(audit.Entry{
+			User:   user,
+			Op:     audit.OpSetPerm,
+			Entity: baseURL,
+			ACL:    &auditACL,
+		})
+		if operation == "read" {
+			// Read ACLs are stored in the search index.
+			if err := s.UpdateSearchBaseURL(baseURL); err != nil {
+				return errgo.Notef(err, "cannot update search entities for %q", baseURL)
+			}
+		}
+	}
+	return nil
+}
+
 // MatchingInterfacesQuery returns a mongo query
 // that will find any charms that require any interfaces
 // in the required slice or provide any interfaces in the
@@ -1261,7 +2844,8 @@ func (s *Store) MatchingInterfacesQuery(required, provided []string) *mgo.Query
 	}})
 }
 
-// AddLog adds a log message to the database.
+// AddLog adds a log message to the database. Error-level ingestion
+// logs are also sent to the configured IngestionErrorWebhook, if any.
 func (s *Store) AddLog(data *json.RawMessage, logLevel mongodoc.LogLevel, logType mongodoc.LogType, urls []*charm.URL) error {
 	// Encode the JSON data.
 	b, err := json.Marshal(data)
@@ -1298,20 +2882,28 @@ func (s *Store) AddLog(data *json.RawMessage, logLevel mongodoc.LogLevel, logTyp
 	if err := s.DB.Logs().Insert(log); err != nil {
 		return errgo.Mask(err)
 	}
+	if logLevel == mongodoc.ErrorLevel && logType == mongodoc.IngestionType {
+		s.pool.notifyIngestionError(&IngestionErrorNotification{
+			Data: json.RawMessage(b),
+			URLs: allUrls,
+			Time: log.Time,
+		})
+	}
 	return nil
 }
 
 // DeleteEntity deletes the entity with the given id from the store. If
 // the entity is the current published revision for any channel or the
 // last revision with the same base entity, it returns an error with an
-// ErrForbidden cause.
-func (s *Store) DeleteEntity(id *router.ResolvedURL) error {
+// ErrForbidden cause. On success, an OpDelete audit entry is recorded
+// for the given user.
+func (s *Store) DeleteEntity(id *router.ResolvedURL, user string) error {
 	// Find all the entities that use the base URL of id so
 	// that we can refuse to delete the last reference to the
 	// base URL.
 	var entities []*mongodoc.Entity
 	err := s.DB.Entities().Find(bson.D{{"baseurl", mongodoc.BaseURL(&id.URL)}}).
-		Select(FieldSelector("blobhash", "prev5blobhash")).
+		Select(FieldSelector("blobhash", "prev5blobhash", "size")).
 		All(&entities)
 	if err != nil {
 		return errgo.Mask(err)
@@ -1358,35 +2950,57 @@ func (s *Store) DeleteEntity(id *router.ResolvedURL) error {
 		}
 		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
 	}
-
+	s.pool.invalidateBlob(entity.BlobHash)
+	if entity.PreV5BlobHash != "" && entity.PreV5BlobHash != entity.BlobHash {
+		s.pool.invalidateBlob(entity.PreV5BlobHash)
+	}
+	s.AddAudit(audit.Entry{
+		User:     user,
+		Op:       audit.OpDelete,
+		Entity:   &id.URL,
+		BlobHash: entity.BlobHash,
+		Size:     entity.Size,
+	})
 	return nil
 }
 
 // StoreDatabase wraps an mgo.DB ands adds a few convenience methods.
 type StoreDatabase struct {
 	*mgo.Database
+
+	// prefix holds the prefix added to the names of all the
+	// collections returned by C.
+	prefix string
 }
 
 // clone copies the StoreDatabase, cloning the underlying mgo session.
 func (s StoreDatabase) clone() StoreDatabase {
 	return StoreDatabase{
-		&mgo.Database{
+		Database: &mgo.Database{
 			Name:    s.Name,
 			Session: s.Session.Clone(),
 		},
+		prefix: s.prefix,
 	}
 }
 
 // copy copies the StoreDatabase, copying the underlying mgo session.
 func (s StoreDatabase) copy() StoreDatabase {
 	return StoreDatabase{
-		&mgo.Database{
+		Database: &mgo.Database{
 			Name:    s.Name,
 			Session: s.Session.Copy(),
 		},
+		prefix: s.prefix,
 	}
 }
 
+// C returns the collection with the given name, after adding the
+// collection prefix configured with ServerParams.CollectionPrefix.
+func (s StoreDatabase) C(name string) *mgo.Collection {
+	return s.Database.C(s.prefix + name)
+}
+
 // Close closes the store database's underlying session.
 func (s StoreDatabase) Close() {
 	s.Session.Close()
@@ -1403,11 +3017,23 @@ func (s StoreDatabase) Revisions() *mgo.Collection {
 	return s.C("revisions")
 }
 
+// RevisionBases holds the mongo collection where the revision
+// bases set with Store.SetRevisionBase are stored.
+func (s StoreDatabase) RevisionBases() *mgo.Collection {
+	return s.C("revision_bases")
+}
+
 // BaseEntities returns the mongo collection where base entities are stored.
 func (s StoreDatabase) BaseEntities() *mgo.Collection {
 	return s.C("base_entities")
 }
 
+// ReindexJobs returns the Mongo collection where the progress of
+// search reindex jobs is stored.
+func (s StoreDatabase) ReindexJobs() *mgo.Collection {
+	return s.C("reindex_jobs")
+}
+
 // Resources returns the mongo collection where resources are stored.
 func (s StoreDatabase) Resources() *mgo.Collection {
 	return s.C("resources")
@@ -1435,17 +3061,54 @@ func (s StoreDatabase) DownloadCounts() *mgo.Collection {
 	return s.C("download_counts")
 }
 
+// APITokens returns the Mongo collection where hashed API tokens are
+// stored.
+func (s StoreDatabase) APITokens() *mgo.Collection {
+	return s.C("api_tokens")
+}
+
+// Audit returns the Mongo collection where audit log entries are
+// stored.
+func (s StoreDatabase) Audit() *mgo.Collection {
+	return s.C("audit")
+}
+
+// PendingPublishes returns the Mongo collection where publish
+// requests awaiting approval are stored.
+func (s StoreDatabase) PendingPublishes() *mgo.Collection {
+	return s.C("pending_publishes")
+}
+
+// PublishEvents returns the capped Mongo collection where the most
+// recent publish events are stored.
+func (s StoreDatabase) PublishEvents() *mgo.Collection {
+	return s.C("publishevents")
+}
+
+// UploadBlocklist returns the Mongo collection where the upload
+// blocklist is stored.
+func (s StoreDatabase) UploadBlocklist() *mgo.Collection {
+	return s.C("upload_blocklist")
+}
+
 // allCollections holds for each collection used by the charm store a
 // function returns that collection.
 var allCollections = []func(StoreDatabase) *mgo.Collection{
+	StoreDatabase.APITokens,
+	StoreDatabase.Audit,
 	StoreDatabase.BaseEntities,
 	StoreDatabase.DownloadCounts,
 	StoreDatabase.Entities,
 	StoreDatabase.Logs,
 	StoreDatabase.Macaroons,
 	StoreDatabase.Migrations,
+	StoreDatabase.PendingPublishes,
+	StoreDatabase.PublishEvents,
+	StoreDatabase.ReindexJobs,
 	StoreDatabase.Resources,
+	StoreDatabase.RevisionBases,
 	StoreDatabase.Revisions,
+	StoreDatabase.UploadBlocklist,
 }
 
 // Collections returns a slice of all the collections used
@@ -21,9 +21,12 @@ import (
 	"time"
 
 	"github.com/juju/charmrepo/v6/csclient/params"
+	"github.com/juju/loggo"
 	jc "github.com/juju/testing/checkers"
+	"golang.org/x/net/context"
 	gc "gopkg.in/check.v1"
 	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 	"gopkg.in/natefinch/lumberjack.v2"
 
@@ -234,6 +237,57 @@ func (s *StoreSuite) TestRequestStoreFailsWhenPoolIsClosed(c *gc.C) {
 	c.Assert(store, gc.IsNil)
 }
 
+func (s *StoreSuite) TestCollectionPrefix(c *gc.C) {
+	db := s.Session.DB("juju_test")
+	stagingPool, err := NewPool(db, nil, nil, ServerParams{
+		CollectionPrefix: "staging_",
+	})
+	c.Assert(err, gc.Equals, nil)
+	defer stagingPool.Close()
+	staging := stagingPool.Store()
+	defer staging.Close()
+	prodPool, err := NewPool(db, nil, nil, ServerParams{
+		CollectionPrefix: "prod_",
+		BlobStorePrefix:  "blobs",
+	})
+	c.Assert(err, gc.Equals, nil)
+	defer prodPool.Close()
+	prod := prodPool.Store()
+	defer prod.Close()
+
+	c.Assert(staging.DB.Entities().Name, gc.Equals, "staging_entities")
+	c.Assert(prod.DB.Entities().Name, gc.Equals, "prod_entities")
+
+	rurl := MustParseResolvedURL("cs:~charmers/precise/wordpress-1")
+	err = staging.AddCharmWithArchive(rurl, storetesting.Charms.CharmDir("wordpress"))
+	c.Assert(err, gc.Equals, nil)
+
+	// The entity is only visible in the store that added it.
+	_, err = staging.FindEntity(rurl, nil)
+	c.Assert(err, gc.Equals, nil)
+	_, err = prod.FindEntity(rurl, nil)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+
+	// The collections of the two stores coexist in the same
+	// database and have their own indexes.
+	names, err := db.CollectionNames()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(names, jc.Contains, "staging_entities")
+	c.Assert(names, jc.Contains, "staging_entitystore.files")
+	c.Assert(names, jc.Contains, "prod_entities")
+	c.Assert(names, jc.Contains, "prod_blobs.files")
+	c.Assert(names, gc.Not(jc.Contains), "entities")
+	n, err := db.C("staging_entitystore.files").Count()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Not(gc.Equals), 0)
+	n, err = db.C("prod_blobs.files").Count()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 0)
+	indexes, err := db.C("prod_entities").Indexes()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(len(indexes), jc.GreaterThan, 1)
+}
+
 func (s *StoreSuite) TestRequestStoreLimitMaintained(c *gc.C) {
 	config := ServerParams{
 		HTTPRequestWaitDuration: time.Millisecond,
@@ -272,6 +326,56 @@ func (s *StoreSuite) TestPoolDoubleClose(c *gc.C) {
 	p.Close()
 }
 
+func (s *StoreSuite) TestProbe(c *gc.C) {
+	config := ServerParams{
+		HTTPRequestWaitDuration: time.Millisecond,
+		MaxMgoSessions:          10,
+	}
+	p, err := NewPool(s.Session.DB("juju_test"), nil, nil, config)
+	c.Assert(err, gc.Equals, nil)
+	defer p.Close()
+	store, err := p.RequestStore()
+	c.Assert(err, gc.Equals, nil)
+	defer store.Close()
+
+	result, err := store.Probe(context.Background())
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(result.MongoLatency > 0, gc.Equals, true, gc.Commentf("mongo latency %v", result.MongoLatency))
+	c.Assert(result.BlobStoreLatency > 0, gc.Equals, true, gc.Commentf("blob store latency %v", result.BlobStoreLatency))
+	c.Assert(result.SessionsInUse, gc.Equals, 1)
+	c.Assert(result.MaxSessions, gc.Equals, 10)
+	c.Assert(result.SessionUtilization, gc.Equals, 0.1)
+
+	// The session used by the probe is closed afterwards.
+	store1, err := p.RequestStore()
+	c.Assert(err, gc.Equals, nil)
+	defer store1.Close()
+	result, err = store.Probe(context.Background())
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(result.SessionsInUse, gc.Equals, 2)
+	c.Assert(result.SessionUtilization, gc.Equals, 0.2)
+}
+
+func (s *StoreSuite) TestProbeContextDone(c *gc.C) {
+	p, err := NewPool(s.Session.DB("juju_test"), nil, nil, ServerParams{})
+	c.Assert(err, gc.Equals, nil)
+	defer p.Close()
+	store := p.Store()
+	defer store.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = store.Probe(ctx)
+	c.Assert(err, gc.ErrorMatches, `cannot probe store: context canceled`)
+	c.Assert(errgo.Cause(err), gc.Equals, context.Canceled)
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+	_, err = store.Probe(ctx)
+	c.Assert(errgo.Cause(err), gc.Equals, context.DeadlineExceeded)
+}
+
 func (s *StoreSuite) TestFindEntities(c *gc.C) {
 	s.testURLFinding(c, func(store *Store, expand *charm.URL, expect []*router.ResolvedURL) {
 		// Check FindEntities works when just retrieving the id and promulgated id.
@@ -334,915 +438,3223 @@ func (s *StoreSuite) TestFindEntity(c *gc.C) {
 	c.Assert(entity3, gc.IsNil)
 }
 
-var findBaseEntityTests = []struct {
-	about  string
-	stored []string
-	url    string
-	fields []string
-	expect *mongodoc.BaseEntity
+func (s *StoreSuite) TestPreferredURLs(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	ids := MustParseResolvedURLs([]string{
+		"3 cs:~charmers/" + storetesting.SearchSeries[0] + "/wordpress-5",
+		"cs:~bob/" + storetesting.SearchSeries[0] + "/wordpress-2",
+		"0 cs:~charmers/bundle/wordpress-simple-1",
+	})
+	err := store.AddCharmWithArchive(ids[0], storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	err = store.AddCharmWithArchive(ids[1], storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	err = store.AddBundleWithArchive(ids[2], storetesting.Charms.BundleDir("wordpress-simple"))
+	c.Assert(err, gc.Equals, nil)
+
+	missing := MustParseResolvedURL("cs:~bob/" + storetesting.SearchSeries[0] + "/mysql-1")
+	urls, err := store.PreferredURLs(append(ids, missing))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(urls, jc.DeepEquals, map[string]*charm.URL{
+		"cs:~charmers/" + storetesting.SearchSeries[0] + "/wordpress-5": charm.MustParseURL("cs:" + storetesting.SearchSeries[0] + "/wordpress-3"),
+		"cs:~bob/" + storetesting.SearchSeries[0] + "/wordpress-2":      charm.MustParseURL("cs:~bob/" + storetesting.SearchSeries[0] + "/wordpress-2"),
+		"cs:~charmers/bundle/wordpress-simple-1":                        charm.MustParseURL("cs:bundle/wordpress-simple-0"),
+	})
+
+	urls, err = store.PreferredURLs(nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(urls, gc.HasLen, 0)
+}
+
+var bundlesContainingBundles = []struct {
+	id       string
+	charms   []string
+	channels []params.Channel
 }{{
-	about:  "entity found, base url, all fields",
-	stored: []string{"42 cs:~charmers/utopic/mysql-42"},
-	url:    "mysql",
-	expect: storetesting.NormalizeBaseEntity(&mongodoc.BaseEntity{
-		URL:         charm.MustParseURL("~charmers/mysql"),
-		User:        "charmers",
-		Name:        "mysql",
-		Promulgated: true,
-		ChannelACLs: map[params.Channel]mongodoc.ACL{
-			params.UnpublishedChannel: {
-				Read:  []string{"charmers"},
-				Write: []string{"charmers"},
-			},
-			params.EdgeChannel: {
-				Read:  []string{"charmers"},
-				Write: []string{"charmers"},
-			},
-			params.BetaChannel: {
-				Read:  []string{"charmers"},
-				Write: []string{"charmers"},
-			},
-			params.CandidateChannel: {
-				Read:  []string{"charmers"},
-				Write: []string{"charmers"},
-			},
-			params.StableChannel: {
-				Read:  []string{"charmers"},
-				Write: []string{"charmers"},
-			},
-		},
-	}),
+	id:       "~charmers/bundle/promulgated-0",
+	charms:   []string{"cs:wordpress", "cs:mysql"},
+	channels: []params.Channel{params.StableChannel, params.EdgeChannel},
 }, {
-	about:  "entity found, fully qualified url, few fields",
-	stored: []string{"42 cs:~charmers/utopic/mysql-42", "~who/" + storetesting.SearchSeries[0] + "/mysql-47"},
-	url:    "~who/" + storetesting.SearchSeries[0] + "/mysql-0",
-	fields: []string{"user"},
-	expect: &mongodoc.BaseEntity{
-		URL:  charm.MustParseURL("~who/mysql"),
-		User: "who",
-	},
+	id:       "~charmers/bundle/owner-url-0",
+	charms:   []string{"cs:~charmers/trusty/wordpress-5"},
+	channels: []params.Channel{params.StableChannel},
 }, {
-	about:  "entity found, partial url, only the ACLs",
-	stored: []string{"42 cs:~charmers/utopic/mysql-42", "~who/" + storetesting.SearchSeries[1] + "/mysql-47"},
-	url:    "~who/mysql-42",
-	fields: []string{"channelacls"},
-	expect: &mongodoc.BaseEntity{
-		URL: charm.MustParseURL("~who/mysql"),
-		ChannelACLs: map[params.Channel]mongodoc.ACL{
-			params.UnpublishedChannel: {
-				Read:  []string{"who"},
-				Write: []string{"who"},
-			},
-			params.EdgeChannel: {
-				Read:  []string{"who"},
-				Write: []string{"who"},
-			},
-			params.BetaChannel: {
-				Read:  []string{"who"},
-				Write: []string{"who"},
-			},
-			params.CandidateChannel: {
-				Read:  []string{"who"},
-				Write: []string{"who"},
-			},
-			params.StableChannel: {
-				Read:  []string{"who"},
-				Write: []string{"who"},
-			},
-		},
-	},
+	id:       "~charmers/bundle/edge-only-0",
+	charms:   []string{"cs:xenial/wordpress-2"},
+	channels: []params.Channel{params.EdgeChannel},
 }, {
-	about:  "entity not found, charm name",
-	stored: []string{"42 cs:~charmers/utopic/mysql-42", "~who/" + storetesting.SearchSeries[1] + "/mysql-47"},
-	url:    "rails",
+	id:     "~charmers/bundle/unpublished-0",
+	charms: []string{"cs:wordpress"},
 }, {
-	about:  "entity not found, user",
-	stored: []string{"42 cs:~charmers/utopic/mysql-42", "~who/" + storetesting.SearchSeries[1] + "/mysql-47"},
-	url:    "~dalek/mysql",
-	fields: []string{"channelacls"},
+	id:       "~charmers/bundle/other-0",
+	charms:   []string{"cs:mysql"},
+	channels: []params.Channel{params.StableChannel},
+}, {
+	id:       "~bob/bundle/other-wordpress-0",
+	charms:   []string{"cs:~bob/wordpress"},
+	channels: []params.Channel{params.StableChannel},
 }}
 
-func (s *StoreSuite) TestFindBaseEntity(c *gc.C) {
-	ch := storetesting.Charms.CharmDir("wordpress")
+var bundlesContainingTests = []struct {
+	about     string
+	url       string
+	channel   params.Channel
+	expectIds []string
+}{{
+	about:   "owner URL in stable channel",
+	url:     "~charmers/trusty/wordpress-1",
+	channel: params.StableChannel,
+	expectIds: []string{
+		"~charmers/bundle/owner-url-0",
+		"~charmers/bundle/promulgated-0",
+	},
+}, {
+	about:   "no channel is treated as stable",
+	url:     "~charmers/trusty/wordpress-1",
+	channel: params.NoChannel,
+	expectIds: []string{
+		"~charmers/bundle/owner-url-0",
+		"~charmers/bundle/promulgated-0",
+	},
+}, {
+	about:   "promulgated URL in stable channel",
+	url:     "wordpress",
+	channel: params.StableChannel,
+	expectIds: []string{
+		"~charmers/bundle/owner-url-0",
+		"~charmers/bundle/promulgated-0",
+	},
+}, {
+	about:   "edge channel",
+	url:     "~charmers/wordpress",
+	channel: params.EdgeChannel,
+	expectIds: []string{
+		"~charmers/bundle/edge-only-0",
+		"~charmers/bundle/promulgated-0",
+	},
+}, {
+	about:   "unpublished channel includes all bundles",
+	url:     "~charmers/trusty/wordpress-1",
+	channel: params.UnpublishedChannel,
+	expectIds: []string{
+		"~charmers/bundle/edge-only-0",
+		"~charmers/bundle/owner-url-0",
+		"~charmers/bundle/promulgated-0",
+		"~charmers/bundle/unpublished-0",
+	},
+}, {
+	about:     "non-promulgated charm",
+	url:       "~bob/trusty/wordpress-0",
+	channel:   params.StableChannel,
+	expectIds: []string{"~bob/bundle/other-wordpress-0"},
+}, {
+	about:     "charm not in the store",
+	url:       "~alice/haproxy",
+	channel:   params.StableChannel,
+	expectIds: []string{},
+}}
+
+func (s *StoreSuite) TestBundlesContaining(c *gc.C) {
 	store := s.newStore(c, false)
 	defer store.Close()
-	for i, test := range findBaseEntityTests {
-		c.Logf("test %d: %s", i, test.about)
-
-		// Add initial charms to the store.
-		for _, url := range MustParseResolvedURLs(test.stored) {
-			err := store.AddCharmWithArchive(url, ch)
-			c.Assert(err, gc.Equals, nil)
+	wordpress := router.MustNewResolvedURL("~charmers/trusty/wordpress-1", 1)
+	err := store.AddCharmWithArchive(wordpress, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	err = store.SetPromulgated(wordpress, true)
+	c.Assert(err, gc.Equals, nil)
+	for _, b := range bundlesContainingBundles {
+		id := router.MustNewResolvedURL(b.id, -1)
+		apps := make(map[string]*charm.ApplicationSpec)
+		for i, ch := range b.charms {
+			apps[fmt.Sprintf("app%d", i)] = &charm.ApplicationSpec{
+				Charm: ch,
+			}
 		}
-
-		// Find the entity.
-		id := charm.MustParseURL(test.url)
-		baseEntity, err := store.FindBaseEntity(id, FieldSelector(test.fields...))
-		if test.expect == nil {
-			// We don't expect the entity to be found.
-			c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
-			c.Assert(baseEntity, gc.IsNil)
-		} else {
+		err := store.AddBundleWithArchive(id, storetesting.NewBundle(&charm.BundleData{
+			Applications: apps,
+		}))
+		c.Assert(err, gc.Equals, nil)
+		if len(b.channels) > 0 {
+			err = store.Publish(id, nil, b.channels...)
 			c.Assert(err, gc.Equals, nil)
-			c.Assert(storetesting.NormalizeBaseEntity(baseEntity), jc.DeepEquals, storetesting.NormalizeBaseEntity(test.expect))
 		}
-
-		// Remove all the entities from the store.
-		_, err = store.DB.Entities().RemoveAll(nil)
-		c.Assert(err, gc.Equals, nil)
-		_, err = store.DB.BaseEntities().RemoveAll(nil)
+	}
+	for i, test := range bundlesContainingTests {
+		c.Logf("test %d: %s", i, test.about)
+		urls, err := store.BundlesContaining(charm.MustParseURL(test.url), test.channel)
 		c.Assert(err, gc.Equals, nil)
+		ids := make([]string, len(urls))
+		for i, url := range urls {
+			ids[i] = url.URL.Path()
+		}
+		c.Assert(ids, jc.DeepEquals, test.expectIds)
 	}
 }
 
-func (s *StoreSuite) TestAddCharmsWithTheSameBaseEntity(c *gc.C) {
+func (s *StoreSuite) TestFilterPublished(c *gc.C) {
 	store := s.newStore(c, false)
 	defer store.Close()
+	stable := router.MustNewResolvedURL("~charmers/trusty/wordpress-0", -1)
+	edge := router.MustNewResolvedURL("~charmers/trusty/wordpress-1", -1)
+	unpublished := router.MustNewResolvedURL("~charmers/trusty/wordpress-2", -1)
+	promulgated := router.MustNewResolvedURL("~charmers/trusty/mysql-0", 3)
+	for _, url := range []*router.ResolvedURL{stable, edge, unpublished, promulgated} {
+		err := store.AddCharmWithArchive(url, storetesting.NewCharm(nil))
+		c.Assert(err, gc.Equals, nil)
+	}
+	err := store.Publish(stable, nil, params.StableChannel, params.EdgeChannel)
+	c.Assert(err, gc.Equals, nil)
+	err = store.Publish(edge, nil, params.EdgeChannel)
+	c.Assert(err, gc.Equals, nil)
+	err = store.Publish(promulgated, nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	missing := router.MustNewResolvedURL("~charmers/trusty/wordpress-3", -1)
+	urls := []*router.ResolvedURL{promulgated, unpublished, missing, edge, stable}
 
-	// Add a charm to the database.
-	ch := storetesting.Charms.CharmDir("wordpress")
-	url := router.MustNewResolvedURL("~charmers/"+storetesting.SearchSeries[1]+"/wordpress-12", 12)
-	err := store.AddCharmWithArchive(url, ch)
+	filtered, err := store.FilterPublished(urls, params.StableChannel)
 	c.Assert(err, gc.Equals, nil)
+	c.Assert(filtered, jc.DeepEquals, []*router.ResolvedURL{promulgated, stable})
 
-	// Add a second charm to the database, sharing the same base URL.
-	err = store.AddCharmWithArchive(router.MustNewResolvedURL("~charmers/utopic/wordpress-13", -1), ch)
+	filtered, err = store.FilterPublished(urls, params.NoChannel)
 	c.Assert(err, gc.Equals, nil)
+	c.Assert(filtered, jc.DeepEquals, []*router.ResolvedURL{promulgated, stable})
 
-	// Ensure a single base entity has been created.
-	num, err := store.DB.BaseEntities().Count()
+	filtered, err = store.FilterPublished(urls, params.EdgeChannel)
 	c.Assert(err, gc.Equals, nil)
-	c.Assert(num, gc.Equals, 1)
-}
+	c.Assert(filtered, jc.DeepEquals, []*router.ResolvedURL{edge, stable})
 
-type entitiesByURL []*mongodoc.Entity
+	filtered, err = store.FilterPublished(urls, params.CandidateChannel)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(filtered, gc.HasLen, 0)
 
-func (s entitiesByURL) Len() int      { return len(s) }
-func (s entitiesByURL) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
-func (s entitiesByURL) Less(i, j int) bool {
-	return s[i].URL.String() < s[j].URL.String()
+	filtered, err = store.FilterPublished(urls, params.UnpublishedChannel)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(filtered, jc.DeepEquals, []*router.ResolvedURL{promulgated, unpublished, edge, stable})
+
+	filtered, err = store.FilterPublished(nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(filtered, gc.HasLen, 0)
 }
 
-type entitiesByPromulgatedURL []*mongodoc.Entity
+func (s *StoreSuite) TestPurgeUser(c *gc.C) {
+	s.PatchValue(&blobGCGracePeriod, time.Duration(0))
+	store := s.newStore(c, false)
+	defer store.Close()
 
-func (s entitiesByPromulgatedURL) Len() int      { return len(s) }
-func (s entitiesByPromulgatedURL) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
-func (s entitiesByPromulgatedURL) Less(i, j int) bool {
-	return s[i].PromulgatedURL.String() < s[j].PromulgatedURL.String()
+	// Add a charm with a resource, a bundle and a reserved
+	// name for bob.
+	charmURL := router.MustNewResolvedURL("~bob/xenial/wordpress-0", -1)
+	err := store.AddCharmWithArchive(charmURL, storetesting.NewCharm(storetesting.MetaWithResources(nil, "data")))
+	c.Assert(err, gc.Equals, nil)
+	resourceData := "some resource data"
+	res, err := store.UploadResource(charmURL, "data", -1, strings.NewReader(resourceData), hashOfString(resourceData), int64(len(resourceData)))
+	c.Assert(err, gc.Equals, nil)
+	err = store.Publish(charmURL, map[string]int{"data": res.Revision}, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	b := storetesting.Charms.BundleDir("wordpress-simple")
+	s.addRequiredCharms(c, b)
+	bundleURL := router.MustNewResolvedURL("~bob/bundle/wordpress-simple-0", -1)
+	err = store.AddBundleWithArchive(bundleURL, b)
+	c.Assert(err, gc.Equals, nil)
+	err = store.ReserveName(charm.MustParseURL("~bob/reserved"), "bob")
+	c.Assert(err, gc.Equals, nil)
+	_, err = store.CreateAPIToken("bob", time.Now().Add(time.Hour))
+	c.Assert(err, gc.Equals, nil)
+
+	err = store.IncrementDownloadCounts(charmURL)
+	c.Assert(err, gc.Equals, nil)
+
+	// Add a charm for alice, which should not be affected apart
+	// from the references to bob: bob can read it, has published it
+	// and has requested that it be published.
+	aliceURL := router.MustNewResolvedURL("~alice/xenial/wordpress-0", -1)
+	err = store.AddCharmWithArchive(aliceURL, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	err = store.SetPerms(&aliceURL.URL, "stable.read", "alice", "bob")
+	c.Assert(err, gc.Equals, nil)
+	err = store.SetPerms(&aliceURL.URL, "stable.write", "bob")
+	c.Assert(err, gc.Equals, nil)
+	err = store.PublishAs("bob", aliceURL, nil, false, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	err = store.DB.PendingPublishes().Insert(&mongodoc.PendingPublish{
+		Id:      pendingPublishId(&aliceURL.URL, params.CandidateChannel),
+		URL:     &aliceURL.URL,
+		Channel: params.CandidateChannel,
+		User:    "bob",
+		Time:    time.Now(),
+	})
+	c.Assert(err, gc.Equals, nil)
+	err = store.IncrementDownloadCounts(aliceURL)
+	c.Assert(err, gc.Equals, nil)
+
+	var blobHashes []string
+	for _, url := range []*router.ResolvedURL{charmURL, bundleURL} {
+		entity, err := store.FindEntity(url, FieldSelector("blobhash"))
+		c.Assert(err, gc.Equals, nil)
+		blobHashes = append(blobHashes, entity.BlobHash)
+	}
+	blobHashes = append(blobHashes, res.BlobHash)
+
+	report, err := store.PurgeUser("bob", false)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(report.AuditEntries > 0, gc.Equals, true)
+	report.AuditEntries = 0
+	c.Assert(report, jc.DeepEquals, PurgeReport{
+		Entities:     2,
+		BaseEntities: 2,
+		Reservations: 1,
+		Resources:    1,
+	})
+
+	for _, url := range []*router.ResolvedURL{charmURL, bundleURL} {
+		_, err = store.FindEntity(url, nil)
+		c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+		_, err = store.FindBaseEntity(&url.URL, nil)
+		c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	}
+	n, err := store.DB.BaseEntities().Find(bson.D{{"user", "bob"}}).Count()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 0)
+	n, err = store.DB.Resources().Find(bson.D{{"baseurl", charm.MustParseURL("~bob/wordpress")}}).Count()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 0)
+	n, err = store.DB.Audit().Find(bson.D{{"user", "bob"}}).Count()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 0)
+	n, err = store.DB.APITokens().Find(bson.D{{"user", "bob"}}).Count()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 0)
+	for _, hash := range blobHashes {
+		_, _, err := store.BlobStore.Open(hash, nil)
+		c.Assert(errgo.Cause(err), gc.Equals, blobstore.ErrNotFound, gc.Commentf("blob %s", hash))
+	}
+
+	n, err = store.DB.DownloadCounts().Find(bson.D{{"id", bson.RegEx{Pattern: "^cs:~bob/"}}}).Count()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 0)
+	n, err = store.DB.PendingPublishes().Find(bson.D{{"user", "bob"}}).Count()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 0)
+
+	// Alice's charm is still there, but no longer refers to bob.
+	_, err = store.FindEntity(aliceURL, nil)
+	c.Assert(err, gc.Equals, nil)
+	aliceBase, err := store.FindBaseEntity(&aliceURL.URL, FieldSelector("channelacls", "publishhistory"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(aliceBase.ChannelACLs[params.StableChannel], jc.DeepEquals, mongodoc.ACL{
+		Read: []string{"alice"},
+	})
+	c.Assert(aliceBase.PublishHistory, gc.Not(gc.HasLen), 0)
+	for _, h := range aliceBase.PublishHistory {
+		c.Assert(h.User, gc.Equals, "")
+	}
+	n, err = store.DB.DownloadCounts().Find(bson.D{{"id", bson.RegEx{Pattern: "^cs:~alice/"}}}).Count()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Not(gc.Equals), 0)
+
+	// Purging again removes nothing.
+	report, err = store.PurgeUser("bob", false)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(report, jc.DeepEquals, PurgeReport{})
 }
 
-var bundleUnitCountTests = []struct {
-	about       string
-	data        *charm.BundleData
-	expectUnits int
-}{{
-	about: "no units",
-	data: &charm.BundleData{
-		Applications: map[string]*charm.ApplicationSpec{
-			"wordpress": {
-				Charm:    "cs:utopic/wordpress-0",
-				NumUnits: 0,
-			},
-			"mysql": {
-				Charm:    "cs:" + storetesting.SearchSeries[1] + "/mysql-0",
-				NumUnits: 0,
-			},
-		},
-	},
+func (s *StoreSuite) TestPurgeUserPromulgated(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	url := router.MustNewResolvedURL("~bob/xenial/wordpress-0", 0)
+	err := store.AddCharmWithArchive(url, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	err = store.SetPromulgated(url, true)
+	c.Assert(err, gc.Equals, nil)
+
+	_, err = store.PurgeUser("bob", false)
+	c.Assert(err, gc.ErrorMatches, `cannot purge user "bob": user owns promulgated entities cs:~bob/wordpress`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrForbidden)
+	_, err = store.FindEntity(url, nil)
+	c.Assert(err, gc.Equals, nil)
+
+	report, err := store.PurgeUser("bob", true)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(report.Entities, gc.Equals, 1)
+	c.Assert(report.BaseEntities, gc.Equals, 1)
+	_, err = store.FindEntity(url, nil)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+var latestPublishedRevisionTests = []struct {
+	about       string
+	baseURL     string
+	series      string
+	channel     params.Channel
+	expectURL   string
+	expectError string
+}{{
+	about:     "single series charm in stable channel",
+	baseURL:   "cs:~charmers/wordpress",
+	series:    "trusty",
+	channel:   params.StableChannel,
+	expectURL: "0 cs:~charmers/trusty/wordpress-0",
+}, {
+	about:     "single series charm in edge channel",
+	baseURL:   "cs:~charmers/wordpress",
+	series:    "trusty",
+	channel:   params.EdgeChannel,
+	expectURL: "0 cs:~charmers/trusty/wordpress-0",
+}, {
+	about:     "multi-series charm",
+	baseURL:   "cs:~charmers/wordpress",
+	series:    "xenial",
+	channel:   params.EdgeChannel,
+	expectURL: "1 cs:~charmers/wordpress-1",
+}, {
+	about:     "multi-series charm, other supported series",
+	baseURL:   "cs:~charmers/wordpress",
+	series:    "bionic",
+	channel:   params.EdgeChannel,
+	expectURL: "1 cs:~charmers/wordpress-1",
+}, {
+	about:     "promulgated base URL",
+	baseURL:   "cs:wordpress",
+	series:    "trusty",
+	channel:   params.StableChannel,
+	expectURL: "0 cs:~charmers/trusty/wordpress-0",
+}, {
+	about:       "series not published in channel",
+	baseURL:     "cs:~charmers/wordpress",
+	series:      "xenial",
+	channel:     params.StableChannel,
+	expectError: `no cs:~charmers/wordpress entity published for series "xenial" in stable channel`,
 }, {
-	about: "a single unit",
-	data: &charm.BundleData{
-		Applications: map[string]*charm.ApplicationSpec{
-			"wordpress": {
-				Charm:    "cs:" + storetesting.SearchSeries[1] + "/wordpress-42",
-				NumUnits: 1,
-			},
-			"mysql": {
-				Charm:    "cs:" + storetesting.SearchSeries[1] + "/mysql-47",
-				NumUnits: 0,
-			},
-		},
-	},
-	expectUnits: 1,
+	about:       "nothing published in channel",
+	baseURL:     "cs:~charmers/wordpress",
+	series:      "trusty",
+	channel:     params.BetaChannel,
+	expectError: `no cs:~charmers/wordpress entity published for series "trusty" in beta channel`,
 }, {
-	about: "multiple units",
-	data: &charm.BundleData{
-		Applications: map[string]*charm.ApplicationSpec{
-			"wordpress": {
-				Charm:    "cs:utopic/wordpress-1",
-				NumUnits: 1,
-			},
-			"mysql": {
-				Charm:    "cs:utopic/mysql-2",
-				NumUnits: 2,
-			},
-			"riak": {
-				Charm:    "cs:utopic/riak-3",
-				NumUnits: 5,
-			},
-		},
-	},
-	expectUnits: 8,
+	about:       "unknown series",
+	baseURL:     "cs:~charmers/wordpress",
+	series:      "precise",
+	channel:     params.EdgeChannel,
+	expectError: `no cs:~charmers/wordpress entity published for series "precise" in edge channel`,
+}, {
+	about:       "unpublished channel",
+	baseURL:     "cs:~charmers/wordpress",
+	series:      "trusty",
+	channel:     params.UnpublishedChannel,
+	expectError: `no cs:~charmers/wordpress entity published for series "trusty" in unpublished channel`,
+}, {
+	about:       "base entity not found",
+	baseURL:     "cs:~charmers/mysql",
+	series:      "trusty",
+	channel:     params.StableChannel,
+	expectError: `base entity not found`,
 }}
 
-func (s *StoreSuite) TestBundleUnitCount(c *gc.C) {
+func (s *StoreSuite) TestLatestPublishedRevision(c *gc.C) {
 	store := s.newStore(c, false)
 	defer store.Close()
-	entities := store.DB.Entities()
-	for i, test := range bundleUnitCountTests {
-		c.Logf("test %d: %s", i, test.about)
-		url := router.MustNewResolvedURL("cs:~charmers/bundle/wordpress-simple-0", -1)
-		url.URL.Revision = i
-		url.PromulgatedRevision = i
 
-		// Add the bundle used for this test.
-		b := storetesting.NewBundle(test.data)
-		s.addRequiredCharms(c, b)
-		err := store.AddBundleWithArchive(url, b)
-		c.Assert(err, gc.Equals, nil)
+	id := MustParseResolvedURL("0 cs:~charmers/trusty/wordpress-0")
+	err := store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	err = store.Publish(id, nil, params.StableChannel, params.EdgeChannel)
+	c.Assert(err, gc.Equals, nil)
 
-		// Retrieve the bundle from the database.
-		var doc mongodoc.Entity
-		err = entities.FindId(&url.URL).One(&doc)
-		c.Assert(err, gc.Equals, nil)
+	id = MustParseResolvedURL("1 cs:~charmers/wordpress-1")
+	err = store.AddCharmWithArchive(id, storetesting.NewCharm(storetesting.MetaWithSupportedSeries(nil, "xenial", "bionic")))
+	c.Assert(err, gc.Equals, nil)
+	err = store.Publish(id, nil, params.EdgeChannel)
+	c.Assert(err, gc.Equals, nil)
 
-		c.Assert(*doc.BundleUnitCount, gc.Equals, test.expectUnits)
+	for i, test := range latestPublishedRevisionTests {
+		c.Logf("test %d: %s", i, test.about)
+		rurl, err := store.LatestPublishedRevision(charm.MustParseURL(test.baseURL), test.series, test.channel)
+		if test.expectError != "" {
+			c.Assert(err, gc.ErrorMatches, test.expectError)
+			c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+			continue
+		}
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(rurl, jc.DeepEquals, MustParseResolvedURL(test.expectURL))
 	}
 }
 
-var bundleMachineCountTests = []struct {
-	about          string
-	data           *charm.BundleData
-	expectMachines int
-}{{
-	about: "no machines",
-	data: &charm.BundleData{
-		Applications: map[string]*charm.ApplicationSpec{
-			"mysql": {
-				Charm:    "cs:utopic/mysql-0",
-				NumUnits: 0,
-			},
-			"wordpress": {
-				Charm:    "cs:" + storetesting.SearchSeries[1] + "/wordpress-0",
-				NumUnits: 0,
-			},
-		},
-	},
-}, {
-	about: "a single machine (no placement)",
-	data: &charm.BundleData{
-		Applications: map[string]*charm.ApplicationSpec{
-			"mysql": {
-				Charm:    "cs:" + storetesting.SearchSeries[1] + "/mysql-42",
-				NumUnits: 1,
-			},
-			"wordpress": {
-				Charm:    "cs:" + storetesting.SearchSeries[1] + "/wordpress-47",
-				NumUnits: 0,
-			},
-		},
-	},
-	expectMachines: 1,
-}, {
-	about: "a single machine (machine placement)",
-	data: &charm.BundleData{
-		Applications: map[string]*charm.ApplicationSpec{
-			"mysql": {
-				Charm:    "cs:" + storetesting.SearchSeries[1] + "/mysql-42",
-				NumUnits: 1,
-				To:       []string{"1"},
-			},
-		},
-		Machines: map[string]*charm.MachineSpec{
-			"1": nil,
-		},
-	},
-	expectMachines: 1,
-}, {
-	about: "a single machine (hulk smash)",
-	data: &charm.BundleData{
-		Applications: map[string]*charm.ApplicationSpec{
-			"mysql": {
-				Charm:    "cs:" + storetesting.SearchSeries[1] + "/mysql-42",
-				NumUnits: 1,
-				To:       []string{"1"},
-			},
-			"wordpress": {
-				Charm:    "cs:" + storetesting.SearchSeries[1] + "/wordpress-47",
-				NumUnits: 1,
-				To:       []string{"1"},
-			},
+func (s *StoreSuite) TestChannelHeads(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	id := MustParseResolvedURL("0 cs:~charmers/trusty/wordpress-0")
+	err := store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	err = store.Publish(id, nil, params.StableChannel, params.EdgeChannel)
+	c.Assert(err, gc.Equals, nil)
+
+	id = MustParseResolvedURL("1 cs:~charmers/wordpress-1")
+	err = store.AddCharmWithArchive(id, storetesting.NewCharm(storetesting.MetaWithSupportedSeries(nil, "xenial", "bionic")))
+	c.Assert(err, gc.Equals, nil)
+	err = store.Publish(id, nil, params.EdgeChannel)
+	c.Assert(err, gc.Equals, nil)
+
+	id = MustParseResolvedURL("cs:~bob/trusty/wordpress-0")
+	err = store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+
+	heads, err := store.ChannelHeads(charm.MustParseURL("~charmers/wordpress"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(heads, jc.DeepEquals, map[params.Channel]map[string]*router.ResolvedURL{
+		params.StableChannel: {
+			"trusty": MustParseResolvedURL("0 cs:~charmers/trusty/wordpress-0"),
 		},
-		Machines: map[string]*charm.MachineSpec{
-			"1": nil,
+		params.EdgeChannel: {
+			"trusty": MustParseResolvedURL("0 cs:~charmers/trusty/wordpress-0"),
+			"xenial": MustParseResolvedURL("1 cs:~charmers/wordpress-1"),
+			"bionic": MustParseResolvedURL("1 cs:~charmers/wordpress-1"),
 		},
-	},
-	expectMachines: 1,
-}, {
-	about: "a single machine (co-location)",
-	data: &charm.BundleData{
-		Applications: map[string]*charm.ApplicationSpec{
-			"mysql": {
-				Charm:    "cs:" + storetesting.SearchSeries[1] + "/mysql-42",
-				NumUnits: 1,
-			},
-			"wordpress": {
-				Charm:    "cs:" + storetesting.SearchSeries[1] + "/wordpress-47",
-				NumUnits: 1,
-				To:       []string{"mysql/0"},
+	})
+
+	// An entity that has never been published has no heads.
+	heads, err = store.ChannelHeads(charm.MustParseURL("~bob/wordpress"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(heads, gc.HasLen, 0)
+
+	_, err = store.ChannelHeads(charm.MustParseURL("~charmers/mysql"))
+	c.Assert(err, gc.ErrorMatches, "base entity not found")
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *StoreSuite) TestChannelStatus(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	var now time.Time
+	s.PatchValue(&timeNow, func() time.Time {
+		return now
+	})
+
+	now = time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)
+	id0 := MustParseResolvedURL("cs:~charmers/trusty/wordpress-0")
+	err := store.AddCharmWithArchive(id0, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	err = store.Publish(id0, nil, params.EdgeChannel)
+	c.Assert(err, gc.Equals, nil)
+
+	now = time.Date(2020, 3, 2, 0, 0, 0, 0, time.UTC)
+	id1 := MustParseResolvedURL("cs:~charmers/xenial/wordpress-1")
+	err = store.AddCharmWithArchive(id1, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	err = store.Publish(id1, nil, params.EdgeChannel)
+	c.Assert(err, gc.Equals, nil)
+
+	// A charm released only to edge shows the other channels
+	// as empty.
+	baseEntity, err := store.FindBaseEntity(charm.MustParseURL("~charmers/wordpress"), FieldSelector("channelentities", "publishhistory"))
+	c.Assert(err, gc.Equals, nil)
+	status, err := store.ChannelStatus(baseEntity)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(status, jc.DeepEquals, map[params.Channel]*ChannelStatus{
+		params.StableChannel:    nil,
+		params.CandidateChannel: nil,
+		params.BetaChannel:      nil,
+		params.EdgeChannel: {
+			Heads: map[string]*router.ResolvedURL{
+				"trusty": id0,
+				"xenial": id1,
 			},
+			PublishTime: time.Date(2020, 3, 2, 0, 0, 0, 0, time.UTC),
 		},
-	},
-	expectMachines: 1,
-}, {
-	about: "a single machine (containerization)",
-	data: &charm.BundleData{
+	})
+
+	// An entity that has never been published has every channel
+	// empty.
+	id := MustParseResolvedURL("cs:~bob/trusty/wordpress-0")
+	err = store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	baseEntity, err = store.FindBaseEntity(charm.MustParseURL("~bob/wordpress"), FieldSelector("channelentities", "publishhistory"))
+	c.Assert(err, gc.Equals, nil)
+	status, err = store.ChannelStatus(baseEntity)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(status, jc.DeepEquals, map[params.Channel]*ChannelStatus{
+		params.StableChannel:    nil,
+		params.CandidateChannel: nil,
+		params.BetaChannel:      nil,
+		params.EdgeChannel:      nil,
+	})
+}
+
+func (s *StoreSuite) TestBundleClosure(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	for _, ch := range []struct {
+		id       string
+		channels []params.Channel
+	}{{
+		id:       "~charmers/trusty/mysql-0",
+		channels: []params.Channel{params.StableChannel},
+	}, {
+		id:       "~charmers/trusty/mysql-1",
+		channels: []params.Channel{params.EdgeChannel},
+	}, {
+		id:       "~charmers/trusty/varnish-2",
+		channels: []params.Channel{params.StableChannel, params.EdgeChannel},
+	}, {
+		id:       "~charmers/trusty/wordpress-3",
+		channels: []params.Channel{params.StableChannel, params.EdgeChannel},
+	}} {
+		id := router.MustNewResolvedURL(ch.id, -1)
+		err := store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+		c.Assert(err, gc.Equals, nil)
+		err = store.Publish(id, nil, ch.channels...)
+		c.Assert(err, gc.Equals, nil)
+	}
+	bundleId := router.MustNewResolvedURL("~charmers/bundle/wordpress-simple-0", -1)
+	err := store.AddBundleWithArchive(bundleId, storetesting.NewBundle(&charm.BundleData{
 		Applications: map[string]*charm.ApplicationSpec{
-			"mysql": {
-				Charm:    "cs:" + storetesting.SearchSeries[1] + "/mysql-42",
-				NumUnits: 1,
-				To:       []string{"1"},
-			},
 			"wordpress": {
-				Charm:    "cs:" + storetesting.SearchSeries[1] + "/wordpress-47",
-				NumUnits: 1,
-				To:       []string{"lxc:1"},
+				Charm: "cs:~charmers/trusty/wordpress",
 			},
-			"riak": {
-				Charm:    "cs:utopic/riak-3",
-				NumUnits: 2,
-				To:       []string{"kvm:1"},
+			"wordpress2": {
+				Charm: "cs:~charmers/trusty/wordpress",
 			},
-		},
-		Machines: map[string]*charm.MachineSpec{
-			"1": nil,
-		},
-	},
-	expectMachines: 1,
-}, {
-	about: "multiple machines (no placement)",
-	data: &charm.BundleData{
-		Applications: map[string]*charm.ApplicationSpec{
 			"mysql": {
-				Charm:    "cs:utopic/mysql-1",
-				NumUnits: 1,
-			},
-			"wordpress": {
-				Charm:    "cs:utopic/wordpress-2",
-				NumUnits: 2,
+				Charm: "cs:~charmers/trusty/mysql",
 			},
-			"riak": {
-				Charm:    "cs:utopic/riak-3",
-				NumUnits: 5,
+			"varnish": {
+				Charm: "cs:~charmers/trusty/varnish-2",
 			},
 		},
-	},
-	expectMachines: 1 + 2 + 5,
-}, {
-	about: "multiple machines (machine placement)",
-	data: &charm.BundleData{
-		Applications: map[string]*charm.ApplicationSpec{
-			"mysql": {
-				Charm:    "cs:utopic/mysql-1",
-				NumUnits: 2,
-				To:       []string{"1", "3"},
-			},
-			"wordpress": {
-				Charm:    "cs:utopic/wordpress-2",
-				NumUnits: 1,
-				To:       []string{"2"},
-			},
+	}))
+	c.Assert(err, gc.Equals, nil)
+
+	ids, unresolved, err := store.BundleClosure(bundleId, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(unresolved, gc.HasLen, 0)
+	c.Assert(ids, jc.DeepEquals, []*router.ResolvedURL{
+		router.MustNewResolvedURL("~charmers/trusty/mysql-0", -1),
+		router.MustNewResolvedURL("~charmers/trusty/varnish-2", -1),
+		router.MustNewResolvedURL("~charmers/trusty/wordpress-3", -1),
+	})
+
+	// The charms are resolved to the heads of the requested channel.
+	ids, unresolved, err = store.BundleClosure(bundleId, params.EdgeChannel)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(unresolved, gc.HasLen, 0)
+	c.Assert(ids, jc.DeepEquals, []*router.ResolvedURL{
+		router.MustNewResolvedURL("~charmers/trusty/mysql-1", -1),
+		router.MustNewResolvedURL("~charmers/trusty/varnish-2", -1),
+		router.MustNewResolvedURL("~charmers/trusty/wordpress-3", -1),
+	})
+
+	// Charms that cannot be found in the channel are returned
+	// separately.
+	ids, unresolved, err = store.BundleClosure(bundleId, params.CandidateChannel)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(ids, gc.HasLen, 0)
+	c.Assert(unresolved, jc.DeepEquals, []*charm.URL{
+		charm.MustParseURL("cs:~charmers/trusty/mysql"),
+		charm.MustParseURL("cs:~charmers/trusty/varnish-2"),
+		charm.MustParseURL("cs:~charmers/trusty/wordpress"),
+	})
+
+	_, _, err = store.BundleClosure(router.MustNewResolvedURL("~charmers/trusty/mysql-0", -1), params.StableChannel)
+	c.Assert(err, gc.ErrorMatches, `cs:~charmers/trusty/mysql-0 is not a bundle`)
+}
+
+func (s *StoreSuite) TestHighestRevision(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	for _, test := range []struct {
+		id      string
+		publish bool
+	}{
+		{"0 cs:~charmers/trusty/wordpress-0", true},
+		{"3 cs:~charmers/xenial/wordpress-3", true},
+		{"1 cs:~charmers/trusty/wordpress-1", true},
+		// The highest revision is unpublished.
+		{"cs:~charmers/trusty/wordpress-7", false},
+		// Other users' revisions are not included.
+		{"cs:~bob/trusty/wordpress-10", true},
+	} {
+		id := MustParseResolvedURL(test.id)
+		err := store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+		c.Assert(err, gc.Equals, nil)
+		if test.publish {
+			err = store.Publish(id, nil, params.StableChannel)
+			c.Assert(err, gc.Equals, nil)
+		}
+	}
+
+	rev, err := store.HighestRevision(charm.MustParseURL("~charmers/wordpress"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(rev, gc.Equals, 7)
+
+	_, err = store.HighestRevision(charm.MustParseURL("~charmers/mysql"))
+	c.Assert(err, gc.ErrorMatches, `no entities found for cs:~charmers/mysql`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *StoreSuite) TestRecentlyPublished(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := t0
+	s.PatchValue(&timeNow, func() time.Time {
+		return now
+	})
+	publish := func(id string, t time.Time, channels ...params.Channel) {
+		now = t
+		err := store.Publish(MustParseResolvedURL(id), nil, channels...)
+		c.Assert(err, gc.Equals, nil)
+	}
+	for _, id := range []string{
+		"0 ~charmers/trusty/wordpress-0",
+		"~charmers/trusty/mysql-0",
+		"~charmers/trusty/mysql-1",
+		"~bob/trusty/haproxy-0",
+	} {
+		err := store.AddCharmWithArchive(MustParseResolvedURL(id), storetesting.NewCharm(nil))
+		c.Assert(err, gc.Equals, nil)
+	}
+	err := store.AddCharmWithArchive(MustParseResolvedURL("~charmers/varnish-0"), storetesting.NewCharm(storetesting.MetaWithSupportedSeries(nil, "trusty", "xenial")))
+	c.Assert(err, gc.Equals, nil)
+	publish("0 ~charmers/trusty/wordpress-0", t0.Add(1*time.Hour), params.StableChannel)
+	publish("~charmers/trusty/mysql-0", t0.Add(2*time.Hour), params.StableChannel, params.EdgeChannel)
+	publish("~charmers/varnish-0", t0.Add(3*time.Hour), params.StableChannel)
+	publish("~bob/trusty/haproxy-0", t0.Add(4*time.Hour), params.EdgeChannel)
+	publish("~charmers/trusty/mysql-1", t0.Add(5*time.Hour), params.EdgeChannel)
+	// Publishing again moves the entity to the front.
+	publish("0 ~charmers/trusty/wordpress-0", t0.Add(6*time.Hour), params.StableChannel)
+
+	tests := []struct {
+		about   string
+		channel params.Channel
+		limit   int
+		expect  []PublishedEntity
+	}{{
+		about:   "stable channel",
+		channel: params.StableChannel,
+		expect: []PublishedEntity{{
+			Id:   MustParseResolvedURL("0 ~charmers/trusty/wordpress-0"),
+			Time: t0.Add(6 * time.Hour),
+		}, {
+			Id:   MustParseResolvedURL("~charmers/varnish-0"),
+			Time: t0.Add(3 * time.Hour),
+		}, {
+			Id:   MustParseResolvedURL("~charmers/trusty/mysql-0"),
+			Time: t0.Add(2 * time.Hour),
+		}},
+	}, {
+		about:   "no channel is the stable channel",
+		channel: params.NoChannel,
+		limit:   1,
+		expect: []PublishedEntity{{
+			Id:   MustParseResolvedURL("0 ~charmers/trusty/wordpress-0"),
+			Time: t0.Add(6 * time.Hour),
+		}},
+	}, {
+		about:   "edge channel with limit",
+		channel: params.EdgeChannel,
+		limit:   2,
+		expect: []PublishedEntity{{
+			Id:   MustParseResolvedURL("~charmers/trusty/mysql-1"),
+			Time: t0.Add(5 * time.Hour),
+		}, {
+			Id:   MustParseResolvedURL("~bob/trusty/haproxy-0"),
+			Time: t0.Add(4 * time.Hour),
+		}},
+	}, {
+		about:   "no entities",
+		channel: params.CandidateChannel,
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: %s", i, test.about)
+		published, err := store.RecentlyPublished(test.channel, test.limit, nil)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(published, gc.HasLen, len(test.expect))
+		for j, p := range published {
+			c.Assert(p.Id, jc.DeepEquals, test.expect[j].Id)
+			c.Assert(p.Time.Equal(test.expect[j].Time), gc.Equals, true, gc.Commentf("got %v, want %v", p.Time, test.expect[j].Time))
+		}
+	}
+}
+
+func (s *StoreSuite) TestChannelHistory(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := t0
+	s.PatchValue(&timeNow, func() time.Time {
+		return now
+	})
+	for _, id := range []string{
+		"~charmers/trusty/wordpress-0",
+		"~charmers/trusty/wordpress-1",
+		"~charmers/trusty/wordpress-2",
+		"~charmers/xenial/wordpress-3",
+	} {
+		err := store.AddCharmWithArchive(MustParseResolvedURL(id), storetesting.NewCharm(nil))
+		c.Assert(err, gc.Equals, nil)
+	}
+	publish := func(user, id string, t time.Time, channels ...params.Channel) {
+		now = t
+		err := store.PublishAs(user, MustParseResolvedURL(id), nil, false, channels...)
+		c.Assert(err, gc.Equals, nil)
+	}
+	publish("bob", "~charmers/trusty/wordpress-0", t0.Add(1*time.Hour), params.StableChannel, params.EdgeChannel)
+	publish("alice", "~charmers/trusty/wordpress-1", t0.Add(2*time.Hour), params.EdgeChannel)
+	publish("alice", "~charmers/trusty/wordpress-1", t0.Add(3*time.Hour), params.StableChannel)
+	publish("bob", "~charmers/xenial/wordpress-3", t0.Add(4*time.Hour), params.StableChannel)
+	publish("bob", "~charmers/trusty/wordpress-0", t0.Add(5*time.Hour), params.StableChannel)
+	now = t0.Add(6 * time.Hour)
+	err := store.Publish(MustParseResolvedURL("~charmers/trusty/wordpress-2"), nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+
+	history, err := store.ChannelHistory(charm.MustParseURL("~charmers/wordpress"), "trusty", params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(history, jc.DeepEquals, []ChannelHistoryEntry{{
+		Revision:    2,
+		PublishedAt: t0.Add(6 * time.Hour),
+	}, {
+		Revision:    0,
+		PublishedAt: t0.Add(5 * time.Hour),
+		PublishedBy: "bob",
+	}, {
+		Revision:    1,
+		PublishedAt: t0.Add(3 * time.Hour),
+		PublishedBy: "alice",
+	}, {
+		Revision:    0,
+		PublishedAt: t0.Add(1 * time.Hour),
+		PublishedBy: "bob",
+	}})
+
+	history, err = store.ChannelHistory(charm.MustParseURL("~charmers/wordpress"), "trusty", params.EdgeChannel)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(history, jc.DeepEquals, []ChannelHistoryEntry{{
+		Revision:    1,
+		PublishedAt: t0.Add(2 * time.Hour),
+		PublishedBy: "alice",
+	}, {
+		Revision:    0,
+		PublishedAt: t0.Add(1 * time.Hour),
+		PublishedBy: "bob",
+	}})
+
+	history, err = store.ChannelHistory(charm.MustParseURL("~charmers/wordpress"), "xenial", params.EdgeChannel)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(history, gc.HasLen, 0)
+
+	_, err = store.ChannelHistory(charm.MustParseURL("~charmers/django"), "trusty", params.StableChannel)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+
+	_, err = store.ChannelHistory(charm.MustParseURL("~charmers/trusty/wordpress"), "trusty", params.StableChannel)
+	c.Assert(err, gc.ErrorMatches, `"cs:~charmers/trusty/wordpress" is not a base URL`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+}
+
+func (s *StoreSuite) TestReserveName(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	err := store.ReserveName(charm.MustParseURL("~charmers/wordpress"), "bob")
+	c.Assert(err, gc.Equals, nil)
+	bobACL := mongodoc.ACL{
+		Read:  []string{"bob"},
+		Write: []string{"bob"},
+	}
+	baseEntity, err := store.FindBaseEntity(charm.MustParseURL("~charmers/wordpress"), nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(baseEntity.User, gc.Equals, "charmers")
+	c.Assert(baseEntity.Name, gc.Equals, "wordpress")
+	for _, ch := range params.OrderedChannels {
+		c.Assert(baseEntity.ChannelACLs[ch], jc.DeepEquals, bobACL, gc.Commentf("channel %s", ch))
+	}
+	_, err = store.HighestRevision(charm.MustParseURL("~charmers/wordpress"))
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+
+	// The name cannot be reserved twice.
+	err = store.ReserveName(charm.MustParseURL("~charmers/wordpress"), "alice")
+	c.Assert(err, gc.ErrorMatches, `name cs:~charmers/wordpress is already in use`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrForbidden)
+
+	// Adding an entity keeps the reservation's ACLs.
+	err = store.AddCharmWithArchive(MustParseResolvedURL("~charmers/trusty/wordpress-0"), storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	baseEntity, err = store.FindBaseEntity(charm.MustParseURL("~charmers/wordpress"), nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(baseEntity.ChannelACLs[params.UnpublishedChannel], jc.DeepEquals, bobACL)
+}
+
+func (s *StoreSuite) TestReserveNameInvalidURL(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	err := store.ReserveName(charm.MustParseURL("~charmers/trusty/wordpress"), "bob")
+	c.Assert(err, gc.ErrorMatches, `"cs:~charmers/trusty/wordpress" is not a base URL`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+
+	err = store.ReserveName(charm.MustParseURL("wordpress"), "bob")
+	c.Assert(err, gc.ErrorMatches, `"cs:wordpress" has no user`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+}
+
+func (s *StoreSuite) TestIterEntityURLs(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	const n = 300
+	for i := 0; i < n; i++ {
+		e := &mongodoc.Entity{
+			URL:        charm.MustParseURL(fmt.Sprintf("~bob/%s/wordpress-%d", storetesting.SearchSeries[0], i)),
+			BlobHash:   fmt.Sprintf("hash%d", i),
+			Size:       int64(i + 1),
+			UploadTime: time.Now(),
+		}
+		if i%2 == 0 {
+			e.PromulgatedURL = charm.MustParseURL(fmt.Sprintf("%s/wordpress-%d", storetesting.SearchSeries[0], i))
+		}
+		err := store.DB.Entities().Insert(denormalizedEntity(e))
+		c.Assert(err, gc.Equals, nil)
+	}
+	err := store.DB.Entities().Insert(denormalizedEntity(&mongodoc.Entity{
+		URL: charm.MustParseURL("~alice/" + storetesting.SearchSeries[0] + "/mysql-0"),
+	}))
+	c.Assert(err, gc.Equals, nil)
+
+	iter, err := store.IterEntityURLs(bson.D{{"user", "bob"}})
+	c.Assert(err, gc.Equals, nil)
+	defer iter.Close()
+	seen := make(map[string]bool)
+	for iter.Next() {
+		e := iter.Entity()
+		c.Assert(e.URL.User, gc.Equals, "bob")
+		if e.URL.Revision%2 == 0 {
+			c.Assert(e.PromulgatedURL, gc.NotNil)
+			c.Assert(e.PromulgatedURL.Revision, gc.Equals, e.URL.Revision)
+		} else {
+			c.Assert(e.PromulgatedURL, gc.IsNil)
+		}
+		// Check that no other fields have been fetched.
+		c.Assert(e.BaseURL, gc.IsNil)
+		c.Assert(e.BlobHash, gc.Equals, "")
+		c.Assert(e.Size, gc.Equals, int64(0))
+		c.Assert(e.UploadTime.IsZero(), gc.Equals, true)
+		seen[e.URL.String()] = true
+	}
+	c.Assert(iter.Err(), gc.Equals, nil)
+	c.Assert(seen, gc.HasLen, n)
+}
+
+func (s *StoreSuite) TestStoreSummary(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	for _, e := range []*mongodoc.Entity{{
+		URL:      charm.MustParseURL("~bob/precise/wordpress-0"),
+		BlobHash: "hash1",
+		Size:     100,
+	}, {
+		// This revision shares its archive with the previous one.
+		URL:      charm.MustParseURL("~bob/precise/wordpress-1"),
+		BlobHash: "hash1",
+		Size:     100,
+	}, {
+		URL:      charm.MustParseURL("~bob/trusty/mysql-0"),
+		BlobHash: "hash2",
+		Size:     50,
+	}, {
+		URL:      charm.MustParseURL("~bob/bundle/wordpress-simple-0"),
+		BlobHash: "hash3",
+		Size:     10,
+	}} {
+		err := store.DB.Entities().Insert(denormalizedEntity(e))
+		c.Assert(err, gc.Equals, nil)
+	}
+	for _, r := range []*mongodoc.Resource{{
+		BaseURL:  charm.MustParseURL("~bob/wordpress"),
+		Name:     "data",
+		Revision: 0,
+		BlobHash: "resourcehash1",
+		Size:     7,
+	}, {
+		BaseURL:  charm.MustParseURL("~bob/wordpress"),
+		Name:     "data",
+		Revision: 1,
+		BlobHash: "resourcehash1",
+		Size:     7,
+	}, {
+		BaseURL:           charm.MustParseURL("~bob/wordpress"),
+		Name:              "image",
+		Revision:          0,
+		DockerImageDigest: "sha256:abcd",
+	}} {
+		err := store.DB.Resources().Insert(r)
+		c.Assert(err, gc.Equals, nil)
+	}
+	expect := StoreSummary{
+		Charms:    3,
+		Bundles:   1,
+		Resources: 3,
+		BlobBytes: 167,
+	}
+	summary, err := store.StoreSummary()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(summary, jc.DeepEquals, expect)
+
+	// The summary is cached.
+	err = store.DB.Entities().Insert(denormalizedEntity(&mongodoc.Entity{
+		URL:      charm.MustParseURL("~bob/trusty/mysql-1"),
+		BlobHash: "hash4",
+		Size:     1000,
+	}))
+	c.Assert(err, gc.Equals, nil)
+	summary, err = store.StoreSummary()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(summary, jc.DeepEquals, expect)
+
+	store.pool.statsCache.EvictAll()
+	summary, err = store.StoreSummary()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(summary, jc.DeepEquals, StoreSummary{
+		Charms:    4,
+		Bundles:   1,
+		Resources: 3,
+		BlobBytes: 1167,
+	})
+}
+
+func (s *StoreSuite) TestDuplicateBlobReport(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	groups, err := store.DuplicateBlobReport()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(groups, gc.HasLen, 0)
+
+	for _, e := range []*mongodoc.Entity{{
+		URL:      charm.MustParseURL("~bob/precise/wordpress-0"),
+		BlobHash: "hash1",
+		Size:     100,
+	}, {
+		URL:      charm.MustParseURL("~alice/precise/wordpress-3"),
+		BlobHash: "hash1",
+		Size:     100,
+	}, {
+		URL:      charm.MustParseURL("~bob/trusty/mysql-0"),
+		BlobHash: "hash2",
+		Size:     50,
+	}, {
+		URL:      charm.MustParseURL("~bob/trusty/mysql-1"),
+		BlobHash: "hash3",
+		Size:     10,
+	}} {
+		err := store.DB.Entities().Insert(denormalizedEntity(e))
+		c.Assert(err, gc.Equals, nil)
+	}
+	for _, r := range []*mongodoc.Resource{{
+		BaseURL:  charm.MustParseURL("~bob/wordpress"),
+		Name:     "data",
+		Revision: 0,
+		BlobHash: "resourcehash1",
+		Size:     7,
+	}, {
+		BaseURL:  charm.MustParseURL("~bob/wordpress"),
+		Name:     "data",
+		Revision: 1,
+		BlobHash: "resourcehash1",
+		Size:     7,
+	}, {
+		BaseURL:  charm.MustParseURL("~alice/wordpress"),
+		Name:     "data",
+		Revision: 0,
+		BlobHash: "resourcehash1",
+		Size:     7,
+	}, {
+		// A resource with the same content as an entity archive.
+		BaseURL:  charm.MustParseURL("~bob/mysql"),
+		Name:     "archive",
+		Revision: 0,
+		BlobHash: "hash3",
+		Size:     10,
+	}, {
+		BaseURL:  charm.MustParseURL("~bob/mysql"),
+		Name:     "config",
+		Revision: 0,
+		BlobHash: "resourcehash2",
+		Size:     5,
+	}, {
+		BaseURL:           charm.MustParseURL("~bob/wordpress"),
+		Name:              "image",
+		Revision:          0,
+		DockerImageDigest: "sha256:abcd",
+	}, {
+		BaseURL:           charm.MustParseURL("~bob/wordpress"),
+		Name:              "image",
+		Revision:          1,
+		DockerImageDigest: "sha256:abcd",
+	}} {
+		err := store.DB.Resources().Insert(r)
+		c.Assert(err, gc.Equals, nil)
+	}
+	groups, err = store.DuplicateBlobReport()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(groups, jc.DeepEquals, []DuplicateBlobGroup{{
+		BlobHash: "hash1",
+		Size:     100,
+		Entities: []*charm.URL{
+			charm.MustParseURL("~alice/precise/wordpress-3"),
+			charm.MustParseURL("~bob/precise/wordpress-0"),
 		},
-		Machines: map[string]*charm.MachineSpec{
-			"1": nil, "2": nil, "3": nil,
+	}, {
+		BlobHash: "hash3",
+		Size:     10,
+		Entities: []*charm.URL{
+			charm.MustParseURL("~bob/trusty/mysql-1"),
 		},
-	},
-	expectMachines: 2 + 1,
-}, {
-	about: "multiple machines (hulk smash)",
-	data: &charm.BundleData{
-		Applications: map[string]*charm.ApplicationSpec{
-			"mysql": {
-				Charm:    "cs:" + storetesting.SearchSeries[1] + "/mysql-42",
-				NumUnits: 1,
-				To:       []string{"1"},
+		Resources: []DuplicateBlobResource{{
+			BaseURL:  charm.MustParseURL("~bob/mysql"),
+			Name:     "archive",
+			Revision: 0,
+		}},
+	}, {
+		BlobHash: "resourcehash1",
+		Size:     7,
+		Resources: []DuplicateBlobResource{{
+			BaseURL:  charm.MustParseURL("~alice/wordpress"),
+			Name:     "data",
+			Revision: 0,
+		}, {
+			BaseURL:  charm.MustParseURL("~bob/wordpress"),
+			Name:     "data",
+			Revision: 0,
+		}, {
+			BaseURL:  charm.MustParseURL("~bob/wordpress"),
+			Name:     "data",
+			Revision: 1,
+		}},
+	}})
+}
+
+func (s *StoreSuite) TestOrphanedBaseEntities(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	for _, id := range []string{
+		"~charmers/trusty/wordpress-0",
+		"~charmers/trusty/wordpress-1",
+		"~charmers/trusty/mysql-0",
+	} {
+		err := store.AddCharmWithArchive(MustParseResolvedURL(id), storetesting.NewCharm(nil))
+		c.Assert(err, gc.Equals, nil)
+	}
+	// A reserved name has no entities but is not orphaned.
+	err := store.ReserveName(charm.MustParseURL("~charmers/django"), "bob")
+	c.Assert(err, gc.Equals, nil)
+
+	urls, err := store.OrphanedBaseEntities()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(urls, gc.HasLen, 0)
+
+	// Delete all the revisions of wordpress.
+	_, err = store.DB.Entities().RemoveAll(bson.D{{"baseurl", charm.MustParseURL("~charmers/wordpress")}})
+	c.Assert(err, gc.Equals, nil)
+
+	urls, err = store.OrphanedBaseEntities()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(urls, jc.DeepEquals, []*charm.URL{charm.MustParseURL("~charmers/wordpress")})
+
+	removed, err := store.RemoveBaseEntityIfOrphaned(charm.MustParseURL("~charmers/mysql"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(removed, gc.Equals, false)
+	removed, err = store.RemoveBaseEntityIfOrphaned(charm.MustParseURL("~charmers/django"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(removed, gc.Equals, false)
+	removed, err = store.RemoveBaseEntityIfOrphaned(charm.MustParseURL("~charmers/wordpress"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(removed, gc.Equals, true)
+
+	_, err = store.FindBaseEntity(charm.MustParseURL("~charmers/wordpress"), nil)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	urls, err = store.OrphanedBaseEntities()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(urls, gc.HasLen, 0)
+}
+
+func (s *StoreSuite) TestOrphanedBaseEntitiesAfterReservationUsed(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	err := store.ReserveName(charm.MustParseURL("~charmers/wordpress"), "bob")
+	c.Assert(err, gc.Equals, nil)
+	err = store.AddCharmWithArchive(MustParseResolvedURL("~charmers/trusty/wordpress-0"), storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	baseEntity, err := store.FindBaseEntity(charm.MustParseURL("~charmers/wordpress"), nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(baseEntity.Reserved, gc.Equals, false)
+
+	// Once the reservation has been used, deleting all the
+	// revisions leaves an orphan.
+	_, err = store.DB.Entities().RemoveAll(bson.D{{"baseurl", charm.MustParseURL("~charmers/wordpress")}})
+	c.Assert(err, gc.Equals, nil)
+	urls, err := store.OrphanedBaseEntities()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(urls, jc.DeepEquals, []*charm.URL{charm.MustParseURL("~charmers/wordpress")})
+}
+
+func (s *StoreSuite) TestEntitiesByUploadTime(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	const n = 10
+	// Insert the entities in reverse order of upload time
+	// to check that the iterator sorts them.
+	for i := n - 1; i >= 0; i-- {
+		err := store.DB.Entities().Insert(denormalizedEntity(&mongodoc.Entity{
+			URL:        charm.MustParseURL(fmt.Sprintf("~bob/%s/wordpress-%d", storetesting.SearchSeries[0], i)),
+			BlobHash:   fmt.Sprintf("hash%d", i),
+			UploadTime: t0.Add(time.Duration(i) * time.Hour),
+		}))
+		c.Assert(err, gc.Equals, nil)
+	}
+
+	iter := store.EntitiesByUploadTime(t0.Add(3*time.Hour), t0.Add(7*time.Hour), "uploadtime")
+	defer iter.Close()
+	var revisions []int
+	for iter.Next() {
+		e := iter.Entity()
+		c.Assert(e.UploadTime.UTC(), gc.DeepEquals, t0.Add(time.Duration(e.URL.Revision)*time.Hour))
+		// Check that only the requested fields have been fetched.
+		c.Assert(e.BlobHash, gc.Equals, "")
+		revisions = append(revisions, e.URL.Revision)
+	}
+	c.Assert(iter.Err(), gc.Equals, nil)
+	c.Assert(revisions, jc.DeepEquals, []int{3, 4, 5, 6})
+
+	// All fields are fetched when none are specified.
+	iter = store.EntitiesByUploadTime(t0.Add(9*time.Hour), t0.Add(24*time.Hour))
+	defer iter.Close()
+	c.Assert(iter.Next(), gc.Equals, true)
+	c.Assert(iter.Entity().URL.Revision, gc.Equals, 9)
+	c.Assert(iter.Entity().BlobHash, gc.Equals, "hash9")
+	c.Assert(iter.Next(), gc.Equals, false)
+	c.Assert(iter.Err(), gc.Equals, nil)
+}
+
+var findBaseEntityTests = []struct {
+	about  string
+	stored []string
+	url    string
+	fields []string
+	expect *mongodoc.BaseEntity
+}{{
+	about:  "entity found, base url, all fields",
+	stored: []string{"42 cs:~charmers/utopic/mysql-42"},
+	url:    "mysql",
+	expect: storetesting.NormalizeBaseEntity(&mongodoc.BaseEntity{
+		URL:         charm.MustParseURL("~charmers/mysql"),
+		User:        "charmers",
+		Name:        "mysql",
+		Promulgated: true,
+		ChannelACLs: map[params.Channel]mongodoc.ACL{
+			params.UnpublishedChannel: {
+				Read:  []string{"charmers"},
+				Write: []string{"charmers"},
 			},
-			"wordpress": {
-				Charm:    "cs:" + storetesting.SearchSeries[1] + "/wordpress-47",
-				NumUnits: 1,
-				To:       []string{"2"},
+			params.EdgeChannel: {
+				Read:  []string{"charmers"},
+				Write: []string{"charmers"},
 			},
-			"riak": {
-				Charm:    "cs:utopic/riak-3",
-				NumUnits: 2,
-				To:       []string{"1", "2"},
+			params.BetaChannel: {
+				Read:  []string{"charmers"},
+				Write: []string{"charmers"},
 			},
-		},
-		Machines: map[string]*charm.MachineSpec{
-			"1": nil, "2": nil,
-		},
-	},
-	expectMachines: 1 + 1 + 0,
-}, {
-	about: "multiple machines (co-location)",
-	data: &charm.BundleData{
-		Applications: map[string]*charm.ApplicationSpec{
-			"mysql": {
-				Charm:    "cs:" + storetesting.SearchSeries[1] + "/mysql-42",
-				NumUnits: 2,
+			params.CandidateChannel: {
+				Read:  []string{"charmers"},
+				Write: []string{"charmers"},
 			},
-			"wordpress": {
-				Charm:    "cs:" + storetesting.SearchSeries[1] + "/wordpress-47",
-				NumUnits: 3,
-				To:       []string{"mysql/0", "mysql/1", "new"},
+			params.StableChannel: {
+				Read:  []string{"charmers"},
+				Write: []string{"charmers"},
 			},
 		},
+	}),
+}, {
+	about:  "entity found, fully qualified url, few fields",
+	stored: []string{"42 cs:~charmers/utopic/mysql-42", "~who/" + storetesting.SearchSeries[0] + "/mysql-47"},
+	url:    "~who/" + storetesting.SearchSeries[0] + "/mysql-0",
+	fields: []string{"user"},
+	expect: &mongodoc.BaseEntity{
+		URL:  charm.MustParseURL("~who/mysql"),
+		User: "who",
 	},
-	expectMachines: 2 + 1,
 }, {
-	about: "multiple machines (containerization)",
-	data: &charm.BundleData{
-		Applications: map[string]*charm.ApplicationSpec{
-			"mysql": {
-				Charm:    "cs:" + storetesting.SearchSeries[1] + "/mysql-42",
-				NumUnits: 2,
-				To:       []string{"1", "2"},
+	about:  "entity found, partial url, only the ACLs",
+	stored: []string{"42 cs:~charmers/utopic/mysql-42", "~who/" + storetesting.SearchSeries[1] + "/mysql-47"},
+	url:    "~who/mysql-42",
+	fields: []string{"channelacls"},
+	expect: &mongodoc.BaseEntity{
+		URL: charm.MustParseURL("~who/mysql"),
+		ChannelACLs: map[params.Channel]mongodoc.ACL{
+			params.UnpublishedChannel: {
+				Read:  []string{"who"},
+				Write: []string{"who"},
 			},
-			"wordpress": {
-				Charm:    "cs:" + storetesting.SearchSeries[1] + "/wordpress-47",
-				NumUnits: 4,
-				To:       []string{"lxc:1", "lxc:2", "lxc:3", "lxc:3"},
+			params.EdgeChannel: {
+				Read:  []string{"who"},
+				Write: []string{"who"},
 			},
-			"riak": {
-				Charm:    "cs:utopic/riak-3",
-				NumUnits: 1,
-				To:       []string{"kvm:2"},
+			params.BetaChannel: {
+				Read:  []string{"who"},
+				Write: []string{"who"},
+			},
+			params.CandidateChannel: {
+				Read:  []string{"who"},
+				Write: []string{"who"},
+			},
+			params.StableChannel: {
+				Read:  []string{"who"},
+				Write: []string{"who"},
 			},
-		},
-		Machines: map[string]*charm.MachineSpec{
-			"1": nil, "2": nil, "3": nil,
 		},
 	},
-	expectMachines: 2 + 1 + 0,
 }, {
-	about: "multiple machines (partial placement in a container)",
+	about:  "entity not found, charm name",
+	stored: []string{"42 cs:~charmers/utopic/mysql-42", "~who/" + storetesting.SearchSeries[1] + "/mysql-47"},
+	url:    "rails",
+}, {
+	about:  "entity not found, user",
+	stored: []string{"42 cs:~charmers/utopic/mysql-42", "~who/" + storetesting.SearchSeries[1] + "/mysql-47"},
+	url:    "~dalek/mysql",
+	fields: []string{"channelacls"},
+}}
+
+func (s *StoreSuite) TestFindBaseEntity(c *gc.C) {
+	ch := storetesting.Charms.CharmDir("wordpress")
+	store := s.newStore(c, false)
+	defer store.Close()
+	for i, test := range findBaseEntityTests {
+		c.Logf("test %d: %s", i, test.about)
+
+		// Add initial charms to the store.
+		for _, url := range MustParseResolvedURLs(test.stored) {
+			err := store.AddCharmWithArchive(url, ch)
+			c.Assert(err, gc.Equals, nil)
+		}
+
+		// Find the entity.
+		id := charm.MustParseURL(test.url)
+		baseEntity, err := store.FindBaseEntity(id, FieldSelector(test.fields...))
+		if test.expect == nil {
+			// We don't expect the entity to be found.
+			c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+			c.Assert(baseEntity, gc.IsNil)
+		} else {
+			c.Assert(err, gc.Equals, nil)
+			c.Assert(storetesting.NormalizeBaseEntity(baseEntity), jc.DeepEquals, storetesting.NormalizeBaseEntity(test.expect))
+		}
+
+		// Remove all the entities from the store.
+		_, err = store.DB.Entities().RemoveAll(nil)
+		c.Assert(err, gc.Equals, nil)
+		_, err = store.DB.BaseEntities().RemoveAll(nil)
+		c.Assert(err, gc.Equals, nil)
+	}
+}
+
+func (s *StoreSuite) TestCandidateBaseEntities(c *gc.C) {
+	ch := storetesting.Charms.CharmDir("wordpress")
+	store := s.newStore(c, false)
+	defer store.Close()
+	for _, url := range MustParseResolvedURLs([]string{
+		"~bob/trusty/wordpress-0",
+		"~bob/precise/wordpress-1",
+		"~alice/trusty/wordpress-0",
+		"0 ~charmers/trusty/wordpress-0",
+		"~bob/trusty/mysql-0",
+	}) {
+		err := store.AddCharmWithArchive(url, ch)
+		c.Assert(err, gc.Equals, nil)
+	}
+	err := store.SetPromulgated(MustParseResolvedURL("0 ~charmers/trusty/wordpress-0"), true)
+	c.Assert(err, gc.Equals, nil)
+
+	baseEntities, err := store.CandidateBaseEntities("wordpress", FieldSelector("promulgated"))
+	c.Assert(err, gc.Equals, nil)
+	var ids []string
+	var promulgated []bool
+	for _, baseEntity := range baseEntities {
+		ids = append(ids, baseEntity.URL.String())
+		promulgated = append(promulgated, bool(baseEntity.Promulgated))
+		// Fields that were not selected are not populated.
+		c.Assert(baseEntity.ChannelACLs, gc.IsNil)
+	}
+	c.Assert(ids, jc.DeepEquals, []string{"cs:~alice/wordpress", "cs:~bob/wordpress", "cs:~charmers/wordpress"})
+	c.Assert(promulgated, jc.DeepEquals, []bool{false, false, true})
+
+	baseEntities, err = store.CandidateBaseEntities("nothing", nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(baseEntities, gc.HasLen, 0)
+}
+
+func (s *StoreSuite) TestAddCharmsWithTheSameBaseEntity(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	// Add a charm to the database.
+	ch := storetesting.Charms.CharmDir("wordpress")
+	url := router.MustNewResolvedURL("~charmers/"+storetesting.SearchSeries[1]+"/wordpress-12", 12)
+	err := store.AddCharmWithArchive(url, ch)
+	c.Assert(err, gc.Equals, nil)
+
+	// Add a second charm to the database, sharing the same base URL.
+	err = store.AddCharmWithArchive(router.MustNewResolvedURL("~charmers/utopic/wordpress-13", -1), ch)
+	c.Assert(err, gc.Equals, nil)
+
+	// Ensure a single base entity has been created.
+	num, err := store.DB.BaseEntities().Count()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(num, gc.Equals, 1)
+}
+
+type entitiesByURL []*mongodoc.Entity
+
+func (s entitiesByURL) Len() int      { return len(s) }
+func (s entitiesByURL) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s entitiesByURL) Less(i, j int) bool {
+	return s[i].URL.String() < s[j].URL.String()
+}
+
+type entitiesByPromulgatedURL []*mongodoc.Entity
+
+func (s entitiesByPromulgatedURL) Len() int      { return len(s) }
+func (s entitiesByPromulgatedURL) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s entitiesByPromulgatedURL) Less(i, j int) bool {
+	return s[i].PromulgatedURL.String() < s[j].PromulgatedURL.String()
+}
+
+var bundleUnitCountTests = []struct {
+	about       string
+	data        *charm.BundleData
+	expectUnits int
+}{{
+	about: "no units",
 	data: &charm.BundleData{
 		Applications: map[string]*charm.ApplicationSpec{
-			"mysql": {
-				Charm:    "cs:" + storetesting.SearchSeries[1] + "/mysql-42",
-				NumUnits: 1,
-				To:       []string{"1"},
-			},
 			"wordpress": {
-				Charm:    "cs:" + storetesting.SearchSeries[1] + "/wordpress-47",
-				NumUnits: 10,
-				To:       []string{"lxc:1", "lxc:2"},
+				Charm:    "cs:utopic/wordpress-0",
+				NumUnits: 0,
+			},
+			"mysql": {
+				Charm:    "cs:" + storetesting.SearchSeries[1] + "/mysql-0",
+				NumUnits: 0,
 			},
-		},
-		Machines: map[string]*charm.MachineSpec{
-			"1": nil, "2": nil,
 		},
 	},
-	expectMachines: 1 + 1,
 }, {
-	about: "multiple machines (partial placement in a new machine)",
+	about: "a single unit",
 	data: &charm.BundleData{
 		Applications: map[string]*charm.ApplicationSpec{
-			"mysql": {
-				Charm:    "cs:" + storetesting.SearchSeries[1] + "/mysql-42",
+			"wordpress": {
+				Charm:    "cs:" + storetesting.SearchSeries[1] + "/wordpress-42",
 				NumUnits: 1,
-				To:       []string{"1"},
 			},
-			"wordpress": {
-				Charm:    "cs:" + storetesting.SearchSeries[1] + "/wordpress-47",
-				NumUnits: 10,
-				To:       []string{"lxc:1", "1", "new"},
+			"mysql": {
+				Charm:    "cs:" + storetesting.SearchSeries[1] + "/mysql-47",
+				NumUnits: 0,
 			},
 		},
-		Machines: map[string]*charm.MachineSpec{
-			"1": nil,
-		},
 	},
-	expectMachines: 1 + 8,
+	expectUnits: 1,
 }, {
-	about: "multiple machines (partial placement with new machines)",
+	about: "multiple units",
 	data: &charm.BundleData{
 		Applications: map[string]*charm.ApplicationSpec{
-			"mysql": {
-				Charm:    "cs:" + storetesting.SearchSeries[1] + "/mysql-42",
-				NumUnits: 3,
-			},
 			"wordpress": {
-				Charm:    "cs:" + storetesting.SearchSeries[1] + "/wordpress-47",
-				NumUnits: 6,
-				To:       []string{"new", "1", "lxc:1", "new"},
+				Charm:    "cs:utopic/wordpress-1",
+				NumUnits: 1,
+			},
+			"mysql": {
+				Charm:    "cs:utopic/mysql-2",
+				NumUnits: 2,
 			},
 			"riak": {
 				Charm:    "cs:utopic/riak-3",
-				NumUnits: 10,
-				To:       []string{"kvm:2", "lxc:mysql/1", "new", "new", "kvm:2"},
+				NumUnits: 5,
 			},
 		},
-		Machines: map[string]*charm.MachineSpec{
-			"1": nil, "2": nil,
-		},
 	},
-	expectMachines: 3 + 5 + 3,
-}, {
-	about: "placement into container on new machine",
-	data: &charm.BundleData{
-		Applications: map[string]*charm.ApplicationSpec{
-			"wordpress": {
-				Charm:    "cs:" + storetesting.SearchSeries[1] + "/wordpress-47",
-				NumUnits: 6,
-				To:       []string{"lxc:new", "1", "lxc:1", "kvm:new"},
-			},
-		},
+	expectUnits: 8,
+}}
+
+func (s *StoreSuite) TestBundleUnitCount(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	entities := store.DB.Entities()
+	for i, test := range bundleUnitCountTests {
+		c.Logf("test %d: %s", i, test.about)
+		url := router.MustNewResolvedURL("cs:~charmers/bundle/wordpress-simple-0", -1)
+		url.URL.Revision = i
+		url.PromulgatedRevision = i
+
+		// Add the bundle used for this test.
+		b := storetesting.NewBundle(test.data)
+		s.addRequiredCharms(c, b)
+		err := store.AddBundleWithArchive(url, b)
+		c.Assert(err, gc.Equals, nil)
+
+		// Retrieve the bundle from the database.
+		var doc mongodoc.Entity
+		err = entities.FindId(&url.URL).One(&doc)
+		c.Assert(err, gc.Equals, nil)
+
+		c.Assert(*doc.BundleUnitCount, gc.Equals, test.expectUnits)
+	}
+}
+
+var bundleMachineCountTests = []struct {
+	about          string
+	data           *charm.BundleData
+	expectMachines int
+}{{
+	about: "no machines",
+	data: &charm.BundleData{
+		Applications: map[string]*charm.ApplicationSpec{
+			"mysql": {
+				Charm:    "cs:utopic/mysql-0",
+				NumUnits: 0,
+			},
+			"wordpress": {
+				Charm:    "cs:" + storetesting.SearchSeries[1] + "/wordpress-0",
+				NumUnits: 0,
+			},
+		},
+	},
+}, {
+	about: "a single machine (no placement)",
+	data: &charm.BundleData{
+		Applications: map[string]*charm.ApplicationSpec{
+			"mysql": {
+				Charm:    "cs:" + storetesting.SearchSeries[1] + "/mysql-42",
+				NumUnits: 1,
+			},
+			"wordpress": {
+				Charm:    "cs:" + storetesting.SearchSeries[1] + "/wordpress-47",
+				NumUnits: 0,
+			},
+		},
+	},
+	expectMachines: 1,
+}, {
+	about: "a single machine (machine placement)",
+	data: &charm.BundleData{
+		Applications: map[string]*charm.ApplicationSpec{
+			"mysql": {
+				Charm:    "cs:" + storetesting.SearchSeries[1] + "/mysql-42",
+				NumUnits: 1,
+				To:       []string{"1"},
+			},
+		},
 		Machines: map[string]*charm.MachineSpec{
 			"1": nil,
 		},
 	},
-	expectMachines: 5,
-}}
+	expectMachines: 1,
+}, {
+	about: "a single machine (hulk smash)",
+	data: &charm.BundleData{
+		Applications: map[string]*charm.ApplicationSpec{
+			"mysql": {
+				Charm:    "cs:" + storetesting.SearchSeries[1] + "/mysql-42",
+				NumUnits: 1,
+				To:       []string{"1"},
+			},
+			"wordpress": {
+				Charm:    "cs:" + storetesting.SearchSeries[1] + "/wordpress-47",
+				NumUnits: 1,
+				To:       []string{"1"},
+			},
+		},
+		Machines: map[string]*charm.MachineSpec{
+			"1": nil,
+		},
+	},
+	expectMachines: 1,
+}, {
+	about: "a single machine (co-location)",
+	data: &charm.BundleData{
+		Applications: map[string]*charm.ApplicationSpec{
+			"mysql": {
+				Charm:    "cs:" + storetesting.SearchSeries[1] + "/mysql-42",
+				NumUnits: 1,
+			},
+			"wordpress": {
+				Charm:    "cs:" + storetesting.SearchSeries[1] + "/wordpress-47",
+				NumUnits: 1,
+				To:       []string{"mysql/0"},
+			},
+		},
+	},
+	expectMachines: 1,
+}, {
+	about: "a single machine (containerization)",
+	data: &charm.BundleData{
+		Applications: map[string]*charm.ApplicationSpec{
+			"mysql": {
+				Charm:    "cs:" + storetesting.SearchSeries[1] + "/mysql-42",
+				NumUnits: 1,
+				To:       []string{"1"},
+			},
+			"wordpress": {
+				Charm:    "cs:" + storetesting.SearchSeries[1] + "/wordpress-47",
+				NumUnits: 1,
+				To:       []string{"lxc:1"},
+			},
+			"riak": {
+				Charm:    "cs:utopic/riak-3",
+				NumUnits: 2,
+				To:       []string{"kvm:1"},
+			},
+		},
+		Machines: map[string]*charm.MachineSpec{
+			"1": nil,
+		},
+	},
+	expectMachines: 1,
+}, {
+	about: "multiple machines (no placement)",
+	data: &charm.BundleData{
+		Applications: map[string]*charm.ApplicationSpec{
+			"mysql": {
+				Charm:    "cs:utopic/mysql-1",
+				NumUnits: 1,
+			},
+			"wordpress": {
+				Charm:    "cs:utopic/wordpress-2",
+				NumUnits: 2,
+			},
+			"riak": {
+				Charm:    "cs:utopic/riak-3",
+				NumUnits: 5,
+			},
+		},
+	},
+	expectMachines: 1 + 2 + 5,
+}, {
+	about: "multiple machines (machine placement)",
+	data: &charm.BundleData{
+		Applications: map[string]*charm.ApplicationSpec{
+			"mysql": {
+				Charm:    "cs:utopic/mysql-1",
+				NumUnits: 2,
+				To:       []string{"1", "3"},
+			},
+			"wordpress": {
+				Charm:    "cs:utopic/wordpress-2",
+				NumUnits: 1,
+				To:       []string{"2"},
+			},
+		},
+		Machines: map[string]*charm.MachineSpec{
+			"1": nil, "2": nil, "3": nil,
+		},
+	},
+	expectMachines: 2 + 1,
+}, {
+	about: "multiple machines (hulk smash)",
+	data: &charm.BundleData{
+		Applications: map[string]*charm.ApplicationSpec{
+			"mysql": {
+				Charm:    "cs:" + storetesting.SearchSeries[1] + "/mysql-42",
+				NumUnits: 1,
+				To:       []string{"1"},
+			},
+			"wordpress": {
+				Charm:    "cs:" + storetesting.SearchSeries[1] + "/wordpress-47",
+				NumUnits: 1,
+				To:       []string{"2"},
+			},
+			"riak": {
+				Charm:    "cs:utopic/riak-3",
+				NumUnits: 2,
+				To:       []string{"1", "2"},
+			},
+		},
+		Machines: map[string]*charm.MachineSpec{
+			"1": nil, "2": nil,
+		},
+	},
+	expectMachines: 1 + 1 + 0,
+}, {
+	about: "multiple machines (co-location)",
+	data: &charm.BundleData{
+		Applications: map[string]*charm.ApplicationSpec{
+			"mysql": {
+				Charm:    "cs:" + storetesting.SearchSeries[1] + "/mysql-42",
+				NumUnits: 2,
+			},
+			"wordpress": {
+				Charm:    "cs:" + storetesting.SearchSeries[1] + "/wordpress-47",
+				NumUnits: 3,
+				To:       []string{"mysql/0", "mysql/1", "new"},
+			},
+		},
+	},
+	expectMachines: 2 + 1,
+}, {
+	about: "multiple machines (containerization)",
+	data: &charm.BundleData{
+		Applications: map[string]*charm.ApplicationSpec{
+			"mysql": {
+				Charm:    "cs:" + storetesting.SearchSeries[1] + "/mysql-42",
+				NumUnits: 2,
+				To:       []string{"1", "2"},
+			},
+			"wordpress": {
+				Charm:    "cs:" + storetesting.SearchSeries[1] + "/wordpress-47",
+				NumUnits: 4,
+				To:       []string{"lxc:1", "lxc:2", "lxc:3", "lxc:3"},
+			},
+			"riak": {
+				Charm:    "cs:utopic/riak-3",
+				NumUnits: 1,
+				To:       []string{"kvm:2"},
+			},
+		},
+		Machines: map[string]*charm.MachineSpec{
+			"1": nil, "2": nil, "3": nil,
+		},
+	},
+	expectMachines: 2 + 1 + 0,
+}, {
+	about: "multiple machines (partial placement in a container)",
+	data: &charm.BundleData{
+		Applications: map[string]*charm.ApplicationSpec{
+			"mysql": {
+				Charm:    "cs:" + storetesting.SearchSeries[1] + "/mysql-42",
+				NumUnits: 1,
+				To:       []string{"1"},
+			},
+			"wordpress": {
+				Charm:    "cs:" + storetesting.SearchSeries[1] + "/wordpress-47",
+				NumUnits: 10,
+				To:       []string{"lxc:1", "lxc:2"},
+			},
+		},
+		Machines: map[string]*charm.MachineSpec{
+			"1": nil, "2": nil,
+		},
+	},
+	expectMachines: 1 + 1,
+}, {
+	about: "multiple machines (partial placement in a new machine)",
+	data: &charm.BundleData{
+		Applications: map[string]*charm.ApplicationSpec{
+			"mysql": {
+				Charm:    "cs:" + storetesting.SearchSeries[1] + "/mysql-42",
+				NumUnits: 1,
+				To:       []string{"1"},
+			},
+			"wordpress": {
+				Charm:    "cs:" + storetesting.SearchSeries[1] + "/wordpress-47",
+				NumUnits: 10,
+				To:       []string{"lxc:1", "1", "new"},
+			},
+		},
+		Machines: map[string]*charm.MachineSpec{
+			"1": nil,
+		},
+	},
+	expectMachines: 1 + 8,
+}, {
+	about: "multiple machines (partial placement with new machines)",
+	data: &charm.BundleData{
+		Applications: map[string]*charm.ApplicationSpec{
+			"mysql": {
+				Charm:    "cs:" + storetesting.SearchSeries[1] + "/mysql-42",
+				NumUnits: 3,
+			},
+			"wordpress": {
+				Charm:    "cs:" + storetesting.SearchSeries[1] + "/wordpress-47",
+				NumUnits: 6,
+				To:       []string{"new", "1", "lxc:1", "new"},
+			},
+			"riak": {
+				Charm:    "cs:utopic/riak-3",
+				NumUnits: 10,
+				To:       []string{"kvm:2", "lxc:mysql/1", "new", "new", "kvm:2"},
+			},
+		},
+		Machines: map[string]*charm.MachineSpec{
+			"1": nil, "2": nil,
+		},
+	},
+	expectMachines: 3 + 5 + 3,
+}, {
+	about: "placement into container on new machine",
+	data: &charm.BundleData{
+		Applications: map[string]*charm.ApplicationSpec{
+			"wordpress": {
+				Charm:    "cs:" + storetesting.SearchSeries[1] + "/wordpress-47",
+				NumUnits: 6,
+				To:       []string{"lxc:new", "1", "lxc:1", "kvm:new"},
+			},
+		},
+		Machines: map[string]*charm.MachineSpec{
+			"1": nil,
+		},
+	},
+	expectMachines: 5,
+}}
+
+func (s *StoreSuite) TestBundleMachineCount(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	entities := store.DB.Entities()
+	for i, test := range bundleMachineCountTests {
+		c.Logf("test %d: %s", i, test.about)
+		url := router.MustNewResolvedURL("cs:~charmers/bundle/testbundle-0", -1)
+		url.URL.Revision = i
+		url.PromulgatedRevision = i
+		err := test.data.Verify(nil, nil, nil)
+		c.Assert(err, gc.Equals, nil)
+		// Add the bundle used for this test.
+		b := storetesting.NewBundle(test.data)
+		s.addRequiredCharms(c, b)
+		err = store.AddBundleWithArchive(url, b)
+		c.Assert(err, gc.Equals, nil)
+
+		// Retrieve the bundle from the database.
+		var doc mongodoc.Entity
+		err = entities.FindId(&url.URL).One(&doc)
+		c.Assert(err, gc.Equals, nil)
+
+		c.Assert(*doc.BundleMachineCount, gc.Equals, test.expectMachines)
+	}
+}
+
+func (s *StoreSuite) TestRecomputeBundleCounts(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	entities := store.DB.Entities()
+	type countTest struct {
+		about          string
+		data           *charm.BundleData
+		expectUnits    int
+		expectMachines int
+	}
+	var tests []countTest
+	for _, test := range bundleUnitCountTests {
+		tests = append(tests, countTest{
+			about:          test.about,
+			data:           test.data,
+			expectUnits:    test.expectUnits,
+			expectMachines: bundleMachineCount(test.data),
+		})
+	}
+	for _, test := range bundleMachineCountTests {
+		tests = append(tests, countTest{
+			about:          test.about,
+			data:           test.data,
+			expectUnits:    bundleUnitCount(test.data),
+			expectMachines: test.expectMachines,
+		})
+	}
+	for i, test := range tests {
+		c.Logf("test %d: %s", i, test.about)
+		url := router.MustNewResolvedURL("cs:~charmers/bundle/testbundle-0", -1)
+		url.URL.Revision = i
+		url.PromulgatedRevision = i
+		b := storetesting.NewBundle(test.data)
+		s.addRequiredCharms(c, b)
+		err := store.AddBundleWithArchive(url, b)
+		c.Assert(err, gc.Equals, nil)
+
+		// Make the stored counts stale, as if they had been
+		// computed by an older version of the counting logic.
+		err = entities.UpdateId(&url.URL, bson.D{{
+			"$set", bson.D{
+				{"bundleunitcount", -1},
+			},
+		}, {
+			"$unset", bson.D{
+				{"bundlemachinecount", nil},
+			},
+		}})
+		c.Assert(err, gc.Equals, nil)
+
+		err = store.RecomputeBundleCounts(url)
+		c.Assert(err, gc.Equals, nil)
+
+		var doc mongodoc.Entity
+		err = entities.FindId(&url.URL).One(&doc)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(*doc.BundleUnitCount, gc.Equals, test.expectUnits)
+		c.Assert(*doc.BundleMachineCount, gc.Equals, test.expectMachines)
+	}
+}
+
+func (s *StoreSuite) TestRecomputeBundleCountsNotBundle(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	url := router.MustNewResolvedURL("cs:~charmers/precise/wordpress-0", -1)
+	err := store.RecomputeBundleCounts(url)
+	c.Assert(err, gc.ErrorMatches, `cs:~charmers/precise/wordpress-0 is not a bundle`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+}
+
+func (s *StoreSuite) TestOpenBlob(c *gc.C) {
+	charmArchive := storetesting.Charms.CharmArchive(c.MkDir(), "wordpress")
+	store := s.newStore(c, false)
+	defer store.Close()
+	url := router.MustNewResolvedURL("cs:~charmers/"+storetesting.SearchSeries[0]+"/wordpress-23", 23)
+	err := store.AddCharmWithArchive(url, charmArchive)
+	c.Assert(err, gc.Equals, nil)
+
+	f, err := os.Open(charmArchive.Path)
+	c.Assert(err, gc.Equals, nil)
+	defer f.Close()
+	expectHash := hashOfReader(f)
+
+	blob, err := store.OpenBlob(url)
+	c.Assert(err, gc.Equals, nil)
+	defer blob.Close()
+
+	c.Assert(hashOfReader(blob), gc.Equals, expectHash)
+	c.Assert(blob.Hash, gc.Equals, expectHash)
+
+	info, err := f.Stat()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(blob.Size, gc.Equals, info.Size())
+}
+
+func (s *StoreSuite) TestTraceResolveAndDownload(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	url := router.MustNewResolvedURL("cs:~charmers/"+storetesting.SearchSeries[0]+"/wordpress-23", 23)
+	err := store.AddCharmWithArchive(url, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	err = store.Publish(url, nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+
+	// Register a logger so that we can check the trace output.
+	// It will be automatically removed later because IsolatedMgoESSuite
+	// uses LoggingSuite.
+	var tw loggo.TestWriter
+	err = loggo.RegisterWriter("test-log", &tw)
+	c.Assert(err, gc.Equals, nil)
+	loggo.GetLogger("charmstore.trace").SetLogLevel(loggo.DEBUG)
+
+	// Nothing is traced until a tracer is set.
+	_, err = store.FindBestEntity(charm.MustParseURL("~charmers/wordpress"), params.StableChannel, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(tw.Log(), gc.HasLen, 0)
+
+	store.SetTracer(&Tracer{RequestId: "req-1"})
+	entity, err := store.FindBestEntity(charm.MustParseURL("~charmers/wordpress"), params.StableChannel, nil)
+	c.Assert(err, gc.Equals, nil)
+	blob, err := store.OpenBlob(EntityResolvedURL(entity))
+	c.Assert(err, gc.Equals, nil)
+	blob.Close()
+	_, err = store.FindBestEntity(charm.MustParseURL("~charmers/mysql"), params.StableChannel, nil)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+
+	c.Assert(tw.Log(), jc.LogMatches, []jc.SimpleMessage{
+		{Level: loggo.DEBUG, Message: `request=req-1 op=FindBestEntity collection=entities duration=.* outcome=ok`},
+		{Level: loggo.DEBUG, Message: `request=req-1 op=FindEntity collection=entities duration=.* outcome=ok`},
+		{Level: loggo.DEBUG, Message: `request=req-1 op=OpenBlob collection=blobstore duration=.* outcome=ok`},
+		{Level: loggo.DEBUG, Message: `request=req-1 op=FindBestEntity collection=entities duration=.* outcome=error`},
+	})
+}
+
+func (s *StoreSuite) TestOpenVerifiedBlob(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	url := router.MustNewResolvedURL("cs:~charmers/"+storetesting.SearchSeries[0]+"/wordpress-23", 23)
+	ch := storetesting.NewCharm(nil)
+	err := store.AddCharmWithArchive(url, ch)
+	c.Assert(err, gc.Equals, nil)
+
+	r, err := store.OpenVerifiedBlob(url)
+	c.Assert(err, gc.Equals, nil)
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(data, gc.DeepEquals, ch.Bytes())
+	err = r.Close()
+	c.Assert(err, gc.Equals, nil)
+}
+
+func (s *StoreSuite) TestOpenVerifiedBlobCorrupted(c *gc.C) {
+	corrupt := false
+	p, err := NewPool(s.Session.DB("juju_test"), nil, nil, ServerParams{
+		NewBlobBackend: func(db *mgo.Database) blobstore.Backend {
+			return &corruptingBackend{
+				Backend: blobstore.NewMongoBackend(db, "entitystore"),
+				corrupt: &corrupt,
+			}
+		},
+	})
+	c.Assert(err, gc.Equals, nil)
+	defer p.Close()
+	store := p.Store()
+	defer store.Close()
+	url := router.MustNewResolvedURL("cs:~charmers/"+storetesting.SearchSeries[0]+"/wordpress-23", 23)
+	err = store.AddCharmWithArchive(url, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+
+	corrupt = true
+	r, err := store.OpenVerifiedBlob(url)
+	c.Assert(err, gc.Equals, nil)
+	_, err = ioutil.ReadAll(r)
+	c.Assert(err, gc.ErrorMatches, `archive of cs:~charmers/`+storetesting.SearchSeries[0]+`/wordpress-23 does not match its hash`)
+	err = r.Close()
+	c.Assert(err, gc.ErrorMatches, `archive of cs:~charmers/`+storetesting.SearchSeries[0]+`/wordpress-23 does not match its hash`)
+
+	// The unverified blob is not checked.
+	blob, err := store.OpenBlob(url)
+	c.Assert(err, gc.Equals, nil)
+	defer blob.Close()
+	_, err = ioutil.ReadAll(blob)
+	c.Assert(err, gc.Equals, nil)
+}
+
+// corruptingBackend is a blob store backend that corrupts the data
+// read from it when *corrupt is true.
+type corruptingBackend struct {
+	blobstore.Backend
+	corrupt *bool
+}
+
+func (b *corruptingBackend) Get(name string) (blobstore.ReadSeekCloser, int64, error) {
+	r, size, err := b.Backend.Get(name)
+	if err != nil || !*b.corrupt {
+		return r, size, err
+	}
+	return corruptingReader{r}, size, nil
+}
+
+// corruptingReader inverts the first byte of every read.
+type corruptingReader struct {
+	blobstore.ReadSeekCloser
+}
+
+func (r corruptingReader) Read(buf []byte) (int, error) {
+	n, err := r.ReadSeekCloser.Read(buf)
+	if n > 0 {
+		buf[0] ^= 0xff
+	}
+	return n, err
+}
+
+func (s *StoreSuite) TestOpenBlobFailover(c *gc.C) {
+	fail := false
+	p, err := NewPool(s.Session.DB("juju_test"), nil, nil, ServerParams{
+		NewBlobBackend: func(db *mgo.Database) blobstore.Backend {
+			return &failingBackend{
+				Backend: blobstore.NewMongoBackend(db, "entitystore"),
+				fail:    &fail,
+			}
+		},
+		NewSecondaryBlobBackend: func(db *mgo.Database) blobstore.Backend {
+			// Use the same underlying storage so that the
+			// secondary holds a replica of the primary's blobs.
+			return blobstore.NewMongoBackend(db, "entitystore")
+		},
+	})
+	c.Assert(err, gc.Equals, nil)
+	defer p.Close()
+	store := p.Store()
+	defer store.Close()
+	url := router.MustNewResolvedURL("cs:~charmers/"+storetesting.SearchSeries[0]+"/wordpress-23", 23)
+	ch := storetesting.NewCharm(nil)
+	err = store.AddCharmWithArchive(url, ch)
+	c.Assert(err, gc.Equals, nil)
+
+	fail = true
+	blob, err := store.OpenBlob(url)
+	c.Assert(err, gc.Equals, nil)
+	defer blob.Close()
+	data, err := ioutil.ReadAll(blob)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(data, gc.DeepEquals, ch.Bytes())
+}
+
+func (s *StoreSuite) TestOpenBlobFailoverNotFound(c *gc.C) {
+	fail := false
+	p, err := NewPool(s.Session.DB("juju_test"), nil, nil, ServerParams{
+		NewBlobBackend: func(db *mgo.Database) blobstore.Backend {
+			return &failingBackend{
+				Backend: blobstore.NewMongoBackend(db, "entitystore"),
+				fail:    &fail,
+			}
+		},
+		NewSecondaryBlobBackend: func(db *mgo.Database) blobstore.Backend {
+			return blobstore.NewMongoBackend(db, "secondary")
+		},
+	})
+	c.Assert(err, gc.Equals, nil)
+	defer p.Close()
+	store := p.Store()
+	defer store.Close()
+	url := router.MustNewResolvedURL("cs:~charmers/"+storetesting.SearchSeries[0]+"/wordpress-23", 23)
+	err = store.AddCharmWithArchive(url, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	entity, err := store.FindEntity(url, FieldSelector("blobhash"))
+	c.Assert(err, gc.Equals, nil)
+
+	// The primary is unavailable and the secondary
+	// does not hold the blob.
+	fail = true
+	_, _, err = store.BlobStore.Open(entity.BlobHash, nil)
+	c.Assert(errgo.Cause(err), gc.Equals, blobstore.ErrNotFound)
+	_, err = store.OpenBlob(url)
+	c.Assert(err, gc.ErrorMatches, `cannot open archive data for cs:~charmers/`+storetesting.SearchSeries[0]+`/wordpress-23: .*not found`)
+}
+
+func (s *StoreSuite) TestOpenBlobEncrypted(c *gc.C) {
+	p, err := NewPool(s.Session.DB("juju_test"), nil, nil, ServerParams{
+		BlobEncryptionKeys: map[string][]byte{
+			"key1": []byte("0123456789abcdef"),
+		},
+		BlobEncryptionKeyID: "key1",
+	})
+	c.Assert(err, gc.Equals, nil)
+	defer p.Close()
+	store := p.Store()
+	defer store.Close()
+	url := router.MustNewResolvedURL("cs:~charmers/"+storetesting.SearchSeries[0]+"/wordpress-23", 23)
+	ch := storetesting.NewCharm(nil)
+	err = store.AddCharmWithArchive(url, ch)
+	c.Assert(err, gc.Equals, nil)
+
+	// The blob hash is that of the unencrypted archive.
+	entity, err := store.FindEntity(url, FieldSelector("blobhash", "size"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entity.BlobHash, gc.Equals, hashOfString(string(ch.Bytes())))
+	c.Assert(entity.Size, gc.Equals, int64(len(ch.Bytes())))
+
+	blob, err := store.OpenBlob(url)
+	c.Assert(err, gc.Equals, nil)
+	data, err := ioutil.ReadAll(blob)
+	blob.Close()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(data, gc.DeepEquals, ch.Bytes())
+
+	// The data held in the underlying backend is encrypted.
+	bs := blobstore.New(store.DB.Database, "entitystore", blobstore.NewMongoBackend(store.DB.Database, "entitystore"))
+	r, _, err := bs.Open(entity.BlobHash, nil)
+	c.Assert(err, gc.Equals, nil)
+	defer r.Close()
+	data, err = ioutil.ReadAll(r)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(bytes.Contains(data, ch.Bytes()), gc.Equals, false)
+}
+
+func (s *StoreSuite) TestNewPoolWithInvalidEncryptionKey(c *gc.C) {
+	_, err := NewPool(s.Session.DB("juju_test"), nil, nil, ServerParams{
+		BlobEncryptionKeys: map[string][]byte{
+			"key1": []byte("short"),
+		},
+		BlobEncryptionKeyID: "key1",
+	})
+	c.Assert(err, gc.ErrorMatches, `cannot set up blob encryption: invalid encryption key "key1": crypto/aes: invalid key size 5`)
+}
+
+func (s *StoreSuite) TestNewPoolWithCompressedEncryptedBlobs(c *gc.C) {
+	_, err := NewPool(s.Session.DB("juju_test"), nil, nil, ServerParams{
+		BlobEncryptionKeys: map[string][]byte{
+			"key1": []byte("0123456789abcdef"),
+		},
+		BlobEncryptionKeyID: "key1",
+		CompressBlobs:       true,
+	})
+	c.Assert(err, gc.ErrorMatches, `cannot compress encrypted blobs`)
+
+	// Keys that are only used for decryption count too.
+	_, err = NewPool(s.Session.DB("juju_test"), nil, nil, ServerParams{
+		BlobEncryptionKeys: map[string][]byte{
+			"key1": []byte("0123456789abcdef"),
+		},
+		CompressBlobs: true,
+	})
+	c.Assert(err, gc.ErrorMatches, `cannot compress encrypted blobs`)
+}
+
+func (s *StoreSuite) TestNewPoolWithCachedEncryptedBlobs(c *gc.C) {
+	_, err := NewPool(s.Session.DB("juju_test"), nil, nil, ServerParams{
+		BlobEncryptionKeys: map[string][]byte{
+			"key1": []byte("0123456789abcdef"),
+		},
+		BlobEncryptionKeyID: "key1",
+		BlobCacheDir:        c.MkDir(),
+	})
+	c.Assert(err, gc.ErrorMatches, `cannot cache encrypted blobs on disk`)
+}
+
+func (s *StoreSuite) TestOpenBlobSharded(c *gc.C) {
+	p, err := NewPool(s.Session.DB("juju_test"), nil, nil, ServerParams{
+		BlobStoreShardDepth: 2,
+	})
+	c.Assert(err, gc.Equals, nil)
+	defer p.Close()
+	store := p.Store()
+	defer store.Close()
+	url := router.MustNewResolvedURL("cs:~charmers/"+storetesting.SearchSeries[0]+"/wordpress-23", 23)
+	ch := storetesting.NewCharm(nil)
+	err = store.AddCharmWithArchive(url, ch)
+	c.Assert(err, gc.Equals, nil)
+
+	blob, err := store.OpenBlob(url)
+	c.Assert(err, gc.Equals, nil)
+	data, err := ioutil.ReadAll(blob)
+	blob.Close()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(data, gc.DeepEquals, ch.Bytes())
+
+	// The object in the underlying backend is stored under
+	// a key prefixed by the blob hash.
+	hash := hashOfString(string(ch.Bytes()))
+	var file struct {
+		Filename string
+	}
+	err = store.DB.Database.GridFS("entitystore").Find(nil).One(&file)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(file.Filename, jc.HasPrefix, hash[0:2]+"/"+hash[2:4]+"/"+hash[0:16]+"-")
+}
+
+func (s *StoreSuite) TestNewPoolWithInvalidShardDepth(c *gc.C) {
+	_, err := NewPool(s.Session.DB("juju_test"), nil, nil, ServerParams{
+		BlobStoreShardDepth: 9,
+	})
+	c.Assert(err, gc.ErrorMatches, `invalid blob store shard depth 9`)
+}
+
+// failingBackend is a blob store backend that returns a
+// transient error from Get when *fail is true.
+type failingBackend struct {
+	blobstore.Backend
+	fail *bool
+}
+
+func (b *failingBackend) Get(name string) (blobstore.ReadSeekCloser, int64, error) {
+	if *b.fail {
+		return nil, 0, errgo.New("backend temporarily unavailable")
+	}
+	return b.Backend.Get(name)
+}
+
+func (s *StoreSuite) TestOpenBlobPreV5(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	ch := storetesting.NewCharm(storetesting.MetaWithSupportedSeries(nil, storetesting.SearchSeries[1], storetesting.SearchSeries[0]))
+
+	url := router.MustNewResolvedURL("cs:~charmers/multi-series-23", 23)
+	err := store.AddCharmWithArchive(url, ch)
+	c.Assert(err, gc.Equals, nil)
+
+	blob, err := store.OpenBlobPreV5(url)
+	c.Assert(err, gc.Equals, nil)
+	defer blob.Close()
+
+	data, err := ioutil.ReadAll(blob)
+	c.Assert(err, gc.Equals, nil)
+	preV5Ch, err := charm.ReadCharmArchiveBytes(data)
+	c.Assert(err, gc.Equals, nil)
+
+	// Check that the hashes and sizes are consistent with the data
+	// we've read.
+	c.Assert(blob.Hash, gc.Equals, fmt.Sprintf("%x", sha512.Sum384(data)))
+	c.Assert(blob.Size, gc.Equals, int64(len(data)))
+
+	entity, err := store.FindEntity(url, nil)
+	c.Assert(err, gc.Equals, nil)
+
+	c.Assert(entity.PreV5BlobHash, gc.Equals, blob.Hash)
+	c.Assert(entity.PreV5BlobHash256, gc.Equals, fmt.Sprintf("%x", sha256.Sum256(data)))
+	c.Assert(entity.PreV5BlobSize, gc.Equals, blob.Size)
+
+	c.Assert(preV5Ch.Meta().Series, gc.HasLen, 0)
+
+	// Check that the series really are in the post-v5 blob.
+	blob, err = store.OpenBlob(url)
+	c.Assert(err, gc.Equals, nil)
+	defer blob.Close()
+
+	data, err = ioutil.ReadAll(blob)
+	c.Assert(err, gc.Equals, nil)
+
+	postV5Ch, err := charm.ReadCharmArchiveBytes(data)
+	c.Assert(err, gc.Equals, nil)
+
+	c.Assert(postV5Ch.Meta().Series, jc.DeepEquals, []string{storetesting.SearchSeries[1], storetesting.SearchSeries[0]})
+}
+
+func (s *StoreSuite) TestOpenBlobPreV5WithMultiSeriesCharmInSingleSeriesId(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	ch := storetesting.NewCharm(storetesting.MetaWithSupportedSeries(nil, storetesting.SearchSeries[1], storetesting.SearchSeries[0]))
+
+	url := router.MustNewResolvedURL("cs:~charmers/"+storetesting.SearchSeries[0]+"/multi-series-23", 23)
+	err := store.AddCharmWithArchive(url, ch)
+	c.Assert(err, gc.Equals, nil)
+
+	blob, err := store.OpenBlobPreV5(url)
+	c.Assert(err, gc.Equals, nil)
+	defer blob.Close()
+
+	data, err := ioutil.ReadAll(blob)
+	c.Assert(err, gc.Equals, nil)
+	preV5Ch, err := charm.ReadCharmArchiveBytes(data)
+	c.Assert(err, gc.Equals, nil)
+
+	c.Assert(preV5Ch.Meta().Series, gc.HasLen, 0)
+}
+
+func (s *StoreSuite) TestAddLog(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	urls := []*charm.URL{
+		charm.MustParseURL("cs:mysql"),
+		charm.MustParseURL("cs:rails"),
+	}
+	infoData := json.RawMessage([]byte(`"info data"`))
+	errorData := json.RawMessage([]byte(`"error data"`))
+
+	// Add logs to the store.
+	beforeAdding := time.Now().Add(-time.Second)
+	err := store.AddLog(&infoData, mongodoc.InfoLevel, mongodoc.IngestionType, nil)
+	c.Assert(err, gc.Equals, nil)
+	err = store.AddLog(&errorData, mongodoc.ErrorLevel, mongodoc.IngestionType, urls)
+	c.Assert(err, gc.Equals, nil)
+	afterAdding := time.Now().Add(time.Second)
+
+	// Retrieve the logs from the store.
+	var docs []mongodoc.Log
+	err = store.DB.Logs().Find(nil).Sort("_id").All(&docs)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(docs, gc.HasLen, 2)
+
+	// The docs have been correctly added to the Mongo collection.
+	infoDoc, errorDoc := docs[0], docs[1]
+	c.Assert(infoDoc.Time, jc.TimeBetween(beforeAdding, afterAdding))
+	c.Assert(errorDoc.Time, jc.TimeBetween(beforeAdding, afterAdding))
+	infoDoc.Time = time.Time{}
+	errorDoc.Time = time.Time{}
+	c.Assert(infoDoc, jc.DeepEquals, mongodoc.Log{
+		Data:  []byte(infoData),
+		Level: mongodoc.InfoLevel,
+		Type:  mongodoc.IngestionType,
+		URLs:  nil,
+	})
+	c.Assert(errorDoc, jc.DeepEquals, mongodoc.Log{
+		Data:  []byte(errorData),
+		Level: mongodoc.ErrorLevel,
+		Type:  mongodoc.IngestionType,
+		URLs:  urls,
+	})
+}
+
+func (s *StoreSuite) TestAddLogDataError(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	data := json.RawMessage([]byte("!"))
+
+	// Try to add the invalid log message to the store.
+	err := store.AddLog(&data, mongodoc.InfoLevel, mongodoc.IngestionType, nil)
+	c.Assert(err, gc.ErrorMatches, "cannot marshal log data: json: error calling MarshalJSON .*")
+}
+
+func (s *StoreSuite) TestAddLogBaseURLs(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	// Add the log to the store with associated URLs.
+	data := json.RawMessage([]byte(`"info data"`))
+	err := store.AddLog(&data, mongodoc.WarningLevel, mongodoc.IngestionType, []*charm.URL{
+		charm.MustParseURL(storetesting.SearchSeries[1] + "/mysql-42"),
+		charm.MustParseURL("~who/utopic/wordpress"),
+	})
+	c.Assert(err, gc.Equals, nil)
+
+	// Retrieve the log from the store.
+	var doc mongodoc.Log
+	err = store.DB.Logs().Find(nil).One(&doc)
+	c.Assert(err, gc.Equals, nil)
+
+	// The log includes the base URLs.
+	c.Assert(doc.URLs, jc.DeepEquals, []*charm.URL{
+		charm.MustParseURL(storetesting.SearchSeries[1] + "/mysql-42"),
+		charm.MustParseURL("mysql"),
+		charm.MustParseURL("~who/utopic/wordpress"),
+		charm.MustParseURL("~who/wordpress"),
+	})
+}
+
+func (s *StoreSuite) TestAddLogDuplicateURLs(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	// Add the log to the store with associated URLs.
+	data := json.RawMessage([]byte(`"info data"`))
+	err := store.AddLog(&data, mongodoc.WarningLevel, mongodoc.IngestionType, []*charm.URL{
+		charm.MustParseURL(storetesting.SearchSeries[1] + "/mysql-42"),
+		charm.MustParseURL("mysql"),
+		charm.MustParseURL(storetesting.SearchSeries[1] + "/mysql-42"),
+		charm.MustParseURL("mysql"),
+	})
+	c.Assert(err, gc.Equals, nil)
+
+	// Retrieve the log from the store.
+	var doc mongodoc.Log
+	err = store.DB.Logs().Find(nil).One(&doc)
+	c.Assert(err, gc.Equals, nil)
+
+	// The log excludes duplicate URLs.
+	c.Assert(doc.URLs, jc.DeepEquals, []*charm.URL{
+		charm.MustParseURL(storetesting.SearchSeries[1] + "/mysql-42"),
+		charm.MustParseURL("mysql"),
+	})
+}
+
+func (s *StoreSuite) TestCollections(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	colls := store.DB.Collections()
+	names, err := store.DB.CollectionNames()
+	c.Assert(err, gc.Equals, nil)
+	// Some collections don't have indexes so they are created only when used.
+	createdOnUse := map[string]bool{
+		"migrations":       true,
+		"upload_blocklist": true,
+	}
+	// Check that all collections mentioned by Collections are actually created.
+	for _, coll := range colls {
+		found := false
+		for _, name := range names {
+			if name == coll.Name || createdOnUse[coll.Name] {
+				found = true
+			}
+		}
+		if !found {
+			c.Errorf("collection %q not created", coll.Name)
+		}
+
+	}
+	otherCollections := map[string]bool{
+		"managedStoredResources": true,
+		"entitystore.chunks":     true,
+		"entitystore.blobref":    true,
+		"storedResources":        true,
+		"txns":                   true,
+		"txns.log":               true,
+		"txns.stash":             true,
+	}
+	// Check that all created collections are mentioned in Collections.
+	for _, name := range names {
+		if strings.HasPrefix(name, "system.") || strings.HasPrefix(name, "blobstore.") || otherCollections[name] {
+			continue
+		}
+		if name == "system.indexes" || name == "managedStoredResources" || name == "entitystore.files" {
+			continue
+		}
+		found := false
+		for _, coll := range colls {
+			if coll.Name == name {
+				found = true
+			}
+		}
+		if !found {
+			c.Errorf("extra collection %q found", name)
+		}
+	}
+}
+
+func (s *StoreSuite) TestOpenCachedBlobFileWithInvalidEntity(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	wordpress := storetesting.Charms.CharmDir("wordpress")
+	url := router.MustNewResolvedURL("cs:~charmers/"+storetesting.SearchSeries[0]+"/wordpress-23", 23)
+	err := store.AddCharmWithArchive(url, wordpress)
+	c.Assert(err, gc.Equals, nil)
+
+	entity, err := store.FindEntity(url, FieldSelector("charmmeta"))
+	c.Assert(err, gc.Equals, nil)
+	r, err := store.OpenCachedBlobFile(entity, "", nil)
+	c.Assert(err, gc.ErrorMatches, "provided entity does not have required fields")
+	c.Assert(r, gc.Equals, nil)
+}
+
+func (s *StoreSuite) TestOpenCachedBlobFileWithFoundContent(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	wordpress := storetesting.Charms.CharmDir("wordpress")
+	url := router.MustNewResolvedURL("cs:~charmers/"+storetesting.SearchSeries[0]+"/wordpress-23", 23)
+	err := store.AddCharmWithArchive(url, wordpress)
+	c.Assert(err, gc.Equals, nil)
+
+	// Get our expected content.
+	data, err := ioutil.ReadFile(filepath.Join(wordpress.Path, "metadata.yaml"))
+	c.Assert(err, gc.Equals, nil)
+	expectContent := string(data)
+
+	entity, err := store.FindEntity(url, FieldSelector("blobhash", "contents"))
+	c.Assert(err, gc.Equals, nil)
+
+	// Check that, when we open the file for the first time,
+	// we see the expected content.
+	r, err := store.OpenCachedBlobFile(entity, mongodoc.FileIcon, func(f *zip.File) bool {
+		return path.Clean(f.Name) == "metadata.yaml"
+	})
+	c.Assert(err, gc.Equals, nil)
+	defer r.Close()
+	data, err = ioutil.ReadAll(r)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(string(data), gc.Equals, expectContent)
+
+	// When retrieving the entity again, check that the Contents
+	// map has been set appropriately...
+	entity, err = store.FindEntity(url, FieldSelector("blobhash", "contents"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entity.Contents, gc.HasLen, 1)
+	c.Assert(entity.Contents[mongodoc.FileIcon].IsValid(), gc.Equals, true)
 
-func (s *StoreSuite) TestBundleMachineCount(c *gc.C) {
+	// ... and that OpenCachedBlobFile still returns a reader with the
+	// same data, without making use of the isFile callback.
+	r, err = store.OpenCachedBlobFile(entity, mongodoc.FileIcon, func(f *zip.File) bool {
+		c.Errorf("isFile called unexpectedly")
+		return false
+	})
+	c.Assert(err, gc.Equals, nil)
+	defer r.Close()
+	data, err = ioutil.ReadAll(r)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(string(data), gc.Equals, expectContent)
+}
+
+func (s *StoreSuite) TestOpenCachedBlobFileWithNotFoundContent(c *gc.C) {
 	store := s.newStore(c, false)
 	defer store.Close()
-	entities := store.DB.Entities()
-	for i, test := range bundleMachineCountTests {
-		c.Logf("test %d: %s", i, test.about)
-		url := router.MustNewResolvedURL("cs:~charmers/bundle/testbundle-0", -1)
-		url.URL.Revision = i
-		url.PromulgatedRevision = i
-		err := test.data.Verify(nil, nil, nil)
-		c.Assert(err, gc.Equals, nil)
-		// Add the bundle used for this test.
-		b := storetesting.NewBundle(test.data)
-		s.addRequiredCharms(c, b)
-		err = store.AddBundleWithArchive(url, b)
-		c.Assert(err, gc.Equals, nil)
 
-		// Retrieve the bundle from the database.
-		var doc mongodoc.Entity
-		err = entities.FindId(&url.URL).One(&doc)
-		c.Assert(err, gc.Equals, nil)
+	wordpress := storetesting.Charms.CharmDir("wordpress")
+	url := router.MustNewResolvedURL("cs:~charmers/"+storetesting.SearchSeries[0]+"/wordpress-23", 23)
+	err := store.AddCharmWithArchive(url, wordpress)
+	c.Assert(err, gc.Equals, nil)
 
-		c.Assert(*doc.BundleMachineCount, gc.Equals, test.expectMachines)
-	}
+	entity, err := store.FindEntity(url, FieldSelector("blobhash", "contents"))
+	c.Assert(err, gc.Equals, nil)
+
+	// Check that, when we open the file for the first time,
+	// we get a NotFound error.
+	r, err := store.OpenCachedBlobFile(entity, mongodoc.FileIcon, func(f *zip.File) bool {
+		return false
+	})
+	c.Assert(err, gc.ErrorMatches, "not found")
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	c.Assert(r, gc.Equals, nil)
+
+	// When retrieving the entity again, check that the Contents
+	// map has been set appropriately...
+	entity, err = store.FindEntity(url, FieldSelector("blobhash", "contents"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entity.Contents, gc.DeepEquals, map[mongodoc.FileId]mongodoc.ZipFile{
+		mongodoc.FileIcon: {},
+	})
+
+	// ... and that OpenCachedBlobFile still returns a NotFound
+	// error, without making use of the isFile callback.
+	r, err = store.OpenCachedBlobFile(entity, mongodoc.FileIcon, func(f *zip.File) bool {
+		c.Errorf("isFile called unexpectedly")
+		return false
+	})
+	c.Assert(err, gc.ErrorMatches, "not found")
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	c.Assert(r, gc.Equals, nil)
 }
 
-func (s *StoreSuite) TestOpenBlob(c *gc.C) {
-	charmArchive := storetesting.Charms.CharmArchive(c.MkDir(), "wordpress")
+func (s *StoreSuite) TestCheckContents(c *gc.C) {
 	store := s.newStore(c, false)
 	defer store.Close()
-	url := router.MustNewResolvedURL("cs:~charmers/"+storetesting.SearchSeries[0]+"/wordpress-23", 23)
-	err := store.AddCharmWithArchive(url, charmArchive)
+
+	b := storetesting.Charms.BundleDir("wordpress-simple")
+	s.addRequiredCharms(c, b)
+	url := router.MustNewResolvedURL("cs:~charmers/bundle/wordpress-simple-0", -1)
+	err := store.AddBundleWithArchive(url, b)
 	c.Assert(err, gc.Equals, nil)
 
-	f, err := os.Open(charmArchive.Path)
+	// Populate the cache with the correct README entry.
+	entity, err := store.FindEntity(url, FieldSelector("blobhash", "contents"))
 	c.Assert(err, gc.Equals, nil)
-	defer f.Close()
-	expectHash := hashOfReader(f)
+	r, err := store.OpenCachedBlobFile(entity, mongodoc.FileReadMe, IsReadMeFile)
+	c.Assert(err, gc.Equals, nil)
+	r.Close()
+	entity, err = store.FindEntity(url, FieldSelector("contents"))
+	c.Assert(err, gc.Equals, nil)
+	readme := entity.Contents[mongodoc.FileReadMe]
+	c.Assert(readme.IsValid(), gc.Equals, true)
 
-	blob, err := store.OpenBlob(url)
+	problems, err := store.CheckContents(url, false)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(problems, gc.HasLen, 0)
+
+	// Plant some bad entries.
+	badReadMe := readme
+	badReadMe.Offset++
+	badIcon := mongodoc.ZipFile{Offset: 100, Size: 10}
+	err = store.UpdateEntity(url, bson.D{{"$set", bson.D{
+		{"contents." + string(mongodoc.FileReadMe), badReadMe},
+		{"contents." + string(mongodoc.FileIcon), badIcon},
+		{"contents.unknown", readme},
+	}}})
 	c.Assert(err, gc.Equals, nil)
-	defer blob.Close()
 
-	c.Assert(hashOfReader(blob), gc.Equals, expectHash)
-	c.Assert(blob.Hash, gc.Equals, expectHash)
+	expectProblems := []ContentsProblem{{
+		FileId: mongodoc.FileIcon,
+		Cached: badIcon,
+	}, {
+		FileId: mongodoc.FileReadMe,
+		Cached: badReadMe,
+		Actual: readme,
+	}, {
+		FileId:  "unknown",
+		Cached:  readme,
+		Unknown: true,
+	}}
 
-	info, err := f.Stat()
+	// Check that the problems are detected without changing anything.
+	problems, err = store.CheckContents(url, false)
 	c.Assert(err, gc.Equals, nil)
-	c.Assert(blob.Size, gc.Equals, info.Size())
+	c.Assert(problems, jc.DeepEquals, expectProblems)
+	entity, err = store.FindEntity(url, FieldSelector("contents"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entity.Contents, gc.HasLen, 3)
+	c.Assert(entity.Contents[mongodoc.FileReadMe], gc.Equals, badReadMe)
+
+	// Check that the problems are fixed.
+	problems, err = store.CheckContents(url, true)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(problems, jc.DeepEquals, expectProblems)
+	entity, err = store.FindEntity(url, FieldSelector("contents"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entity.Contents, jc.DeepEquals, map[mongodoc.FileId]mongodoc.ZipFile{
+		mongodoc.FileReadMe: readme,
+		mongodoc.FileIcon:   {},
+	})
+	problems, err = store.CheckContents(url, false)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(problems, gc.HasLen, 0)
 }
 
-func (s *StoreSuite) TestOpenBlobPreV5(c *gc.C) {
+func (s *StoreSuite) TestCheckContentsNotFound(c *gc.C) {
 	store := s.newStore(c, false)
 	defer store.Close()
-	ch := storetesting.NewCharm(storetesting.MetaWithSupportedSeries(nil, storetesting.SearchSeries[1], storetesting.SearchSeries[0]))
 
-	url := router.MustNewResolvedURL("cs:~charmers/multi-series-23", 23)
-	err := store.AddCharmWithArchive(url, ch)
+	_, err := store.CheckContents(router.MustNewResolvedURL("cs:~charmers/precise/wordpress-0", -1), false)
+	c.Assert(err, gc.ErrorMatches, "entity not found")
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *StoreSuite) TestRebuildContents(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	url := router.MustNewResolvedURL("cs:~charmers/xenial/wordpress-0", -1)
+	err := store.AddEntityWithArchive(url, storetesting.NewBlob([]storetesting.File{{
+		Name: "metadata.yaml",
+		Data: []byte("name: wordpress\nsummary: a blog\ndescription: a blog\n"),
+	}, {
+		Name: "README.md",
+		Data: []byte("readme content"),
+	}, {
+		Name: "icon.svg",
+		Data: []byte("<svg/>"),
+	}}))
 	c.Assert(err, gc.Equals, nil)
 
-	blob, err := store.OpenBlobPreV5(url)
+	// Plant some stale entries.
+	err = store.UpdateEntity(url, bson.D{{"$set", bson.D{
+		{"contents." + string(mongodoc.FileReadMe), mongodoc.ZipFile{Offset: 1, Size: 2}},
+		{"contents." + string(mongodoc.FileIcon), mongodoc.ZipFile{}},
+	}}})
 	c.Assert(err, gc.Equals, nil)
-	defer blob.Close()
 
-	data, err := ioutil.ReadAll(blob)
+	err = store.RebuildContents(url, mongodoc.FileReadMe, mongodoc.FileIcon)
 	c.Assert(err, gc.Equals, nil)
-	preV5Ch, err := charm.ReadCharmArchiveBytes(data)
+	entity, err := store.FindEntity(url, FieldSelector("blobhash", "contents"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entity.Contents, gc.HasLen, 2)
+	c.Assert(entity.Contents[mongodoc.FileReadMe].IsValid(), gc.Equals, true)
+	c.Assert(entity.Contents[mongodoc.FileIcon].IsValid(), gc.Equals, true)
+	problems, err := store.CheckContents(url, false)
 	c.Assert(err, gc.Equals, nil)
+	c.Assert(problems, gc.HasLen, 0)
 
-	// Check that the hashes and sizes are consistent with the data
-	// we've read.
-	c.Assert(blob.Hash, gc.Equals, fmt.Sprintf("%x", sha512.Sum384(data)))
-	c.Assert(blob.Size, gc.Equals, int64(len(data)))
+	// The rebuilt entries are used to read the files.
+	r, err := store.OpenCachedBlobFile(entity, mongodoc.FileReadMe, IsReadMeFile)
+	c.Assert(err, gc.Equals, nil)
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(string(data), gc.Equals, "readme content")
 
-	entity, err := store.FindEntity(url, nil)
+	// With no files specified, all known files are rebuilt.
+	err = store.RebuildContents(url)
 	c.Assert(err, gc.Equals, nil)
+	entity, err = store.FindEntity(url, FieldSelector("contents"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entity.Contents, gc.HasLen, 3)
+	c.Assert(entity.Contents[mongodoc.FileReadMe].IsValid(), gc.Equals, true)
+	c.Assert(entity.Contents[mongodoc.FileIcon].IsValid(), gc.Equals, true)
+	// There is no LXD profile, which is recorded with
+	// an invalid entry.
+	c.Assert(entity.Contents[mongodoc.FileLXDProfile].IsValid(), gc.Equals, false)
+}
 
-	c.Assert(entity.PreV5BlobHash, gc.Equals, blob.Hash)
-	c.Assert(entity.PreV5BlobHash256, gc.Equals, fmt.Sprintf("%x", sha256.Sum256(data)))
-	c.Assert(entity.PreV5BlobSize, gc.Equals, blob.Size)
+func (s *StoreSuite) TestRebuildContentsErrors(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
 
-	c.Assert(preV5Ch.Meta().Series, gc.HasLen, 0)
+	url := router.MustNewResolvedURL("cs:~charmers/precise/wordpress-0", -1)
+	err := store.RebuildContents(url, mongodoc.FileReadMe)
+	c.Assert(err, gc.ErrorMatches, "entity not found")
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
 
-	// Check that the series really are in the post-v5 blob.
-	blob, err = store.OpenBlob(url)
+	err = store.AddCharmWithArchive(url, storetesting.NewCharm(nil))
 	c.Assert(err, gc.Equals, nil)
-	defer blob.Close()
+	err = store.RebuildContents(url, "unknown")
+	c.Assert(err, gc.ErrorMatches, `unknown contents file "unknown"`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+}
 
-	data, err = ioutil.ReadAll(blob)
+func (s *StoreSuite) TestVerifyChannelConsistency(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	url0 := router.MustNewResolvedURL("cs:~charmers/precise/wordpress-0", -1)
+	url1 := router.MustNewResolvedURL("cs:~charmers/precise/wordpress-1", -1)
+	for _, url := range []*router.ResolvedURL{url0, url1} {
+		err := store.AddCharmWithArchive(url, storetesting.NewCharm(nil))
+		c.Assert(err, gc.Equals, nil)
+	}
+	err := store.Publish(url0, nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	err = store.Publish(url1, nil, params.StableChannel, params.EdgeChannel)
 	c.Assert(err, gc.Equals, nil)
 
-	postV5Ch, err := charm.ReadCharmArchiveBytes(data)
+	// A superseded revision that is still published is consistent.
+	baseURL := charm.MustParseURL("cs:~charmers/wordpress")
+	problems, err := store.VerifyChannelConsistency(baseURL)
 	c.Assert(err, gc.Equals, nil)
+	c.Assert(problems, gc.HasLen, 0)
 
-	c.Assert(postV5Ch.Meta().Series, jc.DeepEquals, []string{storetesting.SearchSeries[1], storetesting.SearchSeries[0]})
+	// Desynchronize the entities from the base entity.
+	missing := charm.MustParseURL("cs:~charmers/trusty/wordpress-5")
+	err = store.DB.Entities().UpdateId(&url1.URL, bson.D{{
+		"$unset", bson.D{{"published.edge", true}},
+	}})
+	c.Assert(err, gc.Equals, nil)
+	err = store.DB.Entities().UpdateId(&url0.URL, bson.D{{
+		"$set", bson.D{{"published.candidate", true}},
+	}})
+	c.Assert(err, gc.Equals, nil)
+	err = store.DB.BaseEntities().UpdateId(baseURL, bson.D{{
+		"$set", bson.D{{"channelentities.beta.trusty", missing}},
+	}})
+	c.Assert(err, gc.Equals, nil)
+
+	expectProblems := []Inconsistency{{
+		Kind:    HeadNotFound,
+		Channel: params.BetaChannel,
+		Series:  "trusty",
+		Entity:  missing,
+	}, {
+		Kind:    PublishedWithoutHead,
+		Channel: params.CandidateChannel,
+		Entity:  &url0.URL,
+	}, {
+		Kind:    HeadNotPublished,
+		Channel: params.EdgeChannel,
+		Series:  "precise",
+		Entity:  &url1.URL,
+	}}
+	problems, err = store.VerifyChannelConsistency(baseURL)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(problems, jc.DeepEquals, expectProblems)
+
+	// Repair the inconsistencies.
+	err = store.FixChannelConsistency(baseURL, problems)
+	c.Assert(err, gc.Equals, nil)
+	problems, err = store.VerifyChannelConsistency(baseURL)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(problems, gc.HasLen, 0)
+
+	entity, err := store.FindEntity(url0, FieldSelector("published"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entity.Published, jc.DeepEquals, map[params.Channel]bool{
+		params.StableChannel: true,
+	})
+	entity, err = store.FindEntity(url1, FieldSelector("published"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entity.Published, jc.DeepEquals, map[params.Channel]bool{
+		params.StableChannel: true,
+		params.EdgeChannel:   true,
+	})
+	baseEntity, err := store.FindBaseEntity(baseURL, FieldSelector("channelentities"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(baseEntity.ChannelEntities[params.BetaChannel], gc.HasLen, 0)
+	c.Assert(baseEntity.ChannelEntities[params.StableChannel], jc.DeepEquals, map[string]*charm.URL{
+		"precise": &url1.URL,
+	})
 }
 
-func (s *StoreSuite) TestOpenBlobPreV5WithMultiSeriesCharmInSingleSeriesId(c *gc.C) {
+func (s *StoreSuite) TestVerifyChannelConsistencyNotFound(c *gc.C) {
 	store := s.newStore(c, false)
 	defer store.Close()
-	ch := storetesting.NewCharm(storetesting.MetaWithSupportedSeries(nil, storetesting.SearchSeries[1], storetesting.SearchSeries[0]))
 
-	url := router.MustNewResolvedURL("cs:~charmers/"+storetesting.SearchSeries[0]+"/multi-series-23", 23)
-	err := store.AddCharmWithArchive(url, ch)
+	_, err := store.VerifyChannelConsistency(charm.MustParseURL("cs:~charmers/wordpress"))
+	c.Assert(err, gc.ErrorMatches, "base entity not found")
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *StoreSuite) TestYankRevision(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	url0 := router.MustNewResolvedURL("cs:~charmers/precise/wordpress-0", -1)
+	url1 := router.MustNewResolvedURL("cs:~charmers/precise/wordpress-1", -1)
+	for _, url := range []*router.ResolvedURL{url0, url1} {
+		err := store.AddCharmWithArchive(url, storetesting.NewCharm(nil))
+		c.Assert(err, gc.Equals, nil)
+		err = store.Publish(url, nil, params.StableChannel)
+		c.Assert(err, gc.Equals, nil)
+	}
+	err := store.Publish(url1, nil, params.EdgeChannel)
 	c.Assert(err, gc.Equals, nil)
 
-	blob, err := store.OpenBlobPreV5(url)
+	err = store.YankRevision(url1, params.StableChannel, "bob")
 	c.Assert(err, gc.Equals, nil)
-	defer blob.Close()
 
-	data, err := ioutil.ReadAll(blob)
+	// The previous revision is now current in the stable channel.
+	entity, err := store.FindBestEntity(charm.MustParseURL("~charmers/precise/wordpress"), params.StableChannel, nil)
 	c.Assert(err, gc.Equals, nil)
-	preV5Ch, err := charm.ReadCharmArchiveBytes(data)
+	c.Assert(entity.URL, jc.DeepEquals, &url0.URL)
+
+	// The yanked revision cannot be resolved in the stable channel,
+	// even by its full id.
+	_, err = store.FindBestEntity(&url1.URL, params.StableChannel, nil)
+	c.Assert(err, gc.ErrorMatches, `cs:~charmers/precise/wordpress-1 not found in stable channel`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+
+	// It remains current in the edge channel.
+	entity, err = store.FindBestEntity(charm.MustParseURL("~charmers/precise/wordpress"), params.EdgeChannel, nil)
 	c.Assert(err, gc.Equals, nil)
+	c.Assert(entity.URL, jc.DeepEquals, &url1.URL)
 
-	c.Assert(preV5Ch.Meta().Series, gc.HasLen, 0)
+	entity, err = store.FindEntity(url1, FieldSelector("yanked"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entity.Yanked, jc.DeepEquals, map[params.Channel]bool{
+		params.StableChannel: true,
+	})
+	problems, err := store.VerifyChannelConsistency(&url1.URL)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(problems, gc.HasLen, 0)
+
+	// The yank is recorded in the audit log.
+	entries, err := store.EntityAuditHistory(&url1.URL, 1)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entries, gc.HasLen, 1)
+	entries[0].Time = time.Time{}
+	c.Assert(entries[0], jc.DeepEquals, audit.Entry{
+		User:    "bob",
+		Op:      audit.OpYank,
+		Entity:  &url1.URL,
+		Channel: "stable",
+	})
+
+	// Yanking the revision again fails.
+	err = store.YankRevision(url1, params.StableChannel, "bob")
+	c.Assert(err, gc.ErrorMatches, `cs:~charmers/precise/wordpress-1 not found in stable channel`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+
+	// Yanking the only remaining revision removes the series from
+	// the channel.
+	err = store.YankRevision(url0, params.StableChannel, "bob")
+	c.Assert(err, gc.Equals, nil)
+	_, err = store.FindBestEntity(charm.MustParseURL("~charmers/precise/wordpress"), params.StableChannel, nil)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	baseEntity, err := store.FindBaseEntity(&url0.URL, FieldSelector("channelentities"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(baseEntity.ChannelEntities[params.StableChannel], gc.HasLen, 0)
+
+	// Publishing the revision again reinstates it.
+	err = store.Publish(url1, nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	entity, err = store.FindBestEntity(&url1.URL, params.StableChannel, FieldSelector("yanked"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entity.Yanked, gc.HasLen, 0)
 }
 
-func (s *StoreSuite) TestAddLog(c *gc.C) {
+func (s *StoreSuite) TestYankRevisionWithoutPublishHistory(c *gc.C) {
 	store := s.newStore(c, false)
 	defer store.Close()
-	urls := []*charm.URL{
-		charm.MustParseURL("cs:mysql"),
-		charm.MustParseURL("cs:rails"),
+
+	url0 := router.MustNewResolvedURL("cs:~charmers/precise/wordpress-0", -1)
+	url1 := router.MustNewResolvedURL("cs:~charmers/precise/wordpress-1", -1)
+	for _, url := range []*router.ResolvedURL{url0, url1} {
+		err := store.AddCharmWithArchive(url, storetesting.NewCharm(nil))
+		c.Assert(err, gc.Equals, nil)
+		err = store.Publish(url, nil, params.StableChannel)
+		c.Assert(err, gc.Equals, nil)
 	}
-	infoData := json.RawMessage([]byte(`"info data"`))
-	errorData := json.RawMessage([]byte(`"error data"`))
+	// Simulate entities published before the publish history was kept.
+	err := store.DB.BaseEntities().UpdateId(mongodoc.BaseURL(&url0.URL), bson.D{{
+		"$unset", bson.D{{"publishhistory", true}},
+	}})
+	c.Assert(err, gc.Equals, nil)
 
-	// Add logs to the store.
-	beforeAdding := time.Now().Add(-time.Second)
-	err := store.AddLog(&infoData, mongodoc.InfoLevel, mongodoc.IngestionType, nil)
+	err = store.YankRevision(url1, params.StableChannel, "bob")
 	c.Assert(err, gc.Equals, nil)
-	err = store.AddLog(&errorData, mongodoc.ErrorLevel, mongodoc.IngestionType, urls)
+
+	// The highest revision still published in the channel is now current.
+	entity, err := store.FindBestEntity(charm.MustParseURL("~charmers/precise/wordpress"), params.StableChannel, nil)
 	c.Assert(err, gc.Equals, nil)
-	afterAdding := time.Now().Add(time.Second)
+	c.Assert(entity.URL, jc.DeepEquals, &url0.URL)
+}
 
-	// Retrieve the logs from the store.
-	var docs []mongodoc.Log
-	err = store.DB.Logs().Find(nil).Sort("_id").All(&docs)
+func (s *StoreSuite) TestYankRevisionInvalidChannel(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	url := router.MustNewResolvedURL("cs:~charmers/precise/wordpress-0", -1)
+	err := store.AddCharmWithArchive(url, storetesting.NewCharm(nil))
 	c.Assert(err, gc.Equals, nil)
-	c.Assert(docs, gc.HasLen, 2)
+	err = store.YankRevision(url, params.UnpublishedChannel, "bob")
+	c.Assert(err, gc.ErrorMatches, `cannot yank "cs:~charmers/precise/wordpress-0": invalid channel "unpublished"`)
+}
 
-	// The docs have been correctly added to the Mongo collection.
-	infoDoc, errorDoc := docs[0], docs[1]
-	c.Assert(infoDoc.Time, jc.TimeBetween(beforeAdding, afterAdding))
-	c.Assert(errorDoc.Time, jc.TimeBetween(beforeAdding, afterAdding))
-	infoDoc.Time = time.Time{}
-	errorDoc.Time = time.Time{}
-	c.Assert(infoDoc, jc.DeepEquals, mongodoc.Log{
-		Data:  []byte(infoData),
-		Level: mongodoc.InfoLevel,
-		Type:  mongodoc.IngestionType,
-		URLs:  nil,
-	})
-	c.Assert(errorDoc, jc.DeepEquals, mongodoc.Log{
-		Data:  []byte(errorData),
-		Level: mongodoc.ErrorLevel,
-		Type:  mongodoc.IngestionType,
-		URLs:  urls,
+func (s *StoreSuite) TestCopyChannelState(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	stableCharm := storetesting.NewCharm(storetesting.MetaWithTags(nil, "stable"))
+	edgeCharm := storetesting.NewCharm(storetesting.MetaWithTags(nil, "edge"))
+	from0 := router.MustNewResolvedURL("cs:~charmers/precise/wordpress-0", -1)
+	from1 := router.MustNewResolvedURL("cs:~charmers/precise/wordpress-1", -1)
+	err := store.AddCharmWithArchive(from0, stableCharm)
+	c.Assert(err, gc.Equals, nil)
+	err = store.AddCharmWithArchive(from1, edgeCharm)
+	c.Assert(err, gc.Equals, nil)
+	err = store.Publish(from0, nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	err = store.Publish(from1, nil, params.EdgeChannel)
+	c.Assert(err, gc.Equals, nil)
+
+	// The forked charm's revisions are in a different order.
+	to0 := router.MustNewResolvedURL("cs:~bob/precise/wordpress-0", -1)
+	to1 := router.MustNewResolvedURL("cs:~bob/precise/wordpress-1", -1)
+	err = store.AddCharmWithArchive(to0, edgeCharm)
+	c.Assert(err, gc.Equals, nil)
+	err = store.AddCharmWithArchive(to1, stableCharm)
+	c.Assert(err, gc.Equals, nil)
+
+	err = store.CopyChannelState(charm.MustParseURL("cs:~charmers/wordpress"), charm.MustParseURL("cs:~bob/wordpress"))
+	c.Assert(err, gc.Equals, nil)
+
+	baseEntity, err := store.FindBaseEntity(&to0.URL, FieldSelector("channelentities"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(baseEntity.ChannelEntities, jc.DeepEquals, map[params.Channel]map[string]*charm.URL{
+		params.StableChannel: {
+			"precise": &to1.URL,
+		},
+		params.EdgeChannel: {
+			"precise": &to0.URL,
+		},
 	})
+	entity, err := store.FindBestEntity(charm.MustParseURL("~bob/precise/wordpress"), params.StableChannel, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entity.URL, jc.DeepEquals, &to1.URL)
+	entity, err = store.FindBestEntity(charm.MustParseURL("~bob/precise/wordpress"), params.EdgeChannel, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entity.URL, jc.DeepEquals, &to0.URL)
+	problems, err := store.VerifyChannelConsistency(&to0.URL)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(problems, gc.HasLen, 0)
 }
 
-func (s *StoreSuite) TestAddLogDataError(c *gc.C) {
+func (s *StoreSuite) TestCopyChannelStateReplacesHeads(c *gc.C) {
 	store := s.newStore(c, false)
 	defer store.Close()
-	data := json.RawMessage([]byte("!"))
 
-	// Try to add the invalid log message to the store.
-	err := store.AddLog(&data, mongodoc.InfoLevel, mongodoc.IngestionType, nil)
-	c.Assert(err, gc.ErrorMatches, "cannot marshal log data: json: error calling MarshalJSON .*")
+	stableCharm := storetesting.NewCharm(storetesting.MetaWithTags(nil, "stable"))
+	from := router.MustNewResolvedURL("cs:~charmers/precise/wordpress-0", -1)
+	err := store.AddCharmWithArchive(from, stableCharm)
+	c.Assert(err, gc.Equals, nil)
+	err = store.Publish(from, nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+
+	// The target's existing heads are replaced by the copy.
+	to0 := router.MustNewResolvedURL("cs:~bob/precise/wordpress-0", -1)
+	to1 := router.MustNewResolvedURL("cs:~bob/precise/wordpress-1", -1)
+	err = store.AddCharmWithArchive(to0, stableCharm)
+	c.Assert(err, gc.Equals, nil)
+	err = store.AddCharmWithArchive(to1, storetesting.NewCharm(storetesting.MetaWithTags(nil, "other")))
+	c.Assert(err, gc.Equals, nil)
+	err = store.Publish(to1, nil, params.StableChannel, params.EdgeChannel)
+	c.Assert(err, gc.Equals, nil)
+
+	err = store.CopyChannelState(charm.MustParseURL("cs:~charmers/wordpress"), charm.MustParseURL("cs:~bob/wordpress"))
+	c.Assert(err, gc.Equals, nil)
+
+	baseEntity, err := store.FindBaseEntity(&to0.URL, FieldSelector("channelentities"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(baseEntity.ChannelEntities, jc.DeepEquals, map[params.Channel]map[string]*charm.URL{
+		params.StableChannel: {
+			"precise": &to0.URL,
+		},
+	})
+	entity, err := store.FindEntity(to1, FieldSelector("published"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entity.Published, gc.HasLen, 0)
+	problems, err := store.VerifyChannelConsistency(&to0.URL)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(problems, gc.HasLen, 0)
 }
 
-func (s *StoreSuite) TestAddLogBaseURLs(c *gc.C) {
+func (s *StoreSuite) TestCopyChannelStateNoMatchingRevision(c *gc.C) {
 	store := s.newStore(c, false)
 	defer store.Close()
 
-	// Add the log to the store with associated URLs.
-	data := json.RawMessage([]byte(`"info data"`))
-	err := store.AddLog(&data, mongodoc.WarningLevel, mongodoc.IngestionType, []*charm.URL{
-		charm.MustParseURL(storetesting.SearchSeries[1] + "/mysql-42"),
-		charm.MustParseURL("~who/utopic/wordpress"),
-	})
+	from := router.MustNewResolvedURL("cs:~charmers/precise/wordpress-0", -1)
+	err := store.AddCharmWithArchive(from, storetesting.NewCharm(storetesting.MetaWithTags(nil, "stable")))
 	c.Assert(err, gc.Equals, nil)
-
-	// Retrieve the log from the store.
-	var doc mongodoc.Log
-	err = store.DB.Logs().Find(nil).One(&doc)
+	err = store.Publish(from, nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	to := router.MustNewResolvedURL("cs:~bob/precise/wordpress-0", -1)
+	err = store.AddCharmWithArchive(to, storetesting.NewCharm(storetesting.MetaWithTags(nil, "other")))
 	c.Assert(err, gc.Equals, nil)
 
-	// The log includes the base URLs.
-	c.Assert(doc.URLs, jc.DeepEquals, []*charm.URL{
-		charm.MustParseURL(storetesting.SearchSeries[1] + "/mysql-42"),
-		charm.MustParseURL("mysql"),
-		charm.MustParseURL("~who/utopic/wordpress"),
-		charm.MustParseURL("~who/wordpress"),
-	})
+	err = store.CopyChannelState(charm.MustParseURL("cs:~charmers/wordpress"), charm.MustParseURL("cs:~bob/wordpress"))
+	c.Assert(err, gc.ErrorMatches, `cannot copy channel state from cs:~charmers/wordpress to cs:~bob/wordpress: no revision matches cs:~charmers/precise/wordpress-0`)
+
+	// The target is left unchanged.
+	baseEntity, err := store.FindBaseEntity(&to.URL, FieldSelector("channelentities"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(baseEntity.ChannelEntities, gc.HasLen, 0)
 }
 
-func (s *StoreSuite) TestAddLogDuplicateURLs(c *gc.C) {
+func (s *StoreSuite) TestCopyChannelStateNotFound(c *gc.C) {
 	store := s.newStore(c, false)
 	defer store.Close()
 
-	// Add the log to the store with associated URLs.
-	data := json.RawMessage([]byte(`"info data"`))
-	err := store.AddLog(&data, mongodoc.WarningLevel, mongodoc.IngestionType, []*charm.URL{
-		charm.MustParseURL(storetesting.SearchSeries[1] + "/mysql-42"),
-		charm.MustParseURL("mysql"),
-		charm.MustParseURL(storetesting.SearchSeries[1] + "/mysql-42"),
-		charm.MustParseURL("mysql"),
-	})
+	err := store.CopyChannelState(charm.MustParseURL("cs:~charmers/wordpress"), charm.MustParseURL("cs:~bob/wordpress"))
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *StoreSuite) TestRenameCharm(c *gc.C) {
+	store := s.newStore(c, true)
+	defer store.Close()
+	series := storetesting.SearchSeries[0]
+
+	old0 := router.MustNewResolvedURL("cs:~bob/"+series+"/wordpres-0", 0)
+	old1 := router.MustNewResolvedURL("cs:~bob/"+series+"/wordpres-1", 1)
+	err := store.AddCharmWithArchive(old0, storetesting.NewCharm(storetesting.MetaWithTags(nil, "stable")))
+	c.Assert(err, gc.Equals, nil)
+	err = store.AddCharmWithArchive(old1, storetesting.NewCharm(storetesting.MetaWithTags(nil, "edge")))
+	c.Assert(err, gc.Equals, nil)
+	err = store.Publish(old0, nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	err = store.Publish(old1, nil, params.EdgeChannel)
 	c.Assert(err, gc.Equals, nil)
 
-	// Retrieve the log from the store.
-	var doc mongodoc.Log
-	err = store.DB.Logs().Find(nil).One(&doc)
+	err = store.RenameCharm(charm.MustParseURL("cs:~bob/wordpres"), charm.MustParseURL("cs:~bob/wordpress"))
 	c.Assert(err, gc.Equals, nil)
 
-	// The log excludes duplicate URLs.
-	c.Assert(doc.URLs, jc.DeepEquals, []*charm.URL{
-		charm.MustParseURL(storetesting.SearchSeries[1] + "/mysql-42"),
-		charm.MustParseURL("mysql"),
+	// The old URLs no longer resolve.
+	for _, url := range []string{"~bob/" + series + "/wordpres-0", "~bob/" + series + "/wordpres-1", "~bob/wordpres", series + "/wordpres-1", "wordpres"} {
+		_, err := store.FindBestEntity(charm.MustParseURL(url), params.NoChannel, nil)
+		c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound, gc.Commentf("url %s", url))
+	}
+	_, err = store.FindBaseEntity(charm.MustParseURL("cs:~bob/wordpres"), nil)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+
+	// The new URLs resolve to the renamed entities.
+	new0 := router.MustNewResolvedURL("cs:~bob/"+series+"/wordpress-0", 0)
+	new1 := router.MustNewResolvedURL("cs:~bob/"+series+"/wordpress-1", 1)
+	for _, test := range []struct {
+		url     string
+		channel params.Channel
+		expect  *router.ResolvedURL
+	}{
+		{"~bob/" + series + "/wordpress-0", params.NoChannel, new0},
+		{"~bob/" + series + "/wordpress-1", params.NoChannel, new1},
+		{"~bob/wordpress", params.StableChannel, new0},
+		{"~bob/wordpress", params.EdgeChannel, new1},
+		{series + "/wordpress-1", params.NoChannel, new1},
+		{"wordpress", params.StableChannel, new0},
+	} {
+		entity, err := store.FindBestEntity(charm.MustParseURL(test.url), test.channel, nil)
+		c.Assert(err, gc.Equals, nil, gc.Commentf("url %s", test.url))
+		c.Assert(EntityResolvedURL(entity), jc.DeepEquals, test.expect, gc.Commentf("url %s", test.url))
+		c.Assert(entity.BaseURL, jc.DeepEquals, charm.MustParseURL("cs:~bob/wordpress"))
+		c.Assert(entity.Name, gc.Equals, "wordpress")
+	}
+	baseEntity, err := store.FindBaseEntity(charm.MustParseURL("cs:~bob/wordpress"), nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(baseEntity.Name, gc.Equals, "wordpress")
+	c.Assert(bool(baseEntity.Promulgated), gc.Equals, true)
+	c.Assert(baseEntity.ChannelEntities, jc.DeepEquals, map[params.Channel]map[string]*charm.URL{
+		params.StableChannel: {
+			series: &new0.URL,
+		},
+		params.EdgeChannel: {
+			series: &new1.URL,
+		},
 	})
+	c.Assert(baseEntity.PublishHistory, gc.HasLen, 2)
+	c.Assert(baseEntity.PublishHistory[0].URL, jc.DeepEquals, &new0.URL)
+	c.Assert(baseEntity.PublishHistory[1].URL, jc.DeepEquals, &new1.URL)
+
+	// New revisions continue from the old ones.
+	rev, err := store.NewRevision(charm.MustParseURL("cs:~bob/" + series + "/wordpress"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(rev, gc.Equals, 2)
+
+	// The search record has been renamed.
+	_, err = store.ES.GetSearchDocument(&old0.URL)
+	c.Assert(err, gc.ErrorMatches, "cannot retrieve search document for .*")
+	doc, err := store.ES.GetSearchDocument(&new0.URL)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(doc.URL, jc.DeepEquals, &new0.URL)
 }
 
-func (s *StoreSuite) TestCollections(c *gc.C) {
+func (s *StoreSuite) TestRenameCharmNewNameExists(c *gc.C) {
 	store := s.newStore(c, false)
 	defer store.Close()
-	colls := store.DB.Collections()
-	names, err := store.DB.CollectionNames()
-	c.Assert(err, gc.Equals, nil)
-	// Some collections don't have indexes so they are created only when used.
-	createdOnUse := map[string]bool{
-		"migrations": true,
-	}
-	// Check that all collections mentioned by Collections are actually created.
-	for _, coll := range colls {
-		found := false
-		for _, name := range names {
-			if name == coll.Name || createdOnUse[coll.Name] {
-				found = true
-			}
-		}
-		if !found {
-			c.Errorf("collection %q not created", coll.Name)
-		}
 
+	for _, id := range []string{"cs:~bob/precise/wordpres-0", "cs:~bob/precise/wordpress-0"} {
+		err := store.AddCharmWithArchive(router.MustNewResolvedURL(id, -1), storetesting.NewCharm(nil))
+		c.Assert(err, gc.Equals, nil)
 	}
-	otherCollections := map[string]bool{
-		"managedStoredResources": true,
-		"entitystore.chunks":     true,
-		"entitystore.blobref":    true,
-		"storedResources":        true,
-		"txns":                   true,
-		"txns.log":               true,
-		"txns.stash":             true,
-	}
-	// Check that all created collections are mentioned in Collections.
-	for _, name := range names {
-		if strings.HasPrefix(name, "system.") || strings.HasPrefix(name, "blobstore.") || otherCollections[name] {
-			continue
-		}
-		if name == "system.indexes" || name == "managedStoredResources" || name == "entitystore.files" {
-			continue
-		}
-		found := false
-		for _, coll := range colls {
-			if coll.Name == name {
-				found = true
-			}
-		}
-		if !found {
-			c.Errorf("extra collection %q found", name)
-		}
-	}
+	err := store.RenameCharm(charm.MustParseURL("cs:~bob/wordpres"), charm.MustParseURL("cs:~bob/wordpress"))
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrForbidden)
+	c.Assert(err, gc.ErrorMatches, `cannot rename cs:~bob/wordpres: cs:~bob/wordpress already exists`)
+
+	// Nothing has changed.
+	_, err = store.FindEntity(router.MustNewResolvedURL("cs:~bob/precise/wordpres-0", -1), nil)
+	c.Assert(err, gc.Equals, nil)
 }
 
-func (s *StoreSuite) TestOpenCachedBlobFileWithInvalidEntity(c *gc.C) {
+func (s *StoreSuite) TestRenameCharmPromulgatedNameExists(c *gc.C) {
 	store := s.newStore(c, false)
 	defer store.Close()
 
-	wordpress := storetesting.Charms.CharmDir("wordpress")
-	url := router.MustNewResolvedURL("cs:~charmers/"+storetesting.SearchSeries[0]+"/wordpress-23", 23)
-	err := store.AddCharmWithArchive(url, wordpress)
+	err := store.AddCharmWithArchive(router.MustNewResolvedURL("cs:~bob/precise/wordpres-0", 0), storetesting.NewCharm(nil))
 	c.Assert(err, gc.Equals, nil)
-
-	entity, err := store.FindEntity(url, FieldSelector("charmmeta"))
+	err = store.AddCharmWithArchive(router.MustNewResolvedURL("cs:~alice/precise/wordpress-0", 0), storetesting.NewCharm(nil))
 	c.Assert(err, gc.Equals, nil)
-	r, err := store.OpenCachedBlobFile(entity, "", nil)
-	c.Assert(err, gc.ErrorMatches, "provided entity does not have required fields")
-	c.Assert(r, gc.Equals, nil)
+
+	err = store.RenameCharm(charm.MustParseURL("cs:~bob/wordpres"), charm.MustParseURL("cs:~bob/wordpress"))
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrForbidden)
+	c.Assert(err, gc.ErrorMatches, `cannot rename cs:~bob/wordpres: promulgated name "wordpress" is already in use`)
 }
 
-func (s *StoreSuite) TestOpenCachedBlobFileWithFoundContent(c *gc.C) {
+func (s *StoreSuite) TestRenameCharmOtherBasePromulgated(c *gc.C) {
 	store := s.newStore(c, false)
 	defer store.Close()
 
-	wordpress := storetesting.Charms.CharmDir("wordpress")
-	url := router.MustNewResolvedURL("cs:~charmers/"+storetesting.SearchSeries[0]+"/wordpress-23", 23)
-	err := store.AddCharmWithArchive(url, wordpress)
+	err := store.AddCharmWithArchive(router.MustNewResolvedURL("cs:~bob/precise/wordpres-0", 0), storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	alice := router.MustNewResolvedURL("cs:~alice/trusty/wordpress-0", -1)
+	err = store.AddCharmWithArchive(alice, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	err = store.SetPromulgated(alice, true)
 	c.Assert(err, gc.Equals, nil)
 
-	// Get our expected content.
-	data, err := ioutil.ReadFile(filepath.Join(wordpress.Path, "metadata.yaml"))
+	err = store.RenameCharm(charm.MustParseURL("cs:~bob/wordpres"), charm.MustParseURL("cs:~bob/wordpress"))
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrForbidden)
+	c.Assert(err, gc.ErrorMatches, `cannot rename cs:~bob/wordpres: another charm named "wordpress" is already promulgated`)
+
+	// Nothing has changed.
+	_, err = store.FindEntity(router.MustNewResolvedURL("cs:~bob/precise/wordpres-0", 0), nil)
 	c.Assert(err, gc.Equals, nil)
-	expectContent := string(data)
+	_, err = store.FindBaseEntity(charm.MustParseURL("cs:~bob/wordpress"), nil)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
 
-	entity, err := store.FindEntity(url, FieldSelector("blobhash", "contents"))
+func (s *StoreSuite) TestRenameCharmResumesInterruptedRename(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	old0 := router.MustNewResolvedURL("cs:~bob/precise/wordpres-0", 0)
+	err := store.AddCharmWithArchive(old0, storetesting.NewCharm(nil))
 	c.Assert(err, gc.Equals, nil)
+	err = store.Publish(old0, nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	oldBase := charm.MustParseURL("cs:~bob/wordpres")
+	newBase := charm.MustParseURL("cs:~bob/wordpress")
 
-	// Check that, when we open the file for the first time,
-	// we see the expected content.
-	r, err := store.OpenCachedBlobFile(entity, mongodoc.FileIcon, func(f *zip.File) bool {
-		return path.Clean(f.Name) == "metadata.yaml"
+	s.PatchValue(TestRenameWritten, func() error {
+		return errgo.New("interrupted")
 	})
+	err = store.RenameCharm(oldBase, newBase)
+	c.Assert(err, gc.ErrorMatches, "interrupted")
+
+	// Both names exist, and the new one records the rename.
+	_, err = store.FindEntity(old0, nil)
 	c.Assert(err, gc.Equals, nil)
-	defer r.Close()
-	data, err = ioutil.ReadAll(r)
+	baseEntity, err := store.FindBaseEntity(newBase, nil)
 	c.Assert(err, gc.Equals, nil)
-	c.Assert(string(data), gc.Equals, expectContent)
+	c.Assert(baseEntity.RenamedFrom, jc.DeepEquals, oldBase)
 
-	// When retrieving the entity again, check that the Contents
-	// map has been set appropriately...
-	entity, err = store.FindEntity(url, FieldSelector("blobhash", "contents"))
+	// Running the rename again completes it.
+	*TestRenameWritten = nil
+	err = store.RenameCharm(oldBase, newBase)
 	c.Assert(err, gc.Equals, nil)
-	c.Assert(entity.Contents, gc.HasLen, 1)
-	c.Assert(entity.Contents[mongodoc.FileIcon].IsValid(), gc.Equals, true)
+	_, err = store.FindBaseEntity(oldBase, nil)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	_, err = store.FindEntity(old0, nil)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	entity, err := store.FindBestEntity(charm.MustParseURL("wordpress"), params.StableChannel, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(EntityResolvedURL(entity), jc.DeepEquals, router.MustNewResolvedURL("cs:~bob/precise/wordpress-0", 0))
+	baseEntity, err = store.FindBaseEntity(newBase, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(baseEntity.RenamedFrom, gc.IsNil)
+	rev, err := store.NewRevision(charm.MustParseURL("cs:~bob/precise/wordpress"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(rev, gc.Equals, 1)
 
-	// ... and that OpenCachedBlobFile still returns a reader with the
-	// same data, without making use of the isFile callback.
-	r, err = store.OpenCachedBlobFile(entity, mongodoc.FileIcon, func(f *zip.File) bool {
-		c.Errorf("isFile called unexpectedly")
-		return false
-	})
+	// A rename interrupted after the old base entity was removed
+	// is also completed.
+	err = store.DB.BaseEntities().UpdateId(newBase, bson.D{{"$set", bson.D{{"renamedfrom", oldBase}}}})
 	c.Assert(err, gc.Equals, nil)
-	defer r.Close()
-	data, err = ioutil.ReadAll(r)
+	err = store.RenameCharm(oldBase, newBase)
 	c.Assert(err, gc.Equals, nil)
-	c.Assert(string(data), gc.Equals, expectContent)
+	baseEntity, err = store.FindBaseEntity(newBase, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(baseEntity.RenamedFrom, gc.IsNil)
 }
 
-func (s *StoreSuite) TestOpenCachedBlobFileWithNotFoundContent(c *gc.C) {
+func (s *StoreSuite) TestRenameCharmNotFound(c *gc.C) {
 	store := s.newStore(c, false)
 	defer store.Close()
 
-	wordpress := storetesting.Charms.CharmDir("wordpress")
-	url := router.MustNewResolvedURL("cs:~charmers/"+storetesting.SearchSeries[0]+"/wordpress-23", 23)
-	err := store.AddCharmWithArchive(url, wordpress)
-	c.Assert(err, gc.Equals, nil)
-
-	entity, err := store.FindEntity(url, FieldSelector("blobhash", "contents"))
-	c.Assert(err, gc.Equals, nil)
-
-	// Check that, when we open the file for the first time,
-	// we get a NotFound error.
-	r, err := store.OpenCachedBlobFile(entity, mongodoc.FileIcon, func(f *zip.File) bool {
-		return false
-	})
-	c.Assert(err, gc.ErrorMatches, "not found")
+	err := store.RenameCharm(charm.MustParseURL("cs:~bob/wordpres"), charm.MustParseURL("cs:~bob/wordpress"))
 	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
-	c.Assert(r, gc.Equals, nil)
+}
 
-	// When retrieving the entity again, check that the Contents
-	// map has been set appropriately...
-	entity, err = store.FindEntity(url, FieldSelector("blobhash", "contents"))
-	c.Assert(err, gc.Equals, nil)
-	c.Assert(entity.Contents, gc.DeepEquals, map[mongodoc.FileId]mongodoc.ZipFile{
-		mongodoc.FileIcon: {},
-	})
+func (s *StoreSuite) TestRenameCharmDifferentUser(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
 
-	// ... and that OpenCachedBlobFile still returns a NotFound
-	// error, without making use of the isFile callback.
-	r, err = store.OpenCachedBlobFile(entity, mongodoc.FileIcon, func(f *zip.File) bool {
-		c.Errorf("isFile called unexpectedly")
-		return false
-	})
-	c.Assert(err, gc.ErrorMatches, "not found")
-	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
-	c.Assert(r, gc.Equals, nil)
+	err := store.RenameCharm(charm.MustParseURL("cs:~bob/wordpres"), charm.MustParseURL("cs:~alice/wordpress"))
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+	c.Assert(err, gc.ErrorMatches, `cannot rename cs:~bob/wordpres to cs:~alice/wordpress: user differs`)
 }
 
 func (s *StoreSuite) TestSESPutDoesNotErrorWithNoESConfigured(c *gc.C) {
@@ -2591,6 +5003,96 @@ func (s *StoreSuite) TestUpdateEntity(c *gc.C) {
 	}
 }
 
+func (s *StoreSuite) TestUpdateEntityExtraInfo(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	writes := 0
+	s.PatchValue(TestExtraInfoWritten, func(*router.ResolvedURL) {
+		writes++
+	})
+	url := router.MustNewResolvedURL("~charmers/"+storetesting.SearchSeries[1]+"/wordpress-10", -1)
+	err := store.AddCharmWithArchive(url, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+
+	tests := []struct {
+		about         string
+		values        map[string][]byte
+		expectChanged bool
+		expectInfo    map[string][]byte
+	}{{
+		about: "new values",
+		values: map[string][]byte{
+			"a": []byte(`"one"`),
+			"b": []byte(`2`),
+		},
+		expectChanged: true,
+		expectInfo: map[string][]byte{
+			"a": []byte(`"one"`),
+			"b": []byte(`2`),
+		},
+	}, {
+		about: "identical values",
+		values: map[string][]byte{
+			"a": []byte(`"one"`),
+			"b": []byte(`2`),
+		},
+		expectInfo: map[string][]byte{
+			"a": []byte(`"one"`),
+			"b": []byte(`2`),
+		},
+	}, {
+		about: "one value differs",
+		values: map[string][]byte{
+			"a": []byte(`"one"`),
+			"b": []byte(`3`),
+		},
+		expectChanged: true,
+		expectInfo: map[string][]byte{
+			"a": []byte(`"one"`),
+			"b": []byte(`3`),
+		},
+	}, {
+		about: "remove value",
+		values: map[string][]byte{
+			"b": nil,
+		},
+		expectChanged: true,
+		expectInfo: map[string][]byte{
+			"a": []byte(`"one"`),
+		},
+	}, {
+		about: "remove absent value",
+		values: map[string][]byte{
+			"b": nil,
+		},
+		expectInfo: map[string][]byte{
+			"a": []byte(`"one"`),
+		},
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: %s", i, test.about)
+		writes = 0
+		changed, err := store.UpdateEntityExtraInfo(url, test.values)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(changed, gc.Equals, test.expectChanged)
+		if test.expectChanged {
+			c.Assert(writes, gc.Equals, 1)
+		} else {
+			c.Assert(writes, gc.Equals, 0)
+		}
+		entity, err := store.FindEntity(url, FieldSelector("extrainfo"))
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(entity.ExtraInfo, jc.DeepEquals, test.expectInfo)
+	}
+
+	// Updating a non-existent entity returns a not found error.
+	_, err = store.UpdateEntityExtraInfo(router.MustNewResolvedURL("~charmers/"+storetesting.SearchSeries[1]+"/mysql-1", -1), map[string][]byte{
+		"a": []byte(`"one"`),
+	})
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	c.Assert(writes, gc.Equals, 0)
+}
+
 var updateBaseEntityTests = []struct {
 	url       string
 	expectErr string
@@ -3116,139 +5618,571 @@ func (s *StoreSuite) TestSetPromulgatedUpdateSearch(c *gc.C) {
 	doc = zdoc
 	err = store.ES.GetDocument(s.TestIndex, typeName, store.ES.getID(charm.MustParseURL("~openstack-charmers/"+storetesting.SearchSeries[1]+"/wordpress-0")), &doc)
 	c.Assert(err, gc.Equals, nil)
-	c.Assert(doc.PromulgatedURL, gc.IsNil)
-	c.Assert(doc.PromulgatedRevision, gc.Equals, -1)
-	doc = zdoc
-	err = store.ES.GetDocument(s.TestIndex, typeName, store.ES.getID(charm.MustParseURL("~openstack-charmers/"+storetesting.SearchSeries[0]+"/wordpress-0")), &doc)
+	c.Assert(doc.PromulgatedURL, gc.IsNil)
+	c.Assert(doc.PromulgatedRevision, gc.Equals, -1)
+	doc = zdoc
+	err = store.ES.GetDocument(s.TestIndex, typeName, store.ES.getID(charm.MustParseURL("~openstack-charmers/"+storetesting.SearchSeries[0]+"/wordpress-0")), &doc)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(doc.PromulgatedURL, gc.IsNil)
+	c.Assert(doc.PromulgatedRevision, gc.Equals, -1)
+}
+
+func (s *StoreSuite) TestRecomputePromulgatedRevisions(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	// Each entity is uploaded an hour after the previous one.
+	entities := []*mongodoc.Entity{
+		entity("~charmers/trusty/wordpress-0", "trusty/wordpress-0"),
+		// A gap in the promulgated revisions.
+		entity("~charmers/trusty/wordpress-1", "trusty/wordpress-3"),
+		// A duplicate promulgated revision.
+		entity("~charmers/xenial/wordpress-0", "xenial/wordpress-3"),
+		// A promulgated revision without a promulgated URL.
+		entity("~charmers/xenial/wordpress-1", ""),
+		// An entity that is not promulgated.
+		entity("~bob/trusty/wordpress-0", ""),
+		// An entity with a different name.
+		entity("~charmers/trusty/mysql-0", "trusty/mysql-5"),
+	}
+	entities[3].PromulgatedRevision = 7
+	for i, e := range entities {
+		e.UploadTime = t0.Add(time.Duration(i) * time.Hour)
+		err := store.DB.Entities().Insert(e)
+		c.Assert(err, gc.Equals, nil)
+	}
+	expect := map[string]string{
+		"~charmers/trusty/wordpress-0": "trusty/wordpress-0",
+		"~charmers/trusty/wordpress-1": "trusty/wordpress-1",
+		"~charmers/xenial/wordpress-0": "xenial/wordpress-2",
+		"~charmers/xenial/wordpress-1": "xenial/wordpress-3",
+		"~bob/trusty/wordpress-0":      "",
+		"~charmers/trusty/mysql-0":     "trusty/mysql-5",
+	}
+	// Running a second time should make no changes.
+	for i := 0; i < 2; i++ {
+		err := store.RecomputePromulgatedRevisions("wordpress")
+		c.Assert(err, gc.Equals, nil)
+		for id, pid := range expect {
+			e, err := store.FindEntity(router.MustNewResolvedURL(id, -1), FieldSelector("promulgated-url", "promulgated-revision"))
+			c.Assert(err, gc.Equals, nil)
+			if pid == "" {
+				c.Assert(e.PromulgatedURL, gc.IsNil, gc.Commentf("%s", id))
+				c.Assert(e.PromulgatedRevision, gc.Equals, -1, gc.Commentf("%s", id))
+				continue
+			}
+			purl := charm.MustParseURL(pid)
+			c.Assert(e.PromulgatedURL, jc.DeepEquals, purl, gc.Commentf("%s", id))
+			c.Assert(e.PromulgatedRevision, gc.Equals, purl.Revision, gc.Commentf("%s", id))
+		}
+	}
+}
+
+func (s *StoreSuite) TestRecomputePromulgatedRevisionsUpdatesRevisions(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	for _, id := range []string{
+		"0 cs:~charmers/trusty/wordpress-0",
+		"0 cs:~charmers/xenial/wordpress-1",
+	} {
+		err := store.AddCharmWithArchive(MustParseResolvedURL(id), storetesting.NewCharm(nil))
+		c.Assert(err, gc.Equals, nil)
+	}
+	err := store.RecomputePromulgatedRevisions("wordpress")
+	c.Assert(err, gc.Equals, nil)
+	e, err := store.FindEntity(MustParseResolvedURL("cs:~charmers/xenial/wordpress-1"), FieldSelector("promulgated-url"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(e.PromulgatedURL, jc.DeepEquals, charm.MustParseURL("cs:xenial/wordpress-1"))
+
+	// A new promulgated revision does not clash with the
+	// renumbered one.
+	rev, err := store.NewRevision(charm.MustParseURL("cs:xenial/wordpress"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(rev, gc.Equals, 2)
+	err = store.AddCharmWithArchive(router.MustNewResolvedURL("cs:~charmers/xenial/wordpress-2", rev), storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+}
+
+func (s *StoreSuite) TestRecomputePromulgatedRevisionsNoEntities(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	err := store.RecomputePromulgatedRevisions("wordpress")
+	c.Assert(err, gc.Equals, nil)
+}
+
+var entityResolvedURLTests = []struct {
+	about  string
+	entity *mongodoc.Entity
+	rurl   *router.ResolvedURL
+}{{
+	about: "user owned, published",
+	entity: &mongodoc.Entity{
+		URL: charm.MustParseURL("~charmers/" + storetesting.SearchSeries[0] + "/wordpress-23"),
+	},
+	rurl: &router.ResolvedURL{
+		URL:                 *charm.MustParseURL("~charmers/" + storetesting.SearchSeries[0] + "/wordpress-23"),
+		PromulgatedRevision: -1,
+	},
+}, {
+	about: "promulgated, published",
+	entity: &mongodoc.Entity{
+		URL:            charm.MustParseURL("~charmers/" + storetesting.SearchSeries[0] + "/wordpress-23"),
+		PromulgatedURL: charm.MustParseURL(storetesting.SearchSeries[0] + "/wordpress-4"),
+	},
+	rurl: &router.ResolvedURL{
+		URL:                 *charm.MustParseURL("~charmers/" + storetesting.SearchSeries[0] + "/wordpress-23"),
+		PromulgatedRevision: 4,
+	},
+}}
+
+func (s *StoreSuite) TestEntityResolvedURL(c *gc.C) {
+	for i, test := range entityResolvedURLTests {
+		c.Logf("test %d: %s", i, test.about)
+		c.Assert(EntityResolvedURL(test.entity), gc.DeepEquals, test.rurl)
+	}
+}
+
+func (s *StoreSuite) TestCopyCopiesSessions(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	wordpress := storetesting.Charms.CharmDir("wordpress")
+	url := MustParseResolvedURL("23 cs:~charmers/" + storetesting.SearchSeries[0] + "/wordpress-23")
+	err := store.AddCharmWithArchive(url, wordpress)
+	c.Assert(err, gc.Equals, nil)
+
+	store1 := store.Copy()
+	defer store1.Close()
+
+	// Close the store we copied from. The copy should be unaffected.
+	store.Close()
+
+	entity, err := store1.FindEntity(url, nil)
+	c.Assert(err, gc.Equals, nil)
+
+	// Also check the blob store, as it has its own session reference.
+	r, _, err := store1.BlobStore.Open(entity.BlobHash, nil)
+	c.Assert(err, gc.Equals, nil)
+	r.Close()
+
+	// Also check the macaroon storage as that also has its own session reference.
+	m, err := store1.Bakery.NewMacaroon(nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(m, gc.NotNil)
+}
+
+func (s *StoreSuite) TestAddAudit(c *gc.C) {
+	filename := filepath.Join(c.MkDir(), "audit.log")
+	config := ServerParams{
+		AuditLogger: &lumberjack.Logger{
+			Filename: filename,
+		},
+	}
+
+	p, err := NewPool(s.Session.DB("juju_test"), nil, nil, config)
+	c.Assert(err, gc.Equals, nil)
+	defer p.Close()
+
+	store := p.Store()
+	defer store.Close()
+
+	entries := []audit.Entry{{
+		User:   "George Clooney",
+		Op:     audit.OpSetPerm,
+		Entity: charm.MustParseURL("cs:mycharm"),
+		ACL: &audit.ACL{
+			Read:  []string{"eleven", "ocean"},
+			Write: []string{"brad", "pitt"},
+		},
+	}, {
+		User: "Julia Roberts",
+		Op:   audit.OpSetPerm,
+	}}
+
+	now := time.Now()
+	for _, e := range entries {
+		store.addAuditAtTime(e, now)
+	}
+	data, err := ioutil.ReadFile(filename)
+	c.Assert(err, gc.Equals, nil)
+
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	c.Assert(lines, gc.HasLen, len(entries))
+	for i, e := range entries {
+		e.Time = now
+		c.Assert(lines[i], jc.JSONEquals, e)
+	}
+}
+
+func (s *StoreSuite) TestAddAuditWithNoLumberjack(c *gc.C) {
+	p, err := NewPool(s.Session.DB("juju_test"), nil, nil, ServerParams{})
+	c.Assert(err, gc.Equals, nil)
+	defer p.Close()
+
+	store := p.Store()
+	defer store.Close()
+
+	// Check that it does not panic.
+	store.AddAudit(audit.Entry{
+		User:   "George Clooney",
+		Op:     audit.OpSetPerm,
+		Entity: charm.MustParseURL("cs:mycharm"),
+		ACL: &audit.ACL{
+			Read:  []string{"eleven", "ocean"},
+			Write: []string{"brad", "pitt"},
+		},
+	})
+}
+
+func (s *StoreSuite) TestUploadAndDeleteAudit(c *gc.C) {
+	filename := filepath.Join(c.MkDir(), "audit.log")
+	p, err := NewPool(s.Session.DB("juju_test"), nil, nil, ServerParams{
+		AuditLogger: &lumberjack.Logger{
+			Filename: filename,
+		},
+	})
+	c.Assert(err, gc.Equals, nil)
+	defer p.Close()
+
+	store := p.Store()
+	defer store.Close()
+
+	charmId := router.MustNewResolvedURL("~charmers/"+storetesting.SearchSeries[0]+"/wordpress-0", -1)
+	err = store.AddCharmWithArchive(charmId, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	charmId1 := router.MustNewResolvedURL("~charmers/"+storetesting.SearchSeries[0]+"/wordpress-1", -1)
+	err = store.AddCharmWithArchive(charmId1, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	bundleId := router.MustNewResolvedURL("~charmers/bundle/wordpress-simple-0", -1)
+	err = store.AddBundleWithArchive(bundleId, storetesting.NewBundle(&charm.BundleData{
+		Applications: map[string]*charm.ApplicationSpec{
+			"wordpress": {
+				Charm: "cs:~charmers/" + storetesting.SearchSeries[0] + "/wordpress-1",
+			},
+		},
+	}))
+	c.Assert(err, gc.Equals, nil)
+
+	var expect []audit.Entry
+	for _, id := range []*router.ResolvedURL{charmId, charmId1, bundleId} {
+		entity, err := store.FindEntity(id, FieldSelector("blobhash", "size"))
+		c.Assert(err, gc.Equals, nil)
+		expect = append(expect, audit.Entry{
+			User:     "charmers",
+			Op:       audit.OpUpload,
+			Entity:   &id.URL,
+			BlobHash: entity.BlobHash,
+			Size:     entity.Size,
+		})
+	}
+	err = store.DeleteEntity(charmId, "bob")
+	c.Assert(err, gc.Equals, nil)
+	expect = append(expect, audit.Entry{
+		User:     "bob",
+		Op:       audit.OpDelete,
+		Entity:   &charmId.URL,
+		BlobHash: expect[0].BlobHash,
+		Size:     expect[0].Size,
+	})
+
+	data, err := ioutil.ReadFile(filename)
+	c.Assert(err, gc.Equals, nil)
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	c.Assert(lines, gc.HasLen, len(expect))
+	for i, line := range lines {
+		var e audit.Entry
+		err := json.Unmarshal([]byte(line), &e)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(e.Time.IsZero(), gc.Equals, false)
+		e.Time = time.Time{}
+		c.Assert(e, jc.DeepEquals, expect[i])
+	}
+}
+
+func (s *StoreSuite) TestUploadAndDeleteAuditWithNoLumberjack(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	// Check that uploads and deletes succeed without an audit logger.
+	for i := 0; i < 2; i++ {
+		id := router.MustNewResolvedURL(fmt.Sprintf("~charmers/%s/wordpress-%d", storetesting.SearchSeries[0], i), -1)
+		err := store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+		c.Assert(err, gc.Equals, nil)
+	}
+	err := store.DeleteEntity(router.MustNewResolvedURL("~charmers/"+storetesting.SearchSeries[0]+"/wordpress-0", -1), "charmers")
+	c.Assert(err, gc.Equals, nil)
+}
+
+func (s *StoreSuite) TestEntityAuditHistory(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	id0 := router.MustNewResolvedURL("~charmers/"+storetesting.SearchSeries[0]+"/wordpress-0", -1)
+	id1 := router.MustNewResolvedURL("~charmers/"+storetesting.SearchSeries[0]+"/wordpress-1", -1)
+	var expect []audit.Entry
+	for _, id := range []*router.ResolvedURL{id0, id1} {
+		err := store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+		c.Assert(err, gc.Equals, nil)
+		entity, err := store.FindEntity(id, FieldSelector("blobhash", "size"))
+		c.Assert(err, gc.Equals, nil)
+		expect = append(expect, audit.Entry{
+			User:     "charmers",
+			Op:       audit.OpUpload,
+			Entity:   &id.URL,
+			BlobHash: entity.BlobHash,
+			Size:     entity.Size,
+		})
+	}
+	for _, readers := range [][]string{{"bob"}, {"bob", "alice"}, {"everyone"}} {
+		e := audit.Entry{
+			User:   "admin",
+			Op:     audit.OpSetPerm,
+			Entity: &id1.URL,
+			ACL: &audit.ACL{
+				Read: readers,
+			},
+		}
+		store.AddAudit(e)
+		expect = append(expect, e)
+	}
+	err := store.DeleteEntity(id0, "charmers")
+	c.Assert(err, gc.Equals, nil)
+	expect = append(expect, audit.Entry{
+		User:     "charmers",
+		Op:       audit.OpDelete,
+		Entity:   &id0.URL,
+		BlobHash: expect[0].BlobHash,
+		Size:     expect[0].Size,
+	})
+	// Entries for other entities are not included.
+	store.AddAudit(audit.Entry{
+		User:   "admin",
+		Op:     audit.OpSetPerm,
+		Entity: charm.MustParseURL("~charmers/" + storetesting.SearchSeries[0] + "/mysql-0"),
+	})
+
+	// reversed returns the given entries, most recent first.
+	reversed := func(entries ...audit.Entry) []audit.Entry {
+		r := make([]audit.Entry, len(entries))
+		for i, e := range entries {
+			r[len(entries)-1-i] = e
+		}
+		return r
+	}
+	tests := []struct {
+		about  string
+		url    *charm.URL
+		limit  int
+		expect []audit.Entry
+	}{{
+		about:  "all revisions",
+		url:    charm.MustParseURL("~charmers/" + storetesting.SearchSeries[0] + "/wordpress"),
+		expect: reversed(expect...),
+	}, {
+		about:  "all revisions with limit",
+		url:    charm.MustParseURL("~charmers/" + storetesting.SearchSeries[0] + "/wordpress"),
+		limit:  2,
+		expect: reversed(expect[4:]...),
+	}, {
+		about:  "single revision",
+		url:    &id1.URL,
+		expect: reversed(expect[1:5]...),
+	}, {
+		about:  "deleted revision",
+		url:    &id0.URL,
+		expect: reversed(expect[0], expect[2], expect[3], expect[4], expect[5]),
+	}, {
+		about:  "no entries",
+		url:    charm.MustParseURL("~bob/" + storetesting.SearchSeries[0] + "/wordpress"),
+		expect: []audit.Entry{},
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: %s", i, test.about)
+		entries, err := store.EntityAuditHistory(test.url, test.limit)
+		c.Assert(err, gc.Equals, nil)
+		for i := range entries {
+			c.Assert(entries[i].Time.IsZero(), gc.Equals, false)
+			entries[i].Time = time.Time{}
+		}
+		c.Assert(entries, jc.DeepEquals, test.expect)
+	}
+}
+
+func (s *StoreSuite) TestEntityAuditHistoryNoUser(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	_, err := store.EntityAuditHistory(charm.MustParseURL("wordpress"), 0)
+	c.Assert(err, gc.ErrorMatches, `no user specified in "cs:wordpress"`)
+}
+
+func (s *StoreSuite) TestSetPermsBatch(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	ids := []*router.ResolvedURL{
+		router.MustNewResolvedURL("~charmers/"+storetesting.SearchSeries[0]+"/wordpress-0", -1),
+		router.MustNewResolvedURL("~charmers/"+storetesting.SearchSeries[0]+"/mysql-0", -1),
+		router.MustNewResolvedURL("~bob/"+storetesting.SearchSeries[0]+"/varnish-0", -1),
+	}
+	for _, id := range ids {
+		err := store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+		c.Assert(err, gc.Equals, nil)
+	}
+	err := store.SetPermsBatch([]*charm.URL{
+		&ids[0].URL,
+		&ids[1].URL,
+		charm.MustParseURL("~charmers/wordpress"),
+	}, "stable.write", []string{"charmers", "team"}, "charmers", nil)
+	c.Assert(err, gc.Equals, nil)
+
+	for i, id := range ids {
+		be, err := store.FindBaseEntity(&id.URL, nil)
+		c.Assert(err, gc.Equals, nil)
+		if i == 2 {
+			c.Assert(be.ChannelACLs[params.StableChannel].Write, jc.DeepEquals, []string{"bob"})
+			continue
+		}
+		c.Assert(be.ChannelACLs[params.StableChannel].Write, jc.DeepEquals, []string{"charmers", "team"})
+		c.Assert(be.ChannelACLs[params.StableChannel].Read, jc.DeepEquals, []string{"charmers"})
+	}
+}
+
+func (s *StoreSuite) TestSetPermsBatchNotFound(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	id := router.MustNewResolvedURL("~charmers/"+storetesting.SearchSeries[0]+"/wordpress-0", -1)
+	err := store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+
+	err = store.SetPermsBatch([]*charm.URL{
+		&id.URL,
+		charm.MustParseURL("~charmers/nosuch"),
+	}, "stable.read", []string{params.Everyone}, "charmers", nil)
+	c.Assert(err, gc.ErrorMatches, `base entity "cs:~charmers/nosuch" not found`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+
+	// The existing entity has not been changed.
+	be, err := store.FindBaseEntity(&id.URL, nil)
 	c.Assert(err, gc.Equals, nil)
-	c.Assert(doc.PromulgatedURL, gc.IsNil)
-	c.Assert(doc.PromulgatedRevision, gc.Equals, -1)
+	c.Assert(be.ChannelACLs[params.StableChannel].Read, jc.DeepEquals, []string{"charmers"})
 }
 
-var entityResolvedURLTests = []struct {
-	about  string
-	entity *mongodoc.Entity
-	rurl   *router.ResolvedURL
-}{{
-	about: "user owned, published",
-	entity: &mongodoc.Entity{
-		URL: charm.MustParseURL("~charmers/" + storetesting.SearchSeries[0] + "/wordpress-23"),
-	},
-	rurl: &router.ResolvedURL{
-		URL:                 *charm.MustParseURL("~charmers/" + storetesting.SearchSeries[0] + "/wordpress-23"),
-		PromulgatedRevision: -1,
-	},
-}, {
-	about: "promulgated, published",
-	entity: &mongodoc.Entity{
-		URL:            charm.MustParseURL("~charmers/" + storetesting.SearchSeries[0] + "/wordpress-23"),
-		PromulgatedURL: charm.MustParseURL(storetesting.SearchSeries[0] + "/wordpress-4"),
-	},
-	rurl: &router.ResolvedURL{
-		URL:                 *charm.MustParseURL("~charmers/" + storetesting.SearchSeries[0] + "/wordpress-23"),
-		PromulgatedRevision: 4,
-	},
-}}
+func (s *StoreSuite) TestSetPermsBatchUnauthorized(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
 
-func (s *StoreSuite) TestEntityResolvedURL(c *gc.C) {
-	for i, test := range entityResolvedURLTests {
-		c.Logf("test %d: %s", i, test.about)
-		c.Assert(EntityResolvedURL(test.entity), gc.DeepEquals, test.rurl)
+	ids := []*router.ResolvedURL{
+		router.MustNewResolvedURL("~charmers/"+storetesting.SearchSeries[0]+"/wordpress-0", -1),
+		router.MustNewResolvedURL("~bob/"+storetesting.SearchSeries[0]+"/mysql-0", -1),
+	}
+	for _, id := range ids {
+		err := store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+		c.Assert(err, gc.Equals, nil)
+	}
+	var checked []string
+	err := store.SetPermsBatch([]*charm.URL{
+		&ids[0].URL,
+		&ids[1].URL,
+	}, "stable.write", []string{"team"}, "charmers", func(ch params.Channel, be *mongodoc.BaseEntity) error {
+		c.Check(ch, gc.Equals, params.StableChannel)
+		checked = append(checked, be.URL.String())
+		if be.URL.User != "charmers" {
+			return errgo.WithCausef(nil, params.ErrUnauthorized, "cannot write %v", be.URL)
+		}
+		return nil
+	})
+	c.Assert(err, gc.ErrorMatches, `cannot write cs:~bob/mysql`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrUnauthorized)
+
+	// No base entity has been changed, including the
+	// authorized one.
+	c.Assert(checked, jc.SameContents, []string{"cs:~charmers/wordpress", "cs:~bob/mysql"})
+	for _, id := range ids {
+		be, err := store.FindBaseEntity(&id.URL, nil)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(be.ChannelACLs[params.StableChannel].Write, jc.DeepEquals, []string{id.URL.User})
 	}
 }
 
-func (s *StoreSuite) TestCopyCopiesSessions(c *gc.C) {
+func (s *StoreSuite) TestSetPermsBatchNoChannel(c *gc.C) {
 	store := s.newStore(c, false)
 	defer store.Close()
 
-	wordpress := storetesting.Charms.CharmDir("wordpress")
-	url := MustParseResolvedURL("23 cs:~charmers/" + storetesting.SearchSeries[0] + "/wordpress-23")
-	err := store.AddCharmWithArchive(url, wordpress)
+	id := router.MustNewResolvedURL("~charmers/"+storetesting.SearchSeries[0]+"/wordpress-0", -1)
+	err := store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
 	c.Assert(err, gc.Equals, nil)
 
-	store1 := store.Copy()
-	defer store1.Close()
+	// An op without a channel applies to the unpublished channel.
+	err = store.SetPermsBatch([]*charm.URL{&id.URL}, "write", []string{"team"}, "charmers", nil)
+	c.Assert(err, gc.Equals, nil)
+	be, err := store.FindBaseEntity(&id.URL, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(be.ChannelACLs[params.UnpublishedChannel].Write, jc.DeepEquals, []string{"team"})
+	c.Assert(be.ChannelACLs[params.StableChannel].Write, jc.DeepEquals, []string{"charmers"})
+}
 
-	// Close the store we copied from. The copy should be unaffected.
-	store.Close()
+func (s *StoreSuite) TestSetPermsBatchInvalidOp(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
 
-	entity, err := store1.FindEntity(url, nil)
+	id := router.MustNewResolvedURL("~charmers/"+storetesting.SearchSeries[0]+"/wordpress-0", -1)
+	err := store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
 	c.Assert(err, gc.Equals, nil)
 
-	// Also check the blob store, as it has its own session reference.
-	r, _, err := store1.BlobStore.Open(entity.BlobHash, nil)
-	c.Assert(err, gc.Equals, nil)
-	r.Close()
+	err = store.SetPermsBatch([]*charm.URL{&id.URL}, "stable.delete", []string{"bob"}, "charmers", nil)
+	c.Assert(err, gc.ErrorMatches, `invalid operation "delete"`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
 
-	// Also check the macaroon storage as that also has its own session reference.
-	m, err := store1.Bakery.NewMacaroon(nil)
-	c.Assert(err, gc.Equals, nil)
-	c.Assert(m, gc.NotNil)
+	err = store.SetPermsBatch([]*charm.URL{&id.URL}, "nosuch.read", []string{"bob"}, "charmers", nil)
+	c.Assert(err, gc.ErrorMatches, `invalid channel "nosuch"`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
 }
 
-func (s *StoreSuite) TestAddAudit(c *gc.C) {
+func (s *StoreSuite) TestSetPermsBatchAudit(c *gc.C) {
 	filename := filepath.Join(c.MkDir(), "audit.log")
-	config := ServerParams{
+	p, err := NewPool(s.Session.DB("juju_test"), nil, nil, ServerParams{
 		AuditLogger: &lumberjack.Logger{
 			Filename: filename,
 		},
-	}
-
-	p, err := NewPool(s.Session.DB("juju_test"), nil, nil, config)
+	})
 	c.Assert(err, gc.Equals, nil)
 	defer p.Close()
 
 	store := p.Store()
 	defer store.Close()
 
-	entries := []audit.Entry{{
-		User:   "George Clooney",
-		Op:     audit.OpSetPerm,
-		Entity: charm.MustParseURL("cs:mycharm"),
-		ACL: &audit.ACL{
-			Read:  []string{"eleven", "ocean"},
-			Write: []string{"brad", "pitt"},
-		},
-	}, {
-		User: "Julia Roberts",
-		Op:   audit.OpSetPerm,
-	}}
-
-	now := time.Now()
-	for _, e := range entries {
-		store.addAuditAtTime(e, now)
+	ids := []*router.ResolvedURL{
+		router.MustNewResolvedURL("~charmers/"+storetesting.SearchSeries[0]+"/wordpress-0", -1),
+		router.MustNewResolvedURL("~charmers/"+storetesting.SearchSeries[0]+"/mysql-0", -1),
 	}
-	data, err := ioutil.ReadFile(filename)
+	for _, id := range ids {
+		err := store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+		c.Assert(err, gc.Equals, nil)
+	}
+	err = store.SetPermsBatch([]*charm.URL{&ids[0].URL, &ids[1].URL}, "stable.read", []string{"everyone"}, "alice", nil)
 	c.Assert(err, gc.Equals, nil)
 
+	data, err := ioutil.ReadFile(filename)
+	c.Assert(err, gc.Equals, nil)
 	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
-	c.Assert(lines, gc.HasLen, len(entries))
-	for i, e := range entries {
-		e.Time = now
-		c.Assert(lines[i], jc.JSONEquals, e)
+	// Skip the entries recorded for the uploads.
+	c.Assert(lines, gc.HasLen, 2*len(ids))
+	lines = lines[len(ids):]
+	for i, id := range ids {
+		var e audit.Entry
+		err := json.Unmarshal([]byte(lines[i]), &e)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(e.User, gc.Equals, "alice")
+		c.Assert(e.Op, gc.Equals, audit.OpSetPerm)
+		c.Assert(e.Entity, jc.DeepEquals, mongodoc.BaseURL(&id.URL))
+		c.Assert(e.ACL, jc.DeepEquals, &audit.ACL{
+			Read: []string{"everyone"},
+		})
 	}
 }
 
-func (s *StoreSuite) TestAddAuditWithNoLumberjack(c *gc.C) {
-	p, err := NewPool(s.Session.DB("juju_test"), nil, nil, ServerParams{})
-	c.Assert(err, gc.Equals, nil)
-	defer p.Close()
-
-	store := p.Store()
-	defer store.Close()
-
-	// Check that it does not panic.
-	store.AddAudit(audit.Entry{
-		User:   "George Clooney",
-		Op:     audit.OpSetPerm,
-		Entity: charm.MustParseURL("cs:mycharm"),
-		ACL: &audit.ACL{
-			Read:  []string{"eleven", "ocean"},
-			Write: []string{"brad", "pitt"},
-		},
-	})
-}
-
 func (s *StoreSuite) TestDenormalizeEntity(c *gc.C) {
 	e := &mongodoc.Entity{
 		URL: charm.MustParseURL("~someone/utopic/acharm-45"),
@@ -3460,6 +6394,160 @@ func (s *StoreSuite) TestNewRevisionConcurrent(c *gc.C) {
 	c.Assert(got, jc.DeepEquals, expect)
 }
 
+var retryReadTests = []struct {
+	about          string
+	retryAttempts  int
+	errs           []error
+	expectAttempts int
+	expectError    string
+}{{
+	about:          "transient error succeeds on retry",
+	retryAttempts:  2,
+	errs:           []error{&mgo.QueryError{Code: 10107, Message: "not master"}},
+	expectAttempts: 2,
+}, {
+	about:         "transient errors exceed retry attempts",
+	retryAttempts: 2,
+	errs: []error{
+		io.EOF,
+		&mgo.QueryError{Code: 11602, Message: "operation was interrupted"},
+		&mgo.QueryError{Code: 10107, Message: "not master"},
+	},
+	expectAttempts: 3,
+	expectError:    "not master",
+}, {
+	about:          "permanent error is not retried",
+	retryAttempts:  2,
+	errs:           []error{&mgo.QueryError{Code: 2, Message: "bad value"}},
+	expectAttempts: 1,
+	expectError:    "bad value",
+}, {
+	about:          "retries disabled",
+	errs:           []error{io.EOF},
+	expectAttempts: 1,
+	expectError:    "EOF",
+}}
+
+func (s *StoreSuite) TestReadsRetryTransientErrors(c *gc.C) {
+	s.PatchValue(&mongoRetryDelay, time.Duration(0))
+	rurl := MustParseResolvedURL("cs:~charmers/" + storetesting.SearchSeries[0] + "/wordpress-5")
+	reads := []struct {
+		op   string
+		read func(store *Store) error
+	}{{
+		op: "FindEntity",
+		read: func(store *Store) error {
+			_, err := store.FindEntity(rurl, nil)
+			return err
+		},
+	}, {
+		op: "FindBestEntity",
+		read: func(store *Store) error {
+			_, err := store.FindBestEntity(&rurl.URL, params.UnpublishedChannel, nil)
+			return err
+		},
+	}, {
+		op: "FindBaseEntity",
+		read: func(store *Store) error {
+			_, err := store.FindBaseEntity(&rurl.URL, nil)
+			return err
+		},
+	}}
+	for i, test := range retryReadTests {
+		c.Logf("test %d: %s", i, test.about)
+		p, err := NewPool(s.Session.DB("juju_test"), nil, nil, ServerParams{
+			MongoRetryAttempts: test.retryAttempts,
+		})
+		c.Assert(err, gc.Equals, nil)
+		store := p.Store()
+		if i == 0 {
+			err := store.AddCharmWithArchive(rurl, storetesting.Charms.CharmDir("wordpress"))
+			c.Assert(err, gc.Equals, nil)
+		}
+		for _, read := range reads {
+			c.Logf("%s", read.op)
+			attempts := 0
+			s.PatchValue(TestMongoReadError, func(op string) error {
+				c.Check(op, gc.Equals, read.op)
+				attempts++
+				if attempts <= len(test.errs) {
+					return test.errs[attempts-1]
+				}
+				return nil
+			})
+			err := read.read(store)
+			if test.expectError != "" {
+				c.Assert(err, gc.ErrorMatches, test.expectError)
+			} else {
+				c.Assert(err, gc.Equals, nil)
+			}
+			c.Assert(attempts, gc.Equals, test.expectAttempts)
+		}
+		store.Close()
+		p.Close()
+	}
+}
+
+func (s *StoreSuite) TestNewPoolWithTooManyMongoRetryAttempts(c *gc.C) {
+	_, err := NewPool(s.Session.DB("juju_test"), nil, nil, ServerParams{
+		MongoRetryAttempts: maxMongoRetryAttempts + 1,
+	})
+	c.Assert(err, gc.ErrorMatches, `invalid mongo retry attempts 11`)
+}
+
+func (s *StoreSuite) TestNewRevisionRetriesAfterCollision(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	s.PatchValue(&newRevisionRetryDelay, time.Duration(0))
+	attempts := 0
+	s.PatchValue(TestNewRevisionCollision, func(id *charm.URL) bool {
+		c.Check(id.String(), gc.Equals, "cs:~charmers/wordpress")
+		attempts++
+		return attempts <= 3
+	})
+	rev, err := store.NewRevision(charm.MustParseURL("cs:~charmers/wordpress-5"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(rev, gc.Equals, 0)
+	c.Assert(attempts, gc.Equals, 4)
+}
+
+func (s *StoreSuite) TestNewRevisionMaxAttempts(c *gc.C) {
+	s.PatchValue(&newRevisionRetryDelay, time.Duration(0))
+	attempts := 0
+	s.PatchValue(TestNewRevisionCollision, func(id *charm.URL) bool {
+		attempts++
+		return true
+	})
+
+	// By default, NewRevision gives up after the default
+	// number of attempts.
+	store := s.newStore(c, false)
+	defer store.Close()
+	_, err := store.NewRevision(charm.MustParseURL("cs:~charmers/wordpress"))
+	c.Assert(err, gc.ErrorMatches, `cannot obtain new revision for cs:~charmers/wordpress: too many concurrent allocations after 10 attempts`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrServiceUnavailable)
+	c.Assert(attempts, gc.Equals, defaultNewRevisionMaxAttempts)
+
+	// The limit can be configured.
+	p, err := NewPool(s.Session.DB("juju_test"), nil, nil, ServerParams{
+		NewRevisionMaxAttempts: 3,
+	})
+	c.Assert(err, gc.Equals, nil)
+	defer p.Close()
+	store1 := p.Store()
+	defer store1.Close()
+	attempts = 0
+	_, err = store1.NewRevision(charm.MustParseURL("cs:~charmers/wordpress"))
+	c.Assert(err, gc.ErrorMatches, `cannot obtain new revision for cs:~charmers/wordpress: too many concurrent allocations after 3 attempts`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrServiceUnavailable)
+	c.Assert(attempts, gc.Equals, 3)
+
+	// No revision was allocated.
+	n, err := store1.DB.Revisions().Count()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 0)
+}
+
 func (s *StoreSuite) TestNewRevisionWithExistingSingleSeries(c *gc.C) {
 	store := s.newStore(c, true)
 	defer store.Close()
@@ -3534,6 +6622,78 @@ func (s *StoreSuite) TestAddRevisionWithExisting(c *gc.C) {
 	c.Assert(rev, gc.Equals, 5)
 }
 
+func (s *StoreSuite) TestSetRevisionBase(c *gc.C) {
+	store := s.newStore(c, true)
+	defer store.Close()
+	err := store.SetRevisionBase(charm.MustParseURL("cs:~bob/wordpress"), 100)
+	c.Assert(err, gc.Equals, nil)
+
+	id := charm.MustParseURL("~bob/" + storetesting.SearchSeries[0] + "/wordpress")
+	for i := 0; i < 3; i++ {
+		rev, err := store.NewRevision(id)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(rev, gc.Equals, 100+i)
+	}
+	// Multi-series revisions are allocated above the
+	// existing single-series ones.
+	rev, err := store.NewRevision(charm.MustParseURL("~bob/wordpress"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(rev, gc.Equals, 103)
+
+	// Other base URLs are unaffected.
+	rev, err = store.NewRevision(charm.MustParseURL("~alice/" + storetesting.SearchSeries[0] + "/wordpress"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(rev, gc.Equals, 0)
+}
+
+func (s *StoreSuite) TestSetRevisionBaseWithExistingRevisions(c *gc.C) {
+	store := s.newStore(c, true)
+	defer store.Close()
+	id := router.MustNewResolvedURL("~bob/"+storetesting.SearchSeries[0]+"/wordpress-3", -1)
+	err := store.AddRevision(id)
+	c.Assert(err, gc.Equals, nil)
+
+	err = store.SetRevisionBase(charm.MustParseURL("cs:~bob/wordpress"), 3)
+	c.Assert(err, gc.ErrorMatches, `revision base 3 is not greater than existing revision 3 of cs:~bob/`+storetesting.SearchSeries[0]+`/wordpress`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+
+	err = store.SetRevisionBase(charm.MustParseURL("cs:~bob/wordpress"), 50)
+	c.Assert(err, gc.Equals, nil)
+
+	// The existing id continues from the base.
+	rev, err := store.NewRevision(&id.URL)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(rev, gc.Equals, 50)
+	rev, err = store.NewRevision(&id.URL)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(rev, gc.Equals, 51)
+
+	// Adding an explicit revision below the base
+	// does not cause lower revisions to be allocated.
+	id2 := router.MustNewResolvedURL("~bob/quantal/wordpress-2", -1)
+	err = store.AddRevision(id2)
+	c.Assert(err, gc.Equals, nil)
+	rev, err = store.NewRevision(&id2.URL)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(rev, gc.Equals, 50)
+}
+
+func (s *StoreSuite) TestSetRevisionBaseErrors(c *gc.C) {
+	store := s.newStore(c, true)
+	defer store.Close()
+	err := store.SetRevisionBase(charm.MustParseURL("cs:~bob/wordpress-2"), 10)
+	c.Assert(err, gc.ErrorMatches, `"cs:~bob/wordpress-2" is not a base URL`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+
+	err = store.SetRevisionBase(charm.MustParseURL("cs:~bob/xenial/wordpress"), 10)
+	c.Assert(err, gc.ErrorMatches, `"cs:~bob/xenial/wordpress" is not a base URL`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+
+	err = store.SetRevisionBase(charm.MustParseURL("cs:~bob/wordpress"), -1)
+	c.Assert(err, gc.ErrorMatches, `invalid revision base -1`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+}
+
 var publishTests = []struct {
 	about              string
 	url                *router.ResolvedURL
@@ -4119,35 +7279,304 @@ var publishTests = []struct {
 func (s *StoreSuite) TestPublish(c *gc.C) {
 	store := s.newStore(c, true)
 	defer store.Close()
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	s.PatchValue(&timeNow, func() time.Time {
+		return now
+	})
 
 	for i, test := range publishTests {
 		c.Logf("test %d: %s", i, test.about)
 
-		// Remove existing entities and base entities.
-		_, err := store.DB.Entities().RemoveAll(nil)
+		// Remove existing entities and base entities.
+		_, err := store.DB.Entities().RemoveAll(nil)
+		c.Assert(err, gc.Equals, nil)
+		_, err = store.DB.BaseEntities().RemoveAll(nil)
+		c.Assert(err, gc.Equals, nil)
+		// Insert the existing entity.
+		err = store.DB.Entities().Insert(denormalizedEntity(test.initialEntity))
+		c.Assert(err, gc.Equals, nil)
+		// Insert the existing base entity.
+		err = store.DB.BaseEntities().Insert(test.initialBaseEntity)
+		c.Assert(err, gc.Equals, nil)
+
+		// Publish the entity.
+		err = store.Publish(test.url, nil, test.channels...)
+		if test.expectedErr != "" {
+			c.Assert(err, gc.ErrorMatches, test.expectedErr)
+			continue
+		}
+		c.Assert(err, gc.Equals, nil)
+		entity, err := store.FindEntity(test.url, nil)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(entity, jc.DeepEquals, denormalizedEntity(test.expectedEntity))
+		baseEntity, err := store.FindBaseEntity(&test.url.URL, nil)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(baseEntity.PublishHistory, jc.DeepEquals, expectedPublishHistory(test.expectedEntity, test.channels, now))
+		baseEntity.PublishHistory = nil
+		c.Assert(storetesting.NormalizeBaseEntity(baseEntity), jc.DeepEquals, storetesting.NormalizeBaseEntity(test.expectedBaseEntity))
+	}
+}
+
+// expectedPublishHistory returns the publish history expected after
+// publishing the given entity to the given channels at the given time.
+func expectedPublishHistory(entity *mongodoc.Entity, channels []params.Channel, t time.Time) []mongodoc.PublishHistoryEntry {
+	series := entity.SupportedSeries
+	if len(series) == 0 {
+		series = []string{entity.URL.Series}
+	}
+	var history []mongodoc.PublishHistoryEntry
+	for _, c := range channels {
+		if !params.ValidChannels[c] || c == params.UnpublishedChannel {
+			continue
+		}
+		for _, s := range series {
+			history = append(history, mongodoc.PublishHistoryEntry{
+				Channel: c,
+				Series:  s,
+				URL:     entity.URL,
+				Time:    t,
+			})
+		}
+	}
+	return history
+}
+
+func (s *StoreSuite) TestPublishHistoryIsCapped(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	s.PatchValue(&maxPublishHistory, 3)
+
+	var ids []*router.ResolvedURL
+	for i := 0; i < 5; i++ {
+		id := MustParseResolvedURL(fmt.Sprintf("~charmers/trusty/wordpress-%d", i))
+		err := store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
 		c.Assert(err, gc.Equals, nil)
-		_, err = store.DB.BaseEntities().RemoveAll(nil)
+		err = store.Publish(id, nil, params.StableChannel)
 		c.Assert(err, gc.Equals, nil)
-		// Insert the existing entity.
-		err = store.DB.Entities().Insert(denormalizedEntity(test.initialEntity))
+		ids = append(ids, id)
+	}
+	be, err := store.FindBaseEntity(charm.MustParseURL("~charmers/wordpress"), FieldSelector("publishhistory"))
+	c.Assert(err, gc.Equals, nil)
+	// Only the most recent entries are kept.
+	var urls []*charm.URL
+	for _, h := range be.PublishHistory {
+		urls = append(urls, h.URL)
+	}
+	c.Assert(urls, jc.DeepEquals, []*charm.URL{&ids[2].URL, &ids[3].URL, &ids[4].URL})
+}
+
+func (s *StoreSuite) TestFindBestEntityAt(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := t0
+	s.PatchValue(&timeNow, func() time.Time {
+		return now
+	})
+	publish := func(id string, t time.Time, channels ...params.Channel) {
+		now = t
+		err := store.Publish(MustParseResolvedURL(id), nil, channels...)
 		c.Assert(err, gc.Equals, nil)
-		// Insert the existing base entity.
-		err = store.DB.BaseEntities().Insert(test.initialBaseEntity)
+	}
+	for _, id := range []string{
+		"0 ~charmers/trusty/wordpress-0",
+		"1 ~charmers/trusty/wordpress-1",
+		"2 ~charmers/trusty/wordpress-2",
+	} {
+		err := store.AddCharmWithArchive(MustParseResolvedURL(id), storetesting.NewCharm(nil))
 		c.Assert(err, gc.Equals, nil)
+	}
+	err := store.AddCharmWithArchive(MustParseResolvedURL("3 ~charmers/wordpress-3"), storetesting.NewCharm(storetesting.MetaWithSupportedSeries(nil, "trusty", "xenial")))
+	c.Assert(err, gc.Equals, nil)
+	publish("0 ~charmers/trusty/wordpress-0", t0.Add(1*time.Hour), params.StableChannel, params.EdgeChannel)
+	publish("1 ~charmers/trusty/wordpress-1", t0.Add(2*time.Hour), params.EdgeChannel)
+	publish("1 ~charmers/trusty/wordpress-1", t0.Add(3*time.Hour), params.StableChannel)
+	publish("2 ~charmers/trusty/wordpress-2", t0.Add(4*time.Hour), params.EdgeChannel)
+	publish("3 ~charmers/wordpress-3", t0.Add(5*time.Hour), params.StableChannel)
 
-		// Publish the entity.
-		err = store.Publish(test.url, nil, test.channels...)
-		if test.expectedErr != "" {
-			c.Assert(err, gc.ErrorMatches, test.expectedErr)
+	tests := []struct {
+		url         string
+		channel     params.Channel
+		at          time.Time
+		expectURL   string
+		expectError string
+	}{{
+		url:         "~charmers/wordpress",
+		channel:     params.StableChannel,
+		at:          t0,
+		expectError: `no matching charm or bundle for cs:~charmers/wordpress in stable channel at 2020-01-01T00:00:00Z`,
+	}, {
+		url:       "~charmers/wordpress",
+		channel:   params.StableChannel,
+		at:        t0.Add(time.Hour),
+		expectURL: "cs:~charmers/trusty/wordpress-0",
+	}, {
+		url:       "~charmers/wordpress",
+		channel:   params.StableChannel,
+		at:        t0.Add(150 * time.Minute),
+		expectURL: "cs:~charmers/trusty/wordpress-0",
+	}, {
+		url:       "~charmers/wordpress",
+		channel:   params.EdgeChannel,
+		at:        t0.Add(150 * time.Minute),
+		expectURL: "cs:~charmers/trusty/wordpress-1",
+	}, {
+		url:       "~charmers/wordpress",
+		channel:   params.StableChannel,
+		at:        t0.Add(3 * time.Hour),
+		expectURL: "cs:~charmers/trusty/wordpress-1",
+	}, {
+		url:       "~charmers/wordpress",
+		channel:   params.NoChannel,
+		at:        t0.Add(4 * time.Hour),
+		expectURL: "cs:~charmers/trusty/wordpress-1",
+	}, {
+		url:       "~charmers/wordpress",
+		channel:   params.StableChannel,
+		at:        t0.Add(6 * time.Hour),
+		expectURL: "cs:~charmers/wordpress-3",
+	}, {
+		url:       "~charmers/trusty/wordpress",
+		channel:   params.StableChannel,
+		at:        t0.Add(6 * time.Hour),
+		expectURL: "cs:~charmers/wordpress-3",
+	}, {
+		url:         "~charmers/xenial/wordpress",
+		channel:     params.StableChannel,
+		at:          t0.Add(4 * time.Hour),
+		expectError: `no matching charm or bundle for cs:~charmers/xenial/wordpress in stable channel at 2020-01-01T04:00:00Z`,
+	}, {
+		url:       "~charmers/xenial/wordpress",
+		channel:   params.StableChannel,
+		at:        t0.Add(5 * time.Hour),
+		expectURL: "cs:~charmers/wordpress-3",
+	}, {
+		url:       "wordpress",
+		channel:   params.StableChannel,
+		at:        t0.Add(3 * time.Hour),
+		expectURL: "cs:~charmers/trusty/wordpress-1",
+	}, {
+		url:       "~charmers/trusty/wordpress-2",
+		channel:   params.EdgeChannel,
+		at:        t0,
+		expectURL: "cs:~charmers/trusty/wordpress-2",
+	}, {
+		url:       "~charmers/wordpress",
+		channel:   params.StableChannel,
+		expectURL: "cs:~charmers/wordpress-3",
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: %s %s at %v", i, test.url, test.channel, test.at)
+		entity, err := store.FindBestEntityAt(charm.MustParseURL(test.url), test.channel, test.at, FieldSelector("_id"))
+		if test.expectError != "" {
+			c.Assert(err, gc.ErrorMatches, test.expectError)
+			c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
 			continue
 		}
 		c.Assert(err, gc.Equals, nil)
-		entity, err := store.FindEntity(test.url, nil)
+		c.Assert(entity.URL.String(), gc.Equals, test.expectURL)
+	}
+}
+
+func (s *StoreSuite) TestFindBestEntityForArch(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	addCharm := func(id string, archs ...charm.Architecture) {
+		err := store.AddCharmWithArchive(MustParseResolvedURL(id), storetesting.NewCharm(&charm.Meta{
+			Architectures: archs,
+		}))
 		c.Assert(err, gc.Equals, nil)
-		c.Assert(entity, jc.DeepEquals, denormalizedEntity(test.expectedEntity))
-		baseEntity, err := store.FindBaseEntity(&test.url.URL, nil)
+	}
+	addCharm("~charmers/focal/wordpress-0", "amd64", "arm64")
+	addCharm("~charmers/bionic/wordpress-1", "s390x")
+	addCharm("~charmers/xenial/wordpress-2")
+	addCharm("~charmers/focal/wordpress-3", "ppc64el")
+	for _, id := range []string{
+		"~charmers/focal/wordpress-0",
+		"~charmers/bionic/wordpress-1",
+	} {
+		err := store.Publish(MustParseResolvedURL(id), nil, params.StableChannel)
 		c.Assert(err, gc.Equals, nil)
-		c.Assert(storetesting.NormalizeBaseEntity(baseEntity), jc.DeepEquals, storetesting.NormalizeBaseEntity(test.expectedBaseEntity))
+	}
+	err := store.Publish(MustParseResolvedURL("~charmers/xenial/wordpress-2"), nil, params.EdgeChannel)
+	c.Assert(err, gc.Equals, nil)
+
+	// The architectures are stored on the entity.
+	entity, err := store.FindEntity(MustParseResolvedURL("~charmers/focal/wordpress-0"), FieldSelector("architectures"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entity.Architectures, jc.DeepEquals, []string{"amd64", "arm64"})
+	entity, err = store.FindEntity(MustParseResolvedURL("~charmers/xenial/wordpress-2"), FieldSelector("architectures"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entity.Architectures, gc.HasLen, 0)
+
+	tests := []struct {
+		url         string
+		channel     params.Channel
+		arch        string
+		expectURL   string
+		expectError string
+	}{{
+		url:       "~charmers/wordpress",
+		channel:   params.StableChannel,
+		expectURL: "cs:~charmers/focal/wordpress-0",
+	}, {
+		url:       "~charmers/wordpress",
+		channel:   params.StableChannel,
+		arch:      "arm64",
+		expectURL: "cs:~charmers/focal/wordpress-0",
+	}, {
+		url:       "~charmers/wordpress",
+		channel:   params.StableChannel,
+		arch:      "s390x",
+		expectURL: "cs:~charmers/bionic/wordpress-1",
+	}, {
+		url:         "~charmers/focal/wordpress",
+		channel:     params.StableChannel,
+		arch:        "s390x",
+		expectError: `no matching charm or bundle for cs:~charmers/focal/wordpress with architecture "s390x"`,
+	}, {
+		url:         "~charmers/wordpress",
+		channel:     params.StableChannel,
+		arch:        "ppc64el",
+		expectError: `no matching charm or bundle for cs:~charmers/wordpress with architecture "ppc64el"`,
+	}, {
+		url:       "~charmers/wordpress",
+		channel:   params.EdgeChannel,
+		arch:      "ppc64el",
+		expectURL: "cs:~charmers/xenial/wordpress-2",
+	}, {
+		url:       "~charmers/wordpress",
+		channel:   params.UnpublishedChannel,
+		arch:      "ppc64el",
+		expectURL: "cs:~charmers/focal/wordpress-3",
+	}, {
+		url:       "~charmers/wordpress",
+		channel:   params.UnpublishedChannel,
+		arch:      "s390x",
+		expectURL: "cs:~charmers/bionic/wordpress-1",
+	}, {
+		url:         "~charmers/focal/wordpress",
+		channel:     params.UnpublishedChannel,
+		arch:        "s390x",
+		expectError: `no matching charm or bundle for cs:~charmers/focal/wordpress with architecture "s390x"`,
+	}, {
+		url:       "~charmers/focal/wordpress-0",
+		channel:   params.StableChannel,
+		arch:      "s390x",
+		expectURL: "cs:~charmers/focal/wordpress-0",
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: %s %s arch %q", i, test.url, test.channel, test.arch)
+		entity, err := store.FindBestEntityForArch(charm.MustParseURL(test.url), test.channel, time.Time{}, test.arch, FieldSelector("_id"))
+		if test.expectError != "" {
+			c.Assert(err, gc.ErrorMatches, test.expectError)
+			c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+			continue
+		}
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(entity.URL.String(), gc.Equals, test.expectURL)
 	}
 }
 
@@ -4169,6 +7598,330 @@ func (s *StoreSuite) TestPublishWithFailedESInsert(c *gc.C) {
 	c.Assert(err, gc.ErrorMatches, "cannot index cs:~charmers/"+storetesting.SearchSeries[0]+"/wordpress-12 to ElasticSearch: .*")
 }
 
+func (s *StoreSuite) TestPublishAutoPromulgates(c *gc.C) {
+	store := s.newAutoPromulgateStore(c, "charmers")
+	defer store.Close()
+	series := storetesting.SearchSeries[0]
+	url := router.MustNewResolvedURL("~charmers/"+series+"/wordpress-1", -1)
+	err := store.AddCharmWithArchive(url, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+
+	// Publishing to edge does not promulgate.
+	err = store.Publish(url, nil, params.EdgeChannel)
+	c.Assert(err, gc.Equals, nil)
+	s.assertPromulgated(c, store, "~charmers/wordpress", false)
+
+	// The first publish to stable does, and records the publisher
+	// in the audit log.
+	err = store.PublishAs("alice", url, nil, false, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	s.assertPromulgated(c, store, "~charmers/wordpress", true)
+	entity, err := store.FindEntity(url, FieldSelector("promulgated-url"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entity.PromulgatedURL, jc.DeepEquals, charm.MustParseURL("cs:"+series+"/wordpress-0"))
+
+	// Publishing again does not promulgate again.
+	err = store.Publish(url, nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	entries, err := store.EntityAuditHistory(&url.URL, 0)
+	c.Assert(err, gc.Equals, nil)
+	var promulgations []audit.Entry
+	for _, e := range entries {
+		if e.Op == audit.OpPromulgate {
+			e.Time = time.Time{}
+			promulgations = append(promulgations, e)
+		}
+	}
+	c.Assert(promulgations, jc.DeepEquals, []audit.Entry{{
+		User:   "alice",
+		Op:     audit.OpPromulgate,
+		Entity: &url.URL,
+	}})
+
+	// Charms owned by other users are not promulgated.
+	other := router.MustNewResolvedURL("~bob/"+series+"/mysql-1", -1)
+	err = store.AddCharmWithArchive(other, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	err = store.Publish(other, nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	s.assertPromulgated(c, store, "~bob/mysql", false)
+}
+
+func (s *StoreSuite) TestPublishAutoPromulgateConflict(c *gc.C) {
+	store := s.newAutoPromulgateStore(c, "charmers")
+	defer store.Close()
+	series := storetesting.SearchSeries[0]
+
+	// Another user already holds the promulgated name.
+	bobURL := router.MustNewResolvedURL("~bob/"+series+"/wordpress-1", -1)
+	err := store.AddCharmWithArchive(bobURL, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	err = store.SetPromulgated(bobURL, true)
+	c.Assert(err, gc.Equals, nil)
+
+	url := router.MustNewResolvedURL("~charmers/"+series+"/wordpress-1", -1)
+	err = store.AddCharmWithArchive(url, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	err = store.Publish(url, nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	s.assertPromulgated(c, store, "~bob/wordpress", true)
+	s.assertPromulgated(c, store, "~charmers/wordpress", false)
+	entity, err := store.FindEntity(url, FieldSelector("promulgated-url"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entity.PromulgatedURL, gc.IsNil)
+}
+
+func (s *StoreSuite) TestBulkPublish(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	wordpress0 := router.MustNewResolvedURL("~charmers/precise/wordpress-0", -1)
+	wordpress1 := router.MustNewResolvedURL("~charmers/precise/wordpress-1", -1)
+	mysql0 := router.MustNewResolvedURL("~charmers/precise/mysql-0", -1)
+	for _, url := range []*router.ResolvedURL{wordpress0, wordpress1, mysql0} {
+		err := store.AddCharmWithArchive(url, storetesting.NewCharm(nil))
+		c.Assert(err, gc.Equals, nil)
+	}
+	err := store.Publish(wordpress0, nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+
+	err = store.BulkPublish([]PublishRequest{{
+		Id:       wordpress1,
+		Channels: []params.Channel{params.StableChannel},
+	}, {
+		Id:       mysql0,
+		Channels: []params.Channel{params.StableChannel, params.EdgeChannel},
+	}})
+	c.Assert(err, gc.Equals, nil)
+
+	for _, test := range []struct {
+		id      string
+		channel params.Channel
+		expect  *router.ResolvedURL
+	}{
+		{"~charmers/precise/wordpress", params.StableChannel, wordpress1},
+		{"~charmers/precise/mysql", params.StableChannel, mysql0},
+		{"~charmers/precise/mysql", params.EdgeChannel, mysql0},
+	} {
+		entity, err := store.FindBestEntity(charm.MustParseURL(test.id), test.channel, nil)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(entity.URL, jc.DeepEquals, &test.expect.URL)
+	}
+	baseEntity, err := store.FindBaseEntity(&wordpress1.URL, FieldSelector("publishhistory"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(baseEntity.PublishHistory, gc.HasLen, 2)
+	c.Assert(baseEntity.PublishHistory[1].URL, jc.DeepEquals, &wordpress1.URL)
+}
+
+func (s *StoreSuite) TestBulkPublishInvalidEntry(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	wordpress0 := router.MustNewResolvedURL("~charmers/precise/wordpress-0", -1)
+	wordpress1 := router.MustNewResolvedURL("~charmers/precise/wordpress-1", -1)
+	for _, url := range []*router.ResolvedURL{wordpress0, wordpress1} {
+		err := store.AddCharmWithArchive(url, storetesting.NewCharm(nil))
+		c.Assert(err, gc.Equals, nil)
+	}
+	err := store.Publish(wordpress0, nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+
+	err = store.BulkPublish([]PublishRequest{{
+		Id:       wordpress1,
+		Channels: []params.Channel{params.StableChannel},
+	}, {
+		Id:       router.MustNewResolvedURL("~charmers/precise/mysql-0", -1),
+		Channels: []params.Channel{params.StableChannel},
+	}})
+	c.Assert(err, gc.ErrorMatches, `cannot publish cs:~charmers/precise/mysql-0: entity not found`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+
+	// Nothing has been published.
+	entity, err := store.FindBestEntity(charm.MustParseURL("~charmers/precise/wordpress"), params.StableChannel, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entity.URL, jc.DeepEquals, &wordpress0.URL)
+	entity, err = store.FindEntity(wordpress1, FieldSelector("published"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entity.Published, gc.HasLen, 0)
+}
+
+func (s *StoreSuite) TestBulkPublishRollback(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	wordpress0 := router.MustNewResolvedURL("~charmers/precise/wordpress-0", -1)
+	wordpress1 := router.MustNewResolvedURL("~charmers/precise/wordpress-1", -1)
+	mysql0 := router.MustNewResolvedURL("~charmers/precise/mysql-0", -1)
+	for _, url := range []*router.ResolvedURL{wordpress0, wordpress1, mysql0} {
+		err := store.AddCharmWithArchive(url, storetesting.NewCharm(nil))
+		c.Assert(err, gc.Equals, nil)
+	}
+	err := store.Publish(wordpress0, nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	err = store.YankRevision(wordpress0, params.StableChannel, "bob")
+	c.Assert(err, gc.Equals, nil)
+	err = store.Publish(wordpress1, nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+
+	getState := func() ([]*mongodoc.Entity, []*mongodoc.BaseEntity) {
+		var entities []*mongodoc.Entity
+		for _, url := range []*router.ResolvedURL{wordpress0, wordpress1, mysql0} {
+			entity, err := store.FindEntity(url, FieldSelector("published", "yanked"))
+			c.Assert(err, gc.Equals, nil)
+			entities = append(entities, normalizePublishState(entity))
+		}
+		var baseEntities []*mongodoc.BaseEntity
+		for _, url := range []*router.ResolvedURL{wordpress0, mysql0} {
+			baseEntity, err := store.FindBaseEntity(&url.URL, FieldSelector("channelentities", "channelresources", "publishhistory"))
+			c.Assert(err, gc.Equals, nil)
+			baseEntities = append(baseEntities, normalizeChannelState(baseEntity))
+		}
+		return entities, baseEntities
+	}
+	entities, baseEntities := getState()
+
+	// Simulate a failure after all the updates have been applied.
+	var ops []*publishOp
+	for _, url := range []*router.ResolvedURL{wordpress0, mysql0} {
+		op, err := store.preparePublish(url, nil, false, []params.Channel{params.StableChannel, params.EdgeChannel})
+		c.Assert(err, gc.Equals, nil)
+		ops = append(ops, op)
+	}
+	var saved bulkPublishState
+	err = saved.save(store, ops)
+	c.Assert(err, gc.Equals, nil)
+	err = store.applyBulkPublish(ops, &saved)
+	c.Assert(err, gc.Equals, nil)
+	entity, err := store.FindBestEntity(charm.MustParseURL("~charmers/precise/mysql"), params.EdgeChannel, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entity.URL, jc.DeepEquals, &mysql0.URL)
+
+	err = saved.restore(store)
+	c.Assert(err, gc.Equals, nil)
+	gotEntities, gotBaseEntities := getState()
+	c.Assert(gotEntities, jc.DeepEquals, entities)
+	c.Assert(gotBaseEntities, jc.DeepEquals, baseEntities)
+
+	// The restored base entities can still be published to.
+	err = store.Publish(mysql0, nil, params.EdgeChannel)
+	c.Assert(err, gc.Equals, nil)
+}
+
+func (s *StoreSuite) TestBulkPublishRollbackKeepsConcurrentChanges(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	wordpress0 := router.MustNewResolvedURL("~charmers/precise/wordpress-0", -1)
+	wordpress1 := router.MustNewResolvedURL("~charmers/precise/wordpress-1", -1)
+	for _, url := range []*router.ResolvedURL{wordpress0, wordpress1} {
+		err := store.AddCharmWithArchive(url, storetesting.NewCharm(nil))
+		c.Assert(err, gc.Equals, nil)
+	}
+	op, err := store.preparePublish(wordpress0, nil, false, []params.Channel{params.StableChannel, params.EdgeChannel})
+	c.Assert(err, gc.Equals, nil)
+	ops := []*publishOp{op}
+	var saved bulkPublishState
+	err = saved.save(store, ops)
+	c.Assert(err, gc.Equals, nil)
+	err = store.applyBulkPublish(ops, &saved)
+	c.Assert(err, gc.Equals, nil)
+
+	// Another revision is published to the edge channel before the
+	// bulk publish is rolled back.
+	err = store.Publish(wordpress1, nil, params.EdgeChannel)
+	c.Assert(err, gc.Equals, nil)
+
+	err = saved.restore(store)
+	c.Assert(err, gc.Equals, nil)
+	entity, err := store.FindBestEntity(charm.MustParseURL("~charmers/precise/wordpress"), params.EdgeChannel, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entity.URL, jc.DeepEquals, &wordpress1.URL)
+	_, err = store.FindBestEntity(charm.MustParseURL("~charmers/precise/wordpress"), params.StableChannel, nil)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	baseEntity, err := store.FindBaseEntity(&wordpress0.URL, FieldSelector("publishhistory"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(baseEntity.PublishHistory, gc.HasLen, 1)
+	c.Assert(baseEntity.PublishHistory[0].URL, jc.DeepEquals, &wordpress1.URL)
+}
+
+func (s *StoreSuite) TestBulkPublishConcurrentChange(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	wordpress0 := router.MustNewResolvedURL("~charmers/precise/wordpress-0", -1)
+	wordpress1 := router.MustNewResolvedURL("~charmers/precise/wordpress-1", -1)
+	for _, url := range []*router.ResolvedURL{wordpress0, wordpress1} {
+		err := store.AddCharmWithArchive(url, storetesting.NewCharm(nil))
+		c.Assert(err, gc.Equals, nil)
+	}
+	op, err := store.preparePublish(wordpress0, nil, false, []params.Channel{params.StableChannel})
+	c.Assert(err, gc.Equals, nil)
+	ops := []*publishOp{op}
+	var saved bulkPublishState
+	err = saved.save(store, ops)
+	c.Assert(err, gc.Equals, nil)
+
+	// The channel is changed after the bulk publish has been checked.
+	err = store.Publish(wordpress1, nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+
+	err = store.applyBulkPublish(ops, &saved)
+	c.Assert(err, gc.ErrorMatches, `cannot update base entity for "cs:~charmers/wordpress": channels changed concurrently`)
+	err = saved.restore(store)
+	c.Assert(err, gc.Equals, nil)
+	entity, err := store.FindBestEntity(charm.MustParseURL("~charmers/precise/wordpress"), params.StableChannel, FieldSelector("published"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entity.URL, jc.DeepEquals, &wordpress1.URL)
+	entity, err = store.FindEntity(wordpress0, FieldSelector("published"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entity.Published[params.StableChannel], gc.Equals, false)
+}
+
+// normalizePublishState removes the empty maps left in the given
+// entity when all the channels are removed from its publishing state.
+func normalizePublishState(e *mongodoc.Entity) *mongodoc.Entity {
+	if len(e.Published) == 0 {
+		e.Published = nil
+	}
+	if len(e.Yanked) == 0 {
+		e.Yanked = nil
+	}
+	return e
+}
+
+// normalizeChannelState removes the empty maps left in the given base
+// entity when all the series are removed from its channels.
+func normalizeChannelState(e *mongodoc.BaseEntity) *mongodoc.BaseEntity {
+	for ch, heads := range e.ChannelEntities {
+		if len(heads) == 0 {
+			delete(e.ChannelEntities, ch)
+		}
+	}
+	if len(e.ChannelEntities) == 0 {
+		e.ChannelEntities = nil
+	}
+	if len(e.ChannelResources) == 0 {
+		e.ChannelResources = nil
+	}
+	return e
+}
+
+func (s *StoreSuite) newAutoPromulgateStore(c *gc.C, users ...string) *Store {
+	p, err := NewPool(s.Session.DB("juju_test"), nil, nil, ServerParams{
+		AutoPromulgateUsers: users,
+	})
+	c.Assert(err, gc.Equals, nil)
+	store := p.Store()
+	defer p.Close()
+	return store
+}
+
+func (s *StoreSuite) assertPromulgated(c *gc.C, store *Store, id string, promulgated bool) {
+	baseEntity, err := store.FindBaseEntity(charm.MustParseURL(id), FieldSelector("promulgated"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(bool(baseEntity.Promulgated), gc.Equals, promulgated, gc.Commentf("%s", id))
+}
+
 func (s *StoreSuite) TestDeleteEntity(c *gc.C) {
 	store := s.newStore(c, false)
 	defer store.Close()
@@ -4188,7 +7941,7 @@ func (s *StoreSuite) TestDeleteEntity(c *gc.C) {
 	entity, err := store.FindEntity(url, nil)
 	c.Assert(err, gc.Equals, nil)
 
-	err = store.DeleteEntity(url)
+	err = store.DeleteEntity(url, "charmers")
 	c.Assert(err, gc.Equals, nil)
 
 	_, err = store.FindEntity(url, nil)
@@ -4216,7 +7969,7 @@ func (s *StoreSuite) TestDeleteEntityWithOnlyOneRevision(c *gc.C) {
 	}))
 	c.Assert(err, gc.Equals, nil)
 
-	err = store.DeleteEntity(url)
+	err = store.DeleteEntity(url, "charmers")
 	c.Assert(err, gc.ErrorMatches, `cannot delete last revision of charm or bundle`)
 }
 
@@ -4237,7 +7990,7 @@ func (s *StoreSuite) TestDeleteEntityWithPublishedRevision(c *gc.C) {
 	}))
 	c.Assert(err, gc.Equals, nil)
 
-	err = store.DeleteEntity(url)
+	err = store.DeleteEntity(url, "charmers")
 	c.Assert(err, gc.ErrorMatches, `cannot delete "cs:~charmers/`+storetesting.SearchSeries[0]+`/wordpress-12" because it is the current revision in channels \[beta edge\]`)
 
 	// Check that it really hasn't been deleted.
@@ -4338,7 +8091,7 @@ func (s *StoreSuite) TestGC(c *gc.C) {
 	}
 
 	// Then remove an entity and a resource.
-	err = store.DeleteEntity(id1)
+	err = store.DeleteEntity(id1, "charmers")
 	c.Assert(err, gc.Equals, nil)
 	err = store.DB.Resources().Remove(bson.D{{
 		"baseurl", resource2.BaseURL,
@@ -4366,6 +8119,74 @@ func (s *StoreSuite) TestGC(c *gc.C) {
 	}
 }
 
+func (s *StoreSuite) TestBlobInvalidator(c *gc.C) {
+	invalidated := make(chan string, 10)
+	p, err := NewPool(s.Session.DB("juju_test"), nil, nil, ServerParams{
+		BlobInvalidator: func(hash string) {
+			invalidated <- hash
+		},
+	})
+	c.Assert(err, gc.Equals, nil)
+	defer p.Close()
+	store := p.Store()
+	defer store.Close()
+
+	id1 := router.MustNewResolvedURL("~charmers/"+storetesting.SearchSeries[0]+"/wordpress-1", -1)
+	err = store.AddCharmWithArchive(id1, storetesting.NewCharm(&charm.Meta{
+		Summary: "charm that will be deleted",
+		Series:  []string{storetesting.SearchSeries[0], storetesting.SearchSeries[1]},
+	}))
+	c.Assert(err, gc.Equals, nil)
+	id2 := router.MustNewResolvedURL("~charmers/"+storetesting.SearchSeries[0]+"/wordpress-2", -1)
+	err = store.AddCharmWithArchive(id2, storetesting.NewCharm(&charm.Meta{
+		Summary: "charm that will not be deleted",
+		Series:  []string{storetesting.SearchSeries[0], storetesting.SearchSeries[1]},
+	}))
+	c.Assert(err, gc.Equals, nil)
+	entity, err := store.FindEntity(id1, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entity.PreV5BlobExtraHash, gc.Not(gc.Equals), "")
+
+	// Deleting the entity invalidates the hashes that
+	// its archives were served with.
+	err = store.DeleteEntity(id1, "charmers")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(receiveHashes(c, invalidated, 2), jc.DeepEquals, map[string]bool{
+		entity.BlobHash:      true,
+		entity.PreV5BlobHash: true,
+	})
+
+	// Garbage collection invalidates the blobs it removes.
+	err = store.BlobStoreGC(time.Now())
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(receiveHashes(c, invalidated, 2), jc.DeepEquals, map[string]bool{
+		entity.BlobHash:           true,
+		entity.PreV5BlobExtraHash: true,
+	})
+
+	// Nothing else is invalidated.
+	select {
+	case hash := <-invalidated:
+		c.Fatalf("unexpected invalidation of %q", hash)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// receiveHashes receives n hashes from the given channel
+// and returns them as a set.
+func receiveHashes(c *gc.C, hashc <-chan string, n int) map[string]bool {
+	hashes := make(map[string]bool)
+	for i := 0; i < n; i++ {
+		select {
+		case hash := <-hashc:
+			hashes[hash] = true
+		case <-time.After(5 * time.Second):
+			c.Fatalf("timed out waiting for blob invalidation")
+		}
+	}
+	return hashes
+}
+
 func urlStrings(urls []*charm.URL) []string {
 	urlStrs := make([]string, len(urls))
 	for i, url := range urls {
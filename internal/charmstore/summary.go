@@ -0,0 +1,104 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5/internal/charmstore"
+
+import (
+	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// StoreSummary holds totals across the whole charm store.
+type StoreSummary struct {
+	// Charms holds the number of charm revisions.
+	Charms int64
+
+	// Bundles holds the number of bundle revisions.
+	Bundles int64
+
+	// Resources holds the number of resource revisions.
+	Resources int64
+
+	// BlobBytes holds the total size of the distinct entity
+	// archives and resource blobs held in the blob store.
+	BlobBytes int64
+}
+
+// storeSummaryCacheKey holds the key used to cache the store summary
+// in the stats cache. It cannot be confused with an entity id.
+const storeSummaryCacheKey = "store-summary"
+
+// StoreSummary returns totals across the whole charm store. The result
+// is cached for ServerParams.StatsCacheMaxAge, so it may not reflect
+// recent changes.
+func (s *Store) StoreSummary() (StoreSummary, error) {
+	v, err := s.pool.statsCache.Get(storeSummaryCacheKey, func() (interface{}, error) {
+		return s.storeSummary()
+	})
+	if err != nil {
+		return StoreSummary{}, errgo.Mask(err)
+	}
+	return v.(StoreSummary), nil
+}
+
+// storeSummary calculates the totals returned by StoreSummary.
+func (s *Store) storeSummary() (StoreSummary, error) {
+	var summary StoreSummary
+	// Group the entities by blob first so that archives shared
+	// between entities are only counted once.
+	var entityTotals []struct {
+		Bundle bool  `bson:"_id"`
+		N      int64 `bson:"n"`
+		Size   int64 `bson:"size"`
+	}
+	if err := s.DB.Entities().Pipe([]bson.D{{
+		{"$group", bson.D{
+			{"_id", "$blobhash"},
+			{"bundle", bson.D{{"$first", bson.D{{"$eq", []interface{}{"$series", "bundle"}}}}}},
+			{"n", bson.D{{"$sum", 1}}},
+			{"size", bson.D{{"$first", "$size"}}},
+		}},
+	}, {
+		{"$group", bson.D{
+			{"_id", "$bundle"},
+			{"n", bson.D{{"$sum", "$n"}}},
+			{"size", bson.D{{"$sum", "$size"}}},
+		}},
+	}}).All(&entityTotals); err != nil {
+		return StoreSummary{}, errgo.Notef(err, "cannot count entities")
+	}
+	for _, t := range entityTotals {
+		if t.Bundle {
+			summary.Bundles += t.N
+		} else {
+			summary.Charms += t.N
+		}
+		summary.BlobBytes += t.Size
+	}
+	// Docker resources have no blob, so they do not contribute
+	// to the size.
+	var resourceTotals []struct {
+		N    int64 `bson:"n"`
+		Size int64 `bson:"size"`
+	}
+	if err := s.DB.Resources().Pipe([]bson.D{{
+		{"$group", bson.D{
+			{"_id", "$blobhash"},
+			{"n", bson.D{{"$sum", 1}}},
+			{"size", bson.D{{"$first", "$size"}}},
+		}},
+	}, {
+		{"$group", bson.D{
+			{"_id", nil},
+			{"n", bson.D{{"$sum", "$n"}}},
+			{"size", bson.D{{"$sum", "$size"}}},
+		}},
+	}}).All(&resourceTotals); err != nil {
+		return StoreSummary{}, errgo.Notef(err, "cannot count resources")
+	}
+	for _, t := range resourceTotals {
+		summary.Resources += t.N
+		summary.BlobBytes += t.Size
+	}
+	return summary, nil
+}
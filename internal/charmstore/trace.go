@@ -0,0 +1,72 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5/internal/charmstore"
+
+import (
+	"time"
+
+	"github.com/juju/loggo"
+)
+
+// traceLogger is the logger that trace spans are written to. Tracing
+// is only enabled when it is logging at DEBUG level.
+var traceLogger = loggo.GetLogger("charmstore.trace")
+
+// TracingEnabled reports whether trace spans will be logged. It can be
+// used to avoid creating a Tracer when it would not be used.
+func TracingEnabled() bool {
+	return traceLogger.IsDebugEnabled()
+}
+
+// Tracer holds the request-scoped state used to trace store
+// operations.
+type Tracer struct {
+	// RequestId holds the id of the request being traced. It is
+	// included in every span logged.
+	RequestId string
+}
+
+// SetTracer sets the tracer used to trace operations on the store. If
+// t is nil, tracing is disabled. The tracer is inherited by copies of
+// the store and is cleared when the store is closed.
+func (s *Store) SetTracer(t *Tracer) {
+	s.tracer = t
+}
+
+// span holds a single traced operation. A nil *span is valid and
+// records nothing.
+type span struct {
+	tracer     *Tracer
+	op         string
+	collection string
+	start      time.Time
+}
+
+// startSpan starts a span tracing the given operation on the given
+// collection. It returns nil if tracing is disabled, so the cost of an
+// untraced operation is a single check.
+func (s *Store) startSpan(op, collection string) *span {
+	if s.tracer == nil || !traceLogger.IsDebugEnabled() {
+		return nil
+	}
+	return &span{
+		tracer:     s.tracer,
+		op:         op,
+		collection: collection,
+		start:      time.Now(),
+	}
+}
+
+// done logs the span, recording the outcome of the operation as
+// determined by err.
+func (sp *span) done(err error) {
+	if sp == nil {
+		return
+	}
+	outcome := "ok"
+	if err != nil {
+		outcome = "error"
+	}
+	traceLogger.Debugf("request=%s op=%s collection=%s duration=%v outcome=%s", sp.tracer.RequestId, sp.op, sp.collection, time.Since(sp.start), outcome)
+}
@@ -0,0 +1,147 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5/internal/charmstore"
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/juju/charmstore.v5/internal/charm"
+)
+
+// webhookAttempts holds the maximum number of times delivery of an
+// ingestion error notification is attempted.
+var webhookAttempts = 5
+
+// webhookRetryDelay holds the time to wait before the first retry of a
+// failed notification. The delay doubles after each further failure.
+var webhookRetryDelay = time.Second
+
+// webhookQueueSize holds the maximum number of ingestion error
+// notifications waiting to be delivered. Notifications are dropped
+// while the queue is full. It is defined as a variable so that it can
+// be overridden in tests.
+var webhookQueueSize = 100
+
+// webhookClient holds the HTTP client used to deliver notifications.
+var webhookClient = &http.Client{
+	Timeout: 30 * time.Second,
+}
+
+// IngestionErrorNotification holds the JSON payload POSTed to the
+// configured IngestionErrorWebhook for each error-level ingestion log
+// entry.
+type IngestionErrorNotification struct {
+	// Data holds the JSON-encoded log message.
+	Data json.RawMessage `json:"data"`
+
+	// URLs holds the entity URLs associated with the log message.
+	URLs []*charm.URL `json:"urls,omitempty"`
+
+	// Time holds the time the log entry was added.
+	Time time.Time `json:"time"`
+}
+
+// notifyIngestionError queues the given notification for delivery to
+// the configured IngestionErrorWebhook, if any. It does not wait for
+// the notification to be delivered. If the queue is full, the
+// notification is dropped.
+func (p *Pool) notifyIngestionError(n *IngestionErrorNotification) {
+	if p.webhookC == nil {
+		return
+	}
+	select {
+	case p.webhookC <- n:
+	default:
+		logger.Errorf("dropping ingestion error notification: too many notifications waiting to be delivered")
+	}
+}
+
+// startWebhookWorker starts the goroutine that delivers the
+// notifications queued by notifyIngestionError, if an
+// IngestionErrorWebhook is configured.
+func (p *Pool) startWebhookWorker() {
+	if p.config.IngestionErrorWebhook == "" {
+		return
+	}
+	p.webhookC = make(chan *IngestionErrorNotification, webhookQueueSize)
+	p.webhookDone = make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	p.webhookCancel = cancel
+	go func() {
+		defer close(p.webhookDone)
+		for {
+			select {
+			case n := <-p.webhookC:
+				if err := postWebhook(ctx, p.config.IngestionErrorWebhook, n); err != nil {
+					logger.Errorf("cannot deliver ingestion error notification: %v", err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// stopWebhookWorker stops the goroutine started by startWebhookWorker
+// and waits for it to finish. Notifications that have not been
+// delivered are discarded.
+func (p *Pool) stopWebhookWorker() {
+	if p.webhookCancel == nil {
+		return
+	}
+	p.webhookCancel()
+	<-p.webhookDone
+}
+
+// postWebhook POSTs the given value as JSON to the given URL, retrying
+// up to webhookAttempts times with exponential backoff until it
+// receives a successful response or the given context is done.
+func postWebhook(ctx context.Context, url string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	delay := webhookRetryDelay
+	for i := 0; ; i++ {
+		err = postWebhookOnce(ctx, url, body)
+		if err == nil {
+			return nil
+		}
+		if i+1 >= webhookAttempts {
+			return errgo.Notef(err, "giving up after %d attempts", webhookAttempts)
+		}
+		logger.Debugf("webhook delivery to %q failed (retrying in %v): %v", url, delay, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return errgo.Notef(ctx.Err(), "giving up after %d attempts", i+1)
+		}
+		delay *= 2
+	}
+}
+
+// postWebhookOnce makes a single attempt to POST the given JSON body
+// to the given URL.
+func postWebhookOnce(ctx context.Context, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errgo.Newf("unexpected response status %q", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"gopkg.in/juju/charmstore.v5/internal/charm"
+	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
+)
+
+type webhookSuite struct {
+	commonSuite
+}
+
+var _ = gc.Suite(&webhookSuite{})
+
+// webhookRequest holds a request received by a test webhook server.
+type webhookRequest struct {
+	contentType string
+	body        []byte
+}
+
+// newWebhookServer returns a server that sends each request it
+// receives on the returned channel. The first failures requests
+// receive an internal server error response.
+func newWebhookServer(failures int) (*httptest.Server, <-chan webhookRequest) {
+	reqs := make(chan webhookRequest, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		reqs <- webhookRequest{
+			contentType: req.Header.Get("Content-Type"),
+			body:        body,
+		}
+		if failures > 0 {
+			failures--
+			http.Error(w, "try again later", http.StatusInternalServerError)
+		}
+	}))
+	return srv, reqs
+}
+
+// newPool returns a pool that delivers ingestion error notifications
+// to the given webhook. Notifications are only delivered until the
+// pool is closed.
+func (s *webhookSuite) newPool(c *gc.C, webhook string) *Pool {
+	p, err := NewPool(s.Session.DB("juju_test"), nil, nil, ServerParams{
+		IngestionErrorWebhook: webhook,
+	})
+	c.Assert(err, gc.Equals, nil)
+	return p
+}
+
+func (s *webhookSuite) TestIngestionErrorWebhook(c *gc.C) {
+	srv, reqs := newWebhookServer(0)
+	defer srv.Close()
+	p := s.newPool(c, srv.URL)
+	defer p.Close()
+	store := p.Store()
+	defer store.Close()
+
+	urls := []*charm.URL{
+		charm.MustParseURL("cs:~charmers/trusty/mysql-1"),
+	}
+	data := json.RawMessage(`"error data"`)
+	before := time.Now().Add(-time.Second)
+	err := store.AddLog(&data, mongodoc.ErrorLevel, mongodoc.IngestionType, urls)
+	c.Assert(err, gc.Equals, nil)
+	after := time.Now().Add(time.Second)
+
+	var req webhookRequest
+	select {
+	case req = <-reqs:
+	case <-time.After(5 * time.Second):
+		c.Fatalf("timed out waiting for webhook request")
+	}
+	c.Assert(req.contentType, gc.Equals, "application/json")
+	var n IngestionErrorNotification
+	err = json.Unmarshal(req.body, &n)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n.Time, jc.TimeBetween(before, after))
+	n.Time = time.Time{}
+	c.Assert(n, jc.DeepEquals, IngestionErrorNotification{
+		Data: json.RawMessage(`"error data"`),
+		URLs: []*charm.URL{
+			charm.MustParseURL("cs:~charmers/trusty/mysql-1"),
+			charm.MustParseURL("cs:~charmers/mysql"),
+		},
+	})
+}
+
+func (s *webhookSuite) TestIngestionErrorWebhookIgnoresOtherLogs(c *gc.C) {
+	srv, reqs := newWebhookServer(0)
+	defer srv.Close()
+	p := s.newPool(c, srv.URL)
+	defer p.Close()
+	store := p.Store()
+	defer store.Close()
+
+	data := json.RawMessage(`"info data"`)
+	err := store.AddLog(&data, mongodoc.InfoLevel, mongodoc.IngestionType, nil)
+	c.Assert(err, gc.Equals, nil)
+	data = json.RawMessage(`"legacy error"`)
+	err = store.AddLog(&data, mongodoc.ErrorLevel, mongodoc.LegacyStatisticsType, nil)
+	c.Assert(err, gc.Equals, nil)
+
+	select {
+	case req := <-reqs:
+		c.Fatalf("unexpected webhook request %s", req.body)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func (s *webhookSuite) TestIngestionErrorWebhookRetries(c *gc.C) {
+	s.PatchValue(&webhookRetryDelay, time.Millisecond)
+	srv, reqs := newWebhookServer(2)
+	defer srv.Close()
+	p := s.newPool(c, srv.URL)
+	defer p.Close()
+	store := p.Store()
+	defer store.Close()
+
+	data := json.RawMessage(`"error data"`)
+	err := store.AddLog(&data, mongodoc.ErrorLevel, mongodoc.IngestionType, nil)
+	c.Assert(err, gc.Equals, nil)
+
+	// The notification is delivered again after each failure.
+	for i := 0; i < 3; i++ {
+		select {
+		case req := <-reqs:
+			var n IngestionErrorNotification
+			err = json.Unmarshal(req.body, &n)
+			c.Assert(err, gc.Equals, nil)
+			c.Assert(string(n.Data), gc.Equals, `"error data"`)
+		case <-time.After(5 * time.Second):
+			c.Fatalf("timed out waiting for webhook request %d", i)
+		}
+	}
+	select {
+	case req := <-reqs:
+		c.Fatalf("unexpected webhook request %s", req.body)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func (s *webhookSuite) TestIngestionErrorWebhookQueueFull(c *gc.C) {
+	s.PatchValue(&webhookQueueSize, 1)
+	received := make(chan string, 10)
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var n IngestionErrorNotification
+		json.NewDecoder(req.Body).Decode(&n)
+		received <- string(n.Data)
+		<-release
+	}))
+	defer srv.Close()
+	p := s.newPool(c, srv.URL)
+	defer p.Close()
+	store := p.Store()
+	defer store.Close()
+
+	addLog := func(msg string) {
+		data := json.RawMessage(msg)
+		err := store.AddLog(&data, mongodoc.ErrorLevel, mongodoc.IngestionType, nil)
+		c.Assert(err, gc.Equals, nil)
+	}
+	// The first notification is being delivered, the second waits
+	// in the queue and the third is dropped.
+	addLog(`"first"`)
+	select {
+	case data := <-received:
+		c.Assert(data, gc.Equals, `"first"`)
+	case <-time.After(5 * time.Second):
+		c.Fatalf("timed out waiting for webhook request")
+	}
+	addLog(`"second"`)
+	addLog(`"third"`)
+	close(release)
+	select {
+	case data := <-received:
+		c.Assert(data, gc.Equals, `"second"`)
+	case <-time.After(5 * time.Second):
+		c.Fatalf("timed out waiting for webhook request")
+	}
+	select {
+	case data := <-received:
+		c.Fatalf("unexpected webhook request %s", data)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func (s *webhookSuite) TestCloseStopsWebhookDelivery(c *gc.C) {
+	s.PatchValue(&webhookRetryDelay, time.Hour)
+	srv, reqs := newWebhookServer(1)
+	defer srv.Close()
+	p := s.newPool(c, srv.URL)
+	store := p.Store()
+
+	data := json.RawMessage(`"error data"`)
+	err := store.AddLog(&data, mongodoc.ErrorLevel, mongodoc.IngestionType, nil)
+	c.Assert(err, gc.Equals, nil)
+	store.Close()
+	select {
+	case <-reqs:
+	case <-time.After(5 * time.Second):
+		c.Fatalf("timed out waiting for webhook request")
+	}
+
+	// Closing the pool does not wait for the retry.
+	done := make(chan struct{})
+	go func() {
+		p.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		c.Fatalf("timed out waiting for pool to close")
+	}
+}
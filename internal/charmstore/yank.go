@@ -0,0 +1,218 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore // import "gopkg.in/juju/charmstore.v5/internal/charmstore"
+
+import (
+	"fmt"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v5/audit"
+	"gopkg.in/juju/charmstore.v5/internal/charm"
+	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5/internal/router"
+)
+
+// yankMaxAttempts holds the maximum number of times that YankRevision
+// tries to update the channel heads of a base entity that is being
+// concurrently modified.
+const yankMaxAttempts = 5
+
+// YankRevision withdraws the entity with the given id from the given
+// channel, for example because it was published in error. The entity
+// is marked as yanked in the channel, so that it can no longer be
+// resolved in that channel, even by its full id, until it is
+// published there again. The given user is recorded in the audit log
+// and publish history as having yanked it.
+//
+// For each series where the entity is the current revision in the
+// channel, the most recently published revision that is still
+// available in the channel becomes current instead. Revisions
+// published before the publish history was recorded do not appear in
+// it, so if the history holds no such revision, the highest revision
+// still published in the channel for the series is used. If there is
+// none, the series is removed from the channel. Note that the
+// resources published to the channel are left unchanged.
+//
+// The entity is marked as yanked before the channel heads are
+// updated, and the heads are only changed if they have not been
+// changed concurrently, so a concurrent publish is never overwritten.
+//
+// If the entity is not published in the channel, an error with a
+// params.ErrNotFound cause is returned.
+func (s *Store) YankRevision(url *router.ResolvedURL, channel params.Channel, user string) error {
+	if !params.ValidChannels[channel] || channel == params.UnpublishedChannel {
+		return errgo.Newf("cannot yank %q: invalid channel %q", url, channel)
+	}
+	entity, err := s.FindEntity(url, FieldSelector("series", "supportedseries"))
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	// Only one of any concurrent attempts to yank the
+	// entity can succeed here.
+	err = s.DB.Entities().Update(bson.D{
+		{"_id", &url.URL},
+		{"published." + string(channel), true},
+	}, bson.D{
+		{"$set", bson.D{{"yanked." + string(channel), true}}},
+		{"$unset", bson.D{{"published." + string(channel), true}}},
+	})
+	if err == mgo.ErrNotFound {
+		return errgo.WithCausef(nil, params.ErrNotFound, "%s not found in %s channel", url, channel)
+	}
+	if err != nil {
+		return errgo.Notef(err, "cannot update %q", url)
+	}
+	series := entity.SupportedSeries
+	if len(series) == 0 {
+		series = []string{entity.Series}
+	}
+	for attempt := 1; ; attempt++ {
+		ok, err := s.yankChannelHeads(url, channel, series, user)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if ok {
+			break
+		}
+		if attempt >= yankMaxAttempts {
+			return errgo.Newf("cannot update channel heads for %q: too many concurrent updates", url)
+		}
+	}
+	s.AddAudit(audit.Entry{
+		User:    user,
+		Op:      audit.OpYank,
+		Entity:  &url.URL,
+		Channel: string(channel),
+	})
+	if channel != params.StableChannel {
+		return nil
+	}
+	if err := s.UpdateSearchBaseURL(mongodoc.BaseURL(&url.URL)); err != nil {
+		return errgo.Notef(err, "cannot update search entities for %q", &url.URL)
+	}
+	return nil
+}
+
+// yankChannelHeads replaces the given yanked entity as the current
+// revision in the given channel for each of the given series. It
+// reports false without changing anything if the channel heads were
+// changed concurrently.
+func (s *Store) yankChannelHeads(url *router.ResolvedURL, channel params.Channel, series []string, user string) (bool, error) {
+	baseEntity, err := s.FindBaseEntity(&url.URL, FieldSelector("channelentities", "publishhistory"))
+	if err != nil {
+		return false, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	query := bson.D{{"_id", baseEntity.URL}}
+	var set, unset bson.D
+	var history []mongodoc.PublishHistoryEntry
+	now := timeNow()
+	for _, s1 := range series {
+		head := baseEntity.ChannelEntities[channel][s1]
+		if head == nil || *head != url.URL {
+			continue
+		}
+		key := fmt.Sprintf("channelentities.%s.%s", channel, s1)
+		query = append(query, bson.DocElem{key, &url.URL})
+		prev, err := s.previousChannelHead(baseEntity, channel, s1, &url.URL)
+		if err != nil {
+			return false, errgo.Mask(err)
+		}
+		if prev == nil {
+			unset = append(unset, bson.DocElem{key, true})
+			continue
+		}
+		set = append(set, bson.DocElem{key, prev})
+		history = append(history, mongodoc.PublishHistoryEntry{
+			Channel: channel,
+			Series:  s1,
+			URL:     prev,
+			Time:    now,
+			User:    user,
+		})
+	}
+	var update bson.D
+	if len(set) > 0 {
+		update = append(update, bson.DocElem{"$set", set})
+		update = append(update, pushPublishHistory(history))
+	}
+	if len(unset) > 0 {
+		update = append(update, bson.DocElem{"$unset", unset})
+	}
+	if len(update) == 0 {
+		return true, nil
+	}
+	err = s.DB.BaseEntities().Update(query, update)
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, errgo.Notef(err, "cannot update base entity for %q", url)
+	}
+	if err := s.addPublishEvents(history); err != nil {
+		return false, errgo.Mask(err)
+	}
+	return true, nil
+}
+
+// previousChannelHead returns the most recently published entity,
+// other than the given one, that was current in the given channel for
+// the given series and is still published there, or nil if there is
+// none.
+func (s *Store) previousChannelHead(baseEntity *mongodoc.BaseEntity, channel params.Channel, series string, yanked *charm.URL) (*charm.URL, error) {
+	// The publish history is held in the order that entities
+	// were published.
+	var candidates []*charm.URL
+	seen := make(map[charm.URL]bool)
+	for i := len(baseEntity.PublishHistory) - 1; i >= 0; i-- {
+		h := baseEntity.PublishHistory[i]
+		if h.Channel != channel || h.Series != series || *h.URL == *yanked || seen[*h.URL] {
+			continue
+		}
+		seen[*h.URL] = true
+		candidates = append(candidates, h.URL)
+	}
+	if len(candidates) > 0 {
+		var entities []*mongodoc.Entity
+		if err := s.DB.Entities().Find(bson.D{
+			{"_id", bson.D{{"$in", candidates}}},
+			{"published." + string(channel), true},
+		}).Select(FieldSelector("_id")).All(&entities); err != nil {
+			return nil, errgo.Notef(err, "cannot find previously published entities")
+		}
+		available := make(map[charm.URL]bool, len(entities))
+		for _, e := range entities {
+			available[*e.URL] = true
+		}
+		for _, u := range candidates {
+			if available[*u] {
+				return u, nil
+			}
+		}
+	}
+	// The history does not record a suitable entity, perhaps
+	// because it was published before the history was kept,
+	// so fall back to the highest revision still published in
+	// the channel.
+	var entity mongodoc.Entity
+	err := s.DB.Entities().Find(bson.D{
+		{"baseurl", baseEntity.URL},
+		{"_id", bson.D{{"$ne", yanked}}},
+		{"published." + string(channel), true},
+		{"$or", []bson.D{
+			{{"supportedseries", series}},
+			{{"series", series}},
+		}},
+	}).Sort("-revision").Select(FieldSelector("_id")).One(&entity)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot find published entities")
+	}
+	return entity.URL, nil
+}
@@ -10,6 +10,7 @@ import (
 	"gopkg.in/errgo.v1"
 	"gopkg.in/mgo.v2/bson"
 
+	"gopkg.in/juju/charmstore.v5/audit"
 	"gopkg.in/juju/charmstore.v5/internal/charm"
 )
 
@@ -103,6 +104,23 @@ type Entity struct {
 	// for required interfaces.
 	CharmRequiredInterfaces []string
 
+	// Assumes holds the expressions in the assumes block of the
+	// charm's metadata, all of which must be satisfied for the
+	// charm to be deployed. It is empty for charms without an
+	// assumes block, which can be deployed anywhere.
+	Assumes []AssumesExpression `json:",omitempty" bson:",omitempty"`
+
+	// AssumesFeatures holds each feature expression found anywhere
+	// in Assumes, including any version constraint, for example
+	// "juju>=2.9". It is used for searching.
+	AssumesFeatures []string `json:",omitempty" bson:",omitempty"`
+
+	// Architectures holds the architectures declared in the
+	// charm's metadata. It is empty for bundles and for charms
+	// that do not declare any architectures, which can be
+	// deployed to any architecture.
+	Architectures []string `json:",omitempty" bson:",omitempty"`
+
 	BundleData   *charm.BundleData
 	BundleReadMe string
 
@@ -138,6 +156,19 @@ type Entity struct {
 
 	// Published holds whether the entity has been published on a channel.
 	Published map[params.Channel]bool `json:",omitempty" bson:",omitempty"`
+
+	// Yanked holds whether the entity has been yanked from a channel
+	// since it was last published there.
+	Yanked map[params.Channel]bool `json:",omitempty" bson:",omitempty"`
+
+	// Source holds the name of the upstream source that the entity
+	// was ingested from, such as "launchpad" or "github". It is
+	// empty if the entity was not ingested.
+	Source string `json:",omitempty" bson:",omitempty"`
+
+	// SourceURL holds the location of the entity in its upstream
+	// source.
+	SourceURL string `json:",omitempty" bson:",omitempty"`
 }
 
 // PreferredURL returns the preferred way to refer to this entity. If
@@ -155,6 +186,31 @@ func (e *Entity) PreferredURL(usePromulgated bool) *charm.URL {
 	return &u
 }
 
+// AssumesExpression holds an expression from the assumes block of a
+// charm's metadata. Exactly one of Feature, AnyOf and AllOf is set.
+type AssumesExpression struct {
+	// Feature holds the name of a feature that must be provided
+	// by the deployment environment, for example "juju" or
+	// "k8s-api".
+	Feature string `json:",omitempty" bson:",omitempty"`
+
+	// Op holds the operator of a version constraint on the
+	// feature, either ">=" or "<". It is empty when there is no
+	// constraint.
+	Op string `json:",omitempty" bson:",omitempty"`
+
+	// Version holds the version that the feature is compared
+	// with by Op.
+	Version string `json:",omitempty" bson:",omitempty"`
+
+	// AnyOf holds expressions at least one of which must be
+	// satisfied.
+	AnyOf []AssumesExpression `json:",omitempty" bson:",omitempty"`
+
+	// AllOf holds expressions all of which must be satisfied.
+	AllOf []AssumesExpression `json:",omitempty" bson:",omitempty"`
+}
+
 // BaseEntity holds metadata for a charm or bundle
 // independent of any specific uploaded revision or series.
 type BaseEntity struct {
@@ -194,11 +250,25 @@ type BaseEntity struct {
 	// version for that channel and resource name.
 	ChannelResources map[params.Channel][]ResourceRevision
 
+	// PublishHistory holds a record of the publications of entity
+	// revisions for each channel and series, in the order they were
+	// made. Only the most recent publications are kept.
+	PublishHistory []PublishHistoryEntry `bson:",omitempty" json:",omitempty"`
+
 	// NoIngest is set to true when a charm or bundle has been uploaded
 	// with a POST request. Since the ingester only uses PUT requests
 	// at present, this signifies that someone has taken over control from
 	// the ingester.
 	NoIngest bool `bson:",omitempty"`
+
+	// Reserved is set to true when the base entity was created by
+	// reserving its name and no entity has been added to it since.
+	Reserved bool `bson:",omitempty" json:",omitempty"`
+
+	// RenamedFrom holds the URL of the base entity that this one is
+	// being renamed from. It is only set while the rename is in
+	// progress, so that an interrupted rename can be completed.
+	RenamedFrom *charm.URL `bson:",omitempty" json:",omitempty"`
 }
 
 // LatestRevision holds an entry in the revisions collection.
@@ -217,6 +287,84 @@ type LatestRevision struct {
 	Revision int
 }
 
+// RevisionBase holds an entry in the revision_bases collection.
+type RevisionBase struct {
+	// BaseURL holds the base URL that the revision base
+	// applies to (e.g. cs:~user/foo).
+	BaseURL *charm.URL `bson:"_id"`
+
+	// Base holds the lowest revision number that will be
+	// allocated for new revisions of ids with the base URL.
+	Base int
+}
+
+// PublishHistoryEntry records the publication of an entity revision
+// as the current revision for a channel and series.
+type PublishHistoryEntry struct {
+	// Channel holds the channel the entity was published to.
+	Channel params.Channel
+
+	// Series holds the series the entity was published for.
+	Series string
+
+	// URL holds the id of the published entity.
+	URL *charm.URL
+
+	// Time holds the time the entity was published.
+	Time time.Time
+
+	// User holds the name of the user that published the entity,
+	// if known.
+	User string `bson:",omitempty" json:",omitempty"`
+}
+
+// PublishEvent holds an entry in the publishevents collection,
+// recording that an entity revision became the current revision in a
+// channel.
+type PublishEvent struct {
+	// Channel holds the channel the entity was published to.
+	Channel params.Channel
+
+	// URL holds the id of the published entity.
+	URL *charm.URL
+
+	// Time holds the time the entity was published.
+	Time time.Time
+}
+
+// ReindexJob holds an entry in the reindex_jobs collection, recording
+// the progress of a reindex of the search index.
+type ReindexJob struct {
+	// Id holds the id of the job.
+	Id string `bson:"_id"`
+
+	// Running holds whether the job has not yet finished. It is
+	// unset when the job finishes, and a unique index on it ensures
+	// that only one job runs at a time.
+	Running bool `bson:",omitempty"`
+
+	// CancelRequested holds whether the job has been asked to stop.
+	CancelRequested bool `bson:",omitempty"`
+
+	// Done holds the number of entities processed so far.
+	Done int
+
+	// Total holds the total number of entities to process.
+	Total int
+
+	// Error holds the reason the job failed, if it did.
+	Error string `bson:",omitempty"`
+
+	// UpdateTime holds the time the job's progress was last
+	// recorded. A running job that has not been updated for a long
+	// time is assumed to have been abandoned.
+	UpdateTime time.Time
+
+	// FinishTime holds the time the job finished. Finished jobs are
+	// removed by MongoDB some time after they finish.
+	FinishTime *time.Time `bson:",omitempty"`
+}
+
 // ResourceRevision specifies an association of a resource name to a
 // revision.
 type ResourceRevision struct {
@@ -238,8 +386,9 @@ type ACL struct {
 type FileId string
 
 const (
-	FileReadMe FileId = "readme"
-	FileIcon   FileId = "icon"
+	FileReadMe     FileId = "readme"
+	FileIcon       FileId = "icon"
+	FileLXDProfile FileId = "lxd-profile"
 )
 
 // ZipFile refers to a specific file in the uploaded archive blob.
@@ -367,7 +516,9 @@ type DownloadCount struct {
 	// ID contains the ID the download count is for.
 	ID string
 
-	// Period contains the time period this count is for.
+	// Period contains the time period this count is for. The
+	// all-time counts of downloads made by each type of client
+	// have a period of "client:" followed by the client type.
 	Period string
 
 	// Count contains the current count.
@@ -376,4 +527,81 @@ type DownloadCount struct {
 	// Expires contains the time at which this count is no longer
 	// needed.
 	Expires *time.Time `bson:"expires,omitempty"`
+
+	// CompactedDays holds the daily periods whose counts have been
+	// added to this count when compacting download counts.
+	CompactedDays []string `bson:"compacteddays,omitempty"`
+}
+
+// APIToken holds a token that authenticates requests made on behalf
+// of a user. Only a hash of the token is stored.
+type APIToken struct {
+	// Hash holds the hex-encoded SHA256 hash of the token.
+	Hash string `bson:"_id"`
+
+	// User holds the name of the user that the token
+	// authenticates.
+	User string
+
+	// Created holds the time the token was created.
+	Created time.Time
+
+	// Expires holds the time after which the token is no
+	// longer valid.
+	Expires time.Time
+}
+
+// UploadBlocklist holds the upload blocklist, as stored in the
+// upload_blocklist collection.
+type UploadBlocklist struct {
+	// Id holds the id of the document. There is only one.
+	Id string `bson:"_id"`
+
+	// Patterns holds the patterns matching the "user/name" of
+	// entities that may not be uploaded.
+	Patterns []string
+}
+
+// PendingPublish holds a request to publish an entity to a channel
+// that requires approval, as stored in the pending_publishes
+// collection.
+type PendingPublish struct {
+	// Id holds the id of the request, which is derived from the
+	// channel and the entity id, so that there is at most one
+	// pending request for each.
+	Id string `bson:"_id"`
+
+	// URL holds the id of the entity to be published.
+	URL *charm.URL
+
+	// Channel holds the channel to publish the entity to.
+	Channel params.Channel
+
+	// Resources holds the resource revisions to publish with the
+	// entity.
+	Resources map[string]int `bson:",omitempty" json:",omitempty"`
+
+	// RequireResources holds whether all the charm's resources
+	// must be specified when the entity is published.
+	RequireResources bool `bson:",omitempty" json:",omitempty"`
+
+	// User holds the name of the user that requested the publish.
+	User string
+
+	// Time holds the time the request was made.
+	Time time.Time
+}
+
+// AuditEntry holds an audit log entry as stored in the audit
+// collection.
+type AuditEntry struct {
+	// Id holds the id of the entry. As object ids increase
+	// over time, this orders entries that have the same time.
+	Id bson.ObjectId `bson:"_id"`
+
+	// BaseURL holds the base URL of the entity that the
+	// entry refers to, if any.
+	BaseURL *charm.URL `bson:",omitempty"`
+
+	audit.Entry `bson:",inline"`
 }
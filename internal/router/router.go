@@ -6,12 +6,15 @@
 package router // import "gopkg.in/juju/charmstore.v5/internal/router"
 
 import (
+	"bytes"
+	"compress/gzip"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/url"
 	"reflect"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 
@@ -21,6 +24,7 @@ import (
 	"gopkg.in/errgo.v1"
 	"gopkg.in/httprequest.v1"
 	"gopkg.in/macaroon-bakery.v2-unstable/httpbakery"
+	"gopkg.in/yaml.v2"
 
 	"gopkg.in/juju/charmstore.v5/internal/charm"
 	"gopkg.in/juju/charmstore.v5/internal/monitoring"
@@ -114,6 +118,19 @@ type Handlers struct {
 	// which may end in a trailing slash (/) to indicate that longer
 	// paths are allowed too.
 	Meta map[string]BulkIncludeHandler
+
+	// MetaPost holds handlers for POST requests to paths under
+	// the meta endpoint of a single charm or bundle id. The map
+	// key holds the path below meta, for example
+	// "resources/download-urls". Unlike the Meta handlers, these
+	// are not available through the bulk meta endpoints.
+	MetaPost map[string]IdHandler
+
+	// MetaYAML holds the paths under the meta endpoint of a single
+	// charm or bundle id, for example "charm-metadata", whose
+	// responses are returned as YAML rather than JSON when the
+	// client asks for it. See wantsYAML.
+	MetaYAML map[string]bool
 }
 
 // Router represents a charm store HTTP request router.
@@ -126,6 +143,21 @@ type Router struct {
 
 	// monitor holds a metric monitor to time a request.
 	Monitor monitoring.Request
+
+	// MetaGzipThreshold holds the size in bytes above which the
+	// JSON bodies of metadata responses are gzip-compressed when
+	// the client accepts that encoding. If it is zero, metadata
+	// responses are never compressed.
+	MetaGzipThreshold int
+
+	// MaxMetaIds holds the maximum number of ids allowed in a
+	// bulk meta request. If it is zero, there is no limit.
+	MaxMetaIds int
+
+	// MaxMetaIncludes holds the maximum number of include
+	// parameters allowed in a meta request. If it is zero, there
+	// is no limit.
+	MaxMetaIncludes int
 }
 
 // ResolvedURL represents a URL that has been resolved by resolveURL.
@@ -294,7 +326,7 @@ func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	header.Set("Access-Control-Allow-Headers", "Bakery-Protocol-Version, Macaroons, X-Requested-With")
 	header.Set("Access-Control-Allow-Credentials", "true")
 	header.Set("Access-Control-Cache-Max-Age", "600")
-	header.Set("Access-Control-Allow-Methods", "DELETE,GET,HEAD,PUT,POST,OPTIONS")
+	header.Set("Access-Control-Allow-Methods", "DELETE,GET,HEAD,PATCH,PUT,POST,OPTIONS")
 	header.Set("Access-Control-Expose-Headers", "WWW-Authenticate")
 
 	if req.Method == "OPTIONS" {
@@ -303,7 +335,7 @@ func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		// only a subset of these. This means we can avoid
 		// putting OPTIONS handling in every endpoint,
 		// and it shouldn't actually matter in practice.
-		header.Set("Allow", "DELETE,GET,HEAD,PUT,POST")
+		header.Set("Allow", "DELETE,GET,HEAD,PATCH,PUT,POST")
 		header.Set("Access-Control-Allow-Origin", req.Header.Get("Origin"))
 		return
 	}
@@ -396,19 +428,28 @@ func handlerKey(path string) (key, rest string) {
 func (r *Router) serveMeta(id *charm.URL, w http.ResponseWriter, req *http.Request) error {
 	switch req.Method {
 	case "GET", "HEAD":
+		if req.Method == "HEAD" && req.URL.Path == "/any" && len(req.Form["include"]) == 0 {
+			return r.serveMetaAnyHead(id, w, req)
+		}
+		if err := r.checkMetaLimits(req); err != nil {
+			return errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+		}
 		r.willIncludeMetadata(req)
 		rurl, err := r.Context.ResolveURL(id)
 		if err != nil {
 			// Note: preserve error cause from ResolveURL.
 			return errgo.Mask(err, errgo.Any)
 		}
+		yamlResp := r.handlers.MetaYAML[strings.TrimPrefix(req.URL.Path, "/")] && wantsYAML(req)
 		resp, err := r.serveMetaGet(rurl, req)
 		if err != nil {
 			// Note: preserve error causes from meta handlers.
 			return errgo.Mask(err, errgo.Any)
 		}
-		httprequest.WriteJSON(w, http.StatusOK, resp)
-		return nil
+		if yamlResp {
+			return writeMetaYAML(w, resp)
+		}
+		return r.writeMetaJSON(w, req, resp)
 	case "PUT":
 		rurl, err := r.Context.ResolveURL(id)
 		if err != nil {
@@ -418,10 +459,43 @@ func (r *Router) serveMeta(id *charm.URL, w http.ResponseWriter, req *http.Reque
 		// Put requests don't return any data unless there's
 		// an error.
 		return r.serveMetaPut(rurl, req)
+	case "POST":
+		handler := r.handlers.MetaPost[strings.TrimPrefix(req.URL.Path, "/")]
+		if handler == nil {
+			break
+		}
+		req.URL.Path = ""
+		// Note: preserve error cause from handlers.
+		return errgo.Mask(handler(id, w, req), errgo.Any)
 	}
 	return params.ErrMethodNotAllowed
 }
 
+// serveMetaAnyHead serves a HEAD request to meta/any with no
+// included metadata. It reports only whether the entity exists, so no
+// metadata is fetched and no body is returned. Entities that the client
+// is not authorized to read are reported as not found so that their
+// existence is not revealed.
+//
+// HEAD id/meta/any
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#head-idmetaany
+func (r *Router) serveMetaAnyHead(id *charm.URL, w http.ResponseWriter, req *http.Request) error {
+	rurl, err := r.Context.ResolveURL(id)
+	if err == nil {
+		err = r.Context.AuthorizeEntity(rurl, req)
+	}
+	if cause := errgo.Cause(err); cause == params.ErrNotFound || isAuthorizationError(cause) {
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+	if err != nil {
+		// Note: preserve error cause from the context.
+		return errgo.Mask(err, errgo.Any)
+	}
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
 // willIncludeMetadata notifies the context about any metadata
 // that will probably be required by the request, so that initial
 // fetches (for example by ResolveURL) can fetch additional
@@ -596,8 +670,7 @@ func (r *Router) serveBulkMeta(w http.ResponseWriter, req *http.Request) error {
 		if err != nil {
 			return errgo.Mask(err, errgo.Any)
 		}
-		httprequest.WriteJSON(w, http.StatusOK, resp)
-		return nil
+		return r.writeMetaJSON(w, req, resp)
 	case "PUT":
 		return r.serveBulkMetaPut(req)
 	default:
@@ -605,6 +678,98 @@ func (r *Router) serveBulkMeta(w http.ResponseWriter, req *http.Request) error {
 	}
 }
 
+// writeMetaJSON writes the given metadata response as JSON. If the
+// encoded response is larger than r.MetaGzipThreshold and the client
+// accepts gzip encoding, the body is gzip-compressed. The
+// Content-Length header always reflects the size of the body as sent.
+func (r *Router) writeMetaJSON(w http.ResponseWriter, req *http.Request, resp interface{}) error {
+	if r.MetaGzipThreshold <= 0 {
+		return httprequest.WriteJSON(w, http.StatusOK, resp)
+	}
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	header := w.Header()
+	header.Set("Content-Type", "application/json")
+	header.Add("Vary", "Accept-Encoding")
+	if len(data) > r.MetaGzipThreshold && acceptsGzip(req) {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(data); err != nil {
+			return errgo.Mask(err)
+		}
+		if err := zw.Close(); err != nil {
+			return errgo.Mask(err)
+		}
+		data = buf.Bytes()
+		header.Set("Content-Encoding", "gzip")
+	}
+	header.Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+	return nil
+}
+
+// writeMetaYAML writes the given metadata response as YAML. Struct
+// fields are written in the order they are declared and map keys are
+// sorted, so the output is stable.
+func writeMetaYAML(w http.ResponseWriter, resp interface{}) error {
+	data, err := yaml.Marshal(resp)
+	if err != nil {
+		return errgo.Notef(err, "cannot marshal YAML response")
+	}
+	header := w.Header()
+	header.Set("Content-Type", yamlContentType)
+	header.Add("Vary", "Accept")
+	header.Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+	return nil
+}
+
+// yamlContentType holds the content type of YAML responses.
+const yamlContentType = "application/yaml"
+
+// wantsYAML reports whether the client has asked for a YAML
+// response, either with a format=yaml query parameter or by
+// accepting application/yaml.
+func wantsYAML(req *http.Request) bool {
+	if req.Form.Get("format") == "yaml" {
+		return true
+	}
+	for _, h := range req.Header["Accept"] {
+		for _, mediaType := range strings.Split(h, ",") {
+			if strings.TrimSpace(strings.Split(mediaType, ";")[0]) == yamlContentType {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// acceptsGzip reports whether the Accept-Encoding header of the given
+// request allows a gzip-encoded response.
+func acceptsGzip(req *http.Request) bool {
+	for _, h := range req.Header["Accept-Encoding"] {
+		for _, coding := range strings.Split(h, ",") {
+			parts := strings.Split(coding, ";")
+			if strings.TrimSpace(parts[0]) != "gzip" {
+				continue
+			}
+			for _, p := range parts[1:] {
+				if q := strings.TrimSpace(p); strings.HasPrefix(q, "q=") {
+					if v, err := strconv.ParseFloat(q[2:], 64); err == nil && v == 0 {
+						return false
+					}
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
 // serveBulkMetaGet serves the "bulk" metadata retrieval endpoint
 // that can return information on several ids at once.
 //
@@ -615,6 +780,9 @@ func (r *Router) serveBulkMetaGet(req *http.Request) (interface{}, error) {
 	if len(ids) == 0 {
 		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "no ids specified in meta request")
 	}
+	if err := r.checkMetaLimits(req); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
 	delete(req.Form, "id")
 	ignoreAuth, err := ParseBool(req.Form.Get("ignore-auth"))
 	if err != nil {
@@ -658,6 +826,19 @@ func (r *Router) serveBulkMetaGet(req *http.Request) (interface{}, error) {
 	return result, nil
 }
 
+// checkMetaLimits checks that the number of ids and includes in the
+// given meta request do not exceed r.MaxMetaIds and r.MaxMetaIncludes,
+// so that overly large requests are rejected before any work is done.
+func (r *Router) checkMetaLimits(req *http.Request) error {
+	if n := len(req.Form["id"]); r.MaxMetaIds > 0 && n > r.MaxMetaIds {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "too many ids in meta request (%d > %d)", n, r.MaxMetaIds)
+	}
+	if n := len(req.Form["include"]); r.MaxMetaIncludes > 0 && n > r.MaxMetaIncludes {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "too many includes in meta request (%d > %d)", n, r.MaxMetaIncludes)
+	}
+	return nil
+}
+
 // ParseBool returns the boolean value represented by the string.
 // It accepts "1" or "0". Any other value returns an error.
 func ParseBool(value string) (bool, error) {
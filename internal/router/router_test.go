@@ -5,12 +5,15 @@ package router
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -24,6 +27,7 @@ import (
 	"gopkg.in/errgo.v1"
 	"gopkg.in/httprequest.v1"
 	"gopkg.in/macaroon-bakery.v2-unstable/httpbakery"
+	"gopkg.in/yaml.v2"
 
 	"gopkg.in/juju/charmstore.v5/audit"
 	"gopkg.in/juju/charmstore.v5/internal/charm"
@@ -1185,6 +1189,68 @@ func (s *RouterSuite) TestRouterGet(c *gc.C) {
 	}
 }
 
+var metaAnyHeadTests = []struct {
+	about        string
+	urlStr       string
+	resolveURL   func(*charm.URL) (*ResolvedURL, error)
+	authorize    func(*ResolvedURL, *http.Request) error
+	expectStatus int
+}{{
+	about:        "entity exists",
+	urlStr:       "/precise/wordpress-42/meta/any",
+	expectStatus: http.StatusOK,
+}, {
+	about:        "entity not found",
+	urlStr:       "/precise/wordpress-42/meta/any",
+	resolveURL:   resolveURLError(params.ErrNotFound),
+	expectStatus: http.StatusNotFound,
+}, {
+	about:        "unauthorized entity",
+	urlStr:       "/precise/wordpress-42/meta/any",
+	authorize:    neverAuthorize,
+	expectStatus: http.StatusNotFound,
+}, {
+	about:        "discharge required",
+	urlStr:       "/precise/wordpress-42/meta/any",
+	authorize:    dischargeRequiredAuthorize,
+	expectStatus: http.StatusNotFound,
+}, {
+	about:        "other error",
+	urlStr:       "/precise/wordpress-42/meta/any",
+	resolveURL:   resolveURLError(errgo.New("oops")),
+	expectStatus: http.StatusInternalServerError,
+}}
+
+func (s *RouterSuite) TestMetaAnyHead(c *gc.C) {
+	for i, test := range metaAnyHeadTests {
+		c.Logf("test %d: %s", i, test.about)
+		ctxt := alwaysContext
+		if test.resolveURL != nil {
+			ctxt.resolveURL = test.resolveURL
+		}
+		if test.authorize != nil {
+			ctxt.authorizeURL = test.authorize
+		}
+		ctxt.willIncludeMetadata = func([]string) {
+			c.Errorf("WillIncludeMetadata called for HEAD request")
+		}
+		router := New(&Handlers{
+			Meta: map[string]BulkIncludeHandler{
+				"foo": testMetaHandler(0),
+			},
+		}, ctxt)
+		rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+			Handler: router,
+			URL:     test.urlStr,
+			Method:  "HEAD",
+		})
+		c.Assert(rec.Code, gc.Equals, test.expectStatus)
+		if test.expectStatus != http.StatusInternalServerError {
+			c.Assert(rec.Body.Bytes(), gc.HasLen, 0)
+		}
+	}
+}
+
 type funcContext struct {
 	resolveURL          func(id *charm.URL) (*ResolvedURL, error)
 	authorizeURL        func(id *ResolvedURL, req *http.Request) error
@@ -1264,7 +1330,7 @@ func (s *RouterSuite) TestCORSHeaders(c *gc.C) {
 	c.Assert(rec.Header().Get("Access-Control-Allow-Origin"), gc.Equals, "*")
 	c.Assert(rec.Header().Get("Access-Control-Cache-Max-Age"), gc.Equals, "600")
 	c.Assert(rec.Header().Get("Access-Control-Allow-Headers"), gc.Equals, "Bakery-Protocol-Version, Macaroons, X-Requested-With")
-	c.Assert(rec.Header().Get("Access-Control-Allow-Methods"), gc.Equals, "DELETE,GET,HEAD,PUT,POST,OPTIONS")
+	c.Assert(rec.Header().Get("Access-Control-Allow-Methods"), gc.Equals, "DELETE,GET,HEAD,PATCH,PUT,POST,OPTIONS")
 	c.Assert(rec.Header().Get("Access-Control-Expose-Headers"), gc.Equals, "WWW-Authenticate")
 }
 
@@ -1325,6 +1391,96 @@ func (s *RouterSuite) TestHTTPRequestPassedThroughToMeta(c *gc.C) {
 	c.Assert(donePut, jc.IsTrue)
 }
 
+func (s *RouterSuite) TestMetaPost(c *gc.C) {
+	var gotId *charm.URL
+	h := New(&Handlers{
+		MetaPost: map[string]IdHandler{
+			"foo/bar": func(id *charm.URL, w http.ResponseWriter, req *http.Request) error {
+				gotId = id
+				return httprequest.WriteJSON(w, http.StatusOK, "posted")
+			},
+		},
+	}, alwaysContext)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:    h,
+		Method:     "POST",
+		URL:        "/precise/wordpress-2/meta/foo/bar",
+		ExpectBody: "posted",
+	})
+	c.Assert(gotId, jc.DeepEquals, charm.MustParseURL("precise/wordpress-2"))
+
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      h,
+		Method:       "POST",
+		URL:          "/precise/wordpress-2/meta/foo",
+		ExpectStatus: http.StatusMethodNotAllowed,
+		ExpectBody: params.Error{
+			Code:    params.ErrMethodNotAllowed,
+			Message: params.ErrMethodNotAllowed.Error(),
+		},
+	})
+}
+
+var metaLimitsTests = []struct {
+	about       string
+	url         string
+	expectError string
+}{{
+	about: "ids within limit",
+	url:   "/meta/foo?id=wordpress&id=mysql",
+}, {
+	about:       "too many ids",
+	url:         "/meta/foo?id=wordpress&id=mysql&id=django",
+	expectError: "too many ids in meta request (3 > 2)",
+}, {
+	about: "includes within limit",
+	url:   "/wordpress/meta/any?include=foo&include=foo",
+}, {
+	about:       "too many includes",
+	url:         "/wordpress/meta/any?include=foo&include=foo&include=foo",
+	expectError: "too many includes in meta request (3 > 2)",
+}, {
+	about:       "too many bulk includes",
+	url:         "/meta/any?id=wordpress&include=foo&include=foo&include=foo",
+	expectError: "too many includes in meta request (3 > 2)",
+}}
+
+func (s *RouterSuite) TestMetaLimits(c *gc.C) {
+	called := 0
+	h := New(&Handlers{
+		Meta: map[string]BulkIncludeHandler{
+			"foo": SingleIncludeHandler(func(id *ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
+				called++
+				return "ok", nil
+			}),
+		},
+	}, alwaysContext)
+	h.MaxMetaIds = 2
+	h.MaxMetaIncludes = 2
+	for i, test := range metaLimitsTests {
+		c.Logf("test %d: %s", i, test.about)
+		called = 0
+		rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+			Handler: h,
+			URL:     test.url,
+		})
+		if test.expectError == "" {
+			c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body))
+			continue
+		}
+		c.Assert(rec.Code, gc.Equals, http.StatusBadRequest)
+		var errResp params.Error
+		err := json.Unmarshal(rec.Body.Bytes(), &errResp)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(errResp, jc.DeepEquals, params.Error{
+			Code:    params.ErrBadRequest,
+			Message: test.expectError,
+		})
+		// No metadata was fetched.
+		c.Assert(called, gc.Equals, 0)
+	}
+}
+
 func (s *RouterSuite) TestOptionsHTTPMethod(c *gc.C) {
 	h := New(&Handlers{}, alwaysContext)
 	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
@@ -1338,8 +1494,8 @@ func (s *RouterSuite) TestOptionsHTTPMethod(c *gc.C) {
 	c.Assert(header.Get("Access-Control-Allow-Origin"), gc.Equals, "https://1.2.42.47")
 	c.Assert(header.Get("Access-Control-Cache-Max-Age"), gc.Equals, "600")
 	c.Assert(header.Get("Access-Control-Allow-Headers"), gc.Equals, "Bakery-Protocol-Version, Macaroons, X-Requested-With")
-	c.Assert(header.Get("Access-Control-Allow-Methods"), gc.Equals, "DELETE,GET,HEAD,PUT,POST,OPTIONS")
-	c.Assert(header.Get("Allow"), gc.Equals, "DELETE,GET,HEAD,PUT,POST")
+	c.Assert(header.Get("Access-Control-Allow-Methods"), gc.Equals, "DELETE,GET,HEAD,PATCH,PUT,POST,OPTIONS")
+	c.Assert(header.Get("Allow"), gc.Equals, "DELETE,GET,HEAD,PATCH,PUT,POST")
 }
 
 var routerPutTests = []struct {
@@ -2181,6 +2337,176 @@ func (s *RouterSuite) TestWriteJSON(c *gc.C) {
 	c.Assert(rec.Header().Get("content-type"), gc.Equals, "application/json")
 }
 
+var metaGzipTests = []struct {
+	about          string
+	url            string
+	acceptEncoding string
+	expectGzip     bool
+}{{
+	about:          "large body with gzip accepted",
+	url:            "/wordpress/meta/foo?size=100",
+	acceptEncoding: "gzip",
+	expectGzip:     true,
+}, {
+	about:          "large bulk body with gzip accepted",
+	url:            "/meta/foo?id=wordpress&size=100",
+	acceptEncoding: "deflate, gzip;q=0.5",
+	expectGzip:     true,
+}, {
+	about: "large body without accept-encoding",
+	url:   "/wordpress/meta/foo?size=100",
+}, {
+	about:          "large body with gzip refused",
+	url:            "/wordpress/meta/foo?size=100",
+	acceptEncoding: "gzip;q=0",
+}, {
+	about:          "small body with gzip accepted",
+	url:            "/wordpress/meta/foo?size=10",
+	acceptEncoding: "gzip",
+}}
+
+func (s *RouterSuite) TestMetaGzip(c *gc.C) {
+	h := New(&Handlers{
+		Meta: map[string]BulkIncludeHandler{
+			"foo": SingleIncludeHandler(func(id *ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
+				n, err := strconv.Atoi(req.Form.Get("size"))
+				if err != nil {
+					return nil, err
+				}
+				return strings.Repeat("x", n), nil
+			}),
+		},
+	}, alwaysContext)
+	h.MetaGzipThreshold = 50
+	for i, test := range metaGzipTests {
+		c.Logf("test %d: %s", i, test.about)
+		req, err := http.NewRequest("GET", test.url, nil)
+		c.Assert(err, gc.Equals, nil)
+		if test.acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", test.acceptEncoding)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body))
+		c.Assert(rec.Header().Get("Content-Type"), gc.Equals, "application/json")
+		c.Assert(rec.Header().Get("Vary"), gc.Equals, "Accept-Encoding")
+		c.Assert(rec.Header().Get("Content-Length"), gc.Equals, strconv.Itoa(rec.Body.Len()))
+		body := rec.Body.Bytes()
+		if test.expectGzip {
+			c.Assert(rec.Header().Get("Content-Encoding"), gc.Equals, "gzip")
+			zr, err := gzip.NewReader(rec.Body)
+			c.Assert(err, gc.Equals, nil)
+			body, err = ioutil.ReadAll(zr)
+			c.Assert(err, gc.Equals, nil)
+		} else {
+			c.Assert(rec.Header().Get("Content-Encoding"), gc.Equals, "")
+		}
+		var v interface{}
+		err = json.Unmarshal(body, &v)
+		c.Assert(err, gc.Equals, nil)
+	}
+}
+
+func (s *RouterSuite) TestMetaGzipDisabled(c *gc.C) {
+	h := New(&Handlers{
+		Meta: map[string]BulkIncludeHandler{
+			"foo": SingleIncludeHandler(func(id *ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
+				return strings.Repeat("x", 1000), nil
+			}),
+		},
+	}, alwaysContext)
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: h,
+		URL:     "/wordpress/meta/foo",
+		Header:  http.Header{"Accept-Encoding": {"gzip"}},
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	c.Assert(rec.Header().Get("Content-Encoding"), gc.Equals, "")
+	c.Assert(rec.Body.String(), gc.Equals, `"`+strings.Repeat("x", 1000)+`"`)
+}
+
+var metaYAMLTests = []struct {
+	about      string
+	url        string
+	accept     string
+	expectYAML bool
+}{{
+	about:      "accept header",
+	url:        "/wordpress/meta/foo",
+	accept:     "application/yaml",
+	expectYAML: true,
+}, {
+	about:      "accept header with several types",
+	url:        "/wordpress/meta/foo",
+	accept:     "text/html, application/yaml;q=0.9, */*;q=0.1",
+	expectYAML: true,
+}, {
+	about:      "format parameter",
+	url:        "/wordpress/meta/foo?format=yaml",
+	expectYAML: true,
+}, {
+	about: "no YAML requested",
+	url:   "/wordpress/meta/foo",
+}, {
+	about:  "other accepted type",
+	url:    "/wordpress/meta/foo",
+	accept: "application/json",
+}, {
+	about:  "endpoint without YAML support",
+	url:    "/wordpress/meta/bar",
+	accept: "application/yaml",
+}, {
+	about:  "bulk request",
+	url:    "/meta/foo?id=wordpress",
+	accept: "application/yaml",
+}}
+
+func (s *RouterSuite) TestMetaYAML(c *gc.C) {
+	type metaResult struct {
+		Name  string            `yaml:"name"`
+		Attrs map[string]string `yaml:"attrs"`
+	}
+	result := metaResult{
+		Name:  "wordpress",
+		Attrs: map[string]string{"b": "2", "a": "1"},
+	}
+	handler := SingleIncludeHandler(func(id *ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
+		return result, nil
+	})
+	h := New(&Handlers{
+		Meta: map[string]BulkIncludeHandler{
+			"foo": handler,
+			"bar": handler,
+		},
+		MetaYAML: map[string]bool{
+			"foo": true,
+		},
+	}, alwaysContext)
+	for i, test := range metaYAMLTests {
+		c.Logf("test %d: %s", i, test.about)
+		req, err := http.NewRequest("GET", test.url, nil)
+		c.Assert(err, gc.Equals, nil)
+		if test.accept != "" {
+			req.Header.Set("Accept", test.accept)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body))
+		if !test.expectYAML {
+			c.Assert(rec.Header().Get("Content-Type"), gc.Equals, "application/json")
+			continue
+		}
+		c.Assert(rec.Header().Get("Content-Type"), gc.Equals, "application/yaml")
+		c.Assert(rec.Header().Get("Vary"), gc.Equals, "Accept")
+		c.Assert(rec.Header().Get("Content-Length"), gc.Equals, strconv.Itoa(rec.Body.Len()))
+		c.Assert(rec.Body.String(), gc.Equals, "name: wordpress\nattrs:\n  a: \"1\"\n  b: \"2\"\n")
+		var got metaResult
+		err = yaml.Unmarshal(rec.Body.Bytes(), &got)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(got, jc.DeepEquals, result)
+	}
+}
+
 func (s *RouterSuite) TestWriteError(c *gc.C) {
 	rec := httptest.NewRecorder()
 	WriteError(context.TODO(), rec, errgo.Newf("an error"))
@@ -21,6 +21,29 @@ import (
 
 var logger = loggo.GetLogger("charmstore.internal.router")
 
+// ErrEntityTooLarge is the error code used when an uploaded charm or
+// bundle exceeds one of the configured size limits. The params package
+// does not define this code, so it is defined here alongside its HTTP
+// status.
+const ErrEntityTooLarge params.ErrorCode = "entity too large"
+
+// The following error codes are used by the tus resumable upload
+// endpoints, which must return specific HTTP statuses that have no
+// equivalent in the params package.
+const (
+	// ErrConflict is used when a request conflicts with the
+	// current state of the resource.
+	ErrConflict params.ErrorCode = "conflict"
+
+	// ErrPreconditionFailed is used when a required request
+	// header has an unsupported value.
+	ErrPreconditionFailed params.ErrorCode = "precondition failed"
+
+	// ErrUnsupportedMediaType is used when a request body has
+	// an unexpected content type.
+	ErrUnsupportedMediaType params.ErrorCode = "unsupported media type"
+)
+
 // WriteError can be used to write an error response.
 var WriteError = errorToResp.WriteError
 
@@ -96,6 +119,14 @@ func errorToResp1(err error) (int, interface{}) {
 		status = http.StatusMethodNotAllowed
 	case params.ErrServiceUnavailable:
 		status = http.StatusServiceUnavailable
+	case ErrEntityTooLarge:
+		status = http.StatusRequestEntityTooLarge
+	case ErrConflict:
+		status = http.StatusConflict
+	case ErrPreconditionFailed:
+		status = http.StatusPreconditionFailed
+	case ErrUnsupportedMediaType:
+		status = http.StatusUnsupportedMediaType
 	}
 	return status, errorBody
 }
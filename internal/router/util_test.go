@@ -10,8 +10,10 @@ import (
 	"net/url"
 	"strings"
 
+	"github.com/juju/charmrepo/v6/csclient/params"
 	jujutesting "github.com/juju/testing"
 	jc "github.com/juju/testing/checkers"
+	"github.com/juju/testing/httptesting"
 	gc "gopkg.in/check.v1"
 	"gopkg.in/errgo.v1"
 
@@ -293,3 +295,50 @@ func (*utilSuite) TestUnmarshalJSONObject(c *gc.C) {
 		c.Assert(string(v), jc.JSONEquals, test.expectValue)
 	}
 }
+
+func (*utilSuite) TestHandleErrorsEntityTooLarge(c *gc.C) {
+	h := router.HandleErrors(func(http.ResponseWriter, *http.Request) error {
+		return errgo.WithCausef(nil, router.ErrEntityTooLarge, "bundle archive too large")
+	})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      h,
+		URL:          "/",
+		ExpectStatus: http.StatusRequestEntityTooLarge,
+		ExpectBody: params.Error{
+			Code:    router.ErrEntityTooLarge,
+			Message: "bundle archive too large",
+		},
+	})
+}
+
+var handleErrorsStatusTests = []struct {
+	code         params.ErrorCode
+	expectStatus int
+}{{
+	code:         router.ErrConflict,
+	expectStatus: http.StatusConflict,
+}, {
+	code:         router.ErrPreconditionFailed,
+	expectStatus: http.StatusPreconditionFailed,
+}, {
+	code:         router.ErrUnsupportedMediaType,
+	expectStatus: http.StatusUnsupportedMediaType,
+}}
+
+func (*utilSuite) TestHandleErrorsStatus(c *gc.C) {
+	for i, test := range handleErrorsStatusTests {
+		c.Logf("test %d: %s", i, test.code)
+		h := router.HandleErrors(func(http.ResponseWriter, *http.Request) error {
+			return errgo.WithCausef(nil, test.code, "some error")
+		})
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:      h,
+			URL:          "/",
+			ExpectStatus: test.expectStatus,
+			ExpectBody: params.Error{
+				Code:    test.code,
+				Message: "some error",
+			},
+		})
+	}
+}
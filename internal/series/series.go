@@ -93,3 +93,43 @@ var Series = map[string]SeriesInfo{
 	// Kubernetes
 	"kubernetes": {true, Kubernetes, true, 1.1},
 }
+
+// baseSeries holds the series name for each known base, keyed by
+// operating system and then by version.
+var baseSeries = map[Distribution]map[string]string{
+	Ubuntu: {
+		"11.10": "oneiric",
+		"12.04": "precise",
+		"12.10": "quantal",
+		"13.04": "raring",
+		"13.10": "saucy",
+		"14.04": "trusty",
+		"14.10": "utopic",
+		"15.04": "vivid",
+		"15.10": "wily",
+		"16.04": "xenial",
+		"16.10": "yakkety",
+		"17.04": "zesty",
+		"17.10": "artful",
+		"18.04": "bionic",
+		"18.10": "cosmic",
+		"19.04": "disco",
+		"19.10": "eoan",
+		"20.04": "focal",
+		"20.10": "groovy",
+		"21.04": "hirsute",
+		"21.10": "impish",
+		"22.04": "jammy",
+	},
+	CentOS: {
+		"7": "centos7",
+	},
+}
+
+// SeriesForBase returns the series name corresponding to the base with
+// the given operating system and version, for example "ubuntu" and
+// "20.04". It reports whether the base is known.
+func SeriesForBase(os, version string) (string, bool) {
+	s, ok := baseSeries[Distribution(os)][version]
+	return s, ok
+}
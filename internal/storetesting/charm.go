@@ -86,9 +86,11 @@ func NewBundleWithOverlaysFlag(data *charm.BundleData, containsOverlays bool) *B
 // Note that because it implements charmstore.ArchiverTo,
 // it can be used as an argument to charmstore.Store.AddCharmWithArchive.
 type Charm struct {
-	blob    *Blob
-	meta    *charm.Meta
-	metrics *charm.Metrics
+	blob       *Blob
+	meta       *charm.Meta
+	metrics    *charm.Metrics
+	assumes    []interface{}
+	lxdProfile *charm.LXDProfile
 }
 
 var _ charm.Charm = (*Charm)(nil)
@@ -113,6 +115,17 @@ func (c *Charm) initBlob() {
 	if err != nil {
 		panic(err)
 	}
+	if c.assumes != nil {
+		// The charm package does not know about assumes
+		// blocks, so add it to the metadata separately.
+		assumesYAML, err := yaml.Marshal(map[string]interface{}{
+			"assumes": c.assumes,
+		})
+		if err != nil {
+			panic(err)
+		}
+		metaYAML = append(metaYAML, assumesYAML...)
+	}
 	files := []File{{
 		Name: "metadata.yaml",
 		Data: metaYAML,
@@ -130,6 +143,16 @@ func (c *Charm) initBlob() {
 			Data: metricsYAML,
 		})
 	}
+	if c.lxdProfile != nil {
+		profileYAML, err := yaml.Marshal(c.lxdProfile)
+		if err != nil {
+			panic(err)
+		}
+		files = append(files, File{
+			Name: "lxd-profile.yaml",
+			Data: profileYAML,
+		})
+	}
 	c.blob = NewBlob(files)
 }
 
@@ -138,6 +161,21 @@ func (c *Charm) WithMetrics(metrics *charm.Metrics) *Charm {
 	return c
 }
 
+// WithAssumes adds an assumes block holding the given expressions to
+// the charm's metadata. Each expression is either a string or a map
+// holding an "any-of" or "all-of" key.
+func (c *Charm) WithAssumes(assumes ...interface{}) *Charm {
+	c.assumes = assumes
+	return c
+}
+
+// WithLXDProfile adds an lxd-profile.yaml file holding the given
+// profile to the charm.
+func (c *Charm) WithLXDProfile(profile *charm.LXDProfile) *Charm {
+	c.lxdProfile = profile
+	return c
+}
+
 // Meta implements charm.Charm.Meta.
 func (c *Charm) Meta() *charm.Meta {
 	return c.meta
@@ -251,7 +289,9 @@ func MetaWithSupportedSeries(m *charm.Meta, series ...string) *charm.Meta {
 // with the given relations, where each relation
 // is specified as a white-space-separated
 // triple:
+//
 //	role name interface
+//
 // where role specifies the role of the interface
 // (provides or requires), name holds the relation
 // name and interface holds the interface relation type.
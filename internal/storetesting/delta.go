@@ -0,0 +1,72 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package storetesting // import "gopkg.in/juju/charmstore.v5/internal/storetesting"
+
+import (
+	"bytes"
+)
+
+// Delta returns a VCDIFF delta (see RFC 3284) that transforms source
+// into target. The delta copies the longest common prefix and suffix
+// of the two from source and adds everything else literally, so it is
+// only suitable for tests.
+func Delta(source, target []byte) []byte {
+	prefix := 0
+	for prefix < len(source) && prefix < len(target) && source[prefix] == target[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(source)-prefix && suffix < len(target)-prefix && source[len(source)-1-suffix] == target[len(target)-1-suffix] {
+		suffix++
+	}
+	var data, inst, addr bytes.Buffer
+	if prefix > 0 {
+		// COPY with mode VCD_SELF and an explicit size.
+		inst.WriteByte(19)
+		writeDeltaInt(&inst, prefix)
+		writeDeltaInt(&addr, 0)
+	}
+	if middle := target[prefix : len(target)-suffix]; len(middle) > 0 {
+		// ADD with an explicit size.
+		inst.WriteByte(1)
+		writeDeltaInt(&inst, len(middle))
+		data.Write(middle)
+	}
+	if suffix > 0 {
+		inst.WriteByte(19)
+		writeDeltaInt(&inst, suffix)
+		writeDeltaInt(&addr, len(source)-suffix)
+	}
+	var enc bytes.Buffer
+	writeDeltaInt(&enc, len(target))
+	enc.WriteByte(0)
+	writeDeltaInt(&enc, data.Len())
+	writeDeltaInt(&enc, inst.Len())
+	writeDeltaInt(&enc, addr.Len())
+	enc.Write(data.Bytes())
+	enc.Write(inst.Bytes())
+	enc.Write(addr.Bytes())
+
+	var delta bytes.Buffer
+	delta.Write([]byte{0xd6, 0xc3, 0xc4, 0x00, 0x00})
+	// A single window using the whole of source as its source segment.
+	delta.WriteByte(0x01)
+	writeDeltaInt(&delta, len(source))
+	writeDeltaInt(&delta, 0)
+	writeDeltaInt(&delta, enc.Len())
+	delta.Write(enc.Bytes())
+	return delta.Bytes()
+}
+
+// writeDeltaInt writes n to buf as a VCDIFF variable length integer.
+func writeDeltaInt(buf *bytes.Buffer, n int) {
+	var b [10]byte
+	i := len(b) - 1
+	b[i] = byte(n & 0x7f)
+	for n >>= 7; n > 0; n >>= 7 {
+		i--
+		b[i] = byte(n&0x7f) | 0x80
+	}
+	buf.Write(b[i:])
+}
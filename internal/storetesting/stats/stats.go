@@ -4,6 +4,7 @@
 package stats // import "gopkg.in/juju/charmstore.v5/internal/storetesting/stats"
 
 import (
+	"reflect"
 	"time"
 
 	gc "gopkg.in/check.v1"
@@ -49,6 +50,23 @@ func CheckTotalDownloads(c *gc.C, store *charmstore.Store, id *charm.URL, expect
 	c.Errorf("total downloads for %#v is %d, want %d", id, counts.Total, expected)
 }
 
+// CheckDownloadsByClient checks that the all-time download counts of
+// the entity with the given id, keyed by client type, eventually match
+// expected.
+func CheckDownloadsByClient(c *gc.C, store *charmstore.Store, id *charm.URL, expected map[string]int64) {
+	var counts map[string]int64
+	for retry := 0; retry < 10; retry++ {
+		var err error
+		time.Sleep(100 * time.Millisecond)
+		counts, err = store.ArchiveDownloadCountsByClient(id)
+		c.Assert(err, gc.Equals, nil)
+		if reflect.DeepEqual(counts, expected) {
+			return
+		}
+	}
+	c.Errorf("downloads by client for %#v are %v, want %v", id, counts, expected)
+}
+
 // ThisWeek processes the given day-count mappings, and calculates how
 // many of the counts occurred in the current week. This is necessary as
 // weekly stats are grouped by ISO8601 week, and therefore the value
@@ -39,6 +39,12 @@ var reqHandlerPool = mempool.Pool{
 type Handler struct {
 	*v5.Handler
 	readOnly bool
+
+	// maxMetaIds and maxMetaIncludes hold the limits on bulk meta
+	// requests, as configured with ServerParams.MaxMetaResponseEntities
+	// and ServerParams.MaxMetaIncludes.
+	maxMetaIds      int
+	maxMetaIncludes int
 }
 
 type ReqHandler struct {
@@ -51,8 +57,10 @@ func New(p charmstore.APIHandlerParams) (Handler, error) {
 		return Handler{}, errgo.Mask(err)
 	}
 	return Handler{
-		Handler:  h,
-		readOnly: p.ReadOnly,
+		Handler:         h,
+		readOnly:        p.ReadOnly,
+		maxMetaIds:      p.MaxMetaResponseEntities,
+		maxMetaIncludes: p.MaxMetaIncludes,
 	}, nil
 }
 
@@ -114,6 +122,8 @@ func (h *Handler) NewReqHandler(req *http.Request) (ReqHandler, error) {
 	}
 	rh := reqHandlerPool.Get().(ReqHandler)
 	rh.Handler = h.Handler
+	rh.Router.MaxMetaIds = h.maxMetaIds
+	rh.Router.MaxMetaIncludes = h.maxMetaIncludes
 	rh.Store = &v5.StoreWithChannel{
 		Store:   store,
 		Channel: params.Channel(req.Form.Get("channel")),
@@ -141,12 +151,19 @@ func newReqHandler() ReqHandler {
 	handlers.Meta["hash256"] = h.EntityHandler(h.metaHash256, "prev5blobhash256")
 	handlers.Id["expand-id"] = resolveId(authId(h.serveExpandId))
 	handlers.Id["archive"] = h.serveArchive(handlers.Id["archive"])
-	handlers.Id["archive/"] = resolveId(authId(h.serveArchiveFile))
+	handlers.Id["archive/"] = resolveId(h.serveArchiveFile)
 
 	// Delete new endpoints that we don't want to provide in v4.
 	delete(handlers.Id, "publish")
 	delete(handlers.Id, "resource")
 	delete(handlers.Id, "allperms")
+	delete(handlers.Id, "reserve")
+	delete(handlers.Id, "approve-publish")
+
+	delete(handlers.MetaPost, "resources/download-urls")
+
+	// YAML metadata responses are only provided in v5.
+	handlers.MetaYAML = nil
 
 	delete(handlers.Meta, "published")
 	delete(handlers.Meta, "resources")
@@ -155,9 +172,44 @@ func newReqHandler() ReqHandler {
 	delete(handlers.Meta, "can-write")
 	delete(handlers.Meta, "promulgated-id")
 	delete(handlers.Meta, "unpromulgated-id")
-
+	delete(handlers.Meta, "min-juju-version")
+	delete(handlers.Meta, "channel-heads")
+	delete(handlers.Meta, "channel-status")
+	delete(handlers.Meta, "bundle-closure")
+	delete(handlers.Meta, "channel-history")
+	delete(handlers.Meta, "published-time")
+	delete(handlers.Meta, "charm-storage")
+	delete(handlers.Meta, "charm-devices")
+	delete(handlers.Meta, "archive-tree")
+	delete(handlers.Meta, "audit")
+	delete(handlers.Meta, "can-deploy")
+	delete(handlers.Meta, "yanked")
+	delete(handlers.Meta, "assumes")
+	delete(handlers.Meta, "lxd-profile")
+	delete(handlers.Meta, "provenance")
+	delete(handlers.Meta, "highest-revision")
+	delete(handlers.Meta, "charm-containers")
+	delete(handlers.Meta, "extra-bindings")
+
+	delete(handlers.Global, "admin/api-tokens")
+	delete(handlers.Global, "admin/charm-metrics")
+	delete(handlers.Global, "admin/download-counts")
+	delete(handlers.Global, "admin/duplicate-blobs")
+	delete(handlers.Global, "admin/flush-group-cache")
+	delete(handlers.Global, "admin/reindex")
+	delete(handlers.Global, "admin/reindex/")
+	delete(handlers.Global, "admin/search-dump")
+	delete(handlers.Global, "admin/summary")
+	delete(handlers.Global, "admin/upload-blocklist")
 	delete(handlers.Global, "upload")
 	delete(handlers.Global, "upload/")
+	delete(handlers.Global, "meta/candidates")
+	delete(handlers.Global, "pending-publishes")
+	delete(handlers.Global, "perms-batch")
+	delete(handlers.Global, "feed/recent")
+	delete(handlers.Global, "resources-by-hash/")
+	delete(handlers.Global, "suggest")
+	delete(handlers.Global, "trending")
 
 	h.Router = router.New(handlers, h)
 	return h
@@ -330,13 +330,11 @@ var metaEndpoints = []metaEndpoint{{
 	name: "stats",
 	get: func(store *charmstore.Store, url *router.ResolvedURL) (interface{}, error) {
 		// The entities used for those tests were never downloaded.
-		return &params.StatsResponse{
-			ArchiveDownloadCount: 0,
-		}, nil
+		return &v5.StatsResponse{}, nil
 	},
 	checkURL: newResolvedURL("~charmers/precise/wordpress-23", 23),
 	assertCheckData: func(c *gc.C, data interface{}) {
-		c.Assert(data, gc.FitsTypeOf, (*params.StatsResponse)(nil))
+		c.Assert(data, gc.FitsTypeOf, (*v5.StatsResponse)(nil))
 	},
 }, {
 	name: "extra-info",
@@ -3440,6 +3438,50 @@ func entityACLs(store *charmstore.Store, url *router.ResolvedURL) (mongodoc.ACL,
 	return be.ChannelACLs[ch], nil
 }
 
+type metaLimitsSuite struct {
+	commonSuite
+}
+
+var _ = gc.Suite(&metaLimitsSuite{})
+
+func (s *metaLimitsSuite) SetUpSuite(c *gc.C) {
+	s.maxMetaResponseEntities = 2
+	s.maxMetaIncludes = 2
+	s.commonSuite.SetUpSuite(c)
+}
+
+func (s *metaLimitsSuite) TestMetaLimits(c *gc.C) {
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("cs:~charmers/precise/wordpress-23", 23))
+	s.addPublicCharmFromRepo(c, "mysql", newResolvedURL("cs:~charmers/precise/mysql-5", 5))
+	s.addPublicCharmFromRepo(c, "varnish", newResolvedURL("cs:~charmers/precise/varnish-1", 1))
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		URL:     storeURL("meta/id-name?id=precise/wordpress-23&id=precise/mysql-5"),
+		ExpectBody: map[string]params.IdNameResponse{
+			"precise/wordpress-23": {Name: "wordpress"},
+			"precise/mysql-5":      {Name: "mysql"},
+		},
+	})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("meta/id-name?id=precise/wordpress-23&id=precise/mysql-5&id=precise/varnish-1"),
+		ExpectStatus: http.StatusBadRequest,
+		ExpectBody: params.Error{
+			Code:    params.ErrBadRequest,
+			Message: "too many ids in meta request (3 > 2)",
+		},
+	})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("meta/any?id=precise/wordpress-23&include=id-name&include=id-revision&include=id-series"),
+		ExpectStatus: http.StatusBadRequest,
+		ExpectBody: params.Error{
+			Code:    params.ErrBadRequest,
+			Message: "too many includes in meta request (3 > 2)",
+		},
+	})
+}
+
 // V4 SPECIFIC
 // v4BundleMetadata creates a representation of data with the v4
 // compatible format.
@@ -11,7 +11,7 @@ import (
 
 	"gopkg.in/juju/charmstore.v5/internal/charm"
 	"gopkg.in/juju/charmstore.v5/internal/router"
-	v5 "gopkg.in/juju/charmstore.v5/internal/v5"
+	"gopkg.in/juju/charmstore.v5/internal/v5"
 )
 
 // serveArchive returns a handler for /archive that falls back to v5ServeArchive
@@ -25,12 +25,22 @@ func (h ReqHandler) serveArchive(v5ServeArchive router.IdHandler) router.IdHandl
 		case "DELETE":
 			return errgo.WithCausef(nil, params.ErrMethodNotAllowed, "DELETE not allowed")
 		}
-		return v5ServeArchive(id, w, req)
+		err := v5ServeArchive(id, w, req)
+		if v5.IsNotZipArchive(err) {
+			// The v4 API has always reported an upload that is
+			// not a zip file as an invalid entity.
+			kind := "charm"
+			if id.Series == "bundle" {
+				kind = "bundle"
+			}
+			return errgo.WithCausef(nil, params.ErrInvalidEntity, "cannot read %s archive: zip: not a valid zip file", kind)
+		}
+		return err
 	}
 }
 
 func (h ReqHandler) serveGetArchive(id *router.ResolvedURL, w http.ResponseWriter, req *http.Request) error {
-	if err := h.AuthorizeEntityForOp(id, req, v5.OpReadWithTerms); err != nil {
+	if err := h.AuthorizeArchiveDownload(id, req); err != nil {
 		return errgo.Mask(err, errgo.Any)
 	}
 	blob, err := h.Store.OpenBlobPreV5(id)
@@ -38,13 +48,18 @@ func (h ReqHandler) serveGetArchive(id *router.ResolvedURL, w http.ResponseWrite
 		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
 	}
 	defer blob.Close()
-	h.SendEntityArchive(id, w, req, blob)
+	// The v4 API has always suggested a file name of the form
+	// "name.zip".
+	h.SendEntityArchiveWithDisposition(id, w, req, blob, "attachment; filename="+id.PreferredURL().Name+".zip")
 	return nil
 }
 
 // GET id/archive/path
 // https://github.com/juju/charmstore/blob/v4/docs/API.md#get-idarchivepath
 func (h ReqHandler) serveArchiveFile(id *router.ResolvedURL, w http.ResponseWriter, req *http.Request) error {
+	if err := h.AuthorizeArchiveDownload(id, req); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
 	blob, err := h.Store.OpenBlobPreV5(id)
 	if err != nil {
 		return errgo.Notef(err, "cannot open archive data for %v", id)
@@ -33,6 +33,7 @@ import (
 	"gopkg.in/juju/charmstore.v5/internal/router"
 	"gopkg.in/juju/charmstore.v5/internal/storetesting"
 	"gopkg.in/juju/charmstore.v5/internal/storetesting/stats"
+	v4 "gopkg.in/juju/charmstore.v5/internal/v4"
 	v5 "gopkg.in/juju/charmstore.v5/internal/v5"
 )
 
@@ -59,6 +60,7 @@ func (s *ArchiveSuite) TestGet(c *gc.C) {
 		ch.Bytes(),
 	)
 	c.Assert(rec.Header().Get(params.EntityIdHeader), gc.Equals, "cs:~charmers/precise/wordpress-0")
+	c.Assert(rec.Header().Get("Content-Disposition"), gc.Equals, "attachment; filename=wordpress.zip")
 	assertCacheControl(c, rec.Header(), true)
 
 	// Check that the HTTP range logic is plugged in OK. If this
@@ -77,6 +79,42 @@ func (s *ArchiveSuite) TestGet(c *gc.C) {
 	assertCacheControl(c, rec.Header(), true)
 }
 
+func (s *ArchiveSuite) TestGetRequirePublishedForDownload(c *gc.C) {
+	config := s.srvParams
+	config.RequirePublishedForDownload = true
+	srv, err := charmstore.NewServer(s.Session.DB("charmstore"), nil, config, map[string]charmstore.NewAPIHandlerFunc{"v4": v4.NewAPIHandler})
+	c.Assert(err, gc.Equals, nil)
+	defer srv.Close()
+
+	// An unpublished charm cannot be downloaded by a user that can
+	// only read it, but its owner can download it.
+	id := newResolvedURL("cs:~charmers/precise/mysql-0", -1)
+	err = s.store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.SetPerms(&id.URL, "unpublished.read", params.Everyone)
+	c.Assert(err, gc.Equals, nil)
+	for _, path := range []string{"archive", "archive/metadata.yaml"} {
+		s.idmServer.SetDefaultUser("bob")
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:      srv,
+			URL:          storeURL("~charmers/precise/mysql-0/" + path),
+			Do:           bakeryDo(nil),
+			ExpectStatus: http.StatusUnauthorized,
+			ExpectBody: params.Error{
+				Message: `access denied for user "bob"`,
+				Code:    params.ErrUnauthorized,
+			},
+		})
+		s.idmServer.SetDefaultUser("charmers")
+		rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+			Handler: srv,
+			URL:     storeURL("~charmers/precise/mysql-0/" + path),
+			Do:      bakeryDo(nil),
+		})
+		c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.Bytes()))
+	}
+}
+
 func (s *ArchiveSuite) TestGetWithPartialId(c *gc.C) {
 	id := newResolvedURL("cs:~charmers/precise/wordpress-0", -1)
 	ch := storetesting.NewCharm(nil)
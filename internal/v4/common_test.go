@@ -93,6 +93,12 @@ type commonSuite struct {
 	// maxMgoSessions specifies the value that will be given
 	// to config.MaxMgoSessions when calling charmstore.NewServer.
 	maxMgoSessions int
+
+	// maxMetaResponseEntities and maxMetaIncludes specify the values
+	// that will be given to config.MaxMetaResponseEntities and
+	// config.MaxMetaIncludes when calling charmstore.NewServer.
+	maxMetaResponseEntities int
+	maxMetaIncludes         int
 }
 
 func (s *commonSuite) SetUpSuite(c *gc.C) {
@@ -139,13 +145,15 @@ func (s *commonSuite) startServer(c *gc.C) {
 	// Disable group caching.
 	s.PatchValue(&v5.PermCacheExpiry, time.Duration(0))
 	config := charmstore.ServerParams{
-		AuthUsername:     testUsername,
-		AuthPassword:     testPassword,
-		StatsCacheMaxAge: time.Nanosecond,
-		MaxMgoSessions:   s.maxMgoSessions,
-		AgentUsername:    "notused",
-		AgentKey:         new(bakery.KeyPair),
-		ReadOnly:         s.readOnly,
+		AuthUsername:            testUsername,
+		AuthPassword:            testPassword,
+		StatsCacheMaxAge:        time.Nanosecond,
+		MaxMgoSessions:          s.maxMgoSessions,
+		AgentUsername:           "notused",
+		AgentKey:                new(bakery.KeyPair),
+		ReadOnly:                s.readOnly,
+		MaxMetaResponseEntities: s.maxMetaResponseEntities,
+		MaxMetaIncludes:         s.maxMetaIncludes,
 	}
 	keyring := httpbakery.NewPublicKeyRing(nil, nil)
 	keyring.AllowInsecure()
@@ -7,18 +7,21 @@ import (
 	"archive/zip"
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/juju/charmrepo/v6/csclient/params"
 	"github.com/juju/idmclient"
 	"github.com/juju/loggo"
 	"github.com/juju/mempool"
+	"github.com/juju/version"
 	"golang.org/x/net/context"
 	"gopkg.in/errgo.v1"
 	"gopkg.in/httprequest.v1"
@@ -36,6 +39,7 @@ import (
 	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
 	"gopkg.in/juju/charmstore.v5/internal/monitoring"
 	"gopkg.in/juju/charmstore.v5/internal/router"
+	"gopkg.in/juju/charmstore.v5/internal/series"
 )
 
 // SetAuthCookie holds the parameters used to make a set-auth-cookie request
@@ -72,6 +76,10 @@ type Handler struct {
 	// parameters of the search. It should only be used for searches
 	// from unauthenticated users.
 	searchCache *cache.Cache
+
+	// archiveTreeCache is a cache of archive trees
+	// keyed on the hash of the archive blob.
+	archiveTreeCache *cache.Cache
 }
 
 // ReqHandler holds the context for a single HTTP request.
@@ -109,13 +117,18 @@ const (
 // and group membership information will be cached for.
 var PermCacheExpiry = time.Minute
 
+// MetaGzipThreshold holds the size in bytes above which metadata
+// responses are gzip-compressed for clients that accept it.
+var MetaGzipThreshold = 8 * 1024
+
 func New(params charmstore.APIHandlerParams) (*Handler, error) {
 	return &Handler{
-		Pool:        params.Pool,
-		config:      params.ServerParams,
-		rootPath:    params.Path,
-		searchCache: cache.New(params.SearchCacheMaxAge),
-		idmClient:   params.IDMClient,
+		Pool:             params.Pool,
+		config:           params.ServerParams,
+		rootPath:         params.Path,
+		searchCache:      cache.New(params.SearchCacheMaxAge),
+		archiveTreeCache: cache.New(archiveTreeCacheMaxAge),
+		idmClient:        params.IDMClient,
 	}, nil
 }
 
@@ -148,16 +161,38 @@ var (
 type StoreWithChannel struct {
 	*charmstore.Store
 	Channel params.Channel
+
+	// At holds the time at which channel heads are resolved.
+	// If it is zero, the currently published entities are used.
+	At time.Time
+
+	// Arch holds the architecture that resolved entities must
+	// support. If it is empty, entities for any architecture
+	// may be used.
+	Arch string
 }
 
 func (s *StoreWithChannel) FindBestEntity(url *charm.URL, fields map[string]int) (*mongodoc.Entity, error) {
-	return s.Store.FindBestEntity(url, s.Channel, fields)
+	return s.Store.FindBestEntityForArch(url, s.Channel, s.At, s.Arch, fields)
 }
 
 func (s *StoreWithChannel) FindBaseEntity(url *charm.URL, fields map[string]int) (*mongodoc.BaseEntity, error) {
 	return s.Store.FindBaseEntity(url, fields)
 }
 
+// lastRequestId holds the id most recently generated by requestId.
+var lastRequestId uint64
+
+// requestId returns the id used to identify the given request in trace
+// spans. The X-Request-Id header is used if present; otherwise a new
+// id is generated.
+func requestId(req *http.Request) string {
+	if id := req.Header.Get("X-Request-Id"); id != "" {
+		return id
+	}
+	return strconv.FormatUint(atomic.AddUint64(&lastRequestId, 1), 10)
+}
+
 // NewReqHandler returns an instance of a *ReqHandler
 // suitable for handling the given HTTP request. After use, the ReqHandler.Close
 // method should be called to close it.
@@ -177,6 +212,18 @@ func (h *Handler) NewReqHandler(req *http.Request) (*ReqHandler, error) {
 			return nil, badRequestf(nil, "invalid channel %q specified in request", ch)
 		}
 	}
+	channel := params.Channel(req.Form.Get("channel"))
+	var at time.Time
+	if s := req.Form.Get("at"); s != "" {
+		var err error
+		at, err = time.Parse(time.RFC3339, s)
+		if err != nil {
+			return nil, badRequestf(err, "invalid at value %q specified in request", s)
+		}
+		if channel == params.UnpublishedChannel {
+			return nil, badRequestf(nil, "at cannot be specified with the %s channel", channel)
+		}
+	}
 	store, err := h.Pool.RequestStore()
 	if err != nil {
 		if errgo.Cause(err) == charmstore.ErrTooManySessions {
@@ -184,11 +231,23 @@ func (h *Handler) NewReqHandler(req *http.Request) (*ReqHandler, error) {
 		}
 		return nil, errgo.Mask(err)
 	}
+	if charmstore.TracingEnabled() {
+		store.SetTracer(&charmstore.Tracer{
+			RequestId: requestId(req),
+		})
+	}
 	rh := reqHandlerPool.Get().(*ReqHandler)
 	rh.Handler = h
+	rh.Router.MetaGzipThreshold = MetaGzipThreshold
+	rh.Router.MaxMetaIds = h.config.MaxMetaResponseEntities
+	rh.Router.MaxMetaIncludes = h.config.MaxMetaIncludes
 	rh.Store = &StoreWithChannel{
 		Store:   store,
-		Channel: params.Channel(req.Form.Get("channel")),
+		Channel: channel,
+		At:      at,
+	}
+	if !canDeployRequest(req) {
+		rh.Store.Arch = req.Form.Get("arch")
 	}
 	rh.Cache = entitycache.New(rh.Store)
 	rh.Cache.AddEntityFields(RequiredEntityFields)
@@ -196,6 +255,22 @@ func (h *Handler) NewReqHandler(req *http.Request) (*ReqHandler, error) {
 	return rh, nil
 }
 
+// canDeployRequest reports whether the given request asks for
+// meta/can-deploy, either directly or with an include parameter. The
+// arch parameter of such a request holds the architecture to check,
+// so it must not restrict which entity an id resolves to.
+func canDeployRequest(req *http.Request) bool {
+	if strings.HasSuffix(strings.TrimSuffix(req.URL.Path, "/"), "/meta/can-deploy") {
+		return true
+	}
+	for _, include := range req.Form["include"] {
+		if include == "can-deploy" {
+			return true
+		}
+	}
+	return false
+}
+
 // RouterHandlers returns router handlers that will route requests to
 // the given ReqHandler. This is provided so that different API versions
 // can override selected parts of the handlers to serve their own API
@@ -205,52 +280,82 @@ func RouterHandlers(h *ReqHandler) *router.Handlers {
 	authId := h.AuthIdHandler
 	return &router.Handlers{
 		Global: map[string]http.Handler{
-			"changes/published":    router.HandleJSON(h.serveChangesPublished),
-			"debug":                http.HandlerFunc(h.serveDebug),
-			"debug/pprof/":         newPprofHandler(h),
-			"debug/status":         router.HandleJSON(h.serveDebugStatus),
-			"list":                 router.HandleJSON(h.serveList),
-			"log":                  router.HandleErrors(h.serveLog),
-			"logout":               http.HandlerFunc(logout),
-			"search":               router.HandleJSON(h.serveSearch),
-			"search/interesting":   http.HandlerFunc(h.serveSearchInteresting),
-			"set-auth-cookie":      router.HandleErrors(h.serveSetAuthCookie),
-			"stats/":               router.NotFoundHandler(),
-			"stats/counter/":       router.HandleJSON(h.serveStatsCounter),
-			"stats/update":         router.HandleErrors(h.serveStatsUpdate),
-			"macaroon":             router.HandleJSON(h.serveMacaroon),
-			"delegatable-macaroon": router.HandleJSON(h.serveDelegatableMacaroon),
-			"whoami":               router.HandleJSON(h.serveWhoAmI),
-			"upload":               router.HandleErrors(h.serveUploadId),
-			"upload/":              router.HandleErrors(h.serveUploadPart),
+			"admin/api-tokens":        router.HandleErrors(h.serveAdminAPITokens),
+			"admin/charm-metrics":     router.HandleErrors(h.serveAdminCharmMetrics),
+			"admin/download-counts":   router.HandleJSON(h.serveAdminDownloadCounts),
+			"admin/duplicate-blobs":   router.HandleJSON(h.serveAdminDuplicateBlobs),
+			"admin/flush-group-cache": router.HandleErrors(h.serveAdminFlushGroupCache),
+			"admin/reindex":           router.HandleJSON(h.serveAdminReindex),
+			"admin/reindex/":          router.HandleJSON(h.serveAdminReindexJob),
+			"admin/search-dump":       router.HandleErrors(h.serveAdminSearchDump),
+			"admin/summary":           router.HandleJSON(h.serveAdminSummary),
+			"admin/upload-blocklist":  router.HandleErrors(h.serveAdminUploadBlocklist),
+			"changes/published":       router.HandleJSON(h.serveChangesPublished),
+			"debug":                   http.HandlerFunc(h.serveDebug),
+			"debug/pprof/":            newPprofHandler(h),
+			"debug/status":            router.HandleJSON(h.serveDebugStatus),
+			"feed/recent":             router.HandleJSON(h.serveFeedRecent),
+			"list":                    router.HandleJSON(h.serveList),
+			"log":                     router.HandleErrors(h.serveLog),
+			"logout":                  http.HandlerFunc(logout),
+			"meta/candidates":         router.HandleJSON(h.serveCandidates),
+			"pending-publishes":       router.HandleJSON(h.servePendingPublishes),
+			"perms-batch":             router.HandleErrors(h.servePermsBatch),
+			"resources-by-hash/":      router.HandleJSON(h.serveResourcesByHash),
+			"search":                  router.HandleJSON(h.serveSearch),
+			"search/interesting":      http.HandlerFunc(h.serveSearchInteresting),
+			"set-auth-cookie":         router.HandleErrors(h.serveSetAuthCookie),
+			"stats/":                  router.NotFoundHandler(),
+			"stats/counter/":          router.HandleJSON(h.serveStatsCounter),
+			"stats/update":            router.HandleErrors(h.serveStatsUpdate),
+			"suggest":                 router.HandleJSON(h.serveSuggest),
+			"trending":                router.HandleJSON(h.serveTrending),
+			"macaroon":                router.HandleJSON(h.serveMacaroon),
+			"delegatable-macaroon":    router.HandleJSON(h.serveDelegatableMacaroon),
+			"whoami":                  router.HandleJSON(h.serveWhoAmI),
+			"upload":                  router.HandleErrors(h.serveUploadId),
+			"upload/":                 router.HandleErrors(h.serveUploadPart),
 		},
 		Id: map[string]router.IdHandler{
 			"archive":                     h.serveArchive,
-			"archive/":                    resolveId(authId(h.serveArchiveFile), "blobhash", "blobhash"),
+			"archive/":                    h.archivePathHandler(resolveId(h.serveArchiveFile, "blobhash", "blobhash")),
 			"diagram.svg":                 resolveId(authId(h.serveDiagram), "bundledata"),
 			"expand-id":                   resolveId(authId(h.serveExpandId)),
 			"icon.svg":                    resolveId(authId(h.serveIcon), "contents", "blobhash"),
 			"publish":                     resolveId(h.servePublish),
+			"approve-publish":             resolveId(h.serveApprovePublish),
 			"promulgate":                  resolveId(h.servePromulgate),
 			"readme":                      resolveId(authId(h.serveReadMe), "contents", "blobhash"),
 			"resource/":                   reqBodyReadHandler(resolveId(authId(h.serveResources), "charmmeta")),
 			"docker-resource-upload-info": resolveId(h.serveDockerResourceUploadInfo, "charmmeta"),
 			"allperms":                    h.serveAllPerms,
+			"reserve":                     h.serveReserve,
 		},
 		Meta: map[string]router.BulkIncludeHandler{
 			"archive-size":         h.EntityHandler(h.metaArchiveSize, "size"),
+			"archive-tree":         h.EntityHandler(h.metaArchiveTree, "blobhash"),
 			"archive-upload-time":  h.EntityHandler(h.metaArchiveUploadTime, "uploadtime"),
+			"assumes":              h.EntityHandler(h.metaAssumes, "assumes"),
+			"audit":                h.EntityHandler(h.metaAudit),
+			"bundle-closure":       h.EntityHandler(h.metaBundleClosure),
 			"bundle-machine-count": h.EntityHandler(h.metaBundleMachineCount, "bundlemachinecount"),
 			"bundle-metadata":      h.EntityHandler(h.metaBundleMetadata, "bundledata"),
 			"bundles-containing":   h.EntityHandler(h.metaBundlesContaining),
 			"bundle-unit-count":    h.EntityHandler(h.metaBundleUnitCount, "bundleunitcount"),
+			"can-deploy":           h.EntityHandler(h.metaCanDeploy, "supportedseries", "charmmeta"),
 			"can-ingest":           h.baseEntityHandler(h.metaCanIngest, "noingest"),
 			"can-write":            h.baseEntityHandler(h.metaCanWrite),
+			"channel-heads":        h.baseEntityHandler(h.metaChannelHeads, "channelacls"),
+			"channel-history":      h.EntityHandler(h.metaChannelHistory, "supportedseries"),
+			"channel-status":       h.baseEntityHandler(h.metaChannelStatus, "channelacls", "channelentities", "publishhistory"),
 			"charm-actions":        h.EntityHandler(h.metaCharmActions, "charmactions"),
 			"charm-config":         h.EntityHandler(h.metaCharmConfig, "charmconfig"),
+			"charm-containers":     h.EntityHandler(h.metaCharmContainers, "charmmeta"),
+			"charm-devices":        h.EntityHandler(h.metaCharmDevices, "charmmeta"),
 			"charm-metadata":       h.EntityHandler(h.metaCharmMetadata, "charmmeta"),
 			"charm-metrics":        h.EntityHandler(h.metaCharmMetrics, "charmmetrics"),
 			"charm-related":        h.EntityHandler(h.metaCharmRelated, "charmprovidedinterfaces", "charmrequiredinterfaces"),
+			"charm-storage":        h.EntityHandler(h.metaCharmStorage, "charmmeta"),
 			"common-info": h.puttableBaseEntityHandler(
 				h.metaCommonInfo,
 				h.putMetaCommonInfo,
@@ -261,6 +366,7 @@ func RouterHandlers(h *ReqHandler) *router.Handlers {
 				h.putMetaCommonInfoWithKey,
 				"commoninfo",
 			),
+			"extra-bindings": h.EntityHandler(h.metaExtraBindings, "charmmeta"),
 			"extra-info": h.puttableEntityHandler(
 				h.metaExtraInfo,
 				h.putMetaExtraInfo,
@@ -273,18 +379,23 @@ func RouterHandlers(h *ReqHandler) *router.Handlers {
 			),
 			"hash256":          h.EntityHandler(h.metaHash256, "blobhash256"),
 			"hash":             h.EntityHandler(h.metaHash, "blobhash"),
+			"highest-revision": h.baseEntityHandler(h.metaHighestRevision),
 			"id":               h.EntityHandler(h.metaId, "_id"),
 			"id-name":          h.EntityHandler(h.metaIdName, "_id"),
 			"id-revision":      h.EntityHandler(h.metaIdRevision, "_id"),
 			"id-series":        h.EntityHandler(h.metaIdSeries, "_id"),
 			"id-user":          h.EntityHandler(h.metaIdUser, "_id"),
+			"lxd-profile":      h.EntityHandler(h.metaLXDProfile, "contents", "blobhash"),
 			"manifest":         h.EntityHandler(h.metaManifest, "blobhash"),
+			"min-juju-version": h.EntityHandler(h.metaMinJujuVersion, "charmmeta"),
 			"owner":            h.EntityHandler(h.metaOwner, "_id"),
 			"perm":             h.puttableBaseEntityHandler(h.metaPerm, h.putMetaPerm, "channelacls"),
 			"perm/":            h.puttableBaseEntityHandler(h.metaPermWithKey, h.putMetaPermWithKey, "channelacls"),
 			"promulgated":      h.baseEntityHandler(h.metaPromulgated, "promulgated"),
 			"promulgated-id":   h.EntityHandler(h.metaPromulgatedId, "_id", "promulgated-url"),
+			"provenance":       h.EntityHandler(h.metaProvenance, "source", "sourceurl"),
 			"published":        h.EntityHandler(h.metaPublished, "published"),
+			"published-time":   h.EntityHandler(h.metaPublishedTime, "published"),
 			"resources":        h.EntityHandler(h.metaResources, "charmmeta"),
 			"resources/":       h.EntityHandler(h.metaResourcesSingle, "charmmeta"),
 			"revision-info":    router.SingleIncludeHandler(h.metaRevisionInfo),
@@ -293,10 +404,19 @@ func RouterHandlers(h *ReqHandler) *router.Handlers {
 			"tags":             h.EntityHandler(h.metaTags, "charmmeta", "bundledata"),
 			"terms":            h.EntityHandler(h.metaTerms, "charmmeta"),
 			"unpromulgated-id": h.EntityHandler(h.metaUnpromulgatedId, "_id"),
+			"yanked":           h.EntityHandler(h.metaYanked, "yanked"),
 
 			// endpoints not yet implemented:
 			// "color": router.SingleIncludeHandler(h.metaColor),
 		},
+		MetaPost: map[string]router.IdHandler{
+			"resources/download-urls": resolveId(h.serveResourceDownloadURLs, "charmmeta"),
+		},
+		MetaYAML: map[string]bool{
+			"charm-actions":  true,
+			"charm-config":   true,
+			"charm-metadata": true,
+		},
 	}
 }
 
@@ -496,6 +616,18 @@ func (h *ReqHandler) updateBaseEntity(id *router.ResolvedURL, fields map[string]
 }
 
 func (h *ReqHandler) updateEntity(id *router.ResolvedURL, fields map[string]interface{}, entries []audit.Entry) error {
+	if h.Handler.config.DedupExtraInfoWrites {
+		if values, ok := extraInfoValues(fields); ok {
+			changed, err := h.Store.UpdateEntityExtraInfo(id, values)
+			if err != nil {
+				return errgo.Notef(err, "cannot update %q", &id.URL)
+			}
+			if changed {
+				h.addAuditForEntries(entries)
+			}
+			return nil
+		}
+	}
 	err := h.Store.UpdateEntity(id, entityUpdateOp(fields))
 	if err != nil {
 		return errgo.Notef(err, "cannot update %q", &id.URL)
@@ -504,6 +636,28 @@ func (h *ReqHandler) updateEntity(id *router.ResolvedURL, fields map[string]inte
 	return nil
 }
 
+// extraInfoValues returns the extra-info values set by the given
+// update fields, keyed by extra-info key, and reports whether all the
+// fields are extra-info fields.
+func extraInfoValues(fields map[string]interface{}) (map[string][]byte, bool) {
+	values := make(map[string][]byte, len(fields))
+	for name, val := range fields {
+		if !strings.HasPrefix(name, "extrainfo.") {
+			return nil, false
+		}
+		key := strings.TrimPrefix(name, "extrainfo.")
+		switch val := val.(type) {
+		case nil:
+			values[key] = nil
+		case json.RawMessage:
+			values[key] = val
+		default:
+			return nil, false
+		}
+	}
+	return values, true
+}
+
 // entityUpdateOp returns a mongo update operation that
 // sets the given fields. Any nil fields will be unset.
 func entityUpdateOp(fields map[string]interface{}) bson.D {
@@ -630,6 +784,54 @@ func (h *ReqHandler) metaCharmMetrics(entity *mongodoc.Entity, id *router.Resolv
 	return entity.CharmMetrics, nil
 }
 
+// GET id/meta/charm-storage
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#get-idmetacharm-storage
+func (h *ReqHandler) metaCharmStorage(entity *mongodoc.Entity, id *router.ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
+	if entity.CharmMeta == nil {
+		return nil, nil
+	}
+	if entity.CharmMeta.Storage == nil {
+		return map[string]charm.Storage{}, nil
+	}
+	return entity.CharmMeta.Storage, nil
+}
+
+// GET id/meta/charm-devices
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#get-idmetacharm-devices
+func (h *ReqHandler) metaCharmDevices(entity *mongodoc.Entity, id *router.ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
+	if entity.CharmMeta == nil {
+		return nil, nil
+	}
+	if entity.CharmMeta.Devices == nil {
+		return map[string]charm.Device{}, nil
+	}
+	return entity.CharmMeta.Devices, nil
+}
+
+// GET id/meta/extra-bindings
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#get-idmetaextra-bindings
+func (h *ReqHandler) metaExtraBindings(entity *mongodoc.Entity, id *router.ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
+	if entity.CharmMeta == nil {
+		return nil, nil
+	}
+	if entity.CharmMeta.ExtraBindings == nil {
+		return map[string]charm.ExtraBinding{}, nil
+	}
+	return entity.CharmMeta.ExtraBindings, nil
+}
+
+// GET id/meta/charm-containers
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#get-idmetacharm-containers
+func (h *ReqHandler) metaCharmContainers(entity *mongodoc.Entity, id *router.ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
+	if entity.CharmMeta == nil {
+		return nil, nil
+	}
+	if entity.CharmMeta.Containers == nil {
+		return map[string]charm.Container{}, nil
+	}
+	return entity.CharmMeta.Containers, nil
+}
+
 // GET id/meta/bundle-metadata
 // https://github.com/juju/charmstore/blob/v5/docs/API.md#get-idmetabundle-metadata
 func (h *ReqHandler) metaBundleMetadata(entity *mongodoc.Entity, id *router.ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
@@ -710,6 +912,185 @@ func (h *ReqHandler) metaTerms(entity *mongodoc.Entity, id *router.ResolvedURL,
 	return entity.CharmMeta.Terms, nil
 }
 
+// MinJujuVersionResponse holds the response to a
+// GET id/meta/min-juju-version request.
+type MinJujuVersionResponse struct {
+	MinJujuVersion version.Number
+}
+
+// GET id/meta/min-juju-version
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#get-idmetamin-juju-version
+func (h *ReqHandler) metaMinJujuVersion(entity *mongodoc.Entity, id *router.ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
+	if entity.URL.Series == "bundle" {
+		return nil, nil
+	}
+	// Charms that do not declare a minimum version report the zero
+	// version, which is compatible with any version of Juju.
+	return &MinJujuVersionResponse{
+		MinJujuVersion: entity.CharmMeta.MinJujuVersion,
+	}, nil
+}
+
+// AssumesResponse holds the response to a
+// GET id/meta/assumes request.
+type AssumesResponse struct {
+	// Assumes holds the expressions in the assumes block of the
+	// charm's metadata, all of which must be satisfied for the
+	// charm to be deployed.
+	Assumes []AssumesExpression
+}
+
+// AssumesExpression holds an expression from the assumes block of a
+// charm's metadata. Exactly one of Feature, AnyOf and AllOf is set.
+type AssumesExpression struct {
+	// Feature holds the name of a required feature, such as "juju".
+	Feature string `json:",omitempty"`
+
+	// Op holds the operator of a version constraint on the
+	// feature, either ">=" or "<", or is empty if there is none.
+	Op string `json:",omitempty"`
+
+	// Version holds the version that the feature is compared
+	// with by Op.
+	Version string `json:",omitempty"`
+
+	// AnyOf holds expressions at least one of which must be
+	// satisfied.
+	AnyOf []AssumesExpression `json:",omitempty"`
+
+	// AllOf holds expressions all of which must be satisfied.
+	AllOf []AssumesExpression `json:",omitempty"`
+}
+
+// GET id/meta/assumes
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#get-idmetaassumes
+func (h *ReqHandler) metaAssumes(entity *mongodoc.Entity, id *router.ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
+	if entity.URL.Series == "bundle" {
+		return nil, nil
+	}
+	// Charms without an assumes block report no expressions, as
+	// they can be deployed anywhere.
+	return &AssumesResponse{
+		Assumes: assumesExpressions(entity.Assumes),
+	}, nil
+}
+
+// assumesExpressions converts the given stored assumes expressions to
+// their API representation. It never returns nil.
+func assumesExpressions(exprs []mongodoc.AssumesExpression) []AssumesExpression {
+	result := make([]AssumesExpression, len(exprs))
+	for i, e := range exprs {
+		result[i] = AssumesExpression{
+			Feature: e.Feature,
+			Op:      e.Op,
+			Version: e.Version,
+		}
+		if e.AnyOf != nil {
+			result[i].AnyOf = assumesExpressions(e.AnyOf)
+		}
+		if e.AllOf != nil {
+			result[i].AllOf = assumesExpressions(e.AllOf)
+		}
+	}
+	return result
+}
+
+// ProvenanceResponse holds the response to a
+// GET id/meta/provenance request.
+type ProvenanceResponse struct {
+	// Source holds the name of the upstream source that the
+	// entity was ingested from.
+	Source string
+
+	// SourceURL holds the location of the entity in that source.
+	SourceURL string `json:",omitempty"`
+}
+
+// GET id/meta/provenance
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#get-idmetaprovenance
+func (h *ReqHandler) metaProvenance(entity *mongodoc.Entity, id *router.ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
+	if entity.Source == "" {
+		return nil, nil
+	}
+	return &ProvenanceResponse{
+		Source:    entity.Source,
+		SourceURL: entity.SourceURL,
+	}, nil
+}
+
+// CanDeployResponse holds the response to a
+// GET id/meta/can-deploy request.
+type CanDeployResponse struct {
+	// CanDeploy holds whether the charm can be deployed
+	// to the requested base and architecture.
+	CanDeploy bool
+
+	// Reason holds why the charm cannot be deployed.
+	Reason string `json:",omitempty"`
+}
+
+// GET id/meta/can-deploy?base=os@version[&arch=architecture]
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#get-idmetacan-deploy
+func (h *ReqHandler) metaCanDeploy(entity *mongodoc.Entity, id *router.ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
+	if entity.URL.Series == "bundle" {
+		return nil, nil
+	}
+	base := flags.Get("base")
+	if base == "" {
+		return nil, badRequestf(nil, "base not specified")
+	}
+	os, version := base, ""
+	if i := strings.Index(base, "@"); i >= 0 {
+		os, version = base[:i], base[i+1:]
+	}
+	// The version may be followed by a risk, as in "20.04/stable".
+	if i := strings.Index(version, "/"); i >= 0 {
+		version = version[:i]
+	}
+	if os == "" || version == "" {
+		return nil, badRequestf(nil, "invalid base %q", base)
+	}
+	s, ok := series.SeriesForBase(os, version)
+	if !ok {
+		return &CanDeployResponse{
+			Reason: fmt.Sprintf("unknown base %q", base),
+		}, nil
+	}
+	supported := entity.SupportedSeries
+	if len(supported) == 0 {
+		supported = []string{entity.URL.Series}
+	}
+	if !containsString(supported, s) {
+		return &CanDeployResponse{
+			Reason: fmt.Sprintf("series %q not supported (supported series: %s)", s, strings.Join(supported, ", ")),
+		}, nil
+	}
+	if arch := flags.Get("arch"); arch != "" && len(entity.CharmMeta.Architectures) > 0 {
+		archs := make([]string, len(entity.CharmMeta.Architectures))
+		for i, a := range entity.CharmMeta.Architectures {
+			archs[i] = string(a)
+		}
+		if !containsString(archs, arch) {
+			return &CanDeployResponse{
+				Reason: fmt.Sprintf("architecture %q not supported (supported architectures: %s)", arch, strings.Join(archs, ", ")),
+			}, nil
+		}
+	}
+	return &CanDeployResponse{
+		CanDeploy: true,
+	}, nil
+}
+
+// containsString reports whether ss contains s.
+func containsString(ss []string, s string) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
 // GET id/meta/color
 func (h *ReqHandler) metaColor(id *router.ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
 	return nil, errNotImplemented
@@ -757,35 +1138,78 @@ func (h *ReqHandler) metaTags(entity *mongodoc.Entity, id *router.ResolvedURL, p
 	}, nil
 }
 
+// StatsResponse holds the response to a GET id/meta/stats request.
+type StatsResponse struct {
+	params.StatsResponse
+
+	// ArchiveDownloadCountByClient holds the all-time downloads
+	// count for the specific revision of the entity, keyed by the
+	// type of client that made the downloads.
+	ArchiveDownloadCountByClient map[string]int64 `json:",omitempty"`
+}
+
+// StatsRangeResponse holds the response to a GET id/meta/stats
+// request that specifies a date range.
+type StatsRangeResponse struct {
+	StatsResponse
+
+	// ArchiveDownloadInRange holds the downloads count for the
+	// specific revision of the entity within the requested range.
+	ArchiveDownloadInRange int64
+}
+
 // GET id/meta/stats/
 // https://github.com/juju/charmstore/blob/v5/docs/API.md#get-idmetastats
 func (h *ReqHandler) metaStats(entity *mongodoc.Entity, id *router.ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
 	if h.Handler.config.DisableSlowMetadata {
-		return &params.StatsResponse{}, nil
+		return &StatsResponse{}, nil
 	}
 	mon := monitoring.NewMetaDuration("stats")
 	defer mon.Done()
+	start, end, inRange, err := parseStatsRange(flags)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
 	// Retrieve the aggregated downloads count for the specific revision.
 	preferredURL := id.PreferredURL()
 	counts, countsAllRevisions, err := h.Store.ArchiveDownloadCounts(preferredURL)
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
-	// Return the response.
-	return &params.StatsResponse{
-		ArchiveDownloadCount: counts.Total,
-		ArchiveDownload: params.StatsCount{
-			Total: counts.Total,
-			Day:   counts.LastDay,
-			Week:  counts.LastWeek,
-			Month: counts.LastMonth,
-		},
-		ArchiveDownloadAllRevisions: params.StatsCount{
-			Total: countsAllRevisions.Total,
-			Day:   countsAllRevisions.LastDay,
-			Week:  countsAllRevisions.LastWeek,
-			Month: countsAllRevisions.LastMonth,
+	countsByClient, err := h.Store.ArchiveDownloadCountsByClient(preferredURL)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	resp := &StatsResponse{
+		StatsResponse: params.StatsResponse{
+			ArchiveDownloadCount: counts.Total,
+			ArchiveDownload: params.StatsCount{
+				Total: counts.Total,
+				Day:   counts.LastDay,
+				Week:  counts.LastWeek,
+				Month: counts.LastMonth,
+			},
+			ArchiveDownloadAllRevisions: params.StatsCount{
+				Total: countsAllRevisions.Total,
+				Day:   countsAllRevisions.LastDay,
+				Week:  countsAllRevisions.LastWeek,
+				Month: countsAllRevisions.LastMonth,
+			},
 		},
+	}
+	if len(countsByClient) > 0 {
+		resp.ArchiveDownloadCountByClient = countsByClient
+	}
+	if !inRange {
+		return resp, nil
+	}
+	count, err := h.Store.DownloadCountInRange(id, start, end)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &StatsRangeResponse{
+		StatsResponse:          *resp,
+		ArchiveDownloadInRange: count,
 	}, nil
 }
 
@@ -1140,6 +1564,9 @@ func (h *ReqHandler) metaCanWrite(entity *mongodoc.BaseEntity, id *router.Resolv
 // GET id/meta/perm/key
 // https://github.com/juju/charmstore/blob/v5/docs/API.md#get-idmetapermkey
 func (h *ReqHandler) metaPermWithKey(entity *mongodoc.BaseEntity, id *router.ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
+	if path == "/effective" {
+		return h.metaPermEffective(entity, id, req)
+	}
 	ch, err := h.entityChannel(id)
 	if err != nil {
 		return nil, errgo.Mask(err)
@@ -1157,6 +1584,25 @@ func (h *ReqHandler) metaPermWithKey(entity *mongodoc.BaseEntity, id *router.Res
 	return nil, errgo.WithCausef(nil, params.ErrNotFound, "unknown permission")
 }
 
+// GET id/meta/perm/effective
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#get-idmetapermeffective
+func (h *ReqHandler) metaPermEffective(entity *mongodoc.BaseEntity, id *router.ResolvedURL, req *http.Request) (interface{}, error) {
+	if err := h.authenticateAdmin(req); err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	// Report the readers of the channel used to authorize
+	// requests for the entity.
+	ch, err := h.entityChannel(id)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	readers, err := h.Store.EffectiveReaders(&id.URL, ch)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	return readers, nil
+}
+
 func (h *ReqHandler) visibleACL(req *http.Request, acls mongodoc.ACL) (mongodoc.ACL, error) {
 	respForEveryone := mongodoc.ACL{
 		Read:  []string{"everyone"},
@@ -1270,6 +1716,169 @@ func (h *ReqHandler) metaPublished(entity *mongodoc.Entity, id *router.ResolvedU
 	}, nil
 }
 
+// ChannelHeadsResponse holds the response to a GET id/meta/channel-heads
+// request. It maps each channel to the entities currently published in
+// that channel, keyed by series.
+type ChannelHeadsResponse map[params.Channel]map[string]ChannelHead
+
+// ChannelHead holds the ids of an entity published in a channel.
+type ChannelHead struct {
+	// Id holds the fully qualified id of the entity.
+	Id *charm.URL
+
+	// PromulgatedId holds the promulgated id of the entity, if
+	// it is promulgated.
+	PromulgatedId *charm.URL `json:",omitempty"`
+}
+
+// ChannelStatusResponse holds the response to a GET
+// id/meta/channel-status request. It maps each channel to its status,
+// or to nil if nothing is published in the channel.
+type ChannelStatusResponse map[params.Channel]*ChannelStatus
+
+// ChannelStatus holds the status of a channel.
+type ChannelStatus struct {
+	// Heads holds the entities currently published in the channel,
+	// keyed by series.
+	Heads map[string]ChannelHead
+
+	// PublishTime holds the time that the most recent of the
+	// current heads was published, if known.
+	PublishTime *time.Time `json:",omitempty"`
+}
+
+// BundleClosureResponse holds the response to a GET
+// id/meta/bundle-closure request.
+type BundleClosureResponse struct {
+	// Charms holds the ids of the charms deployed by the bundle,
+	// resolved in the requested channel. Charms that the current
+	// user is not allowed to read are omitted.
+	Charms []ChannelHead
+
+	// Unresolved holds the charm references in the bundle that
+	// cannot be found in the requested channel.
+	Unresolved []*charm.URL `json:",omitempty"`
+}
+
+// HighestRevisionResponse holds the response to a
+// GET id/meta/highest-revision request.
+type HighestRevisionResponse struct {
+	// Revision holds the highest revision of any entity with the
+	// same base URL as the requested id.
+	Revision int
+}
+
+// GET id/meta/highest-revision
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#get-idmetahighest-revision
+func (h *ReqHandler) metaHighestRevision(entity *mongodoc.BaseEntity, id *router.ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
+	rev, err := h.Store.HighestRevision(entity.URL)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	return &HighestRevisionResponse{
+		Revision: rev,
+	}, nil
+}
+
+// GET id/meta/channel-heads
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#get-idmetachannel-heads
+func (h *ReqHandler) metaChannelHeads(entity *mongodoc.BaseEntity, id *router.ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
+	heads, err := h.Store.ChannelHeads(entity.URL)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	resp := make(ChannelHeadsResponse, len(heads))
+	for ch, entities := range heads {
+		// Omit channels that aren't readable by the current user.
+		if _, err := h.authorize(authorizeParams{
+			req:              req,
+			acls:             []mongodoc.ACL{entity.ChannelACLs[ch]},
+			ops:              []string{OpReadWithNoTerms},
+			ignoreEntityACLs: true,
+		}); err != nil {
+			continue
+		}
+		resp[ch] = make(map[string]ChannelHead, len(entities))
+		for series, rurl := range entities {
+			resp[ch][series] = ChannelHead{
+				Id:            &rurl.URL,
+				PromulgatedId: rurl.PromulgatedURL(),
+			}
+		}
+	}
+	return resp, nil
+}
+
+// GET id/meta/channel-status
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#get-idmetachannel-status
+func (h *ReqHandler) metaChannelStatus(entity *mongodoc.BaseEntity, id *router.ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
+	status, err := h.Store.ChannelStatus(entity)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	resp := make(ChannelStatusResponse, len(status))
+	for ch, st := range status {
+		// Omit channels that aren't readable by the current user.
+		if _, err := h.authorize(authorizeParams{
+			req:              req,
+			acls:             []mongodoc.ACL{entity.ChannelACLs[ch]},
+			ops:              []string{OpReadWithNoTerms},
+			ignoreEntityACLs: true,
+		}); err != nil {
+			continue
+		}
+		if st == nil {
+			resp[ch] = nil
+			continue
+		}
+		chStatus := &ChannelStatus{
+			Heads: make(map[string]ChannelHead, len(st.Heads)),
+		}
+		for series, rurl := range st.Heads {
+			chStatus.Heads[series] = ChannelHead{
+				Id:            &rurl.URL,
+				PromulgatedId: rurl.PromulgatedURL(),
+			}
+		}
+		if !st.PublishTime.IsZero() {
+			chStatus.PublishTime = &st.PublishTime
+		}
+		resp[ch] = chStatus
+	}
+	return resp, nil
+}
+
+// GET id/meta/bundle-closure
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#get-idmetabundle-closure
+func (h *ReqHandler) metaBundleClosure(entity *mongodoc.Entity, id *router.ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
+	if entity.URL.Series != "bundle" {
+		return nil, nil
+	}
+	ch := h.Store.Channel
+	if ch == params.NoChannel {
+		ch = params.StableChannel
+	}
+	ids, unresolved, err := h.Store.BundleClosure(id, ch)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	resp := &BundleClosureResponse{
+		Charms:     make([]ChannelHead, 0, len(ids)),
+		Unresolved: unresolved,
+	}
+	for _, rurl := range ids {
+		// Omit charms that aren't readable by the current user.
+		if err := h.AuthorizeEntityForOp(rurl, req, OpReadWithNoTerms); err != nil {
+			continue
+		}
+		resp.Charms = append(resp.Charms, ChannelHead{
+			Id:            &rurl.URL,
+			PromulgatedId: rurl.PromulgatedURL(),
+		})
+	}
+	return resp, nil
+}
+
 // GET id/meta/archive-upload-time
 // https://github.com/juju/charmstore/blob/v5/docs/API.md#get-idmetaarchive-upload-time
 func (h *ReqHandler) metaArchiveUploadTime(entity *mongodoc.Entity, id *router.ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
@@ -1278,6 +1887,113 @@ func (h *ReqHandler) metaArchiveUploadTime(entity *mongodoc.Entity, id *router.R
 	}, nil
 }
 
+// PublishedTimeResponse holds the response to a GET
+// id/meta/published-time request.
+type PublishedTimeResponse struct {
+	// Channel holds the channel that the entity was published to.
+	Channel params.Channel
+
+	// PublishTime holds the time that the entity most recently
+	// became the current revision in the channel.
+	PublishTime time.Time
+}
+
+// GET id/meta/published-time[?channel=channel]
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#get-idmetapublished-time
+func (h *ReqHandler) metaPublishedTime(entity *mongodoc.Entity, id *router.ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
+	ch, err := h.entityChannel(id)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	if ch == params.UnpublishedChannel {
+		// The entity has not been published anywhere, so there
+		// is no publish time to report.
+		return nil, nil
+	}
+	if !entity.Published[ch] {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "%s not published in the %s channel", id, ch)
+	}
+	t, err := h.Store.PublishTime(id, ch)
+	if errgo.Cause(err) == params.ErrNotFound {
+		// The entity was published before publications
+		// were recorded.
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &PublishedTimeResponse{
+		Channel:     ch,
+		PublishTime: t.UTC(),
+	}, nil
+}
+
+// GET id/meta/channel-history[?series=series]
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#get-idmetachannel-history
+func (h *ReqHandler) metaChannelHistory(entity *mongodoc.Entity, id *router.ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
+	ch := h.Store.Channel
+	if ch == params.NoChannel {
+		ch = params.StableChannel
+	}
+	series := flags.Get("series")
+	if series == "" {
+		series = id.URL.Series
+	}
+	if series == "" && len(entity.SupportedSeries) > 0 {
+		series = entity.SupportedSeries[0]
+	}
+	history, err := h.Store.ChannelHistory(mongodoc.BaseURL(&id.URL), series, ch)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	return history, nil
+}
+
+// GET id/meta/audit[?limit=count]
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#get-idmetaaudit
+func (h *ReqHandler) metaAudit(entity *mongodoc.Entity, id *router.ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
+	if err := h.authenticateAdmin(req); err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	limit := 0
+	if limitStr := flags.Get("limit"); limitStr != "" {
+		var err error
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 {
+			return nil, badRequestf(nil, "invalid 'limit' value")
+		}
+	}
+	entries, err := h.Store.EntityAuditHistory(&id.URL, limit)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	for i := range entries {
+		entries[i].Time = entries[i].Time.UTC()
+	}
+	return entries, nil
+}
+
+// YankedResponse holds the response to a GET id/meta/yanked request.
+type YankedResponse struct {
+	// Channels holds the channels that the entity has been yanked
+	// from, ordered by stability.
+	Channels []params.Channel
+}
+
+// GET id/meta/yanked
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#get-idmetayanked
+func (h *ReqHandler) metaYanked(entity *mongodoc.Entity, id *router.ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
+	channels := []params.Channel{}
+	for _, ch := range params.OrderedChannels {
+		if entity.Yanked[ch] {
+			channels = append(channels, ch)
+		}
+	}
+	return &YankedResponse{
+		Channels: channels,
+	}, nil
+}
+
 // GET changes/published[?limit=$count][&start=$fromdate][&stop=$todate]
 // https://github.com/juju/charmstore/blob/v5/docs/API.md#get-changespublished
 func (h *ReqHandler) serveChangesPublished(_ http.Header, r *http.Request) (interface{}, error) {
@@ -1339,6 +2055,66 @@ func (h *ReqHandler) serveChangesPublished(_ http.Header, r *http.Request) (inte
 	return results, nil
 }
 
+// CandidatesResponse holds the response to a GET meta/candidates
+// request.
+type CandidatesResponse struct {
+	Candidates []Candidate
+}
+
+// Candidate holds one of the base entities that a name may refer to.
+type Candidate struct {
+	// Id holds the base id of the entity, for example
+	// cs:~bob/wordpress.
+	Id *charm.URL
+
+	// User holds the owner of the entity.
+	User string
+
+	// Promulgated holds whether the entity is promulgated.
+	Promulgated bool
+}
+
+// GET meta/candidates?name=name
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#get-metacandidates
+func (h *ReqHandler) serveCandidates(_ http.Header, req *http.Request) (interface{}, error) {
+	name := req.Form.Get("name")
+	if name == "" {
+		return nil, badRequestf(nil, "name parameter not specified")
+	}
+	channel := h.Store.Channel
+	if channel == params.NoChannel {
+		channel = params.StableChannel
+	}
+	baseEntities, err := h.Store.CandidateBaseEntities(name, charmstore.FieldSelector(
+		"user",
+		"promulgated",
+		"channelacls."+string(channel),
+	))
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	resp := CandidatesResponse{
+		Candidates: []Candidate{},
+	}
+	for _, baseEntity := range baseEntities {
+		// Ignore entities that aren't readable by the current user.
+		if _, err := h.authorize(authorizeParams{
+			req:              req,
+			acls:             []mongodoc.ACL{baseEntity.ChannelACLs[channel]},
+			ops:              []string{OpReadWithNoTerms},
+			ignoreEntityACLs: true,
+		}); err != nil {
+			continue
+		}
+		resp.Candidates = append(resp.Candidates, Candidate{
+			Id:          baseEntity.URL,
+			User:        baseEntity.User,
+			Promulgated: bool(baseEntity.Promulgated),
+		})
+	}
+	return resp, nil
+}
+
 // GET /macaroon
 // See https://github.com/juju/charmstore/blob/v5/docs/API.md#get-macaroon
 // Return a macaroon that will enable access to that can be checked by just
@@ -1513,6 +2289,48 @@ func (h *ReqHandler) servePromulgate(id *router.ResolvedURL, w http.ResponseWrit
 	return nil
 }
 
+// PUT id/reserve[?user=user]
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#put-idreserve
+func (h *ReqHandler) serveReserve(id *charm.URL, w http.ResponseWriter, req *http.Request) error {
+	if req.Method != "PUT" {
+		return errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s not allowed", req.Method)
+	}
+	if id.Series != "" || id.Revision != -1 {
+		return badRequestf(nil, "cannot specify series or revision in charm id for reserve request")
+	}
+	if id.User == "" {
+		return badRequestf(nil, "cannot use promulgated URL in reserve request")
+	}
+	// Anyone that could upload to the name if it did not
+	// exist may reserve it.
+	auth, err := h.authorize(authorizeParams{
+		req: req,
+		acls: []mongodoc.ACL{{
+			Write: []string{id.User},
+		}},
+		ops: []string{OpWrite},
+	})
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	user := req.Form.Get("user")
+	switch {
+	case user == "" && auth.Username == "":
+		return badRequestf(nil, "user not specified")
+	case user == "":
+		user = auth.Username
+	case user != auth.Username && !auth.Admin:
+		return errgo.WithCausef(nil, params.ErrForbidden, "cannot reserve name for another user")
+	}
+	if err := h.Store.CheckUploadAllowed(id); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrForbidden))
+	}
+	if err := h.Store.ReserveName(id, user); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrBadRequest), errgo.Is(params.ErrForbidden))
+	}
+	return nil
+}
+
 // GET id/allperms
 // https://github.com/juju/charmstore/blob/v5/docs/API.md#get-id-allperms
 func (h *ReqHandler) serveAllPerms(id *charm.URL, w http.ResponseWriter, req *http.Request) error {
@@ -1558,7 +2376,7 @@ func (h *ReqHandler) serveAllPerms(id *charm.URL, w http.ResponseWriter, req *ht
 	return nil
 }
 
-// PUT id/publish
+// PUT id/publish[?require-resources=true]
 // See https://github.com/juju/charmstore/blob/v5/docs/API.md#put-idpublish
 func (h *ReqHandler) servePublish(id *router.ResolvedURL, w http.ResponseWriter, req *http.Request) error {
 	if req.Method != "PUT" {
@@ -1572,6 +2390,14 @@ func (h *ReqHandler) servePublish(id *router.ResolvedURL, w http.ResponseWriter,
 	if err := httprequest.Unmarshal(httprequest.Params{Request: req}, &publish); err != nil {
 		return badRequestf(err, "cannot unmarshal publish request body")
 	}
+	requireResources := false
+	if v := req.Form.Get("require-resources"); v != "" {
+		var err error
+		requireResources, err = strconv.ParseBool(v)
+		if err != nil {
+			return badRequestf(err, "invalid value for require-resources")
+		}
+	}
 	chans := publish.Channels
 	if len(chans) == 0 {
 		return badRequestf(nil, "no channels provided")
@@ -1600,23 +2426,188 @@ func (h *ReqHandler) servePublish(id *router.ResolvedURL, w http.ResponseWriter,
 	for _, c := range chans {
 		acls = append(acls, baseEntity.ChannelACLs[c])
 	}
-	if _, err := h.authorize(authorizeParams{
+	auth, err := h.authorize(authorizeParams{
 		req:              req,
 		acls:             acls,
 		entityIds:        []*router.ResolvedURL{id},
 		ignoreEntityACLs: true, // acls holds all the ACLs we care about.
 		ops:              []string{OpWrite},
-	}); err != nil {
+	})
+	if err != nil {
 		return errgo.Mask(err, errgo.Any)
 	}
 
-	if err := h.Store.Publish(id, publish.Resources, chans...); err != nil {
+	// Publishing to channels that require approval only records
+	// a request, unless admin credentials have been used.
+	var approvalChans []params.Channel
+	if !auth.Admin {
+		publishChans := make([]params.Channel, 0, len(chans))
+		for _, c := range chans {
+			if h.Store.ApprovalRequired(c) {
+				approvalChans = append(approvalChans, c)
+			} else {
+				publishChans = append(publishChans, c)
+			}
+		}
+		chans = publishChans
+	}
+	if len(chans) > 0 {
+		if err := h.Store.PublishAs(auth.Username, id, publish.Resources, requireResources, chans...); err != nil {
+			if errgo.Cause(err) == charmstore.ErrPublishResourceMismatch {
+				return errgo.WithCausef(err, params.ErrBadRequest, "")
+			}
+			return errgo.NoteMask(err, "cannot publish charm or bundle", errgo.Is(params.ErrNotFound))
+		}
+	}
+	if len(approvalChans) == 0 {
+		// TODO add publish audit
+		return nil
+	}
+	for _, c := range approvalChans {
+		if err := h.Store.RequestPublish(id, c, publish.Resources, requireResources, auth.Username); err != nil {
+			return errgo.NoteMask(err, "cannot request publish", errgo.Is(params.ErrNotFound))
+		}
+	}
+	w.WriteHeader(http.StatusAccepted)
+	return nil
+}
+
+// ApprovePublishRequest holds the body of a PUT id/approve-publish
+// request.
+type ApprovePublishRequest struct {
+	// Channel holds the channel of the publish request to approve.
+	Channel params.Channel
+}
+
+// PUT id/approve-publish
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#put-idapprove-publish
+func (h *ReqHandler) serveApprovePublish(id *router.ResolvedURL, w http.ResponseWriter, req *http.Request) error {
+	if req.Method != "PUT" {
+		return errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s not allowed", req.Method)
+	}
+	var approve struct {
+		ApprovePublishRequest `httprequest:",body"`
+	}
+	if err := httprequest.Unmarshal(httprequest.Params{Request: req}, &approve); err != nil {
+		return badRequestf(err, "cannot unmarshal approve publish request body")
+	}
+	if !h.Store.ApprovalRequired(approve.Channel) {
+		return badRequestf(nil, "publishing to the %q channel does not require approval", approve.Channel)
+	}
+	baseEntity, err := h.Cache.BaseEntity(&id.URL, charmstore.FieldSelector("channelacls"))
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	// Approvers need the same permissions as would be
+	// needed to publish directly.
+	auth, err := h.authorize(authorizeParams{
+		req:              req,
+		acls:             []mongodoc.ACL{baseEntity.ChannelACLs[approve.Channel]},
+		entityIds:        []*router.ResolvedURL{id},
+		ignoreEntityACLs: true,
+		ops:              []string{OpWrite},
+	})
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	if err := h.Store.ApprovePublish(id, approve.Channel, auth.Username); err != nil {
 		if errgo.Cause(err) == charmstore.ErrPublishResourceMismatch {
 			return errgo.WithCausef(err, params.ErrBadRequest, "")
 		}
-		return errgo.NoteMask(err, "cannot publish charm or bundle", errgo.Is(params.ErrNotFound))
+		return errgo.NoteMask(err, "cannot approve publish", errgo.Is(params.ErrNotFound), errgo.Is(params.ErrForbidden))
+	}
+	return nil
+}
+
+// GET pending-publishes
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#get-pending-publishes
+func (h *ReqHandler) servePendingPublishes(_ http.Header, req *http.Request) (interface{}, error) {
+	if req.Method != "GET" {
+		return nil, errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s not allowed", req.Method)
+	}
+	if _, err := h.Authenticate(req); err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	docs, err := h.Store.ListPendingPublishes()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	results := []mongodoc.PendingPublish{}
+	for _, doc := range docs {
+		// Only include the requests that the user could approve.
+		baseEntity, err := h.Cache.BaseEntity(doc.URL, charmstore.FieldSelector("channelacls"))
+		if errgo.Cause(err) == params.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		if _, err := h.authorize(authorizeParams{
+			req:              req,
+			acls:             []mongodoc.ACL{baseEntity.ChannelACLs[doc.Channel]},
+			ignoreEntityACLs: true,
+			ops:              []string{OpWrite},
+		}); err != nil {
+			continue
+		}
+		results = append(results, doc)
+	}
+	return results, nil
+}
+
+// PermsBatchRequest holds the body of a PUT perms-batch request.
+type PermsBatchRequest struct {
+	// Ids holds the ids of the entities whose base entities'
+	// permissions are changed.
+	Ids []*charm.URL
+
+	// Op holds the ACL to change, in the form "channel.operation",
+	// for example "stable.write".
+	Op string
+
+	// ACL holds the new value of the ACL.
+	ACL []string
+}
+
+// PUT perms-batch
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#put-perms-batch
+func (h *ReqHandler) servePermsBatch(w http.ResponseWriter, req *http.Request) error {
+	if req.Method != "PUT" {
+		return errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s not allowed", req.Method)
+	}
+	var body PermsBatchRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return badRequestf(err, "cannot unmarshal request body")
+	}
+	// Do not allow empty ACLs, as for PUT id/meta/perm.
+	if len(body.ACL) == 0 {
+		return badRequestf(nil, "empty ACL")
+	}
+	if _, err := h.Authenticate(req); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	user := h.auditUser()
+	urls := make([]*charm.URL, len(body.Ids))
+	for i, id := range body.Ids {
+		rurl, err := h.ResolveURL(id)
+		if err != nil {
+			return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+		}
+		urls[i] = &rurl.URL
+	}
+	// Every base entity is authorized before any change is made.
+	err := h.Store.SetPermsBatch(urls, body.Op, body.ACL, user, func(ch params.Channel, be *mongodoc.BaseEntity) error {
+		_, err := h.authorize(authorizeParams{
+			req:              req,
+			acls:             []mongodoc.ACL{be.ChannelACLs[ch]},
+			ignoreEntityACLs: true,
+			ops:              []string{OpWrite},
+		})
+		return errgo.Mask(err, errgo.Any)
+	})
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
 	}
-	// TODO add publish audit
 	return nil
 }
 
@@ -1705,19 +2696,26 @@ var testAddAuditCallback func(e audit.Entry)
 // addAudit delegates an audit entry to the store to record an audit log after
 // it has set correctly the user doing the action.
 func (h *ReqHandler) addAudit(e audit.Entry) {
-	if h.auth.User == nil && !h.auth.Admin {
-		panic("No auth set in ReqHandler")
-	}
-	e.User = h.auth.Username
-	if h.auth.Admin && e.User == "" {
-		e.User = "admin"
-	}
+	e.User = h.auditUser()
 	h.Store.AddAudit(e)
 	if testAddAuditCallback != nil {
 		testAddAuditCallback(e)
 	}
 }
 
+// auditUser returns the name of the authenticated user to record in
+// audit entries. It must only be called after the request has been
+// authorized.
+func (h *ReqHandler) auditUser() string {
+	if h.auth.User == nil && !h.auth.Admin {
+		panic("No auth set in ReqHandler")
+	}
+	if h.auth.Admin && h.auth.Username == "" {
+		return "admin"
+	}
+	return h.auth.Username
+}
+
 // logout handles the GET /v5/logout endpoint that is used to log out of
 // charmstore.
 func logout(w http.ResponseWriter, r *http.Request) {
@@ -6,6 +6,7 @@ package v5_test
 import (
 	"archive/zip"
 	"bytes"
+	"compress/gzip"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -18,6 +19,7 @@ import (
 	"github.com/juju/charmrepo/v6/csclient/params"
 	jc "github.com/juju/testing/checkers"
 	"github.com/juju/testing/httptesting"
+	"github.com/juju/version"
 	gc "gopkg.in/check.v1"
 	"gopkg.in/errgo.v1"
 	"gopkg.in/macaroon-bakery.v2-unstable/bakery"
@@ -91,6 +93,13 @@ type metaEndpoint struct {
 	// assertCheckData holds a function that will be used to check that
 	// the get function returns sane data for checkURL.
 	assertCheckData func(c *gc.C, data interface{})
+
+	// query holds any query parameters that must be added to
+	// requests for the endpoint.
+	query string
+
+	// admin holds whether the endpoint requires admin credentials.
+	admin bool
 }
 
 const (
@@ -128,6 +137,70 @@ var metaEndpoints = []metaEndpoint{{
 	assertCheckData: func(c *gc.C, data interface{}) {
 		c.Assert(data.(*charm.Meta).Summary, gc.Equals, "Blog engine")
 	},
+}, {
+	name:      "charm-storage",
+	exclusive: charmOnly,
+	get: entityGetter(func(entity *mongodoc.Entity) interface{} {
+		if entity.CharmMeta == nil {
+			return nil
+		}
+		if entity.CharmMeta.Storage == nil {
+			return map[string]charm.Storage{}
+		}
+		return entity.CharmMeta.Storage
+	}),
+	checkURL: newResolvedURL("~charmers/precise/wordpress-23", 23),
+	assertCheckData: func(c *gc.C, data interface{}) {
+		c.Assert(data, jc.DeepEquals, map[string]charm.Storage{})
+	},
+}, {
+	name:      "charm-devices",
+	exclusive: charmOnly,
+	get: entityGetter(func(entity *mongodoc.Entity) interface{} {
+		if entity.CharmMeta == nil {
+			return nil
+		}
+		if entity.CharmMeta.Devices == nil {
+			return map[string]charm.Device{}
+		}
+		return entity.CharmMeta.Devices
+	}),
+	checkURL: newResolvedURL("~charmers/precise/wordpress-23", 23),
+	assertCheckData: func(c *gc.C, data interface{}) {
+		c.Assert(data, jc.DeepEquals, map[string]charm.Device{})
+	},
+}, {
+	name:      "extra-bindings",
+	exclusive: charmOnly,
+	get: entityGetter(func(entity *mongodoc.Entity) interface{} {
+		if entity.CharmMeta == nil {
+			return nil
+		}
+		if entity.CharmMeta.ExtraBindings == nil {
+			return map[string]charm.ExtraBinding{}
+		}
+		return entity.CharmMeta.ExtraBindings
+	}),
+	checkURL: newResolvedURL("~charmers/precise/wordpress-23", 23),
+	assertCheckData: func(c *gc.C, data interface{}) {
+		c.Assert(data, jc.DeepEquals, map[string]charm.ExtraBinding{})
+	},
+}, {
+	name:      "charm-containers",
+	exclusive: charmOnly,
+	get: entityGetter(func(entity *mongodoc.Entity) interface{} {
+		if entity.CharmMeta == nil {
+			return nil
+		}
+		if entity.CharmMeta.Containers == nil {
+			return map[string]charm.Container{}
+		}
+		return entity.CharmMeta.Containers
+	}),
+	checkURL: newResolvedURL("~charmers/precise/wordpress-23", 23),
+	assertCheckData: func(c *gc.C, data interface{}) {
+		c.Assert(data, jc.DeepEquals, map[string]charm.Container{})
+	},
 }, {
 	name:      "charm-metrics",
 	exclusive: charmOnly,
@@ -144,6 +217,60 @@ var metaEndpoints = []metaEndpoint{{
 			"pings":      {Type: "gauge", Description: "Description of the metric."},
 		})
 	},
+}, {
+	name:      "min-juju-version",
+	exclusive: charmOnly,
+	get: entityGetter(func(entity *mongodoc.Entity) interface{} {
+		if entity.CharmMeta == nil {
+			return nil
+		}
+		return &v5.MinJujuVersionResponse{
+			MinJujuVersion: entity.CharmMeta.MinJujuVersion,
+		}
+	}),
+	checkURL: newResolvedURL("~charmers/precise/wordpress-23", 23),
+	assertCheckData: func(c *gc.C, data interface{}) {
+		c.Assert(data.(*v5.MinJujuVersionResponse).MinJujuVersion, gc.Equals, version.Number{})
+	},
+}, {
+	name:      "assumes",
+	exclusive: charmOnly,
+	get: entityGetter(func(entity *mongodoc.Entity) interface{} {
+		if entity.CharmMeta == nil {
+			return nil
+		}
+		// None of the test charms have an assumes block.
+		return &v5.AssumesResponse{
+			Assumes: []v5.AssumesExpression{},
+		}
+	}),
+	checkURL: newResolvedURL("~charmers/precise/wordpress-23", 23),
+	assertCheckData: func(c *gc.C, data interface{}) {
+		c.Assert(data, jc.DeepEquals, &v5.AssumesResponse{
+			Assumes: []v5.AssumesExpression{},
+		})
+	},
+}, {
+	name: "provenance",
+	get: entityGetter(func(entity *mongodoc.Entity) interface{} {
+		// None of the test entities were ingested.
+		return nil
+	}),
+	checkURL: newResolvedURL("~charmers/precise/wordpress-23", 23),
+	assertCheckData: func(c *gc.C, data interface{}) {
+		c.Assert(data, gc.IsNil)
+	},
+}, {
+	name:      "lxd-profile",
+	exclusive: charmOnly,
+	get: entityGetter(func(entity *mongodoc.Entity) interface{} {
+		// None of the test charms have an LXD profile.
+		return nil
+	}),
+	checkURL: newResolvedURL("~charmers/precise/wordpress-23", 23),
+	assertCheckData: func(c *gc.C, data interface{}) {
+		c.Assert(data, gc.IsNil)
+	},
 }, {
 	name:      "bundle-metadata",
 	exclusive: bundleOnly,
@@ -236,6 +363,15 @@ var metaEndpoints = []metaEndpoint{{
 	assertCheckData: func(c *gc.C, data interface{}) {
 		c.Assert(data.([]params.ManifestFile), gc.Not(gc.HasLen), 0)
 	},
+}, {
+	name: "archive-tree",
+	get: zipGetter(func(r *zip.Reader) interface{} {
+		return v5.NewArchiveTree(r.File)
+	}),
+	checkURL: newResolvedURL("~charmers/bundle/wordpress-simple-42", 42),
+	assertCheckData: func(c *gc.C, data interface{}) {
+		c.Assert(data.(*v5.ArchiveTreeEntry).Children, gc.Not(gc.HasLen), 0)
+	},
 }, {
 	name: "archive-upload-time",
 	get: entityGetter(func(entity *mongodoc.Entity) interface{} {
@@ -302,6 +438,41 @@ var metaEndpoints = []metaEndpoint{{
 	assertCheckData: func(c *gc.C, data interface{}) {
 		c.Assert(data, gc.FitsTypeOf, (*params.RelatedResponse)(nil))
 	},
+}, {
+	name:      "bundle-closure",
+	exclusive: bundleOnly,
+	get: func(store *charmstore.Store, url *router.ResolvedURL) (interface{}, error) {
+		if url.URL.Series != "bundle" {
+			return nil, nil
+		}
+		ids, unresolved, err := store.BundleClosure(url, params.StableChannel)
+		if err != nil {
+			return nil, err
+		}
+		resp := &v5.BundleClosureResponse{
+			Charms:     make([]v5.ChannelHead, len(ids)),
+			Unresolved: unresolved,
+		}
+		for i, id := range ids {
+			resp.Charms[i] = v5.ChannelHead{
+				Id:            &id.URL,
+				PromulgatedId: id.PromulgatedURL(),
+			}
+		}
+		return resp, nil
+	},
+	checkURL: newResolvedURL("~charmers/bundle/wordpress-simple-42", 42),
+	assertCheckData: func(c *gc.C, data interface{}) {
+		c.Assert(data, jc.DeepEquals, &v5.BundleClosureResponse{
+			Charms: []v5.ChannelHead{{
+				Id:            charm.MustParseURL("cs:~charmers/precise/mysql-5"),
+				PromulgatedId: charm.MustParseURL("cs:precise/mysql-5"),
+			}, {
+				Id:            charm.MustParseURL("cs:~charmers/precise/wordpress-23"),
+				PromulgatedId: charm.MustParseURL("cs:precise/wordpress-23"),
+			}},
+		})
+	},
 }, {
 	name:      "bundles-containing",
 	exclusive: charmOnly,
@@ -321,13 +492,11 @@ var metaEndpoints = []metaEndpoint{{
 	name: "stats",
 	get: func(store *charmstore.Store, url *router.ResolvedURL) (interface{}, error) {
 		// The entities used for those tests were never downloaded.
-		return &params.StatsResponse{
-			ArchiveDownloadCount: 0,
-		}, nil
+		return &v5.StatsResponse{}, nil
 	},
 	checkURL: newResolvedURL("~charmers/precise/wordpress-23", 23),
 	assertCheckData: func(c *gc.C, data interface{}) {
-		c.Assert(data, gc.FitsTypeOf, (*params.StatsResponse)(nil))
+		c.Assert(data, gc.FitsTypeOf, (*v5.StatsResponse)(nil))
 	},
 }, {
 	name: "extra-info",
@@ -581,6 +750,20 @@ var metaEndpoints = []metaEndpoint{{
 	assertCheckData: func(c *gc.C, data interface{}) {
 		c.Assert(data, gc.Equals, params.CanIngestResponse{CanIngest: true})
 	},
+}, {
+	name: "yanked",
+	get: entityGetter(func(entity *mongodoc.Entity) interface{} {
+		// None of the test entities have been yanked.
+		return &v5.YankedResponse{
+			Channels: []params.Channel{},
+		}
+	}),
+	checkURL: newResolvedURL("~charmers/precise/wordpress-23", 23),
+	assertCheckData: func(c *gc.C, data interface{}) {
+		c.Assert(data, jc.DeepEquals, &v5.YankedResponse{
+			Channels: []params.Channel{},
+		})
+	},
 }, {
 	name: "supported-series",
 	get: entityGetter(func(entity *mongodoc.Entity) interface{} {
@@ -717,6 +900,183 @@ var metaEndpoints = []metaEndpoint{{
 			}},
 		})
 	},
+}, {
+	name: "published-time",
+	get: func(store *charmstore.Store, url *router.ResolvedURL) (interface{}, error) {
+		// All the entities published are in stable.
+		t, err := store.PublishTime(url, params.StableChannel)
+		if err != nil {
+			return nil, err
+		}
+		return &v5.PublishedTimeResponse{
+			Channel:     params.StableChannel,
+			PublishTime: t.UTC(),
+		}, nil
+	},
+	checkURL: newResolvedURL("cs:~charmers/precise/wordpress-23", 23),
+	assertCheckData: func(c *gc.C, data interface{}) {
+		c.Assert(data.(*v5.PublishedTimeResponse).Channel, gc.Equals, params.StableChannel)
+		c.Assert(data.(*v5.PublishedTimeResponse).PublishTime.IsZero(), gc.Equals, false)
+	},
+}, {
+	name: "channel-history",
+	get: func(store *charmstore.Store, url *router.ResolvedURL) (interface{}, error) {
+		// All the entities published are in stable.
+		series := url.URL.Series
+		if series == "" {
+			entity, err := store.FindEntity(url, charmstore.FieldSelector("supportedseries"))
+			if err != nil {
+				return nil, err
+			}
+			series = entity.SupportedSeries[0]
+		}
+		return store.ChannelHistory(mongodoc.BaseURL(&url.URL), series, params.StableChannel)
+	},
+	checkURL: newResolvedURL("cs:~charmers/precise/wordpress-23", 23),
+	assertCheckData: func(c *gc.C, data interface{}) {
+		history := data.([]charmstore.ChannelHistoryEntry)
+		c.Assert(history, gc.HasLen, 1)
+		c.Assert(history[0].Revision, gc.Equals, 23)
+		c.Assert(history[0].PublishedAt.IsZero(), gc.Equals, false)
+	},
+}, {
+	name: "channel-heads",
+	get: func(store *charmstore.Store, url *router.ResolvedURL) (interface{}, error) {
+		heads, err := store.ChannelHeads(&url.URL)
+		if err != nil {
+			return nil, err
+		}
+		resp := make(v5.ChannelHeadsResponse)
+		for ch, entities := range heads {
+			resp[ch] = make(map[string]v5.ChannelHead)
+			for series, id := range entities {
+				resp[ch][series] = v5.ChannelHead{
+					Id:            &id.URL,
+					PromulgatedId: id.PromulgatedURL(),
+				}
+			}
+		}
+		return resp, nil
+	},
+	checkURL: newResolvedURL("cs:~charmers/precise/wordpress-23", 23),
+	assertCheckData: func(c *gc.C, data interface{}) {
+		c.Assert(data, jc.DeepEquals, v5.ChannelHeadsResponse{
+			params.StableChannel: {
+				"precise": {
+					Id:            charm.MustParseURL("cs:~charmers/precise/wordpress-23"),
+					PromulgatedId: charm.MustParseURL("cs:precise/wordpress-23"),
+				},
+			},
+		})
+	},
+}, {
+	name: "channel-status",
+	get: func(store *charmstore.Store, url *router.ResolvedURL) (interface{}, error) {
+		e, err := store.FindBaseEntity(&url.URL, nil)
+		if err != nil {
+			return nil, err
+		}
+		status, err := store.ChannelStatus(e)
+		if err != nil {
+			return nil, err
+		}
+		resp := make(v5.ChannelStatusResponse)
+		for ch, st := range status {
+			if st == nil {
+				resp[ch] = nil
+				continue
+			}
+			resp[ch] = &v5.ChannelStatus{
+				Heads: make(map[string]v5.ChannelHead),
+			}
+			for series, id := range st.Heads {
+				resp[ch].Heads[series] = v5.ChannelHead{
+					Id:            &id.URL,
+					PromulgatedId: id.PromulgatedURL(),
+				}
+			}
+			if !st.PublishTime.IsZero() {
+				resp[ch].PublishTime = &st.PublishTime
+			}
+		}
+		return resp, nil
+	},
+	checkURL: newResolvedURL("cs:~charmers/precise/wordpress-23", 23),
+	assertCheckData: func(c *gc.C, data interface{}) {
+		resp := data.(v5.ChannelStatusResponse)
+		c.Assert(resp[params.StableChannel], gc.NotNil)
+		c.Assert(resp[params.StableChannel].Heads, jc.DeepEquals, map[string]v5.ChannelHead{
+			"precise": {
+				Id:            charm.MustParseURL("cs:~charmers/precise/wordpress-23"),
+				PromulgatedId: charm.MustParseURL("cs:precise/wordpress-23"),
+			},
+		})
+	},
+}, {
+	name:      "can-deploy",
+	exclusive: charmOnly,
+	query:     "base=ubuntu@12.04",
+	get: entityGetter(func(entity *mongodoc.Entity) interface{} {
+		if entity.URL.Series == "bundle" {
+			return nil
+		}
+		supported := entity.SupportedSeries
+		if len(supported) == 0 {
+			supported = []string{entity.URL.Series}
+		}
+		for _, s := range supported {
+			if s == "precise" {
+				return &v5.CanDeployResponse{
+					CanDeploy: true,
+				}
+			}
+		}
+		return &v5.CanDeployResponse{
+			Reason: fmt.Sprintf("series \"precise\" not supported (supported series: %s)", strings.Join(supported, ", ")),
+		}
+	}),
+	checkURL: newResolvedURL("~charmers/precise/wordpress-23", 23),
+	assertCheckData: func(c *gc.C, data interface{}) {
+		c.Assert(data, jc.DeepEquals, &v5.CanDeployResponse{
+			CanDeploy: true,
+		})
+	},
+}, {
+	name:  "audit",
+	admin: true,
+	get: func(store *charmstore.Store, url *router.ResolvedURL) (interface{}, error) {
+		entries, err := store.EntityAuditHistory(&url.URL, 0)
+		if err != nil {
+			return nil, err
+		}
+		for i := range entries {
+			entries[i].Time = entries[i].Time.UTC()
+		}
+		return entries, nil
+	},
+	checkURL: newResolvedURL("~charmers/precise/wordpress-23", 23),
+	assertCheckData: func(c *gc.C, data interface{}) {
+		entries := data.([]audit.Entry)
+		c.Assert(entries, gc.Not(gc.HasLen), 0)
+		c.Assert(entries[len(entries)-1].Op, gc.Equals, audit.OpUpload)
+	},
+}, {
+	name: "highest-revision",
+	get: func(store *charmstore.Store, url *router.ResolvedURL) (interface{}, error) {
+		rev, err := store.HighestRevision(mongodoc.BaseURL(&url.URL))
+		if err != nil {
+			return nil, err
+		}
+		return &v5.HighestRevisionResponse{
+			Revision: rev,
+		}, nil
+	},
+	checkURL: newResolvedURL("cs:~charmers/precise/wordpress-23", 23),
+	assertCheckData: func(c *gc.C, data interface{}) {
+		c.Assert(data, jc.DeepEquals, &v5.HighestRevisionResponse{
+			Revision: 23,
+		})
+	},
 }}
 
 // TestEndpointGet tries to ensure that the endpoint
@@ -824,6 +1184,13 @@ func (s *APISuite) TestMetaEndpointsSingle(c *gc.C) {
 		for _, url := range urls {
 			charmId := strings.TrimPrefix(url.String(), "cs:")
 			path := charmId + "/meta/" + ep.name
+			if ep.query != "" {
+				path += "?" + ep.query
+			}
+			var username, password string
+			if ep.admin {
+				username, password = testUsername, testPassword
+			}
 			expectData, err := ep.get(s.store, url)
 			if err != nil && ep.isExcluded(url) {
 				// endpoint not relevant.
@@ -836,6 +1203,8 @@ func (s *APISuite) TestMetaEndpointsSingle(c *gc.C) {
 					Handler:      s.srv,
 					Do:           do,
 					URL:          storeURL(path),
+					Username:     username,
+					Password:     password,
 					ExpectStatus: http.StatusNotFound,
 					ExpectBody: params.Error{
 						Message: params.ErrMetadataNotFound.Error(),
@@ -850,6 +1219,8 @@ func (s *APISuite) TestMetaEndpointsSingle(c *gc.C) {
 				Handler:    s.srv,
 				Do:         do,
 				URL:        storeURL(path),
+				Username:   username,
+				Password:   password,
 				ExpectBody: expectData,
 			})
 		}
@@ -1004,42 +1375,504 @@ func (s *APISuite) TestMetaPublished(c *gc.C) {
 	}
 }
 
-func (s *APISuite) TestMetaPermAudit(c *gc.C) {
-	var calledEntities []audit.Entry
-	s.PatchValue(v5.TestAddAuditCallback, func(e audit.Entry) {
-		calledEntities = append(calledEntities, e)
+func (s *APISuite) TestMetaChannelHistory(c *gc.C) {
+	for _, id := range []*router.ResolvedURL{
+		newResolvedURL("~charmers/precise/wordpress-0", -1),
+		newResolvedURL("~charmers/precise/wordpress-1", -1),
+	} {
+		err := s.store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+		c.Assert(err, gc.Equals, nil)
+	}
+	err := s.store.SetPerms(charm.MustParseURL("~charmers/wordpress"), "edge.read", params.Everyone)
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.PublishAs("bob", newResolvedURL("~charmers/precise/wordpress-0", -1), nil, false, params.EdgeChannel)
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.PublishAs("alice", newResolvedURL("~charmers/precise/wordpress-1", -1), nil, false, params.EdgeChannel)
+	c.Assert(err, gc.Equals, nil)
+
+	var history []charmstore.ChannelHistoryEntry
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		URL:     storeURL("~charmers/precise/wordpress-1/meta/channel-history?channel=edge"),
+		ExpectBody: httptesting.BodyAsserter(func(c *gc.C, body json.RawMessage) {
+			err := json.Unmarshal(body, &history)
+			c.Assert(err, gc.Equals, nil)
+		}),
 	})
-	s.idmServer.SetDefaultUser("bob")
+	c.Assert(history, gc.HasLen, 2)
+	c.Assert(history[0].Revision, gc.Equals, 1)
+	c.Assert(history[0].PublishedBy, gc.Equals, "alice")
+	c.Assert(history[1].Revision, gc.Equals, 0)
+	c.Assert(history[1].PublishedBy, gc.Equals, "bob")
+	c.Assert(history[0].PublishedAt.Before(history[1].PublishedAt), gc.Equals, false)
+
+	// Nothing has been published for the trusty series.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:    s.srv,
+		URL:        storeURL("~charmers/precise/wordpress-1/meta/channel-history?channel=edge&series=trusty"),
+		ExpectBody: []charmstore.ChannelHistoryEntry{},
+	})
+}
 
-	url := newResolvedURL("~bob/precise/wordpress-23", 23)
-	s.addPublicCharmFromRepo(c, "wordpress", url)
-	s.assertPut(c, "precise/wordpress-23/meta/perm/read", []string{"charlie"})
-	c.Assert(calledEntities, jc.DeepEquals, []audit.Entry{{
-		User: "bob",
-		Op:   audit.OpSetPerm,
-		ACL: &audit.ACL{
-			Read: []string{"charlie"},
-		},
-		Entity: charm.MustParseURL("~bob/precise/wordpress-23"),
-	}})
-	calledEntities = []audit.Entry{}
+func (s *APISuite) TestMetaPublishedTime(c *gc.C) {
+	id := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	err := s.store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.SetPerms(&id.URL, "unpublished.read", params.Everyone)
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.SetPerms(&id.URL, "edge.read", params.Everyone)
+	c.Assert(err, gc.Equals, nil)
 
-	s.assertPutAsAdmin(c, "precise/wordpress-23/meta/perm/write", []string{"bob", "foo"})
-	c.Assert(calledEntities, jc.DeepEquals, []audit.Entry{{
-		User: "admin",
-		Op:   audit.OpSetPerm,
-		ACL: &audit.ACL{
-			Write: []string{"bob", "foo"},
+	// An unpublished entity has no publish time.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		URL:     storeURL("~charmers/precise/wordpress-0/meta/any?include=published-time&channel=unpublished"),
+		ExpectBody: params.MetaAnyResponse{
+			Id: charm.MustParseURL("cs:~charmers/precise/wordpress-0"),
 		},
-		Entity: charm.MustParseURL("~bob/precise/wordpress-23"),
-	}})
-	calledEntities = []audit.Entry{}
-
-	s.assertPut(c, "precise/wordpress-23/meta/perm", params.PermRequest{
-		Read:  []string{"a"},
-		Write: []string{"b", "c"},
 	})
-	c.Assert(calledEntities, jc.DeepEquals, []audit.Entry{{
+
+	before := time.Now()
+	err = s.store.Publish(id, nil, params.EdgeChannel)
+	c.Assert(err, gc.Equals, nil)
+	after := time.Now()
+	t, err := s.store.PublishTime(id, params.EdgeChannel)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(t.Before(before.Add(-time.Second)), gc.Equals, false)
+	c.Assert(t.After(after.Add(time.Second)), gc.Equals, false)
+	expect := &v5.PublishedTimeResponse{
+		Channel:     params.EdgeChannel,
+		PublishTime: t.UTC(),
+	}
+
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:    s.srv,
+		URL:        storeURL("~charmers/precise/wordpress-0/meta/published-time?channel=edge"),
+		ExpectBody: expect,
+	})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		URL:     storeURL("~charmers/precise/wordpress-0/meta/any?include=published-time&channel=edge"),
+		ExpectBody: params.MetaAnyResponse{
+			Id: charm.MustParseURL("cs:~charmers/precise/wordpress-0"),
+			Meta: map[string]interface{}{
+				"published-time": expect,
+			},
+		},
+	})
+
+	// The entity has not been published to the stable channel.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("~charmers/precise/wordpress-0/meta/published-time?channel=stable"),
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody: params.Error{
+			Code:    params.ErrNotFound,
+			Message: `cs:~charmers/precise/wordpress-0 not found in stable channel`,
+		},
+	})
+	_, err = s.store.PublishTime(id, params.StableChannel)
+	c.Assert(err, gc.ErrorMatches, `cs:~charmers/precise/wordpress-0 has not been published to the stable channel`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *APISuite) TestMetaAssumes(c *gc.C) {
+	id := newResolvedURL("~charmers/focal/assumer-0", -1)
+	ch := storetesting.NewCharm(nil).WithAssumes(
+		"juju >= 2.9",
+		map[string]interface{}{
+			"any-of": []interface{}{"k8s-api", "lxd"},
+		},
+	)
+	s.addPublicCharm(c, ch, id)
+	s.assertGet(c, "~charmers/focal/assumer-0/meta/assumes", &v5.AssumesResponse{
+		Assumes: []v5.AssumesExpression{{
+			Feature: "juju",
+			Op:      ">=",
+			Version: "2.9",
+		}, {
+			AnyOf: []v5.AssumesExpression{{
+				Feature: "k8s-api",
+			}, {
+				Feature: "lxd",
+			}},
+		}},
+	})
+}
+
+func (s *APISuite) TestMetaLXDProfile(c *gc.C) {
+	id := newResolvedURL("~charmers/focal/profiled-0", -1)
+	ch := storetesting.NewCharm(nil).WithLXDProfile(&charm.LXDProfile{
+		Description: "profile for testing",
+		Config: map[string]string{
+			"security.nesting": "true",
+		},
+		Devices: map[string]map[string]string{
+			"tun": {
+				"type": "unix-char",
+				"path": "/dev/net/tun",
+			},
+		},
+	})
+	s.addPublicCharm(c, ch, id)
+	s.assertGet(c, "~charmers/focal/profiled-0/meta/lxd-profile", &v5.LXDProfileResponse{
+		Description: "profile for testing",
+		Config: map[string]string{
+			"security.nesting": "true",
+		},
+		Devices: map[string]map[string]string{
+			"tun": {
+				"type": "unix-char",
+				"path": "/dev/net/tun",
+			},
+		},
+	})
+	// The location of the profile in the archive is now cached.
+	entity, err := s.store.FindEntity(id, charmstore.FieldSelector("contents"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entity.Contents[mongodoc.FileLXDProfile].IsValid(), gc.Equals, true)
+}
+
+func (s *APISuite) TestMetaLXDProfileNotFound(c *gc.C) {
+	id := newResolvedURL("~charmers/focal/unprofiled-0", -1)
+	s.addPublicCharm(c, storetesting.NewCharm(nil), id)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("~charmers/focal/unprofiled-0/meta/lxd-profile"),
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody: params.Error{
+			Code:    params.ErrMetadataNotFound,
+			Message: params.ErrMetadataNotFound.Error(),
+		},
+	})
+}
+
+func (s *APISuite) TestMetaLXDProfileDisallowed(c *gc.C) {
+	id := newResolvedURL("~charmers/focal/profiled-0", -1)
+	ch := storetesting.NewCharm(nil).WithLXDProfile(&charm.LXDProfile{
+		Config: map[string]string{
+			"boot.autostart":   "true",
+			"limits.memory":    "1GB",
+			"security.nesting": "true",
+		},
+		Devices: map[string]map[string]string{
+			"root": {
+				"type": "disk",
+				"path": "/",
+			},
+			"tun": {
+				"type": "unix-char",
+				"path": "/dev/net/tun",
+			},
+		},
+	})
+	s.addPublicCharm(c, ch, id)
+	s.assertGet(c, "~charmers/focal/profiled-0/meta/lxd-profile", &v5.LXDProfileResponse{
+		Config: map[string]string{
+			"boot.autostart":   "true",
+			"limits.memory":    "1GB",
+			"security.nesting": "true",
+		},
+		Devices: map[string]map[string]string{
+			"root": {
+				"type": "disk",
+				"path": "/",
+			},
+			"tun": {
+				"type": "unix-char",
+				"path": "/dev/net/tun",
+			},
+		},
+		DisallowedConfig:  []string{"boot.autostart", "limits.memory"},
+		DisallowedDevices: []string{"root"},
+	})
+}
+
+func (s *APISuite) TestMetaYanked(c *gc.C) {
+	id0 := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	s.addPublicCharm(c, storetesting.NewCharm(nil), id0)
+	id1 := newResolvedURL("~charmers/precise/wordpress-1", -1)
+	s.addPublicCharm(c, storetesting.NewCharm(nil), id1)
+	err := s.store.Publish(id1, nil, params.EdgeChannel)
+	c.Assert(err, gc.Equals, nil)
+
+	err = s.store.YankRevision(id1, params.StableChannel, "bob")
+	c.Assert(err, gc.Equals, nil)
+	s.assertGet(c, "~charmers/precise/wordpress-1/meta/yanked", &v5.YankedResponse{
+		Channels: []params.Channel{params.StableChannel},
+	})
+	s.assertGet(c, "~charmers/precise/wordpress-0/meta/yanked", &v5.YankedResponse{
+		Channels: []params.Channel{},
+	})
+
+	// The yanked revision cannot be resolved in the
+	// stable channel, but it is still available in edge.
+	s.assertGet(c, "~charmers/precise/wordpress/meta/id-revision", params.IdRevisionResponse{
+		Revision: 0,
+	})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("~charmers/precise/wordpress-1/meta/id-revision?channel=stable"),
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody: params.Error{
+			Code:    params.ErrNotFound,
+			Message: "cs:~charmers/precise/wordpress-1 not found in stable channel",
+		},
+	})
+	s.assertGet(c, "~charmers/precise/wordpress/meta/id-revision?channel=edge", params.IdRevisionResponse{
+		Revision: 1,
+	})
+}
+
+func (s *APISuite) TestMetaChannelHeads(c *gc.C) {
+	for _, test := range []struct {
+		id       string
+		channels []params.Channel
+	}{{
+		id:       "~charmers/trusty/wordpress-0",
+		channels: []params.Channel{params.StableChannel, params.EdgeChannel},
+	}, {
+		id:       "~charmers/xenial/wordpress-1",
+		channels: []params.Channel{params.EdgeChannel},
+	}, {
+		id:       "~charmers/trusty/wordpress-2",
+		channels: []params.Channel{params.EdgeChannel},
+	}} {
+		id := newResolvedURL(test.id, charm.MustParseURL(test.id).Revision)
+		err := s.store.AddCharmWithArchive(id, storetesting.Charms.CharmDir("wordpress"))
+		c.Assert(err, gc.Equals, nil)
+		err = s.store.Publish(id, nil, test.channels...)
+		c.Assert(err, gc.Equals, nil)
+	}
+	err := s.store.SetPerms(charm.MustParseURL("~charmers/wordpress"), "stable.read", params.Everyone)
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.SetPerms(charm.MustParseURL("~charmers/wordpress"), "edge.read", "charmers")
+	c.Assert(err, gc.Equals, nil)
+
+	stableHeads := map[string]v5.ChannelHead{
+		"trusty": {
+			Id:            charm.MustParseURL("cs:~charmers/trusty/wordpress-0"),
+			PromulgatedId: charm.MustParseURL("cs:trusty/wordpress-0"),
+		},
+	}
+	edgeHeads := map[string]v5.ChannelHead{
+		"trusty": {
+			Id:            charm.MustParseURL("cs:~charmers/trusty/wordpress-2"),
+			PromulgatedId: charm.MustParseURL("cs:trusty/wordpress-2"),
+		},
+		"xenial": {
+			Id:            charm.MustParseURL("cs:~charmers/xenial/wordpress-1"),
+			PromulgatedId: charm.MustParseURL("cs:xenial/wordpress-1"),
+		},
+	}
+
+	// An anonymous user can only see the stable channel.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		URL:     storeURL("~charmers/trusty/wordpress-0/meta/channel-heads"),
+		ExpectBody: v5.ChannelHeadsResponse{
+			params.StableChannel: stableHeads,
+		},
+	})
+
+	// The owner can see both channels, including through meta/any.
+	s.idmServer.SetDefaultUser("charmers")
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		Do:      bakeryDo(nil),
+		URL:     storeURL("~charmers/trusty/wordpress-0/meta/any?include=channel-heads"),
+		ExpectBody: params.MetaAnyResponse{
+			Id: charm.MustParseURL("cs:~charmers/trusty/wordpress-0"),
+			Meta: map[string]interface{}{
+				"channel-heads": v5.ChannelHeadsResponse{
+					params.StableChannel: stableHeads,
+					params.EdgeChannel:   edgeHeads,
+				},
+			},
+		},
+	})
+}
+
+func (s *APISuite) TestMetaChannelStatus(c *gc.C) {
+	id := newResolvedURL("~charmers/trusty/wordpress-3", -1)
+	err := s.store.AddCharmWithArchive(id, storetesting.Charms.CharmDir("wordpress"))
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.Publish(id, nil, params.EdgeChannel)
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.SetPerms(charm.MustParseURL("~charmers/wordpress"), "stable.read", params.Everyone)
+	c.Assert(err, gc.Equals, nil)
+	for _, ch := range []params.Channel{params.CandidateChannel, params.BetaChannel, params.EdgeChannel} {
+		err = s.store.SetPerms(charm.MustParseURL("~charmers/wordpress"), string(ch)+".read", params.Everyone)
+		c.Assert(err, gc.Equals, nil)
+	}
+	baseEntity, err := s.store.FindBaseEntity(charm.MustParseURL("~charmers/wordpress"), nil)
+	c.Assert(err, gc.Equals, nil)
+	status, err := s.store.ChannelStatus(baseEntity)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(status[params.EdgeChannel], gc.NotNil)
+	publishTime := status[params.EdgeChannel].PublishTime
+	c.Assert(publishTime.IsZero(), gc.Equals, false)
+
+	// The channels with nothing released are included as null.
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL("~charmers/trusty/wordpress-3/meta/channel-status"),
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.Bytes()))
+	c.Assert(rec.Body.String(), jc.JSONEquals, map[string]interface{}{
+		"stable":    nil,
+		"candidate": nil,
+		"beta":      nil,
+		"edge": map[string]interface{}{
+			"Heads": map[string]interface{}{
+				"trusty": map[string]interface{}{
+					"Id": "cs:~charmers/trusty/wordpress-3",
+				},
+			},
+			"PublishTime": publishTime,
+		},
+	})
+}
+
+func (s *APISuite) TestMetaBundleClosure(c *gc.C) {
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("~charmers/precise/wordpress-23", 23))
+	s.addPublicCharmFromRepo(c, "mysql", newResolvedURL("~charmers/precise/mysql-5", 5))
+	bundleId := newResolvedURL("~charmers/bundle/wordpress-simple-42", 42)
+	s.addPublicBundleFromRepo(c, "wordpress-simple", bundleId, false)
+
+	// Make a newer revision of mysql available in the edge channel
+	// alongside the same wordpress and bundle revisions.
+	mysqlId := newResolvedURL("~charmers/precise/mysql-6", 6)
+	err := s.store.AddCharmWithArchive(mysqlId, storetesting.Charms.CharmDir("mysql"))
+	c.Assert(err, gc.Equals, nil)
+	for _, id := range []*router.ResolvedURL{
+		mysqlId,
+		newResolvedURL("~charmers/precise/wordpress-23", 23),
+		bundleId,
+	} {
+		err = s.store.Publish(id, nil, params.EdgeChannel)
+		c.Assert(err, gc.Equals, nil)
+		err = s.store.SetPerms(&id.URL, "edge.read", params.Everyone)
+		c.Assert(err, gc.Equals, nil)
+	}
+
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		URL:     storeURL("bundle/wordpress-simple-42/meta/bundle-closure"),
+		ExpectBody: v5.BundleClosureResponse{
+			Charms: []v5.ChannelHead{{
+				Id:            charm.MustParseURL("cs:~charmers/precise/mysql-5"),
+				PromulgatedId: charm.MustParseURL("cs:precise/mysql-5"),
+			}, {
+				Id:            charm.MustParseURL("cs:~charmers/precise/wordpress-23"),
+				PromulgatedId: charm.MustParseURL("cs:precise/wordpress-23"),
+			}},
+		},
+	})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		URL:     storeURL("bundle/wordpress-simple-42/meta/bundle-closure?channel=edge"),
+		ExpectBody: v5.BundleClosureResponse{
+			Charms: []v5.ChannelHead{{
+				Id:            charm.MustParseURL("cs:~charmers/precise/mysql-6"),
+				PromulgatedId: charm.MustParseURL("cs:precise/mysql-6"),
+			}, {
+				Id:            charm.MustParseURL("cs:~charmers/precise/wordpress-23"),
+				PromulgatedId: charm.MustParseURL("cs:precise/wordpress-23"),
+			}},
+		},
+	})
+
+	// Charms that the user cannot read are omitted.
+	err = s.store.SetPerms(charm.MustParseURL("~charmers/mysql"), "edge.read", "bob")
+	c.Assert(err, gc.Equals, nil)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		URL:     storeURL("bundle/wordpress-simple-42/meta/bundle-closure?channel=edge"),
+		ExpectBody: v5.BundleClosureResponse{
+			Charms: []v5.ChannelHead{{
+				Id:            charm.MustParseURL("cs:~charmers/precise/wordpress-23"),
+				PromulgatedId: charm.MustParseURL("cs:precise/wordpress-23"),
+			}},
+		},
+	})
+
+	// Charms that cannot be resolved in the channel are reported
+	// without failing the whole request.
+	err = s.store.Publish(bundleId, nil, params.CandidateChannel)
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.SetPerms(&bundleId.URL, "candidate.read", params.Everyone)
+	c.Assert(err, gc.Equals, nil)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		URL:     storeURL("bundle/wordpress-simple-42/meta/bundle-closure?channel=candidate"),
+		ExpectBody: v5.BundleClosureResponse{
+			Charms: []v5.ChannelHead{},
+			Unresolved: []*charm.URL{
+				charm.MustParseURL("cs:mysql"),
+				charm.MustParseURL("cs:wordpress"),
+			},
+		},
+	})
+}
+
+func (s *APISuite) TestMetaHighestRevision(c *gc.C) {
+	for _, id := range []string{
+		"~charmers/trusty/wordpress-0",
+		"~charmers/xenial/wordpress-3",
+		"~charmers/trusty/wordpress-1",
+	} {
+		s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL(id, -1))
+	}
+	// An unpublished revision still counts.
+	err := s.store.AddCharmWithArchive(newResolvedURL("~charmers/trusty/wordpress-5", -1), storetesting.Charms.CharmDir("wordpress"))
+	c.Assert(err, gc.Equals, nil)
+
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		URL:     storeURL("~charmers/trusty/wordpress-0/meta/highest-revision"),
+		ExpectBody: v5.HighestRevisionResponse{
+			Revision: 5,
+		},
+	})
+}
+
+func (s *APISuite) TestMetaPermAudit(c *gc.C) {
+	var calledEntities []audit.Entry
+	s.PatchValue(v5.TestAddAuditCallback, func(e audit.Entry) {
+		calledEntities = append(calledEntities, e)
+	})
+	s.idmServer.SetDefaultUser("bob")
+
+	url := newResolvedURL("~bob/precise/wordpress-23", 23)
+	s.addPublicCharmFromRepo(c, "wordpress", url)
+	s.assertPut(c, "precise/wordpress-23/meta/perm/read", []string{"charlie"})
+	c.Assert(calledEntities, jc.DeepEquals, []audit.Entry{{
+		User: "bob",
+		Op:   audit.OpSetPerm,
+		ACL: &audit.ACL{
+			Read: []string{"charlie"},
+		},
+		Entity: charm.MustParseURL("~bob/precise/wordpress-23"),
+	}})
+	calledEntities = []audit.Entry{}
+
+	s.assertPutAsAdmin(c, "precise/wordpress-23/meta/perm/write", []string{"bob", "foo"})
+	c.Assert(calledEntities, jc.DeepEquals, []audit.Entry{{
+		User: "admin",
+		Op:   audit.OpSetPerm,
+		ACL: &audit.ACL{
+			Write: []string{"bob", "foo"},
+		},
+		Entity: charm.MustParseURL("~bob/precise/wordpress-23"),
+	}})
+	calledEntities = []audit.Entry{}
+
+	s.assertPut(c, "precise/wordpress-23/meta/perm", params.PermRequest{
+		Read:  []string{"a"},
+		Write: []string{"b", "c"},
+	})
+	c.Assert(calledEntities, jc.DeepEquals, []audit.Entry{{
 		User: "bob",
 		Op:   audit.OpSetPerm,
 		ACL: &audit.ACL{
@@ -1574,6 +2407,114 @@ func (s *APISuite) TestMetaPermGetAsAdmin(c *gc.C) {
 	})
 }
 
+func (s *APISuite) TestMetaPermEffective(c *gc.C) {
+	config := s.noMacaroonSrvParams
+	config.GroupMembers = func(group string) ([]string, error) {
+		if group == "charmers" {
+			return []string{"bob", "alice"}, nil
+		}
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "group %q not found", group)
+	}
+	srv, err := charmstore.NewServer(s.Session.DB("charmstore"), nil, config, map[string]charmstore.NewAPIHandlerFunc{"v5": v5.NewAPIHandler})
+	c.Assert(err, gc.Equals, nil)
+	defer srv.Close()
+
+	id := newResolvedURL("~charmers/precise/wordpress-23", 23)
+	err = s.store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.SetPerms(&id.URL, "unpublished.read", "charmers", "dave")
+	c.Assert(err, gc.Equals, nil)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:    srv,
+		URL:        storeURL("~charmers/precise/wordpress-23/meta/perm/effective"),
+		Username:   testUsername,
+		Password:   testPassword,
+		ExpectBody: []string{"alice", "bob", "dave"},
+	})
+
+	err = s.store.SetPerms(&id.URL, "unpublished.read", "charmers", params.Everyone)
+	c.Assert(err, gc.Equals, nil)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:    srv,
+		URL:        storeURL("~charmers/precise/wordpress-23/meta/perm/effective"),
+		Username:   testUsername,
+		Password:   testPassword,
+		ExpectBody: []string{params.Everyone},
+	})
+
+	// The endpoint requires admin credentials.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      srv,
+		URL:          storeURL("~charmers/precise/wordpress-23/meta/perm/effective"),
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody: params.Error{
+			Code:    params.ErrUnauthorized,
+			Message: "authentication failed: missing HTTP auth header",
+		},
+	})
+}
+
+func (s *APISuite) TestMetaAudit(c *gc.C) {
+	id := newResolvedURL("~charmers/precise/wordpress-23", 23)
+	err := s.store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	entity, err := s.store.FindEntity(id, charmstore.FieldSelector("blobhash", "size"))
+	c.Assert(err, gc.Equals, nil)
+	expect := []audit.Entry{{
+		User:     "charmers",
+		Op:       audit.OpUpload,
+		Entity:   &id.URL,
+		BlobHash: entity.BlobHash,
+		Size:     entity.Size,
+	}}
+	for _, readers := range [][]string{{"bob"}, {"bob", "alice"}, {"everyone"}} {
+		s.assertPutAsAdmin(c, "~charmers/precise/wordpress-23/meta/perm/read", readers)
+		expect = append([]audit.Entry{{
+			User:   "admin",
+			Op:     audit.OpSetPerm,
+			Entity: &id.URL,
+			ACL: &audit.ACL{
+				Read: readers,
+			},
+		}}, expect...)
+	}
+
+	for _, limit := range []int{0, 2} {
+		path := "~charmers/precise/wordpress-23/meta/audit"
+		expectEntries := expect
+		if limit > 0 {
+			path += fmt.Sprintf("?limit=%d", limit)
+			expectEntries = expect[:limit]
+		}
+		rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+			Handler:  s.srv,
+			URL:      storeURL(path),
+			Username: testUsername,
+			Password: testPassword,
+		})
+		c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body))
+		var entries []audit.Entry
+		err = json.Unmarshal(rec.Body.Bytes(), &entries)
+		c.Assert(err, gc.Equals, nil)
+		for i := range entries {
+			c.Assert(entries[i].Time.IsZero(), gc.Equals, false)
+			entries[i].Time = time.Time{}
+		}
+		c.Assert(entries, jc.DeepEquals, expectEntries)
+	}
+
+	// The endpoint requires admin credentials.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.noMacaroonSrv,
+		URL:          storeURL("~charmers/precise/wordpress-23/meta/audit"),
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody: params.Error{
+			Code:    params.ErrUnauthorized,
+			Message: "authentication failed: missing HTTP auth header",
+		},
+	})
+}
+
 func (s *APISuite) TestMetaPermPutUnauthorized(c *gc.C) {
 	id := "precise/wordpress-23"
 	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("~charmers/"+id, 23))
@@ -1718,6 +2659,129 @@ func (s *APISuite) TestMetaTerms(c *gc.C) {
 	})
 }
 
+var metaCanDeployTests = []struct {
+	about        string
+	id           string
+	query        string
+	expectStatus int
+	expectBody   interface{}
+}{{
+	about: "matching base",
+	id:    "~charmers/multi-0",
+	query: "base=ubuntu@20.04&arch=arm64",
+	expectBody: v5.CanDeployResponse{
+		CanDeploy: true,
+	},
+}, {
+	about: "matching base with risk",
+	id:    "~charmers/multi-0",
+	query: "base=ubuntu@18.04/stable",
+	expectBody: v5.CanDeployResponse{
+		CanDeploy: true,
+	},
+}, {
+	about: "mismatched series",
+	id:    "~charmers/multi-0",
+	query: "base=ubuntu@16.04&arch=amd64",
+	expectBody: v5.CanDeployResponse{
+		Reason: `series "xenial" not supported (supported series: bionic, focal)`,
+	},
+}, {
+	about: "mismatched architecture",
+	id:    "~charmers/multi-0",
+	query: "base=ubuntu@20.04&arch=s390x",
+	expectBody: v5.CanDeployResponse{
+		Reason: `architecture "s390x" not supported (supported architectures: amd64, arm64)`,
+	},
+}, {
+	about: "revision-less id with matching base",
+	id:    "~charmers/multi",
+	query: "base=ubuntu@20.04&arch=arm64",
+	expectBody: v5.CanDeployResponse{
+		CanDeploy: true,
+	},
+}, {
+	about: "revision-less id with mismatched architecture",
+	id:    "~charmers/multi",
+	query: "base=ubuntu@20.04&arch=s390x",
+	expectBody: v5.CanDeployResponse{
+		Reason: `architecture "s390x" not supported (supported architectures: amd64, arm64)`,
+	},
+}, {
+	about: "revision-less id with mismatched series",
+	id:    "~charmers/multi",
+	query: "base=ubuntu@16.04&arch=amd64",
+	expectBody: v5.CanDeployResponse{
+		Reason: `series "xenial" not supported (supported series: bionic, focal)`,
+	},
+}, {
+	about: "single series charm without architectures",
+	id:    "~charmers/focal/single-0",
+	query: "base=ubuntu@20.04&arch=s390x",
+	expectBody: v5.CanDeployResponse{
+		CanDeploy: true,
+	},
+}, {
+	about: "unknown base",
+	id:    "~charmers/multi-0",
+	query: "base=ubuntu@99.04",
+	expectBody: v5.CanDeployResponse{
+		Reason: `unknown base "ubuntu@99.04"`,
+	},
+}, {
+	about:        "base not specified",
+	id:           "~charmers/multi-0",
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: "base not specified",
+	},
+}, {
+	about:        "invalid base",
+	id:           "~charmers/multi-0",
+	query:        "base=ubuntu",
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `invalid base "ubuntu"`,
+	},
+}}
+
+func (s *APISuite) TestMetaCanDeploy(c *gc.C) {
+	meta := storetesting.MetaWithSupportedSeries(nil, "bionic", "focal")
+	meta.Architectures = []charm.Architecture{"amd64", "arm64"}
+	s.addPublicCharm(c, storetesting.NewCharm(meta), newResolvedURL("~charmers/multi-0", -1))
+	s.addPublicCharm(c, storetesting.NewCharm(nil), newResolvedURL("~charmers/focal/single-0", -1))
+	for i, test := range metaCanDeployTests {
+		c.Logf("test %d: %s", i, test.about)
+		expectStatus := test.expectStatus
+		if expectStatus == 0 {
+			expectStatus = http.StatusOK
+		}
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:      s.srv,
+			URL:          storeURL(test.id + "/meta/can-deploy?" + test.query),
+			ExpectStatus: expectStatus,
+			ExpectBody:   test.expectBody,
+		})
+	}
+
+	// The arch parameter does not restrict resolution when
+	// can-deploy is requested through meta/any either.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		URL:     storeURL("~charmers/multi/meta/any?include=can-deploy&base=ubuntu@20.04&arch=s390x"),
+		ExpectBody: params.MetaAnyResponse{
+			Id: charm.MustParseURL("cs:~charmers/multi-0"),
+			Meta: map[string]interface{}{
+				"can-deploy": v5.CanDeployResponse{
+					Reason: `architecture "s390x" not supported (supported architectures: amd64, arm64)`,
+				},
+			},
+		},
+	})
+}
+
 func (s *APISuite) TestMetaTermsBundle(c *gc.C) {
 	id := newResolvedURL("~charmers/bundle/wordpress-simple-10", 10)
 	s.addPublicBundleFromRepo(c, "wordpress-simple", id, true)
@@ -1942,6 +3006,57 @@ func (s *APISuite) TestExtraInfoBadPutRequests(c *gc.C) {
 	}
 }
 
+func (s *APISuite) TestExtraInfoPutDedup(c *gc.C) {
+	config := s.srvParams
+	config.DedupExtraInfoWrites = true
+	srv, err := charmstore.NewServer(s.Session.DB("charmstore"), nil, config, map[string]charmstore.NewAPIHandlerFunc{"v5": v5.NewAPIHandler})
+	c.Assert(err, gc.Equals, nil)
+	defer srv.Close()
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("cs:~charmers/precise/wordpress-23", 23))
+
+	put := func(path string, val interface{}) {
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:  srv,
+			URL:      storeURL("precise/wordpress-23/meta/" + path),
+			Method:   "PUT",
+			Username: testUsername,
+			Password: testPassword,
+			Header: http.Header{
+				"Content-Type": {"application/json"},
+			},
+			Body: strings.NewReader(mustMarshalJSON(val)),
+		})
+	}
+	put("extra-info", map[string]interface{}{
+		"foo": "bar",
+		"baz": 1,
+	})
+	// Putting identical values succeeds.
+	put("extra-info", map[string]interface{}{
+		"foo": "bar",
+		"baz": 1,
+	})
+	put("extra-info/foo", "bar")
+	s.assertGet(c, "precise/wordpress-23/meta/extra-info", map[string]interface{}{
+		"foo": "bar",
+		"baz": 1,
+	})
+
+	// Putting a different value changes it.
+	put("extra-info/baz", 2)
+	s.assertGet(c, "precise/wordpress-23/meta/extra-info", map[string]interface{}{
+		"foo": "bar",
+		"baz": 2,
+	})
+
+	// Putting null removes the value, even if repeated.
+	put("extra-info/baz", nil)
+	put("extra-info/baz", nil)
+	s.assertGet(c, "precise/wordpress-23/meta/extra-info", map[string]interface{}{
+		"foo": "bar",
+	})
+}
+
 func (s *APISuite) TestExtraInfoPutUnauthorized(c *gc.C) {
 	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("cs:~charmers/precise/wordpress-23", 23))
 	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
@@ -2059,11 +3174,14 @@ func (s *APISuite) TestMetaEndpointsAny(c *gc.C) {
 			Meta: make(map[string]interface{}),
 		}
 		for _, ep := range metaEndpoints {
-			if ep.isExcluded(url) || ep.exclusive == promulgatedOnly {
+			if ep.isExcluded(url) || ep.exclusive == promulgatedOnly || ep.admin {
 				// endpoint not relevant.
 				continue
 			}
 			flags = append(flags, "include="+ep.name)
+			if ep.query != "" {
+				flags = append(flags, ep.query)
+			}
 			val, err := ep.get(s.store, url)
 			if err != nil && ep.isExcluded(url) {
 				// endpoint not relevant.
@@ -2078,6 +3196,202 @@ func (s *APISuite) TestMetaEndpointsAny(c *gc.C) {
 	}
 }
 
+var metaAnyHeadTests = []struct {
+	about        string
+	id           string
+	expectStatus int
+}{{
+	about:        "public entity",
+	id:           "precise/wordpress-23",
+	expectStatus: http.StatusOK,
+}, {
+	about:        "private entity",
+	id:           "~charmers/precise/mysql-5",
+	expectStatus: http.StatusNotFound,
+}, {
+	about:        "missing entity",
+	id:           "precise/wordpress-1",
+	expectStatus: http.StatusNotFound,
+}}
+
+func (s *APISuite) TestMetaAnyHead(c *gc.C) {
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("cs:~charmers/precise/wordpress-23", 23))
+	id, _ := s.addPublicCharmFromRepo(c, "mysql", newResolvedURL("cs:~charmers/precise/mysql-5", -1))
+	err := s.store.SetPerms(&id.URL, "stable.read", "charmers")
+	c.Assert(err, gc.Equals, nil)
+	s.idmServer.SetDefaultUser("bob")
+	for i, test := range metaAnyHeadTests {
+		c.Logf("test %d: %s", i, test.about)
+		rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+			Handler: s.srv,
+			Do:      bakeryDo(nil),
+			URL:     storeURL(test.id + "/meta/any"),
+			Method:  "HEAD",
+		})
+		c.Assert(rec.Code, gc.Equals, test.expectStatus)
+		c.Assert(rec.Body.Bytes(), gc.HasLen, 0)
+	}
+}
+
+func (s *APISuite) TestMetaCharmYAML(c *gc.C) {
+	_, ch := s.addPublicCharmFromRepo(c, "sample", newResolvedURL("cs:~charmers/precise/sample-10", 10))
+
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL("precise/sample-10/meta/charm-metadata"),
+		Header:  http.Header{"Accept": {"application/yaml"}},
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.Bytes()))
+	c.Assert(rec.Header().Get("Content-Type"), gc.Equals, "application/yaml")
+	meta, err := charm.ReadMeta(rec.Body)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(meta, jc.DeepEquals, ch.Meta())
+
+	rec = httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL("precise/sample-10/meta/charm-config?format=yaml"),
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.Bytes()))
+	c.Assert(rec.Header().Get("Content-Type"), gc.Equals, "application/yaml")
+	config, err := charm.ReadConfig(rec.Body)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(config, jc.DeepEquals, ch.Config())
+
+	rec = httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL("precise/sample-10/meta/charm-actions?format=yaml"),
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.Bytes()))
+	c.Assert(rec.Header().Get("Content-Type"), gc.Equals, "application/yaml")
+	c.Assert(rec.Body.String(), jc.YAMLEquals, ch.Actions())
+
+	// Other endpoints are still returned as JSON.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:    s.srv,
+		URL:        storeURL("precise/sample-10/meta/id-name?format=yaml"),
+		ExpectBody: params.IdNameResponse{Name: "sample"},
+	})
+}
+
+func (s *APISuite) TestMetaAnyGzip(c *gc.C) {
+	s.PatchValue(&v5.MetaGzipThreshold, 100)
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("cs:~charmers/precise/wordpress-23", 23))
+	url := storeURL("precise/wordpress-23/meta/any?include=charm-metadata&include=charm-config")
+
+	// Without Accept-Encoding the response is not compressed.
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     url,
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.Bytes()))
+	c.Assert(rec.Header().Get("Content-Encoding"), gc.Equals, "")
+	c.Assert(rec.Header().Get("Content-Length"), gc.Equals, fmt.Sprint(rec.Body.Len()))
+	plain := rec.Body.Bytes()
+	c.Assert(len(plain) > 100, gc.Equals, true)
+
+	rec = httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     url,
+		Header:  http.Header{"Accept-Encoding": {"gzip"}},
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.Bytes()))
+	c.Assert(rec.Header().Get("Content-Encoding"), gc.Equals, "gzip")
+	c.Assert(rec.Header().Get("Content-Type"), gc.Equals, "application/json")
+	c.Assert(rec.Header().Get("Content-Length"), gc.Equals, fmt.Sprint(rec.Body.Len()))
+	zr, err := gzip.NewReader(rec.Body)
+	c.Assert(err, gc.Equals, nil)
+	data, err := ioutil.ReadAll(zr)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(string(data), gc.Equals, string(plain))
+
+	// Small responses are never compressed.
+	rec = httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL("precise/wordpress-23/meta/id-name"),
+		Header:  http.Header{"Accept-Encoding": {"gzip"}},
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.Bytes()))
+	c.Assert(rec.Header().Get("Content-Encoding"), gc.Equals, "")
+	c.Assert(rec.Body.String(), gc.Equals, `{"Name":"wordpress"}`)
+}
+
+type metaLimitsSuite struct {
+	commonSuite
+}
+
+var _ = gc.Suite(&metaLimitsSuite{})
+
+func (s *metaLimitsSuite) SetUpSuite(c *gc.C) {
+	s.maxMetaResponseEntities = 2
+	s.maxMetaIncludes = 2
+	s.commonSuite.SetUpSuite(c)
+}
+
+var metaLimitsTests = []struct {
+	about        string
+	url          string
+	expectStatus int
+	expectBody   interface{}
+}{{
+	about:        "ids within limit",
+	url:          "meta/id-name?id=precise/wordpress-23&id=precise/mysql-5",
+	expectStatus: http.StatusOK,
+	expectBody: map[string]params.IdNameResponse{
+		"precise/wordpress-23": {Name: "wordpress"},
+		"precise/mysql-5":      {Name: "mysql"},
+	},
+}, {
+	about:        "too many ids",
+	url:          "meta/id-name?id=precise/wordpress-23&id=precise/mysql-5&id=precise/varnish-1",
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: "too many ids in meta request (3 > 2)",
+	},
+}, {
+	about:        "includes within limit",
+	url:          "precise/wordpress-23/meta/any?include=id-name&include=id-revision",
+	expectStatus: http.StatusOK,
+	expectBody: params.MetaAnyResponse{
+		Id: charm.MustParseURL("cs:precise/wordpress-23"),
+		Meta: map[string]interface{}{
+			"id-name":     params.IdNameResponse{Name: "wordpress"},
+			"id-revision": params.IdRevisionResponse{Revision: 23},
+		},
+	},
+}, {
+	about:        "too many includes",
+	url:          "precise/wordpress-23/meta/any?include=id-name&include=id-revision&include=id-series",
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: "too many includes in meta request (3 > 2)",
+	},
+}, {
+	about:        "too many includes in bulk request",
+	url:          "meta/any?id=precise/wordpress-23&include=id-name&include=id-revision&include=id-series",
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: "too many includes in meta request (3 > 2)",
+	},
+}}
+
+func (s *metaLimitsSuite) TestMetaLimits(c *gc.C) {
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("cs:~charmers/precise/wordpress-23", 23))
+	s.addPublicCharmFromRepo(c, "mysql", newResolvedURL("cs:~charmers/precise/mysql-5", 5))
+	s.addPublicCharmFromRepo(c, "varnish", newResolvedURL("cs:~charmers/precise/varnish-1", 1))
+	for i, test := range metaLimitsTests {
+		c.Logf("test %d: %s", i, test.about)
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:      s.srv,
+			URL:          storeURL(test.url),
+			ExpectStatus: test.expectStatus,
+			ExpectBody:   test.expectBody,
+		})
+	}
+}
+
 func (s *APISuite) TestMetaAnyWithNoIncludesAndNoEntity(c *gc.C) {
 	wordpressURL, _ := s.addPublicCharmFromRepo(
 		c,
@@ -2122,10 +3436,243 @@ func (s *APISuite) TestMetaCharmActions(c *gc.C) {
 		params.MetaAnyResponse{
 			Id: url.PreferredURL(),
 			Meta: map[string]interface{}{
-				"charm-actions": sample.Actions(),
+				"charm-actions": sample.Actions(),
+			},
+		},
+	)
+}
+
+func (s *APISuite) TestMetaArchiveTree(c *gc.C) {
+	s.addPublicCharmFromRepo(c, "all-hooks", newResolvedURL("cs:~charmers/precise/all-hooks-1", -1))
+	var tree v5.ArchiveTreeEntry
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		URL:     storeURL("~charmers/precise/all-hooks-1/meta/archive-tree"),
+		ExpectBody: httptesting.BodyAsserter(func(c *gc.C, body json.RawMessage) {
+			err := json.Unmarshal(body, &tree)
+			c.Assert(err, gc.Equals, nil)
+		}),
+	})
+	c.Assert(tree.Name, gc.Equals, "")
+	c.Assert(tree.Dir, gc.Equals, true)
+	var names []string
+	var size int64
+	for _, e := range tree.Children {
+		names = append(names, e.Name)
+		size += e.Size
+	}
+	c.Assert(names, jc.DeepEquals, []string{"hooks", "metadata.yaml", "revision"})
+	c.Assert(tree.Size, gc.Equals, size)
+	hooks := tree.Children[0]
+	c.Assert(hooks.Dir, gc.Equals, true)
+	c.Assert(hooks.Children, gc.Not(gc.HasLen), 0)
+
+	subdir := &v5.ArchiveTreeEntry{
+		Name: "subdir",
+		Dir:  true,
+		Size: 23,
+		Children: []*v5.ArchiveTreeEntry{{
+			Name: "stuff",
+			Size: 23,
+		}},
+	}
+	var found bool
+	for _, e := range hooks.Children {
+		if e.Name == "subdir" {
+			c.Assert(e, jc.DeepEquals, subdir)
+			found = true
+		}
+	}
+	c.Assert(found, gc.Equals, true)
+
+	// The path parameter selects a subdirectory or file.
+	s.assertGet(c, "~charmers/precise/all-hooks-1/meta/archive-tree?path=hooks/subdir", subdir)
+	s.assertGet(c, "~charmers/precise/all-hooks-1/meta/archive-tree?path=/hooks/subdir/", subdir)
+	s.assertGet(c, "~charmers/precise/all-hooks-1/meta/archive-tree?path=hooks/subdir/stuff", subdir.Children[0])
+	s.assertGet(c, "~charmers/precise/all-hooks-1/meta/any?include=archive-tree&path=hooks/subdir", params.MetaAnyResponse{
+		Id: charm.MustParseURL("cs:~charmers/precise/all-hooks-1"),
+		Meta: map[string]interface{}{
+			"archive-tree": subdir,
+		},
+	})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("~charmers/precise/all-hooks-1/meta/archive-tree?path=hooks/nothere"),
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody: params.Error{
+			Code:    params.ErrNotFound,
+			Message: `"hooks/nothere" not found in archive`,
+		},
+	})
+}
+
+func (s *APISuite) TestMetaCharmContainers(c *gc.C) {
+	meta, err := charm.ReadMeta(strings.NewReader(`
+name: sidecar
+summary: A sidecar charm
+description: A charm with a workload container.
+platforms: [kubernetes]
+architectures: [amd64]
+systems:
+- os: ubuntu
+  channel: "20.04/stable"
+resources:
+  app-image:
+    type: oci-image
+storage:
+  data:
+    type: filesystem
+containers:
+  app:
+    systems:
+    - resource: app-image
+    mounts:
+    - storage: data
+      location: /srv/data
+`))
+	c.Assert(err, gc.Equals, nil)
+	id := newResolvedURL("~charmers/kubernetes/sidecar-1", -1)
+	err = s.store.AddCharmWithArchive(id, storetesting.NewCharm(meta))
+	c.Assert(err, gc.Equals, nil)
+	s.addDockerResource(c, id, "app-image", "app-image content")
+	err = s.store.Publish(id, map[string]int{"app-image": 0}, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.SetPerms(&id.URL, "stable.read", params.Everyone)
+	c.Assert(err, gc.Equals, nil)
+
+	c.Assert(meta.Containers, gc.HasLen, 1)
+	s.assertGet(c, "~charmers/kubernetes/sidecar-1/meta/charm-containers", meta.Containers)
+	s.assertGet(c, "~charmers/kubernetes/sidecar-1/meta/any?include=charm-containers",
+		params.MetaAnyResponse{
+			Id: id.PreferredURL(),
+			Meta: map[string]interface{}{
+				"charm-containers": meta.Containers,
+			},
+		},
+	)
+
+	// A machine charm declares no containers.
+	url, _ := s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("cs:~charmers/precise/wordpress-23", 23))
+	s.assertGet(c, "precise/wordpress-23/meta/charm-containers", map[string]charm.Container{})
+	s.assertGet(c, "precise/wordpress-23/meta/any?include=charm-containers",
+		params.MetaAnyResponse{
+			Id: url.PreferredURL(),
+			Meta: map[string]interface{}{
+				"charm-containers": map[string]charm.Container{},
+			},
+		},
+	)
+}
+
+func (s *APISuite) TestMetaCharmStorageAndDevices(c *gc.C) {
+	storage := map[string]charm.Storage{
+		"data": {
+			Name:     "data",
+			Type:     "filesystem",
+			CountMin: 1,
+			CountMax: 1,
+			Location: "/srv/data",
+		},
+	}
+	devices := map[string]charm.Device{
+		"bitcoinminer": {
+			Name:        "bitcoinminer",
+			Description: "A GPU for mining",
+			Type:        "nvidia.com/gpu",
+			CountMin:    1,
+			CountMax:    2,
+		},
+	}
+	url, _ := s.addPublicCharm(c, storetesting.NewCharm(&charm.Meta{
+		Name:    "storage",
+		Summary: "A charm with storage",
+		Storage: storage,
+		Devices: devices,
+	}), newResolvedURL("cs:~charmers/xenial/storage-1", 1))
+	s.assertGet(c, "xenial/storage-1/meta/charm-storage", storage)
+	s.assertGet(c, "xenial/storage-1/meta/charm-devices", devices)
+	s.assertGet(c, "xenial/storage-1/meta/any?include=charm-storage&include=charm-devices",
+		params.MetaAnyResponse{
+			Id: url.PreferredURL(),
+			Meta: map[string]interface{}{
+				"charm-storage": storage,
+				"charm-devices": devices,
+			},
+		},
+	)
+
+	// A charm that declares no storage or devices
+	// returns empty results.
+	url, _ = s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("cs:~charmers/precise/wordpress-23", 23))
+	s.assertGet(c, "precise/wordpress-23/meta/charm-storage", map[string]charm.Storage{})
+	s.assertGet(c, "precise/wordpress-23/meta/charm-devices", map[string]charm.Device{})
+	s.assertGet(c, "precise/wordpress-23/meta/any?include=charm-storage&include=charm-devices",
+		params.MetaAnyResponse{
+			Id: url.PreferredURL(),
+			Meta: map[string]interface{}{
+				"charm-storage": map[string]charm.Storage{},
+				"charm-devices": map[string]charm.Device{},
+			},
+		},
+	)
+
+	// Bundles have no charm storage or devices.
+	s.addPublicBundleFromRepo(c, "wordpress-simple", newResolvedURL("cs:~charmers/bundle/wordpress-simple-42", 42), true)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("bundle/wordpress-simple-42/meta/charm-storage"),
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody: params.Error{
+			Code:    params.ErrMetadataNotFound,
+			Message: "metadata not found",
+		},
+	})
+}
+
+func (s *APISuite) TestMetaExtraBindings(c *gc.C) {
+	bindings := map[string]charm.ExtraBinding{
+		"cluster": {Name: "cluster"},
+		"public":  {Name: "public"},
+	}
+	url, _ := s.addPublicCharm(c, storetesting.NewCharm(&charm.Meta{
+		Name:          "bindings",
+		Summary:       "A charm with extra bindings",
+		ExtraBindings: bindings,
+	}), newResolvedURL("cs:~charmers/xenial/bindings-1", 1))
+	s.assertGet(c, "xenial/bindings-1/meta/extra-bindings", bindings)
+	s.assertGet(c, "xenial/bindings-1/meta/any?include=extra-bindings",
+		params.MetaAnyResponse{
+			Id: url.PreferredURL(),
+			Meta: map[string]interface{}{
+				"extra-bindings": bindings,
+			},
+		},
+	)
+
+	// A charm that declares no extra bindings returns
+	// an empty result.
+	url, _ = s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("cs:~charmers/precise/wordpress-23", 23))
+	s.assertGet(c, "precise/wordpress-23/meta/extra-bindings", map[string]charm.ExtraBinding{})
+	s.assertGet(c, "precise/wordpress-23/meta/any?include=extra-bindings",
+		params.MetaAnyResponse{
+			Id: url.PreferredURL(),
+			Meta: map[string]interface{}{
+				"extra-bindings": map[string]charm.ExtraBinding{},
 			},
 		},
 	)
+
+	// Bundles have no extra bindings.
+	s.addPublicBundleFromRepo(c, "wordpress-simple", newResolvedURL("cs:~charmers/bundle/wordpress-simple-42", 42), true)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("bundle/wordpress-simple-42/meta/extra-bindings"),
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody: params.Error{
+			Code:    params.ErrMetadataNotFound,
+			Message: "metadata not found",
+		},
+	})
 }
 
 func (s *APISuite) TestBulkMeta(c *gc.C) {
@@ -2968,6 +4515,75 @@ func (s *APISuite) TestMetaStats(c *gc.C) {
 	}
 }
 
+func (s *APISuite) TestMetaStatsInRange(c *gc.C) {
+	id := newResolvedURL("cs:~charmers/trusty/wordpress-0", 0)
+	s.addPublicCharmFromRepo(c, "wordpress", id)
+	for _, t := range []time.Time{
+		time.Date(2016, 1, 1, 10, 0, 0, 0, time.UTC),
+		time.Date(2016, 1, 2, 10, 0, 0, 0, time.UTC),
+		time.Date(2016, 1, 2, 23, 0, 0, 0, time.UTC),
+		time.Date(2016, 1, 3, 10, 0, 0, 0, time.UTC),
+	} {
+		err := s.store.IncrementDownloadCountsAtTime(id, t)
+		c.Assert(err, gc.Equals, nil)
+	}
+	s.assertGet(c, "wordpress/meta/stats?start=2016-01-02&end=2016-01-02", &v5.StatsRangeResponse{
+		StatsResponse: v5.StatsResponse{
+			StatsResponse: params.StatsResponse{
+				ArchiveDownloadCount: 4,
+				ArchiveDownload: params.StatsCount{
+					Total: 4,
+				},
+				ArchiveDownloadAllRevisions: params.StatsCount{
+					Total: 4,
+				},
+			},
+		},
+		ArchiveDownloadInRange: 2,
+	})
+	s.assertGet(c, "wordpress/meta/any?include=stats&start=2016-01-02", params.MetaAnyResponse{
+		Id: id.PreferredURL(),
+		Meta: map[string]interface{}{
+			"stats": &v5.StatsRangeResponse{
+				StatsResponse: v5.StatsResponse{
+					StatsResponse: params.StatsResponse{
+						ArchiveDownloadCount: 4,
+						ArchiveDownload: params.StatsCount{
+							Total: 4,
+						},
+						ArchiveDownloadAllRevisions: params.StatsCount{
+							Total: 4,
+						},
+					},
+				},
+				ArchiveDownloadInRange: 3,
+			},
+		},
+	})
+}
+
+func (s *APISuite) TestMetaStatsInvalidRange(c *gc.C) {
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("cs:~charmers/trusty/wordpress-0", 0))
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("wordpress/meta/stats?start=yesterday"),
+		ExpectStatus: http.StatusBadRequest,
+		ExpectBody: params.Error{
+			Message: `invalid 'start' value "yesterday": parsing time "yesterday" as "2006-01-02": cannot parse "yesterday" as "2006"`,
+			Code:    params.ErrBadRequest,
+		},
+	})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("wordpress/meta/stats?start=2016-01-02&end=2016-01-01"),
+		ExpectStatus: http.StatusBadRequest,
+		ExpectBody: params.Error{
+			Message: `'end' value "2016-01-01" is before 'start' value "2016-01-02"`,
+			Code:    params.ErrBadRequest,
+		},
+	})
+}
+
 type publishSpec struct {
 	id   *router.ResolvedURL
 	time string
@@ -3586,6 +5202,105 @@ func (s *APISuite) TestPublishSuccess(c *gc.C) {
 	})
 }
 
+func (s *APISuite) TestPublishRequireResources(c *gc.C) {
+	s.idmServer.SetDefaultUser("bob")
+
+	id0 := newResolvedURL("cs:~bob/precise/wordpress-0", -1)
+	meta := storetesting.MetaWithResources(nil, "someResource", "otherResource")
+	err := s.store.AddCharmWithArchive(id0, storetesting.NewCharm(meta))
+	c.Assert(err, gc.Equals, nil)
+	s.uploadResource(c, id0, "someResource", "stuff 0")
+	s.uploadResource(c, id0, "otherResource", "other 0")
+	err = s.store.Publish(id0, map[string]int{"someResource": 0, "otherResource": 0}, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+
+	err = s.store.AddCharmWithArchive(newResolvedURL("cs:~bob/precise/wordpress-1", -1), storetesting.NewCharm(meta))
+	c.Assert(err, gc.Equals, nil)
+
+	// With require-resources, otherResource must be pinned.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		Method:  "PUT",
+		URL:     storeURL("~bob/precise/wordpress-1/publish?require-resources=true"),
+		Do:      bakeryDo(nil),
+		JSONBody: params.PublishRequest{
+			Resources: map[string]int{
+				"someResource": 0,
+			},
+			Channels: []params.Channel{params.StableChannel},
+		},
+		ExpectStatus: http.StatusBadRequest,
+		ExpectBody: params.Error{
+			Message: `resources are missing from publish request: otherResource`,
+			Code:    params.ErrBadRequest,
+		},
+	})
+
+	// Without it, otherResource keeps its stable revision.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		Method:  "PUT",
+		URL:     storeURL("~bob/precise/wordpress-1/publish"),
+		Do:      bakeryDo(nil),
+		JSONBody: params.PublishRequest{
+			Resources: map[string]int{
+				"someResource": 0,
+			},
+			Channels: []params.Channel{params.StableChannel},
+		},
+	})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		URL:     storeURL("~bob/precise/wordpress/meta/id-revision"),
+		Do:      bakeryDo(nil),
+		ExpectBody: params.IdRevisionResponse{
+			Revision: 1,
+		},
+	})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		URL:     storeURL("~bob/precise/wordpress/meta/resources"),
+		Do:      bakeryDo(nil),
+		ExpectBody: []params.Resource{{
+			Name:        "otherResource",
+			Type:        "file",
+			Path:        "otherResource-file",
+			Description: "otherResource description",
+			Revision:    0,
+			Fingerprint: rawHash(hashOfString("other 0")),
+			Size:        int64(len("other 0")),
+		}, {
+			Name:        "someResource",
+			Type:        "file",
+			Path:        "someResource-file",
+			Description: "someResource description",
+			Revision:    0,
+			Fingerprint: rawHash(hashOfString("stuff 0")),
+			Size:        int64(len("stuff 0")),
+		}},
+	})
+
+	// Nothing is carried over to a channel that has no revision of
+	// otherResource, so it must still be given explicitly.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		Method:  "PUT",
+		URL:     storeURL("~bob/precise/wordpress-1/publish"),
+		Do:      bakeryDo(nil),
+		JSONBody: params.PublishRequest{
+			Resources: map[string]int{
+				"someResource": 0,
+			},
+			Channels: []params.Channel{params.EdgeChannel},
+		},
+		ExpectStatus: http.StatusBadRequest,
+		ExpectBody: params.Error{
+			Message: `resources are missing from publish request: otherResource`,
+			Code:    params.ErrBadRequest,
+		},
+	})
+}
+
 // publishCharmsAtKnownTimes populates the store with
 // a range of charms with known time stamps.
 func (s *APISuite) publishCharmsAtKnownTimes(c *gc.C, charms []publishSpec) {
@@ -4423,3 +6138,360 @@ func entityACLs(store *charmstore.Store, url *router.ResolvedURL) (mongodoc.ACL,
 	}
 	return be.ChannelACLs[ch], nil
 }
+
+func (s *APISuite) TestResolveAt(c *gc.C) {
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 2; i++ {
+		s.addPublicCharm(c, storetesting.NewCharm(nil), newResolvedURL(fmt.Sprintf("cs:~charmers/trusty/wordpress-%d", i), i))
+	}
+	// Rewrite the publish times so that the test is deterministic.
+	err := s.store.DB.BaseEntities().UpdateId(charm.MustParseURL("cs:~charmers/wordpress"), bson.D{{
+		"$set", bson.D{
+			{"publishhistory.0.time", t0.Add(time.Hour)},
+			{"publishhistory.1.time", t0.Add(2 * time.Hour)},
+		},
+	}})
+	c.Assert(err, gc.Equals, nil)
+
+	tests := []struct {
+		about        string
+		at           time.Time
+		expectStatus int
+		expectBody   interface{}
+	}{{
+		about:        "before first publish",
+		at:           t0,
+		expectStatus: http.StatusNotFound,
+		expectBody: params.Error{
+			Code:    params.ErrNotFound,
+			Message: `no matching charm or bundle for cs:wordpress in stable channel at 2020-01-01T00:00:00Z`,
+		},
+	}, {
+		about:      "after first publish",
+		at:         t0.Add(90 * time.Minute),
+		expectBody: params.IdRevisionResponse{Revision: 0},
+	}, {
+		about:      "after second publish",
+		at:         t0.Add(3 * time.Hour),
+		expectBody: params.IdRevisionResponse{Revision: 1},
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: %s", i, test.about)
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:      s.srv,
+			URL:          storeURL("wordpress/meta/id-revision?at=" + test.at.Format(time.RFC3339)),
+			ExpectStatus: test.expectStatus,
+			ExpectBody:   test.expectBody,
+		})
+	}
+}
+
+func (s *APISuite) TestResolveAtInvalid(c *gc.C) {
+	s.addPublicCharm(c, storetesting.NewCharm(nil), newResolvedURL("cs:~charmers/trusty/wordpress-0", 0))
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("wordpress/meta/id-revision?at=yesterday"),
+		ExpectStatus: http.StatusBadRequest,
+		ExpectBody: params.Error{
+			Code:    params.ErrBadRequest,
+			Message: `invalid at value "yesterday" specified in request: parsing time "yesterday" as "2006-01-02T15:04:05Z07:00": cannot parse "yesterday" as "2006"`,
+		},
+	})
+}
+
+func (s *APISuite) TestResolveArch(c *gc.C) {
+	s.addPublicCharm(c, storetesting.NewCharm(&charm.Meta{
+		Architectures: []charm.Architecture{"amd64"},
+	}), newResolvedURL("cs:~charmers/focal/wordpress-4", 4))
+	s.addPublicCharm(c, storetesting.NewCharm(nil), newResolvedURL("cs:~charmers/bionic/wordpress-3", 3))
+	s.addPublicCharm(c, storetesting.NewCharm(&charm.Meta{
+		Architectures: []charm.Architecture{"amd64"},
+	}), newResolvedURL("cs:~charmers/focal/mysql-0", 0))
+
+	tests := []struct {
+		about        string
+		id           string
+		arch         string
+		expectStatus int
+		expectBody   interface{}
+	}{{
+		about:      "no arch",
+		id:         "wordpress",
+		expectBody: params.IdRevisionResponse{Revision: 4},
+	}, {
+		about:      "supported arch",
+		id:         "wordpress",
+		arch:       "amd64",
+		expectBody: params.IdRevisionResponse{Revision: 4},
+	}, {
+		about:      "arch supported by charm without architectures",
+		id:         "wordpress",
+		arch:       "arm64",
+		expectBody: params.IdRevisionResponse{Revision: 3},
+	}, {
+		about:        "unsupported arch",
+		id:           "mysql",
+		arch:         "arm64",
+		expectStatus: http.StatusNotFound,
+		expectBody: params.Error{
+			Code:    params.ErrNotFound,
+			Message: `no matching charm or bundle for cs:mysql with architecture "arm64"`,
+		},
+	}, {
+		about:      "id with revision",
+		id:         "focal/mysql-0",
+		arch:       "arm64",
+		expectBody: params.IdRevisionResponse{Revision: 0},
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: %s", i, test.about)
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:      s.srv,
+			URL:          storeURL(test.id + "/meta/id-revision?arch=" + test.arch),
+			ExpectStatus: test.expectStatus,
+			ExpectBody:   test.expectBody,
+		})
+	}
+}
+
+func (s *APISuite) TestAdminSearchDump(c *gc.C) {
+	s.addPublicCharm(c, storetesting.NewCharm(nil), newResolvedURL("cs:~charmers/trusty/wordpress-0", -1))
+	id := newResolvedURL("cs:~charmers/xenial/mysql-0", -1)
+	err := s.store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.SetPerms(&id.URL, "edge.read", params.Everyone, "bob")
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.Publish(id, nil, params.EdgeChannel)
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.AddCharmWithArchive(newResolvedURL("cs:~charmers/trusty/unpublished-0", -1), storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+
+	type dumpDoc struct {
+		URL      *charm.URL
+		ReadACLs []string
+		Series   []string
+	}
+	tests := []struct {
+		about      string
+		query      string
+		expectDocs []dumpDoc
+	}{{
+		about: "default channel",
+		expectDocs: []dumpDoc{{
+			URL:      charm.MustParseURL("cs:~charmers/trusty/wordpress-0"),
+			ReadACLs: []string{params.Everyone},
+			Series:   []string{"trusty"},
+		}},
+	}, {
+		about: "stable channel",
+		query: "?channel=stable",
+		expectDocs: []dumpDoc{{
+			URL:      charm.MustParseURL("cs:~charmers/trusty/wordpress-0"),
+			ReadACLs: []string{params.Everyone},
+			Series:   []string{"trusty"},
+		}},
+	}, {
+		about: "edge channel",
+		query: "?channel=edge",
+		expectDocs: []dumpDoc{{
+			URL:      charm.MustParseURL("cs:~charmers/xenial/mysql-0"),
+			ReadACLs: []string{params.Everyone, "bob"},
+			Series:   []string{"xenial"},
+		}},
+	}, {
+		about: "channel with nothing published",
+		query: "?channel=candidate",
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: %s", i, test.about)
+		rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+			Handler:  s.srv,
+			URL:      storeURL("admin/search-dump" + test.query),
+			Username: testUsername,
+			Password: testPassword,
+		})
+		c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.Bytes()))
+		c.Assert(rec.Header().Get("Content-Type"), gc.Equals, "application/x-ndjson")
+		var docs []dumpDoc
+		for _, line := range strings.SplitAfter(rec.Body.String(), "\n") {
+			if line == "" {
+				continue
+			}
+			c.Assert(strings.HasSuffix(line, "\n"), gc.Equals, true)
+			var doc dumpDoc
+			err := json.Unmarshal([]byte(line), &doc)
+			c.Assert(err, gc.Equals, nil, gc.Commentf("line %q", line))
+			docs = append(docs, doc)
+		}
+		c.Assert(docs, jc.DeepEquals, test.expectDocs)
+	}
+}
+
+func (s *APISuite) TestAdminSearchDumpUnpublishedChannel(c *gc.C) {
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("admin/search-dump?channel=unpublished"),
+		Username:     testUsername,
+		Password:     testPassword,
+		ExpectStatus: http.StatusBadRequest,
+		ExpectBody: params.Error{
+			Code:    params.ErrBadRequest,
+			Message: `cannot dump search documents for the unpublished channel`,
+		},
+	})
+}
+
+func (s *APISuite) TestAdminSearchDumpUnauthorized(c *gc.C) {
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.noMacaroonSrv,
+		URL:          storeURL("admin/search-dump"),
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody: params.Error{
+			Code:    params.ErrUnauthorized,
+			Message: "authentication failed: missing HTTP auth header",
+		},
+	})
+}
+
+func (s *APISuite) TestAdminSummary(c *gc.C) {
+	s.addPublicBundleFromRepo(c, "wordpress-simple", newResolvedURL("cs:~charmers/bundle/wordpress-simple-0", -1), true)
+	summary, err := s.store.StoreSummary()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(summary.Charms, gc.Equals, int64(2))
+	c.Assert(summary.Bundles, gc.Equals, int64(1))
+	c.Assert(summary.BlobBytes, gc.Not(gc.Equals), int64(0))
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:    s.srv,
+		URL:        storeURL("admin/summary"),
+		Username:   testUsername,
+		Password:   testPassword,
+		ExpectBody: summary,
+	})
+}
+
+func (s *APISuite) TestAdminSummaryUnauthorized(c *gc.C) {
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.noMacaroonSrv,
+		URL:          storeURL("admin/summary"),
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody: params.Error{
+			Code:    params.ErrUnauthorized,
+			Message: "authentication failed: missing HTTP auth header",
+		},
+	})
+}
+
+func (s *APISuite) TestAdminDuplicateBlobs(c *gc.C) {
+	// Two charms uploaded from the same charm directory share a
+	// blob hash.
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("cs:~charmers/precise/wordpress-0", -1))
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("cs:~bob/precise/wordpress-0", -1))
+	s.addPublicCharmFromRepo(c, "mysql", newResolvedURL("cs:~charmers/precise/mysql-0", -1))
+	entity, err := s.store.FindEntity(newResolvedURL("cs:~charmers/precise/wordpress-0", -1), nil)
+	c.Assert(err, gc.Equals, nil)
+	entity1, err := s.store.FindEntity(newResolvedURL("cs:~bob/precise/wordpress-0", -1), nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entity1.BlobHash, gc.Equals, entity.BlobHash)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		URL:      storeURL("admin/duplicate-blobs"),
+		Username: testUsername,
+		Password: testPassword,
+		ExpectBody: []charmstore.DuplicateBlobGroup{{
+			BlobHash: entity.BlobHash,
+			Size:     entity.Size,
+			Entities: []*charm.URL{
+				charm.MustParseURL("cs:~bob/precise/wordpress-0"),
+				charm.MustParseURL("cs:~charmers/precise/wordpress-0"),
+			},
+		}},
+	})
+}
+
+func (s *APISuite) TestAdminDuplicateBlobsUnauthorized(c *gc.C) {
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.noMacaroonSrv,
+		URL:          storeURL("admin/duplicate-blobs"),
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody: params.Error{
+			Code:    params.ErrUnauthorized,
+			Message: "authentication failed: missing HTTP auth header",
+		},
+	})
+}
+
+func (s *APISuite) TestCandidates(c *gc.C) {
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("cs:~bob/trusty/wordpress-0", -1))
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("cs:~alice/trusty/wordpress-0", -1))
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("cs:~charmers/trusty/wordpress-0", 0))
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("cs:~dave/trusty/wordpress-0", -1))
+	s.addPublicCharmFromRepo(c, "mysql", newResolvedURL("cs:~bob/trusty/mysql-0", -1))
+	s.setPerms(c, map[string][]string{
+		"~dave/wordpress": {"dave"},
+	})
+
+	// Anonymous users see only the public entities.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		URL:     storeURL("meta/candidates?name=wordpress"),
+		Do:      bakeryDo(nil),
+		ExpectBody: v5.CandidatesResponse{
+			Candidates: []v5.Candidate{{
+				Id:   charm.MustParseURL("cs:~alice/wordpress"),
+				User: "alice",
+			}, {
+				Id:   charm.MustParseURL("cs:~bob/wordpress"),
+				User: "bob",
+			}, {
+				Id:          charm.MustParseURL("cs:~charmers/wordpress"),
+				User:        "charmers",
+				Promulgated: true,
+			}},
+		},
+	})
+
+	// The owner can see their private entity too.
+	s.idmServer.SetDefaultUser("dave")
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		URL:     storeURL("meta/candidates?name=wordpress"),
+		Do:      bakeryDo(nil),
+		ExpectBody: v5.CandidatesResponse{
+			Candidates: []v5.Candidate{{
+				Id:   charm.MustParseURL("cs:~alice/wordpress"),
+				User: "alice",
+			}, {
+				Id:   charm.MustParseURL("cs:~bob/wordpress"),
+				User: "bob",
+			}, {
+				Id:          charm.MustParseURL("cs:~charmers/wordpress"),
+				User:        "charmers",
+				Promulgated: true,
+			}, {
+				Id:   charm.MustParseURL("cs:~dave/wordpress"),
+				User: "dave",
+			}},
+		},
+	})
+
+	// A name with no entities has no candidates.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		URL:     storeURL("meta/candidates?name=nothing"),
+		ExpectBody: v5.CandidatesResponse{
+			Candidates: []v5.Candidate{},
+		},
+	})
+}
+
+func (s *APISuite) TestCandidatesNoName(c *gc.C) {
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("meta/candidates"),
+		ExpectStatus: http.StatusBadRequest,
+		ExpectBody: params.Error{
+			Code:    params.ErrBadRequest,
+			Message: "name parameter not specified",
+		},
+	})
+}
@@ -0,0 +1,99 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5 // import "gopkg.in/juju/charmstore.v5/internal/v5"
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+)
+
+// CreateAPITokenRequest holds the body of a POST admin/api-tokens
+// request.
+type CreateAPITokenRequest struct {
+	// User holds the name of the user that the token
+	// authenticates as.
+	User string
+
+	// Expires holds the time at which the token expires.
+	Expires time.Time
+}
+
+// CreateAPITokenResponse holds the response to a POST
+// admin/api-tokens request.
+type CreateAPITokenResponse struct {
+	// Token holds the new API token. It cannot be retrieved
+	// again later.
+	Token string
+}
+
+// RevokeAPITokensRequest holds the body of a DELETE admin/api-tokens
+// request. Exactly one of its fields must be set.
+type RevokeAPITokensRequest struct {
+	// Token holds a single API token to revoke.
+	Token string `json:",omitempty"`
+
+	// User holds the name of a user whose API tokens
+	// are all revoked.
+	User string `json:",omitempty"`
+}
+
+// POST admin/api-tokens
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#post-adminapi-tokens
+//
+// DELETE admin/api-tokens
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#delete-adminapi-tokens
+func (h *ReqHandler) serveAdminAPITokens(w http.ResponseWriter, req *http.Request) error {
+	if err := h.authenticateAdmin(req); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	switch req.Method {
+	case "POST":
+		var body CreateAPITokenRequest
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			return badRequestf(err, "cannot unmarshal body")
+		}
+		if body.User == "" {
+			return badRequestf(nil, "user not specified")
+		}
+		if !body.Expires.After(time.Now()) {
+			return badRequestf(nil, "expiry time must be in the future")
+		}
+		token, err := h.Store.CreateAPIToken(body.User, body.Expires)
+		if err != nil {
+			return errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+		}
+		logger.Infof("created API token for %q expiring at %v", body.User, body.Expires)
+		return httprequest.WriteJSON(w, http.StatusOK, CreateAPITokenResponse{
+			Token: token,
+		})
+	case "DELETE":
+		var body RevokeAPITokensRequest
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			return badRequestf(err, "cannot unmarshal body")
+		}
+		switch {
+		case body.Token != "" && body.User != "":
+			return badRequestf(nil, "cannot specify both token and user")
+		case body.Token != "":
+			if err := h.Store.RevokeAPIToken(body.Token); err != nil {
+				return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+			}
+			logger.Infof("revoked API token")
+		case body.User != "":
+			if err := h.Store.RevokeAPITokens(body.User); err != nil {
+				return errgo.Mask(err)
+			}
+			logger.Infof("revoked all API tokens for %q", body.User)
+		default:
+			return badRequestf(nil, "token or user not specified")
+		}
+		return nil
+	}
+	return errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s method not allowed", req.Method)
+}
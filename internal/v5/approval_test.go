@@ -0,0 +1,205 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	jc "github.com/juju/testing/checkers"
+	"github.com/juju/testing/httptesting"
+	gc "gopkg.in/check.v1"
+
+	"gopkg.in/juju/charmstore.v5/internal/charm"
+	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5/internal/storetesting"
+	v5 "gopkg.in/juju/charmstore.v5/internal/v5"
+)
+
+type approvalSuite struct {
+	commonSuite
+}
+
+var _ = gc.Suite(&approvalSuite{})
+
+func (s *approvalSuite) SetUpSuite(c *gc.C) {
+	s.enableIdentity = true
+	s.approvalRequiredChannels = []params.Channel{params.StableChannel}
+	s.commonSuite.SetUpSuite(c)
+}
+
+func (s *approvalSuite) addCharm(c *gc.C) *charm.URL {
+	s.idmServer.AddUser("bob", "charmers")
+	s.idmServer.AddUser("alice", "charmers")
+	id := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	err := s.store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	for _, ch := range []params.Channel{params.EdgeChannel, params.StableChannel} {
+		err := s.store.SetPerms(&id.URL, string(ch)+".read", "charmers")
+		c.Assert(err, gc.Equals, nil)
+		err = s.store.SetPerms(&id.URL, string(ch)+".write", "charmers")
+		c.Assert(err, gc.Equals, nil)
+	}
+	return &id.URL
+}
+
+func (s *approvalSuite) assertPublished(c *gc.C, url *charm.URL, channel params.Channel, published bool) {
+	entity, err := s.store.FindEntity(newResolvedURL(url.String(), -1), nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entity.Published[channel], gc.Equals, published)
+}
+
+func (s *approvalSuite) pendingPublishes(c *gc.C, user string) []mongodoc.PendingPublish {
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL("pending-publishes"),
+		Do:      s.bakeryDoAsUser(user),
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.Bytes()))
+	var docs []mongodoc.PendingPublish
+	err := json.Unmarshal(rec.Body.Bytes(), &docs)
+	c.Assert(err, gc.Equals, nil)
+	for i := range docs {
+		c.Assert(docs[i].Time.IsZero(), gc.Equals, false)
+		docs[i].Time = time.Time{}
+	}
+	return docs
+}
+
+func (s *approvalSuite) TestPublishRequiresApproval(c *gc.C) {
+	url := s.addCharm(c)
+
+	// Publishing to a channel that does not require approval
+	// happens immediately.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		Method:  "PUT",
+		URL:     storeURL(url.Path() + "/publish"),
+		Do:      s.bakeryDoAsUser("bob"),
+		JSONBody: params.PublishRequest{
+			Channels: []params.Channel{params.EdgeChannel},
+		},
+	})
+	s.assertPublished(c, url, params.EdgeChannel, true)
+
+	// Publishing to the stable channel only records a request.
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		Method:  "PUT",
+		URL:     storeURL(url.Path() + "/publish"),
+		Do:      s.bakeryDoAsUser("bob"),
+		JSONBody: params.PublishRequest{
+			Channels: []params.Channel{params.StableChannel},
+		},
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusAccepted, gc.Commentf("body: %s", rec.Body.Bytes()))
+	s.assertPublished(c, url, params.StableChannel, false)
+
+	c.Assert(s.pendingPublishes(c, "alice"), jc.DeepEquals, []mongodoc.PendingPublish{{
+		Id:      "stable cs:~charmers/precise/wordpress-0",
+		URL:     url,
+		Channel: params.StableChannel,
+		User:    "bob",
+	}})
+	// Users that cannot approve the request do not see it.
+	c.Assert(s.pendingPublishes(c, "eve"), gc.HasLen, 0)
+
+	// Bob cannot approve their own request.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		Method:  "PUT",
+		URL:     storeURL(url.Path() + "/approve-publish"),
+		Do:      s.bakeryDoAsUser("bob"),
+		JSONBody: v5.ApprovePublishRequest{
+			Channel: params.StableChannel,
+		},
+		ExpectStatus: http.StatusForbidden,
+		ExpectBody: params.Error{
+			Code:    params.ErrForbidden,
+			Message: "cannot approve publish: cannot approve own publish request",
+		},
+	})
+	s.assertPublished(c, url, params.StableChannel, false)
+
+	// Alice can approve it.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		Method:  "PUT",
+		URL:     storeURL(url.Path() + "/approve-publish"),
+		Do:      s.bakeryDoAsUser("alice"),
+		JSONBody: v5.ApprovePublishRequest{
+			Channel: params.StableChannel,
+		},
+	})
+	s.assertPublished(c, url, params.StableChannel, true)
+	c.Assert(s.pendingPublishes(c, "alice"), gc.HasLen, 0)
+}
+
+func (s *approvalSuite) TestAdminPublishDoesNotRequireApproval(c *gc.C) {
+	url := s.addCharm(c)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		Method:   "PUT",
+		URL:      storeURL(url.Path() + "/publish"),
+		Username: testUsername,
+		Password: testPassword,
+		JSONBody: params.PublishRequest{
+			Channels: []params.Channel{params.StableChannel},
+		},
+	})
+	s.assertPublished(c, url, params.StableChannel, true)
+}
+
+var approvePublishErrorTests = []struct {
+	about        string
+	method       string
+	body         v5.ApprovePublishRequest
+	expectStatus int
+	expectBody   params.Error
+}{{
+	about:        "bad method",
+	method:       "POST",
+	body:         v5.ApprovePublishRequest{Channel: params.StableChannel},
+	expectStatus: http.StatusMethodNotAllowed,
+	expectBody: params.Error{
+		Code:    params.ErrMethodNotAllowed,
+		Message: "POST not allowed",
+	},
+}, {
+	about:        "channel without approval",
+	method:       "PUT",
+	body:         v5.ApprovePublishRequest{Channel: params.EdgeChannel},
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `publishing to the "edge" channel does not require approval`,
+	},
+}, {
+	about:        "no pending request",
+	method:       "PUT",
+	body:         v5.ApprovePublishRequest{Channel: params.StableChannel},
+	expectStatus: http.StatusNotFound,
+	expectBody: params.Error{
+		Code:    params.ErrNotFound,
+		Message: "cannot approve publish: no pending publish of cs:~charmers/precise/wordpress-0 to the stable channel",
+	},
+}}
+
+func (s *approvalSuite) TestApprovePublishErrors(c *gc.C) {
+	url := s.addCharm(c)
+	for i, test := range approvePublishErrorTests {
+		c.Logf("test %d: %s", i, test.about)
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:      s.srv,
+			Method:       test.method,
+			URL:          storeURL(url.Path() + "/approve-publish"),
+			Do:           s.bakeryDoAsUser("alice"),
+			JSONBody:     test.body,
+			ExpectStatus: test.expectStatus,
+			ExpectBody:   test.expectBody,
+		})
+	}
+}
@@ -5,11 +5,14 @@ package v5 // import "gopkg.in/juju/charmstore.v5/internal/v5"
 
 import (
 	stdzip "archive/zip"
+	"bufio"
+	"bytes"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"mime"
 	"net/http"
+	"os"
 	"path/filepath"
 	"strconv"
 	"time"
@@ -19,6 +22,7 @@ import (
 	"gopkg.in/httprequest.v1"
 	"gopkg.in/mgo.v2/bson"
 
+	"gopkg.in/juju/charmstore.v5/internal/blobstore"
 	"gopkg.in/juju/charmstore.v5/internal/charm"
 	"gopkg.in/juju/charmstore.v5/internal/charmstore"
 	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
@@ -102,11 +106,19 @@ func (h *ReqHandler) authorizeUpload(id *charm.URL, req *http.Request) error {
 	}); err != nil {
 		return errgo.Mask(err, errgo.Any)
 	}
+	// The source of an entity records where it was ingested from,
+	// so only admin (ingestion) credentials may set it.
+	if !h.auth.Admin && (req.Form.Get("source") != "" || req.Form.Get("source-url") != "") {
+		return errgo.WithCausef(nil, params.ErrUnauthorized, "source and source-url may only be specified with admin credentials")
+	}
+	if err := h.Store.CheckUploadAllowed(id); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrForbidden))
+	}
 	return nil
 }
 
 func (h *ReqHandler) serveGetArchive(id *router.ResolvedURL, w http.ResponseWriter, req *http.Request) error {
-	if err := h.AuthorizeEntityForOp(id, req, OpReadWithTerms); err != nil {
+	if err := h.AuthorizeArchiveDownload(id, req); err != nil {
 		return errgo.Mask(err, errgo.Any)
 	}
 	blob, err := h.Store.OpenBlob(id)
@@ -118,28 +130,92 @@ func (h *ReqHandler) serveGetArchive(id *router.ResolvedURL, w http.ResponseWrit
 	return nil
 }
 
+// AuthorizeArchiveDownload checks that the given request is authorized
+// to download the archive of the entity with the given id, or files
+// within it. When ServerParams.RequirePublishedForDownload is set, only
+// users that can write to an entity may download it while it is not
+// published to any channel.
+func (h *ReqHandler) AuthorizeArchiveDownload(id *router.ResolvedURL, req *http.Request) error {
+	ops := []string{OpReadWithTerms}
+	if h.Handler.config.RequirePublishedForDownload {
+		entity, err := h.Cache.Entity(&id.URL, charmstore.FieldSelector("published"))
+		if err != nil {
+			return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+		}
+		if !isPublished(entity) {
+			ops = append(ops, OpWrite)
+		}
+	}
+	if _, err := h.authorize(authorizeParams{
+		req:       req,
+		ops:       ops,
+		entityIds: []*router.ResolvedURL{id},
+	}); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	return nil
+}
+
+// isPublished reports whether the given entity
+// is published to any channel.
+func isPublished(entity *mongodoc.Entity) bool {
+	for _, published := range entity.Published {
+		if published {
+			return true
+		}
+	}
+	return false
+}
+
 // SendEntityArchive writes the given blob, which has been retrieved
 // from the given id, as a response to the given request.
 func (h *ReqHandler) SendEntityArchive(id *router.ResolvedURL, w http.ResponseWriter, req *http.Request, blob *charmstore.Blob) {
+	h.SendEntityArchiveWithDisposition(id, w, req, blob, archiveContentDisposition(id))
+}
+
+// SendEntityArchiveWithDisposition is like SendEntityArchive except
+// that the response has the given Content-Disposition header value.
+func (h *ReqHandler) SendEntityArchiveWithDisposition(id *router.ResolvedURL, w http.ResponseWriter, req *http.Request, blob *charmstore.Blob, disposition string) {
 	header := w.Header()
-	setArchiveCacheControl(w.Header(), h.isPublic(id))
+	h.setEntityArchiveCacheControl(header, id)
 	header.Set(params.ContentHashHeader, blob.Hash)
 	header.Set(params.EntityIdHeader, id.PreferredURL().String())
-	header.Set("Content-Disposition", "attachment; filename="+id.PreferredURL().Name+".zip")
+	header.Set("Content-Disposition", disposition)
 
-	if StatsEnabled(req) {
-		h.Store.IncrementDownloadCountsAsync(id)
+	// Each revision of an entity is immutable, so its upload time
+	// is the time that its archive was last modified.
+	var modTime time.Time
+	if entity, err := h.Cache.Entity(&id.URL, charmstore.FieldSelector("uploadtime")); err == nil {
+		modTime = entity.UploadTime
+	}
+	// A client revalidating its cached copy of the archive has
+	// not downloaded it again.
+	if StatsEnabled(req) && !notModified(req, modTime) {
+		h.Store.IncrementDownloadCountsAsync(id, downloadClient(req))
 	}
 	// TODO(rog) should we set connection=close here?
 	// See https://codereview.appspot.com/5958045
-	serveContent(w, req, blob.Size, blob)
+	serveContent(w, req, blob.Size, blob, modTime)
+}
+
+// archiveContentDisposition returns the Content-Disposition header
+// value used when sending the archive of the entity with the given id.
+// It suggests a file name of the form "name_revision.charm", or
+// "name_revision.bundle" for bundles.
+func archiveContentDisposition(id *router.ResolvedURL) string {
+	url := id.PreferredURL()
+	ext := ".charm"
+	if url.Series == "bundle" {
+		ext = ".bundle"
+	}
+	return fmt.Sprintf(`attachment; filename="%s_%d%s"`, url.Name, url.Revision, ext)
 }
 
 func (h *ReqHandler) serveDeleteArchive(id *router.ResolvedURL, w http.ResponseWriter, req *http.Request) error {
 	if err := h.AuthorizeEntityForOp(id, req, OpWrite); err != nil {
 		return errgo.Mask(err, errgo.Any)
 	}
-	if err := h.Store.DeleteEntity(id); err != nil {
+	if err := h.Store.DeleteEntity(id, h.auditUser()); err != nil {
 		return errgo.NoteMask(err, fmt.Sprintf("cannot delete %q", id.PreferredURL()), errgo.Is(params.ErrNotFound), errgo.Is(params.ErrForbidden))
 	}
 	return nil
@@ -159,6 +235,91 @@ func (h *ReqHandler) servePostArchive(id *charm.URL, w http.ResponseWriter, req
 	if req.ContentLength == -1 {
 		return badRequestf(nil, "Content-Length not specified")
 	}
+	if err := h.checkUploadBody(req); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	return h.postArchive(id, w, req, req.Body, hash, req.ContentLength)
+}
+
+// defaultUploadContentTypes holds the content types accepted for
+// uploaded archives when ServerParams.UploadContentTypes is empty.
+var defaultUploadContentTypes = []string{"application/zip"}
+
+// zipMagic holds the signatures that a zip archive may start with: a
+// local file header, or the end of central directory record of an
+// empty archive.
+var zipMagic = [][]byte{
+	[]byte("PK\x03\x04"),
+	[]byte("PK\x05\x06"),
+}
+
+// checkUploadBody checks that the body of the given archive upload
+// request has an allowed content type and looks like a zip archive, so
+// that bodies that cannot be valid archives are rejected before they
+// are read in full. The content type is taken from the Content-Type
+// header or, if that is missing or generic, sniffed from the body. On
+// success, req.Body is replaced with a reader that returns the whole
+// body, including the bytes examined.
+func (h *ReqHandler) checkUploadBody(req *http.Request) error {
+	br := bufio.NewReaderSize(req.Body, 512)
+	head, err := br.Peek(512)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return errgo.Notef(err, "cannot read archive")
+	}
+	req.Body = struct {
+		io.Reader
+		io.Closer
+	}{br, req.Body}
+
+	contentType := req.Header.Get("Content-Type")
+	if contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			return badRequestf(err, "invalid content type %q", contentType)
+		}
+		contentType = mediaType
+	}
+	if contentType == "" || contentType == "application/octet-stream" {
+		contentType, _, _ = mime.ParseMediaType(http.DetectContentType(head))
+	}
+	allowed := h.Handler.config.UploadContentTypes
+	if len(allowed) == 0 {
+		allowed = defaultUploadContentTypes
+	}
+	if !containsString(allowed, contentType) {
+		return badRequestf(nil, "unsupported content type %q", contentType)
+	}
+	for _, magic := range zipMagic {
+		if bytes.HasPrefix(head, magic) {
+			return nil
+		}
+	}
+	return badRequestf(errNotZipArchive, "archive is not a zip file")
+}
+
+// errNotZipArchive is the underlying error of the error returned when
+// an uploaded archive is not a zip file.
+var errNotZipArchive = errgo.New("not a zip file")
+
+// IsNotZipArchive reports whether err was returned because an uploaded
+// archive is not a zip file.
+func IsNotZipArchive(err error) bool {
+	for err != nil {
+		if err == errNotZipArchive {
+			return true
+		}
+		w, ok := err.(errgo.Wrapper)
+		if !ok {
+			return false
+		}
+		err = w.Underlying()
+	}
+	return false
+}
+
+// postArchive uploads the archive of the given size and hash read from
+// r as a new revision of id, and writes the response to w.
+func (h *ReqHandler) postArchive(id *charm.URL, w http.ResponseWriter, req *http.Request, r io.Reader, hash string, size int64) error {
 	oldURL, oldHash, err := h.latestRevisionInfo(id)
 	if err != nil && errgo.Cause(err) != params.ErrNotFound {
 		return errgo.Notef(err, "cannot get hash of latest revision")
@@ -173,7 +334,7 @@ func (h *ReqHandler) servePostArchive(id *charm.URL, w http.ResponseWriter, req
 	}
 	newRevision, err := h.Store.NewRevision(id)
 	if err != nil {
-		return errgo.Notef(err, "cannot get new revision")
+		return errgo.NoteMask(err, "cannot get new revision", errgo.Is(params.ErrServiceUnavailable))
 	}
 	rid := &router.ResolvedURL{URL: *id}
 	rid.URL.Revision = newRevision
@@ -181,11 +342,18 @@ func (h *ReqHandler) servePostArchive(id *charm.URL, w http.ResponseWriter, req
 	if err != nil {
 		return errgo.Mask(err)
 	}
-	if err := h.Store.UploadEntity(rid, req.Body, hash, req.ContentLength, nil); err != nil {
+	if err := h.Store.UploadEntityWithParams(rid, r, hash, size, charmstore.AddParams{
+		Source:    req.Form.Get("source"),
+		User:      h.auditUser(),
+		SourceURL: req.Form.Get("source-url"),
+	}); err != nil {
 		return errgo.Mask(err,
+			errgo.Is(params.ErrBadRequest),
 			errgo.Is(params.ErrDuplicateUpload),
 			errgo.Is(params.ErrEntityIdNotAllowed),
+			errgo.Is(params.ErrForbidden),
 			errgo.Is(params.ErrInvalidEntity),
+			errgo.Is(router.ErrEntityTooLarge),
 		)
 	}
 	if ingesting, _ := router.ParseBool(req.Form.Get("ingest")); !ingesting {
@@ -212,6 +380,126 @@ func (h *ReqHandler) servePostArchive(id *charm.URL, w http.ResponseWriter, req
 	})
 }
 
+// archivePathHandler returns a handler for paths within id/archive.
+// POST requests to id/archive/delta are served by
+// servePostArchiveDelta and tus upload requests to id/archive/tus
+// are served by serveArchiveTus; all other requests are passed to
+// serveFile.
+func (h *ReqHandler) archivePathHandler(serveFile router.IdHandler) router.IdHandler {
+	return func(id *charm.URL, w http.ResponseWriter, req *http.Request) error {
+		isDelta := req.Method == "POST" && req.URL.Path == "/delta"
+		if !isDelta && !isTusRequest(req) {
+			return serveFile(id, w, req)
+		}
+		// Make sure we consume the full request body, before
+		// responding. See serveArchive for details.
+		defer io.Copy(ioutil.Discard, req.Body)
+		h.Cache.AddBaseEntityFields(charmstore.FieldSelector("noingest"))
+		if err := h.authorizeUpload(id, req); err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+		if isDelta {
+			return h.servePostArchiveDelta(id, w, req)
+		}
+		return h.serveArchiveTus(id, w, req)
+	}
+}
+
+// POST id/archive/delta?hash=sha384hash&base=revision
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#post-idarchivedelta
+func (h *ReqHandler) servePostArchiveDelta(id *charm.URL, w http.ResponseWriter, req *http.Request) error {
+	if id.Revision != -1 {
+		return badRequestf(nil, "revision specified, but should not be specified")
+	}
+	if id.User == "" {
+		return badRequestf(nil, "user not specified")
+	}
+	hash := req.Form.Get("hash")
+	if hash == "" {
+		return badRequestf(nil, "hash parameter not specified")
+	}
+	baseStr := req.Form.Get("base")
+	if baseStr == "" {
+		return badRequestf(nil, "base parameter not specified")
+	}
+	base, err := strconv.Atoi(baseStr)
+	if err != nil || base < 0 {
+		return badRequestf(nil, "invalid base parameter %q", baseStr)
+	}
+	baseId := &router.ResolvedURL{
+		URL:                 *id,
+		PromulgatedRevision: -1,
+	}
+	baseId.URL.Revision = base
+	blob, err := h.Store.OpenBlob(baseId)
+	if err != nil {
+		return errgo.NoteMask(err, fmt.Sprintf("cannot open base archive %q", &baseId.URL), errgo.Is(params.ErrNotFound))
+	}
+	defer blob.Close()
+	// The reconstructed archive is written to a temporary file
+	// so that a large delta does not use unbounded memory.
+	f, err := ioutil.TempFile("", "charmstore-delta")
+	if err != nil {
+		return errgo.Notef(err, "cannot create temporary file")
+	}
+	defer func() {
+		f.Close()
+		if err := os.Remove(f.Name()); err != nil {
+			logger.Warningf("cannot remove temporary file: %v", err)
+		}
+	}()
+	// The reconstructed archive is subject to the same size limit
+	// as an archive uploaded in full.
+	maxSize := int64(maxDeltaArchiveSize)
+	if max := h.Handler.config.MaxArchiveSize; max > 0 && max < maxSize {
+		maxSize = max
+	}
+	hasher := blobstore.NewHash()
+	lw := &limitedWriter{
+		w: io.MultiWriter(f, hasher),
+		n: maxSize,
+	}
+	if err := blobstore.ApplyDelta(lw, blob, req.Body); err != nil {
+		if lw.exceeded {
+			return errgo.WithCausef(nil, router.ErrEntityTooLarge, "archive too large (maximum %d bytes)", maxSize)
+		}
+		if errgo.Cause(err) == blobstore.ErrInvalidDelta {
+			return badRequestf(err, "cannot apply delta")
+		}
+		return errgo.Notef(err, "cannot apply delta")
+	}
+	if actualHash := fmt.Sprintf("%x", hasher.Sum(nil)); actualHash != hash {
+		return errgo.WithCausef(nil, params.ErrInvalidEntity, "hash mismatch: reconstructed archive has hash %s", actualHash)
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return errgo.Notef(err, "cannot seek to start of reconstructed archive")
+	}
+	return h.postArchive(id, w, req, f, hash, maxSize-lw.n)
+}
+
+// maxDeltaArchiveSize holds the maximum size of an archive
+// reconstructed from a delta.
+const maxDeltaArchiveSize = 1 << 30
+
+// limitedWriter writes to w, failing once more than n bytes
+// have been written.
+type limitedWriter struct {
+	w        io.Writer
+	n        int64
+	exceeded bool
+}
+
+// Write implements io.Writer.
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > w.n {
+		w.exceeded = true
+		return 0, errgo.New("write limit exceeded")
+	}
+	n, err := w.w.Write(p)
+	w.n -= int64(n)
+	return n, err
+}
+
 func (h *ReqHandler) servePutArchive(id *charm.URL, w http.ResponseWriter, req *http.Request) (err error) {
 	if id.Revision == -1 {
 		return badRequestf(nil, "revision not specified")
@@ -226,6 +514,9 @@ func (h *ReqHandler) servePutArchive(id *charm.URL, w http.ResponseWriter, req *
 	if req.ContentLength == -1 {
 		return badRequestf(nil, "Content-Length not specified")
 	}
+	if err := h.checkUploadBody(req); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
 	var chans []params.Channel
 	for _, c := range req.Form["channel"] {
 		c := params.Channel(c)
@@ -267,11 +558,19 @@ func (h *ReqHandler) servePutArchive(id *charm.URL, w http.ResponseWriter, req *
 	if err := h.Store.AddRevision(rid); err != nil {
 		return errgo.Mask(err)
 	}
-	if err := h.Store.UploadEntity(rid, req.Body, hash, req.ContentLength, chans); err != nil {
+	if err := h.Store.UploadEntityWithParams(rid, req.Body, hash, req.ContentLength, charmstore.AddParams{
+		Channels:  chans,
+		Source:    req.Form.Get("source"),
+		SourceURL: req.Form.Get("source-url"),
+		User:      h.auditUser(),
+	}); err != nil {
 		return errgo.Mask(err,
+			errgo.Is(params.ErrBadRequest),
 			errgo.Is(params.ErrDuplicateUpload),
 			errgo.Is(params.ErrEntityIdNotAllowed),
+			errgo.Is(params.ErrForbidden),
 			errgo.Is(params.ErrInvalidEntity),
+			errgo.Is(router.ErrEntityTooLarge),
 		)
 	}
 	return httprequest.WriteJSON(w, http.StatusOK, &params.ArchiveUploadResponse{
@@ -301,6 +600,12 @@ func (h *ReqHandler) latestRevisionInfo(id *charm.URL) (*router.ResolvedURL, str
 // GET id/archive/path
 // https://github.com/juju/charmstore/blob/v5/docs/API.md#get-idarchivepath
 func (h *ReqHandler) serveArchiveFile(id *router.ResolvedURL, w http.ResponseWriter, req *http.Request) error {
+	if err := h.AuthorizeArchiveDownload(id, req); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	if id.URL.Series == "bundle" && req.URL.Path == "/bundle-with-charms" {
+		return h.serveBundleWithCharms(id, w, req)
+	}
 	blob, err := h.Store.OpenBlob(id)
 	if err != nil {
 		return errgo.Notef(err, "cannot open archive data for %v", id)
@@ -309,6 +614,130 @@ func (h *ReqHandler) serveArchiveFile(id *router.ResolvedURL, w http.ResponseWri
 	return h.ServeBlobFile(w, req, id, blob)
 }
 
+const (
+	// defaultMaxBundleWithCharmsSize holds the maximum total size of
+	// the archives included in a bundle-with-charms archive when
+	// no limit is configured.
+	defaultMaxBundleWithCharmsSize = 1 << 30
+
+	// defaultMaxBundleWithCharmsCount holds the maximum number of
+	// charms included in a bundle-with-charms archive when no
+	// limit is configured.
+	defaultMaxBundleWithCharmsCount = 100
+)
+
+// GET id/archive/bundle-with-charms[?on-missing=fail|skip]
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#get-idarchivebundle-with-charms
+func (h *ReqHandler) serveBundleWithCharms(id *router.ResolvedURL, w http.ResponseWriter, req *http.Request) error {
+	skipMissing := false
+	switch onMissing := req.Form.Get("on-missing"); onMissing {
+	case "", "fail":
+	case "skip":
+		skipMissing = true
+	default:
+		return badRequestf(nil, "invalid on-missing value %q", onMissing)
+	}
+	entity, err := h.Cache.Entity(&id.URL, charmstore.FieldSelector("bundlecharms", "size"))
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	maxCount := h.Handler.config.MaxBundleWithCharmsCount
+	if maxCount == 0 {
+		maxCount = defaultMaxBundleWithCharmsCount
+	}
+	maxSize := h.Handler.config.MaxBundleWithCharmsSize
+	if maxSize == 0 {
+		maxSize = defaultMaxBundleWithCharmsSize
+	}
+	if len(entity.BundleCharms) > maxCount {
+		return errgo.WithCausef(nil, params.ErrForbidden, "bundle has too many charms (%d, maximum %d)", len(entity.BundleCharms), maxCount)
+	}
+
+	// Resolve and authorize all the charms before writing anything,
+	// so that any error can still be returned to the client.
+	h.Cache.StartFetch(entity.BundleCharms)
+	size := entity.Size
+	isPublic := h.isPublic(id)
+	var charmIds []*router.ResolvedURL
+	for _, url := range entity.BundleCharms {
+		cid, err := h.ResolveURL(url)
+		if err == nil {
+			err = h.AuthorizeArchiveDownload(cid, req)
+		}
+		if err != nil {
+			cause := errgo.Cause(err)
+			if skipMissing && (cause == params.ErrNotFound || cause == params.ErrUnauthorized || isDischargeRequiredError(err)) {
+				// The contents now depend on the user making
+				// the request, so must not be cached publicly.
+				isPublic = false
+				continue
+			}
+			return errgo.NoteMask(err, fmt.Sprintf("cannot get charm %q", url), errgo.Any)
+		}
+		ce, err := h.Cache.Entity(&cid.URL, charmstore.FieldSelector("size"))
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		size += ce.Size
+		if size > maxSize {
+			return errgo.WithCausef(nil, params.ErrForbidden, "bundle archives too large (maximum %d bytes)", maxSize)
+		}
+		isPublic = isPublic && h.isPublic(cid)
+		charmIds = append(charmIds, cid)
+	}
+
+	header := w.Header()
+	setArchiveCacheControl(header, isPublic)
+	header.Set("Content-Type", "application/zip")
+	header.Set(params.EntityIdHeader, id.PreferredURL().String())
+	header.Set("Content-Disposition", "attachment; filename="+id.PreferredURL().Name+"-with-charms.zip")
+	w.WriteHeader(http.StatusOK)
+
+	zw := stdzip.NewWriter(w)
+	if err := h.writeArchiveToZip(zw, "bundle.zip", id, req); err != nil {
+		// The response has already started, so all we can do is log
+		// the error and leave the client with a truncated archive.
+		logger.Errorf("cannot write bundle-with-charms archive for %v: %v", id, err)
+		return nil
+	}
+	for _, cid := range charmIds {
+		if err := h.writeArchiveToZip(zw, "charms/"+cid.PreferredURL().Path()+".zip", cid, req); err != nil {
+			logger.Errorf("cannot write bundle-with-charms archive for %v: %v", id, err)
+			return nil
+		}
+	}
+	if err := zw.Close(); err != nil {
+		logger.Errorf("cannot write bundle-with-charms archive for %v: %v", id, err)
+	}
+	return nil
+}
+
+// writeArchiveToZip writes the archive of the entity with the given id
+// to zw as a file with the given name.
+func (h *ReqHandler) writeArchiveToZip(zw *stdzip.Writer, name string, id *router.ResolvedURL, req *http.Request) error {
+	blob, err := h.Store.OpenBlob(id)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer blob.Close()
+	// The archives are already compressed, so there is
+	// nothing to gain by compressing them again.
+	fw, err := zw.CreateHeader(&stdzip.FileHeader{
+		Name:   name,
+		Method: stdzip.Store,
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if _, err := io.Copy(fw, blob); err != nil {
+		return errgo.Mask(err)
+	}
+	if StatsEnabled(req) {
+		h.Store.IncrementDownloadCountsAsync(id, downloadClient(req))
+	}
+	return nil
+}
+
 // ServeBlobFile serves a file from the given blob. The
 // path of the file is taken from req.URL.Path.
 // The blob should be associated with the entity
@@ -344,6 +773,24 @@ func (h *ReqHandler) isPublic(id *router.ResolvedURL) bool {
 // returned from the archive where the id represents the id of a public entity.
 const ArchiveCachePublicMaxAge = 1 * time.Hour
 
+// setEntityArchiveCacheControl sets cache control headers in a
+// response that serves the archive of the entity with the given id.
+// Archives of public entities that are published to the stable channel
+// rarely change, so they may be cached for longer; the archives of all
+// other entities must not be cached.
+func (h *ReqHandler) setEntityArchiveCacheControl(header http.Header, id *router.ResolvedURL) {
+	entity, err := h.Cache.Entity(&id.URL, charmstore.FieldSelector("published"))
+	if err != nil || !entity.Published[params.StableChannel] || !h.isPublic(id) {
+		setArchiveCacheControl(header, false)
+		return
+	}
+	maxAge := h.Handler.config.ArchiveCacheMaxAge
+	if maxAge == 0 {
+		maxAge = ArchiveCachePublicMaxAge
+	}
+	header.Set("Cache-Control", "public, max-age="+strconv.Itoa(int(maxAge/time.Second)))
+}
+
 // setArchiveCacheControl sets cache control headers
 // in a response to an archive-derived endpoint.
 // The isPublic parameter specifies whether
@@ -376,7 +823,7 @@ func (h *ReqHandler) getNewPromulgatedRevision(id *charm.URL) (int, error) {
 	}
 	rev, err := h.Store.NewRevision(purl)
 	if err != nil {
-		return 0, errgo.Mask(err)
+		return 0, errgo.Mask(err, errgo.Is(params.ErrServiceUnavailable))
 	}
 	return rev, nil
 }
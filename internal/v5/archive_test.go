@@ -17,6 +17,7 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path"
 	"sort"
 	"strconv"
 	"strings"
@@ -25,6 +26,7 @@ import (
 
 	"github.com/juju/charmrepo/v6/csclient/params"
 	charmtesting "github.com/juju/charmrepo/v6/testing"
+	jc "github.com/juju/testing/checkers"
 	"github.com/juju/testing/httptesting"
 	gc "gopkg.in/check.v1"
 	"gopkg.in/errgo.v1"
@@ -33,6 +35,7 @@ import (
 	"gopkg.in/macaroon.v2-unstable"
 	"gopkg.in/mgo.v2/bson"
 
+	"gopkg.in/juju/charmstore.v5/audit"
 	"gopkg.in/juju/charmstore.v5/internal/blobstore"
 	"gopkg.in/juju/charmstore.v5/internal/charm"
 	"gopkg.in/juju/charmstore.v5/internal/charmstore"
@@ -88,7 +91,7 @@ func (s *ArchiveSuite) TestGet(c *gc.C) {
 		ch.Bytes(),
 	)
 	c.Assert(rec.Header().Get(params.EntityIdHeader), gc.Equals, "cs:~charmers/precise/wordpress-0")
-	c.Assert(rec.Header().Get("Content-Disposition"), gc.Equals, "attachment; filename=wordpress.zip")
+	c.Assert(rec.Header().Get("Content-Disposition"), gc.Equals, `attachment; filename="wordpress_0.charm"`)
 	assertCacheControl(c, rec.Header(), true)
 
 	// Check that the HTTP range logic is plugged in OK. If this
@@ -107,6 +110,136 @@ func (s *ArchiveSuite) TestGet(c *gc.C) {
 	assertCacheControl(c, rec.Header(), true)
 }
 
+func (s *ArchiveSuite) TestGetLastModified(c *gc.C) {
+	id := newResolvedURL("cs:~charmers/precise/wordpress-0", -1)
+	ch := storetesting.NewCharm(nil)
+	s.addPublicCharm(c, ch, id)
+	entity, err := s.store.FindEntity(id, charmstore.FieldSelector("uploadtime"))
+	c.Assert(err, gc.Equals, nil)
+	lastModified := entity.UploadTime.UTC().Format(http.TimeFormat)
+
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL("~charmers/precise/wordpress-0/archive"),
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.Bytes()))
+	c.Assert(rec.Header().Get("Last-Modified"), gc.Equals, lastModified)
+
+	// The archive has not changed since it was uploaded.
+	rec = httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL("~charmers/precise/wordpress-0/archive"),
+		Header:  http.Header{"If-Modified-Since": {lastModified}},
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusNotModified, gc.Commentf("body: %s", rec.Body.Bytes()))
+	c.Assert(rec.Body.Len(), gc.Equals, 0)
+
+	// A client with an older copy gets the whole archive.
+	rec = httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL("~charmers/precise/wordpress-0/archive"),
+		Header: http.Header{
+			"If-Modified-Since": {entity.UploadTime.Add(-time.Hour).UTC().Format(http.TimeFormat)},
+		},
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.Bytes()))
+	c.Assert(rec.Body.Bytes(), gc.DeepEquals, ch.Bytes())
+	c.Assert(rec.Header().Get("Last-Modified"), gc.Equals, lastModified)
+}
+
+func (s *ArchiveSuite) TestGetCacheControlArchiveCacheMaxAge(c *gc.C) {
+	config := s.srvParams
+	config.ArchiveCacheMaxAge = 24 * time.Hour
+	srv, err := charmstore.NewServer(s.Session.DB("charmstore"), nil, config, map[string]charmstore.NewAPIHandlerFunc{"v5": v5.NewAPIHandler})
+	c.Assert(err, gc.Equals, nil)
+	defer srv.Close()
+
+	id := newResolvedURL("cs:~charmers/precise/wordpress-0", -1)
+	s.addPublicCharm(c, storetesting.NewCharm(nil), id)
+
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: srv,
+		URL:     storeURL("~charmers/precise/wordpress-0/archive"),
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.Bytes()))
+	c.Assert(rec.Header().Get("Cache-Control"), gc.Equals, "public, max-age=86400")
+}
+
+func (s *ArchiveSuite) TestGetCacheControlUnpublished(c *gc.C) {
+	id := newResolvedURL("cs:~charmers/precise/wordpress-0", -1)
+	err := s.store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.SetPerms(&id.URL, "unpublished.read", params.Everyone)
+	c.Assert(err, gc.Equals, nil)
+
+	// Even though the charm can be read by everyone, it is not
+	// published to the stable channel, so it must not be cached.
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL("~charmers/precise/wordpress-0/archive?channel=unpublished"),
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.Bytes()))
+	assertCacheControl(c, rec.Header(), false)
+
+	// Once it is published to the stable channel, it can be cached.
+	s.setPublic(c, id)
+	rec = httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL("~charmers/precise/wordpress-0/archive"),
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.Bytes()))
+	assertCacheControl(c, rec.Header(), true)
+}
+
+func (s *ArchiveSuite) TestGetRequirePublishedForDownload(c *gc.C) {
+	config := s.srvParams
+	config.RequirePublishedForDownload = true
+	srv, err := charmstore.NewServer(s.Session.DB("charmstore"), nil, config, map[string]charmstore.NewAPIHandlerFunc{"v5": v5.NewAPIHandler})
+	c.Assert(err, gc.Equals, nil)
+	defer srv.Close()
+
+	// A published charm can be downloaded by anyone that can read it.
+	s.addPublicCharm(c, storetesting.NewCharm(nil), newResolvedURL("cs:~charmers/precise/wordpress-0", -1))
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: srv,
+		URL:     storeURL("~charmers/precise/wordpress-0/archive"),
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.Bytes()))
+
+	// An unpublished charm cannot be downloaded by a user that can
+	// only read it.
+	id := newResolvedURL("cs:~charmers/precise/mysql-0", -1)
+	err = s.store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.SetPerms(&id.URL, "unpublished.read", params.Everyone)
+	c.Assert(err, gc.Equals, nil)
+	// Neither can the files within its archive.
+	s.idmServer.SetDefaultUser("bob")
+	for _, path := range []string{"archive", "archive/metadata.yaml"} {
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:      srv,
+			URL:          storeURL("~charmers/precise/mysql-0/" + path),
+			Do:           bakeryDo(nil),
+			ExpectStatus: http.StatusUnauthorized,
+			ExpectBody: params.Error{
+				Message: `access denied for user "bob"`,
+				Code:    params.ErrUnauthorized,
+			},
+		})
+	}
+
+	// The owner of the charm can still download it.
+	s.idmServer.SetDefaultUser("charmers")
+	for _, path := range []string{"archive", "archive/metadata.yaml"} {
+		rec = httptesting.DoRequest(c, httptesting.DoRequestParams{
+			Handler: srv,
+			URL:     storeURL("~charmers/precise/mysql-0/" + path),
+			Do:      bakeryDo(nil),
+		})
+		c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.Bytes()))
+	}
+}
+
 func (s *ArchiveSuite) TestGetWithPartialId(c *gc.C) {
 	id := newResolvedURL("cs:~charmers/precise/wordpress-0", -1)
 	ch := storetesting.NewCharm(nil)
@@ -134,6 +267,17 @@ func (s *ArchiveSuite) TestGetPromulgatedWithPartialId(c *gc.C) {
 		ch.Bytes(),
 	)
 	c.Assert(rec.Header().Get(params.EntityIdHeader), gc.Equals, id.PromulgatedURL().String())
+	c.Assert(rec.Header().Get("Content-Disposition"), gc.Equals, `attachment; filename="wordpress_42.charm"`)
+}
+
+func (s *ArchiveSuite) TestGetBundleContentDisposition(c *gc.C) {
+	id, _ := s.addPublicBundleFromRepo(c, "wordpress-simple", newResolvedURL("cs:~charmers/bundle/wordpress-simple-3", -1), true)
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL(id.URL.Path() + "/archive"),
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.Bytes()))
+	c.Assert(rec.Header().Get("Content-Disposition"), gc.Equals, `attachment; filename="wordpress-simple_3.bundle"`)
 }
 
 func (s *ArchiveSuite) TestGetCounters(c *gc.C) {
@@ -159,6 +303,57 @@ func (s *ArchiveSuite) TestGetCounters(c *gc.C) {
 	}
 }
 
+func (s *ArchiveSuite) TestGetCountersByClient(c *gc.C) {
+	id := newResolvedURL("~charmers/utopic/mysql-42", 42)
+	ch := storetesting.NewCharm(nil)
+	s.addPublicCharm(c, ch, id)
+
+	for _, p := range []httptesting.DoRequestParams{{
+		URL: storeURL("~charmers/utopic/mysql-42/archive?client=ci"),
+	}, {
+		URL:    storeURL("~charmers/utopic/mysql-42/archive"),
+		Header: http.Header{"User-Agent": {"Juju/2.8.0"}},
+	}, {
+		URL:    storeURL("~charmers/utopic/mysql-42/archive"),
+		Header: http.Header{"User-Agent": {"Mozilla/5.0 (X11; Linux x86_64)"}},
+	}, {
+		URL:    storeURL("~charmers/utopic/mysql-42/archive?client=unknown"),
+		Header: http.Header{"User-Agent": {"Mozilla/5.0 (X11; Linux x86_64)"}},
+	}, {
+		URL: storeURL("~charmers/utopic/mysql-42/archive"),
+	}} {
+		p := p
+		s.assertArchiveDownload(c, "", &p, ch.Bytes())
+	}
+	expect := map[string]int64{
+		"ci":      1,
+		"juju":    1,
+		"browser": 2,
+		"other":   1,
+	}
+	stats.CheckDownloadsByClient(c, s.store, &id.URL, expect)
+	stats.CheckTotalDownloads(c, s.store, &id.URL, 5)
+
+	s.assertGet(c, "~charmers/utopic/mysql-42/meta/stats", &v5.StatsResponse{
+		StatsResponse: params.StatsResponse{
+			ArchiveDownloadCount: 5,
+			ArchiveDownload: params.StatsCount{
+				Total: 5,
+				Day:   5,
+				Week:  5,
+				Month: 5,
+			},
+			ArchiveDownloadAllRevisions: params.StatsCount{
+				Total: 5,
+				Day:   5,
+				Week:  5,
+				Month: 5,
+			},
+		},
+		ArchiveDownloadCountByClient: expect,
+	})
+}
+
 func (s *ArchiveSuite) TestGetCountersDisabled(c *gc.C) {
 	id := newResolvedURL("~charmers/utopic/mysql-42", 42)
 	ch := storetesting.NewCharm(nil)
@@ -390,6 +585,28 @@ func (s *ArchiveSuite) TestPostCharm(c *gc.C) {
 	c.Assert(rec.Header().Get(params.EntityIdHeader), gc.Equals, "cs:~charmers/precise/wordpress-2")
 }
 
+func (s *ArchiveSuite) TestPostBlockedCharm(c *gc.C) {
+	err := s.store.SetUploadBlocklist([]string{"*/word*"})
+	c.Assert(err, gc.Equals, nil)
+
+	s.assertUploadCharmError(
+		c,
+		"POST",
+		charm.MustParseURL("~charmers/precise/wordpress-0"),
+		nil,
+		"wordpress",
+		nil,
+		http.StatusForbidden,
+		params.Error{
+			Message: `cannot upload "cs:~charmers/precise/wordpress": "charmers/wordpress" is blocked by pattern "*/word*"`,
+			Code:    params.ErrForbidden,
+		},
+	)
+
+	// Names that do not match the blocklist can still be uploaded.
+	s.assertUploadCharm(c, "POST", newResolvedURL("~charmers/precise/mysql-0", -1), "mysql", nil)
+}
+
 func (s *ArchiveSuite) TestPostCurrentVersion(c *gc.C) {
 	s.assertUploadCharm(c, "POST", newResolvedURL("~charmers/precise/wordpress-0", -1), "wordpress", nil)
 
@@ -502,6 +719,90 @@ func (s *ArchiveSuite) TestPutCharmWithInvalidChannel(c *gc.C) {
 	)
 }
 
+func (s *ArchiveSuite) TestPutCharmWithSource(c *gc.C) {
+	blob, hashSum := getBlob(storetesting.Charms.CharmDir("wordpress"))
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:       s.srv,
+		URL:           storeURL("~charmers/precise/wordpress-0/archive?hash=" + hashSum + "&source=github&source-url=" + url.QueryEscape("https://github.com/charmers/wordpress")),
+		Method:        "PUT",
+		ContentLength: int64(blob.Len()),
+		Header: http.Header{
+			"Content-Type": {"application/zip"},
+		},
+		Body:     blob,
+		Username: testUsername,
+		Password: testPassword,
+		ExpectBody: params.ArchiveUploadResponse{
+			Id: charm.MustParseURL("~charmers/precise/wordpress-0"),
+		},
+	})
+	s.assertGetAsAdmin(c, "~charmers/precise/wordpress-0/meta/provenance", &v5.ProvenanceResponse{
+		Source:    "github",
+		SourceURL: "https://github.com/charmers/wordpress",
+	})
+}
+
+func (s *ArchiveSuite) TestPutCharmWithInvalidSource(c *gc.C) {
+	blob, hashSum := getBlob(storetesting.Charms.CharmDir("wordpress"))
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:       s.srv,
+		URL:           storeURL("~charmers/precise/wordpress-0/archive?hash=" + hashSum + "&source=Bad!"),
+		Method:        "PUT",
+		ContentLength: int64(blob.Len()),
+		Header: http.Header{
+			"Content-Type": {"application/zip"},
+		},
+		Body:         blob,
+		Username:     testUsername,
+		Password:     testPassword,
+		ExpectStatus: http.StatusBadRequest,
+		ExpectBody: params.Error{
+			Message: `invalid source "Bad!"`,
+			Code:    params.ErrBadRequest,
+		},
+	})
+}
+
+func (s *ArchiveSuite) TestPostCharmWithSourceNotAdmin(c *gc.C) {
+	blob, hashSum := getBlob(storetesting.Charms.CharmDir("wordpress"))
+	s.doAsUser("charmers", func() {
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:       s.srv,
+			Do:            bakeryDo(nil),
+			URL:           storeURL("~charmers/precise/wordpress/archive?hash=" + hashSum + "&source=github"),
+			Method:        "POST",
+			ContentLength: int64(blob.Len()),
+			Header: http.Header{
+				"Content-Type": {"application/zip"},
+			},
+			Body:         blob,
+			ExpectStatus: http.StatusUnauthorized,
+			ExpectBody: params.Error{
+				Message: "source and source-url may only be specified with admin credentials",
+				Code:    params.ErrUnauthorized,
+			},
+		})
+	})
+	// Nothing has been uploaded.
+	_, err := s.store.FindEntity(newResolvedURL("~charmers/precise/wordpress-0", -1), nil)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *ArchiveSuite) TestPostCharmWithoutSource(c *gc.C) {
+	s.assertUploadCharm(c, "POST", newResolvedURL("~charmers/precise/wordpress-0", -1), "wordpress", nil)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("~charmers/precise/wordpress-0/meta/provenance"),
+		Username:     testUsername,
+		Password:     testPassword,
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody: params.Error{
+			Code:    params.ErrMetadataNotFound,
+			Message: params.ErrMetadataNotFound.Error(),
+		},
+	})
+}
+
 func (s *ArchiveSuite) TestPutMultiseriesCharm(c *gc.C) {
 	s.assertUploadCharm(c, "PUT", newResolvedURL("~charmers/juju-gui-2", -1), "multi-series", nil)
 }
@@ -628,6 +929,35 @@ func (s *ArchiveSuite) TestPostBundle(c *gc.C) {
 	s.assertUploadBundle(c, "POST", newResolvedURL("~charmers/bundle/wordpress-simple-2", -1), "wordpress-simple")
 }
 
+func (s *ArchiveSuite) TestPostArchiveTooLarge(c *gc.C) {
+	config := s.srvParams
+	config.MaxArchiveSize = 100
+	srv, err := charmstore.NewServer(s.Session.DB("charmstore"), nil, config, map[string]charmstore.NewAPIHandlerFunc{"v5": v5.NewAPIHandler})
+	c.Assert(err, gc.Equals, nil)
+	defer srv.Close()
+
+	blob, hashSum := getBlob(storetesting.Charms.CharmDir("wordpress"))
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:       srv,
+		URL:           storeURL("~charmers/precise/wordpress/archive?hash=" + hashSum),
+		Method:        "POST",
+		ContentLength: int64(blob.Len()),
+		Header: http.Header{
+			"Content-Type": {"application/zip"},
+		},
+		Body:         blob,
+		Username:     testUsername,
+		Password:     testPassword,
+		ExpectStatus: http.StatusRequestEntityTooLarge,
+		ExpectBody: params.Error{
+			Message: "archive too large (maximum 100 bytes)",
+			Code:    router.ErrEntityTooLarge,
+		},
+	})
+	_, err = s.store.FindEntity(newResolvedURL("~charmers/precise/wordpress-0", -1), nil)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
 func (s *ArchiveSuite) TestPostHashMismatch(c *gc.C) {
 	content := []byte("some content")
 	hash, _ := hashOf(bytes.NewReader(content))
@@ -652,6 +982,472 @@ func (s *ArchiveSuite) TestPostHashMismatch(c *gc.C) {
 	})
 }
 
+func (s *ArchiveSuite) TestPostDelta(c *gc.C) {
+	// Upload the first revision in full.
+	rev0, hash0 := getBlob(storetesting.Charms.CharmDir("wordpress"))
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		URL:      storeURL("~charmers/precise/wordpress/archive?hash=" + hash0),
+		Method:   "POST",
+		Body:     bytes.NewReader(rev0.Bytes()),
+		Username: testUsername,
+		Password: testPassword,
+		ExpectBody: &params.ArchiveUploadResponse{
+			Id: charm.MustParseURL("~charmers/precise/wordpress-0"),
+		},
+	})
+
+	// Upload the second revision as a delta against the first.
+	rev1 := addFileToZip(c, rev0.Bytes(), "extra", "some extra content")
+	hash1 := hashOfBytes(rev1)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		URL:      storeURL("~charmers/precise/wordpress/archive/delta?base=0&hash=" + hash1),
+		Method:   "POST",
+		Body:     bytes.NewReader(storetesting.Delta(rev0.Bytes(), rev1)),
+		Username: testUsername,
+		Password: testPassword,
+		ExpectBody: &params.ArchiveUploadResponse{
+			Id: charm.MustParseURL("~charmers/precise/wordpress-1"),
+		},
+	})
+
+	// Check that the reconstructed archive is the same as the full
+	// second revision.
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler:  s.srv,
+		URL:      storeURL("~charmers/precise/wordpress-1/archive"),
+		Username: testUsername,
+		Password: testPassword,
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body))
+	c.Assert(rec.Header().Get(params.ContentHashHeader), gc.Equals, hash1)
+	c.Assert(rec.Body.Bytes(), gc.DeepEquals, rev1)
+
+	// Check that the file in the archive can still be retrieved.
+	rec = httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler:  s.srv,
+		URL:      storeURL("~charmers/precise/wordpress-1/archive/extra"),
+		Username: testUsername,
+		Password: testPassword,
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body))
+	c.Assert(rec.Body.String(), gc.Equals, "some extra content")
+}
+
+func (s *ArchiveSuite) TestPostDeltaErrors(c *gc.C) {
+	rev0, hash0 := getBlob(storetesting.Charms.CharmDir("wordpress"))
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		URL:      storeURL("~charmers/precise/wordpress/archive?hash=" + hash0),
+		Method:   "POST",
+		Body:     bytes.NewReader(rev0.Bytes()),
+		Username: testUsername,
+		Password: testPassword,
+		ExpectBody: &params.ArchiveUploadResponse{
+			Id: charm.MustParseURL("~charmers/precise/wordpress-0"),
+		},
+	})
+	rev1 := addFileToZip(c, rev0.Bytes(), "extra", "some extra content")
+	delta := storetesting.Delta(rev0.Bytes(), rev1)
+	tests := []struct {
+		about        string
+		path         string
+		body         []byte
+		expectStatus int
+		expectBody   params.Error
+	}{{
+		about:        "no hash",
+		path:         "~charmers/precise/wordpress/archive/delta?base=0",
+		body:         delta,
+		expectStatus: http.StatusBadRequest,
+		expectBody: params.Error{
+			Code:    params.ErrBadRequest,
+			Message: "hash parameter not specified",
+		},
+	}, {
+		about:        "no base",
+		path:         "~charmers/precise/wordpress/archive/delta?hash=" + hashOfBytes(rev1),
+		body:         delta,
+		expectStatus: http.StatusBadRequest,
+		expectBody: params.Error{
+			Code:    params.ErrBadRequest,
+			Message: "base parameter not specified",
+		},
+	}, {
+		about:        "invalid base",
+		path:         "~charmers/precise/wordpress/archive/delta?base=-1&hash=" + hashOfBytes(rev1),
+		body:         delta,
+		expectStatus: http.StatusBadRequest,
+		expectBody: params.Error{
+			Code:    params.ErrBadRequest,
+			Message: `invalid base parameter "-1"`,
+		},
+	}, {
+		about:        "base not found",
+		path:         "~charmers/precise/wordpress/archive/delta?base=5&hash=" + hashOfBytes(rev1),
+		body:         delta,
+		expectStatus: http.StatusNotFound,
+		expectBody: params.Error{
+			Code:    params.ErrNotFound,
+			Message: `cannot open base archive "cs:~charmers/precise/wordpress-5": entity not found`,
+		},
+	}, {
+		about:        "invalid delta",
+		path:         "~charmers/precise/wordpress/archive/delta?base=0&hash=" + hashOfBytes(rev1),
+		body:         rev1,
+		expectStatus: http.StatusBadRequest,
+		expectBody: params.Error{
+			Code:    params.ErrBadRequest,
+			Message: "cannot apply delta: not a VCDIFF delta",
+		},
+	}, {
+		about:        "hash mismatch",
+		path:         "~charmers/precise/wordpress/archive/delta?base=0&hash=" + hashOfBytes(rev0.Bytes()),
+		body:         delta,
+		expectStatus: http.StatusBadRequest,
+		expectBody: params.Error{
+			Code:    params.ErrInvalidEntity,
+			Message: "hash mismatch: reconstructed archive has hash " + hashOfBytes(rev1),
+		},
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: %s", i, test.about)
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:      s.srv,
+			URL:          storeURL(test.path),
+			Method:       "POST",
+			Body:         bytes.NewReader(test.body),
+			Username:     testUsername,
+			Password:     testPassword,
+			ExpectStatus: test.expectStatus,
+			ExpectBody:   test.expectBody,
+		})
+	}
+}
+
+func (s *ArchiveSuite) TestPostDeltaTooLarge(c *gc.C) {
+	rev0, hash0 := getBlob(storetesting.Charms.CharmDir("wordpress"))
+	config := s.srvParams
+	config.MaxArchiveSize = int64(rev0.Len())
+	srv, err := charmstore.NewServer(s.Session.DB("charmstore"), nil, config, map[string]charmstore.NewAPIHandlerFunc{"v5": v5.NewAPIHandler})
+	c.Assert(err, gc.Equals, nil)
+	defer srv.Close()
+
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  srv,
+		URL:      storeURL("~charmers/precise/wordpress/archive?hash=" + hash0),
+		Method:   "POST",
+		Body:     bytes.NewReader(rev0.Bytes()),
+		Username: testUsername,
+		Password: testPassword,
+		ExpectBody: &params.ArchiveUploadResponse{
+			Id: charm.MustParseURL("~charmers/precise/wordpress-0"),
+		},
+	})
+	// The reconstructed archive is larger than the base.
+	rev1 := addFileToZip(c, rev0.Bytes(), "extra", "some extra content")
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      srv,
+		URL:          storeURL("~charmers/precise/wordpress/archive/delta?base=0&hash=" + hashOfBytes(rev1)),
+		Method:       "POST",
+		Body:         bytes.NewReader(storetesting.Delta(rev0.Bytes(), rev1)),
+		Username:     testUsername,
+		Password:     testPassword,
+		ExpectStatus: http.StatusRequestEntityTooLarge,
+		ExpectBody: params.Error{
+			Message: fmt.Sprintf("archive too large (maximum %d bytes)", rev0.Len()),
+			Code:    router.ErrEntityTooLarge,
+		},
+	})
+	_, err = s.store.FindEntity(newResolvedURL("~charmers/precise/wordpress-1", -1), nil)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *ArchiveSuite) TestTusUpload(c *gc.C) {
+	blob, hash := getBlob(storetesting.Charms.CharmDir("wordpress"))
+	data := blob.Bytes()
+	location := s.createTusUpload(c, "~charmers/precise/wordpress", len(data), hash)
+	c.Assert(strings.HasPrefix(location, "/v5/~charmers/precise/wordpress/archive/tus/"), gc.Equals, true, gc.Commentf("location %q", location))
+	uploadPath := strings.TrimPrefix(location, "/v5/")
+
+	// Upload the archive in three chunks, checking the
+	// offset reported by HEAD part way through.
+	chunk := len(data) / 3
+	rec := s.patchTus(c, uploadPath, 0, data[:chunk])
+	c.Assert(rec.Code, gc.Equals, http.StatusNoContent, gc.Commentf("body: %s", rec.Body))
+	c.Assert(rec.Header().Get("Upload-Offset"), gc.Equals, strconv.Itoa(chunk))
+
+	rec = s.headTus(c, uploadPath)
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body))
+	c.Assert(rec.Header().Get("Tus-Resumable"), gc.Equals, "1.0.0")
+	c.Assert(rec.Header().Get("Upload-Offset"), gc.Equals, strconv.Itoa(chunk))
+	c.Assert(rec.Header().Get("Upload-Length"), gc.Equals, strconv.Itoa(len(data)))
+	c.Assert(rec.Header().Get("Cache-Control"), gc.Equals, "no-store")
+
+	// A PATCH at the wrong offset is rejected.
+	rec = s.patchTus(c, uploadPath, 0, data[:chunk])
+	c.Assert(rec.Code, gc.Equals, http.StatusConflict, gc.Commentf("body: %s", rec.Body))
+
+	rec = s.patchTus(c, uploadPath, chunk, data[chunk:2*chunk])
+	c.Assert(rec.Code, gc.Equals, http.StatusNoContent, gc.Commentf("body: %s", rec.Body))
+	c.Assert(rec.Header().Get("Upload-Offset"), gc.Equals, strconv.Itoa(2*chunk))
+
+	rec = s.patchTus(c, uploadPath, 2*chunk, data[2*chunk:])
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body))
+	c.Assert(rec.Header().Get("Upload-Offset"), gc.Equals, strconv.Itoa(len(data)))
+	var resp params.ArchiveUploadResponse
+	err := json.Unmarshal(rec.Body.Bytes(), &resp)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(resp.Id, gc.DeepEquals, charm.MustParseURL("~charmers/precise/wordpress-0"))
+
+	// The archive has been added as a new entity.
+	rec = httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler:  s.srv,
+		URL:      storeURL("~charmers/precise/wordpress-0/archive"),
+		Username: testUsername,
+		Password: testPassword,
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body))
+	c.Assert(rec.Header().Get(params.ContentHashHeader), gc.Equals, hash)
+	c.Assert(rec.Body.Bytes(), gc.DeepEquals, data)
+
+	// The upload has been removed.
+	rec = s.headTus(c, uploadPath)
+	c.Assert(rec.Code, gc.Equals, http.StatusNotFound)
+}
+
+func (s *ArchiveSuite) TestTusUploadHashMismatch(c *gc.C) {
+	blob, _ := getBlob(storetesting.Charms.CharmDir("wordpress"))
+	data := blob.Bytes()
+	location := s.createTusUpload(c, "~charmers/precise/wordpress", len(data), hashOfBytes([]byte("other")))
+	uploadPath := strings.TrimPrefix(location, "/v5/")
+	rec := s.patchTus(c, uploadPath, 0, data)
+	c.Assert(rec.Code, gc.Equals, http.StatusBadRequest, gc.Commentf("body: %s", rec.Body))
+	var perr params.Error
+	err := json.Unmarshal(rec.Body.Bytes(), &perr)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(perr, gc.DeepEquals, params.Error{
+		Code:    params.ErrInvalidEntity,
+		Message: "hash mismatch: uploaded archive has hash " + hashOfBytes(data),
+	})
+}
+
+func (s *ArchiveSuite) TestTusUploadErrors(c *gc.C) {
+	blob, hash := getBlob(storetesting.Charms.CharmDir("wordpress"))
+	data := blob.Bytes()
+	location := s.createTusUpload(c, "~charmers/precise/wordpress", len(data), hash)
+	uploadPath := strings.TrimPrefix(location, "/v5/")
+	tests := []struct {
+		about        string
+		method       string
+		path         string
+		header       http.Header
+		body         []byte
+		expectStatus int
+		expectBody   params.Error
+	}{{
+		about:        "no Tus-Resumable header",
+		method:       "POST",
+		path:         "~charmers/precise/wordpress/archive/tus",
+		header:       http.Header{"Upload-Length": {"10"}},
+		expectStatus: http.StatusPreconditionFailed,
+		expectBody: params.Error{
+			Code:    router.ErrPreconditionFailed,
+			Message: `unsupported tus version ""`,
+		},
+	}, {
+		about:  "no Upload-Length",
+		method: "POST",
+		path:   "~charmers/precise/wordpress/archive/tus",
+		header: http.Header{
+			"Tus-Resumable": {"1.0.0"},
+		},
+		expectStatus: http.StatusBadRequest,
+		expectBody: params.Error{
+			Code:    params.ErrBadRequest,
+			Message: "Upload-Length not specified",
+		},
+	}, {
+		about:  "no hash",
+		method: "POST",
+		path:   "~charmers/precise/wordpress/archive/tus",
+		header: http.Header{
+			"Tus-Resumable":   {"1.0.0"},
+			"Upload-Length":   {"10"},
+			"Upload-Metadata": {"filename d29yZHByZXNz"},
+		},
+		expectStatus: http.StatusBadRequest,
+		expectBody: params.Error{
+			Code:    params.ErrBadRequest,
+			Message: "hash not specified in Upload-Metadata",
+		},
+	}, {
+		about:  "revision specified",
+		method: "POST",
+		path:   "~charmers/precise/wordpress-3/archive/tus",
+		header: http.Header{
+			"Tus-Resumable": {"1.0.0"},
+		},
+		expectStatus: http.StatusBadRequest,
+		expectBody: params.Error{
+			Code:    params.ErrBadRequest,
+			Message: "revision specified, but should not be specified",
+		},
+	}, {
+		about:  "wrong content type",
+		method: "PATCH",
+		path:   uploadPath,
+		header: http.Header{
+			"Tus-Resumable": {"1.0.0"},
+			"Upload-Offset": {"0"},
+			"Content-Type":  {"application/octet-stream"},
+		},
+		body:         data[:20],
+		expectStatus: http.StatusUnsupportedMediaType,
+		expectBody: params.Error{
+			Code:    router.ErrUnsupportedMediaType,
+			Message: `unexpected content type "application/octet-stream"`,
+		},
+	}, {
+		about:  "chunk too small",
+		method: "PATCH",
+		path:   uploadPath,
+		header: http.Header{
+			"Tus-Resumable": {"1.0.0"},
+			"Upload-Offset": {"0"},
+			"Content-Type":  {"application/offset+octet-stream"},
+		},
+		body:         data[:5],
+		expectStatus: http.StatusBadRequest,
+		expectBody: params.Error{
+			Code:    params.ErrBadRequest,
+			Message: "data too small (need at least 10 bytes, got 5)",
+		},
+	}, {
+		about:  "data too long",
+		method: "PATCH",
+		path:   uploadPath,
+		header: http.Header{
+			"Tus-Resumable": {"1.0.0"},
+			"Upload-Offset": {"0"},
+			"Content-Type":  {"application/offset+octet-stream"},
+		},
+		body:         append(append([]byte(nil), data...), "extra"...),
+		expectStatus: http.StatusBadRequest,
+		expectBody: params.Error{
+			Code:    params.ErrBadRequest,
+			Message: fmt.Sprintf("data exceeds Upload-Length %d", len(data)),
+		},
+	}, {
+		about:  "upload for another entity",
+		method: "PATCH",
+		path:   strings.Replace(uploadPath, "wordpress", "mysql", 1),
+		header: http.Header{
+			"Tus-Resumable": {"1.0.0"},
+			"Upload-Offset": {"0"},
+			"Content-Type":  {"application/offset+octet-stream"},
+		},
+		body:         data,
+		expectStatus: http.StatusNotFound,
+		expectBody: params.Error{
+			Code:    params.ErrNotFound,
+			Message: fmt.Sprintf("upload %q not found", path.Base(uploadPath)),
+		},
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: %s", i, test.about)
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:      s.srv,
+			URL:          storeURL(test.path),
+			Method:       test.method,
+			Header:       test.header,
+			Body:         bytes.NewReader(test.body),
+			Username:     testUsername,
+			Password:     testPassword,
+			ExpectStatus: test.expectStatus,
+			ExpectBody:   test.expectBody,
+		})
+	}
+}
+
+// createTusUpload creates a tus upload of an archive with the given
+// size and hash for the given entity and returns its location.
+func (s *ArchiveSuite) createTusUpload(c *gc.C, id string, size int, hash string) string {
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL(id + "/archive/tus"),
+		Method:  "POST",
+		Header: http.Header{
+			"Tus-Resumable":   {"1.0.0"},
+			"Upload-Length":   {strconv.Itoa(size)},
+			"Upload-Metadata": {"hash " + base64.StdEncoding.EncodeToString([]byte(hash))},
+		},
+		Username: testUsername,
+		Password: testPassword,
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusCreated, gc.Commentf("body: %s", rec.Body))
+	c.Assert(rec.Header().Get("Tus-Resumable"), gc.Equals, "1.0.0")
+	return rec.Header().Get("Location")
+}
+
+// patchTus sends the given data at the given offset
+// to the tus upload at the given path.
+func (s *ArchiveSuite) patchTus(c *gc.C, path string, offset int, data []byte) *httptest.ResponseRecorder {
+	return httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL(path),
+		Method:  "PATCH",
+		Header: http.Header{
+			"Tus-Resumable": {"1.0.0"},
+			"Upload-Offset": {strconv.Itoa(offset)},
+			"Content-Type":  {"application/offset+octet-stream"},
+		},
+		Body:     bytes.NewReader(data),
+		Username: testUsername,
+		Password: testPassword,
+	})
+}
+
+// headTus queries the tus upload at the given path.
+func (s *ArchiveSuite) headTus(c *gc.C, path string) *httptest.ResponseRecorder {
+	return httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL(path),
+		Method:  "HEAD",
+		Header: http.Header{
+			"Tus-Resumable": {"1.0.0"},
+		},
+		Username: testUsername,
+		Password: testPassword,
+	})
+}
+
+// addFileToZip returns a copy of the given zip archive with a file
+// of the given name and content added.
+func addFileToZip(c *gc.C, data []byte, name, content string) []byte {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	c.Assert(err, gc.Equals, nil)
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range zr.File {
+		w, err := zw.CreateHeader(&f.FileHeader)
+		c.Assert(err, gc.Equals, nil)
+		r, err := f.Open()
+		c.Assert(err, gc.Equals, nil)
+		_, err = io.Copy(w, r)
+		c.Assert(err, gc.Equals, nil)
+		r.Close()
+	}
+	w, err := zw.Create(name)
+	c.Assert(err, gc.Equals, nil)
+	_, err = io.WriteString(w, content)
+	c.Assert(err, gc.Equals, nil)
+	err = zw.Close()
+	c.Assert(err, gc.Equals, nil)
+	return buf.Bytes()
+}
+
 func (s *ArchiveSuite) TestPostEntityClearsCanIngest(c *gc.C) {
 	id := newResolvedURL("~charmers/precise/juju-gui-0", -1)
 	s.assertUploadCharm(c, "PUT", id, "wordpress", nil)
@@ -717,11 +1513,60 @@ func invalidZip() io.ReadSeeker {
 }
 
 func (s *ArchiveSuite) TestPostInvalidCharmZip(c *gc.C) {
-	s.assertCannotUpload(c, "~charmers/precise/wordpress", invalidZip(), http.StatusBadRequest, params.ErrInvalidEntity, "cannot read charm archive: zip: not a valid zip file")
+	s.assertCannotUpload(c, "~charmers/precise/wordpress", invalidZip(), http.StatusBadRequest, params.ErrBadRequest, "archive is not a zip file")
 }
 
 func (s *ArchiveSuite) TestPostInvalidBundleZip(c *gc.C) {
-	s.assertCannotUpload(c, "~charmers/bundle/wordpress", invalidZip(), http.StatusBadRequest, params.ErrInvalidEntity, "cannot read bundle archive: zip: not a valid zip file")
+	s.assertCannotUpload(c, "~charmers/bundle/wordpress", invalidZip(), http.StatusBadRequest, params.ErrBadRequest, "archive is not a zip file")
+}
+
+func (s *ArchiveSuite) TestPostUnsupportedContentType(c *gc.C) {
+	ch := storetesting.Charms.CharmArchive(c.MkDir(), "wordpress")
+	data, err := ioutil.ReadFile(ch.Path)
+	c.Assert(err, gc.Equals, nil)
+	hash, size := hashOf(bytes.NewReader(data))
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:       s.srv,
+		URL:           storeURL("~charmers/precise/wordpress/archive?hash=" + hash),
+		Method:        "POST",
+		ContentLength: size,
+		Header: http.Header{
+			"Content-Type": {"text/plain"},
+		},
+		Body:         bytes.NewReader(data),
+		Username:     testUsername,
+		Password:     testPassword,
+		ExpectStatus: http.StatusBadRequest,
+		ExpectBody: params.Error{
+			Code:    params.ErrBadRequest,
+			Message: `unsupported content type "text/plain"`,
+		},
+	})
+	// Nothing has been stored.
+	_, err = s.store.FindEntity(newResolvedURL("cs:~charmers/precise/wordpress-0", -1), nil)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *ArchiveSuite) TestPostSniffsContentType(c *gc.C) {
+	ch := storetesting.Charms.CharmArchive(c.MkDir(), "wordpress")
+	data, err := ioutil.ReadFile(ch.Path)
+	c.Assert(err, gc.Equals, nil)
+	hash, size := hashOf(bytes.NewReader(data))
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:       s.srv,
+		URL:           storeURL("~charmers/precise/wordpress/archive?hash=" + hash),
+		Method:        "POST",
+		ContentLength: size,
+		Header: http.Header{
+			"Content-Type": {"application/octet-stream"},
+		},
+		Body:     bytes.NewReader(data),
+		Username: testUsername,
+		Password: testPassword,
+		ExpectBody: params.ArchiveUploadResponse{
+			Id: charm.MustParseURL("~charmers/precise/wordpress-0"),
+		},
+	})
 }
 
 var postInvalidCharmMetadataTests = []struct {
@@ -1164,6 +2009,94 @@ func (s *ArchiveSuite) TestArchiveFileGet(c *gc.C) {
 	s.assertArchiveFileContents(c, zipFile, "~charmers/utopic/all-hooks-0/archive/hooks/install")
 }
 
+func (s *ArchiveSuite) TestBundleWithCharms(c *gc.C) {
+	id, _ := s.addPublicBundleFromRepo(c, "wordpress-simple", newResolvedURL("cs:~charmers/bundle/wordpress-simple-0", 0), true)
+
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL("bundle/wordpress-simple-0/archive/bundle-with-charms"),
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.Bytes()))
+	c.Assert(rec.Header().Get("Content-Type"), gc.Equals, "application/zip")
+	c.Assert(rec.Header().Get("Content-Disposition"), gc.Equals, "attachment; filename=wordpress-simple-with-charms.zip")
+	assertCacheControl(c, rec.Header(), true)
+
+	s.assertBundleWithCharmsContents(c, rec.Body.Bytes(), map[string]*router.ResolvedURL{
+		"bundle.zip":                    id,
+		"charms/trusty/wordpress-0.zip": newResolvedURL("cs:~charmers/trusty/wordpress-0", 0),
+		"charms/trusty/mysql-0.zip":     newResolvedURL("cs:~charmers/trusty/mysql-0", 0),
+	})
+}
+
+func (s *ArchiveSuite) TestBundleWithCharmsUnauthorizedCharm(c *gc.C) {
+	id, _ := s.addPublicBundleFromRepo(c, "wordpress-simple", newResolvedURL("cs:~charmers/bundle/wordpress-simple-0", 0), true)
+	err := s.store.SetPerms(charm.MustParseURL("cs:~charmers/mysql"), "stable.read", "no-one")
+	c.Assert(err, gc.Equals, nil)
+	s.idmServer.SetDefaultUser("bob")
+
+	// By default, the whole request fails.
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL("bundle/wordpress-simple-0/archive/bundle-with-charms"),
+		Do:      bakeryDo(nil),
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusUnauthorized, gc.Commentf("body: %s", rec.Body.Bytes()))
+	var perr params.Error
+	err = json.Unmarshal(rec.Body.Bytes(), &perr)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(perr.Code, gc.Equals, params.ErrUnauthorized)
+	c.Assert(perr.Message, gc.Matches, `cannot get charm "cs:mysql": .*`)
+
+	// With on-missing=skip, the unauthorized charm is left out.
+	rec = httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL("bundle/wordpress-simple-0/archive/bundle-with-charms?on-missing=skip"),
+		Do:      bakeryDo(nil),
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.Bytes()))
+	assertCacheControl(c, rec.Header(), false)
+	s.assertBundleWithCharmsContents(c, rec.Body.Bytes(), map[string]*router.ResolvedURL{
+		"bundle.zip":                    id,
+		"charms/trusty/wordpress-0.zip": newResolvedURL("cs:~charmers/trusty/wordpress-0", 0),
+	})
+}
+
+func (s *ArchiveSuite) TestBundleWithCharmsInvalidOnMissing(c *gc.C) {
+	s.addPublicBundleFromRepo(c, "wordpress-simple", newResolvedURL("cs:~charmers/bundle/wordpress-simple-0", 0), true)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("bundle/wordpress-simple-0/archive/bundle-with-charms?on-missing=ignore"),
+		ExpectStatus: http.StatusBadRequest,
+		ExpectBody: params.Error{
+			Message: `invalid on-missing value "ignore"`,
+			Code:    params.ErrBadRequest,
+		},
+	})
+}
+
+// assertBundleWithCharmsContents checks that the given zip data holds
+// exactly the archives of the given entities, keyed by file name.
+func (s *ArchiveSuite) assertBundleWithCharmsContents(c *gc.C, data []byte, expect map[string]*router.ResolvedURL) {
+	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(r.File, gc.HasLen, len(expect))
+	for _, f := range r.File {
+		id, ok := expect[f.Name]
+		c.Assert(ok, gc.Equals, true, gc.Commentf("unexpected file %q", f.Name))
+		fr, err := f.Open()
+		c.Assert(err, gc.Equals, nil)
+		got, err := ioutil.ReadAll(fr)
+		fr.Close()
+		c.Assert(err, gc.Equals, nil)
+		blob, err := s.store.OpenBlob(id)
+		c.Assert(err, gc.Equals, nil)
+		want, err := ioutil.ReadAll(blob)
+		blob.Close()
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(got, gc.DeepEquals, want, gc.Commentf("file %q", f.Name))
+	}
+}
+
 // assertArchiveFileContents checks that the response returned by the
 // serveArchiveFile endpoint is correct for the given archive and URL path.
 func (s *ArchiveSuite) assertArchiveFileContents(c *gc.C, zipFile *zip.ReadCloser, path string) {
@@ -1257,6 +2190,31 @@ func (s *ArchiveSuite) TestDeleteSpecificCharm(c *gc.C) {
 	c.Assert(count, gc.Equals, 2)
 }
 
+func (s *ArchiveSuite) TestUploadAndDeleteAuditUser(c *gc.C) {
+	id0 := newResolvedURL("~charmers/utopic/mysql-0", -1)
+	id1 := newResolvedURL("~charmers/utopic/mysql-1", -1)
+	s.assertUploadCharm(c, "PUT", id0, "mysql", nil)
+	s.assertUploadCharm(c, "PUT", id1, "mysql", nil)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		URL:      storeURL(id0.URL.Path() + "/archive"),
+		Method:   "DELETE",
+		Username: testUsername,
+		Password: testPassword,
+	})
+
+	// The entries record the authenticated user, not the owner
+	// of the entity.
+	entries, err := s.store.EntityAuditHistory(charm.MustParseURL("~charmers/utopic/mysql"), 0)
+	c.Assert(err, gc.Equals, nil)
+	var ops []audit.Operation
+	for _, e := range entries {
+		c.Assert(e.User, gc.Equals, "admin")
+		ops = append(ops, e.Op)
+	}
+	c.Assert(ops, jc.DeepEquals, []audit.Operation{audit.OpDelete, audit.OpUpload, audit.OpUpload})
+}
+
 func (s *ArchiveSuite) TestDeleteNotFound(c *gc.C) {
 	// Try to delete a non existing charm using the API.
 	s.doAsUser("charmers", func() {
@@ -0,0 +1,154 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5 // import "gopkg.in/juju/charmstore.v5/internal/v5"
+
+import (
+	"archive/zip"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/juju/charmstore.v5/internal/charmstore"
+	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5/internal/monitoring"
+	"gopkg.in/juju/charmstore.v5/internal/router"
+)
+
+// archiveTreeCacheMaxAge holds the maximum length of time that the
+// tree of an archive is cached for. Archives never change once
+// uploaded, so this only bounds the memory used by the cache.
+const archiveTreeCacheMaxAge = time.Hour
+
+// ArchiveTreeEntry holds a file or directory in the response to a GET
+// id/meta/archive-tree request.
+type ArchiveTreeEntry struct {
+	// Name holds the name of the file or directory within its
+	// parent directory. It is empty for the root of the archive.
+	Name string
+
+	// Size holds the size of a file, or the total size of all the
+	// files within a directory.
+	Size int64
+
+	// Dir holds whether the entry is a directory.
+	Dir bool `json:",omitempty"`
+
+	// Children holds the entries within a directory, ordered by
+	// name.
+	Children []*ArchiveTreeEntry `json:",omitempty"`
+}
+
+// newArchiveTree returns the root directory of a tree holding
+// the given archive files.
+func newArchiveTree(files []*zip.File) *ArchiveTreeEntry {
+	root := &ArchiveTreeEntry{
+		Dir: true,
+	}
+	for _, file := range files {
+		name := strings.Trim(path.Clean("/"+file.Name), "/")
+		if name == "" {
+			continue
+		}
+		fileInfo := file.FileInfo()
+		dir := root
+		elems := strings.Split(name, "/")
+		for _, elem := range elems[:len(elems)-1] {
+			dir = dir.child(elem, true)
+		}
+		entry := dir.child(elems[len(elems)-1], fileInfo.IsDir())
+		if !fileInfo.IsDir() {
+			entry.Size = fileInfo.Size()
+		}
+	}
+	root.finish()
+	return root
+}
+
+// child returns the child of e with the given name,
+// creating it if it does not exist.
+func (e *ArchiveTreeEntry) child(name string, dir bool) *ArchiveTreeEntry {
+	for _, c := range e.Children {
+		if c.Name == name {
+			return c
+		}
+	}
+	c := &ArchiveTreeEntry{
+		Name: name,
+		Dir:  dir,
+	}
+	e.Children = append(e.Children, c)
+	return c
+}
+
+// finish sorts the children of each directory in the
+// tree rooted at e and calculates the directory sizes.
+func (e *ArchiveTreeEntry) finish() {
+	if !e.Dir {
+		return
+	}
+	e.Size = 0
+	for _, c := range e.Children {
+		c.finish()
+		e.Size += c.Size
+	}
+	sort.Slice(e.Children, func(i, j int) bool {
+		return e.Children[i].Name < e.Children[j].Name
+	})
+}
+
+// lookup returns the entry with the given slash-separated
+// path relative to e, or nil if there is none.
+func (e *ArchiveTreeEntry) lookup(p string) *ArchiveTreeEntry {
+	p = strings.Trim(path.Clean("/"+p), "/")
+	if p == "" {
+		return e
+	}
+	for _, elem := range strings.Split(p, "/") {
+		var next *ArchiveTreeEntry
+		for _, c := range e.Children {
+			if c.Name == elem {
+				next = c
+				break
+			}
+		}
+		if next == nil {
+			return nil
+		}
+		e = next
+	}
+	return e
+}
+
+// GET id/meta/archive-tree[?path=path]
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#get-idmetaarchive-tree
+func (h *ReqHandler) metaArchiveTree(entity *mongodoc.Entity, id *router.ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
+	mon := monitoring.NewMetaDuration("archive-tree")
+	defer mon.Done()
+	tree, err := h.Handler.archiveTreeCache.Get(entity.BlobHash, func() (interface{}, error) {
+		r, size, err := h.Store.BlobStore.Open(entity.BlobHash, nil)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot open archive data for %s", id)
+		}
+		defer r.Close()
+		zipReader, err := zip.NewReader(charmstore.ReaderAtSeeker(r), size)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot read archive data for %s", id)
+		}
+		return newArchiveTree(zipReader.File), nil
+	})
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	entry := tree.(*ArchiveTreeEntry).lookup(flags.Get("path"))
+	if entry == nil {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "%q not found in archive", flags.Get("path"))
+	}
+	return entry, nil
+}
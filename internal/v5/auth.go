@@ -130,6 +130,21 @@ func (h *ReqHandler) authenticateAdmin(req *http.Request) error {
 	return nil
 }
 
+// POST admin/flush-group-cache
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#post-adminflush-group-cache
+func (h *ReqHandler) serveAdminFlushGroupCache(w http.ResponseWriter, req *http.Request) error {
+	if err := h.authenticateAdmin(req); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	if req.Method != "POST" {
+		return errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s method not allowed", req.Method)
+	}
+	if h.Handler.idmClient != nil {
+		h.Handler.idmClient.CacheEvictAll()
+	}
+	return nil
+}
+
 // authorizeParams holds parameters for an Authorize request.
 type authorizeParams struct {
 	// req holds the client HTTP request.
@@ -355,6 +370,9 @@ var errActiveTimeExpired = errgo.New("active time expired")
 // valued authorization is returned. It also checks any first party
 // caveats. It does not check ACLs.
 func (h *ReqHandler) checkRequest(p authorizeParams) (Authorization, error) {
+	if token, ok := parseBearerToken(p.req); ok {
+		return h.checkAPIToken(token, p.ops)
+	}
 	user, passwd, err := parseCredentials(p.req)
 	if err == nil {
 		if user != h.Handler.config.AuthUsername || passwd != h.Handler.config.AuthPassword {
@@ -633,6 +651,46 @@ func parseCredentials(req *http.Request) (username, password string, err error)
 	return tokens[0], tokens[1], nil
 }
 
+// parseBearerToken returns the API token from a bearer
+// Authorization header in the given request and reports whether
+// such a header was found.
+func parseBearerToken(req *http.Request) (token string, ok bool) {
+	parts := strings.Fields(req.Header.Get("Authorization"))
+	if len(parts) != 2 || parts[0] != "Bearer" {
+		return "", false
+	}
+	return parts[1], true
+}
+
+// checkAPIToken returns the authorization for the user
+// authenticated by the given API token. API tokens cannot
+// be used to perform operations that require terms to
+// be agreed to.
+func (h *ReqHandler) checkAPIToken(token string, ops []string) (Authorization, error) {
+	for _, op := range ops {
+		if op == OpReadWithTerms {
+			return Authorization{}, errgo.WithCausef(nil, params.ErrUnauthorized, "API token cannot be used to agree to terms")
+		}
+	}
+	if h.Handler.idmClient == nil {
+		return Authorization{}, errgo.WithCausef(nil, params.ErrUnauthorized, "API token authentication not available")
+	}
+	username, err := h.Store.AuthenticateToken(token)
+	if err != nil {
+		return Authorization{}, errgo.Mask(err, errgo.Is(params.ErrUnauthorized))
+	}
+	ident, err := h.Handler.idmClient.DeclaredIdentity(map[string]string{
+		"username": username,
+	})
+	if err != nil {
+		return Authorization{}, errgo.Notef(err, "cannot infer identity")
+	}
+	return Authorization{
+		User:     ident.(*idmclient.User),
+		Username: username,
+	}, nil
+}
+
 const condActiveTimeBefore = "active-time-before"
 
 // activeTimeBeforeCaveat returns a caveat that will be satisfied
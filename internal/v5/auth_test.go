@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"strings"
@@ -25,6 +26,7 @@ import (
 	"gopkg.in/macaroon.v2-unstable"
 
 	"gopkg.in/juju/charmstore.v5/internal/charm"
+	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
 	"gopkg.in/juju/charmstore.v5/internal/storetesting"
 	v5 "gopkg.in/juju/charmstore.v5/internal/v5"
 )
@@ -774,6 +776,167 @@ func (s *authSuite) TestUploadEntityAuthorization(c *gc.C) {
 	}
 }
 
+func (s *authSuite) TestReserveName(c *gc.C) {
+	s.idmServer.AddUser("bob", "group1")
+	s.idmServer.AddUser("alice", "group1")
+	s.idmServer.AddUser("kirk", "group2")
+	upload := func(username string) *httptest.ResponseRecorder {
+		body, hash, size := archiveInfo(c, "wordpress")
+		defer body.Close()
+		return httptesting.DoRequest(c, httptesting.DoRequestParams{
+			Handler:       s.srv,
+			Do:            bakeryDo(s.idmServer.Client(username)),
+			URL:           storeURL("~group1/utopic/django/archive?hash=" + hash),
+			Method:        "POST",
+			ContentLength: size,
+			Header: http.Header{
+				"Content-Type": {"application/zip"},
+			},
+			Body: body,
+		})
+	}
+
+	// A user outside the group cannot reserve the name.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		Do:           bakeryDo(s.idmServer.Client("kirk")),
+		URL:          storeURL("~group1/django/reserve"),
+		Method:       "PUT",
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody: params.Error{
+			Code:    params.ErrUnauthorized,
+			Message: `access denied for user "kirk"`,
+		},
+	})
+
+	// A member of the group can reserve the name for themselves.
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		Do:      bakeryDo(s.idmServer.Client("bob")),
+		URL:     storeURL("~group1/django/reserve"),
+		Method:  "PUT",
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body))
+
+	// The name cannot be reserved again.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		Do:           bakeryDo(s.idmServer.Client("alice")),
+		URL:          storeURL("~group1/django/reserve"),
+		Method:       "PUT",
+		ExpectStatus: http.StatusForbidden,
+		ExpectBody: params.Error{
+			Code:    params.ErrForbidden,
+			Message: `name cs:~group1/django is already in use`,
+		},
+	})
+
+	// Other members of the group can no longer upload to it.
+	rec = upload("alice")
+	c.Assert(rec.Code, gc.Equals, http.StatusUnauthorized, gc.Commentf("body: %s", rec.Body))
+	c.Assert(rec.Body.String(), jc.JSONEquals, params.Error{
+		Code:    params.ErrUnauthorized,
+		Message: `access denied for user "alice"`,
+	})
+
+	// The user it was reserved for can.
+	rec = upload("bob")
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body))
+}
+
+func (s *authSuite) TestReserveNameForAnotherUser(c *gc.C) {
+	s.idmServer.AddUser("bob", "group1")
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		Do:           bakeryDo(s.idmServer.Client("bob")),
+		URL:          storeURL("~group1/django/reserve?user=alice"),
+		Method:       "PUT",
+		ExpectStatus: http.StatusForbidden,
+		ExpectBody: params.Error{
+			Code:    params.ErrForbidden,
+			Message: `cannot reserve name for another user`,
+		},
+	})
+
+	// An admin can reserve a name for any user.
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler:  s.srv,
+		URL:      storeURL("~group1/django/reserve?user=alice"),
+		Method:   "PUT",
+		Username: testUsername,
+		Password: testPassword,
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body))
+	baseEntity, err := s.store.FindBaseEntity(charm.MustParseURL("~group1/django"), nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(baseEntity.ChannelACLs[params.UnpublishedChannel], jc.DeepEquals, mongodoc.ACL{
+		Read:  []string{"alice"},
+		Write: []string{"alice"},
+	})
+}
+
+type groupCacheSuite struct {
+	commonSuite
+}
+
+var _ = gc.Suite(&groupCacheSuite{})
+
+func (s *groupCacheSuite) SetUpSuite(c *gc.C) {
+	s.enableIdentity = true
+	s.groupCacheMaxAge = time.Hour
+	s.commonSuite.SetUpSuite(c)
+}
+
+func (s *groupCacheSuite) TestGroupCache(c *gc.C) {
+	s.idmServer.AddUser("bob", "group1")
+	id := newResolvedURL("~group1/utopic/django-0", -1)
+	err := s.store.AddCharmWithArchive(id, storetesting.Charms.CharmDir("wordpress"))
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.SetPerms(&id.URL, "unpublished.read", "group1")
+	c.Assert(err, gc.Equals, nil)
+	client := s.idmServer.Client("bob")
+	getMeta := func() *httptest.ResponseRecorder {
+		return httptesting.DoRequest(c, httptesting.DoRequestParams{
+			Handler: s.srv,
+			Do:      bakeryDo(client),
+			URL:     storeURL("~group1/utopic/django-0/meta/id-name?channel=unpublished"),
+		})
+	}
+	rec := getMeta()
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body))
+
+	// Removing bob from the group has no effect while their groups
+	// are cached.
+	s.idmServer.RemoveUser("bob")
+	s.idmServer.AddUser("bob")
+	rec = getMeta()
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body))
+
+	// Flushing the cache forces their groups to be fetched again.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		URL:      storeURL("admin/flush-group-cache"),
+		Method:   "POST",
+		Username: testUsername,
+		Password: testPassword,
+	})
+	rec = getMeta()
+	c.Assert(rec.Code, gc.Equals, http.StatusUnauthorized, gc.Commentf("body: %s", rec.Body))
+}
+
+func (s *groupCacheSuite) TestFlushGroupCacheUnauthorized(c *gc.C) {
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.noMacaroonSrv,
+		URL:          storeURL("admin/flush-group-cache"),
+		Method:       "POST",
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody: params.Error{
+			Code:    params.ErrUnauthorized,
+			Message: "authentication failed: missing HTTP auth header",
+		},
+	})
+}
+
 type readSeekCloser interface {
 	io.ReadCloser
 	io.Seeker
@@ -1177,6 +1340,286 @@ func (s *authSuite) TestDelegatableMacaroonCannotBeUsedForWriting(c *gc.C) {
 	})
 }
 
+func (s *authSuite) TestAPIToken(c *gc.C) {
+	id := newResolvedURL("~charmers/utopic/wordpress-1", 1)
+	err := s.store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.SetPerms(&id.URL, "stable.read", "bob")
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.Publish(id, nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	s.idmServer.AddUser("bob")
+	s.idmServer.AddUser("alice")
+
+	bobToken, err := s.store.CreateAPIToken("bob", time.Now().Add(time.Hour))
+	c.Assert(err, gc.Equals, nil)
+	aliceToken, err := s.store.CreateAPIToken("alice", time.Now().Add(time.Hour))
+	c.Assert(err, gc.Equals, nil)
+	bearerHeader := func(token string) http.Header {
+		return http.Header{"Authorization": {"Bearer " + token}}
+	}
+
+	// The token authenticates bob, who can read the entity.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		URL:     storeURL("~charmers/utopic/wordpress-1/meta/id-name"),
+		Header:  bearerHeader(bobToken),
+		ExpectBody: params.IdNameResponse{
+			Name: "wordpress",
+		},
+	})
+
+	// Alice cannot read the entity.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("~charmers/utopic/wordpress-1/meta/id-name"),
+		Header:       bearerHeader(aliceToken),
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody: params.Error{
+			Code:    params.ErrUnauthorized,
+			Message: `access denied for user "alice"`,
+		},
+	})
+
+	// Bob cannot write to the entity.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		Method:       "PUT",
+		URL:          storeURL("~charmers/utopic/wordpress-1/meta/extra-info/foo"),
+		Header:       bearerHeader(bobToken),
+		JSONBody:     "bar",
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody: params.Error{
+			Code:    params.ErrUnauthorized,
+			Message: `access denied for user "bob"`,
+		},
+	})
+
+	// Once revoked, the token is no longer accepted.
+	err = s.store.RevokeAPIToken(bobToken)
+	c.Assert(err, gc.Equals, nil)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("~charmers/utopic/wordpress-1/meta/id-name"),
+		Header:       bearerHeader(bobToken),
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody: params.Error{
+			Code:    params.ErrUnauthorized,
+			Message: "invalid API token",
+		},
+	})
+}
+
+func (s *authSuite) TestWhoAmIWithAPIToken(c *gc.C) {
+	s.idmServer.AddUser("bob", "charmers", "testers")
+	token, err := s.store.CreateAPIToken("bob", time.Now().Add(time.Hour))
+	c.Assert(err, gc.Equals, nil)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		URL:     storeURL("whoami"),
+		Header:  http.Header{"Authorization": {"Bearer " + token}},
+		ExpectBody: params.WhoAmIResponse{
+			User:   "bob",
+			Groups: []string{"charmers", "testers"},
+		},
+	})
+}
+
+func (s *authSuite) TestExpiredAPIToken(c *gc.C) {
+	id := newResolvedURL("~charmers/utopic/wordpress-1", 1)
+	err := s.store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.SetPerms(&id.URL, "stable.read", "bob")
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.Publish(id, nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+
+	token, err := s.store.CreateAPIToken("bob", time.Now().Add(-time.Minute))
+	c.Assert(err, gc.Equals, nil)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("~charmers/utopic/wordpress-1/meta/id-name"),
+		Header:       http.Header{"Authorization": {"Bearer " + token}},
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody: params.Error{
+			Code:    params.ErrUnauthorized,
+			Message: "API token has expired",
+		},
+	})
+}
+
+func (s *authSuite) TestAdminAPITokens(c *gc.C) {
+	s.idmServer.AddUser("bob")
+	var resp v5.CreateAPITokenResponse
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		Method:   "POST",
+		URL:      storeURL("admin/api-tokens"),
+		Username: testUsername,
+		Password: testPassword,
+		JSONBody: v5.CreateAPITokenRequest{
+			User:    "bob",
+			Expires: time.Now().Add(time.Hour),
+		},
+		ExpectBody: httptesting.BodyAsserter(func(c *gc.C, m json.RawMessage) {
+			err := json.Unmarshal(m, &resp)
+			c.Assert(err, gc.Equals, nil)
+		}),
+	})
+	c.Assert(resp.Token, gc.Not(gc.Equals), "")
+	user, err := s.store.AuthenticateToken(resp.Token)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(user, gc.Equals, "bob")
+
+	// Revoke the single token.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		Method:   "DELETE",
+		URL:      storeURL("admin/api-tokens"),
+		Username: testUsername,
+		Password: testPassword,
+		JSONBody: v5.RevokeAPITokensRequest{
+			Token: resp.Token,
+		},
+	})
+	_, err = s.store.AuthenticateToken(resp.Token)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrUnauthorized)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		Method:   "DELETE",
+		URL:      storeURL("admin/api-tokens"),
+		Username: testUsername,
+		Password: testPassword,
+		JSONBody: v5.RevokeAPITokensRequest{
+			Token: resp.Token,
+		},
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody: params.Error{
+			Code:    params.ErrNotFound,
+			Message: "API token not found",
+		},
+	})
+
+	// Revoke all of a user's tokens.
+	token1, err := s.store.CreateAPIToken("bob", time.Now().Add(time.Hour))
+	c.Assert(err, gc.Equals, nil)
+	token2, err := s.store.CreateAPIToken("bob", time.Now().Add(time.Hour))
+	c.Assert(err, gc.Equals, nil)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		Method:   "DELETE",
+		URL:      storeURL("admin/api-tokens"),
+		Username: testUsername,
+		Password: testPassword,
+		JSONBody: v5.RevokeAPITokensRequest{
+			User: "bob",
+		},
+	})
+	for _, token := range []string{token1, token2} {
+		_, err = s.store.AuthenticateToken(token)
+		c.Assert(errgo.Cause(err), gc.Equals, params.ErrUnauthorized)
+	}
+}
+
+var adminAPITokensErrorTests = []struct {
+	about        string
+	method       string
+	body         interface{}
+	expectStatus int
+	expectBody   params.Error
+}{{
+	about:  "no user",
+	method: "POST",
+	body: v5.CreateAPITokenRequest{
+		Expires: time.Now().Add(time.Hour),
+	},
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: "user not specified",
+	},
+}, {
+	about:  "expiry in the past",
+	method: "POST",
+	body: v5.CreateAPITokenRequest{
+		User:    "bob",
+		Expires: time.Now().Add(-time.Hour),
+	},
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: "expiry time must be in the future",
+	},
+}, {
+	about:        "revoke with nothing specified",
+	method:       "DELETE",
+	body:         v5.RevokeAPITokensRequest{},
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: "token or user not specified",
+	},
+}, {
+	about:  "revoke with token and user",
+	method: "DELETE",
+	body: v5.RevokeAPITokensRequest{
+		Token: "foo",
+		User:  "bob",
+	},
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: "cannot specify both token and user",
+	},
+}, {
+	about:        "bad method",
+	method:       "PUT",
+	body:         v5.RevokeAPITokensRequest{},
+	expectStatus: http.StatusMethodNotAllowed,
+	expectBody: params.Error{
+		Code:    params.ErrMethodNotAllowed,
+		Message: "PUT method not allowed",
+	},
+}}
+
+func (s *authSuite) TestAdminAPITokensErrors(c *gc.C) {
+	for i, test := range adminAPITokensErrorTests {
+		c.Logf("test %d: %s", i, test.about)
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:      s.srv,
+			Method:       test.method,
+			URL:          storeURL("admin/api-tokens"),
+			Username:     testUsername,
+			Password:     testPassword,
+			JSONBody:     test.body,
+			ExpectStatus: test.expectStatus,
+			ExpectBody:   test.expectBody,
+		})
+	}
+}
+
+func (s *authSuite) TestAdminAPITokensRequiresAdmin(c *gc.C) {
+	s.idmServer.AddUser("bob")
+	token, err := s.store.CreateAPIToken("bob", time.Now().Add(time.Hour))
+	c.Assert(err, gc.Equals, nil)
+	// A user cannot use their own token to create more.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		Method:  "POST",
+		URL:     storeURL("admin/api-tokens"),
+		Header:  http.Header{"Authorization": {"Bearer " + token}},
+		JSONBody: v5.CreateAPITokenRequest{
+			User:    "bob",
+			Expires: time.Now().Add(time.Hour),
+		},
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody: params.Error{
+			Code:    params.ErrUnauthorized,
+			Message: `access denied for user "bob"`,
+		},
+	})
+}
+
 func (s *authSuite) TestRenewMacaroon(c *gc.C) {
 	m, err := macaroon.New([]byte("key"), []byte("id"), "somewhere")
 	c.Assert(err, gc.Equals, nil)
@@ -0,0 +1,49 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5 // import "gopkg.in/juju/charmstore.v5/internal/v5"
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/httprequest.v1"
+)
+
+// GET /admin/upload-blocklist
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#get-adminupload-blocklist
+//
+// PUT /admin/upload-blocklist
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#put-adminupload-blocklist
+func (h *ReqHandler) serveAdminUploadBlocklist(w http.ResponseWriter, req *http.Request) error {
+	if err := h.authenticateAdmin(req); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	switch req.Method {
+	case "GET":
+		patterns, err := h.Store.UploadBlocklist()
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if patterns == nil {
+			patterns = []string{}
+		}
+		return httprequest.WriteJSON(w, http.StatusOK, patterns)
+	case "PUT":
+		if ctype := req.Header.Get("Content-Type"); ctype != "application/json" {
+			return badRequestf(nil, "unexpected Content-Type %q; expected 'application/json'", ctype)
+		}
+		var patterns []string
+		if err := json.NewDecoder(req.Body).Decode(&patterns); err != nil {
+			return badRequestf(err, "cannot unmarshal body")
+		}
+		if err := h.Store.SetUploadBlocklist(patterns); err != nil {
+			return errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+		}
+		logger.Infof("upload blocklist set to %q", patterns)
+		return nil
+	}
+	return errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s method not allowed", req.Method)
+}
@@ -0,0 +1,105 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5_test
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	"github.com/juju/testing/httptesting"
+	gc "gopkg.in/check.v1"
+)
+
+type blocklistSuite struct {
+	commonSuite
+}
+
+var _ = gc.Suite(&blocklistSuite{})
+
+func (s *blocklistSuite) TestGetEmptyUploadBlocklist(c *gc.C) {
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:    s.srv,
+		URL:        storeURL("admin/upload-blocklist"),
+		Username:   testUsername,
+		Password:   testPassword,
+		ExpectBody: []string{},
+	})
+}
+
+func (s *blocklistSuite) TestSetUploadBlocklist(c *gc.C) {
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		URL:      storeURL("admin/upload-blocklist"),
+		Method:   "PUT",
+		Username: testUsername,
+		Password: testPassword,
+		JSONBody: []string{"bob/*", "*/microsoft-*"},
+	})
+	patterns, err := s.store.UploadBlocklist()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(patterns, gc.DeepEquals, []string{"bob/*", "*/microsoft-*"})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:    s.srv,
+		URL:        storeURL("admin/upload-blocklist"),
+		Username:   testUsername,
+		Password:   testPassword,
+		ExpectBody: []string{"bob/*", "*/microsoft-*"},
+	})
+}
+
+func (s *blocklistSuite) TestSetInvalidUploadBlocklist(c *gc.C) {
+	err := s.store.SetUploadBlocklist([]string{"bob/*"})
+	c.Assert(err, gc.Equals, nil)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("admin/upload-blocklist"),
+		Method:       "PUT",
+		Username:     testUsername,
+		Password:     testPassword,
+		JSONBody:     []string{"bob/[*"},
+		ExpectStatus: http.StatusBadRequest,
+		ExpectBody: params.Error{
+			Code:    params.ErrBadRequest,
+			Message: `invalid upload blocklist pattern "bob/[*"`,
+		},
+	})
+	// The existing blocklist is left unchanged.
+	patterns, err := s.store.UploadBlocklist()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(patterns, gc.DeepEquals, []string{"bob/*"})
+}
+
+func (s *blocklistSuite) TestSetUploadBlocklistBadContentType(c *gc.C) {
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		URL:      storeURL("admin/upload-blocklist"),
+		Method:   "PUT",
+		Username: testUsername,
+		Password: testPassword,
+		Header: http.Header{
+			"Content-Type": {"text/plain"},
+		},
+		Body:         strings.NewReader(`["bob/*"]`),
+		ExpectStatus: http.StatusBadRequest,
+		ExpectBody: params.Error{
+			Code:    params.ErrBadRequest,
+			Message: `unexpected Content-Type "text/plain"; expected 'application/json'`,
+		},
+	})
+}
+
+func (s *blocklistSuite) TestUploadBlocklistRequiresAdmin(c *gc.C) {
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("admin/upload-blocklist"),
+		Method:       "PUT",
+		JSONBody:     []string{"bob/*"},
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody: params.Error{
+			Code:    params.ErrUnauthorized,
+			Message: "authentication failed: missing HTTP auth header",
+		},
+	})
+}
@@ -103,6 +103,20 @@ type commonSuite struct {
 	// to config.MaxMgoSessions when calling charmstore.NewServer.
 	maxMgoSessions int
 
+	// groupCacheMaxAge specifies the value that will be given
+	// to config.GroupCacheMaxAge when calling charmstore.NewServer.
+	groupCacheMaxAge time.Duration
+
+	// approvalRequiredChannels specifies the value that will be given
+	// to config.ApprovalRequiredChannels when calling charmstore.NewServer.
+	approvalRequiredChannels []params.Channel
+
+	// maxMetaResponseEntities and maxMetaIncludes specify the values
+	// that will be given to config.MaxMetaResponseEntities and
+	// config.MaxMetaIncludes when calling charmstore.NewServer.
+	maxMetaResponseEntities int
+	maxMetaIncludes         int
+
 	swift *swift.Client
 	httpsuite.HTTPSuite
 	openstack     *openstackservice.Openstack
@@ -178,14 +192,18 @@ func (s *commonSuite) startServer(c *gc.C) {
 	s.swift.CreateContainer("testc", swift.Private)
 
 	config := charmstore.ServerParams{
-		AuthUsername:          testUsername,
-		AuthPassword:          testPassword,
-		StatsCacheMaxAge:      time.Nanosecond,
-		MaxMgoSessions:        s.maxMgoSessions,
-		MinUploadPartSize:     10,
-		NewBlobBackend:        s.newBlobBackend(c),
-		DockerRegistryAddress: "dockerregistry.example.com",
-		ReadOnly:              s.readOnly,
+		AuthUsername:             testUsername,
+		AuthPassword:             testPassword,
+		StatsCacheMaxAge:         time.Nanosecond,
+		MaxMgoSessions:           s.maxMgoSessions,
+		MinUploadPartSize:        10,
+		NewBlobBackend:           s.newBlobBackend(c),
+		DockerRegistryAddress:    "dockerregistry.example.com",
+		ReadOnly:                 s.readOnly,
+		GroupCacheMaxAge:         s.groupCacheMaxAge,
+		ApprovalRequiredChannels: s.approvalRequiredChannels,
+		MaxMetaResponseEntities:  s.maxMetaResponseEntities,
+		MaxMetaIncludes:          s.maxMetaIncludes,
 	}
 	keyring := httpbakery.NewPublicKeyRing(nil, nil)
 	keyring.AllowInsecure()
@@ -4,12 +4,10 @@
 package v5 // import "gopkg.in/juju/charmstore.v5/internal/v5"
 
 import (
-	"archive/zip"
 	"bytes"
 	"fmt"
 	"io"
 	"net/http"
-	"path"
 	"strings"
 
 	"github.com/juju/charmrepo/v6/csclient/params"
@@ -57,17 +55,6 @@ func (h *ReqHandler) serveDiagram(id *router.ResolvedURL, w http.ResponseWriter,
 	return nil
 }
 
-// These are all forms of README files
-// actually observed in charms in the wild.
-var allowedReadMe = map[string]bool{
-	"readme":          true,
-	"readme.md":       true,
-	"readme.rst":      true,
-	"readme.ex":       true,
-	"readme.markdown": true,
-	"readme.txt":      true,
-}
-
 // GET id/readme
 // https://github.com/juju/charmstore/blob/v4/docs/API.md#get-idreadme
 func (h *ReqHandler) serveReadMe(id *router.ResolvedURL, w http.ResponseWriter, req *http.Request) error {
@@ -75,13 +62,7 @@ func (h *ReqHandler) serveReadMe(id *router.ResolvedURL, w http.ResponseWriter,
 	if err != nil {
 		return errgo.NoteMask(err, "cannot get README", errgo.Is(params.ErrNotFound))
 	}
-	isReadMeFile := func(f *zip.File) bool {
-		name := strings.ToLower(path.Clean(f.Name))
-		// This is the same condition currently used by the GUI.
-		// TODO propagate likely content type from file extension.
-		return allowedReadMe[name]
-	}
-	r, err := h.Store.OpenCachedBlobFile(entity, mongodoc.FileReadMe, isReadMeFile)
+	r, err := h.Store.OpenCachedBlobFile(entity, mongodoc.FileReadMe, charmstore.IsReadMeFile)
 	if err != nil {
 		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
 	}
@@ -101,10 +82,7 @@ func (h *ReqHandler) serveIcon(id *router.ResolvedURL, w http.ResponseWriter, re
 	if err != nil {
 		return errgo.NoteMask(err, "cannot get icon", errgo.Is(params.ErrNotFound))
 	}
-	isIconFile := func(f *zip.File) bool {
-		return path.Clean(f.Name) == "icon.svg"
-	}
-	r, err := h.Store.OpenCachedBlobFile(entity, mongodoc.FileIcon, isIconFile)
+	r, err := h.Store.OpenCachedBlobFile(entity, mongodoc.FileIcon, charmstore.IsIconFile)
 	if err != nil {
 		logger.Errorf("cannot open icon.svg file for %v: %v", id, err)
 		if errgo.Cause(err) != params.ErrNotFound {
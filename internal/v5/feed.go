@@ -0,0 +1,88 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5 // import "gopkg.in/juju/charmstore.v5/internal/v5"
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/juju/charmstore.v5/internal/charm"
+	"gopkg.in/juju/charmstore.v5/internal/charmstore"
+	"gopkg.in/juju/charmstore.v5/internal/router"
+)
+
+const (
+	// defaultFeedLimit holds the number of entities returned
+	// by the feed/recent endpoint when no limit is specified.
+	defaultFeedLimit = 50
+
+	// maxFeedLimit holds the maximum number of entities that
+	// may be requested from the feed/recent endpoint.
+	maxFeedLimit = 500
+)
+
+// FeedItem holds an entity in the response to a GET feed/recent
+// request.
+type FeedItem struct {
+	// Id holds the id of the published entity.
+	Id *charm.URL
+
+	// PromulgatedId holds the promulgated id of the entity, if
+	// it has one.
+	PromulgatedId *charm.URL `json:",omitempty"`
+
+	// PublishTime holds the time the entity was most recently
+	// published to the channel.
+	PublishTime time.Time
+
+	// Summary holds the summary from the charm's metadata. It is
+	// empty for bundles.
+	Summary string `json:",omitempty"`
+}
+
+// GET feed/recent[?channel=$channel][&limit=$count]
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#get-feedrecent
+func (h *ReqHandler) serveFeedRecent(_ http.Header, r *http.Request) (interface{}, error) {
+	channel := h.Store.Channel
+	if channel == params.UnpublishedChannel {
+		return nil, badRequestf(nil, "cannot list recently published entities in the %s channel", channel)
+	}
+	limit, err := intValue(r.Form.Get("limit"), 1, defaultFeedLimit)
+	if err != nil {
+		return nil, badRequestf(err, "invalid 'limit' value")
+	}
+	if limit > maxFeedLimit {
+		return nil, badRequestf(nil, "invalid 'limit' value: value must be <= %d", maxFeedLimit)
+	}
+	// Entities that aren't readable by the current user are omitted
+	// before the limit is applied.
+	published, err := h.Store.RecentlyPublished(channel, limit, func(id *router.ResolvedURL) bool {
+		return h.AuthorizeEntityForOp(id, r, OpReadWithNoTerms) == nil
+	})
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot get recently published entities")
+	}
+	items := []FeedItem{}
+	for _, p := range published {
+		item := FeedItem{
+			Id:          &p.Id.URL,
+			PublishTime: p.Time.UTC(),
+		}
+		if p.Id.PromulgatedRevision != -1 {
+			item.PromulgatedId = p.Id.PromulgatedURL()
+		}
+		if p.Id.URL.Series != "bundle" {
+			entity, err := h.Cache.Entity(&p.Id.URL, charmstore.FieldSelector("charmmeta"))
+			if err != nil {
+				return nil, errgo.Mask(err)
+			}
+			item.Summary = entity.CharmMeta.Summary
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
@@ -0,0 +1,170 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	jc "github.com/juju/testing/checkers"
+	"github.com/juju/testing/httptesting"
+	gc "gopkg.in/check.v1"
+
+	"gopkg.in/juju/charmstore.v5/internal/charm"
+	"gopkg.in/juju/charmstore.v5/internal/storetesting"
+	v5 "gopkg.in/juju/charmstore.v5/internal/v5"
+)
+
+type FeedSuite struct {
+	commonSuite
+}
+
+var _ = gc.Suite(&FeedSuite{})
+
+func (s *FeedSuite) SetUpTest(c *gc.C) {
+	s.enableIdentity = true
+	s.commonSuite.SetUpTest(c)
+}
+
+func (s *FeedSuite) TestFeedRecent(c *gc.C) {
+	// Publish times are held to the millisecond, so make sure
+	// that each publication happens at a different time.
+	_, wordpress := s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("~charmers/precise/wordpress-23", 23))
+	time.Sleep(2 * time.Millisecond)
+	_, mysql := s.addPublicCharmFromRepo(c, "mysql", newResolvedURL("~charmers/precise/mysql-5", 5))
+	time.Sleep(2 * time.Millisecond)
+	s.addPublicBundleFromRepo(c, "wordpress-simple", newResolvedURL("~charmers/bundle/wordpress-simple-1", -1), false)
+	time.Sleep(2 * time.Millisecond)
+
+	// A charm that only bob can read is not included for other
+	// users, and does not count towards the limit even though it
+	// was published most recently.
+	private := newResolvedURL("~bob/precise/riak-0", -1)
+	err := s.store.AddCharmWithArchive(private, storetesting.Charms.CharmDir("riak"))
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.SetPerms(&private.URL, "stable.read", "bob")
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.Publish(private, nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+
+	// A charm that has been uploaded but not published is not
+	// included.
+	err = s.store.AddCharmWithArchive(newResolvedURL("~charmers/precise/varnish-0", -1), storetesting.Charms.CharmDir("varnish"))
+	c.Assert(err, gc.Equals, nil)
+
+	// A charm only published to the edge channel is only
+	// included in the feed for that channel.
+	edge := newResolvedURL("~charmers/precise/category-0", -1)
+	category := storetesting.Charms.CharmDir("category")
+	err = s.store.AddCharmWithArchive(edge, category)
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.SetPerms(&edge.URL, "edge.read", params.Everyone)
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.Publish(edge, nil, params.EdgeChannel)
+	c.Assert(err, gc.Equals, nil)
+
+	tests := []struct {
+		about  string
+		query  string
+		expect []v5.FeedItem
+	}{{
+		about: "default channel",
+		expect: []v5.FeedItem{{
+			Id: charm.MustParseURL("~charmers/bundle/wordpress-simple-1"),
+		}, {
+			Id:            charm.MustParseURL("~charmers/precise/mysql-5"),
+			PromulgatedId: charm.MustParseURL("precise/mysql-5"),
+			Summary:       mysql.Meta().Summary,
+		}, {
+			Id:            charm.MustParseURL("~charmers/precise/wordpress-23"),
+			PromulgatedId: charm.MustParseURL("precise/wordpress-23"),
+			Summary:       wordpress.Meta().Summary,
+		}},
+	}, {
+		about: "with limit",
+		query: "?channel=stable&limit=2",
+		expect: []v5.FeedItem{{
+			Id: charm.MustParseURL("~charmers/bundle/wordpress-simple-1"),
+		}, {
+			Id:            charm.MustParseURL("~charmers/precise/mysql-5"),
+			PromulgatedId: charm.MustParseURL("precise/mysql-5"),
+			Summary:       mysql.Meta().Summary,
+		}},
+	}, {
+		about: "edge channel",
+		query: "?channel=edge",
+		expect: []v5.FeedItem{{
+			Id:      charm.MustParseURL("~charmers/precise/category-0"),
+			Summary: category.Meta().Summary,
+		}},
+	}, {
+		about:  "nothing published",
+		query:  "?channel=candidate",
+		expect: []v5.FeedItem{},
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: %s", i, test.about)
+		rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+			Handler: s.srv,
+			URL:     storeURL("feed/recent" + test.query),
+		})
+		c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.Bytes()))
+		var items []v5.FeedItem
+		err := json.Unmarshal(rec.Body.Bytes(), &items)
+		c.Assert(err, gc.Equals, nil)
+		for j := range items {
+			c.Assert(items[j].PublishTime.IsZero(), gc.Equals, false)
+			if j > 0 {
+				c.Assert(items[j].PublishTime.After(items[j-1].PublishTime), gc.Equals, false)
+			}
+			items[j].PublishTime = time.Time{}
+		}
+		c.Assert(items, jc.DeepEquals, test.expect)
+	}
+}
+
+var feedRecentErrorTests = []struct {
+	about        string
+	url          string
+	expectStatus int
+	expectBody   params.Error
+}{{
+	about:        "invalid limit",
+	url:          "feed/recent?limit=0",
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: "invalid 'limit' value: value must be >= 1",
+	},
+}, {
+	about:        "limit too large",
+	url:          "feed/recent?limit=501",
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: "invalid 'limit' value: value must be <= 500",
+	},
+}, {
+	about:        "unpublished channel",
+	url:          "feed/recent?channel=unpublished",
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: "cannot list recently published entities in the unpublished channel",
+	},
+}}
+
+func (s *FeedSuite) TestFeedRecentErrors(c *gc.C) {
+	for i, test := range feedRecentErrorTests {
+		c.Logf("test %d: %s", i, test.about)
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:      s.srv,
+			URL:          storeURL(test.url),
+			ExpectStatus: test.expectStatus,
+			ExpectBody:   test.expectBody,
+		})
+	}
+}
@@ -15,10 +15,13 @@ import (
 // We use http.FileServer under the covers because that
 // provides us with all the HTTP Content-Range goodness
 // that we'd like.
+// If modTime is non-zero, it is sent as the Last-Modified time
+// of the content and conditional requests are honoured.
 // TODO use http.ServeContent instead of this.
-func serveContent(w http.ResponseWriter, req *http.Request, length int64, content io.ReadSeeker) {
+func serveContent(w http.ResponseWriter, req *http.Request, length int64, content io.ReadSeeker, modTime time.Time) {
 	fs := &archiveFS{
 		length:     length,
+		modTime:    modTime,
 		ReadSeeker: content,
 	}
 	// Copy the request and mutate the path to pretend
@@ -29,13 +32,33 @@ func serveContent(w http.ResponseWriter, req *http.Request, length int64, conten
 	h.ServeHTTP(w, &nreq)
 }
 
+// notModified reports whether serveContent will respond to the given
+// request for content last modified at modTime with 304 Not Modified
+// because of its If-Modified-Since header.
+func notModified(req *http.Request, modTime time.Time) bool {
+	if modTime.IsZero() || req.Method != "GET" && req.Method != "HEAD" {
+		return false
+	}
+	ims := req.Header.Get("If-Modified-Since")
+	if ims == "" || req.Header.Get("If-None-Match") != "" {
+		return false
+	}
+	t, err := http.ParseTime(ims)
+	if err != nil {
+		return false
+	}
+	// The Last-Modified header has a resolution of one second.
+	return !modTime.Truncate(time.Second).After(t)
+}
+
 // archiveFS implements http.FileSystem to serve a single file.
 // http.FileSystem.Open returns an http.File; http.File.Stat returns an
 // os.FileInfo. We implement methods for all of those interfaces on the
 // same type, and return the same value for all the aforementioned
 // methods, since we only ever need one instance of any of them.
 type archiveFS struct {
-	length int64
+	length  int64
+	modTime time.Time
 	io.ReadSeeker
 }
 
@@ -81,7 +104,7 @@ func (fs *archiveFS) Mode() os.FileMode {
 
 // ModTime implements os.FileInfo.ModTime.
 func (fs *archiveFS) ModTime() time.Time {
-	return time.Time{}
+	return fs.modTime
 }
 
 // IsDir implements os.FileInfo.IsDir.
@@ -0,0 +1,105 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5 // import "gopkg.in/juju/charmstore.v5/internal/v5"
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/juju/charmstore.v5/internal/charm"
+	"gopkg.in/juju/charmstore.v5/internal/charmstore"
+	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5/internal/router"
+)
+
+// LXDProfileResponse holds the response to a
+// GET id/meta/lxd-profile request.
+type LXDProfileResponse struct {
+	// Description holds the description of the profile.
+	Description string `json:",omitempty"`
+
+	// Config holds the LXD configuration settings in the profile.
+	Config map[string]string `json:",omitempty"`
+
+	// Devices holds the LXD devices in the profile, keyed by
+	// device name.
+	Devices map[string]map[string]string `json:",omitempty"`
+
+	// DisallowedConfig holds the keys of any configuration
+	// settings that Juju will refuse to apply, in sorted order.
+	DisallowedConfig []string `json:",omitempty"`
+
+	// DisallowedDevices holds the names of any devices with
+	// types that Juju will refuse to apply, in sorted order.
+	DisallowedDevices []string `json:",omitempty"`
+}
+
+// lxdProfileDeviceTypes holds the device types that Juju allows in
+// an LXD profile.
+var lxdProfileDeviceTypes = map[string]bool{
+	"gpu":        true,
+	"unix-block": true,
+	"unix-char":  true,
+	"usb":        true,
+}
+
+// lxdProfileDisallowedConfigPrefixes holds the prefixes of the
+// configuration keys that Juju does not allow in an LXD profile.
+var lxdProfileDisallowedConfigPrefixes = []string{
+	"boot",
+	"limits",
+	"migration",
+}
+
+// GET id/meta/lxd-profile
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#get-idmetalxd-profile
+func (h *ReqHandler) metaLXDProfile(entity *mongodoc.Entity, id *router.ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
+	if entity.URL.Series == "bundle" {
+		return nil, nil
+	}
+	r, err := h.Store.OpenCachedBlobFile(entity, mongodoc.FileLXDProfile, charmstore.IsLXDProfileFile)
+	if err != nil {
+		if errgo.Cause(err) == params.ErrNotFound {
+			return nil, nil
+		}
+		return nil, errgo.Mask(err)
+	}
+	defer r.Close()
+	profile, err := charm.ReadLXDProfile(r)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot read LXD profile for %s", id)
+	}
+	return newLXDProfileResponse(profile), nil
+}
+
+// newLXDProfileResponse returns the response for the given profile,
+// flagging any configuration and devices that Juju will not apply.
+func newLXDProfileResponse(profile *charm.LXDProfile) *LXDProfileResponse {
+	resp := &LXDProfileResponse{
+		Description: profile.Description,
+		Config:      profile.Config,
+		Devices:     profile.Devices,
+	}
+	for key := range profile.Config {
+		for _, prefix := range lxdProfileDisallowedConfigPrefixes {
+			if strings.HasPrefix(key, prefix) {
+				resp.DisallowedConfig = append(resp.DisallowedConfig, key)
+				break
+			}
+		}
+	}
+	for name, device := range profile.Devices {
+		if devType, ok := device["type"]; ok && !lxdProfileDeviceTypes[devType] {
+			resp.DisallowedDevices = append(resp.DisallowedDevices, name)
+		}
+	}
+	sort.Strings(resp.DisallowedConfig)
+	sort.Strings(resp.DisallowedDevices)
+	return resp
+}
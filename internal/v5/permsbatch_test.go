@@ -0,0 +1,116 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5_test
+
+import (
+	"net/http"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	jc "github.com/juju/testing/checkers"
+	"github.com/juju/testing/httptesting"
+	gc "gopkg.in/check.v1"
+
+	"gopkg.in/juju/charmstore.v5/audit"
+	"gopkg.in/juju/charmstore.v5/internal/charm"
+	"gopkg.in/juju/charmstore.v5/internal/router"
+	"gopkg.in/juju/charmstore.v5/internal/storetesting"
+	v5 "gopkg.in/juju/charmstore.v5/internal/v5"
+)
+
+type permsBatchSuite struct {
+	commonSuite
+}
+
+var _ = gc.Suite(&permsBatchSuite{})
+
+func (s *permsBatchSuite) SetUpSuite(c *gc.C) {
+	s.enableIdentity = true
+	s.commonSuite.SetUpSuite(c)
+}
+
+func (s *permsBatchSuite) addCharms(c *gc.C) []*router.ResolvedURL {
+	s.idmServer.AddUser("bob", "charmers")
+	ids := []*router.ResolvedURL{
+		newResolvedURL("~charmers/precise/wordpress-0", -1),
+		newResolvedURL("~charmers/precise/mysql-0", -1),
+		newResolvedURL("~alice/precise/varnish-0", -1),
+	}
+	for _, id := range ids {
+		err := s.store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+		c.Assert(err, gc.Equals, nil)
+	}
+	return ids
+}
+
+func (s *permsBatchSuite) assertStableReaders(c *gc.C, id *router.ResolvedURL, readers []string) {
+	be, err := s.store.FindBaseEntity(&id.URL, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(be.ChannelACLs[params.StableChannel].Read, jc.DeepEquals, readers)
+}
+
+func (s *permsBatchSuite) TestPermsBatch(c *gc.C) {
+	ids := s.addCharms(c)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		Method:  "PUT",
+		URL:     storeURL("perms-batch"),
+		Do:      s.bakeryDoAsUser("bob"),
+		JSONBody: v5.PermsBatchRequest{
+			Ids: []*charm.URL{&ids[0].URL, &ids[1].URL},
+			Op:  "stable.read",
+			ACL: []string{params.Everyone},
+		},
+	})
+	s.assertStableReaders(c, ids[0], []string{params.Everyone})
+	s.assertStableReaders(c, ids[1], []string{params.Everyone})
+	s.assertStableReaders(c, ids[2], []string{"alice"})
+
+	// The authenticated user is recorded in the audit log.
+	entries, err := s.store.EntityAuditHistory(&ids[0].URL, 1)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entries, gc.HasLen, 1)
+	c.Assert(entries[0].Op, gc.Equals, audit.OpSetPerm)
+	c.Assert(entries[0].User, gc.Equals, "bob")
+}
+
+func (s *permsBatchSuite) TestPermsBatchUnauthorized(c *gc.C) {
+	ids := s.addCharms(c)
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		Method:  "PUT",
+		URL:     storeURL("perms-batch"),
+		Do:      s.bakeryDoAsUser("bob"),
+		JSONBody: v5.PermsBatchRequest{
+			Ids: []*charm.URL{&ids[0].URL, &ids[2].URL},
+			Op:  "stable.read",
+			ACL: []string{params.Everyone},
+		},
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusUnauthorized, gc.Commentf("body: %s", rec.Body.Bytes()))
+
+	// Nothing has changed, including the entity that bob
+	// is allowed to change.
+	s.assertStableReaders(c, ids[0], []string{"charmers"})
+	s.assertStableReaders(c, ids[2], []string{"alice"})
+}
+
+func (s *permsBatchSuite) TestPermsBatchInvalidOp(c *gc.C) {
+	ids := s.addCharms(c)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		Method:       "PUT",
+		URL:          storeURL("perms-batch"),
+		Do:           s.bakeryDoAsUser("bob"),
+		ExpectStatus: http.StatusBadRequest,
+		JSONBody: v5.PermsBatchRequest{
+			Ids: []*charm.URL{&ids[0].URL},
+			Op:  "nosuch.read",
+			ACL: []string{params.Everyone},
+		},
+		ExpectBody: params.Error{
+			Code:    params.ErrBadRequest,
+			Message: `invalid channel "nosuch"`,
+		},
+	})
+}
@@ -15,6 +15,7 @@ import (
 	"path"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/juju/charm/v8/resource"
 	"github.com/juju/charmrepo/v6/csclient/params"
@@ -23,6 +24,7 @@ import (
 	"gopkg.in/macaroon-bakery.v2-unstable/bakery/checkers"
 	macaroon "gopkg.in/macaroon.v2-unstable"
 
+	"gopkg.in/juju/charmstore.v5/internal/charm"
 	"gopkg.in/juju/charmstore.v5/internal/charmstore"
 	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
 	"gopkg.in/juju/charmstore.v5/internal/monitoring"
@@ -32,7 +34,11 @@ import (
 // POST id/resource/name
 // https://github.com/juju/charmstore/blob/v5/docs/API.md#post-idresourcesname
 //
+// HEAD id/resource/name
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#head-idresourcename
+//
 // GET  id/resource/name[/revision]
+// HEAD id/resource/name/revision
 // https://github.com/juju/charmstore/blob/v5/docs/API.md#get-idresourcesnamerevision
 func (h *ReqHandler) serveResources(id *router.ResolvedURL, w http.ResponseWriter, req *http.Request) error {
 	// Resources are "published" using "POST id/publish" so we don't
@@ -42,6 +48,15 @@ func (h *ReqHandler) serveResources(id *router.ResolvedURL, w http.ResponseWrite
 		return h.serveDeleteResource(id, w, req)
 	case "GET":
 		return h.serveDownloadResource(id, w, req)
+	case "HEAD":
+		// A HEAD request for a specific revision acts like a GET
+		// without the body; otherwise it checks whether an upload
+		// would be accepted.
+		rid, err := parseResourceId(strings.TrimPrefix(req.URL.Path, "/"))
+		if err == nil && rid.Revision != -1 {
+			return h.serveDownloadResource(id, w, req)
+		}
+		return h.serveCheckUploadResource(id, w, req)
 	case "POST", "PUT":
 		return h.serveUploadResource(id, w, req)
 	default:
@@ -116,7 +131,7 @@ func (h *ReqHandler) serveDownloadResourceFile(id *router.ResolvedURL, r *mongod
 
 	// TODO(rog) should we set connection=close here?
 	// See https://codereview.appspot.com/5958045
-	serveContent(w, req, blob.Size, blob)
+	serveContent(w, req, blob.Size, blob, time.Time{})
 	return nil
 }
 
@@ -166,6 +181,26 @@ func (h *ReqHandler) dockerAuthPassword(id *router.ResolvedURL, resourceName str
 	return base64.RawStdEncoding.EncodeToString(b), nil
 }
 
+// serveCheckUploadResource reports whether a subsequent upload of the
+// named resource would be accepted, so that clients can find out before
+// sending a potentially large body.
+func (h *ReqHandler) serveCheckUploadResource(id *router.ResolvedURL, w http.ResponseWriter, req *http.Request) error {
+	if err := h.AuthorizeEntityForOp(id, req, OpWrite); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	rid, err := parseResourceId(strings.TrimPrefix(req.URL.Path, "/"))
+	if err != nil {
+		return errgo.WithCausef(err, params.ErrNotFound, "")
+	}
+	if !validResourceName(rid.Name) {
+		return badRequestf(nil, "invalid resource name")
+	}
+	if err := h.Store.CanAddResource(id, rid.Name); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound), errgo.Is(params.ErrForbidden))
+	}
+	return nil
+}
+
 func (h *ReqHandler) serveUploadResource(id *router.ResolvedURL, w http.ResponseWriter, req *http.Request) error {
 	if id.URL.Series == "bundle" {
 		return errgo.WithCausef(nil, params.ErrForbidden, "cannot upload a resource to a bundle")
@@ -273,6 +308,42 @@ func (h *ReqHandler) serveDeleteResource(id *router.ResolvedURL, w http.Response
 	return errgo.Mask(h.Store.DeleteResource(id, rid), errgo.Is(params.ErrNotFound), errgo.Is(params.ErrForbidden))
 }
 
+// ResourceRef holds a reference to a charm resource revision,
+// as returned by the resources-by-hash endpoint.
+type ResourceRef struct {
+	Id       *charm.URL
+	Name     string
+	Revision int
+}
+
+// GET /resources-by-hash/hash
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#get-resources-by-hashhash
+func (h *ReqHandler) serveResourcesByHash(_ http.Header, req *http.Request) (interface{}, error) {
+	if err := h.authenticateAdmin(req); err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	if req.Method != "GET" {
+		return nil, errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s not allowed", req.Method)
+	}
+	hash := strings.TrimPrefix(req.URL.Path, "/")
+	if hash == "" || strings.Contains(hash, "/") {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "")
+	}
+	refs, err := h.Store.FindResourcesByHash(hash)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	resp := make([]ResourceRef, len(refs))
+	for i, ref := range refs {
+		resp[i] = ResourceRef{
+			Id:       ref.BaseURL,
+			Name:     ref.Name,
+			Revision: ref.Revision,
+		}
+	}
+	return resp, nil
+}
+
 // GET id/meta/resource
 // https://github.com/juju/charmstore/blob/v5/docs/API.md#get-idmetaresources
 func (h *ReqHandler) metaResources(entity *mongodoc.Entity, id *router.ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
@@ -285,6 +356,9 @@ func (h *ReqHandler) metaResources(entity *mongodoc.Entity, id *router.ResolvedU
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
+	if flags.Get("limit") != "" || flags.Get("after") != "" {
+		return h.metaResourcesPage(entity, id, ch, flags)
+	}
 	resources, err := h.Store.ListResources(id, ch)
 	if err != nil {
 		return nil, errgo.Mask(err)
@@ -300,6 +374,47 @@ func (h *ReqHandler) metaResources(entity *mongodoc.Entity, id *router.ResolvedU
 	return results, nil
 }
 
+// ResourcesPageResponse holds the response to a GET id/meta/resources
+// request that specifies the limit or after flags.
+type ResourcesPageResponse struct {
+	// Resources holds the page of resources.
+	Resources []params.Resource
+
+	// Next holds the value of the after flag that retrieves
+	// the next page. It is empty when there are no more
+	// resources.
+	Next string `json:",omitempty"`
+}
+
+// metaResourcesPage returns the page of resources for the given entity
+// selected by the limit and after flags.
+func (h *ReqHandler) metaResourcesPage(entity *mongodoc.Entity, id *router.ResolvedURL, ch params.Channel, flags url.Values) (interface{}, error) {
+	limit := 0
+	if limitStr := flags.Get("limit"); limitStr != "" {
+		var err error
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 {
+			return nil, badRequestf(nil, "invalid 'limit' value")
+		}
+	}
+	resources, next, err := h.Store.ListResourcesPage(id, ch, flags.Get("after"), limit)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	results := make([]params.Resource, len(resources))
+	for i, res := range resources {
+		result, err := fromResourceDoc(res, entity.CharmMeta.Resources)
+		if err != nil {
+			return nil, err
+		}
+		results[i] = *result
+	}
+	return &ResourcesPageResponse{
+		Resources: results,
+		Next:      next,
+	}, nil
+}
+
 // GET id/meta/resource/*name*[/*revision]
 // https://github.com/juju/charmstore/blob/v5/docs/API.md#get-idmetaresourcesnamerevision
 func (h *ReqHandler) metaResourcesSingle(entity *mongodoc.Entity, id *router.ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
@@ -322,6 +437,9 @@ func (h *ReqHandler) metaResourcesSingle0(entity *mongodoc.Entity, id *router.Re
 	if id.URL.Series == "bundle" {
 		return nil, nil
 	}
+	if _, ok := entity.CharmMeta.Resources[missingResourcesPath]; path == "/"+missingResourcesPath && !ok {
+		return h.metaResourcesMissing(id)
+	}
 	rid, err := parseResourceId(strings.TrimPrefix(path, "/"))
 	if err != nil {
 		return nil, errgo.WithCausef(err, params.ErrNotFound, "")
@@ -354,6 +472,101 @@ func (h *ReqHandler) metaResourcesSingle0(entity *mongodoc.Entity, id *router.Re
 	return result, nil
 }
 
+// missingResourcesPath holds the path within id/meta/resources that
+// lists the resources missing from a channel. A resource declared
+// with the same name takes precedence.
+const missingResourcesPath = "missing"
+
+// GET id/meta/resources/missing
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#get-idmetaresourcesmissing
+func (h *ReqHandler) metaResourcesMissing(id *router.ResolvedURL) (interface{}, error) {
+	ch, err := h.entityChannel(id)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	missing, err := h.Store.MissingResourcesForChannel(id, ch)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	return missing, nil
+}
+
+// ResourceDownloadURL holds the download URL of a single resource
+// revision, as returned by the meta/resources/download-urls endpoint.
+type ResourceDownloadURL struct {
+	// Revision holds the requested revision of the resource.
+	Revision int
+
+	// URL holds the URL that the resource revision can be
+	// downloaded from. It is empty when Error is set.
+	URL string `json:",omitempty"`
+
+	// Error holds the reason why no URL could be returned for the
+	// resource revision.
+	Error *params.Error `json:",omitempty"`
+}
+
+// POST id/meta/resources/download-urls
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#post-idmetaresourcesdownload-urls
+func (h *ReqHandler) serveResourceDownloadURLs(id *router.ResolvedURL, w http.ResponseWriter, req *http.Request) error {
+	// Although this is a POST request, it only reveals what a GET
+	// of the resources would, so it needs the same access.
+	if err := h.AuthorizeEntityForOp(id, req, OpReadWithNoTerms); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	var body struct {
+		Revisions map[string]int `httprequest:",body"`
+	}
+	if err := httprequest.Unmarshal(httprequest.Params{Request: req}, &body); err != nil {
+		return badRequestf(err, "cannot unmarshal resource revisions")
+	}
+	if len(body.Revisions) == 0 {
+		return badRequestf(nil, "no resource revisions specified")
+	}
+	entity, err := h.Cache.Entity(&id.URL, charmstore.FieldSelector("charmmeta"))
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	results := make(map[string]ResourceDownloadURL, len(body.Revisions))
+	for name, rev := range body.Revisions {
+		result := ResourceDownloadURL{
+			Revision: rev,
+		}
+		if err := h.checkResourceRevision(entity, id, name, rev); err != nil {
+			if errgo.Cause(err) != params.ErrNotFound {
+				return errgo.Mask(err)
+			}
+			result.Error = &params.Error{
+				Code:    params.ErrNotFound,
+				Message: err.Error(),
+			}
+		} else {
+			result.URL = fmt.Sprintf("%s/%s/resource/%s/%d", h.Handler.rootPath, id.URL.Path(), name, rev)
+		}
+		results[name] = result
+	}
+	return httprequest.WriteJSON(w, http.StatusOK, results)
+}
+
+// checkResourceRevision checks that the given revision of the named
+// resource of the given entity exists. If it does not, an error with a
+// params.ErrNotFound cause is returned.
+func (h *ReqHandler) checkResourceRevision(entity *mongodoc.Entity, id *router.ResolvedURL, name string, rev int) error {
+	if entity.CharmMeta == nil {
+		return errgo.WithCausef(nil, params.ErrNotFound, "%s has no resources", &id.URL)
+	}
+	if _, ok := entity.CharmMeta.Resources[name]; !ok {
+		return errgo.WithCausef(nil, params.ErrNotFound, "resource %q not found in charm", name)
+	}
+	if rev < 0 {
+		return errgo.WithCausef(nil, params.ErrNotFound, "invalid revision %d", rev)
+	}
+	if _, err := h.Store.ResolveResource(id, name, rev, params.UnpublishedChannel); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	return nil
+}
+
 func fromResourceDoc(doc *mongodoc.Resource, resources map[string]resource.Meta) (*params.Resource, error) {
 	meta, ok := resources[doc.Name]
 	if !ok {
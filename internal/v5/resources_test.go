@@ -18,10 +18,13 @@ import (
 	"github.com/juju/testing/httptesting"
 	gc "gopkg.in/check.v1"
 	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2/bson"
 
 	"gopkg.in/juju/charmstore.v5/internal/blobstore"
 	"gopkg.in/juju/charmstore.v5/internal/charm"
+	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
 	"gopkg.in/juju/charmstore.v5/internal/storetesting"
+	"gopkg.in/juju/charmstore.v5/internal/v5"
 )
 
 type ResourceSuite struct {
@@ -393,6 +396,72 @@ func (s *ResourceSuite) TestUploadResourceNotDeclaredInCharm(c *gc.C) {
 	})
 }
 
+func (s *ResourceSuite) TestHeadUploadResource(c *gc.C) {
+	id := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	s.addPublicCharm(c, storetesting.NewCharm(storetesting.MetaWithResources(nil, "someResource")), id)
+
+	resp := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		Method:  "HEAD",
+		URL:     storeURL(id.URL.Path() + "/resource/someResource"),
+		Do:      s.bakeryDoAsUser("charmers"),
+	})
+	c.Assert(resp.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %q", resp.Body.Bytes()))
+}
+
+func (s *ResourceSuite) TestHeadUploadResourceNotDeclaredInCharm(c *gc.C) {
+	id := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	s.addPublicCharm(c, storetesting.NewCharm(storetesting.MetaWithResources(nil, "someResource")), id)
+
+	resp := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		Method:  "HEAD",
+		URL:     storeURL(id.URL.Path() + "/resource/otherResource"),
+		Do:      s.bakeryDoAsUser("charmers"),
+	})
+	c.Assert(resp.Code, gc.Equals, http.StatusForbidden)
+}
+
+func (s *ResourceSuite) TestHeadUploadResourceUnauthorized(c *gc.C) {
+	id := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	s.addPublicCharm(c, storetesting.NewCharm(storetesting.MetaWithResources(nil, "someResource")), id)
+
+	resp := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		Method:  "HEAD",
+		URL:     storeURL(id.URL.Path() + "/resource/someResource"),
+		Do:      s.bakeryDoAsUser("bob"),
+	})
+	c.Assert(resp.Code, gc.Equals, http.StatusUnauthorized)
+}
+
+func (s *ResourceSuite) TestHeadResourceRevision(c *gc.C) {
+	id := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	s.addPublicCharm(c, storetesting.NewCharm(storetesting.MetaWithResources(nil, "someResource")), id)
+	content := "some content"
+	s.uploadResource(c, id, "someResource", content)
+
+	// A HEAD request for a specific revision acts like GET, so it
+	// needs only read access.
+	resp := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		Method:  "HEAD",
+		URL:     storeURL(id.URL.Path() + "/resource/someResource/0"),
+		Do:      s.bakeryDoAsUser("bob"),
+	})
+	c.Assert(resp.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %q", resp.Body.Bytes()))
+	c.Assert(resp.Header().Get(params.ContentHashHeader), gc.Equals, hashOfString(content))
+	c.Assert(resp.Body.Len(), gc.Equals, 0)
+
+	resp = httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		Method:  "HEAD",
+		URL:     storeURL(id.URL.Path() + "/resource/someResource/3"),
+		Do:      s.bakeryDoAsUser("bob"),
+	})
+	c.Assert(resp.Code, gc.Equals, http.StatusNotFound)
+}
+
 func (s *ResourceSuite) TestUploadResourceFilenameExtensionMismatch(c *gc.C) {
 	id := newResolvedURL("~charmers/precise/wordpress-0", -1)
 	s.addPublicCharm(c, storetesting.NewCharm(&charm.Meta{
@@ -872,6 +941,199 @@ func (s *ResourceSuite) TestMetaResources(c *gc.C) {
 	})
 }
 
+func (s *ResourceSuite) TestResourceDownloadURLs(c *gc.C) {
+	id := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	s.store.AddCharmWithArchive(id, storetesting.NewCharm(storetesting.MetaWithResources(nil, "resource1", "resource2", "resource3")))
+	s.uploadResource(c, id, "resource1", "resource1 content 0")
+	s.uploadResource(c, id, "resource1", "resource1 content 1")
+	s.uploadResource(c, id, "resource2", "resource2 content 0")
+
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		Method:  "POST",
+		URL:     storeURL(id.URL.Path() + "/meta/resources/download-urls"),
+		JSONBody: map[string]int{
+			"resource1": 1,
+			"resource2": 0,
+			"resource3": 0,
+			"resource4": 0,
+		},
+		Do: s.bakeryDoAsUser("charmers"),
+		ExpectBody: map[string]v5.ResourceDownloadURL{
+			"resource1": {
+				Revision: 1,
+				URL:      storeURL(id.URL.Path() + "/resource/resource1/1"),
+			},
+			"resource2": {
+				Revision: 0,
+				URL:      storeURL(id.URL.Path() + "/resource/resource2/0"),
+			},
+			"resource3": {
+				Revision: 0,
+				Error: &params.Error{
+					Code:    params.ErrNotFound,
+					Message: `cs:~charmers/precise/wordpress-0 has no "resource3/0" resource`,
+				},
+			},
+			"resource4": {
+				Revision: 0,
+				Error: &params.Error{
+					Code:    params.ErrNotFound,
+					Message: `resource "resource4" not found in charm`,
+				},
+			},
+		},
+	})
+
+	// The returned URL can be used to download the resource.
+	resp := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL(id.URL.Path() + "/resource/resource1/1"),
+		Do:      s.bakeryDoAsUser("charmers"),
+	})
+	c.Assert(resp.Code, gc.Equals, http.StatusOK)
+	c.Assert(resp.Body.String(), gc.Equals, "resource1 content 1")
+}
+
+func (s *ResourceSuite) TestResourceDownloadURLsUnauthorized(c *gc.C) {
+	id := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	s.store.AddCharmWithArchive(id, storetesting.NewCharm(storetesting.MetaWithResources(nil, "resource1")))
+	s.uploadResource(c, id, "resource1", "resource1 content")
+
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		Method:       "POST",
+		URL:          storeURL(id.URL.Path() + "/meta/resources/download-urls"),
+		JSONBody:     map[string]int{"resource1": 0},
+		Do:           s.bakeryDoAsUser("bob"),
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody: params.Error{
+			Code:    params.ErrUnauthorized,
+			Message: `access denied for user "bob"`,
+		},
+	})
+}
+
+func (s *ResourceSuite) TestResourceDownloadURLsReadOnlyUser(c *gc.C) {
+	id := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	s.addPublicCharm(c, storetesting.NewCharm(storetesting.MetaWithResources(nil, "resource1")), id)
+	s.uploadResource(c, id, "resource1", "resource1 content")
+
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		Method:   "POST",
+		URL:      storeURL(id.URL.Path() + "/meta/resources/download-urls"),
+		JSONBody: map[string]int{"resource1": 0},
+		Do:       s.bakeryDoAsUser("bob"),
+		ExpectBody: map[string]v5.ResourceDownloadURL{
+			"resource1": {
+				Revision: 0,
+				URL:      storeURL(id.URL.Path() + "/resource/resource1/0"),
+			},
+		},
+	})
+}
+
+func (s *ResourceSuite) TestResourceDownloadURLsNoRevisions(c *gc.C) {
+	id := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	s.addPublicCharm(c, storetesting.NewCharm(storetesting.MetaWithResources(nil, "resource1")), id)
+
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		Method:       "POST",
+		URL:          storeURL(id.URL.Path() + "/meta/resources/download-urls"),
+		JSONBody:     map[string]int{},
+		ExpectStatus: http.StatusBadRequest,
+		ExpectBody: params.Error{
+			Code:    params.ErrBadRequest,
+			Message: `no resource revisions specified`,
+		},
+	})
+}
+
+func (s *ResourceSuite) TestMetaResourcesPaged(c *gc.C) {
+	id := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	s.addPublicCharm(c, storetesting.NewCharm(storetesting.MetaWithResources(nil, "resource1", "resource2", "resource3")), id)
+	for i := 1; i <= 3; i++ {
+		s.uploadResource(c, id, "resource1", fmt.Sprintf("resource1 content %d", i))
+	}
+	err := s.store.Publish(id, map[string]int{
+		"resource1": 2,
+		"resource2": 0,
+		"resource3": 0,
+	}, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+
+	expect := []params.Resource{{
+		Name:        "resource1",
+		Type:        "file",
+		Path:        "resource1-file",
+		Description: "resource1 description",
+		Revision:    2,
+		Fingerprint: rawHash(hashOfString("resource1 content 2")),
+		Size:        int64(len("resource1 content 2")),
+	}, {
+		Name:        "resource2",
+		Type:        "file",
+		Path:        "resource2-file",
+		Description: "resource2 description",
+		Revision:    0,
+		Fingerprint: rawHash(hashOfString("resource2 content")),
+		Size:        int64(len("resource2 content")),
+	}, {
+		Name:        "resource3",
+		Type:        "file",
+		Path:        "resource3-file",
+		Description: "resource3 description",
+		Revision:    0,
+		Fingerprint: rawHash(hashOfString("resource3 content")),
+		Size:        int64(len("resource3 content")),
+	}}
+	for i, test := range []struct {
+		query      string
+		expectBody *v5.ResourcesPageResponse
+	}{{
+		query: "limit=2",
+		expectBody: &v5.ResourcesPageResponse{
+			Resources: expect[:2],
+			Next:      "resource2",
+		},
+	}, {
+		query: "limit=2&after=resource2",
+		expectBody: &v5.ResourcesPageResponse{
+			Resources: expect[2:],
+		},
+	}, {
+		query: "limit=2&after=resource3",
+		expectBody: &v5.ResourcesPageResponse{
+			Resources: []params.Resource{},
+		},
+	}, {
+		query: "after=resource1",
+		expectBody: &v5.ResourcesPageResponse{
+			Resources: expect[1:],
+		},
+	}} {
+		c.Logf("test %d: %s", i, test.query)
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:      s.srv,
+			URL:          storeURL(id.URL.Path() + "/meta/resources?" + test.query),
+			ExpectStatus: http.StatusOK,
+			ExpectBody:   test.expectBody,
+		})
+	}
+
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL(id.URL.Path() + "/meta/resources?limit=0"),
+		ExpectStatus: http.StatusBadRequest,
+		ExpectBody: params.Error{
+			Code:    params.ErrBadRequest,
+			Message: "invalid 'limit' value",
+		},
+	})
+}
+
 func (s *ResourceSuite) TestMetaResourcesWithBundle(c *gc.C) {
 	id := newResolvedURL("cs:~charmers/bundle/bundlelovin-10", 10)
 	s.addPublicBundleFromRepo(c, "wordpress-simple", id, true)
@@ -961,6 +1223,93 @@ func (s *ResourceSuite) TestMetaResourcesSingleResourceNotUploaded(c *gc.C) {
 	})
 }
 
+func (s *ResourceSuite) TestMetaResourcesMissing(c *gc.C) {
+	id := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	s.addPublicCharm(c, storetesting.NewCharm(storetesting.MetaWithResources(nil, "resource1", "resource2")), id)
+
+	// All resources are assigned in the stable channel.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:    s.srv,
+		URL:        storeURL(id.URL.Path() + "/meta/resources/missing"),
+		ExpectBody: []string{},
+	})
+
+	// Simulate a charm that was published to the stable
+	// channel before all its resources were required.
+	err := s.store.DB.BaseEntities().UpdateId(mongodoc.BaseURL(&id.URL), bson.D{{
+		"$set", bson.D{{
+			"channelresources.stable", []mongodoc.ResourceRevision{{
+				Name:     "resource1",
+				Revision: 0,
+			}},
+		}},
+	}})
+	c.Assert(err, gc.Equals, nil)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:    s.srv,
+		URL:        storeURL(id.URL.Path() + "/meta/resources/missing?channel=stable"),
+		ExpectBody: []string{"resource2"},
+	})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		URL:     storeURL(id.URL.Path() + "/meta/any?include=resources/missing"),
+		ExpectBody: params.MetaAnyResponse{
+			Id: id.PreferredURL(),
+			Meta: map[string]interface{}{
+				"resources/missing": []string{"resource2"},
+			},
+		},
+	})
+}
+
+func (s *ResourceSuite) TestMetaResourcesMissingNotUploaded(c *gc.C) {
+	id := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	meta := storetesting.MetaWithResources(nil, "resource1", "resource2")
+	err := s.store.AddCharmWithArchive(id, storetesting.NewCharm(meta))
+	c.Assert(err, gc.Equals, nil)
+	s.uploadResource(c, id, "resource2", "resource2 content")
+
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:    s.srv,
+		URL:        storeURL(id.URL.Path() + "/meta/resources/missing?channel=unpublished"),
+		ExpectBody: []string{"resource1"},
+		Do:         s.bakeryDoAsUser("charmers"),
+	})
+}
+
+func (s *ResourceSuite) TestMetaResourcesMissingWithResourceNamedMissing(c *gc.C) {
+	id := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	s.addPublicCharm(c, storetesting.NewCharm(storetesting.MetaWithResources(nil, "missing")), id)
+
+	// A declared resource takes precedence.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		URL:     storeURL(id.URL.Path() + "/meta/resources/missing"),
+		ExpectBody: params.Resource{
+			Name:        "missing",
+			Type:        "file",
+			Path:        "missing-file",
+			Description: "missing description",
+			Revision:    0,
+			Fingerprint: rawHash(hashOfString("missing content")),
+			Size:        int64(len("missing content")),
+		},
+	})
+}
+
+func (s *ResourceSuite) TestMetaResourcesMissingWithBundle(c *gc.C) {
+	id, _ := s.addPublicBundleFromRepo(c, "wordpress-simple", newResolvedURL("cs:~charmers/bundle/something-32", 32), true)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL(id.URL.Path() + "/meta/resources/missing"),
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody: params.Error{
+			Code:    params.ErrMetadataNotFound,
+			Message: string(params.ErrMetadataNotFound),
+		},
+	})
+}
+
 func (s *ResourceSuite) TestMetaResourcesSingleResourceWithRevision(c *gc.C) {
 	id := newResolvedURL("~charmers/precise/wordpress-0", -1)
 	meta := storetesting.MetaWithResources(nil, "someResource")
@@ -1190,3 +1539,43 @@ func (s *ResourceSuite) TestDeleteLastResource(c *gc.C) {
 		Do: s.bakeryDoAsUser("charmers"),
 	})
 }
+
+func (s *ResourceSuite) TestResourcesByHash(c *gc.C) {
+	meta := storetesting.MetaWithResources(nil, "someResource", "otherResource")
+	id1 := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	err := s.store.AddCharmWithArchive(id1, storetesting.NewCharm(meta))
+	c.Assert(err, gc.Equals, nil)
+	id2 := newResolvedURL("~bob/trusty/mysql-0", -1)
+	err = s.store.AddCharmWithArchive(id2, storetesting.NewCharm(meta))
+	c.Assert(err, gc.Equals, nil)
+
+	content := "some content"
+	s.uploadResource(c, id1, "someResource", content)
+	s.uploadResource(c, id2, "otherResource", content)
+	s.uploadResource(c, id2, "someResource", "other content")
+
+	s.AssertAuthOnAdminEndpoint(c, httptesting.JSONCallParams{
+		URL:          storeURL("resources-by-hash/" + hashOfString(content)),
+		ExpectStatus: http.StatusOK,
+		ExpectBody: []v5.ResourceRef{{
+			Id:       charm.MustParseURL("cs:~bob/mysql"),
+			Name:     "otherResource",
+			Revision: 0,
+		}, {
+			Id:       charm.MustParseURL("cs:~charmers/wordpress"),
+			Name:     "someResource",
+			Revision: 0,
+		}},
+	})
+}
+
+func (s *ResourceSuite) TestResourcesByHashNoMatch(c *gc.C) {
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("resources-by-hash/" + hashOfString("no such content")),
+		Username:     testUsername,
+		Password:     testPassword,
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   []v5.ResourceRef{},
+	})
+}
@@ -4,10 +4,13 @@
 package v5 // import "gopkg.in/juju/charmstore.v5/internal/v5"
 
 import (
+	"encoding/json"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/juju/charmrepo/v6/csclient/params"
+	"github.com/juju/version"
 	"golang.org/x/net/context"
 	"gopkg.in/errgo.v1"
 
@@ -30,17 +33,23 @@ func (h *ReqHandler) serveSearch(_ http.Header, req *http.Request) (interface{},
 		logger.Infof("authorization failed on search request, granting no privileges: %v", err)
 	}
 	sp.Admin = auth.Admin
-	if auth.User != nil {
-		sp.Groups = append(sp.Groups, auth.Username)
-		groups, err := auth.User.Groups()
-		if err != nil {
-			logger.Infof("cannot get groups for user %q, assuming no groups: %v", auth.Username, err)
-		}
-		sp.Groups = append(sp.Groups, groups...)
-	}
+	sp.Groups = append(sp.Groups, searchGroups(auth)...)
 	return h.Search(sp, req)
 }
 
+// searchGroups returns the ACL values, other than everyone, that
+// grant read access to search results for the given authorization.
+func searchGroups(auth Authorization) []string {
+	if auth.User == nil {
+		return nil
+	}
+	groups, err := auth.User.Groups()
+	if err != nil {
+		logger.Infof("cannot get groups for user %q, assuming no groups: %v", auth.Username, err)
+	}
+	return append([]string{auth.Username}, groups...)
+}
+
 // Search performs the search specified by SearchParams. If sp
 // specifies that additional metadata needs to be added to the results,
 // then it is added.
@@ -75,6 +84,133 @@ func (h *ReqHandler) serveSearchInteresting(w http.ResponseWriter, req *http.Req
 	router.WriteError(context.TODO(), w, errNotImplemented)
 }
 
+const (
+	// defaultSuggestLimit holds the number of names returned
+	// by the suggest endpoint when no limit is specified.
+	defaultSuggestLimit = 10
+
+	// maxSuggestLimit holds the maximum number of names
+	// that can be returned by the suggest endpoint.
+	maxSuggestLimit = 50
+)
+
+// SuggestResponse holds the response from the suggest endpoint.
+type SuggestResponse struct {
+	Names []string
+}
+
+// GET suggest?q=prefix[&limit=limit]
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#get-suggest
+func (h *ReqHandler) serveSuggest(_ http.Header, req *http.Request) (interface{}, error) {
+	switch channel := h.Store.Channel; channel {
+	case params.NoChannel, params.StableChannel:
+	default:
+		return nil, badRequestf(nil, "cannot suggest names in the %s channel", channel)
+	}
+	prefix := req.Form.Get("q")
+	if prefix == "" {
+		return nil, badRequestf(nil, "missing q parameter")
+	}
+	limit, err := intValue(req.Form.Get("limit"), 1, defaultSuggestLimit)
+	if err != nil {
+		return nil, badRequestf(err, "invalid 'limit' value")
+	}
+	if limit > maxSuggestLimit {
+		return nil, badRequestf(nil, "invalid 'limit' value: value must be <= %d", maxSuggestLimit)
+	}
+	auth, err := h.Authenticate(req)
+	if err != nil {
+		logger.Infof("authorization failed on suggest request, granting no privileges: %v", err)
+	}
+	names, err := h.Store.SearchSuggest(prefix, searchGroups(auth), limit)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if names == nil {
+		names = []string{}
+	}
+	return SuggestResponse{
+		Names: names,
+	}, nil
+}
+
+// GET admin/search-dump[?channel=channel]
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#get-adminsearch-dump
+func (h *ReqHandler) serveAdminSearchDump(w http.ResponseWriter, req *http.Request) error {
+	if err := h.authenticateAdmin(req); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	if req.Method != "GET" {
+		return errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s method not allowed", req.Method)
+	}
+	channel := h.Store.Channel
+	switch channel {
+	case params.NoChannel:
+		channel = params.StableChannel
+	case params.UnpublishedChannel:
+		return badRequestf(nil, "cannot dump search documents for the %s channel", channel)
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	encoder := json.NewEncoder(w)
+	err := h.Store.DumpSearch(channel, func(doc *charmstore.SearchDoc) error {
+		return encoder.Encode(doc)
+	})
+	if err != nil {
+		// The response may already have been partially sent, so
+		// we can only log the error.
+		logger.Errorf("cannot dump search documents: %v", err)
+	}
+	return nil
+}
+
+// POST admin/reindex
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#post-adminreindex
+func (h *ReqHandler) serveAdminReindex(_ http.Header, req *http.Request) (interface{}, error) {
+	if err := h.authenticateAdmin(req); err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	if req.Method != "POST" {
+		return nil, errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s method not allowed", req.Method)
+	}
+	if h.Store.ES == nil || h.Store.ES.Database == nil {
+		return nil, errgo.Newf("search index not configured")
+	}
+	id, err := h.Handler.Pool.StartReindex()
+	if err != nil {
+		return nil, errgo.NoteMask(err, "cannot start reindex", errgo.Is(router.ErrConflict))
+	}
+	return h.Handler.Pool.ReindexStatus(id)
+}
+
+// GET admin/reindex/job-id
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#get-adminreindexjob-id
+//
+// DELETE admin/reindex/job-id
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#delete-adminreindexjob-id
+func (h *ReqHandler) serveAdminReindexJob(_ http.Header, req *http.Request) (interface{}, error) {
+	if err := h.authenticateAdmin(req); err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	id := strings.TrimPrefix(req.URL.Path, "/")
+	if id == "" || strings.Contains(id, "/") {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "")
+	}
+	switch req.Method {
+	case "GET":
+		status, err := h.Handler.Pool.ReindexStatus(id)
+		if err != nil {
+			return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+		}
+		return status, nil
+	case "DELETE":
+		if err := h.Handler.Pool.CancelReindex(id); err != nil {
+			return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+		}
+		return h.Handler.Pool.ReindexStatus(id)
+	}
+	return nil, errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s method not allowed", req.Method)
+}
+
 // ParseSearchParms extracts the search paramaters from the request
 func ParseSearchParams(req *http.Request) (charmstore.SearchParams, error) {
 	sp := charmstore.SearchParams{}
@@ -103,15 +239,32 @@ func ParseSearchParams(req *http.Request) (charmstore.SearchParams, error) {
 					sp.Include = append(sp.Include, s)
 				}
 			}
-		case "description", "name", "owner", "provides", "requires", "series", "summary", "tags", "type":
+		case "assumes-feature", "description", "name", "owner", "provides", "requires", "series", "source", "summary", "tags", "terms", "type":
+			if sp.Filters == nil {
+				sp.Filters = make(map[string][]string)
+			}
+			sp.Filters[k] = v
+		case "min-juju-version", "max-juju-version":
+			for _, vers := range v {
+				if _, err := version.Parse(vers); err != nil {
+					return charmstore.SearchParams{}, badRequestf(err, "invalid %s parameter", k)
+				}
+			}
 			if sp.Filters == nil {
 				sp.Filters = make(map[string][]string)
 			}
 			sp.Filters[k] = v
 		case "promulgated":
-			promulgated, err := router.ParseBool(v[0])
-			if err != nil {
-				return charmstore.SearchParams{}, badRequestf(err, "invalid promulgated filter parameter")
+			var promulgated bool
+			switch v[0] {
+			case "true":
+				promulgated = true
+			case "false":
+			default:
+				promulgated, err = router.ParseBool(v[0])
+				if err != nil {
+					return charmstore.SearchParams{}, badRequestf(err, "invalid promulgated filter parameter")
+				}
 			}
 			if sp.Filters == nil {
 				sp.Filters = make(map[string][]string)
@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"net/url"
 	"sort"
+	"time"
 
 	"github.com/juju/charmrepo/v6/csclient/params"
 	"github.com/juju/loggo"
@@ -227,10 +228,70 @@ func (s *SearchSuite) TestParseSearchParams(c *gc.C) {
 				"promulgated": {"1"},
 			},
 		},
+	}, {
+		about: "promulgated filter - true",
+		query: "promulgated=true&autocomplete=0",
+		expectParams: charmstore.SearchParams{
+			Filters: map[string][]string{
+				"promulgated": {"1"},
+			},
+		},
+	}, {
+		about: "promulgated filter - false",
+		query: "promulgated=false&autocomplete=0",
+		expectParams: charmstore.SearchParams{
+			Filters: map[string][]string{
+				"promulgated": {"0"},
+			},
+		},
 	}, {
 		about:       "promulgated filter - bad",
 		query:       "promulgated=bad",
 		expectError: `invalid promulgated filter parameter: unexpected bool value "bad" \(must be "0" or "1"\)`,
+	}, {
+		about: "max-juju-version filter",
+		query: "max-juju-version=2.3.1&autocomplete=0",
+		expectParams: charmstore.SearchParams{
+			Filters: map[string][]string{
+				"max-juju-version": {"2.3.1"},
+			},
+		},
+	}, {
+		about: "assumes-feature filter",
+		query: "assumes-feature=juju>=3.0&autocomplete=0",
+		expectParams: charmstore.SearchParams{
+			Filters: map[string][]string{
+				"assumes-feature": {"juju>=3.0"},
+			},
+		},
+	}, {
+		about: "source filter",
+		query: "source=launchpad&autocomplete=0",
+		expectParams: charmstore.SearchParams{
+			Filters: map[string][]string{
+				"source": {"launchpad"},
+			},
+		},
+	}, {
+		about: "terms filter",
+		query: "terms=enterprise-terms/1&autocomplete=0",
+		expectParams: charmstore.SearchParams{
+			Filters: map[string][]string{
+				"terms": {"enterprise-terms/1"},
+			},
+		},
+	}, {
+		about:       "max-juju-version filter - bad",
+		query:       "max-juju-version=bad",
+		expectError: `invalid max-juju-version parameter: .*`,
+	}, {
+		about: "min-juju-version filter",
+		query: "min-juju-version=2.0-beta1&autocomplete=0",
+		expectParams: charmstore.SearchParams{
+			Filters: map[string][]string{
+				"min-juju-version": {"2.0-beta1"},
+			},
+		},
 	}}
 	for i, test := range tests {
 		c.Logf("test %d. %s", i, test.about)
@@ -472,6 +533,32 @@ func (s *SearchSuite) TestSuccessfulSearches(c *gc.C) {
 			},
 			false,
 		),
+	}, {
+		about: "promulgated true",
+		query: "promulgated=true",
+		results: storetesting.ResolvedURLs(
+			[]storetesting.SearchEntity{
+				storetesting.SearchEntities["multi-series"],
+				storetesting.SearchEntities["wordpress"],
+				storetesting.SearchEntities["mysql"],
+				storetesting.SearchEntities["wordpress-simple"],
+				storetesting.SearchEntities["squid-forwardproxy"],
+			},
+			false,
+		),
+	}, {
+		about: "promulgated with requires",
+		query: "promulgated=true&requires=mysql",
+		results: storetesting.ResolvedURLs(
+			[]storetesting.SearchEntity{
+				storetesting.SearchEntities["multi-series"],
+				storetesting.SearchEntities["wordpress"],
+			},
+			false,
+		),
+	}, {
+		about: "not promulgated with requires",
+		query: "promulgated=false&requires=mysql",
 	}, {
 		about: "promulgated with owner",
 		query: "promulgated=1&owner=openstack-charmers",
@@ -969,3 +1056,147 @@ func assertResultSet(c *gc.C, sr params.SearchResponse, expected []*router.Resol
 	sort.Strings(expect)
 	c.Assert(results, jc.DeepEquals, expect)
 }
+
+func (s *SearchSuite) TestAdminReindex(c *gc.C) {
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler:  s.srv,
+		Method:   "POST",
+		URL:      storeURL("admin/reindex"),
+		Username: testUsername,
+		Password: testPassword,
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.Bytes()))
+	var status charmstore.ReindexStatus
+	err := json.Unmarshal(rec.Body.Bytes(), &status)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(status.JobId, gc.Not(gc.Equals), "")
+	id := status.JobId
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !status.Finished && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+			Handler:  s.srv,
+			URL:      storeURL("admin/reindex/" + id),
+			Username: testUsername,
+			Password: testPassword,
+		})
+		c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.Bytes()))
+		status = charmstore.ReindexStatus{}
+		err := json.Unmarshal(rec.Body.Bytes(), &status)
+		c.Assert(err, gc.Equals, nil)
+	}
+	c.Assert(status.Finished, gc.Equals, true)
+	c.Assert(status.Error, gc.Equals, "")
+	c.Assert(status.JobId, gc.Equals, id)
+	c.Assert(status.Done, gc.Equals, status.Total)
+	c.Assert(status.Total, gc.Not(gc.Equals), 0)
+
+	// Cancelling a finished job has no effect.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		Method:       "DELETE",
+		URL:          storeURL("admin/reindex/" + id),
+		Username:     testUsername,
+		Password:     testPassword,
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   status,
+	})
+}
+
+func (s *SearchSuite) TestAdminReindexJobNotFound(c *gc.C) {
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		Method:       "DELETE",
+		URL:          storeURL("admin/reindex/no-such-job"),
+		Username:     testUsername,
+		Password:     testPassword,
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody: params.Error{
+			Code:    params.ErrNotFound,
+			Message: `reindex job "no-such-job" not found`,
+		},
+	})
+}
+
+func (s *SearchSuite) TestAdminReindexUnauthorized(c *gc.C) {
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.noMacaroonSrv,
+		Method:       "POST",
+		URL:          storeURL("admin/reindex"),
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody: params.Error{
+			Code:    params.ErrUnauthorized,
+			Message: "authentication failed: missing HTTP auth header",
+		},
+	})
+}
+
+func (s *SearchSuite) TestSuggest(c *gc.C) {
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		URL:     storeURL("suggest?q=mult"),
+		ExpectBody: v5.SuggestResponse{
+			Names: []string{"multi-series"},
+		},
+	})
+}
+
+func (s *SearchSuite) TestSuggestNotReadable(c *gc.C) {
+	// cs:riak is not visible to "everyone".
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		URL:     storeURL("suggest?q=ria"),
+		ExpectBody: v5.SuggestResponse{
+			Names: []string{},
+		},
+	})
+}
+
+func (s *SearchSuite) TestSuggestWithUserMacaroon(c *gc.C) {
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		URL:     storeURL("suggest?q=ria"),
+		Do:      bakeryDo(s.login("test-user")),
+		ExpectBody: v5.SuggestResponse{
+			Names: []string{"riak"},
+		},
+	})
+}
+
+var suggestErrorTests = []struct {
+	about         string
+	url           string
+	expectMessage string
+}{{
+	about:         "missing prefix",
+	url:           "suggest",
+	expectMessage: "missing q parameter",
+}, {
+	about:         "invalid limit",
+	url:           "suggest?q=word&limit=0",
+	expectMessage: "invalid 'limit' value: value must be >= 1",
+}, {
+	about:         "limit too large",
+	url:           "suggest?q=word&limit=51",
+	expectMessage: "invalid 'limit' value: value must be <= 50",
+}, {
+	about:         "unsupported channel",
+	url:           "suggest?q=word&channel=edge",
+	expectMessage: "cannot suggest names in the edge channel",
+}}
+
+func (s *SearchSuite) TestSuggestErrors(c *gc.C) {
+	for i, test := range suggestErrorTests {
+		c.Logf("test %d: %s", i, test.about)
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:      s.srv,
+			URL:          storeURL(test.url),
+			ExpectStatus: http.StatusBadRequest,
+			ExpectBody: params.Error{
+				Code:    params.ErrBadRequest,
+				Message: test.expectMessage,
+			},
+		})
+	}
+}
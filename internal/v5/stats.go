@@ -4,15 +4,20 @@
 package v5 // import "gopkg.in/juju/charmstore.v5/internal/v5"
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 
 	"github.com/juju/charmrepo/v6/csclient/params"
 	"gopkg.in/errgo.v1"
 
+	"gopkg.in/juju/charmstore.v5/internal/charmstore"
 	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5/internal/router"
 )
 
 const dateFormat = "2006-01-02"
@@ -39,6 +44,174 @@ func parseDateRange(form url.Values) (start, stop time.Time, err error) {
 	return
 }
 
+// parseStatsRange parses the start and end dates of the range of
+// downloads requested with id/meta/stats. If neither is specified,
+// inRange is false. A missing start date means the range begins at the
+// start of recorded time and a missing end date means the range ends
+// today.
+func parseStatsRange(flags url.Values) (start, end time.Time, inRange bool, err error) {
+	startStr, endStr := flags.Get("start"), flags.Get("end")
+	if startStr == "" && endStr == "" {
+		return time.Time{}, time.Time{}, false, nil
+	}
+	end = time.Now()
+	if startStr != "" {
+		start, err = time.Parse(dateFormat, startStr)
+		if err != nil {
+			return time.Time{}, time.Time{}, false, badRequestf(err, "invalid 'start' value %q", startStr)
+		}
+	}
+	if endStr != "" {
+		end, err = time.Parse(dateFormat, endStr)
+		if err != nil {
+			return time.Time{}, time.Time{}, false, badRequestf(err, "invalid 'end' value %q", endStr)
+		}
+	}
+	if startStr != "" && endStr != "" && end.Before(start) {
+		return time.Time{}, time.Time{}, false, badRequestf(nil, "'end' value %q is before 'start' value %q", endStr, startStr)
+	}
+	return start, end, true, nil
+}
+
+const (
+	// defaultTrendingLimit holds the number of charms returned
+	// by the trending endpoint when no limit is specified.
+	defaultTrendingLimit = 10
+
+	// maxTrendingLimit holds the maximum number of charms
+	// that may be requested from the trending endpoint.
+	maxTrendingLimit = 100
+
+	// defaultTrendingPeriod holds the window over which
+	// downloads are counted by the trending endpoint
+	// when no start date is specified.
+	defaultTrendingPeriod = 7 * 24 * time.Hour
+)
+
+// GET trending[?since=date][&limit=n][&include=meta[&include=meta...]]
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#get-trending
+func (h *ReqHandler) serveTrending(_ http.Header, r *http.Request) (interface{}, error) {
+	channel := h.Store.Channel
+	if channel == params.UnpublishedChannel {
+		return nil, badRequestf(nil, "cannot list trending charms in the %s channel", channel)
+	}
+	since := time.Now().Add(-defaultTrendingPeriod)
+	if v := r.Form.Get("since"); v != "" {
+		var err error
+		since, err = time.Parse(dateFormat, v)
+		if err != nil {
+			return nil, badRequestf(err, "invalid 'since' value %q", v)
+		}
+	}
+	limit, err := intValue(r.Form.Get("limit"), 1, defaultTrendingLimit)
+	if err != nil {
+		return nil, badRequestf(err, "invalid 'limit' value")
+	}
+	if limit > maxTrendingLimit {
+		return nil, badRequestf(nil, "invalid 'limit' value: value must be <= %d", maxTrendingLimit)
+	}
+	includes := r.Form["include"]
+	for _, inc := range includes {
+		if h.Router.MetaHandler(inc) == nil {
+			return nil, badRequestf(nil, "unrecognized metadata name %q", inc)
+		}
+	}
+	h.WillIncludeMetadata(includes)
+	// Charms that aren't readable by the current user are
+	// omitted before the limit is applied.
+	ids, err := h.Store.TopCharms(channel, since, limit, func(id *router.ResolvedURL) bool {
+		return h.AuthorizeEntityForOp(id, r, OpReadWithNoTerms) == nil
+	})
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot get trending charms")
+	}
+	results := []params.EntityResult{}
+	for _, id := range ids {
+		meta, err := h.Router.GetMetadata(id, includes, r)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot get metadata for %v", id)
+		}
+		results = append(results, params.EntityResult{
+			Id:   id.PreferredURL(),
+			Meta: meta,
+		})
+	}
+	return params.ListResponse{
+		Results: results,
+	}, nil
+}
+
+// defaultCharmMetricsLimit holds the number of charms included by the
+// admin/charm-metrics endpoint when ServerParams.CharmMetricsLimit is
+// zero.
+const defaultCharmMetricsLimit = 100
+
+// openMetricsLabelReplacer escapes label values in OpenMetrics output.
+var openMetricsLabelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// GET admin/charm-metrics[?channel=channel]
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#get-admincharm-metrics
+func (h *ReqHandler) serveAdminCharmMetrics(w http.ResponseWriter, req *http.Request) error {
+	if err := h.authenticateAdmin(req); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	if req.Method != "GET" {
+		return errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s method not allowed", req.Method)
+	}
+	channel := h.Store.Channel
+	switch channel {
+	case params.NoChannel:
+		channel = params.StableChannel
+	case params.UnpublishedChannel:
+		return badRequestf(nil, "cannot get charm metrics for the %s channel", channel)
+	}
+	limit := h.Handler.config.CharmMetricsLimit
+	if limit <= 0 {
+		limit = defaultCharmMetricsLimit
+	}
+	downloads, err := h.Store.TopCharmDownloads(channel, limit)
+	if err != nil {
+		return errgo.Notef(err, "cannot get charm downloads")
+	}
+	var buf bytes.Buffer
+	buf.WriteString("# TYPE charm_downloads counter\n")
+	buf.WriteString("# HELP charm_downloads Archive downloads of all revisions of a charm.\n")
+	for _, d := range downloads {
+		fmt.Fprintf(&buf, "charm_downloads_total{charm=\"%s\"} %d\n",
+			openMetricsLabelReplacer.Replace(d.URL.String()),
+			d.Count,
+		)
+	}
+	buf.WriteString("# EOF\n")
+	w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	w.Write(buf.Bytes())
+	return nil
+}
+
+// GET admin/download-counts?since=time
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#get-admindownload-counts
+func (h *ReqHandler) serveAdminDownloadCounts(_ http.Header, req *http.Request) (interface{}, error) {
+	if err := h.authenticateAdmin(req); err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	if req.Method != "GET" {
+		return nil, errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s method not allowed", req.Method)
+	}
+	s := req.Form.Get("since")
+	if s == "" {
+		return nil, badRequestf(nil, "since not specified")
+	}
+	since, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return nil, badRequestf(err, "invalid since value %q", s)
+	}
+	counts, err := h.Store.DownloadCountsSince(since)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot get download counts")
+	}
+	return counts, nil
+}
+
 // GET stats/counter/key[:key]...?[by=unit]&start=date][&stop=date][&list=1]
 // https://github.com/juju/charmstore/blob/v4/docs/API.md#get-statscounter
 func (h *ReqHandler) serveStatsCounter(_ http.Header, r *http.Request) (interface{}, error) {
@@ -106,3 +279,21 @@ func StatsEnabled(req *http.Request) bool {
 	req.ParseForm()
 	return req.Form.Get("stats") != "0"
 }
+
+// downloadClient returns the type of client that made the given archive
+// download request. The client parameter is used if it holds a valid
+// client type; otherwise the client is classified by its User-Agent
+// header.
+func downloadClient(req *http.Request) string {
+	if client := req.Form.Get("client"); charmstore.ValidClients[client] {
+		return client
+	}
+	ua := strings.ToLower(req.UserAgent())
+	switch {
+	case strings.Contains(ua, "juju"):
+		return charmstore.ClientJuju
+	case strings.HasPrefix(ua, "mozilla/"):
+		return charmstore.ClientBrowser
+	}
+	return charmstore.ClientOther
+}
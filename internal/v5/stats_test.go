@@ -13,6 +13,7 @@ import (
 
 	"gopkg.in/juju/charmstore.v5/internal/charm"
 	"gopkg.in/juju/charmstore.v5/internal/charmstore"
+	"gopkg.in/juju/charmstore.v5/internal/router"
 	"gopkg.in/juju/charmstore.v5/internal/storetesting"
 	v5 "gopkg.in/juju/charmstore.v5/internal/v5"
 )
@@ -217,6 +218,266 @@ func (s *StatsSuite) TestServerStatsUpdatePartOfStatsUpdateGroup(c *gc.C) {
 	})
 }
 
+func (s *StatsSuite) TestTrending(c *gc.C) {
+	now := time.Now()
+	addDownloads := func(id *router.ResolvedURL, n int) {
+		for i := 0; i < n; i++ {
+			err := s.store.IncrementDownloadCountsAtTime(id, now)
+			c.Assert(err, gc.Equals, nil)
+		}
+	}
+	wordpress, _ := s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("~charmers/precise/wordpress-0", 0))
+	addDownloads(wordpress, 3)
+	mysql, _ := s.addPublicCharmFromRepo(c, "mysql", newResolvedURL("~charmers/precise/mysql-0", 0))
+	addDownloads(mysql, 5)
+	varnish, _ := s.addPublicCharmFromRepo(c, "varnish", newResolvedURL("~bob/precise/varnish-0", -1))
+	addDownloads(varnish, 1)
+
+	// A charm that only bob can read is not included for
+	// other users.
+	private := newResolvedURL("~bob/precise/riak-0", -1)
+	err := s.store.AddCharmWithArchive(private, storetesting.Charms.CharmDir("riak"))
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.SetPerms(&private.URL, "stable.read", "bob")
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.Publish(private, nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	addDownloads(private, 10)
+
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		URL:     storeURL("trending"),
+		ExpectBody: params.ListResponse{
+			Results: []params.EntityResult{{
+				Id: charm.MustParseURL("precise/mysql-0"),
+			}, {
+				Id: charm.MustParseURL("precise/wordpress-0"),
+			}, {
+				Id: charm.MustParseURL("~bob/precise/varnish-0"),
+			}},
+		},
+	})
+
+	// The private charm, although the most downloaded, does not
+	// take up a place in the limit.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		URL:     storeURL("trending?limit=1&include=id-name"),
+		ExpectBody: params.ListResponse{
+			Results: []params.EntityResult{{
+				Id: charm.MustParseURL("precise/mysql-0"),
+				Meta: map[string]interface{}{
+					"id-name": params.IdNameResponse{Name: "mysql"},
+				},
+			}},
+		},
+	})
+
+	// Nothing has been published to the edge channel.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		URL:     storeURL("trending?channel=edge"),
+		ExpectBody: params.ListResponse{
+			Results: []params.EntityResult{},
+		},
+	})
+
+	// Downloads are only counted from the start of the given day.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		URL:     storeURL("trending?since=" + now.AddDate(0, 0, 1).UTC().Format("2006-01-02")),
+		ExpectBody: params.ListResponse{
+			Results: []params.EntityResult{},
+		},
+	})
+}
+
+var trendingErrorTests = []struct {
+	about        string
+	url          string
+	expectStatus int
+	expectBody   params.Error
+}{{
+	about:        "invalid since",
+	url:          "trending?since=yesterday",
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `invalid 'since' value "yesterday": parsing time "yesterday" as "2006-01-02": cannot parse "yesterday" as "2006"`,
+	},
+}, {
+	about:        "invalid limit",
+	url:          "trending?limit=0",
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: "invalid 'limit' value: value must be >= 1",
+	},
+}, {
+	about:        "limit too large",
+	url:          "trending?limit=101",
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: "invalid 'limit' value: value must be <= 100",
+	},
+}, {
+	about:        "unknown include",
+	url:          "trending?include=no-such",
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `unrecognized metadata name "no-such"`,
+	},
+}, {
+	about:        "unpublished channel",
+	url:          "trending?channel=unpublished",
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: "cannot list trending charms in the unpublished channel",
+	},
+}}
+
+func (s *StatsSuite) TestTrendingErrors(c *gc.C) {
+	for i, test := range trendingErrorTests {
+		c.Logf("test %d: %s", i, test.about)
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:      s.srv,
+			URL:          storeURL(test.url),
+			ExpectStatus: test.expectStatus,
+			ExpectBody:   test.expectBody,
+		})
+	}
+}
+
+func (s *StatsSuite) TestAdminCharmMetrics(c *gc.C) {
+	now := time.Now()
+	addDownloads := func(id *router.ResolvedURL, n int) {
+		for i := 0; i < n; i++ {
+			err := s.store.IncrementDownloadCountsAtTime(id, now)
+			c.Assert(err, gc.Equals, nil)
+		}
+	}
+	wordpress, _ := s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("~charmers/precise/wordpress-0", 0))
+	addDownloads(wordpress, 3)
+	mysql, _ := s.addPublicCharmFromRepo(c, "mysql", newResolvedURL("~charmers/precise/mysql-0", 0))
+	addDownloads(mysql, 5)
+
+	// A charm only published to the edge channel is only included
+	// in the metrics for that channel.
+	varnish := newResolvedURL("~bob/precise/varnish-0", -1)
+	err := s.store.AddCharmWithArchive(varnish, storetesting.Charms.CharmDir("varnish"))
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.Publish(varnish, nil, params.EdgeChannel)
+	c.Assert(err, gc.Equals, nil)
+	addDownloads(varnish, 1)
+
+	for i, test := range []struct {
+		query      string
+		expectBody string
+	}{{
+		expectBody: `# TYPE charm_downloads counter
+# HELP charm_downloads Archive downloads of all revisions of a charm.
+charm_downloads_total{charm="cs:~charmers/mysql"} 5
+charm_downloads_total{charm="cs:~charmers/wordpress"} 3
+# EOF
+`,
+	}, {
+		query: "?channel=edge",
+		expectBody: `# TYPE charm_downloads counter
+# HELP charm_downloads Archive downloads of all revisions of a charm.
+charm_downloads_total{charm="cs:~bob/varnish"} 1
+# EOF
+`,
+	}} {
+		c.Logf("test %d: %q", i, test.query)
+		rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+			Handler:  s.srv,
+			URL:      storeURL("admin/charm-metrics" + test.query),
+			Username: testUsername,
+			Password: testPassword,
+		})
+		c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.Bytes()))
+		c.Assert(rec.Header().Get("Content-Type"), gc.Equals, "application/openmetrics-text; version=1.0.0; charset=utf-8")
+		c.Assert(rec.Body.String(), gc.Equals, test.expectBody)
+	}
+}
+
+func (s *StatsSuite) TestAdminCharmMetricsUnauthorized(c *gc.C) {
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.noMacaroonSrv,
+		URL:          storeURL("admin/charm-metrics"),
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody: params.Error{
+			Code:    params.ErrUnauthorized,
+			Message: "authentication failed: missing HTTP auth header",
+		},
+	})
+}
+
+func (s *StatsSuite) TestAdminDownloadCounts(c *gc.C) {
+	t1 := time.Date(2016, 1, 1, 13, 0, 0, 0, time.UTC)
+	t2 := time.Date(2016, 1, 5, 13, 0, 0, 0, time.UTC)
+	addDownloads := func(id *router.ResolvedURL, t time.Time, n int) {
+		for i := 0; i < n; i++ {
+			err := s.store.IncrementDownloadCountsAtTime(id, t)
+			c.Assert(err, gc.Equals, nil)
+		}
+	}
+	wordpress, _ := s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("~charmers/precise/wordpress-0", 0))
+	mysql, _ := s.addPublicCharmFromRepo(c, "mysql", newResolvedURL("~charmers/precise/mysql-0", 0))
+	addDownloads(wordpress, t1, 3)
+	addDownloads(mysql, t1, 5)
+	addDownloads(wordpress, t2, 2)
+
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		URL:      storeURL("admin/download-counts?since=2016-01-01T00:00:00Z"),
+		Username: testUsername,
+		Password: testPassword,
+		ExpectBody: map[string]int64{
+			"cs:~charmers/precise/wordpress-0": 5,
+			"cs:~charmers/precise/mysql-0":     5,
+		},
+	})
+	// Downloads recorded before since are excluded.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		URL:      storeURL("admin/download-counts?since=2016-01-03T00:00:00Z"),
+		Username: testUsername,
+		Password: testPassword,
+		ExpectBody: map[string]int64{
+			"cs:~charmers/precise/wordpress-0": 2,
+		},
+	})
+}
+
+func (s *StatsSuite) TestAdminDownloadCountsBadRequest(c *gc.C) {
+	for i, test := range []struct {
+		query         string
+		expectMessage string
+	}{{
+		expectMessage: "since not specified",
+	}, {
+		query:         "?since=yesterday",
+		expectMessage: `invalid since value "yesterday": parsing time "yesterday" as "2006-01-02T15:04:05Z07:00": cannot parse "yesterday" as "2006"`,
+	}} {
+		c.Logf("test %d: %q", i, test.query)
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:      s.srv,
+			URL:          storeURL("admin/download-counts" + test.query),
+			Username:     testUsername,
+			Password:     testPassword,
+			ExpectStatus: http.StatusBadRequest,
+			ExpectBody: params.Error{
+				Code:    params.ErrBadRequest,
+				Message: test.expectMessage,
+			},
+		})
+	}
+}
+
 func (s *StatsSuite) TestStatsEnabled(c *gc.C) {
 	statsEnabled := func(url string) bool {
 		req, _ := http.NewRequest("GET", url, nil)
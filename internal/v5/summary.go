@@ -0,0 +1,43 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5 // import "gopkg.in/juju/charmstore.v5/internal/v5"
+
+import (
+	"net/http"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	"gopkg.in/errgo.v1"
+)
+
+// GET /admin/summary
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#get-adminsummary
+func (h *ReqHandler) serveAdminSummary(_ http.Header, req *http.Request) (interface{}, error) {
+	if err := h.authenticateAdmin(req); err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	if req.Method != "GET" {
+		return nil, errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s method not allowed", req.Method)
+	}
+	summary, err := h.Store.StoreSummary()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return summary, nil
+}
+
+// GET /admin/duplicate-blobs
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#get-adminduplicate-blobs
+func (h *ReqHandler) serveAdminDuplicateBlobs(_ http.Header, req *http.Request) (interface{}, error) {
+	if err := h.authenticateAdmin(req); err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	if req.Method != "GET" {
+		return nil, errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s method not allowed", req.Method)
+	}
+	groups, err := h.Store.DuplicateBlobReport()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return groups, nil
+}
@@ -0,0 +1,311 @@
+// Copyright 2020 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v5 // import "gopkg.in/juju/charmstore.v5/internal/v5"
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/charmrepo/v6/csclient/params"
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/juju/charmstore.v5/internal/blobstore"
+	"gopkg.in/juju/charmstore.v5/internal/charm"
+	"gopkg.in/juju/charmstore.v5/internal/router"
+)
+
+const (
+	// tusVersion holds the version of the tus resumable upload
+	// protocol implemented by the id/archive/tus endpoints.
+	// See https://tus.io/protocols/resumable-upload.html.
+	tusVersion = "1.0.0"
+
+	// tusContentType holds the content type required
+	// for the body of PATCH requests.
+	tusContentType = "application/offset+octet-stream"
+)
+
+// isTusRequest reports whether the given request to a path within
+// id/archive should be served by serveArchiveTus. GET and HEAD
+// requests without a Tus-Resumable header are left alone so that
+// any archive file named "tus" can still be retrieved.
+func isTusRequest(req *http.Request) bool {
+	if req.URL.Path != "/tus" && !strings.HasPrefix(req.URL.Path, "/tus/") {
+		return false
+	}
+	if req.Method == "GET" || req.Method == "HEAD" {
+		return req.Header.Get("Tus-Resumable") != ""
+	}
+	return true
+}
+
+// POST id/archive/tus
+// HEAD id/archive/tus/upload-id
+// PATCH id/archive/tus/upload-id
+// DELETE id/archive/tus/upload-id
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#post-idarchivetus
+func (h *ReqHandler) serveArchiveTus(id *charm.URL, w http.ResponseWriter, req *http.Request) error {
+	header := w.Header()
+	header.Set("Tus-Resumable", tusVersion)
+	if v := req.Header.Get("Tus-Resumable"); v != tusVersion {
+		header.Set("Tus-Version", tusVersion)
+		return errgo.WithCausef(nil, router.ErrPreconditionFailed, "unsupported tus version %q", v)
+	}
+	if id.Revision != -1 {
+		return badRequestf(nil, "revision specified, but should not be specified")
+	}
+	uploadId := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, "/tus"), "/")
+	if uploadId == "" {
+		if req.Method != "POST" {
+			return errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s not allowed", req.Method)
+		}
+		return h.serveTusCreate(id, w, req)
+	}
+	if strings.Contains(uploadId, "/") {
+		return errgo.WithCausef(nil, params.ErrNotFound, "")
+	}
+	info, err := h.tusUploadInfo(id, uploadId)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	switch req.Method {
+	case "HEAD":
+		header.Set("Cache-Control", "no-store")
+		offset, _ := tusOffset(info)
+		header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		header.Set("Upload-Length", strconv.FormatInt(info.Length, 10))
+		header.Set("Upload-Expires", info.Expires.UTC().Format(http.TimeFormat))
+		return nil
+	case "PATCH":
+		return h.serveTusPatch(id, uploadId, info, w, req)
+	case "DELETE":
+		if err := h.Store.BlobStore.RemoveUpload(uploadId); err != nil {
+			return errgo.Mask(err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	return errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s not allowed", req.Method)
+}
+
+// serveTusCreate serves a POST request to create a new tus upload.
+// The Upload-Length header must hold the size of the archive and the
+// Upload-Metadata header must hold its SHA384 hash with the key
+// "hash".
+func (h *ReqHandler) serveTusCreate(id *charm.URL, w http.ResponseWriter, req *http.Request) error {
+	lengthStr := req.Header.Get("Upload-Length")
+	if lengthStr == "" {
+		return badRequestf(nil, "Upload-Length not specified")
+	}
+	length, err := strconv.ParseInt(lengthStr, 10, 64)
+	if err != nil || length <= 0 {
+		return badRequestf(nil, "invalid Upload-Length %q", lengthStr)
+	}
+	bs := h.Store.BlobStore
+	if max := int64(bs.MaxParts) * (bs.MaxPartSize - 1); length > max {
+		return errgo.WithCausef(nil, router.ErrEntityTooLarge, "upload too large (maximum %d bytes)", max)
+	}
+	if max := h.Handler.config.MaxArchiveSize; max > 0 && length > max {
+		return errgo.WithCausef(nil, router.ErrEntityTooLarge, "upload too large (maximum %d bytes)", max)
+	}
+	metadata, err := parseTusMetadata(req.Header.Get("Upload-Metadata"))
+	if err != nil {
+		return badRequestf(err, "invalid Upload-Metadata")
+	}
+	hash := metadata["hash"]
+	if hash == "" {
+		return badRequestf(nil, "hash not specified in Upload-Metadata")
+	}
+	expires := time.Now().Add(defaultUploadExpiryDuration)
+	uploadId, err := bs.NewSizedUpload(expires, length, map[string]string{
+		"id":   id.String(),
+		"hash": hash,
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	header := w.Header()
+	header.Set("Location", h.Handler.rootPath+"/"+id.Path()+"/archive/tus/"+uploadId)
+	header.Set("Upload-Expires", expires.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+// serveTusPatch serves a PATCH request that appends data to the
+// upload with the given id and info. Each request is stored as a
+// single part of the underlying multipart upload, so all but the last
+// request must be at least as large as the minimum part size. When
+// the whole archive has been uploaded, it is added as a new revision
+// of id and the response holds a params.ArchiveUploadResponse.
+func (h *ReqHandler) serveTusPatch(id *charm.URL, uploadId string, info blobstore.UploadInfo, w http.ResponseWriter, req *http.Request) error {
+	if ct := req.Header.Get("Content-Type"); ct != tusContentType {
+		return errgo.WithCausef(nil, router.ErrUnsupportedMediaType, "unexpected content type %q", ct)
+	}
+	offsetStr := req.Header.Get("Upload-Offset")
+	if offsetStr == "" {
+		return badRequestf(nil, "Upload-Offset not specified")
+	}
+	offset, err := strconv.ParseInt(offsetStr, 10, 64)
+	if err != nil {
+		return badRequestf(nil, "invalid Upload-Offset %q", offsetStr)
+	}
+	current, part := tusOffset(info)
+	if offset != current {
+		return errgo.WithCausef(nil, router.ErrConflict, "Upload-Offset %d does not match current offset %d", offset, current)
+	}
+	if req.ContentLength == -1 {
+		return badRequestf(nil, "Content-Length not specified")
+	}
+	size := req.ContentLength
+	if offset+size > info.Length {
+		return badRequestf(nil, "data exceeds Upload-Length %d", info.Length)
+	}
+	bs := h.Store.BlobStore
+	if size > 0 {
+		if offset+size < info.Length && size < bs.MinPartSize {
+			return badRequestf(nil, "data too small (need at least %d bytes, got %d)", bs.MinPartSize, size)
+		}
+		if size >= bs.MaxPartSize {
+			return badRequestf(nil, "data too large (maximum %d bytes)", bs.MaxPartSize-1)
+		}
+		// We need the hash of the part before we can store it,
+		// so copy it to a temporary file first rather than
+		// holding a potentially large part in memory.
+		f, err := ioutil.TempFile("", "charmstore-tus")
+		if err != nil {
+			return errgo.Notef(err, "cannot create temporary file")
+		}
+		defer func() {
+			f.Close()
+			if err := os.Remove(f.Name()); err != nil {
+				logger.Warningf("cannot remove temporary file: %v", err)
+			}
+		}()
+		hasher := blobstore.NewHash()
+		n, err := io.Copy(io.MultiWriter(f, hasher), io.LimitReader(req.Body, size))
+		if err != nil {
+			return errgo.Notef(err, "cannot read request body")
+		}
+		if n != size {
+			return badRequestf(nil, "body too short (expected %d bytes, got %d)", size, n)
+		}
+		if _, err := f.Seek(0, 0); err != nil {
+			return errgo.Notef(err, "cannot seek in temporary file")
+		}
+		hash := fmt.Sprintf("%x", hasher.Sum(nil))
+		if err := bs.PutPart(uploadId, part, f, size, offset, hash); err != nil {
+			if errgo.Cause(err) == blobstore.ErrBadParams {
+				return errgo.WithCausef(err, params.ErrBadRequest, "")
+			}
+			return errgo.Mask(err)
+		}
+		offset += size
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	if offset < info.Length {
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	// The upload is complete; an empty PATCH request at the final
+	// offset retries this step if a previous attempt failed.
+	return h.finishTusUpload(id, uploadId, w, req)
+}
+
+// finishTusUpload adds the contents of the completed tus upload with
+// the given id as a new revision of id, checking that it has the hash
+// declared when the upload was created, and removes the upload.
+func (h *ReqHandler) finishTusUpload(id *charm.URL, uploadId string, w http.ResponseWriter, req *http.Request) error {
+	bs := h.Store.BlobStore
+	info, err := bs.UploadInfo(uploadId)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	parts := make([]blobstore.Part, len(info.Parts))
+	for i, p := range info.Parts {
+		parts[i] = blobstore.Part{
+			Hash: p.Hash,
+		}
+	}
+	idx, hash, err := bs.FinishUpload(uploadId, parts)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if hash != info.Metadata["hash"] {
+		if err := bs.RemoveUpload(uploadId); err != nil {
+			logger.Errorf("cannot remove upload %q: %v", uploadId, err)
+		}
+		return errgo.WithCausef(nil, params.ErrInvalidEntity, "hash mismatch: uploaded archive has hash %s", hash)
+	}
+	r, size, err := bs.Open(hash, idx)
+	if err != nil {
+		return errgo.Notef(err, "cannot open uploaded archive")
+	}
+	defer r.Close()
+	if err := h.postArchive(id, w, req, r, hash, size); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	if err := bs.RemoveUpload(uploadId); err != nil {
+		logger.Errorf("cannot remove upload %q: %v", uploadId, err)
+	}
+	return nil
+}
+
+// tusUploadInfo returns information on the tus upload with the given
+// id, which must have been created for the given entity id.
+func (h *ReqHandler) tusUploadInfo(id *charm.URL, uploadId string) (blobstore.UploadInfo, error) {
+	info, err := h.Store.BlobStore.UploadInfo(uploadId)
+	if errgo.Cause(err) == blobstore.ErrNotFound || err == nil && info.Metadata["id"] != id.String() {
+		return blobstore.UploadInfo{}, errgo.WithCausef(nil, params.ErrNotFound, "upload %q not found", uploadId)
+	}
+	if err != nil {
+		return blobstore.UploadInfo{}, errgo.Mask(err)
+	}
+	return info, nil
+}
+
+// tusOffset returns the number of bytes of the given upload that have
+// been stored contiguously from its start, and the number of parts
+// that hold them.
+func tusOffset(info blobstore.UploadInfo) (offset int64, nparts int) {
+	for _, p := range info.Parts {
+		if p == nil || !p.Complete {
+			break
+		}
+		offset += p.Size
+		nparts++
+	}
+	return offset, nparts
+}
+
+// parseTusMetadata parses the value of an Upload-Metadata header,
+// which holds comma-separated pairs of keys and base64-encoded values.
+func parseTusMetadata(s string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if s == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		fields := strings.Fields(pair)
+		switch len(fields) {
+		case 1:
+			metadata[fields[0]] = ""
+		case 2:
+			value, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				return nil, errgo.Notef(err, "invalid value for key %q", fields[0])
+			}
+			metadata[fields[0]] = string(value)
+		default:
+			return nil, errgo.Newf("invalid key-value pair %q", pair)
+		}
+	}
+	return metadata, nil
+}